@@ -2,7 +2,7 @@ import { useQuery } from "@tanstack/react-query";
 import { useState } from "react";
 import { Card, CardContent, CardHeader, CardTitle } from "@/components/ui/card";
 import { Tabs, TabsContent, TabsList, TabsTrigger } from "@/components/ui/tabs";
-import { TrafficData } from "@shared/schema";
+import { DashboardStats, Timeseries } from "@shared/schema";
 import {
   LineChart,
   Line,
@@ -23,8 +23,32 @@ import { ArrowDownUp, Database, CloudOff, Clock } from "lucide-react";
 export default function Analytics() {
   const [timeRange, setTimeRange] = useState<"hourly" | "daily" | "weekly">("hourly");
   
-  const { data: trafficData, isLoading } = useQuery<TrafficData[]>({
-    queryKey: ["/api/traffic"],
+  // Series range and step for each tab
+  const ranges = {
+    hourly: { since: "24h", step: "1h" },
+    daily: { since: "168h", step: "24h" },
+    weekly: { since: "672h", step: "168h" },
+  };
+  const { since, step } = ranges[timeRange];
+  const seriesUrl = (metric: string) =>
+    `/api/analytics/timeseries?metric=${metric}&since=${since}&step=${step}`;
+
+  const { data: requestSeries, isLoading } = useQuery<Timeseries>({
+    queryKey: [seriesUrl("rps")],
+  });
+  const { data: errorSeries } = useQuery<Timeseries>({
+    queryKey: [seriesUrl("errors")],
+  });
+
+  // Requests and errors per step, from the aligned series
+  const trafficData = requestSeries?.points.map((point, i) => ({
+    timestamp: point.time,
+    requests: Math.round((point.value ?? 0) * requestSeries.step),
+    errors: Math.round(errorSeries?.points[i]?.value ?? 0),
+  }));
+
+  const { data: stats } = useQuery<DashboardStats>({
+    queryKey: ["/api/stats"],
   });
 
   // Generate path distribution data (based on routes data)
@@ -45,15 +69,15 @@ export default function Analytics() {
     { name: "Authentication Failed", count: 45 },
   ];
 
-  // Generate latency distribution data
-  const latencyData = [
-    { range: "0-50ms", count: 1245 },
-    { range: "51-100ms", count: 986 },
-    { range: "101-200ms", count: 743 },
-    { range: "201-500ms", count: 532 },
-    { range: "501-1000ms", count: 321 },
-    { range: ">1000ms", count: 203 },
-  ];
+  // Latency distribution from the gateway's histogram buckets
+  const latency = stats?.latency;
+  const latencyData = (latency?.counts ?? []).map((count, i) => {
+    const bounds = latency?.bounds ?? [];
+    const range = i < bounds.length
+      ? `${i === 0 ? 0 : bounds[i - 1]}-${bounds[i]}ms`
+      : `>${bounds[bounds.length - 1]}ms`;
+    return { range, count };
+  });
 
   const COLORS = ["#3b82f6", "#10b981", "#f59e0b", "#ef4444", "#8b5cf6", "#ec4899"];
 
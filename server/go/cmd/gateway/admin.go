@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig configures access to the management interface
+type AdminConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"` // may be a secret reference
+	Port     int    `json:"port,omitempty"`     // serve the admin API and dashboard on a separate port
+	Prefix   string `json:"prefix,omitempty"`   // path the admin API is mounted at; defaults to /api
+	GRPC     bool   `json:"grpc,omitempty"`     // also serve the control plane over gRPC, on HTTP/2 without TLS
+}
+
+// prefix returns the normalized admin API prefix
+func (c AdminConfig) prefix() string {
+	prefix := strings.TrimRight(c.Prefix, "/")
+	if prefix == "" {
+		return apiPrefix
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+// checkAdminPrefix validates the configured admin API prefix
+func checkAdminPrefix(c AdminConfig, v *ValidationError) {
+	if c.Prefix == "" {
+		return
+	}
+	if c.Prefix == "/" || !strings.HasPrefix(c.Prefix, "/") {
+		v.add("admin.prefix", "must be a path below / such as /api or /_gateway")
+	} else if strings.ContainsAny(c.Prefix, "?#* ") || strings.Contains(c.Prefix, "//") {
+		v.add("admin.prefix", "%q is not a valid path", c.Prefix)
+	}
+}
+
+// adminSharesListener reports whether the admin API is served on the
+// proxy port
+func (c *Config) adminSharesListener() bool {
+	settings := c.settings()
+	port := settings.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return settings.Admin.Port == 0 || settings.Admin.Port == port
+}
+
+// checkReservedPaths reports a route that would shadow or be shadowed by
+// the admin API or dashboard on the proxy listener. Routes may sit beside
+// admin endpoints under the prefix, such as /api/users, but not claim the
+// prefix itself.
+func (c *Config) checkReservedPaths(route *Route, v *ValidationError) {
+	settings := c.settings()
+	if !c.adminSharesListener() {
+		return
+	}
+
+	prefix := settings.Admin.prefix()
+	path := strings.TrimRight(route.Path, "/")
+	if path == prefix {
+		v.add("path", "%s is reserved for the management interface", prefix)
+		return
+	}
+
+	reserved := adminPaths(prefix)
+	if settings.Dashboard.Enabled {
+		reserved = append(reserved, dashboardMountPath(settings.Dashboard))
+	}
+	if settings.Admin.GRPC {
+		reserved = append(reserved, grpcPath)
+	}
+	for _, p := range reserved {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			v.add("path", "%s is reserved for the management interface", p)
+			return
+		}
+	}
+}
+
+// adminAuthConfigured reports whether admin credentials have been set
+func (c AdminConfig) adminAuthConfigured() bool {
+	return c.Username != "" && c.Password != ""
+}
+
+// requireAdmin wraps a handler with HTTP basic authentication against the
+// admin credentials. Requests pass through when no credentials are set.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		admin := config.settings().Admin
+		if !admin.adminAuthConfigured() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected, err := resolveSecret(admin.Password)
+		if err != nil {
+			log.Printf("Admin password: %v", err)
+			writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Admin credentials are unavailable")
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		userMatch := subtle.ConstantTimeCompare([]byte(username), []byte(admin.Username)) == 1
+		passMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+		if !ok || !userMatch || !passMatch {
+			w.Header().Set("WWW-Authenticate", `Basic realm="API Gateway Admin"`)
+			writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
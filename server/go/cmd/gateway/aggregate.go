@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouteTypeAggregate fans a request out to several upstreams and merges the results
+const RouteTypeAggregate = "aggregate"
+
+// maxUpstreamJSONSize caps how much of each upstream response is decoded
+const maxUpstreamJSONSize = 10 << 20
+
+// AggregateConfig configures an aggregation route
+type AggregateConfig struct {
+	Calls []AggregateCall `json:"calls"`
+
+	// Template maps output fields (dotted for nesting) to "<call>.<path>"
+	// references. Without a template each call's response is returned
+	// under its name.
+	Template map[string]string `json:"template,omitempty"`
+}
+
+// AggregateCall is a single upstream request made by an aggregation route
+type AggregateCall struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	Method         string   `json:"method,omitempty"`
+	Required       bool     `json:"required,omitempty"`
+	ForwardQuery   bool     `json:"forwardQuery,omitempty"`
+	ForwardHeaders []string `json:"forwardHeaders,omitempty"`
+}
+
+// aggregateResult is the outcome of one upstream call
+type aggregateResult struct {
+	value interface{}
+	err   error
+}
+
+// serveAggregate calls every upstream in parallel and writes the merged response
+func serveAggregate(w http.ResponseWriter, r *http.Request, route Route, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Share the route's transport, with its egress proxy and timeouts
+	transport, err := proxy.transport(route)
+	if err != nil {
+		log.Printf("Aggregate %s: %v", route.Path, err)
+		writeError(w, r, http.StatusBadGateway, ErrCodeUpstreamFailed, "Upstream proxy is misconfigured")
+		return
+	}
+	client := &http.Client{Transport: transport}
+
+	calls := route.Aggregate.Calls
+	results := make([]aggregateResult, len(calls))
+
+	var wg sync.WaitGroup
+	for i, call := range calls {
+		wg.Add(1)
+		go func(i int, call AggregateCall) {
+			defer wg.Done()
+			value, err := callUpstreamJSON(ctx, client, r, call)
+			results[i] = aggregateResult{value: value, err: err}
+		}(i, call)
+	}
+	wg.Wait()
+
+	responses := make(map[string]interface{}, len(calls))
+	errors := make(map[string]string)
+	for i, call := range calls {
+		if err := results[i].err; err != nil {
+			log.Printf("Aggregate call %s for %s failed: %v", call.Name, route.Path, err)
+			if call.Required {
+				status := http.StatusBadGateway
+				if ctx.Err() == context.DeadlineExceeded {
+					status = http.StatusGatewayTimeout
+				}
+				writeErrorDetails(w, r, status, errorCodeForStatus(status), fmt.Sprintf("upstream %s failed", call.Name), map[string]string{"call": call.Name})
+				return
+			}
+			errors[call.Name] = err.Error()
+			continue
+		}
+		responses[call.Name] = results[i].value
+	}
+
+	var output map[string]interface{}
+	if len(route.Aggregate.Template) == 0 {
+		output = responses
+	} else {
+		output = make(map[string]interface{})
+		for field, ref := range route.Aggregate.Template {
+			if value, ok := lookupJSONPath(responses, ref); ok {
+				setJSONPath(output, field, value)
+			}
+		}
+	}
+	if len(errors) > 0 {
+		output["_errors"] = errors
+	}
+
+	writeJSON(w, output)
+}
+
+// callUpstreamJSON performs a call and decodes its JSON response
+func callUpstreamJSON(ctx context.Context, client *http.Client, r *http.Request, call AggregateCall) (interface{}, error) {
+	target, err := url.Parse(call.URL)
+	if err != nil {
+		return nil, err
+	}
+	if call.ForwardQuery && r.URL.RawQuery != "" {
+		query := target.Query()
+		for key, values := range r.URL.Query() {
+			for _, v := range values {
+				query.Add(key, v)
+			}
+		}
+		target.RawQuery = query.Encode()
+	}
+
+	method := call.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/xml;q=0.9, text/xml;q=0.9")
+	for _, name := range call.ForwardHeaders {
+		if v := r.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxUpstreamJSONSize))
+		return nil, fmt.Errorf("upstream returned %s", resp.Status)
+	}
+
+	return decodeUpstreamBody(resp)
+}
+
+// decodeUpstreamBody decodes a JSON or XML upstream response into a generic value
+func decodeUpstreamBody(resp *http.Response) (interface{}, error) {
+	body := io.LimitReader(resp.Body, maxUpstreamJSONSize)
+
+	if isXMLContentType(resp.Header.Get("Content-Type")) {
+		value, err := decodeXMLValue(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML response: %v", err)
+		}
+		return value, nil
+	}
+
+	var value interface{}
+	if err := json.NewDecoder(body).Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON response: %v", err)
+	}
+	return value, nil
+}
+
+// lookupJSONPath resolves a dotted path (object keys or array indexes)
+// within a decoded JSON value
+func lookupJSONPath(value interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return value, true
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// setJSONPath stores value at a dotted path, creating nested objects
+func setJSONPath(obj map[string]interface{}, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			obj[part] = next
+		}
+		obj = next
+	}
+	obj[parts[len(parts)-1]] = value
+}
+
+// validateAggregate validates an aggregation route's calls and template
+func validateAggregate(cfg *AggregateConfig) error {
+	if cfg == nil || len(cfg.Calls) == 0 {
+		return fmt.Errorf("aggregate routes require at least one call")
+	}
+
+	names := make(map[string]bool)
+	for _, call := range cfg.Calls {
+		if call.Name == "" {
+			return fmt.Errorf("aggregate calls require a name")
+		}
+		if names[call.Name] {
+			return fmt.Errorf("duplicate aggregate call name %q", call.Name)
+		}
+		names[call.Name] = true
+
+		u, err := url.Parse(call.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("aggregate call %q needs an absolute http(s) URL", call.Name)
+		}
+	}
+
+	for field, ref := range cfg.Template {
+		name := strings.SplitN(ref, ".", 2)[0]
+		if !names[name] {
+			return fmt.Errorf("template field %q references unknown call %q", field, name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Alert rule defaults
+const (
+	defaultAlertInterval = 15
+	defaultAlertWindow   = 300
+)
+
+// Metrics alert rules evaluate
+const (
+	AlertMetricErrorRate          = "errorRate"          // share of requests answered with 5xx
+	AlertMetricLatency            = "latency"            // average response time in seconds
+	AlertMetricRequestRate        = "requestRate"        // requests per second
+	AlertMetricUnhealthyUpstreams = "unhealthyUpstreams" // upstreams failing health checks
+)
+
+// Alert states, as the Prometheus alerts API reports them
+const (
+	alertPending = "pending"
+	alertFiring  = "firing"
+)
+
+// AlertsConfig holds threshold rules the gateway evaluates over its own
+// metrics, for deployments without an external monitoring stack
+type AlertsConfig struct {
+	Interval int         `json:"interval,omitempty"` // seconds between evaluations; defaults to 15
+	Rules    []AlertRule `json:"rules,omitempty"`
+}
+
+// AlertRule fires when a metric crosses a threshold for long enough. Its
+// fields follow Prometheus alerting rules, with the expression spelled out.
+type AlertRule struct {
+	Alert       string            `json:"alert"`
+	Metric      string            `json:"metric"`
+	Route       string            `json:"route,omitempty"` // route path; empty covers the whole gateway
+	Op          string            `json:"op,omitempty"`    // >, >=, < or <=; defaults to >
+	Threshold   float64           `json:"threshold"`
+	Window      int               `json:"window,omitempty"`      // seconds the metric is measured over; defaults to 300
+	For         int               `json:"for,omitempty"`         // seconds the condition must hold before the alert fires
+	Labels      map[string]string `json:"labels,omitempty"`      // e.g. severity
+	Annotations map[string]string `json:"annotations,omitempty"` // e.g. summary
+}
+
+// checkAlerts validates the alert rules
+func checkAlerts(c AlertsConfig, v *ValidationError) {
+	checkNonNegative("alerts", []namedInt{{"interval", c.Interval}}, v)
+	seen := make(map[string]bool)
+	for i, rule := range c.Rules {
+		prefix := "alerts.rules[" + strconv.Itoa(i) + "]"
+		if rule.Alert == "" {
+			v.add(prefix+".alert", "is required")
+		}
+		switch rule.Metric {
+		case AlertMetricErrorRate, AlertMetricLatency, AlertMetricRequestRate, AlertMetricUnhealthyUpstreams:
+		default:
+			v.add(prefix+".metric", "unknown metric %q: use errorRate, latency, requestRate or unhealthyUpstreams", rule.Metric)
+		}
+		switch rule.Op {
+		case "", ">", ">=", "<", "<=":
+		default:
+			v.add(prefix+".op", "unknown operator %q: use >, >=, < or <=", rule.Op)
+		}
+		checkNonNegative(prefix, []namedInt{
+			{"window", rule.Window},
+			{"for", rule.For},
+		}, v)
+		if seen[rule.key()] {
+			v.add(prefix, "duplicate alert %q for route %q", rule.Alert, rule.Route)
+		}
+		seen[rule.key()] = true
+	}
+}
+
+// interval returns the time between evaluations
+func (c AlertsConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return defaultAlertInterval * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// key identifies a rule across config reloads
+func (rule AlertRule) key() string {
+	return rule.Alert + "\x00" + rule.Route
+}
+
+// window returns the span the rule's metric is measured over
+func (rule AlertRule) window() time.Duration {
+	if rule.Window <= 0 {
+		return defaultAlertWindow * time.Second
+	}
+	return time.Duration(rule.Window) * time.Second
+}
+
+// matches compares a metric value with the rule's threshold
+func (rule AlertRule) matches(value float64) bool {
+	switch rule.Op {
+	case ">=":
+		return value >= rule.Threshold
+	case "<":
+		return value < rule.Threshold
+	case "<=":
+		return value <= rule.Threshold
+	}
+	return value > rule.Threshold
+}
+
+// op returns the rule's comparison operator
+func (rule AlertRule) op() string {
+	if rule.Op == "" {
+		return ">"
+	}
+	return rule.Op
+}
+
+// Alert is a pending or firing alert, shaped like an entry of the
+// Prometheus alerts API
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	State       string            `json:"state"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	Value       string            `json:"value"`
+}
+
+// alertEvaluator tracks the state of each rule between evaluations
+type alertEvaluator struct {
+	mutex  sync.Mutex
+	active map[string]*Alert
+}
+
+// alerts evaluates the configured alert rules
+var alerts = &alertEvaluator{active: make(map[string]*Alert)}
+
+// start schedules evaluation of the rules. Rules and the interval are
+// reread each time, so config reloads apply.
+func (a *alertEvaluator) start(ctx context.Context, p *Proxy) {
+	jobs.start(ctx, jobSpec{
+		name:      "alert-evaluation",
+		interval:  func() time.Duration { return config.settings().Alerts.interval() },
+		singleton: true,
+		run: func(_ context.Context, now time.Time) error {
+			a.evaluate(p, config.settings().Alerts.Rules, now)
+			return nil
+		},
+	})
+}
+
+// reset forgets pending and firing alerts, as a replica that is no longer
+// leader stops evaluating them
+func (a *alertEvaluator) reset() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.active = make(map[string]*Alert)
+}
+
+// evaluate checks every rule once. A rule whose condition holds turns
+// pending, then firing once it has held for its For period; firing and
+// resolving publish events.
+func (a *alertEvaluator) evaluate(p *Proxy, rules []AlertRule, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	current := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		key := rule.key()
+		current[key] = true
+		value := alertMetric(p, rule, now)
+		alert := a.active[key]
+		if !rule.matches(value) {
+			if alert != nil && alert.State == alertFiring {
+				log.Printf("Alert %s resolved", rule.Alert)
+				events.emit(EventAlertResolved, *alert)
+			}
+			delete(a.active, key)
+			continue
+		}
+
+		if alert == nil {
+			alert = &Alert{State: alertPending, ActiveAt: now}
+			a.active[key] = alert
+		}
+		alert.Labels = alertLabels(rule)
+		alert.Annotations = rule.Annotations
+		if alert.Annotations == nil {
+			alert.Annotations = map[string]string{}
+		}
+		alert.Value = strconv.FormatFloat(value, 'g', -1, 64)
+		if alert.State == alertPending && now.Sub(alert.ActiveAt) >= time.Duration(rule.For)*time.Second {
+			alert.State = alertFiring
+			log.Printf("Alert %s firing: %s %s %s %v", rule.Alert, rule.Metric, alert.Value, rule.op(), rule.Threshold)
+			events.emit(EventAlertFiring, *alert)
+		}
+	}
+
+	// Forget rules removed from the config
+	for key := range a.active {
+		if !current[key] {
+			delete(a.active, key)
+		}
+	}
+}
+
+// alertLabels returns an alert's labels: the rule's own, its name, and
+// its route with the route's owner and team
+func alertLabels(rule AlertRule) map[string]string {
+	labels := map[string]string{"alertname": rule.Alert}
+	if rule.Route != "" {
+		labels["route"] = rule.Route
+		owner := routeOwners()[rule.Route]
+		if owner.Owner != "" {
+			labels["owner"] = owner.Owner
+		}
+		if owner.Team != "" {
+			labels["team"] = owner.Team
+		}
+	}
+	for name, value := range rule.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// alertMetric measures a rule's metric over its window, for its route or
+// the whole gateway
+func alertMetric(p *Proxy, rule AlertRule, now time.Time) float64 {
+	if rule.Metric == AlertMetricUnhealthyUpstreams {
+		return unhealthyUpstreams(p, rule.Route)
+	}
+
+	window := statsLog.window(now.Add(-rule.window()), now)
+	requests, errors, latency := window.TotalRequests, window.TotalErrors, window.AvgResponseTime
+	if rule.Route != "" {
+		rs := window.RouteStats[rule.Route]
+		requests, errors, latency = rs.Requests, rs.Errors, rs.AvgLatency
+	}
+	switch rule.Metric {
+	case AlertMetricErrorRate:
+		if requests == 0 {
+			return 0
+		}
+		return float64(errors) / float64(requests)
+	case AlertMetricLatency:
+		return latency
+	}
+	return float64(requests) / rule.window().Seconds()
+}
+
+// unhealthyUpstreams counts the upstreams failing health checks, or for a
+// route reports 1 if its target is
+func unhealthyUpstreams(p *Proxy, path string) float64 {
+	if path == "" {
+		var count float64
+		for _, svc := range p.getServices() {
+			if svc.Status == "unhealthy" {
+				count++
+			}
+		}
+		return count
+	}
+	for _, route := range config.getRoutes() {
+		if route.Path == path && p.primaryUnhealthy(route) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// list returns the pending and firing alerts, firing first
+func (a *alertEvaluator) list() []Alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	list := make([]Alert, 0, len(a.active))
+	for _, alert := range a.active {
+		list = append(list, *alert)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].State != list[j].State {
+			return list[i].State == alertFiring
+		}
+		return list[i].ActiveAt.Before(list[j].ActiveAt)
+	})
+	return list
+}
+
+// handleAlerts returns the pending and firing alerts in the format of the
+// Prometheus alerts API
+func handleAlerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"alerts": alerts.list()},
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Analytics defaults
+const (
+	defaultAnalyticsFineRetention = 24 // hours
+	defaultAnalyticsMaxEntries    = 500000
+)
+
+// AnalyticsConfig bounds the memory of the per-route request and error
+// counts behind windowed stats, the error breakdown and alerts. Counts are
+// kept by the minute, then merged into hours, and the oldest are evicted
+// once a log holds too many.
+type AnalyticsConfig struct {
+	Retention     int `json:"retention,omitempty"`     // hours of counts kept; defaults to storage.historyRetention
+	FineRetention int `json:"fineRetention,omitempty"` // hours kept by the minute before merging into hours; defaults to 24
+	MaxEntries    int `json:"maxEntries,omitempty"`    // counters each log holds, one per route (and error class) per bucket; defaults to 500000
+}
+
+// checkAnalytics validates the analytics bounds
+func checkAnalytics(c AnalyticsConfig, v *ValidationError) {
+	checkNonNegative("analytics", []namedInt{
+		{"retention", c.Retention},
+		{"fineRetention", c.FineRetention},
+		{"maxEntries", c.MaxEntries},
+	}, v)
+}
+
+// analyticsLimits are the effective analytics bounds
+type analyticsLimits struct {
+	retention  time.Duration
+	fine       time.Duration
+	maxEntries int
+}
+
+// analyticsLimits returns the effective bounds. The fine retention never
+// exceeds the retention.
+func (c *Config) analyticsLimits() analyticsLimits {
+	settings := c.settings()
+	_, retention := settings.Storage.historySettings()
+	if settings.Analytics.Retention > 0 {
+		retention = time.Duration(settings.Analytics.Retention) * time.Hour
+	}
+	fine := time.Duration(defaultAnalyticsFineRetention) * time.Hour
+	if settings.Analytics.FineRetention > 0 {
+		fine = time.Duration(settings.Analytics.FineRetention) * time.Hour
+	}
+	if fine > retention {
+		fine = retention
+	}
+	maxEntries := settings.Analytics.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultAnalyticsMaxEntries
+	}
+	return analyticsLimits{retention: retention, fine: fine, maxEntries: maxEntries}
+}
+
+// logBucket is the counts of one minute or hour of a log
+type logBucket interface {
+	// entries returns the number of counters held
+	entries() int
+	// absorb adds another bucket's counts to this one
+	absorb(other logBucket)
+}
+
+// bucketLog keeps a log's buckets: minutes until the fine retention, then
+// hours until the retention
+type bucketLog struct {
+	minutes   map[int64]logBucket // by Unix minute
+	hours     map[int64]logBucket // by Unix hour
+	newBucket func() logBucket
+
+	evicted int64 // buckets dropped to stay under the cap
+}
+
+// newBucketLog creates an empty log whose buckets newBucket makes
+func newBucketLog(newBucket func() logBucket) bucketLog {
+	return bucketLog{
+		minutes:   make(map[int64]logBucket),
+		hours:     make(map[int64]logBucket),
+		newBucket: newBucket,
+	}
+}
+
+// bucket returns the minute bucket for now. Starting a new minute compacts
+// the log.
+func (b *bucketLog) bucket(now time.Time, limits analyticsLimits) logBucket {
+	minute := now.Unix() / 60
+	m, ok := b.minutes[minute]
+	if !ok {
+		b.compact(now, limits)
+		m = b.newBucket()
+		b.minutes[minute] = m
+	}
+	return m
+}
+
+// compact drops buckets past the retention, merges minutes past the fine
+// retention into their hour and evicts the oldest buckets while the log
+// holds more counters than allowed
+func (b *bucketLog) compact(now time.Time, limits analyticsLimits) {
+	oldest := now.Add(-limits.retention).Unix() / 60
+	fineFrom := now.Add(-limits.fine).Unix() / 60
+	for t, m := range b.minutes {
+		switch {
+		case t < oldest:
+			delete(b.minutes, t)
+		case t < fineFrom:
+			hour, ok := b.hours[t/60]
+			if !ok {
+				hour = b.newBucket()
+				b.hours[t/60] = hour
+			}
+			hour.absorb(m)
+			delete(b.minutes, t)
+		}
+	}
+	for h := range b.hours {
+		if (h+1)*60 <= oldest {
+			delete(b.hours, h)
+		}
+	}
+
+	// Order the buckets oldest first, keyed by their first minute
+	type keyed struct {
+		start  int64
+		hourly bool
+		bucket logBucket
+	}
+	buckets := make([]keyed, 0, len(b.minutes)+len(b.hours))
+	entries := 0
+	for t, m := range b.minutes {
+		buckets = append(buckets, keyed{t, false, m})
+		entries += m.entries()
+	}
+	for h, m := range b.hours {
+		buckets = append(buckets, keyed{h * 60, true, m})
+		entries += m.entries()
+	}
+	if entries <= limits.maxEntries {
+		return
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].start < buckets[j].start })
+	for _, k := range buckets {
+		if entries <= limits.maxEntries {
+			break
+		}
+		if k.hourly {
+			delete(b.hours, k.start/60)
+		} else {
+			delete(b.minutes, k.start)
+		}
+		entries -= k.bucket.entries()
+		b.evicted++
+	}
+}
+
+// each calls f with every bucket overlapping the minutes from to to. Hour
+// buckets count whole, so ranges reaching into them are to the hour.
+func (b *bucketLog) each(from, to int64, f func(logBucket)) {
+	b.spans(from, to, func(start, minutes int64, bucket logBucket) { f(bucket) })
+}
+
+// spans is each with the Unix minute each bucket starts at and the minutes
+// it covers
+func (b *bucketLog) spans(from, to int64, f func(start, minutes int64, bucket logBucket)) {
+	for t, m := range b.minutes {
+		if t >= from && t <= to {
+			f(t, 1, m)
+		}
+	}
+	for h, m := range b.hours {
+		if h*60+59 >= from && h*60 <= to {
+			f(h*60, 60, m)
+		}
+	}
+}
+
+// AnalyticsUsage reports what a log holds
+type AnalyticsUsage struct {
+	Minutes    int        `json:"minutes"` // minute buckets
+	Hours      int        `json:"hours"`   // downsampled hour buckets
+	Entries    int        `json:"entries"` // counters held
+	MaxEntries int        `json:"maxEntries"`
+	Evicted    int64      `json:"evicted"` // buckets dropped to stay under maxEntries
+	Oldest     *time.Time `json:"oldest,omitempty"`
+}
+
+// usage reports the log's size
+func (b *bucketLog) usage(limits analyticsLimits) AnalyticsUsage {
+	u := AnalyticsUsage{
+		Minutes:    len(b.minutes),
+		Hours:      len(b.hours),
+		MaxEntries: limits.maxEntries,
+		Evicted:    b.evicted,
+	}
+	first := int64(-1)
+	for t, m := range b.minutes {
+		u.Entries += m.entries()
+		if first < 0 || t < first {
+			first = t
+		}
+	}
+	for h, m := range b.hours {
+		u.Entries += m.entries()
+		if first < 0 || h*60 < first {
+			first = h * 60
+		}
+	}
+	if first >= 0 {
+		oldest := time.Unix(first*60, 0).UTC()
+		u.Oldest = &oldest
+	}
+	return u
+}
+
+// analyticsUsage reports the size of the request and error logs
+func analyticsUsage() map[string]AnalyticsUsage {
+	limits := config.analyticsLimits()
+	statsLog.mutex.Lock()
+	requests := statsLog.buckets.usage(limits)
+	statsLog.mutex.Unlock()
+	errorLog.mutex.Lock()
+	errors := errorLog.buckets.usage(limits)
+	errorLog.mutex.Unlock()
+	return map[string]AnalyticsUsage{"requests": requests, "errors": errors}
+}
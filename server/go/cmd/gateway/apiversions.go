@@ -0,0 +1,246 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Version sources
+const (
+	VersionFromPath   = "path"
+	VersionFromHeader = "header"
+	VersionFromAccept = "accept"
+)
+
+// defaultVersionHeader names the API version when routing by header
+const defaultVersionHeader = "X-API-Version"
+
+// acceptVersionPattern finds the version in vendor media types such as
+// application/vnd.acme.v2+json
+var acceptVersionPattern = regexp.MustCompile(`\.(v\d+)(\+|$)`)
+
+// VersioningConfig serves several API versions under one logical route.
+// The version comes from a path prefix (/v2/orders for a route at
+// /orders), a header or the Accept header, tried in the order of Sources.
+type VersioningConfig struct {
+	Sources  []string     `json:"sources,omitempty"` // path, header and accept; defaults to all three
+	Header   string       `json:"header,omitempty"`  // defaults to X-API-Version
+	Default  string       `json:"default,omitempty"` // version for requests naming none; empty rejects them
+	Versions []APIVersion `json:"versions"`
+}
+
+// APIVersion is one version of a route's API
+type APIVersion struct {
+	Name   string `json:"name"`             // v1, v2, ...
+	Target string `json:"target,omitempty"` // defaults to the route target
+}
+
+// VersionStat counts the requests served by an API version
+type VersionStat struct {
+	Requests   int64   `json:"requests"`
+	Errors     int64   `json:"errors"` // 5xx responses
+	AvgLatency float64 `json:"avgLatency"`
+}
+
+// checkVersioning validates a route's API versions
+func checkVersioning(c *VersioningConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	for _, source := range c.Sources {
+		switch source {
+		case VersionFromPath, VersionFromHeader, VersionFromAccept:
+		default:
+			v.add("versioning.sources", "unknown source %q: use path, header or accept", source)
+		}
+	}
+	if len(c.Versions) == 0 {
+		v.add("versioning.versions", "needs at least one version")
+	}
+
+	names := make(map[string]bool, len(c.Versions))
+	for _, version := range c.Versions {
+		switch {
+		case version.Name == "" || strings.ContainsAny(version.Name, "/ "):
+			v.add("versioning.versions", "invalid version name %q", version.Name)
+		case names[normalizeVersion(version.Name)]:
+			v.add("versioning.versions", "duplicate version %q", version.Name)
+		}
+		names[normalizeVersion(version.Name)] = true
+		if version.Target != "" {
+			if err := validateTargetURL(version.Target); err != nil {
+				v.add("versioning.versions."+version.Name+".target", "%v", err)
+			}
+		}
+	}
+	if c.Default != "" && !names[normalizeVersion(c.Default)] {
+		v.add("versioning.default", "version %q is not listed", c.Default)
+	}
+}
+
+// normalizeVersion compares "v2", "V2" and "2" as the same version
+func normalizeVersion(name string) string {
+	return strings.TrimPrefix(strings.ToLower(name), "v")
+}
+
+// sources returns the configured version sources in order
+func (c *VersioningConfig) sources() []string {
+	if len(c.Sources) == 0 {
+		return []string{VersionFromPath, VersionFromHeader, VersionFromAccept}
+	}
+	return c.Sources
+}
+
+// usesPath reports whether versions are read from a path prefix
+func (c *VersioningConfig) usesPath() bool {
+	if c == nil {
+		return false
+	}
+	for _, source := range c.sources() {
+		if source == VersionFromPath {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the listed version matching name
+func (c *VersioningConfig) find(name string) (APIVersion, bool) {
+	for _, version := range c.Versions {
+		if normalizeVersion(version.Name) == normalizeVersion(name) {
+			return version, true
+		}
+	}
+	return APIVersion{}, false
+}
+
+// pathVersion returns the version prefixing routePath in requestPath,
+// as in /v2/orders/7 for a route at /orders
+func (c *VersioningConfig) pathVersion(requestPath, routePath string) (APIVersion, bool) {
+	if !c.usesPath() {
+		return APIVersion{}, false
+	}
+	for _, version := range c.Versions {
+		if pathMatches(requestPath, "/"+version.Name+routePath) {
+			return version, true
+		}
+	}
+	return APIVersion{}, false
+}
+
+// matchesPath reports whether a request path reaches the route, directly
+// or under a version prefix
+func (r Route) matchesPath(path string) bool {
+	if pathMatches(path, r.Path) {
+		return true
+	}
+	_, ok := r.Versioning.pathVersion(path, r.Path)
+	return ok
+}
+
+// requestVersion picks the version a request asks for, reporting the name
+// requested when no listed version matches
+func (c *VersioningConfig) requestVersion(r *http.Request, routePath string) (APIVersion, string, bool) {
+	for _, source := range c.sources() {
+		var name string
+		switch source {
+		case VersionFromPath:
+			if version, ok := c.pathVersion(r.URL.Path, routePath); ok {
+				return version, version.Name, true
+			}
+		case VersionFromHeader:
+			header := c.Header
+			if header == "" {
+				header = defaultVersionHeader
+			}
+			name = strings.TrimSpace(r.Header.Get(header))
+		case VersionFromAccept:
+			name = acceptVersion(r.Header.Get("Accept"))
+		}
+		if name != "" {
+			version, ok := c.find(name)
+			return version, name, ok
+		}
+	}
+
+	if c.Default != "" {
+		version, ok := c.find(c.Default)
+		return version, c.Default, ok
+	}
+	return APIVersion{}, "", false
+}
+
+// acceptVersion extracts a version from vendor media types in an Accept
+// header, or from a version parameter
+func acceptVersion(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if m := acceptVersionPattern.FindStringSubmatch(mediaType); m != nil {
+			return m[1]
+		}
+		if v := params["version"]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// applyVersion points the route at the target of the requested API version.
+// It answers 400 when the version is missing or unknown and reports false;
+// otherwise it returns a function recording the outcome per version.
+func applyVersion(w http.ResponseWriter, r *http.Request, route *Route) (http.ResponseWriter, func(), bool) {
+	c := route.Versioning
+	if c == nil {
+		return w, func() {}, true
+	}
+
+	version, requested, ok := c.requestVersion(r, route.Path)
+	if !ok {
+		names := make([]string, len(c.Versions))
+		for i, version := range c.Versions {
+			names[i] = version.Name
+		}
+		message := "API version required"
+		if requested != "" {
+			message = "Unsupported API version " + requested
+		}
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeBadRequest, message, map[string]interface{}{"versions": names})
+		return w, nil, false
+	}
+	if version.Target != "" {
+		route.Target = version.Target
+	}
+	requestContext(r).update(func(rc *RequestContext) { rc.Version = version.Name })
+
+	path := route.Path
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		proxy.recordVersion(path, version.Name, time.Since(start), rec.statusCode())
+	}, true
+}
+
+// recordVersion updates the stats of a route's API version
+func (p *Proxy) recordVersion(path, version string, latency time.Duration, status int) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	versions, ok := p.stats.APIVersions[path]
+	if !ok {
+		versions = make(map[string]VersionStat)
+		p.stats.APIVersions[path] = versions
+	}
+	stat := versions[version]
+	stat.Requests++
+	stat.AvgLatency = (stat.AvgLatency*float64(stat.Requests-1) + latency.Seconds()) / float64(stat.Requests)
+	if status >= 500 {
+		stat.Errors++
+	}
+	versions[version] = stat
+}
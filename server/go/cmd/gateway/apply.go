@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Apply actions
+const (
+	ApplyCreate = "create"
+	ApplyUpdate = "update"
+	ApplyDelete = "delete"
+)
+
+// ApplyRequest declares the state the gateway should be in. Sections left
+// out are not managed: their routes, credentials or config stay as they
+// are. Applying the same request twice changes nothing the second time.
+type ApplyRequest struct {
+	Config      json.RawMessage   `json:"config,omitempty"`      // the settings as for PUT /config
+	Routes      []Route           `json:"routes,omitempty"`      // matched to running routes by path and methods
+	Credentials []ApplyCredential `json:"credentials,omitempty"` // matched to stored credentials by name
+	Prune       bool              `json:"prune,omitempty"`       // delete the routes and credentials of managed sections that are not declared
+	DryRun      bool              `json:"dryRun,omitempty"`      // report the plan without applying it
+}
+
+// ApplyCredential declares a credential. Routes are granted by path, as
+// their IDs are the gateway's to assign.
+type ApplyCredential struct {
+	Name         string             `json:"name"`
+	Route        string             `json:"route,omitempty"` // path of a route granted in full
+	Entitlements []ApplyEntitlement `json:"entitlements,omitempty"`
+	Enabled      *bool              `json:"enabled,omitempty"` // defaults to true
+}
+
+// ApplyEntitlement grants a route, by path or tag, with scopes
+type ApplyEntitlement struct {
+	Route  string   `json:"route,omitempty"`
+	Tag    string   `json:"tag,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// ApplyChange is one change of a plan
+type ApplyChange struct {
+	Action      string            `json:"action"`   // create, update or delete
+	Resource    string            `json:"resource"` // route, credential or config
+	Key         string            `json:"key,omitempty"`
+	ID          int               `json:"id,omitempty"` // of the route or credential; for created routes, the ID it will get
+	Differences []ApplyDifference `json:"differences,omitempty"`
+	Credential  *Credential       `json:"credential,omitempty"` // a created credential, with its secret, once applied
+	Route       *Route            `json:"route,omitempty"`      // a created route, once applied
+}
+
+// ApplyDifference is a setting the plan changes. A null value means the
+// setting is absent on that side.
+type ApplyDifference struct {
+	Path    string      `json:"path"`
+	Current interface{} `json:"current"`
+	Desired interface{} `json:"desired"`
+}
+
+// ApplyResult is the plan and whether it was applied
+type ApplyResult struct {
+	Applied bool          `json:"applied"`
+	Changes []ApplyChange `json:"changes"` // empty when the gateway already matches
+}
+
+// applyPlan is the batch that brings the gateway to the declared state
+type applyPlan struct {
+	ops     []BatchOperation
+	sources []string // the declaration behind each operation, for violations
+	changes []ApplyChange
+}
+
+// routeKey identifies a route by its path and sorted methods
+func routeKey(route Route) string {
+	methods := append([]string(nil), route.Methods...)
+	for i := range methods {
+		methods[i] = strings.ToUpper(methods[i])
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ",") + " " + route.Path
+}
+
+// jsonTree returns v as decoded JSON, for comparison
+func jsonTree(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	err = json.Unmarshal(data, &tree)
+	return tree, err
+}
+
+// differences compares the current and desired form of a resource
+func differences(path string, current, desired interface{}) ([]ApplyDifference, error) {
+	currentTree, err := jsonTree(current)
+	if err != nil {
+		return nil, err
+	}
+	desiredTree, err := jsonTree(desired)
+	if err != nil {
+		return nil, err
+	}
+	var found []ConfigDifference
+	diffConfigTrees(path, currentTree, desiredTree, &found)
+	diffs := make([]ApplyDifference, len(found))
+	for i, d := range found {
+		diffs[i] = ApplyDifference{Path: d.Path, Current: d.File, Desired: d.Runtime}
+	}
+	return diffs, nil
+}
+
+// planApply compares the declared state with the running one and builds
+// the batch that closes the gap: the config first, so routes validate
+// against it, then route deletions, updates and creations, then
+// credentials. Violations name the declaration at fault.
+func planApply(req ApplyRequest) (*applyPlan, error) {
+	var v ValidationError
+	p := &applyPlan{}
+	add := func(source string, op BatchOperation, change ApplyChange) {
+		p.ops = append(p.ops, op)
+		p.sources = append(p.sources, source)
+		p.changes = append(p.changes, change)
+	}
+
+	// Config
+	cfg := config
+	if len(req.Config) > 0 {
+		staged, err := stageConfig("config", req.Config)
+		if err != nil {
+			addViolations(&v, "config", err)
+			return nil, v.err()
+		}
+		cfg = staged
+		diffs, err := differences("", config.settings(), staged.settings())
+		if err != nil {
+			return nil, err
+		}
+		if len(diffs) > 0 {
+			add("config", BatchOperation{Op: BatchUpdateConfig, Config: req.Config},
+				ApplyChange{Action: ApplyUpdate, Resource: "config", Differences: diffs})
+		}
+	}
+
+	// Routes, matched by path and methods
+	running := config.getRoutes()
+	config.routesMutex.RLock()
+	nextID := config.nextRouteID
+	config.routesMutex.RUnlock()
+	byKey := make(map[string][]Route)
+	for _, route := range running {
+		byKey[routeKey(route)] = append(byKey[routeKey(route)], route)
+	}
+	final := make([]Route, 0, len(running)+len(req.Routes)) // the routes once applied, for credential grants
+	declared := make(map[string]bool)
+	var updates, creates []int
+	routeIDs := make([]int, len(req.Routes))
+	desired := make([]Route, len(req.Routes))
+	for i, route := range req.Routes {
+		// Compare routes as the gateway stores them, with templates
+		// applied and methods normalized; the batch reports violations
+		validateRoute(&route, running, cfg)
+		desired[i] = route
+
+		source := fmt.Sprintf("routes[%d]", i)
+		key := routeKey(route)
+		if declared[key] {
+			v.add(source, "declares %s twice", key)
+			continue
+		}
+		declared[key] = true
+		switch matches := byKey[key]; len(matches) {
+		case 0:
+			creates = append(creates, i)
+		case 1:
+			routeIDs[i] = matches[0].ID
+			updates = append(updates, i)
+		default:
+			v.add(source, "%s matches routes %d and %d; remove one of them first", key, matches[0].ID, matches[1].ID)
+		}
+	}
+	for _, route := range running {
+		key := routeKey(route)
+		switch {
+		case declared[key]:
+		case req.Routes != nil && req.Prune && route.source == "":
+			// Included routes belong to their files and are never pruned
+			add(fmt.Sprintf("routes (%s)", key), BatchOperation{Op: BatchDeleteRoute, ID: route.ID},
+				ApplyChange{Action: ApplyDelete, Resource: "route", Key: key, ID: route.ID})
+		default:
+			final = append(final, route)
+		}
+	}
+	for _, i := range updates {
+		route := desired[i]
+		route.ID = routeIDs[i]
+		var current Route
+		for _, r := range running {
+			if r.ID == route.ID {
+				current = r
+			}
+		}
+		final = append(final, route)
+		diffs, err := differences("", current, route)
+		if err != nil {
+			return nil, err
+		}
+		if len(diffs) > 0 {
+			add(fmt.Sprintf("routes[%d]", i), BatchOperation{Op: BatchUpdateRoute, Route: &route},
+				ApplyChange{Action: ApplyUpdate, Resource: "route", Key: routeKey(route), ID: route.ID, Differences: diffs})
+		}
+	}
+	for _, i := range creates {
+		route := desired[i]
+		route.ID = nextID
+		nextID++
+		final = append(final, route)
+		add(fmt.Sprintf("routes[%d]", i), BatchOperation{Op: BatchCreateRoute, Route: &route},
+			ApplyChange{Action: ApplyCreate, Resource: "route", Key: routeKey(route), ID: route.ID})
+	}
+
+	// Credentials, matched by name
+	if req.Credentials != nil {
+		if err := planCredentials(req, final, p, add, &v); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// routeIDByPath resolves a declared grant to the one route with that path
+func routeIDByPath(routes []Route, path string) (int, error) {
+	id := 0
+	for _, route := range routes {
+		if route.Path != path {
+			continue
+		}
+		if id != 0 {
+			return 0, fmt.Errorf("several routes have the path %s; grant them by tag", path)
+		}
+		id = route.ID
+	}
+	if id == 0 {
+		return 0, fmt.Errorf("no route has the path %s", path)
+	}
+	return id, nil
+}
+
+// planCredentials adds the credential changes to a plan. Grants are
+// resolved against the routes as they will be once the plan is applied.
+func planCredentials(req ApplyRequest, routes []Route, p *applyPlan, add func(string, BatchOperation, ApplyChange), v *ValidationError) error {
+	stored, err := store.ListCredentials()
+	if err != nil {
+		return fmt.Errorf("failed to list credentials: %v", err)
+	}
+	byName := make(map[string][]Credential)
+	for _, cred := range stored {
+		byName[cred.Name] = append(byName[cred.Name], cred)
+	}
+
+	declared := make(map[string]bool)
+	for i, c := range req.Credentials {
+		source := fmt.Sprintf("credentials[%d]", i)
+		if declared[c.Name] {
+			v.add(source+".name", "declares %q twice", c.Name)
+			continue
+		}
+		declared[c.Name] = true
+
+		cred := Credential{Name: c.Name, Enabled: c.Enabled == nil || *c.Enabled}
+		if c.Route != "" {
+			id, err := routeIDByPath(routes, c.Route)
+			if err != nil {
+				v.add(source+".route", "%v", err)
+				continue
+			}
+			cred.RouteID = id
+		}
+		resolved := true
+		for j, e := range c.Entitlements {
+			entitlement := Entitlement{Tag: e.Tag, Scopes: e.Scopes}
+			if e.Route != "" {
+				id, err := routeIDByPath(routes, e.Route)
+				if err != nil {
+					v.add(fmt.Sprintf("%s.entitlements[%d].route", source, j), "%v", err)
+					resolved = false
+					continue
+				}
+				entitlement.RouteID = id
+			}
+			cred.Entitlements = append(cred.Entitlements, entitlement)
+		}
+		if !resolved {
+			continue
+		}
+
+		switch matches := byName[c.Name]; len(matches) {
+		case 0:
+			add(source, BatchOperation{Op: BatchCreateCredential, Credential: &cred},
+				ApplyChange{Action: ApplyCreate, Resource: "credential", Key: c.Name})
+		case 1:
+			current := matches[0]
+			cred.ID = current.ID
+			wanted := struct {
+				RouteID      int           `json:"routeId,omitempty"`
+				Enabled      bool          `json:"enabled"`
+				Entitlements []Entitlement `json:"entitlements,omitempty"`
+			}{cred.RouteID, cred.Enabled, cred.Entitlements}
+			existing := wanted
+			existing.RouteID, existing.Enabled, existing.Entitlements = current.RouteID, current.Enabled, current.Entitlements
+			diffs, err := differences("", existing, wanted)
+			if err != nil {
+				return err
+			}
+			if len(diffs) == 0 {
+				continue
+			}
+			add(source, BatchOperation{Op: BatchUpdateCredential, Credential: &cred},
+				ApplyChange{Action: ApplyUpdate, Resource: "credential", Key: c.Name, ID: current.ID, Differences: diffs})
+		default:
+			v.add(source+".name", "%q matches credentials %d and %d; delete one of them first", c.Name, matches[0].ID, matches[1].ID)
+		}
+	}
+	if req.Prune {
+		for _, cred := range stored {
+			if !declared[cred.Name] {
+				add(fmt.Sprintf("credentials (%s)", cred.Name), BatchOperation{Op: BatchDeleteCredential, ID: cred.ID},
+					ApplyChange{Action: ApplyDelete, Resource: "credential", Key: cred.Name, ID: cred.ID})
+			}
+		}
+	}
+	return nil
+}
+
+// sourceViolations renames batch violations, such as
+// operations[2].route.path, after the declarations behind them, as
+// routes[0].path
+func sourceViolations(err error, sources []string) []Violation {
+	violations := err.(*ValidationError).Violations
+	for i, violation := range violations {
+		for j := len(sources) - 1; j >= 0; j-- {
+			prefix := fmt.Sprintf("operations[%d]", j)
+			if !strings.HasPrefix(violation.Field, prefix) {
+				continue
+			}
+			rest := strings.TrimPrefix(violation.Field, prefix)
+			for _, part := range []string{".route", ".credential", ".config"} {
+				if strings.HasPrefix(rest, part) {
+					rest = strings.TrimPrefix(rest, part)
+					break
+				}
+			}
+			violations[i].Field = sources[j] + rest
+			break
+		}
+	}
+	return violations
+}
+
+// handleApply brings the gateway to a declared state of routes,
+// credentials and config, all or nothing, and reports the changes made. A
+// dry run reports the plan alone.
+func handleApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req ApplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	routeWrites.Lock()
+	p, err := planApply(req)
+	if err != nil {
+		routeWrites.Unlock()
+		if _, ok := err.(*ValidationError); ok {
+			writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Declared state is invalid; nothing was applied", err.(*ValidationError).Violations)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to plan: %v", err))
+		return
+	}
+	result := ApplyResult{Changes: p.changes}
+	if result.Changes == nil {
+		result.Changes = []ApplyChange{}
+	}
+	if len(p.ops) == 0 {
+		routeWrites.Unlock()
+		writeJSON(w, result)
+		return
+	}
+
+	batch, err := planBatch(p.ops)
+	if err != nil {
+		routeWrites.Unlock()
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Declared state is invalid; nothing was applied", sourceViolations(err, p.sources))
+		return
+	}
+	if req.DryRun {
+		routeWrites.Unlock()
+		writeJSON(w, result)
+		return
+	}
+	if err := applyBatch(batch); err != nil {
+		routeWrites.Unlock()
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Apply was rolled back: %v", err))
+		return
+	}
+	announceBatch(batch)
+	routeWrites.Unlock()
+	if batch.config != nil {
+		restartBackground(batch.background, config)
+	}
+
+	for i, res := range batch.results {
+		switch res.Op {
+		case BatchCreateRoute:
+			result.Changes[i].Route = res.Route
+		case BatchCreateCredential:
+			result.Changes[i].Credential = res.Credential
+			result.Changes[i].ID = res.Credential.ID
+		}
+	}
+	result.Applied = true
+	log.Printf("Applied declared state: %d changes", len(result.Changes))
+	writeJSON(w, result)
+}
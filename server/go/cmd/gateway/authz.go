@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthorizationConfig lists what a route requires of the bearer token's
+// claims once the request is authenticated
+type AuthorizationConfig struct {
+	Scopes []string    `json:"scopes,omitempty"` // all required, from the scope or scp claim
+	Claims []ClaimRule `json:"claims,omitempty"` // all must hold
+}
+
+// ClaimRule requires a claim, optionally with one of some values. Array
+// claims such as roles match if any element is allowed.
+type ClaimRule struct {
+	Claim string   `json:"claim"`        // dotted path, e.g. org.role
+	In    []string `json:"in,omitempty"` // allowed values; empty only requires presence
+}
+
+// checkAuthorization validates a route's authorization rules, which need
+// a way to verify tokens
+func checkAuthorization(a *AuthorizationConfig, jwt JWTConfig, v *ValidationError) {
+	if a == nil {
+		return
+	}
+	if !jwt.configured() {
+		v.add("authorization", "needs jwt.secret or jwt.jwksUrl to verify bearer tokens")
+	}
+	if len(a.Scopes) == 0 && len(a.Claims) == 0 {
+		v.add("authorization", "needs scopes or claims")
+	}
+	for _, scope := range a.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t") {
+			v.add("authorization.scopes", "invalid scope %q", scope)
+		}
+	}
+	for _, rule := range a.Claims {
+		if rule.Claim == "" {
+			v.add("authorization.claims", "every rule needs a claim")
+		}
+	}
+}
+
+// tokenScopes returns the scopes granted by a token: the space-separated
+// scope claim (RFC 8693) or the scp claim as a string or array
+func tokenScopes(claims map[string]interface{}) map[string]bool {
+	scopes := make(map[string]bool)
+	for _, name := range []string{"scope", "scp"} {
+		for _, s := range claimValues(claims[name]) {
+			for _, scope := range strings.Fields(s) {
+				scopes[scope] = true
+			}
+		}
+	}
+	return scopes
+}
+
+// claimValues flattens a claim into strings; arrays give one per element
+func claimValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, claimValues(item)...)
+		}
+		return values
+	case string:
+		return []string{v}
+	default:
+		return []string{fmt.Sprintf("%v", v)}
+	}
+}
+
+// holds reports whether the claims satisfy the rule
+func (rule ClaimRule) holds(claims map[string]interface{}) bool {
+	values := claimValues(claimValue(claims, rule.Claim))
+	if len(values) == 0 {
+		return false
+	}
+	if len(rule.In) == 0 {
+		return true
+	}
+	for _, v := range values {
+		for _, allowed := range rule.In {
+			if v == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeRequest verifies the bearer token and enforces a route's scope
+// and claim requirements, answering 401 without a valid token and 403 when
+// a requirement is not met
+func authorizeRequest(w http.ResponseWriter, r *http.Request, route Route) bool {
+	a := route.Authorization
+	if a == nil {
+		return true
+	}
+	if !config.settings().JWT.configured() {
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Bearer tokens cannot be verified")
+		return false
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Bearer token required")
+		return false
+	}
+	claims, err := verifyJWT(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gateway", error="invalid_token"`)
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid bearer token: "+err.Error())
+		return false
+	}
+
+	granted := tokenScopes(claims)
+	var missing []string
+	for _, scope := range a.Scopes {
+		if !granted[scope] {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(a.Scopes, " ")))
+		writeErrorDetails(w, r, http.StatusForbidden, ErrCodeForbidden, "Token lacks required scopes",
+			map[string]interface{}{"requiredScopes": a.Scopes, "missingScopes": missing})
+		return false
+	}
+
+	for _, rule := range a.Claims {
+		if !rule.holds(claims) {
+			details := map[string]interface{}{"claim": rule.Claim}
+			if len(rule.In) > 0 {
+				details["allowed"] = rule.In
+			}
+			writeErrorDetails(w, r, http.StatusForbidden, ErrCodeForbidden, "Token claims do not meet the route's requirements", details)
+			return false
+		}
+	}
+
+	requestContext(r).update(func(rc *RequestContext) {
+		rc.Claims = claims
+		if rc.Consumer == "" {
+			rc.AuthMethod, rc.Consumer = AuthMethodJWT, claimString(claims, "sub")
+		}
+	})
+	return true
+}
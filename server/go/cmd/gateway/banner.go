@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigSummary describes the configuration a replica is running
+type ConfigSummary struct {
+	Hash         string    `json:"hash"` // SHA-256 of the effective config, including routes
+	Source       string    `json:"source"`
+	LoadedAt     time.Time `json:"loadedAt"`
+	Listeners    []string  `json:"listeners"`
+	Routes       int       `json:"routes"`
+	ActiveRoutes int       `json:"activeRoutes"`
+	Features     []string  `json:"features"`
+	Overrides    []string  `json:"overrides,omitempty"` // flags and variables overriding the file
+}
+
+// activeConfigState holds the summary of the running configuration
+type activeConfigState struct {
+	mutex   sync.RWMutex
+	summary ConfigSummary
+}
+
+// hash returns the SHA-256 of the effective config
+func (c *Config) hash() string {
+	c.routesMutex.RLock()
+	data, err := json.Marshal(c)
+	c.routesMutex.RUnlock()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// features lists the optional features the config enables
+func (c *Config) features() []string {
+	settings := c.settings()
+	var features []string
+	if settings.EnableRateLimit {
+		features = append(features, "rateLimit")
+	}
+	if settings.Events.Enabled {
+		features = append(features, "events:"+strings.ToLower(settings.Events.Backend))
+	}
+	if settings.GeoIP.CountryDatabase != "" || settings.GeoIP.ASNDatabase != "" {
+		features = append(features, "geoip")
+	}
+	if settings.BotDetection.Enabled {
+		features = append(features, "botDetection")
+	}
+	if settings.UpstreamProxy.URL != "" {
+		features = append(features, "upstreamProxy")
+	}
+	if settings.Dashboard.Enabled {
+		features = append(features, "dashboard")
+	}
+	if settings.Admin.adminAuthConfigured() {
+		features = append(features, "adminAuth")
+	}
+	if fileCrypto != nil {
+		features = append(features, "encryption")
+	}
+	return append(features, "storage:"+settings.Storage.driver())
+}
+
+// summarize describes c as served on the given listeners
+func (c *Config) summarize(listeners []string) ConfigSummary {
+	settings := c.settings()
+	s := ConfigSummary{
+		Hash:      c.hash(),
+		Source:    settings.configFilePath,
+		LoadedAt:  time.Now(),
+		Listeners: listeners,
+		Features:  c.features(),
+	}
+	for _, route := range c.getRoutes() {
+		s.Routes++
+		if route.Active {
+			s.ActiveRoutes++
+		}
+	}
+	for _, o := range settings.overrides {
+		s.Overrides = append(s.Overrides, o.source)
+	}
+	return s
+}
+
+// load records and logs a newly loaded config. Listeners carry over from
+// the previous summary when none are given, since a reload cannot move them.
+func (a *activeConfigState) load(c *Config, listeners []string, reason string) {
+	a.mutex.Lock()
+	if listeners == nil {
+		listeners = a.summary.Listeners
+	}
+	a.summary = c.summarize(listeners)
+	s := a.summary
+	a.mutex.Unlock()
+
+	log.Printf("Config %s: hash=%s source=%s listeners=%s routes=%d active=%d features=%s overrides=%s",
+		reason, s.Hash[:12], s.Source, strings.Join(s.Listeners, ","), s.Routes, s.ActiveRoutes,
+		strings.Join(s.Features, ","), strings.Join(s.Overrides, ","))
+	watches.configChanged()
+}
+
+// routeChanged refreshes the hash and route counts after a route change
+func (a *activeConfigState) routeChanged(change RouteChange) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	loadedAt := a.summary.LoadedAt
+	a.summary = config.summarize(a.summary.Listeners)
+	a.summary.LoadedAt = loadedAt
+}
+
+// get returns the current summary
+func (a *activeConfigState) get() ConfigSummary {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.summary
+}
+
+// handleActiveConfig reports which config revision this replica is running
+func handleActiveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, activeConfig.get())
+}
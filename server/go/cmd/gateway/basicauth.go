@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Basic auth defaults
+const (
+	defaultAuthRealm        = "gateway"
+	defaultAuthUserHeader   = "X-Authenticated-User"
+	defaultBasicAuthCache   = 60
+	htpasswdRecheckInterval = 5 * time.Second
+)
+
+// BasicAuthConfig protects a route with username and password, checked
+// against an htpasswd file and then an LDAP directory, for internal tools
+// that cannot handle tokens. The Authorization header is not forwarded.
+type BasicAuthConfig struct {
+	Realm      string      `json:"realm,omitempty"`
+	File       string      `json:"file,omitempty"`       // htpasswd file with $apr1$ or {SHA} hashes
+	LDAP       *LDAPConfig `json:"ldap,omitempty"`       // bind as the user to check the password
+	UserHeader string      `json:"userHeader,omitempty"` // carries the user upstream; defaults to X-Authenticated-User
+	CacheTTL   int         `json:"cacheTtl,omitempty"`   // seconds a successful login is remembered; defaults to 60, -1 disables
+}
+
+// checkBasicAuth validates a route's basic auth settings
+func checkBasicAuth(b *BasicAuthConfig, v *ValidationError) {
+	if b == nil {
+		return
+	}
+	if b.File == "" && b.LDAP == nil {
+		v.add("basicAuth", "needs a file or ldap")
+	}
+	if b.File != "" {
+		if _, err := os.Stat(b.File); err != nil {
+			v.add("basicAuth.file", "%v", err)
+		}
+	}
+	if b.Realm != "" && strings.ContainsAny(b.Realm, "\"\\") {
+		v.add("basicAuth.realm", "must not contain quotes or backslashes")
+	}
+	if b.CacheTTL < -1 {
+		v.add("basicAuth.cacheTtl", "must be -1 or more")
+	}
+	checkLDAP(b.LDAP, v)
+}
+
+// htpasswdFile holds the users of an htpasswd file, reloaded when the
+// file changes
+type htpasswdFile struct {
+	mutex   sync.Mutex
+	users   map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+// htpasswdFiles caches parsed htpasswd files by path
+var htpasswdFiles = struct {
+	sync.Mutex
+	files map[string]*htpasswdFile
+}{files: make(map[string]*htpasswdFile)}
+
+// loadHtpasswd returns the users of an htpasswd file
+func loadHtpasswd(path string) map[string]string {
+	htpasswdFiles.Lock()
+	f, ok := htpasswdFiles.files[path]
+	if !ok {
+		f = &htpasswdFile{}
+		htpasswdFiles.files[path] = f
+	}
+	htpasswdFiles.Unlock()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if time.Since(f.checked) < htpasswdRecheckInterval {
+		return f.users
+	}
+	f.checked = time.Now()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Failed to read htpasswd file %s: %v", path, err)
+		return f.users
+	}
+	if info.ModTime().Equal(f.modTime) && f.users != nil {
+		return f.users
+	}
+
+	users, err := parseHtpasswd(path)
+	if err != nil {
+		log.Printf("Failed to read htpasswd file %s: %v", path, err)
+		return f.users
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	return users
+}
+
+// parseHtpasswd reads user:hash lines, skipping hashes it cannot check
+func parseHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok {
+			log.Printf("%s:%d: expected user:hash", path, line)
+			continue
+		}
+		if !strings.HasPrefix(hash, "$apr1$") && !strings.HasPrefix(hash, "{SHA}") {
+			log.Printf("%s:%d: unsupported hash for %s; use htpasswd -m or -s", path, line, user)
+			continue
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// checkHtpasswd reports whether password matches an htpasswd hash
+func checkHtpasswd(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		computed = apr1(password, salt)
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// apr1 computes Apache's MD5-based password hash
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+	return magic + salt + "$" + out.String()
+}
+
+// loginCache remembers successful logins so LDAP is not asked on every
+// request. Entries are keyed by a hash of the route, user and password.
+var loginCache = struct {
+	sync.Mutex
+	entries map[[32]byte]time.Time
+}{entries: make(map[[32]byte]time.Time)}
+
+// cachedLogin reports whether a login succeeded within ttl
+func cachedLogin(key [32]byte, ttl time.Duration) bool {
+	loginCache.Lock()
+	defer loginCache.Unlock()
+	at, ok := loginCache.entries[key]
+	if ok && time.Since(at) < ttl {
+		return true
+	}
+	delete(loginCache.entries, key)
+	return false
+}
+
+// rememberLogin records a successful login, dropping expired entries when
+// the cache grows
+func rememberLogin(key [32]byte, ttl time.Duration) {
+	loginCache.Lock()
+	defer loginCache.Unlock()
+	if len(loginCache.entries) >= 10000 {
+		for k, at := range loginCache.entries {
+			if time.Since(at) >= ttl {
+				delete(loginCache.entries, k)
+			}
+		}
+	}
+	loginCache.entries[key] = time.Now()
+}
+
+// checkPassword verifies a user against the htpasswd file, then LDAP
+func (b *BasicAuthConfig) checkPassword(user, password string) (bool, error) {
+	if b.File != "" {
+		if hash, ok := loadHtpasswd(b.File)[user]; ok {
+			return checkHtpasswd(hash, password), nil
+		}
+	}
+	if b.LDAP != nil {
+		return b.LDAP.bind(user, password)
+	}
+	return false, nil
+}
+
+// basicAuthenticate checks a request's basic credentials, answering 401
+// with a challenge when they are missing or wrong
+func basicAuthenticate(w http.ResponseWriter, r *http.Request, route Route) bool {
+	b := route.BasicAuth
+	realm := b.Realm
+	if realm == "" {
+		realm = defaultAuthRealm
+	}
+	challenge := func(message string) bool {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, message)
+		return false
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user == "" {
+		return challenge("Authentication required")
+	}
+
+	ttl := time.Duration(b.CacheTTL) * time.Second
+	if b.CacheTTL == 0 {
+		ttl = defaultBasicAuthCache * time.Second
+	}
+	key := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%s\x00%s", route.ID, user, password)))
+	if ttl <= 0 || !cachedLogin(key, ttl) {
+		valid, err := b.checkPassword(user, password)
+		if err != nil {
+			log.Printf("Basic auth for %s on %s failed: %v", user, route.Path, err)
+			writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Authentication service unavailable")
+			return false
+		}
+		if !valid {
+			return challenge("Invalid username or password")
+		}
+		if ttl > 0 {
+			rememberLogin(key, ttl)
+		}
+	}
+
+	// The password stays at the gateway; the upstream learns the user
+	header := b.UserHeader
+	if header == "" {
+		header = defaultAuthUserHeader
+	}
+	r.Header.Del("Authorization")
+	r.Header.Set(header, user)
+	requestContext(r).setConsumer(AuthMethodBasic, user)
+	return true
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Hashes made with openssl passwd -apr1 -salt abcdefgh secret, and the
+// base64 SHA-1 of hunter2
+const testHtpasswd = `# users
+alice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/
+bob:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=
+carol:plaintext
+`
+
+// useBasicAuth starts a gateway whose route needs basic auth configured by
+// b, answering with the user the upstream was given
+func useBasicAuth(t *testing.T, b BasicAuthConfig) {
+	startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("the Authorization header reached the upstream")
+		}
+		w.Write([]byte(r.Header.Get(defaultAuthUserHeader)))
+	}), func(_ *Config, route *Route) {
+		route.BasicAuth = &b
+	})
+}
+
+// basicAuthRequest sends a request with the given credentials
+func basicAuthRequest(user, password string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/svc/tools", nil)
+	if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	r.Header.Set(defaultAuthUserHeader, "mallory")
+	return serveProxy(r)
+}
+
+func TestBasicAuthHtpasswd(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(file, []byte(testHtpasswd), 0600); err != nil {
+		t.Fatal(err)
+	}
+	useBasicAuth(t, BasicAuthConfig{File: file, CacheTTL: -1})
+
+	for _, tc := range []struct {
+		user, password string
+		want           int
+	}{
+		{"alice", "secret", http.StatusOK},
+		{"bob", "hunter2", http.StatusOK},
+		{"alice", "hunter2", http.StatusUnauthorized},
+		{"carol", "plaintext", http.StatusUnauthorized},
+		{"dave", "secret", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		w := basicAuthRequest(tc.user, tc.password)
+		if w.Code != tc.want {
+			t.Errorf("%s/%s: status %d, want %d", tc.user, tc.password, w.Code, tc.want)
+			continue
+		}
+		if w.Code == http.StatusOK && w.Body.String() != tc.user {
+			t.Errorf("%s: upstream was told the user is %q", tc.user, w.Body.String())
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != `Basic realm="gateway", charset="UTF-8"` {
+			t.Errorf("%s: challenge %q", tc.user, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestBasicAuthLDAP(t *testing.T) {
+	directory := testDirectory(t, "uid=erin,dc=example", "ldap-pass")
+	useBasicAuth(t, BasicAuthConfig{LDAP: directory})
+
+	if w := basicAuthRequest("erin", "ldap-pass"); w.Code != http.StatusOK || w.Body.String() != "erin" {
+		t.Fatalf("valid LDAP login: status %d, user %q", w.Code, w.Body.String())
+	}
+	if w := basicAuthRequest("erin", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong LDAP password: status %d, want 401", w.Code)
+	}
+
+	// A remembered login survives the directory going away; others get 503
+	directory.URL = "ldap://127.0.0.1:1"
+	if w := basicAuthRequest("erin", "ldap-pass"); w.Code != http.StatusOK {
+		t.Fatalf("cached login: status %d, want 200", w.Code)
+	}
+	if w := basicAuthRequest("erin", "other"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("directory down: status %d, want 503", w.Code)
+	}
+}
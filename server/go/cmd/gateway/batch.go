@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBatchOperations bounds the operations in one batch
+const maxBatchOperations = 100
+
+// Batch operations
+const (
+	BatchCreateRoute      = "createRoute"
+	BatchUpdateRoute      = "updateRoute"
+	BatchDeleteRoute      = "deleteRoute"
+	BatchCreateCredential = "createCredential"
+	BatchUpdateCredential = "updateCredential"
+	BatchDeleteCredential = "deleteCredential"
+	BatchUpdateConfig     = "updateConfig"
+)
+
+// BatchRequest is a set of admin operations applied all or nothing
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+	DryRun     bool             `json:"dryRun,omitempty"` // validate without applying
+}
+
+// BatchOperation is one step of a batch. Routes created earlier in the
+// batch may be updated, deleted or granted to credentials by the IDs the
+// dry run reports.
+type BatchOperation struct {
+	Op         string          `json:"op"`
+	Route      *Route          `json:"route,omitempty"`      // createRoute and updateRoute
+	ID         int             `json:"id,omitempty"`         // deleteRoute and deleteCredential
+	Credential *Credential     `json:"credential,omitempty"` // createCredential and updateCredential
+	Config     json.RawMessage `json:"config,omitempty"`     // updateConfig: the settings as for PUT /config
+}
+
+// BatchResult reports what a batch did, or would do on a dry run
+type BatchResult struct {
+	Applied bool                   `json:"applied"`
+	Results []BatchOperationResult `json:"results"`
+}
+
+// BatchOperationResult is the outcome of one operation. A created
+// credential carries its secret, which is not shown again.
+type BatchOperationResult struct {
+	Op         string      `json:"op"`
+	Route      *Route      `json:"route,omitempty"`
+	ID         int         `json:"id,omitempty"`
+	Credential *Credential `json:"credential,omitempty"`
+}
+
+// batchPlan is a batch validated against a staged copy of the state
+type batchPlan struct {
+	config      *Config            // replacement config, nil when the batch keeps it
+	background  backgroundSettings // what background work ran with before
+	routes      []Route
+	nextRouteID int
+	changes     []RouteChange
+	credentials []Credential // to create
+	updated     []Credential // to update, keys and all
+	deleted     []Credential // to delete, as they were
+	previous    []Credential // the updated credentials as they were
+	results     []BatchOperationResult
+}
+
+// routeWrites serializes every change to the route list: the route
+// endpoints, batches and applies, config reloads, replica sync and the
+// controllers. A batch installs the route list it planned against, so a
+// change made by any other writer in between would be lost. Background
+// work is restarted once it is released, as stopping a controller waits
+// for a sync that may be waiting for the lock.
+var routeWrites sync.Mutex
+
+// checkBatchSize reports a batch with no operations or too many
+func checkBatchSize(ops []BatchOperation) error {
+	var v ValidationError
+	if len(ops) == 0 {
+		v.add("operations", "at least one operation is required")
+	}
+	if len(ops) > maxBatchOperations {
+		v.add("operations", "at most %d operations are allowed", maxBatchOperations)
+	}
+	return v.err()
+}
+
+// planBatch validates every operation in order against the state the
+// earlier ones leave, collecting all violations before anything changes
+func planBatch(ops []BatchOperation) (*batchPlan, error) {
+	var v ValidationError
+	cfg := config
+	p := &batchPlan{routes: config.getRoutes()}
+	config.routesMutex.RLock()
+	p.nextRouteID = config.nextRouteID
+	config.routesMutex.RUnlock()
+
+	find := func(id int) int {
+		for i, route := range p.routes {
+			if route.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// Credentials are read from the store when an operation changes one
+	var creds []Credential
+	findCredential := func(id int) (int, error) {
+		if creds == nil {
+			listed, err := store.ListCredentials()
+			if err != nil {
+				return -1, fmt.Errorf("failed to list credentials: %v", err)
+			}
+			creds = append([]Credential{}, listed...)
+		}
+		for i, cred := range creds {
+			if cred.ID == id {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("credential %d does not exist", id)
+	}
+
+	for i, op := range ops {
+		prefix := fmt.Sprintf("operations[%d]", i)
+		result := BatchOperationResult{Op: op.Op}
+		switch op.Op {
+		case BatchCreateRoute, BatchUpdateRoute:
+			if op.Route == nil {
+				v.add(prefix+".route", "is required")
+				continue
+			}
+			route := *op.Route
+			index := -1
+			if op.Op == BatchCreateRoute {
+				route.ID = p.nextRouteID
+			} else if index = find(route.ID); index < 0 {
+				v.add(prefix+".route.id", "route %d does not exist", route.ID)
+				continue
+			} else if p.routes[index].source != "" {
+				v.add(prefix+".route.id", "%s", includedRouteMessage(p.routes[index]))
+				continue
+			}
+			if err := validateRoute(&route, p.routes, cfg); err != nil {
+				addViolations(&v, prefix+".route", err)
+				continue
+			}
+			if index < 0 {
+				p.nextRouteID++
+				p.routes = append(p.routes, route)
+				p.changes = append(p.changes, RouteChange{Kind: RouteCreated, New: &route})
+			} else {
+				old := p.routes[index]
+				p.routes[index] = route
+				p.changes = append(p.changes, RouteChange{Kind: RouteUpdated, Old: &old, New: &route})
+			}
+			result.Route = &route
+
+		case BatchDeleteRoute:
+			index := find(op.ID)
+			if index < 0 {
+				v.add(prefix+".id", "route %d does not exist", op.ID)
+				continue
+			}
+			if p.routes[index].source != "" {
+				v.add(prefix+".id", "%s", includedRouteMessage(p.routes[index]))
+				continue
+			}
+			old := p.routes[index]
+			p.routes = append(p.routes[:index:index], p.routes[index+1:]...)
+			p.changes = append(p.changes, RouteChange{Kind: RouteDeleted, Old: &old})
+			result.ID = op.ID
+
+		case BatchCreateCredential, BatchUpdateCredential:
+			if op.Credential == nil {
+				v.add(prefix+".credential", "is required")
+				continue
+			}
+			cred := *op.Credential
+			var cv ValidationError
+			if strings.TrimSpace(cred.Name) == "" {
+				cv.add("name", "is required")
+			}
+			checkEntitlements(cred, p.routes, &cv)
+			if err := cv.err(); err != nil {
+				addViolations(&v, prefix+".credential", err)
+				continue
+			}
+			if op.Op == BatchCreateCredential {
+				cred.ID = 0
+				cred.LastUsed = nil
+				cred.Enabled = true
+				p.credentials = append(p.credentials, cred)
+				result.Credential = &cred
+				break
+			}
+
+			// Updates change the grants, name and enabled state; the keys stay
+			index, err := findCredential(cred.ID)
+			if err != nil {
+				v.add(prefix+".credential.id", "%v", err)
+				continue
+			}
+			p.previous = append(p.previous, creds[index])
+			updated := creds[index]
+			updated.Name, updated.RouteID, updated.Entitlements, updated.Enabled = cred.Name, cred.RouteID, cred.Entitlements, cred.Enabled
+			creds[index] = updated
+			p.updated = append(p.updated, updated)
+			updated.APISecret = ""
+			result.Credential = &updated
+
+		case BatchDeleteCredential:
+			index, err := findCredential(op.ID)
+			if err != nil {
+				v.add(prefix+".id", "%v", err)
+				continue
+			}
+			p.deleted = append(p.deleted, creds[index])
+			creds = append(creds[:index:index], creds[index+1:]...)
+			result.ID = op.ID
+
+		case BatchUpdateConfig:
+			if p.config != nil {
+				v.add(prefix, "only one updateConfig is allowed per batch")
+				continue
+			}
+			staged, err := stageConfig(prefix+".config", op.Config)
+			if err != nil {
+				addViolations(&v, prefix+".config", err)
+				continue
+			}
+			p.config, cfg = staged, staged
+
+		default:
+			v.add(prefix+".op", "unknown operation %q: use createRoute, updateRoute, deleteRoute, createCredential, updateCredential, deleteCredential or updateConfig", op.Op)
+			continue
+		}
+		p.results = append(p.results, result)
+	}
+	if err := v.err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// stageConfig builds the config an updateConfig operation would install,
+// keeping what PUT /config keeps
+func stageConfig(name string, data json.RawMessage) (*Config, error) {
+	var staged Config
+	if len(data) == 0 {
+		return nil, fmt.Errorf("is required")
+	}
+	if err := decodeConfig(name, data, &staged); err != nil {
+		return nil, err
+	}
+	staged.configFilePath = config.settings().configFilePath
+	if err := staged.applyOverrides(config.settings().overrides); err != nil {
+		return nil, err
+	}
+	if err := staged.validate(); err != nil {
+		return nil, err
+	}
+	if err := checkSecretCommands(&staged); err != nil {
+		return nil, err
+	}
+	return &staged, nil
+}
+
+// addViolations records the violations of err under prefix
+func addViolations(v *ValidationError, prefix string, err error) {
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		v.add(prefix, "%v", err)
+		return
+	}
+	for _, violation := range ve.Violations {
+		v.add(prefix+"."+violation.Field, "%s", violation.Message)
+	}
+}
+
+// applyBatch installs a plan. Routes are persisted in one step, then
+// credentials are created, updated and deleted; if any step fails, the
+// credential changes already made are undone and the previous config and
+// routes restored. A deleted credential is restored with its keys, under a
+// new ID.
+func applyBatch(p *batchPlan) error {
+	p.background = config.backgroundSettings()
+	config.routesMutex.RLock()
+	previous := *config.settings()
+	previousRoutes := append([]Route(nil), config.Routes...)
+	previousNextID := config.nextRouteID
+	config.routesMutex.RUnlock()
+
+	restore := func() {
+		if p.config != nil {
+			config.install(previous, previousRoutes, previousNextID)
+		} else {
+			config.replaceRoutes(previousRoutes, previousNextID)
+		}
+		if p.config != nil {
+			if err := config.save(); err != nil {
+				log.Printf("Batch rollback: failed to restore config: %v", err)
+			}
+		}
+		if len(p.changes) > 0 {
+			if err := store.ReplaceRoutes(previousRoutes); err != nil {
+				log.Printf("Batch rollback: failed to restore routes: %v", err)
+			}
+		}
+	}
+
+	if p.config != nil {
+		config.install(*p.config.settings(), p.routes, p.nextRouteID)
+	} else {
+		config.replaceRoutes(p.routes, p.nextRouteID)
+	}
+	if p.config != nil {
+		if err := config.save(); err != nil {
+			restore()
+			return fmt.Errorf("failed to save config: %v", err)
+		}
+	}
+	if len(p.changes) > 0 {
+		if err := store.ReplaceRoutes(config.getRoutes()); err != nil {
+			restore()
+			return fmt.Errorf("failed to save routes: %v", err)
+		}
+	}
+
+	var created, updated, deleted []Credential
+	undo := func() {
+		for _, c := range deleted {
+			if _, err := store.CreateCredential(c); err != nil {
+				log.Printf("Batch rollback: failed to restore credential %q: %v", c.Name, err)
+			}
+		}
+		// Newest first, so a credential updated twice ends up as it was
+		for i := len(updated) - 1; i >= 0; i-- {
+			if _, err := store.UpdateCredential(p.previous[i]); err != nil {
+				log.Printf("Batch rollback: failed to restore credential %d: %v", p.previous[i].ID, err)
+			}
+		}
+		for _, c := range created {
+			if _, err := store.DeleteCredential(c.ID); err != nil {
+				log.Printf("Batch rollback: failed to delete credential %d: %v", c.ID, err)
+			}
+		}
+		restore()
+	}
+
+	for _, cred := range p.credentials {
+		var err error
+		if cred.APIKey, err = newCredentialToken(16); err == nil {
+			cred.APISecret, err = newCredentialToken(32)
+		}
+		if err == nil {
+			cred.Created = time.Now()
+			cred, err = store.CreateCredential(cred)
+		}
+		if err != nil {
+			undo()
+			return fmt.Errorf("failed to create credential %q: %v", cred.Name, err)
+		}
+		created = append(created, cred)
+	}
+	for _, cred := range p.updated {
+		found, err := store.UpdateCredential(cred)
+		if err == nil && !found {
+			err = fmt.Errorf("not found")
+		}
+		if err != nil {
+			undo()
+			return fmt.Errorf("failed to update credential %d: %v", cred.ID, err)
+		}
+		updated = append(updated, cred)
+	}
+	for _, cred := range p.deleted {
+		if _, err := store.DeleteCredential(cred.ID); err != nil {
+			undo()
+			return fmt.Errorf("failed to delete credential %d: %v", cred.ID, err)
+		}
+		deleted = append(deleted, cred)
+	}
+
+	// Report created credentials in operation order
+	for i := range p.results {
+		if p.results[i].Op == BatchCreateCredential {
+			cred := created[0]
+			created = created[1:]
+			p.results[i].Credential = &cred
+		}
+	}
+	return nil
+}
+
+// replaceRoutes swaps in a route list and the next route ID to hand out
+func (c *Config) replaceRoutes(routes []Route, nextRouteID int) {
+	c.routesMutex.Lock()
+	defer c.routesMutex.Unlock()
+	c.storeRoutes(routes, nextRouteID)
+}
+
+// announceBatch applies the side effects of an applied batch, as the
+// single-entity endpoints do, except restarting background work, which
+// waits until routeWrites is released
+func announceBatch(p *batchPlan) {
+	if p.config != nil {
+		routeLookups.purge()
+		config.configureLogging()
+		traffic.configure(config.settings().Recording)
+		proxy.resetTransports()
+		activeConfig.load(config, nil, "reloaded")
+	}
+	for _, change := range p.changes {
+		routeChanges.notify(change)
+		switch change.Kind {
+		case RouteCreated:
+			events.emit(EventRouteCreated, *change.New)
+		case RouteUpdated:
+			events.emit(EventRouteUpdated, *change.New)
+		case RouteDeleted:
+			events.emit(EventRouteDeleted, map[string]int{"id": change.Old.ID})
+		}
+	}
+	if len(p.credentials)+len(p.updated)+len(p.deleted) > 0 {
+		apiKeys.invalidate()
+	}
+}
+
+// handleBatch validates a set of admin operations up front and applies
+// them all or not at all
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if err := checkBatchSize(req.Operations); err != nil {
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Batch is invalid; nothing was applied", err.(*ValidationError).Violations)
+		return
+	}
+
+	routeWrites.Lock()
+	plan, err := planBatch(req.Operations)
+	if err != nil {
+		routeWrites.Unlock()
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Batch is invalid; nothing was applied", err.(*ValidationError).Violations)
+		return
+	}
+	if req.DryRun {
+		routeWrites.Unlock()
+		writeJSON(w, BatchResult{Results: plan.results})
+		return
+	}
+
+	if err := applyBatch(plan); err != nil {
+		routeWrites.Unlock()
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Batch was rolled back: %v", err))
+		return
+	}
+	announceBatch(plan)
+	routeWrites.Unlock()
+	if plan.config != nil {
+		restartBackground(plan.background, config)
+	}
+	log.Printf("Applied admin batch of %d operations", len(req.Operations))
+	writeJSON(w, BatchResult{Applied: true, Results: plan.results})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingDeletes is a store whose credential deletions fail
+type failingDeletes struct {
+	Store
+}
+
+func (failingDeletes) DeleteCredential(id int) (bool, error) {
+	return false, errors.New("disk full")
+}
+
+func TestBatchRollback(t *testing.T) {
+	cfg := startTestGateway(t, http.NotFoundHandler(), nil)
+	s, err := newStore(cfg.Storage, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	prevStore := store
+	store = failingDeletes{s}
+	defer func() { store = prevStore }()
+
+	kept, err := s.CreateCredential(Credential{Name: "kept", RouteID: 1, APIKey: "key-1", Created: time.Now(), Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doomed, err := s.CreateCredential(Credential{Name: "doomed", RouteID: 1, APIKey: "key-2", Created: time.Now(), Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The credential is updated twice before the deletion fails
+	body, _ := json.Marshal(BatchRequest{Operations: []BatchOperation{
+		{Op: BatchCreateRoute, Route: &Route{Path: "/new", Target: "http://127.0.0.1:1", Methods: []string{"GET"}}},
+		{Op: BatchUpdateCredential, Credential: &Credential{ID: kept.ID, Name: "first", RouteID: 1, Enabled: true}},
+		{Op: BatchUpdateCredential, Credential: &Credential{ID: kept.ID, Name: "second", RouteID: 1, Enabled: false}},
+		{Op: BatchDeleteCredential, ID: doomed.ID},
+	}})
+	w := httptest.NewRecorder()
+	handleBatch(w, httptest.NewRequest("POST", "/batch", bytes.NewReader(body)))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500 for a failed deletion: %s", w.Code, w.Body)
+	}
+
+	creds, err := s.ListCredentials()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creds) != 2 || creds[0].Name != "kept" || !creds[0].Enabled {
+		t.Fatalf("credentials %+v after rollback, want both as they were", creds)
+	}
+	if routes := config.getRoutes(); len(routes) != 1 || routes[0].Path != "/svc" {
+		t.Fatalf("routes %+v after rollback, want only /svc", routes)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxInspectedBodySize caps request bodies buffered for logging or validation
+const maxInspectedBodySize = 1 << 20
+
+// defaultBodyLogBytes is how much of a body is logged by default
+const defaultBodyLogBytes = 2048
+
+// redactedValue replaces redacted fields in logged bodies
+const redactedValue = "***"
+
+// BodyLoggingConfig configures logging of request bodies for a route
+type BodyLoggingConfig struct {
+	Enabled  bool     `json:"enabled"`
+	MaxBytes int      `json:"maxBytes,omitempty"`
+	Redact   []string `json:"redact,omitempty"` // dotted JSON paths or XPath expressions for XML
+}
+
+// inspectRequestBody buffers the request body when the route logs or
+// validates it. It returns false if the request has been answered. Bodies
+// over maxInspectedBodySize are only rejected when they must be validated;
+// otherwise their prefix is logged and the whole body is passed on.
+func inspectRequestBody(w http.ResponseWriter, r *http.Request, route Route) bool {
+	logging := route.BodyLogging != nil && route.BodyLogging.Enabled
+	if capture, set := captureSampled(r); set {
+		logging = logging && capture
+	}
+	if !logging && route.XMLValidation == nil {
+		return true
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		if route.XMLValidation != nil && methodHasBody(r.Method) {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, "XML request body required")
+			return false
+		}
+		return true
+	}
+
+	body := r.Body
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxInspectedBodySize+1))
+	if err != nil {
+		body.Close()
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, "Failed to read request body")
+		return false
+	}
+	isXML := isXMLContentType(r.Header.Get("Content-Type"))
+
+	if len(data) > maxInspectedBodySize {
+		if route.XMLValidation != nil {
+			body.Close()
+			writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large")
+			return false
+		}
+		// Stream what was read, then the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		logRequestBodyPrefix(r, route.BodyLogging, data)
+		return true
+	}
+	body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if route.XMLValidation != nil && (len(data) > 0 || methodHasBody(r.Method)) {
+		if !isXML {
+			writeError(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Expected an XML request body")
+			return false
+		}
+		if soapNS, err := validateXMLBody(data, route.XMLValidation); err != nil {
+			log.Printf("Rejected XML body for %s %s: %v", r.Method, r.URL.Path, err)
+			if soapNS != "" {
+				writeSOAPFault(w, soapNS, err.Error())
+			} else {
+				writeError(w, r, http.StatusBadRequest, ErrCodeValidationFailed, err.Error())
+			}
+			return false
+		}
+	}
+
+	if logging {
+		logRequestBody(r, route.BodyLogging, data, isXML)
+	}
+
+	return true
+}
+
+// peekRequestBody reads a request body of up to maxInspectedBodySize
+// bytes and puts it back for the upstream. It returns false if the body
+// could not be read or is too large; a large body is passed on whole.
+func peekRequestBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	body := r.Body
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxInspectedBodySize+1))
+	if err != nil || len(data) > maxInspectedBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), body), body}
+		return nil, false
+	}
+	body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	return data, true
+}
+
+// methodHasBody reports whether requests with this method normally carry a body
+func methodHasBody(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// logRequestBody logs a redacted, truncated copy of a request body
+func logRequestBody(r *http.Request, cfg *BodyLoggingConfig, data []byte, isXML bool) {
+	redacted, err := redactBody(data, cfg.Redact, isXML)
+	if err != nil {
+		// Never log a body we could not redact
+		log.Printf("Request body for %s %s (%d bytes) not logged: %v", r.Method, r.URL.Path, len(data), err)
+		return
+	}
+
+	limit := bodyLogLimit(cfg)
+	suffix := ""
+	if len(redacted) > limit {
+		redacted = redacted[:limit]
+		suffix = "...(truncated)"
+	}
+
+	log.Printf("Request body for %s %s: %s%s", r.Method, r.URL.Path, redacted, suffix)
+}
+
+// logRequestBodyPrefix logs the start of a body too large to buffer. A
+// partial document cannot be redacted, so nothing is logged for routes
+// with redaction paths.
+func logRequestBodyPrefix(r *http.Request, cfg *BodyLoggingConfig, prefix []byte) {
+	if len(cfg.Redact) > 0 {
+		log.Printf("Request body for %s %s (over %d bytes) not logged: too large to redact", r.Method, r.URL.Path, maxInspectedBodySize)
+		return
+	}
+	if limit := bodyLogLimit(cfg); len(prefix) > limit {
+		prefix = prefix[:limit]
+	}
+	log.Printf("Request body for %s %s: %s...(truncated)", r.Method, r.URL.Path, prefix)
+}
+
+// bodyLogLimit returns how many bytes of a body are logged
+func bodyLogLimit(cfg *BodyLoggingConfig) int {
+	if cfg.MaxBytes <= 0 {
+		return defaultBodyLogBytes
+	}
+	return cfg.MaxBytes
+}
+
+// redactBody applies redaction paths to a JSON or XML body
+func redactBody(data []byte, paths []string, isXML bool) ([]byte, error) {
+	if len(paths) == 0 || len(data) == 0 {
+		return data, nil
+	}
+
+	if isXML {
+		exprs := make([]xpathExpr, 0, len(paths))
+		for _, p := range paths {
+			if !isXPath(p) {
+				continue
+			}
+			x, err := parseXPath(p)
+			if err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, x)
+		}
+		return redactXML(data, exprs)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if !isXPath(p) {
+			redactJSONValue(value, strings.Split(p, "."))
+		}
+	}
+	return json.Marshal(value)
+}
+
+// redactJSONValue replaces the value at a dotted path; "*" matches every
+// element of an array
+func redactJSONValue(value interface{}, parts []string) {
+	if len(parts) == 0 {
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		child, ok := v[parts[0]]
+		if !ok {
+			return
+		}
+		if len(parts) == 1 {
+			v[parts[0]] = redactedValue
+			return
+		}
+		redactJSONValue(child, parts[1:])
+	case []interface{}:
+		for i := range v {
+			if parts[0] != "*" && parts[0] != strconv.Itoa(i) {
+				continue
+			}
+			if len(parts) == 1 {
+				v[i] = redactedValue
+			} else {
+				redactJSONValue(v[i], parts[1:])
+			}
+		}
+	}
+}
+
+// validateBodyRules checks body logging and XML validation settings
+func validateBodyRules(route Route) error {
+	if route.BodyLogging != nil {
+		for _, p := range route.BodyLogging.Redact {
+			if isXPath(p) {
+				if _, err := parseXPath(p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if route.XMLValidation != nil {
+		for _, p := range route.XMLValidation.RequiredPaths {
+			if _, err := parseXPath(p); err != nil {
+				return err
+			}
+		}
+		if path := route.XMLValidation.Schema; path != "" {
+			if _, err := loadXSD(path); err != nil {
+				return fmt.Errorf("xmlValidation.schema %s: %v", path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bot mitigation actions
+const (
+	BotActionOff       = "off"
+	BotActionLog       = "log"
+	BotActionChallenge = "challenge"
+	BotActionBlock     = "block"
+)
+
+// validBotAction reports whether action is a known bot mitigation action
+func validBotAction(action string) bool {
+	switch action {
+	case BotActionOff, BotActionLog, BotActionChallenge, BotActionBlock:
+		return true
+	}
+	return false
+}
+
+// botChallengeCookie is set by the challenge page and checked on retry
+const botChallengeCookie = "gw_bot_check"
+
+// defaultBotChallengeTTL is how long a solved challenge lets a client through
+const defaultBotChallengeTTL = time.Hour
+
+// BotConfig configures bot and scraper detection
+type BotConfig struct {
+	Enabled           bool     `json:"enabled"`
+	Action            string   `json:"action"`            // default action: log, challenge or block
+	BlockedUserAgents []string `json:"blockedUserAgents"` // case-insensitive substrings
+	AllowedUserAgents []string `json:"allowedUserAgents"` // bypass detection entirely
+	RequiredHeaders   []string `json:"requiredHeaders"`   // headers every real browser sends
+	MaxRequestsPerIP  int      `json:"maxRequestsPerIP"`  // per rate window, 0 disables
+	RateWindow        int      `json:"rateWindow"`        // seconds
+	ChallengeSecret   string   `json:"challengeSecret,omitempty"`
+	ChallengeTTL      int      `json:"challengeTtl,omitempty"` // seconds a solved challenge is honored; defaults to 3600
+}
+
+// BotDetector applies bot heuristics to incoming requests
+type BotDetector struct {
+	cfg          BotConfig
+	secret       []byte
+	window       time.Duration
+	challengeTTL time.Duration
+
+	counters map[string]*ipCounter
+	mu       sync.Mutex
+}
+
+// ipCounter counts requests from one IP in the current window
+type ipCounter struct {
+	start time.Time
+	count int
+}
+
+// botPruneJob drops the request counters of idle IPs
+const botPruneJob = "bot-counter-pruning"
+
+// newBotDetector creates a detector, or returns nil if detection is disabled
+func newBotDetector(ctx context.Context, cfg BotConfig) *BotDetector {
+	jobs.remove(botPruneJob)
+	if !cfg.Enabled {
+		return nil
+	}
+
+	if cfg.Action == "" {
+		cfg.Action = BotActionLog
+	}
+
+	window := time.Duration(cfg.RateWindow) * time.Second
+	if window <= 0 {
+		window = time.Minute
+	}
+
+	secret := []byte(cfg.ChallengeSecret)
+	if len(secret) == 0 {
+		// Challenges only need to survive for the life of the process
+		secret = make([]byte, 32)
+		rand.Read(secret)
+	}
+
+	challengeTTL := time.Duration(cfg.ChallengeTTL) * time.Second
+	if challengeTTL <= 0 {
+		challengeTTL = defaultBotChallengeTTL
+	}
+
+	d := &BotDetector{
+		cfg:          cfg,
+		secret:       secret,
+		window:       window,
+		challengeTTL: challengeTTL,
+		counters:     make(map[string]*ipCounter),
+	}
+
+	if cfg.MaxRequestsPerIP > 0 {
+		jobs.start(ctx, jobSpec{
+			name:     botPruneJob,
+			interval: every(window),
+			run: func(_ context.Context, now time.Time) error {
+				d.pruneCounters(now)
+				return nil
+			},
+		})
+	}
+
+	return d
+}
+
+// detect returns the reason a request looks automated, or "" if it does not
+func (d *BotDetector) detect(r *http.Request, ip string) string {
+	ua := strings.ToLower(r.UserAgent())
+
+	for _, allowed := range d.cfg.AllowedUserAgents {
+		if allowed != "" && strings.Contains(ua, strings.ToLower(allowed)) {
+			return ""
+		}
+	}
+
+	for _, blocked := range d.cfg.BlockedUserAgents {
+		if blocked != "" && strings.Contains(ua, strings.ToLower(blocked)) {
+			return "user-agent"
+		}
+	}
+
+	for _, header := range d.cfg.RequiredHeaders {
+		if r.Header.Get(header) == "" {
+			return "missing-header"
+		}
+	}
+
+	if d.cfg.MaxRequestsPerIP > 0 && d.countRequest(ip) > d.cfg.MaxRequestsPerIP {
+		return "request-rate"
+	}
+
+	return ""
+}
+
+// countRequest records a request from ip and returns the count in the current window
+func (d *BotDetector) countRequest(ip string) int {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counter, exists := d.counters[ip]
+	if !exists || now.Sub(counter.start) >= d.window {
+		counter = &ipCounter{start: now}
+		d.counters[ip] = counter
+	}
+	counter.count++
+
+	return counter.count
+}
+
+// pruneCounters removes counters for idle IPs
+func (d *BotDetector) pruneCounters(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ip, counter := range d.counters {
+		if now.Sub(counter.start) >= d.window {
+			delete(d.counters, ip)
+		}
+	}
+}
+
+// check runs detection for the route and applies the configured action.
+// It returns false if the request has been answered and must not be proxied.
+func (d *BotDetector) check(w http.ResponseWriter, r *http.Request, route Route) bool {
+	if d == nil {
+		return true
+	}
+
+	action := d.cfg.Action
+	if route.BotAction != "" {
+		action = route.BotAction
+	}
+	if action == BotActionOff {
+		return true
+	}
+
+	ip := clientIP(r).String()
+	reason := d.detect(r, ip)
+	if reason == "" {
+		return true
+	}
+
+	// Clients that already solved a challenge are let through
+	if action == BotActionChallenge && d.validChallenge(r, ip) {
+		return true
+	}
+
+	proxy.recordBotDetection(reason)
+	requestContext(r).set("botReason", reason)
+	log.Printf("Bot detected (%s) from %s on %s %s, action=%s", reason, ip, r.Method, r.URL.Path, action)
+
+	switch action {
+	case BotActionBlock:
+		writeError(w, r, http.StatusForbidden, ErrCodeBotBlocked, "Forbidden")
+		return false
+	case BotActionChallenge:
+		d.writeChallenge(w, ip)
+		return false
+	}
+
+	return true
+}
+
+// challengeToken signs ip and the time the challenge was issued; the
+// cookie value is <issued unix time>.<signature>
+func (d *BotDetector) challengeToken(ip string, issued int64) string {
+	stamp := strconv.FormatInt(issued, 10)
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write([]byte(ip + "|" + stamp))
+	return stamp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validChallenge checks whether the request carries a solved challenge
+// cookie for its IP that has not expired
+func (d *BotDetector) validChallenge(r *http.Request, ip string) bool {
+	cookie, err := r.Cookie(botChallengeCookie)
+	if err != nil {
+		return false
+	}
+	stamp, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	issued, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(issued, 0))
+	if age > d.challengeTTL || age < -time.Minute {
+		return false
+	}
+	return hmac.Equal([]byte(cookie.Value), []byte(d.challengeToken(ip, issued)))
+}
+
+// writeChallenge answers with a page that sets the challenge cookie and
+// reloads; clients that ignore cookies never get past it
+func (d *BotDetector) writeChallenge(w http.ResponseWriter, ip string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     botChallengeCookie,
+		Value:    d.challengeToken(ip, time.Now().Unix()),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(d.challengeTTL / time.Second),
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Refresh", "1")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, "<!DOCTYPE html><html><head><title>Checking your browser</title></head>"+
+		"<body><p>Checking your browser, you will be redirected shortly.</p></body></html>")
+}
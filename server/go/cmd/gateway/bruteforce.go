@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Brute-force protection defaults
+const (
+	defaultMaxAuthFailures   = 5
+	defaultAuthFailureWindow = 300
+	defaultAuthLockout       = 30
+	defaultMaxAuthLockout    = 3600
+	defaultStuffingThreshold = 10
+	defaultChallengeHeader   = "X-Captcha-Required"
+)
+
+// Actions taken against locked-out clients
+const (
+	LockoutActionBlock     = "block"
+	LockoutActionChallenge = "challenge"
+)
+
+// Identifier sources naming the account a login attempt is for
+const (
+	identifierJSON   = "json:"
+	identifierForm   = "form:"
+	identifierHeader = "header:"
+	identifierBasic  = "basic"
+)
+
+// maxAuthFailureRecords caps the failure records kept. At the cap expired
+// records are pruned, then the oldest are evicted down to
+// authFailureRecordsAfterEviction so eviction does not run on every failure.
+const (
+	maxAuthFailureRecords           = 10000
+	authFailureRecordsAfterEviction = maxAuthFailureRecords * 9 / 10
+)
+
+// BruteForceConfig tracks failed logins on an auth route per client IP and
+// per account. Too many failures lock the IP or account out for a period
+// that doubles with each lockout; one IP failing for many accounts is
+// flagged as credential stuffing.
+type BruteForceConfig struct {
+	Identifier        string `json:"identifier,omitempty"`        // json:username, form:user, header:X-User or basic
+	FailureStatuses   []int  `json:"failureStatuses,omitempty"`   // defaults to 401 and 403
+	MaxFailures       int    `json:"maxFailures,omitempty"`       // within the window before a lockout; defaults to 5
+	Window            int    `json:"window,omitempty"`            // seconds; defaults to 300
+	Lockout           int    `json:"lockout,omitempty"`           // seconds of the first lockout; defaults to 30
+	MaxLockout        int    `json:"maxLockout,omitempty"`        // seconds; defaults to 3600
+	StuffingThreshold int    `json:"stuffingThreshold,omitempty"` // accounts failing from one IP within the window; defaults to 10
+	Action            string `json:"action,omitempty"`            // block (default) or challenge
+	ChallengeHeader   string `json:"challengeHeader,omitempty"`   // tells the upstream and client a CAPTCHA is required; defaults to X-Captcha-Required
+}
+
+// checkBruteForce validates a route's brute-force settings
+func checkBruteForce(b *BruteForceConfig, v *ValidationError) {
+	if b == nil {
+		return
+	}
+	switch {
+	case b.Identifier == "", b.Identifier == identifierBasic:
+	case strings.HasPrefix(b.Identifier, identifierJSON) && len(b.Identifier) > len(identifierJSON):
+	case strings.HasPrefix(b.Identifier, identifierForm) && len(b.Identifier) > len(identifierForm):
+	case strings.HasPrefix(b.Identifier, identifierHeader) && len(b.Identifier) > len(identifierHeader):
+	default:
+		v.add("bruteForce.identifier", "unknown source %q: use json:<field>, form:<field>, header:<name> or basic", b.Identifier)
+	}
+	for _, status := range b.FailureStatuses {
+		if status < 400 || status > 599 {
+			v.add("bruteForce.failureStatuses", "%d is not an error status", status)
+		}
+	}
+	if b.MaxFailures < 0 || b.Window < 0 || b.Lockout < 0 || b.MaxLockout < 0 || b.StuffingThreshold < 0 {
+		v.add("bruteForce", "limits must not be negative")
+	}
+	if b.MaxLockout > 0 && b.MaxLockout < b.lockout() {
+		v.add("bruteForce.maxLockout", "must be at least the first lockout")
+	}
+	switch b.Action {
+	case "", LockoutActionBlock, LockoutActionChallenge:
+	default:
+		v.add("bruteForce.action", "unknown action %q: use block or challenge", b.Action)
+	}
+}
+
+// maxFailures returns the failures allowed within the window
+func (b *BruteForceConfig) maxFailures() int {
+	if b.MaxFailures == 0 {
+		return defaultMaxAuthFailures
+	}
+	return b.MaxFailures
+}
+
+// window returns the period failures are counted over
+func (b *BruteForceConfig) window() time.Duration {
+	if b.Window == 0 {
+		return defaultAuthFailureWindow * time.Second
+	}
+	return time.Duration(b.Window) * time.Second
+}
+
+// lockout returns the first lockout in seconds
+func (b *BruteForceConfig) lockout() int {
+	if b.Lockout == 0 {
+		return defaultAuthLockout
+	}
+	return b.Lockout
+}
+
+// lockoutFor returns the length of the nth lockout, doubling each time
+func (b *BruteForceConfig) lockoutFor(n int) time.Duration {
+	max := b.MaxLockout
+	if max == 0 {
+		max = defaultMaxAuthLockout
+	}
+	seconds := b.lockout()
+	for i := 1; i < n && seconds < max; i++ {
+		seconds *= 2
+	}
+	if seconds > max {
+		seconds = max
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// stuffingThreshold returns how many accounts may fail from one IP
+func (b *BruteForceConfig) stuffingThreshold() int {
+	if b.StuffingThreshold == 0 {
+		return defaultStuffingThreshold
+	}
+	return b.StuffingThreshold
+}
+
+// challengeHeader returns the header signalling a required CAPTCHA
+func (b *BruteForceConfig) challengeHeader() string {
+	if b.ChallengeHeader == "" {
+		return defaultChallengeHeader
+	}
+	return b.ChallengeHeader
+}
+
+// failed reports whether a response status is a failed login
+func (b *BruteForceConfig) failed(status int) bool {
+	if len(b.FailureStatuses) == 0 {
+		return status == http.StatusUnauthorized || status == http.StatusForbidden
+	}
+	for _, s := range b.FailureStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// identifier returns the account a login attempt is for, or ""
+func (b *BruteForceConfig) identifier(r *http.Request) string {
+	switch {
+	case b.Identifier == identifierBasic:
+		user, _, _ := r.BasicAuth()
+		return user
+	case strings.HasPrefix(b.Identifier, identifierHeader):
+		return r.Header.Get(strings.TrimPrefix(b.Identifier, identifierHeader))
+	case strings.HasPrefix(b.Identifier, identifierJSON):
+		data, ok := peekRequestBody(r)
+		if !ok || len(data) == 0 {
+			return ""
+		}
+		var body map[string]interface{}
+		if json.Unmarshal(data, &body) != nil {
+			return ""
+		}
+		if s, ok := claimValue(body, strings.TrimPrefix(b.Identifier, identifierJSON)).(string); ok {
+			return s
+		}
+	case strings.HasPrefix(b.Identifier, identifierForm):
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/x-www-form-urlencoded" {
+			return ""
+		}
+		data, ok := peekRequestBody(r)
+		if !ok {
+			return ""
+		}
+		form, _ := url.ParseQuery(string(data))
+		return form.Get(strings.TrimPrefix(b.Identifier, identifierForm))
+	}
+	return ""
+}
+
+// failureRecord counts the failed logins of one IP or account
+type failureRecord struct {
+	failures    int
+	windowStart time.Time
+	lockouts    int
+	lockedUntil time.Time
+	lastFailure time.Time
+	accounts    map[string]bool // IP records: accounts that failed this window
+	stuffing    bool            // IP records: flagged this window
+}
+
+// authFailures holds failure records keyed by route and IP or account
+var authFailures = struct {
+	sync.Mutex
+	records map[string]*failureRecord
+}{records: make(map[string]*failureRecord)}
+
+// lockedFor returns how long the longest of the records' lockouts lasts
+func lockedFor(keys []string) time.Duration {
+	authFailures.Lock()
+	defer authFailures.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if rec, ok := authFailures.records[key]; ok {
+			if d := time.Until(rec.lockedUntil); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// lock starts a record's next lockout, announcing it
+func (b *BruteForceConfig) lock(rec *failureRecord, route Route, eventType, kind, value string) {
+	rec.lockouts++
+	rec.failures = 0
+	d := b.lockoutFor(rec.lockouts)
+	rec.lockedUntil = time.Now().Add(d)
+
+	log.Printf("Locked out %s %s on %s for %v (%s)", kind, value, route.Path, d, eventType)
+	proxy.recordAuthLockout(route.Path)
+	events.emit(eventType, map[string]interface{}{
+		"routeId": route.ID,
+		"path":    route.Path,
+		kind:      value,
+		"lockout": int(d.Seconds()),
+	})
+}
+
+// recordAuthFailure counts a failed login against the IP and account
+func (b *BruteForceConfig) recordAuthFailure(route Route, ip, account string) {
+	authFailures.Lock()
+	defer authFailures.Unlock()
+
+	now := time.Now()
+	// Each failure may add an IP and an account record
+	if len(authFailures.records)+2 > maxAuthFailureRecords {
+		for key, rec := range authFailures.records {
+			if now.After(rec.lockedUntil) && now.Sub(rec.lastFailure) > b.lockoutFor(rec.lockouts)+b.window() {
+				delete(authFailures.records, key)
+			}
+		}
+		if len(authFailures.records)+2 > maxAuthFailureRecords {
+			evictAuthFailures(now)
+		}
+	}
+
+	count := func(key string) *failureRecord {
+		rec, ok := authFailures.records[key]
+		if !ok {
+			rec = &failureRecord{}
+			authFailures.records[key] = rec
+		}
+		// Lockouts stop escalating once a client has been quiet for the
+		// longest lockout
+		if rec.lockouts > 0 && now.Sub(rec.lastFailure) > b.lockoutFor(rec.lockouts+1)+b.window() {
+			rec.lockouts = 0
+		}
+		if now.Sub(rec.windowStart) > b.window() {
+			rec.windowStart = now
+			rec.failures = 0
+			rec.accounts = nil
+			rec.stuffing = false
+		}
+		rec.failures++
+		rec.lastFailure = now
+		return rec
+	}
+
+	ipRec := count(fmt.Sprintf("%d|ip=%s", route.ID, ip))
+	if account != "" {
+		if ipRec.accounts == nil {
+			ipRec.accounts = make(map[string]bool)
+		}
+		if len(ipRec.accounts) < b.stuffingThreshold() {
+			ipRec.accounts[account] = true
+		}
+		if len(ipRec.accounts) >= b.stuffingThreshold() && !ipRec.stuffing {
+			ipRec.stuffing = true
+			b.lock(ipRec, route, EventCredentialStuffing, "ip", ip)
+		}
+	}
+	if ipRec.failures >= b.maxFailures() && now.After(ipRec.lockedUntil) {
+		b.lock(ipRec, route, EventAuthLockout, "ip", ip)
+	}
+
+	if account != "" {
+		accountRec := count(fmt.Sprintf("%d|account=%s", route.ID, account))
+		if accountRec.failures >= b.maxFailures() && now.After(accountRec.lockedUntil) {
+			b.lock(accountRec, route, EventAuthLockout, "account", account)
+		}
+	}
+	proxy.recordAuthFailure(route.Path)
+}
+
+// evictAuthFailures drops the records whose last failure is oldest,
+// keeping active lockouts as long as there are other records to drop.
+// The caller holds the lock.
+func evictAuthFailures(now time.Time) {
+	keys := make([]string, 0, len(authFailures.records))
+	for key := range authFailures.records {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := authFailures.records[keys[i]], authFailures.records[keys[j]]
+		if aLocked, bLocked := now.Before(a.lockedUntil), now.Before(b.lockedUntil); aLocked != bLocked {
+			return bLocked
+		}
+		return a.lastFailure.Before(b.lastFailure)
+	})
+	evict := len(keys) - authFailureRecordsAfterEviction
+	for _, key := range keys[:evict] {
+		delete(authFailures.records, key)
+	}
+	log.Printf("Auth failure records at the cap of %d, evicted the %d oldest", maxAuthFailureRecords, evict)
+}
+
+// recordAuthSuccess clears an account's failures after a good login
+func recordAuthSuccess(route Route, account string) {
+	authFailures.Lock()
+	delete(authFailures.records, fmt.Sprintf("%d|account=%s", route.ID, account))
+	authFailures.Unlock()
+}
+
+// guardAuth refuses clients locked out of an auth route with 429, or flags
+// that a CAPTCHA is required, and returns a function counting the outcome
+// of the attempt. It reports false if the request has been answered.
+func guardAuth(w http.ResponseWriter, r *http.Request, route Route) (http.ResponseWriter, func(), bool) {
+	b := route.BruteForce
+	if b == nil {
+		return w, func() {}, true
+	}
+
+	ip := clientIP(r).String()
+	account := b.identifier(r)
+	keys := []string{fmt.Sprintf("%d|ip=%s", route.ID, ip)}
+	if account != "" {
+		keys = append(keys, fmt.Sprintf("%d|account=%s", route.ID, account))
+	}
+
+	// Only the gateway decides whether a CAPTCHA is required
+	header := b.challengeHeader()
+	r.Header.Del(header)
+	if wait := lockedFor(keys); wait > 0 {
+		if b.Action != LockoutActionChallenge {
+			seconds := int(wait/time.Second) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			writeErrorDetails(w, r, http.StatusTooManyRequests, ErrCodeLockedOut, "Too many failed login attempts",
+				map[string]interface{}{"retryAfter": seconds})
+			return w, nil, false
+		}
+		r.Header.Set(header, "true")
+		w.Header().Set(header, "true")
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		status := rec.statusCode()
+		switch {
+		case b.failed(status):
+			b.recordAuthFailure(route, ip, account)
+		case status < 400 && account != "":
+			recordAuthSuccess(route, account)
+		}
+	}, true
+}
+
+// recordAuthFailure counts a failed login on a route
+func (p *Proxy) recordAuthFailure(path string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	routeStat.AuthFailures++
+	p.stats.RouteStats[path] = routeStat
+}
+
+// recordAuthLockout counts a lockout on a route
+func (p *Proxy) recordAuthLockout(path string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	routeStat.AuthLockouts++
+	p.stats.RouteStats[path] = routeStat
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Buffering defaults
+const (
+	defaultMaxBufferedBody = 64 << 10
+	defaultBufferMemory    = 64 << 20
+)
+
+// BufferingConfig controls how a route's request bodies reach the upstream.
+// Bodies up to MaxBufferedBody are read fully so they can be replayed on
+// retry; larger bodies are streamed.
+type BufferingConfig struct {
+	MaxBufferedBody        int64 `json:"maxBufferedBody,omitempty"`        // bytes; defaults to 64 KiB
+	MaxBody                int64 `json:"maxBody,omitempty"`                // reject larger bodies; 0 allows any size
+	Retries                int   `json:"retries,omitempty"`                // retries after connection failures, for replayable requests
+	MaxResponseHeaderBytes int64 `json:"maxResponseHeaderBytes,omitempty"` // limit on upstream response headers
+}
+
+// BufferPoolConfig caps the memory used by buffered request bodies across
+// all routes
+type BufferPoolConfig struct {
+	MaxMemory int64  `json:"maxMemory,omitempty"` // bytes; defaults to 64 MiB
+	SpillDir  string `json:"spillDir,omitempty"`  // buffer to temp files here once memory is full; empty rejects
+}
+
+// bufferPool accounts for the memory held by buffered bodies
+type bufferPool struct {
+	mutex sync.Mutex
+	used  int64
+}
+
+// bodyBuffers tracks buffered request bodies
+var bodyBuffers = &bufferPool{}
+
+// reserve claims n bytes of buffer memory, reporting false if the
+// configured maximum would be exceeded
+func (p *bufferPool) reserve(n, max int64) bool {
+	if max <= 0 {
+		max = defaultBufferMemory
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.used+n > max {
+		return false
+	}
+	p.used += n
+	return true
+}
+
+// release returns n bytes of buffer memory
+func (p *bufferPool) release(n int64) {
+	p.mutex.Lock()
+	p.used -= n
+	p.mutex.Unlock()
+}
+
+// checkBuffering validates a route's buffering settings
+func checkBuffering(b *BufferingConfig, v *ValidationError) {
+	if b == nil {
+		return
+	}
+	if b.MaxBufferedBody < 0 {
+		v.add("buffering.maxBufferedBody", "must not be negative")
+	}
+	if b.MaxBody < 0 {
+		v.add("buffering.maxBody", "must not be negative")
+	}
+	if b.Retries < 0 {
+		v.add("buffering.retries", "must not be negative")
+	}
+	if b.MaxResponseHeaderBytes < 0 {
+		v.add("buffering.maxResponseHeaderBytes", "must not be negative")
+	}
+	if b.MaxBody > 0 && b.MaxBufferedBody > b.MaxBody {
+		v.add("buffering.maxBufferedBody", "must not exceed buffering.maxBody")
+	}
+}
+
+// bufferRequestBody applies the route's buffering settings. Small bodies
+// are buffered in memory, or spilled to disk once the memory cap is
+// reached, and made replayable. It returns a function releasing the
+// buffer, and false if the request has been answered.
+func bufferRequestBody(w http.ResponseWriter, r *http.Request, route Route) (func(), bool) {
+	b := route.Buffering
+	noop := func() {}
+	if b == nil || r.Body == nil || r.Body == http.NoBody {
+		return noop, true
+	}
+
+	if b.MaxBody > 0 {
+		if r.ContentLength > b.MaxBody {
+			writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large")
+			return noop, false
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, b.MaxBody)
+	}
+
+	// Already buffered while inspecting the body
+	if r.GetBody != nil {
+		return noop, true
+	}
+
+	limit := b.MaxBufferedBody
+	if limit <= 0 {
+		limit = defaultMaxBufferedBody
+	}
+	if r.ContentLength > limit {
+		return noop, true
+	}
+
+	// Reserve the declared length, or the whole buffer when it is unknown
+	reserved := limit
+	if r.ContentLength >= 0 {
+		reserved = r.ContentLength
+	}
+	if !bodyBuffers.reserve(reserved, config.settings().Buffering.MaxMemory) {
+		if config.settings().Buffering.SpillDir == "" {
+			writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Request buffer capacity exhausted")
+			return noop, false
+		}
+		return spillRequestBody(w, r, limit)
+	}
+	release := func() { bodyBuffers.release(reserved) }
+
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		release()
+		writeBodyReadError(w, r, err)
+		return noop, false
+	}
+
+	// Too large after all: stream the rest behind what was read
+	if int64(len(data)) > limit {
+		release()
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		return noop, true
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	return release, true
+}
+
+// spillRequestBody buffers a request body in a temporary file
+func spillRequestBody(w http.ResponseWriter, r *http.Request, limit int64) (func(), bool) {
+	noop := func() {}
+
+	f, err := ioutil.TempFile(config.settings().Buffering.SpillDir, "gateway-body-")
+	if err != nil {
+		log.Printf("Failed to spill request body: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Request buffer capacity exhausted")
+		return noop, false
+	}
+	release := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		release()
+		writeBodyReadError(w, r, err)
+		return noop, false
+	}
+
+	// Too large after all: stream the rest behind what was written
+	if n > limit {
+		body := r.Body
+		r.Body = readCloser{io.MultiReader(io.NewSectionReader(f, 0, n), body), closerFunc(func() error {
+			release()
+			return body.Close()
+		})}
+		return noop, true
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(io.NewSectionReader(f, 0, n))
+	r.ContentLength = n
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(f, 0, n)), nil
+	}
+	return release, true
+}
+
+// writeBodyReadError reports a failure reading the request body
+func writeBodyReadError(w http.ResponseWriter, r *http.Request, err error) {
+	if _, ok := err.(*http.MaxBytesError); ok {
+		writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large")
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, "Failed to read request body")
+}
+
+// readCloser pairs a reader with the closer of the body it wraps
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func() error
+
+// Close calls f
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// retryTransport retries requests that failed before an upstream response
+// was received, replaying buffered bodies
+type retryTransport struct {
+	base    http.RoundTripper
+	retries int
+}
+
+// RoundTrip sends the request, retrying connection failures
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil || attempt >= t.retries || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		// Timeouts are not retried; the upstream may still be working
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return resp, err
+		}
+
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, gerr := req.GetBody()
+			if gerr != nil {
+				return resp, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		log.Printf("Retrying %s %s (attempt %d of %d): %v", req.Method, req.URL, attempt+1, t.retries, err)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"html"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// catchAllPath is the route path of requests the catch-all proxies; it
+// leaves their paths whole when the template strips the prefix
+const catchAllPath = "/"
+
+// CatchAllConfig handles requests no route matches, or whose route is
+// disabled for them: they are proxied to a default target, or answered
+// with a custom response instead of the route_not_found error
+type CatchAllConfig struct {
+	Target   string `json:"target,omitempty"`   // default backend
+	Template string `json:"template,omitempty"` // route template for the proxied requests' timeout, auth, rewrite and so on
+
+	// Custom response when there is no target. Status defaults to 404;
+	// {method}, {path} and {requestId} in the body are replaced, escaped
+	// for HTML bodies.
+	Status      int               `json:"status,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	route Route // the route unmatched requests are proxied by, built when validated
+}
+
+// checkCatchAll validates the catch-all and builds its route
+func checkCatchAll(c *Config, v *ValidationError) {
+	ca := &c.CatchAll
+	ca.route = Route{}
+	if ca.Status != 0 && (ca.Status < 100 || ca.Status > 599) {
+		v.add("catchAll.status", "%d is not an HTTP status", ca.Status)
+	}
+	if ca.Target == "" {
+		if ca.Template != "" {
+			v.add("catchAll.template", "applies only with a target")
+		}
+		return
+	}
+	if ca.Status != 0 || ca.Body != "" {
+		v.add("catchAll", "use either a target or a custom response")
+	}
+	route := Route{
+		Path:     catchAllPath,
+		Target:   ca.Target,
+		Methods:  []string{"*"},
+		Active:   true,
+		Template: ca.Template,
+	}
+	if err := validateRoute(&route, nil, c); err != nil {
+		addViolations(v, "catchAll", err)
+		return
+	}
+	ca.route = route
+}
+
+// catchAllRoute returns the route that proxies unmatched requests, if a
+// default target is configured
+func (c *Config) catchAllRoute() (Route, bool) {
+	settings := c.settings()
+	return settings.CatchAll.route, settings.CatchAll.route.Target != ""
+}
+
+// serveNoRoute answers a request no route takes, with the custom response
+// when one is configured
+func serveNoRoute(w http.ResponseWriter, r *http.Request) {
+	ca := config.settings().CatchAll
+	if ca.Status == 0 && ca.Body == "" {
+		writeError(w, r, http.StatusNotFound, ErrCodeRouteNotFound, "No route for "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	status := ca.Status
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	recordErrorResponse(r, status, ErrCodeRouteNotFound)
+	for name, value := range ca.Headers {
+		w.Header().Set(name, value)
+	}
+	if ca.ContentType != "" {
+		w.Header().Set("Content-Type", ca.ContentType)
+	}
+	escape := func(s string) string { return s }
+	if strings.Contains(ca.ContentType, "html") {
+		escape = html.EscapeString
+	}
+	body := strings.NewReplacer(
+		"{method}", escape(r.Method),
+		"{path}", escape(r.URL.Path),
+		"{requestId}", escape(r.Header.Get(requestIDHeader)),
+	).Replace(ca.Body)
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
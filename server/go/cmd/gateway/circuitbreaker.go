@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultCircuitOpenFor is how long an open circuit holds requests back
+const defaultCircuitOpenFor = 30 * time.Second
+
+// CircuitBreakerConfig stops a route from sending requests to its target
+// after consecutive failures. Once OpenFor has passed, one trial request
+// goes through; its outcome closes the circuit or opens it again.
+type CircuitBreakerConfig struct {
+	Failures int `json:"failures"`          // consecutive 5xx responses or upstream errors that open the circuit
+	OpenFor  int `json:"openFor,omitempty"` // seconds before a trial request; defaults to 30
+}
+
+// checkCircuitBreaker validates a route's circuit breaker settings
+func checkCircuitBreaker(c *CircuitBreakerConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	if c.Failures <= 0 {
+		v.add("circuitBreaker.failures", "must be positive")
+	}
+	checkNonNegative("circuitBreaker", []namedInt{{"openFor", c.OpenFor}}, v)
+}
+
+// openFor returns how long the circuit stays open
+func (c *CircuitBreakerConfig) openFor() time.Duration {
+	if c.OpenFor <= 0 {
+		return defaultCircuitOpenFor
+	}
+	return time.Duration(c.OpenFor) * time.Second
+}
+
+// Outcomes of requests sent through a circuit
+const (
+	circuitUnknown = iota // the request ended before its outcome was known
+	circuitSuccess
+	circuitFailure
+)
+
+// circuitState tracks one route's consecutive failures
+type circuitState struct {
+	failures int
+	openedAt time.Time // zero while the circuit is closed
+	trial    bool      // a trial request is in flight
+}
+
+// circuitSet holds the circuit of each route with a breaker
+type circuitSet struct {
+	mutex    sync.Mutex
+	circuits map[int]*circuitState
+}
+
+// circuits guards routes with circuit breaker settings
+var circuits = &circuitSet{circuits: make(map[int]*circuitState)}
+
+// allow reports whether a request may go to the route's target. While the
+// circuit is open it also returns how long until a trial request.
+func (cs *circuitSet) allow(route Route) (bool, time.Duration) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	c, ok := cs.circuits[route.ID]
+	if !ok || c.openedAt.IsZero() {
+		return true, 0
+	}
+	wait := route.CircuitBreaker.openFor() - time.Since(c.openedAt)
+	if wait > 0 || c.trial {
+		return false, max(wait, time.Second)
+	}
+	c.trial = true
+	return true, 0
+}
+
+// record counts a request's outcome, opening or closing the circuit
+func (cs *circuitSet) record(route Route, outcome int) {
+	cs.mutex.Lock()
+	c, ok := cs.circuits[route.ID]
+	if !ok {
+		if outcome != circuitFailure {
+			cs.mutex.Unlock()
+			return
+		}
+		c = &circuitState{}
+		cs.circuits[route.ID] = c
+	}
+
+	wasOpen := !c.openedAt.IsZero()
+	trial := c.trial
+	c.trial = false
+	event := ""
+	switch outcome {
+	case circuitSuccess:
+		c.failures = 0
+		if wasOpen && trial {
+			c.openedAt = time.Time{}
+			event = EventCircuitClosed
+		}
+	case circuitFailure:
+		c.failures++
+		if wasOpen && trial {
+			c.openedAt = time.Now()
+		} else if !wasOpen && c.failures >= route.CircuitBreaker.Failures {
+			c.openedAt = time.Now()
+			event = EventCircuitOpened
+		}
+	}
+	failures := c.failures
+	cs.mutex.Unlock()
+
+	switch event {
+	case EventCircuitOpened:
+		log.Printf("Circuit for %s opened after %d consecutive failures", route.Path, failures)
+	case EventCircuitClosed:
+		log.Printf("Circuit for %s closed after a successful trial request", route.Path)
+	}
+	if event != "" {
+		events.emit(event, map[string]interface{}{
+			"routeId":  route.ID,
+			"path":     route.Path,
+			"target":   route.Target,
+			"failures": failures,
+		})
+	}
+}
+
+// routeChanged resets the circuit of an updated or deleted route
+func (cs *circuitSet) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	cs.mutex.Lock()
+	delete(cs.circuits, change.Old.ID)
+	cs.mutex.Unlock()
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header
+func retryAfterSeconds(wait time.Duration) string {
+	return strconv.Itoa(int((wait + time.Second - 1) / time.Second))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Request compression modes
+const (
+	CompressAuto   = "auto"   // once the upstream advertises gzip in Accept-Encoding
+	CompressAlways = "always" // the upstream is known to accept gzip
+)
+
+// defaultCompressMinSize is the smallest body compressed by default
+const defaultCompressMinSize = 1024
+
+// RequestCompressionConfig controls the encoding of request bodies sent to
+// a route's upstream
+type RequestCompressionConfig struct {
+	Compress   string `json:"compress,omitempty"`   // "auto" or "always"; empty leaves bodies as sent
+	MinSize    int64  `json:"minSize,omitempty"`    // bytes; defaults to 1 KiB
+	Decompress bool   `json:"decompress,omitempty"` // decode gzip and deflate bodies for upstreams that cannot
+}
+
+// checkRequestCompression validates a route's compression settings
+func checkRequestCompression(c *RequestCompressionConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	switch c.Compress {
+	case "", CompressAuto, CompressAlways:
+	default:
+		v.add("requestCompression.compress", "must be auto or always")
+	}
+	if c.MinSize < 0 {
+		v.add("requestCompression.minSize", "must not be negative")
+	}
+	if c.Compress != "" && c.Decompress {
+		v.add("requestCompression", "compress and decompress cannot both be set")
+	}
+}
+
+// decompressRequestBody decodes a gzip or deflate request body for routes
+// whose upstream cannot. It runs before the body is validated, logged or
+// checked, so those see the decoded body. It returns false if the request
+// has been answered.
+func decompressRequestBody(w http.ResponseWriter, r *http.Request, route Route) bool {
+	c := route.RequestCompression
+	if c == nil || !c.Decompress || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+
+	var body io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "":
+		return true
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, "Invalid gzip request body")
+			return false
+		}
+		body = zr
+	case "deflate":
+		body = flate.NewReader(r.Body)
+	default:
+		writeError(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Unsupported Content-Encoding")
+		return false
+	}
+
+	orig := r.Body
+	r.Body = readCloser{body, closerFunc(func() error {
+		body.Close()
+		return orig.Close()
+	})}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return true
+}
+
+// encodingSupport remembers which routes' upstreams advertised gzip
+// request bodies (RFC 7694)
+type encodingSupport struct {
+	mutex  sync.RWMutex
+	routes map[int]bool
+}
+
+// upstreamEncodings tracks upstream support for compressed requests
+var upstreamEncodings = &encodingSupport{routes: make(map[int]bool)}
+
+// observe records the encodings an upstream response advertises. A 415
+// means the upstream rejected a compressed body.
+func (e *encodingSupport) observe(routeID int, resp *http.Response) {
+	accept := resp.Header.Values("Accept-Encoding")
+	if len(accept) == 0 && resp.StatusCode != http.StatusUnsupportedMediaType {
+		return
+	}
+
+	gzipOK := false
+	for _, value := range accept {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if strings.EqualFold(strings.TrimSpace(name), "gzip") && !strings.Contains(strings.ReplaceAll(params, " ", ""), "q=0") {
+				gzipOK = true
+			}
+		}
+	}
+
+	e.mutex.Lock()
+	e.routes[routeID] = gzipOK
+	e.mutex.Unlock()
+}
+
+// supportsGzip reports whether a route's upstream advertised gzip
+func (e *encodingSupport) supportsGzip(routeID int) bool {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.routes[routeID]
+}
+
+// routeChanged forgets what a changed route's upstream advertised
+func (e *encodingSupport) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	e.mutex.Lock()
+	delete(e.routes, change.Old.ID)
+	e.mutex.Unlock()
+}
+
+// compressTransport gzips request bodies before sending them upstream
+type compressTransport struct {
+	base  http.RoundTripper
+	route Route
+}
+
+// RoundTrip compresses eligible bodies, streaming them through gzip
+func (t *compressTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.route.RequestCompression
+	minSize := c.MinSize
+	if minSize <= 0 {
+		minSize = defaultCompressMinSize
+	}
+
+	eligible := req.Body != nil && req.Body != http.NoBody &&
+		req.Header.Get("Content-Encoding") == "" &&
+		(req.ContentLength < 0 || req.ContentLength >= minSize) &&
+		(c.Compress == CompressAlways || upstreamEncodings.supportsGzip(t.route.ID))
+	if !eligible {
+		return t.base.RoundTrip(req)
+	}
+
+	pr, pw := io.Pipe()
+	go func(body io.ReadCloser) {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, body)
+		body.Close()
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}(req.Body)
+
+	out := req.Clone(req.Context())
+	out.Body = pr
+	out.ContentLength = -1
+	out.Header.Set("Content-Encoding", "gzip")
+	out.Header.Del("Content-Length")
+	return t.base.RoundTrip(out)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// gzipped compresses data
+func gzipped(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestDecompressedBodyIsValidated(t *testing.T) {
+	received := make(chan string, 1)
+	startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		received <- r.Header.Get("Content-Encoding") + "|" + string(data)
+	}), func(_ *Config, route *Route) {
+		route.RequestCompression = &RequestCompressionConfig{Decompress: true}
+		route.XMLValidation = &XMLValidationConfig{RootElement: "order"}
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/svc/orders", bytes.NewReader(gzipped(t, body)))
+		r.Header.Set("Content-Type", "application/xml")
+		r.Header.Set("Content-Encoding", "gzip")
+		return serveProxy(r)
+	}
+
+	const order = `<order><id>7</id></order>`
+	if w := send(order); w.Code != http.StatusOK {
+		t.Fatalf("valid gzip XML: status %d: %s", w.Code, w.Body.String())
+	}
+	if got := <-received; got != "|"+order {
+		t.Fatalf("upstream received %q, want the decoded body", got)
+	}
+
+	if w := send(`<invoice/>`); w.Code != http.StatusBadRequest {
+		t.Fatalf("gzip XML with the wrong root: status %d, want 400", w.Code)
+	}
+}
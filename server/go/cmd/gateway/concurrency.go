@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultConcurrencyMaxWait is how long a queued request waits by default
+const defaultConcurrencyMaxWait = 1000 * time.Millisecond
+
+// ConcurrencyConfig caps a route's requests in flight to its upstream.
+// Requests over the cap wait briefly in a bounded queue for a slot, so a
+// micro-burst is absorbed instead of answered with 503s.
+type ConcurrencyConfig struct {
+	Max       int `json:"max"`                 // requests in flight upstream
+	Queue     int `json:"queue,omitempty"`     // requests that may wait for a slot; 0 rejects at once
+	MaxWaitMs int `json:"maxWaitMs,omitempty"` // milliseconds a queued request waits; defaults to 1000
+}
+
+// checkConcurrency validates a route's concurrency settings
+func checkConcurrency(c *ConcurrencyConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	if c.Max <= 0 {
+		v.add("concurrency.max", "must be positive")
+	}
+	checkNonNegative("concurrency", []namedInt{
+		{"queue", c.Queue},
+		{"maxWaitMs", c.MaxWaitMs},
+	}, v)
+}
+
+// maxWait returns how long a queued request waits for a slot
+func (c *ConcurrencyConfig) maxWait() time.Duration {
+	if c.MaxWaitMs <= 0 {
+		return defaultConcurrencyMaxWait
+	}
+	return time.Duration(c.MaxWaitMs) * time.Millisecond
+}
+
+// concurrencyLimiter hands out a route's in-flight slots. Waiting
+// requests are served in arrival order.
+type concurrencyLimiter struct {
+	slots   chan struct{}
+	mutex   sync.Mutex
+	waiting int
+}
+
+// limiterSet holds the limiter of each capped route
+type limiterSet struct {
+	mutex    sync.Mutex
+	limiters map[int]*concurrencyLimiter
+}
+
+// routeLimiters caps routes with concurrency settings
+var routeLimiters = &limiterSet{limiters: make(map[int]*concurrencyLimiter)}
+
+// get returns a route's limiter, replacing it if the cap changed
+func (ls *limiterSet) get(route Route) *concurrencyLimiter {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	l, ok := ls.limiters[route.ID]
+	if !ok || cap(l.slots) != route.Concurrency.Max {
+		l = &concurrencyLimiter{slots: make(chan struct{}, route.Concurrency.Max)}
+		ls.limiters[route.ID] = l
+	}
+	return l
+}
+
+// routeChanged drops the limiter of an updated or deleted route. Requests
+// holding its slots release them as usual.
+func (ls *limiterSet) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	ls.mutex.Lock()
+	delete(ls.limiters, change.Old.ID)
+	ls.mutex.Unlock()
+}
+
+// acquire takes a slot, waiting up to maxWait when queue allows. It
+// returns the function releasing the slot and whether the request had to
+// wait, or nil if no slot came free.
+func (l *concurrencyLimiter) acquire(r *http.Request, queue int, maxWait time.Duration) (func(), bool) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, false
+	default:
+	}
+
+	l.mutex.Lock()
+	if l.waiting >= queue {
+		l.mutex.Unlock()
+		return nil, false
+	}
+	l.waiting++
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		l.waiting--
+		l.mutex.Unlock()
+	}()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return nil, true
+}
+
+// limitConcurrency holds a request until the route has a free in-flight
+// slot. It answers 503 when the queue is full or the wait runs out, and
+// otherwise returns the function releasing the slot once the request is
+// done.
+func limitConcurrency(w http.ResponseWriter, r *http.Request, route Route) (func(), bool) {
+	c := route.Concurrency
+	if c == nil || c.Max <= 0 {
+		return func() {}, true
+	}
+
+	release, queued := routeLimiters.get(route).acquire(r, c.Queue, c.maxWait())
+	if release != nil || r.Context().Err() != nil {
+		// A client that left while queued needs no answer
+		proxy.recordQueueing(route.Path, queued, false)
+		return release, release != nil
+	}
+	proxy.recordQueueing(route.Path, queued, true)
+	w.Header().Set("Retry-After", "1")
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Route is at its concurrency limit")
+	return nil, false
+}
+
+// recordQueueing counts requests queued for, or turned away from, a
+// route's in-flight slots
+func (p *Proxy) recordQueueing(path string, queued, rejected bool) {
+	if !queued && !rejected {
+		return
+	}
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	if queued {
+		routeStat.Queued++
+	}
+	if rejected {
+		routeStat.QueueRejected++
+	}
+	p.stats.RouteStats[path] = routeStat
+}
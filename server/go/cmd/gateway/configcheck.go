@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// jsonIndexPath matches numeric segments of encoding/json field paths
+var jsonIndexPath = regexp.MustCompile(`\.(\d+)(\.|$)`)
+
+// decodeConfig strictly decodes a config document. Unknown fields are
+// rejected, and errors name the file position and field path at fault.
+func decodeConfig(name string, data []byte, config *Config) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(config)
+	if err == nil {
+		if dec.More() {
+			return fmt.Errorf("%s: unexpected data after the config object", name)
+		}
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, col := lineColumn(data, syntaxErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %v", name, line, col, syntaxErr)
+	case errors.As(err, &typeErr):
+		line, col := lineColumn(data, typeErr.Offset)
+		return fmt.Errorf("%s:%d:%d: %s: expected %s, got JSON %s", name, line, col, formatFieldPath(typeErr.Field), typeErr.Type, typeErr.Value)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		if path, offset, ok := findJSONKey(data, field); ok {
+			line, col := lineColumn(data, offset)
+			return fmt.Errorf("%s:%d:%d: %s: unknown field", name, line, col, path)
+		}
+		return fmt.Errorf("%s: unknown field %q", name, field)
+	}
+	return fmt.Errorf("%s: %v", name, err)
+}
+
+// lineColumn converts a byte offset into a 1-based line and column
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// formatFieldPath turns "routes.2.timeout" into "routes[2].timeout"
+func formatFieldPath(path string) string {
+	for jsonIndexPath.MatchString(path) {
+		path = jsonIndexPath.ReplaceAllString(path, "[$1]$2")
+	}
+	return path
+}
+
+// jsonFrame tracks the position within one JSON object or array
+type jsonFrame struct {
+	array     bool
+	index     int
+	key       string
+	expectKey bool
+}
+
+// jsonFramePath formats a frame stack as a path like "routes[2].timeout"
+func jsonFramePath(stack []*jsonFrame) string {
+	var path strings.Builder
+	for _, f := range stack {
+		if f.array {
+			fmt.Fprintf(&path, "[%d]", f.index)
+		} else if f.key != "" {
+			if path.Len() > 0 {
+				path.WriteByte('.')
+			}
+			path.WriteString(f.key)
+		}
+	}
+	return path.String()
+}
+
+// findJSONKey locates the first object key named key, returning its path
+// and offset. Decode buffers the whole document before reporting unknown
+// fields, so their position has to be found separately.
+func findJSONKey(data []byte, key string) (string, int64, bool) {
+	var stack []*jsonFrame
+
+	valueDone := func() {
+		if n := len(stack); n > 0 {
+			if top := stack[n-1]; top.array {
+				top.index++
+			} else {
+				top.expectKey = true
+			}
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", 0, false
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, &jsonFrame{expectKey: true})
+			case '[':
+				stack = append(stack, &jsonFrame{array: true})
+			default:
+				stack = stack[:len(stack)-1]
+				valueDone()
+			}
+		case string:
+			if n := len(stack); n > 0 && !stack[n-1].array && stack[n-1].expectKey {
+				stack[n-1].key = t
+				stack[n-1].expectKey = false
+				if t == key {
+					// The key token has just been read; point at its opening quote
+					return jsonFramePath(stack), dec.InputOffset() - int64(len(key)+2), true
+				}
+				continue
+			}
+			valueDone()
+		default:
+			valueDone()
+		}
+	}
+}
+
+// validate checks every config field, reporting all violations with the
+// path of the offending field
+func (c *Config) validate() error {
+	var v ValidationError
+
+	if c.Port < 0 || c.Port > 65535 {
+		v.add("port", "must be between 1 and 65535")
+	}
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 {
+		v.add("admin.port", "must be between 1 and 65535")
+	}
+	checkAdminPrefix(c.Admin, &v)
+	checkJWT(c.JWT, &v)
+	if c.Admin.Password != "" {
+		checkSettingsSecretRef("admin.password", c.Admin.Password, &v)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		v.add("logLevel", "must be one of debug, info, warn or error")
+	}
+	checkRateLimit("defaultRateLimit", c.DefaultRateLimit, &v)
+	checkGatewayRateLimit(c.GatewayRateLimit, &v)
+	if c.DefaultTimeout < 0 {
+		v.add("defaultTimeout", "must not be negative")
+	}
+
+	if c.Events.Enabled {
+		switch strings.ToLower(c.Events.Backend) {
+		case "nats", "kafka":
+		default:
+			v.add("events.backend", "must be nats or kafka")
+		}
+		if c.Events.URL == "" {
+			v.add("events.url", "is required when events are enabled")
+		}
+	}
+
+	checkSync(c.Sync, &v)
+	checkLeader(c.Leader, &v)
+	checkKubernetes(c, &v)
+	checkXDS(c, &v)
+	checkReload(c.Reload, &v)
+	checkScaling(c.Scaling, &v)
+	checkWarmCache(c.WarmCache, &v)
+	checkAnalytics(c.Analytics, &v)
+	checkLatency(c.Latency, &v)
+
+	if c.BotDetection.Action != "" && !validBotAction(c.BotDetection.Action) {
+		v.add("botDetection.action", "must be off, log, challenge or block")
+	}
+	if c.BotDetection.MaxRequestsPerIP < 0 {
+		v.add("botDetection.maxRequestsPerIP", "must not be negative")
+	}
+	if c.BotDetection.ChallengeTTL < 0 {
+		v.add("botDetection.challengeTtl", "must not be negative")
+	}
+
+	checkNonNegative("server", []namedInt{
+		{"readHeaderTimeout", c.Server.ReadHeaderTimeout},
+		{"idleTimeout", c.Server.IdleTimeout},
+		{"minBodyRate", c.Server.MinBodyRate},
+		{"bodyRateGrace", c.Server.BodyRateGrace},
+		{"maxConnsPerIP", c.Server.MaxConnsPerIP},
+		{"maxConns", c.Server.MaxConns},
+	}, &v)
+
+	if c.UpstreamProxy.URL != "" {
+		if _, err := parseEgressProxyURL(c.UpstreamProxy.URL); err != nil {
+			v.add("upstreamProxy.url", "%v", err)
+		}
+	}
+
+	switch driver := c.Storage.driver(); driver {
+	case StorageFile:
+	case StorageSQLite, StoragePostgres:
+		if c.Storage.DSN != "" {
+			checkSettingsSecretRef("storage.dsn", c.Storage.DSN, &v)
+		} else if driver == StoragePostgres {
+			v.add("storage.dsn", "is required for postgres")
+		}
+	default:
+		v.add("storage.driver", "must be sqlite, postgres or file")
+	}
+	checkNonNegative("storage", []namedInt{
+		{"historyInterval", c.Storage.HistoryInterval},
+		{"historyRetention", c.Storage.HistoryRetention},
+	}, &v)
+
+	if c.Buffering.MaxMemory < 0 {
+		v.add("buffering.maxMemory", "must not be negative")
+	}
+	if c.Buffering.SpillDir != "" {
+		if info, err := os.Stat(c.Buffering.SpillDir); err != nil || !info.IsDir() {
+			v.add("buffering.spillDir", "%q is not a directory", c.Buffering.SpillDir)
+		}
+	}
+
+	checkRecording(c.Recording, &v)
+	checkHeaderFilter("responseHeaders", &c.ResponseHeaders, &v)
+	checkForwarded("forwarded", &c.Forwarded, &v)
+	checkReadiness(c.Readiness, &v)
+	checkFeatureFlags(c.FeatureFlags, &v)
+	checkSampling("sampling", &c.Sampling, &v)
+	checkAlerts(c.Alerts, &v)
+	checkTracing(c.Tracing, &v)
+	checkRouteTemplates(c.RouteTemplates, &v)
+	checkCatchAll(c, &v)
+	checkDebug(c.Debug, &v)
+	checkTargetWeights(c.TargetWeights, &v)
+	if !validTenantKey(c.TenantKey) {
+		v.add("tenantKey", "unknown source %q: use header:<name> or claim:<name>", c.TenantKey)
+	}
+
+	checkHealthConfig("healthCheck", c.HealthCheck, &v)
+	names := make([]string, 0, len(c.HealthCheck.Services))
+	for name := range c.HealthCheck.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checkHealthConfig("healthCheck.services."+name, c.HealthCheck.Services[name], &v)
+	}
+
+	ids := make(map[int]string)
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		prefix := routeField(c.Routes, i)
+
+		if route.ID <= 0 {
+			v.add(prefix+".id", "must be a positive integer")
+		} else if first, dup := ids[route.ID]; dup {
+			v.add(prefix+".id", "duplicates the id of %s", first)
+		} else {
+			ids[route.ID] = prefix
+		}
+
+		// Conflicts between loaded routes are reported as warnings
+		if err := validateRoute(route, nil, c); err != nil {
+			for _, violation := range err.(*ValidationError).Violations {
+				v.add(prefix+"."+violation.Field, "%s", violation.Message)
+			}
+		}
+	}
+	checkIncludes(c, &v)
+
+	return v.err()
+}
+
+// checkHealthConfig validates health check settings
+func checkHealthConfig(prefix string, cfg HealthCheckConfig, v *ValidationError) {
+	checkNonNegative(prefix, []namedInt{
+		{"interval", cfg.Interval},
+		{"timeout", cfg.Timeout},
+		{"healthyThreshold", cfg.HealthyThreshold},
+		{"unhealthyThreshold", cfg.UnhealthyThreshold},
+		{"jitter", cfg.Jitter},
+		{"slowStart", cfg.SlowStart},
+		{"flapThreshold", cfg.FlapThreshold},
+		{"flapWindow", cfg.FlapWindow},
+		{"holdDown", cfg.HoldDown},
+	}, v)
+	if cfg.Path != "" && !strings.HasPrefix(cfg.Path, "/") {
+		v.add(prefix+".path", "must start with /")
+	}
+}
+
+// namedInt is a numeric config field and its name
+type namedInt struct {
+	name  string
+	value int
+}
+
+// checkNonNegative reports negative numeric fields
+func checkNonNegative(prefix string, fields []namedInt, v *ValidationError) {
+	for _, f := range fields {
+		if f.value < 0 {
+			v.add(prefix+"."+f.name, "must not be negative")
+		}
+	}
+}
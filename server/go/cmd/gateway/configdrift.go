@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Causes of drift between the config file and the running config
+const (
+	driftFileEdited = "fileEdited" // the file changed since it was loaded or saved; a reload is pending
+	driftUnsaved    = "unsaved"    // runtime changes have not been written
+)
+
+// ConfigDrift compares the persisted config with the running one
+type ConfigDrift struct {
+	Drifted      bool               `json:"drifted"`
+	Cause        string             `json:"cause,omitempty"` // fileEdited or unsaved
+	Source       string             `json:"source"`
+	FileModified time.Time          `json:"fileModified"`
+	SyncedAt     time.Time          `json:"syncedAt"`            // when the gateway last loaded or saved the file
+	RoutesFrom   string             `json:"routesFrom"`          // where persisted routes were read: the file or the storage driver
+	FileError    string             `json:"fileError,omitempty"` // the file could not be read as a config
+	Differences  []ConfigDifference `json:"differences"`
+}
+
+// ConfigDifference is a setting whose persisted and running values differ.
+// A null value means the setting is absent on that side.
+type ConfigDifference struct {
+	Path    string      `json:"path"` // routes are addressed by ID, as routes[id=3].target
+	File    interface{} `json:"file"`
+	Runtime interface{} `json:"runtime"`
+}
+
+// drift compares the config file, and the stored routes when a database
+// holds them, with what the running config would save
+func (c *Config) drift() (ConfigDrift, error) {
+	settings := c.settings()
+	d := ConfigDrift{
+		Source:      settings.configFilePath,
+		SyncedAt:    time.Unix(0, c.syncedAt.Load()),
+		RoutesFrom:  StorageFile,
+		Differences: []ConfigDifference{},
+	}
+
+	data, err := c.fileJSON()
+	if err != nil {
+		return d, err
+	}
+	var running map[string]interface{}
+	if err := json.Unmarshal(data, &running); err != nil {
+		return d, err
+	}
+
+	info, err := os.Stat(settings.configFilePath)
+	if err != nil {
+		return d, err
+	}
+	d.FileModified = info.ModTime()
+	persisted, err := readConfigTree(settings.configFilePath)
+	if err != nil {
+		d.FileError = err.Error()
+	}
+
+	// Routes kept in a database are compared with the database
+	if settings.Storage.driver() != StorageFile {
+		d.RoutesFrom = settings.Storage.driver()
+		routes, err := store.LoadRoutes()
+		if err != nil {
+			return d, fmt.Errorf("storage: %v", err)
+		}
+		data, err := json.Marshal(routes)
+		if err != nil {
+			return d, err
+		}
+		var stored []interface{}
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return d, err
+		}
+		if persisted != nil {
+			persisted["routes"] = stored
+		}
+	}
+
+	if persisted != nil {
+		diffConfigTrees("", persisted, running, &d.Differences)
+	}
+	d.Drifted = len(d.Differences) > 0 || d.FileError != ""
+	if d.Drifted {
+		d.Cause = driftUnsaved
+		if d.FileModified.After(d.SyncedAt) {
+			d.Cause = driftFileEdited
+		}
+	}
+	return d, nil
+}
+
+// readConfigTree reads a config file the way it would be loaded, so
+// formatting and defaults do not count as drift
+func readConfigTree(path string) (map[string]interface{}, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fileCrypto.open(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	data, _, _, err = migrateConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	c := defaultConfig(path)
+	if err := decodeConfig(path, data, c); err != nil {
+		return nil, err
+	}
+	for i := range c.Routes {
+		c.applyTemplate(&c.Routes[i], &ValidationError{})
+	}
+	c.setRoutes(c.Routes)
+
+	normalized, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	err = json.Unmarshal(normalized, &tree)
+	return tree, err
+}
+
+// diffConfigTrees records the differences between two decoded configs
+// below path
+func diffConfigTrees(path string, file, runtime interface{}, out *[]ConfigDifference) {
+	if reflect.DeepEqual(file, runtime) {
+		return
+	}
+	fileMap, fileIsMap := file.(map[string]interface{})
+	runtimeMap, runtimeIsMap := runtime.(map[string]interface{})
+	if fileIsMap && runtimeIsMap {
+		keys := make(map[string]bool)
+		for key := range fileMap {
+			keys[key] = true
+		}
+		for key := range runtimeMap {
+			keys[key] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for key := range keys {
+			sorted = append(sorted, key)
+		}
+		sort.Strings(sorted)
+		for _, key := range sorted {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			if key == "routes" && path == "" {
+				diffRoutes(fileMap[key], runtimeMap[key], out)
+				continue
+			}
+			diffConfigTrees(child, fileMap[key], runtimeMap[key], out)
+		}
+		return
+	}
+	*out = append(*out, ConfigDifference{Path: path, File: file, Runtime: runtime})
+}
+
+// diffRoutes compares route lists by route ID, so an insertion does not
+// show as every later route changing
+func diffRoutes(file, runtime interface{}, out *[]ConfigDifference) {
+	byID := func(list interface{}) (map[string]interface{}, []string) {
+		routes := make(map[string]interface{})
+		var ids []string
+		items, _ := list.([]interface{})
+		for i, item := range items {
+			id := fmt.Sprintf("index=%d", i)
+			if route, ok := item.(map[string]interface{}); ok && route["id"] != nil {
+				id = fmt.Sprintf("id=%v", route["id"])
+			}
+			routes[id] = item
+			ids = append(ids, id)
+		}
+		return routes, ids
+	}
+	fileRoutes, fileIDs := byID(file)
+	runtimeRoutes, runtimeIDs := byID(runtime)
+
+	seen := make(map[string]bool)
+	for _, id := range append(fileIDs, runtimeIDs...) {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		diffConfigTrees("routes["+id+"]", fileRoutes[id], runtimeRoutes[id], out)
+	}
+}
+
+// handleConfigDrift reports whether the config file and the running config
+// have diverged
+func handleConfigDrift(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	d, err := config.drift()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to compare config: %v", err))
+		return
+	}
+	writeJSON(w, d)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Config reload defaults
+const (
+	defaultReloadInterval     = 5
+	defaultReloadReadyTimeout = 30
+
+	configWatchJob = "config-watch"
+)
+
+// ReloadConfig reloads the config file when it changes, such as a mounted
+// ConfigMap, so a Deployment picks up new settings and routes without a
+// restart
+type ReloadConfig struct {
+	Watch        bool `json:"watch"`
+	Interval     int  `json:"interval,omitempty"`     // seconds between checks for changes; defaults to 5
+	ReadyTimeout int  `json:"readyTimeout,omitempty"` // seconds the readiness probe may fail after a reload while critical services are checked; defaults to 30
+}
+
+// interval returns how often the file is checked
+func (c ReloadConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return defaultReloadInterval * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// readyTimeout returns how long a reload holds the gateway unready at most
+func (c ReloadConfig) readyTimeout() time.Duration {
+	if c.ReadyTimeout <= 0 {
+		return defaultReloadReadyTimeout * time.Second
+	}
+	return time.Duration(c.ReadyTimeout) * time.Second
+}
+
+// checkReload validates the reload settings
+func checkReload(c ReloadConfig, v *ValidationError) {
+	checkNonNegative("reload", []namedInt{
+		{"interval", c.Interval},
+		{"readyTimeout", c.ReadyTimeout},
+	}, v)
+}
+
+// ReloadStatus reports config file reloads
+type ReloadStatus struct {
+	Watching    bool       `json:"watching"`
+	Path        string     `json:"path"`
+	Reloads     int64      `json:"reloads"`  // reloads that changed the running config
+	Failures    int64      `json:"failures"` // changed files that failed to load; the running config was kept
+	LastCheck   *time.Time `json:"lastCheck,omitempty"`
+	LastReload  *time.Time `json:"lastReload,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"` // of the config and included files last loaded
+}
+
+// configReloads serializes reloads and records their outcome
+var configReloads = struct {
+	sync.Mutex
+	status ReloadStatus
+}{}
+
+// configFingerprint hashes the config file and the route files it
+// includes, so a change to any of them, including a ConfigMap swapping
+// its mounted files, is noticed
+func configFingerprint(c *Config) (string, error) {
+	settings := c.settings()
+	paths := []string{settings.configFilePath}
+	dir := filepath.Dir(settings.configFilePath)
+	for _, pattern := range settings.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, _ := filepath.Glob(pattern)
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\n%d\n", path, len(data))
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// startConfigWatch checks the config file for changes while reload.watch
+// is set
+func startConfigWatch(ctx context.Context, c *Config) {
+	settings := c.settings()
+	configReloads.Lock()
+	configReloads.status.Watching = settings.Reload.Watch
+	configReloads.status.Path = settings.configFilePath
+	if configReloads.status.Fingerprint == "" {
+		configReloads.status.Fingerprint, _ = configFingerprint(c)
+	}
+	configReloads.Unlock()
+
+	if !settings.Reload.Watch {
+		jobs.remove(configWatchJob)
+		return
+	}
+	jobs.start(ctx, jobSpec{
+		name:     configWatchJob,
+		interval: func() time.Duration { return config.settings().Reload.interval() },
+		run: func(ctx context.Context, now time.Time) error {
+			_, err := reloadConfig(false)
+			return err
+		},
+	})
+}
+
+// handleReloadSignal reloads the config file each time SIGHUP arrives,
+// whether or not it is watched
+func handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if _, err := reloadConfig(true); err != nil {
+				log.Printf("Config reload failed: %v", err)
+			}
+		}
+	}()
+}
+
+// reloadConfig loads the config file again and installs it if it changed.
+// Unless forced, the file is only read when its fingerprint changed. A
+// file that fails to load or validate leaves the running config as it is.
+// Routes the Kubernetes controller and xDS client keep are carried over.
+func reloadConfig(force bool) (bool, error) {
+	configReloads.Lock()
+	defer configReloads.Unlock()
+	status := &configReloads.status
+	now := time.Now()
+	status.LastCheck = &now
+
+	fingerprint, err := configFingerprint(config)
+	if err != nil {
+		status.LastError = err.Error()
+		return false, err
+	}
+	if !force && fingerprint == status.Fingerprint {
+		return false, nil
+	}
+	status.Fingerprint = fingerprint
+
+	loaded, err := loadConfig(config.settings().configFilePath, config.settings().overrides)
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		log.Printf("Config reload: keeping the running config: %v", err)
+		return false, err
+	}
+	routeWrites.Lock()
+	if loaded.Storage.driver() != StorageFile {
+		// A database keeps its own routes
+		loaded.replaceRoutes(config.getRoutes(), 0)
+	}
+	if bytes.Equal(loaded.reloadState(), config.reloadState()) {
+		routeWrites.Unlock()
+		return false, nil
+	}
+
+	// Fail readiness probes until the new config's critical services pass
+	readiness.hold()
+	before := installReloadedConfig(loaded)
+	routeWrites.Unlock()
+	restartBackground(before, config)
+	go releaseAfterReload(loaded.Reload.readyTimeout())
+
+	status.Reloads++
+	status.LastReload = &now
+	status.LastError = ""
+	log.Printf("Reloaded %s", config.settings().configFilePath)
+	return true, nil
+}
+
+// reloadState is the config as a reload compares it: every setting and
+// the routes, without those controllers keep
+func (c *Config) reloadState() []byte {
+	state := configSnapshot{ConfigSettings: *c.settings()}
+	for _, route := range c.getRoutes() {
+		if !controllerRoute(route) {
+			state.Routes = append(state.Routes, route)
+		}
+	}
+	data, _ := json.Marshal(&state)
+	return data
+}
+
+// installReloadedConfig swaps in a reloaded config and applies the side
+// effects a PUT /config and route changes have, but for restarting
+// background work. The caller holds routeWrites and restarts it, with the
+// settings returned, once the lock is released.
+func installReloadedConfig(loaded *Config) backgroundSettings {
+	before := config.backgroundSettings()
+	previous := config.getRoutes()
+	config.routesMutex.RLock()
+	nextRouteID := config.nextRouteID
+	config.routesMutex.RUnlock()
+
+	routes := loaded.getRoutes()
+	taken := make(map[int]bool)
+	for _, route := range routes {
+		taken[route.ID] = true
+	}
+	loaded.routesMutex.RLock()
+	if loaded.nextRouteID > nextRouteID {
+		nextRouteID = loaded.nextRouteID
+	}
+	loaded.routesMutex.RUnlock()
+	for _, route := range previous {
+		if !controllerRoute(route) {
+			continue
+		}
+		// A route added to the file may have taken the ID
+		if taken[route.ID] {
+			route.ID = nextRouteID
+			nextRouteID++
+		}
+		routes = append(routes, route)
+	}
+
+	config.install(*loaded.settings(), routes, nextRouteID)
+	routeLookups.purge()
+	config.configureLogging()
+	traffic.configure(config.settings().Recording)
+	proxy.resetTransports()
+	activeConfig.load(config, nil, "reloaded")
+
+	for _, change := range routeChangesBetween(previous, routes) {
+		routeChanges.notify(change)
+		switch change.Kind {
+		case RouteCreated:
+			events.emit(EventRouteCreated, *change.New)
+		case RouteUpdated:
+			events.emit(EventRouteUpdated, *change.New)
+		case RouteDeleted:
+			events.emit(EventRouteDeleted, map[string]int{"id": change.Old.ID})
+		}
+	}
+	return before
+}
+
+// routeChangesBetween returns the changes that turn one route list into
+// another, matching routes by ID. Changes are local: a replica reloads its
+// own file.
+func routeChangesBetween(before, after []Route) []RouteChange {
+	old := make(map[int]Route)
+	for _, route := range before {
+		old[route.ID] = route
+	}
+	var changes []RouteChange
+	for i := range after {
+		route := after[i]
+		previous, found := old[route.ID]
+		delete(old, route.ID)
+		switch {
+		case !found:
+			changes = append(changes, RouteChange{Kind: RouteCreated, New: &route, Remote: true})
+		case !reflect.DeepEqual(previous, route):
+			changes = append(changes, RouteChange{Kind: RouteUpdated, Old: &previous, New: &route, Remote: true})
+		}
+	}
+	for _, route := range before {
+		if route, ok := old[route.ID]; ok {
+			changes = append(changes, RouteChange{Kind: RouteDeleted, Old: &route, Remote: true})
+		}
+	}
+	return changes
+}
+
+// releaseAfterReload lets readiness probes pass again once the critical
+// services are healthy, or after timeout
+func releaseAfterReload(timeout time.Duration) {
+	defer readiness.release()
+	deadline := time.Now().Add(timeout)
+	for len(proxy.pendingServices()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// handleConfigReload reports reloads on GET and reloads the config file
+// on POST, even when it is not watched
+func handleConfigReload(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, err := reloadConfig(true); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeValidationFailed, fmt.Sprintf("Config reload failed; the running config was kept: %v", err))
+			return
+		}
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	configReloads.Lock()
+	status := configReloads.status
+	configReloads.Unlock()
+	writeJSON(w, status)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestReloadDuringRequests reloads the config file while requests are in
+// flight; run with -race to check that settings and the background work
+// they start are swapped safely
+func TestReloadDuringRequests(t *testing.T) {
+	cfg := startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}), nil)
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if w := serveProxy(httptest.NewRequest("GET", "/svc/items", nil)); w.Code != http.StatusOK {
+					t.Errorf("status %d: %s", w.Code, w.Body.String())
+					return
+				}
+				handleConfig(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/config", nil))
+				handleSync(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/sync", nil))
+				handleLeader(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/leader", nil))
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		settings := *cfg.settings()
+		settings.EnableRateLimit = !settings.EnableRateLimit
+		settings.DefaultRateLimit = rateLimitPerMinute(1 << 30)
+		settings.TenantKey = []string{"", "header:X-Tenant"}[i%2]
+		// Restart the bot detector, replica sync and leader election too
+		settings.BotDetection = BotConfig{Enabled: i%2 == 0, Action: BotActionLog, MaxRequestsPerIP: 1 << 30}
+		settings.Sync.ReplicaID = fmt.Sprintf("replica-%d", i)
+		cfg.setSettings(settings)
+		if err := cfg.save(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reloadConfig(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.settings().TenantKey != "header:X-Tenant" {
+		t.Fatalf("tenantKey = %q after the last reload, want header:X-Tenant", cfg.settings().TenantKey)
+	}
+	if botDetector.Load() != nil {
+		t.Fatal("bot detection is still on after the last reload turned it off")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// configSchemaVersion is the config format this binary reads and writes
+const configSchemaVersion = 2
+
+// configMigration upgrades a config document to the next schema version
+type configMigration struct {
+	version     int // schema version the migration produces
+	description string
+	apply       func(doc map[string]interface{})
+}
+
+// configMigrations upgrade configs written by older versions, in order
+var configMigrations = []configMigration{
+	{1, "record the schema version in the config", func(doc map[string]interface{}) {}},
+	{2, "keep the file store where no storage driver was chosen, as SQLite is now the default", func(doc map[string]interface{}) {
+		storage, _ := doc["storage"].(map[string]interface{})
+		if storage == nil {
+			storage = make(map[string]interface{})
+			doc["storage"] = storage
+		}
+		if driver, _ := storage["driver"].(string); driver == "" {
+			storage["driver"] = StorageFile
+		}
+	}},
+}
+
+// migrateConfig brings a config document up to the current schema version.
+// It returns the document's version and the migrations applied; a current
+// document is returned unchanged.
+func migrateConfig(data []byte) ([]byte, int, []configMigration, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		// Leave syntax errors to the strict decode, which reports positions
+		return data, configSchemaVersion, nil, nil
+	}
+
+	version := 0
+	if v, ok := doc["schemaVersion"].(json.Number); ok {
+		n, err := v.Int64()
+		if err != nil || n < 0 {
+			return nil, 0, nil, fmt.Errorf("schemaVersion: invalid version %s", v)
+		}
+		version = int(n)
+	}
+	if version > configSchemaVersion {
+		return nil, version, nil, fmt.Errorf("schemaVersion: version %d is newer than this gateway supports (%d)", version, configSchemaVersion)
+	}
+
+	var applied []configMigration
+	for _, m := range configMigrations {
+		if m.version > version {
+			m.apply(doc)
+			applied = append(applied, m)
+		}
+	}
+	if len(applied) == 0 {
+		return data, version, nil, nil
+	}
+	doc["schemaVersion"] = configSchemaVersion
+	migrated, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, version, nil, err
+	}
+	return migrated, version, applied, nil
+}
+
+// upgradeReport is the outcome of checking a config against this binary
+type upgradeReport struct {
+	config            *Config
+	raw               []byte // the config file as stored, possibly encrypted
+	version           int
+	migrations        []configMigration
+	storedRoutes      int
+	incompatibilities []string
+}
+
+// checkUpgrade loads the persisted config and routes with this binary's
+// schema, collecting everything that would stop the gateway from starting
+func checkUpgrade(configPath string) (*upgradeReport, error) {
+	report := &upgradeReport{version: configSchemaVersion}
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	report.raw = raw
+	data, err := fileCrypto.open(configPath, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	data, report.version, report.migrations, err = migrateConfig(data)
+	if err != nil {
+		report.incompatibilities = append(report.incompatibilities, err.Error())
+		return report, nil
+	}
+
+	config := defaultConfig(configPath)
+	if err := decodeConfig(configPath, data, config); err != nil {
+		report.incompatibilities = append(report.incompatibilities, err.Error())
+		return report, nil
+	}
+	report.config = config
+	if err := config.validate(); err != nil {
+		for _, v := range err.(*ValidationError).Violations {
+			report.incompatibilities = append(report.incompatibilities, v.Field+": "+v.Message)
+		}
+	}
+
+	// Routes kept in a database are not part of the file
+	if config.Storage.driver() == StorageFile {
+		return report, nil
+	}
+	s, err := newStore(config.Storage, config)
+	if err != nil {
+		report.incompatibilities = append(report.incompatibilities, err.Error())
+		return report, nil
+	}
+	defer s.Close()
+	routes, err := s.LoadRoutes()
+	if err != nil {
+		report.incompatibilities = append(report.incompatibilities, "storage: "+err.Error())
+		return report, nil
+	}
+	report.storedRoutes = len(routes)
+	for i := range routes {
+		if err := validateRoute(&routes[i], nil, config); err != nil {
+			for _, v := range err.(*ValidationError).Violations {
+				report.incompatibilities = append(report.incompatibilities, fmt.Sprintf("storage route %d: %s: %s", routes[i].ID, v.Field, v.Message))
+			}
+		}
+	}
+	return report, nil
+}
+
+// print writes the report in a form suited to a deploy log
+func (r *upgradeReport) print(configPath string) {
+	fmt.Printf("Config: %s\n", configPath)
+	fmt.Printf("Schema version: %d (this gateway: %d)\n", r.version, configSchemaVersion)
+	if len(r.migrations) > 0 {
+		fmt.Printf("Pending migrations:\n")
+		for _, m := range r.migrations {
+			fmt.Printf("  v%d: %s\n", m.version, m.description)
+		}
+	}
+	if r.config != nil && r.config.Storage.driver() != StorageFile {
+		fmt.Printf("Stored routes: %d checked (storage: %s)\n", r.storedRoutes, r.config.Storage.driver())
+	}
+	if len(r.incompatibilities) > 0 {
+		fmt.Printf("Incompatibilities:\n  %s\n", strings.Join(r.incompatibilities, "\n  "))
+	}
+}
+
+// runUpgrade implements "gateway upgrade": it reports whether the
+// persisted config works with this binary and, with --migrate, rewrites it
+// in the current format after backing it up. It returns the exit code.
+func runUpgrade(args []string) int {
+	fs := flag.NewFlagSet("gateway upgrade", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gateway upgrade [--check] [--migrate] [config.json]\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	var configPath string
+	var migrate bool
+	fs.StringVar(&configPath, "config", "", "path to the config file (default "+defaultConfigPath+")")
+	fs.Bool("check", true, "check the config against this binary without changing it")
+	fs.BoolVar(&migrate, "migrate", false, "back up the config and rewrite it in the current format")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(os.Stderr, "unexpected arguments: %s\n", strings.Join(fs.Args()[1:], " "))
+		return 2
+	}
+	if configPath == "" {
+		configPath = fs.Arg(0)
+	}
+	if configPath == "" {
+		configPath = os.Getenv(configPathEnv)
+	}
+	if configPath == "" {
+		configPath = defaultConfigPath
+	}
+
+	var err error
+	fileCrypto, err = loadFileCipher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load encryption key: %v\n", err)
+		return 1
+	}
+	report, err := checkUpgrade(configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report.print(configPath)
+
+	switch {
+	case len(report.incompatibilities) > 0:
+		fmt.Printf("Result: incompatible; fix the config before upgrading\n")
+		return 1
+	case len(report.migrations) == 0:
+		fmt.Printf("Result: compatible, already in the current format\n")
+		return 0
+	case !migrate:
+		fmt.Printf("Result: compatible; run with --migrate to update the file\n")
+		return 0
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", configPath, report.version)
+	if err := ioutil.WriteFile(backup, report.raw, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to back up config: %v\n", err)
+		return 1
+	}
+	report.config.SchemaVersion = configSchemaVersion
+	if err := report.config.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to migrate config: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Result: migrated to schema version %d; previous config saved as %s\n", configSchemaVersion, backup)
+	return 0
+}
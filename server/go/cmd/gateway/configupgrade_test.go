@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateKeepsFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	for name, tc := range map[string]struct {
+		doc  string
+		want string
+	}{
+		"no storage":      {`{"schemaVersion": 1}`, StorageFile},
+		"no driver":       {`{"schemaVersion": 1, "storage": {"dsn": ""}}`, StorageFile},
+		"chosen driver":   {`{"schemaVersion": 1, "storage": {"driver": "postgres", "dsn": "postgres://db/gateway"}}`, StoragePostgres},
+		"current version": {`{"schemaVersion": 2}`, StorageSQLite},
+	} {
+		migrated, _, _, err := migrateConfig([]byte(tc.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c := defaultConfig(path)
+		if err := decodeConfig(path, migrated, c); err != nil {
+			t.Fatalf("%s: migrated config does not load: %v", name, err)
+		}
+		if got := c.Storage.driver(); got != tc.want {
+			t.Errorf("%s: storage driver %q, want %q", name, got, tc.want)
+		}
+	}
+}
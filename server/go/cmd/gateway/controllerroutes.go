@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"strings"
+)
+
+// controllerRoute reports whether a route is kept by a controller, the
+// Kubernetes controller or the xDS client, rather than defined in a file
+// or through the admin API. Such routes survive config reloads.
+func controllerRoute(route Route) bool {
+	return strings.HasPrefix(route.source, kubernetesSource) || strings.HasPrefix(route.source, xdsSource)
+}
+
+// syncControllerRoutes creates, updates and deletes the routes whose
+// source starts with prefix to match desired, logging each change under
+// label. A route that fails validation is passed to reject and its
+// previous version, if any, kept. It returns the number of routes kept.
+func syncControllerRoutes(prefix, label string, desired []Route, reject func(Route, error)) int {
+	routeWrites.Lock()
+	defer routeWrites.Unlock()
+
+	wanted := make(map[string]bool)
+	for _, route := range desired {
+		wanted[route.source+" "+routeKey(route)] = true
+	}
+	current := make(map[string]Route)
+	for _, route := range config.getRoutes() {
+		if !strings.HasPrefix(route.source, prefix) {
+			continue
+		}
+		key := route.source + " " + routeKey(route)
+		if !wanted[key] {
+			removeControllerRoute(prefix, label, route)
+			continue
+		}
+		current[key] = route
+	}
+
+	for _, route := range desired {
+		key := route.source + " " + routeKey(route)
+		old, found := current[key]
+		if found {
+			route.ID = old.ID
+		}
+		if err := validateRoute(&route, config.getRoutes(), config); err != nil {
+			reject(route, err)
+			continue
+		}
+		change := RouteChange{Kind: RouteCreated, New: &route, Remote: true}
+		event := EventRouteCreated
+		if found {
+			if reflect.DeepEqual(old, route) {
+				continue
+			}
+			config.updateRoute(route)
+			change.Kind, change.Old, event = RouteUpdated, &old, EventRouteUpdated
+		} else {
+			route.ID = config.addRoute(route)
+		}
+		routeChanges.notify(change)
+		events.emit(event, route)
+		log.Printf("%s: %s route %d %s from %s", label, change.Kind, route.ID, route.Path, strings.TrimPrefix(route.source, prefix))
+	}
+
+	routes := 0
+	for _, route := range config.getRoutes() {
+		if strings.HasPrefix(route.source, prefix) {
+			routes++
+		}
+	}
+	return routes
+}
+
+// removeControllerRoute deletes a route a controller keeps
+func removeControllerRoute(prefix, label string, route Route) {
+	old, found := config.deleteRoute(route.ID)
+	if !found {
+		return
+	}
+	routeChanges.notify(RouteChange{Kind: RouteDeleted, Old: &old, Remote: true})
+	events.emit(EventRouteDeleted, map[string]int{"id": old.ID})
+	log.Printf("%s: deleted route %d %s from %s", label, old.ID, old.Path, strings.TrimPrefix(old.source, prefix))
+}
+
+// dropControllerRoutes deletes every route whose source starts with
+// prefix, once its controller is disabled
+func dropControllerRoutes(prefix, label string) {
+	routeWrites.Lock()
+	defer routeWrites.Unlock()
+	for _, route := range config.getRoutes() {
+		if strings.HasPrefix(route.source, prefix) {
+			removeControllerRoute(prefix, label, route)
+		}
+	}
+}
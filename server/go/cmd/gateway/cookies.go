@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// encryptedCookiePrefix marks cookie values encrypted by the gateway
+const encryptedCookiePrefix = "gw1."
+
+// CookiePolicy rewrites the cookies an upstream sets, for legacy apps
+// whose cookies are weak or scoped to internal hosts. Encrypted values are
+// decrypted again before requests reach the upstream.
+type CookiePolicy struct {
+	Strip         []string `json:"strip,omitempty"`         // cookie names dropped from responses; "*" drops all
+	Domain        string   `json:"domain,omitempty"`        // replaces the Domain attribute
+	Path          string   `json:"path,omitempty"`          // replaces the Path attribute
+	Secure        bool     `json:"secure,omitempty"`        // adds Secure
+	HttpOnly      bool     `json:"httpOnly,omitempty"`      // adds HttpOnly
+	SameSite      string   `json:"sameSite,omitempty"`      // strict, lax or none
+	Encrypt       []string `json:"encrypt,omitempty"`       // cookie names whose values are encrypted; "*" encrypts all
+	EncryptionKey string   `json:"encryptionKey,omitempty"` // secret reference to a 32-byte key in base64 or hex
+}
+
+// checkCookiePolicy validates a route's cookie policy
+func checkCookiePolicy(c *CookiePolicy, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		v.add("cookies.path", "must start with /")
+	}
+	if strings.ContainsAny(c.Domain, " ;,/") {
+		v.add("cookies.domain", "invalid domain %q", c.Domain)
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "", "strict", "lax", "none":
+	default:
+		v.add("cookies.sameSite", "unknown value %q: use strict, lax or none", c.SameSite)
+	}
+	if len(c.Encrypt) > 0 {
+		checkSecretRef("cookies.encryptionKey", c.EncryptionKey, v)
+	}
+}
+
+// cookieNamed reports whether a cookie name is in a list, where "*"
+// matches every name
+func cookieNamed(name string, names []string) bool {
+	for _, n := range names {
+		if n == "*" || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// aead builds the cipher for encrypted cookie values
+func (c *CookiePolicy) aead() (cipher.AEAD, error) {
+	raw, err := resolveSecret(c.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseEncryptionKey(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptCookie seals a cookie value, binding it to the cookie name
+func encryptCookie(aead cipher.AEAD, name, value string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(name))
+	return encryptedCookiePrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// decryptCookie opens a value sealed by encryptCookie
+func decryptCookie(aead cipher.AEAD, name, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedCookiePrefix) {
+		return "", errors.New("not encrypted by the gateway")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, encryptedCookiePrefix))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", errors.New("corrupt value")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errors.New("decryption failed")
+	}
+	return string(plain), nil
+}
+
+// applyCookiePolicy rewrites the Set-Cookie headers of an upstream response
+func applyCookiePolicy(resp *http.Response, route Route) error {
+	c := route.Cookies
+	lines := resp.Header.Values("Set-Cookie")
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var aead cipher.AEAD
+	if len(c.Encrypt) > 0 {
+		var err error
+		if aead, err = c.aead(); err != nil {
+			return err
+		}
+	}
+
+	resp.Header.Del("Set-Cookie")
+	for _, line := range lines {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil {
+			log.Printf("Dropped malformed Set-Cookie from %s: %v", route.Target, err)
+			continue
+		}
+		if cookieNamed(cookie.Name, c.Strip) {
+			continue
+		}
+		if c.Domain != "" {
+			cookie.Domain = c.Domain
+		}
+		if c.Path != "" {
+			cookie.Path = c.Path
+		}
+		cookie.Secure = cookie.Secure || c.Secure
+		cookie.HttpOnly = cookie.HttpOnly || c.HttpOnly
+		switch strings.ToLower(c.SameSite) {
+		case "strict":
+			cookie.SameSite = http.SameSiteStrictMode
+		case "lax":
+			cookie.SameSite = http.SameSiteLaxMode
+		case "none":
+			// Browsers reject SameSite=None without Secure
+			cookie.SameSite = http.SameSiteNoneMode
+			cookie.Secure = true
+		}
+		if aead != nil && cookieNamed(cookie.Name, c.Encrypt) && cookie.MaxAge >= 0 && cookie.Value != "" {
+			if cookie.Value, err = encryptCookie(aead, cookie.Name, cookie.Value); err != nil {
+				return err
+			}
+		}
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+	return nil
+}
+
+// decryptRequestCookies restores cookie values encrypted at the edge before
+// the request reaches the upstream. Cookies that fail to decrypt, such as
+// values forged by clients, are dropped.
+func decryptRequestCookies(r *http.Request, route Route) error {
+	c := route.Cookies
+	if len(c.Encrypt) == 0 || r.Header.Get("Cookie") == "" {
+		return nil
+	}
+	aead, err := c.aead()
+	if err != nil {
+		return err
+	}
+
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookieNamed(cookie.Name, c.Encrypt) {
+			value, err := decryptCookie(aead, cookie.Name, cookie.Value)
+			if err != nil {
+				log.Printf("Dropped cookie %s on %s: %v", cookie.Name, route.Path, err)
+				continue
+			}
+			cookie.Value = value
+		}
+		r.AddCookie(cookie)
+	}
+	return nil
+}
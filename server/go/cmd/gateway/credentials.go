@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// newCredentialToken generates a random hex token of n bytes
+func newCredentialToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleCredentials lists credentials and creates new ones. Secrets are only
+// returned when a credential is created.
+func handleCredentials(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		creds, err := store.ListCredentials()
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to list credentials: %v", err))
+			return
+		}
+
+		// Filter by route, including credentials entitled to it by tag
+		var filterRoute *Route
+		if routeFilter := r.URL.Query().Get("routeId"); routeFilter != "" {
+			id, _ := strconv.Atoi(routeFilter)
+			route, found := config.getRoute(id)
+			if !found {
+				route = Route{ID: id}
+			}
+			filterRoute = &route
+		}
+		listed := make([]Credential, 0, len(creds))
+		for _, c := range creds {
+			if filterRoute != nil && !c.entitles(*filterRoute, http.MethodGet) && !c.entitles(*filterRoute, http.MethodPost) {
+				continue
+			}
+			c.APISecret = ""
+			listed = append(listed, c)
+		}
+		writeJSON(w, listed)
+
+	case http.MethodPost:
+		var cred Credential
+		if err := json.NewDecoder(r.Body).Decode(&cred); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+
+		var v ValidationError
+		if strings.TrimSpace(cred.Name) == "" {
+			v.add("name", "is required")
+		}
+		checkEntitlements(cred, config.getRoutes(), &v)
+		if err := v.err(); err != nil {
+			writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Credential is invalid", v.Violations)
+			return
+		}
+
+		// Keys and secrets are always generated by the gateway
+		var err error
+		if cred.APIKey, err = newCredentialToken(16); err == nil {
+			cred.APISecret, err = newCredentialToken(32)
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to generate credential: %v", err))
+			return
+		}
+		cred.ID = 0
+		cred.Created = time.Now()
+		cred.LastUsed = nil
+		cred.Enabled = true
+
+		cred, err = store.CreateCredential(cred)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save credential: %v", err))
+			return
+		}
+		apiKeys.invalidate()
+
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, cred)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleCredential deletes a credential
+func handleCredential(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/credentials/"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "Invalid credential ID")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		found, err := store.DeleteCredential(id)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to delete credential: %v", err))
+			return
+		}
+		if !found {
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Credential not found")
+			return
+		}
+		apiKeys.invalidate()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+	}
+}
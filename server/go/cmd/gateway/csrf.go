@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRF defaults
+const (
+	defaultCSRFCookie = "gw_csrf"
+	defaultCSRFHeader = "X-CSRF-Token"
+)
+
+// defaultCSRFExemptMethods are safe methods that never change state
+var defaultCSRFExemptMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace}
+
+// CSRFConfig protects cookie-authenticated routes from cross-site requests.
+// The gateway sets a random token cookie that pages read and echo back in a
+// header or form field (double submit); state-changing requests without a
+// matching token, or from another site, are rejected.
+type CSRFConfig struct {
+	CookieName     string   `json:"cookieName,omitempty"`     // defaults to gw_csrf
+	HeaderName     string   `json:"headerName,omitempty"`     // defaults to X-CSRF-Token
+	FormField      string   `json:"formField,omitempty"`      // also accept the token from urlencoded forms
+	ExemptMethods  []string `json:"exemptMethods,omitempty"`  // defaults to GET, HEAD, OPTIONS and TRACE
+	ExemptPaths    []string `json:"exemptPaths,omitempty"`    // path prefixes skipped, e.g. webhooks
+	TrustedOrigins []string `json:"trustedOrigins,omitempty"` // other origins allowed to submit, e.g. https://admin.example.com
+	SameSite       string   `json:"sameSite,omitempty"`       // token cookie attribute: strict or lax (default)
+}
+
+// checkCSRF validates a route's CSRF settings
+func checkCSRF(c *CSRFConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	if c.CookieName != "" && strings.ContainsAny(c.CookieName, " \t;,=\"") {
+		v.add("csrf.cookieName", "invalid cookie name %q", c.CookieName)
+	}
+	for _, method := range c.ExemptMethods {
+		if !validMethods[method] {
+			v.add("csrf.exemptMethods", "%q is not a valid HTTP method", method)
+		}
+	}
+	for _, origin := range c.TrustedOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			v.add("csrf.trustedOrigins", "invalid origin %q: use scheme://host[:port]", origin)
+		}
+	}
+	switch strings.ToLower(c.SameSite) {
+	case "", "strict", "lax":
+	default:
+		v.add("csrf.sameSite", "unknown value %q: use strict or lax", c.SameSite)
+	}
+}
+
+// cookieName returns the name of the token cookie
+func (c *CSRFConfig) cookieName() string {
+	if c.CookieName == "" {
+		return defaultCSRFCookie
+	}
+	return c.CookieName
+}
+
+// exempt reports whether a request is not checked
+func (c *CSRFConfig) exempt(r *http.Request) bool {
+	methods := c.ExemptMethods
+	if len(methods) == 0 {
+		methods = defaultCSRFExemptMethods
+	}
+	for _, m := range methods {
+		if m == r.Method {
+			return true
+		}
+	}
+	for _, prefix := range c.ExemptPaths {
+		if pathMatches(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossSite reports why a request comes from another site, or "" if it
+// does not. Browsers send Sec-Fetch-Site and Origin on state-changing
+// requests; requests with neither are left to the token check.
+func (c *CSRFConfig) crossSite(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin != "" && origin != "null" {
+		for _, trusted := range c.TrustedOrigins {
+			if strings.EqualFold(origin, trusted) {
+				return ""
+			}
+		}
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			return "origin " + origin + " is not allowed"
+		}
+		return ""
+	}
+	if r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+		return "cross-site request"
+	}
+	return ""
+}
+
+// submittedToken returns the token sent in the header or form field
+func (c *CSRFConfig) submittedToken(r *http.Request) string {
+	header := c.HeaderName
+	if header == "" {
+		header = defaultCSRFHeader
+	}
+	if token := r.Header.Get(header); token != "" {
+		return token
+	}
+	if c.FormField == "" {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return ""
+	}
+	data, ok := peekRequestBody(r)
+	if !ok {
+		return ""
+	}
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return ""
+	}
+	return form.Get(c.FormField)
+}
+
+// issueCSRFToken sets a new token cookie, readable by the route's pages
+func (c *CSRFConfig) issueCSRFToken(w http.ResponseWriter, r *http.Request, route Route) {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	sameSite := http.SameSiteLaxMode
+	if strings.EqualFold(c.SameSite, "strict") {
+		sameSite = http.SameSiteStrictMode
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookieName(),
+		Value:    hex.EncodeToString(buf),
+		Path:     route.Path,
+		Secure:   r.TLS != nil,
+		SameSite: sameSite,
+	})
+}
+
+// checkCSRFRequest rejects state-changing requests that come from another
+// site or lack the token matching the cookie. Requests without cookies
+// carry no ambient credentials and pass. It returns false if the request
+// has been answered.
+func checkCSRFRequest(w http.ResponseWriter, r *http.Request, route Route) bool {
+	c := route.CSRF
+	cookie, err := r.Cookie(c.cookieName())
+	if err != nil || cookie.Value == "" {
+		c.issueCSRFToken(w, r, route)
+	}
+
+	if c.exempt(r) || r.Header.Get("Cookie") == "" {
+		return true
+	}
+
+	reject := func(reason string) bool {
+		log.Printf("CSRF check failed for %s %s: %s", r.Method, r.URL.Path, reason)
+		writeErrorDetails(w, r, http.StatusForbidden, ErrCodeCSRFFailed, "CSRF check failed",
+			map[string]interface{}{"reason": reason})
+		return false
+	}
+	if reason := c.crossSite(r); reason != "" {
+		return reject(reason)
+	}
+	if cookie == nil || cookie.Value == "" {
+		return reject("missing token cookie")
+	}
+	token := c.submittedToken(r)
+	if token == "" {
+		return reject("missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+		return reject("token mismatch")
+	}
+	return true
+}
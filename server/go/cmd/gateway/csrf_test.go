@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// csrfPost builds a state-changing request carrying the token cookie
+func csrfPost(path, body, token string) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.AddCookie(&http.Cookie{Name: defaultCSRFCookie, Value: token})
+	return r
+}
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), func(_ *Config, route *Route) {
+		route.CSRF = &CSRFConfig{
+			FormField:      "csrf",
+			ExemptPaths:    []string{"/svc/hooks"},
+			TrustedOrigins: []string{"https://admin.example.com"},
+		}
+	})
+
+	w := serveProxy(httptest.NewRequest("GET", "/svc/page", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultCSRFCookie || cookies[0].Value == "" {
+		t.Fatalf("GET set cookies %v, want a token cookie", cookies)
+	}
+	token := cookies[0].Value
+
+	for name, tc := range map[string]struct {
+		r    func() *http.Request
+		want int
+	}{
+		"header token": {func() *http.Request {
+			r := csrfPost("/svc/items", "", token)
+			r.Header.Set(defaultCSRFHeader, token)
+			return r
+		}, http.StatusNotFound},
+		"form token": {func() *http.Request {
+			r := csrfPost("/svc/items", "csrf="+token, token)
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			return r
+		}, http.StatusNotFound},
+		"trusted origin": {func() *http.Request {
+			r := csrfPost("/svc/items", "", token)
+			r.Header.Set(defaultCSRFHeader, token)
+			r.Header.Set("Origin", "https://admin.example.com")
+			return r
+		}, http.StatusNotFound},
+		"no cookies": {func() *http.Request {
+			return httptest.NewRequest("POST", "/svc/items", nil)
+		}, http.StatusNotFound},
+		"exempt path": {func() *http.Request {
+			return csrfPost("/svc/hooks/github", "", token)
+		}, http.StatusNotFound},
+		"missing token": {func() *http.Request {
+			return csrfPost("/svc/items", "", token)
+		}, http.StatusForbidden},
+		"token mismatch": {func() *http.Request {
+			r := csrfPost("/svc/items", "", token)
+			r.Header.Set(defaultCSRFHeader, token+"0")
+			return r
+		}, http.StatusForbidden},
+		"other origin": {func() *http.Request {
+			r := csrfPost("/svc/items", "", token)
+			r.Header.Set(defaultCSRFHeader, token)
+			r.Header.Set("Origin", "https://evil.example")
+			return r
+		}, http.StatusForbidden},
+		"cross-site fetch": {func() *http.Request {
+			r := csrfPost("/svc/items", "", token)
+			r.Header.Set(defaultCSRFHeader, token)
+			r.Header.Set("Sec-Fetch-Site", "cross-site")
+			return r
+		}, http.StatusForbidden},
+	} {
+		// The upstream answers 404, so passing requests are those that reach it
+		if w := serveProxy(tc.r()); w.Code != tc.want {
+			t.Errorf("%s: status %d, want %d: %s", name, w.Code, tc.want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation or a parent process
+const listenFDsStart = 3
+
+// Listener names matched against LISTEN_FDNAMES
+const (
+	listenerProxy = "proxy"
+	listenerAdmin = "admin"
+)
+
+// inheritedListeners holds the listening sockets passed to the gateway at
+// startup, by name
+type inheritedListeners struct {
+	mutex     sync.Mutex
+	listeners map[string]net.Listener
+	unnamed   []net.Listener
+}
+
+// inherited holds the sockets passed by systemd or a parent process
+var inherited = &inheritedListeners{}
+
+// load takes over the sockets described by LISTEN_FDS and LISTEN_FDNAMES.
+// Systemd also sets LISTEN_PID, which must match this process; a parent
+// process handing over its sockets on upgrade leaves it unset. The
+// variables are cleared so they do not leak into child processes.
+func (l *inheritedListeners) load() error {
+	pid, fds, names := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if fds == "" {
+		return nil
+	}
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.listeners = make(map[string]net.Listener)
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i < len(fdNames) {
+			name = fdNames[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited fd %d: %v", fd, err)
+		}
+		if name != "" && name != "unknown" {
+			l.listeners[name] = listener
+		} else {
+			l.unnamed = append(l.unnamed, listener)
+		}
+		log.Printf("Inherited listener %s on fd %d (%s)", name, fd, listener.Addr())
+	}
+	return nil
+}
+
+// take returns the inherited socket for a listener, by name or, for
+// unnamed sockets, in the order proxy then admin
+func (l *inheritedListeners) take(name string) (net.Listener, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if listener, ok := l.listeners[name]; ok {
+		delete(l.listeners, name)
+		return listener, true
+	}
+	if len(l.unnamed) > 0 {
+		listener := l.unnamed[0]
+		l.unnamed = l.unnamed[1:]
+		return listener, true
+	}
+	return nil, false
+}
+
+// close closes inherited sockets no listener took
+func (l *inheritedListeners) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name, listener := range l.listeners {
+		log.Printf("Warning: closing unused inherited listener %s (%s)", name, listener.Addr())
+		listener.Close()
+	}
+	for _, listener := range l.unnamed {
+		log.Printf("Warning: closing unused inherited listener %s", listener.Addr())
+		listener.Close()
+	}
+	l.listeners, l.unnamed = nil, nil
+}
+
+// listen returns the inherited socket for a listener, or opens one on port
+func listen(name string, port int) (net.Listener, error) {
+	if listener, ok := inherited.take(name); ok {
+		return listener, nil
+	}
+	return net.Listen("tcp", fmt.Sprintf(":%d", port))
+}
+
+// writePIDFile records the gateway's process ID
+func writePIDFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removePIDFile deletes the PID file if it still names this process; after
+// an upgrade it belongs to the new process
+func removePIDFile(path string) {
+	if path == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil || string(bytes.TrimSpace(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove PID file %s: %v", path, err)
+	}
+}
+
+// logOutput is the log file, if logging to one
+var (
+	logOutputMutex sync.Mutex
+	logOutput      *os.File
+)
+
+// openLogFile switches logging to path, closing the previous log file
+func openLogFile(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	logOutputMutex.Lock()
+	defer logOutputMutex.Unlock()
+
+	log.SetOutput(file)
+	if logOutput != nil {
+		logOutput.Close()
+	}
+	logOutput = file
+	return nil
+}
+
+// reopenLogs reopens the log and recording files, so they can be rotated by
+// moving them aside and sending SIGUSR1
+func reopenLogs(c *Config) {
+	settings := c.settings()
+	if settings.LogFile != "" {
+		if err := openLogFile(settings.LogFile); err != nil {
+			log.Printf("Failed to reopen log file %s: %v", settings.LogFile, err)
+		} else {
+			log.Printf("Reopened log file %s", settings.LogFile)
+		}
+	}
+	traffic.reopen()
+}
+
+// handleReopenSignal reopens the log files each time SIGUSR1 arrives
+func handleReopenSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			reopenLogs(config)
+		}
+	}()
+}
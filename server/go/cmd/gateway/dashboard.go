@@ -0,0 +1,49 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+)
+
+// dashboardAssets holds the built dashboard frontend. Populate the
+// dashboard directory with `npm run build:gateway-ui` before building.
+//
+//go:embed all:dashboard
+var dashboardAssets embed.FS
+
+// defaultDashboardPath is where the dashboard is mounted by default
+const defaultDashboardPath = "/dashboard"
+
+// DashboardConfig configures the embedded management dashboard
+type DashboardConfig struct {
+	Enabled bool   `json:"enabled"`
+	Path    string `json:"path"`
+}
+
+// dashboardHandler serves the embedded dashboard under the given path
+func dashboardHandler(path string) http.Handler {
+	assets, err := fs.Sub(dashboardAssets, "dashboard")
+	if err != nil {
+		// The embed directive guarantees the directory exists
+		panic(err)
+	}
+	root := http.FS(assets)
+
+	return requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveFiles(w, r, root, path, defaultStaticIndex, true, 31536000)
+	}))
+}
+
+// dashboardMountPath normalizes the configured dashboard path
+func dashboardMountPath(cfg DashboardConfig) string {
+	path := strings.TrimRight(cfg.Path, "/")
+	if path == "" {
+		path = defaultDashboardPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Debug header defaults
+const (
+	defaultDebugHeader   = "X-Gateway-Debug"
+	defaultDebugTokenTTL = 15 * time.Minute
+	maxDebugTokenTTL     = 24 * time.Hour
+)
+
+// Response headers debug mode adds
+const (
+	debugRouteHeader     = "X-Gateway-Route"
+	debugTargetHeader    = "X-Gateway-Target"
+	debugDecisionsHeader = "X-Gateway-Decisions"
+)
+
+// DebugConfig controls the debug response headers, which report the
+// route, target and middleware decisions that handled a request. They are
+// sent for routes with debug set, and for requests carrying a debug token
+// issued by POST /debug/tokens.
+type DebugConfig struct {
+	Header      string `json:"header,omitempty"`      // request header carrying debug tokens; defaults to X-Gateway-Debug
+	TokenSecret string `json:"tokenSecret,omitempty"` // signs debug tokens; may be a secret reference. Unset, tokens last until restart.
+}
+
+// checkDebug validates the debug header settings
+func checkDebug(c DebugConfig, v *ValidationError) {
+	if c.TokenSecret != "" {
+		checkSettingsSecretRef("debug.tokenSecret", c.TokenSecret, v)
+	}
+}
+
+// header returns the request header debug tokens are read from
+func (c DebugConfig) header() string {
+	if c.Header == "" {
+		return defaultDebugHeader
+	}
+	return c.Header
+}
+
+// debugProcessSecret signs tokens when no secret is configured
+var debugProcessSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// debugSecret returns the key debug tokens are signed with
+func debugSecret() ([]byte, error) {
+	if config.settings().Debug.TokenSecret == "" {
+		return debugProcessSecret, nil
+	}
+	secret, err := resolveSecret(config.settings().Debug.TokenSecret)
+	return []byte(secret), err
+}
+
+// signDebugToken issues a token valid until expires, for one route or, with
+// routeID 0, every route. Tokens read "<expires>.<routeID>.<signature>".
+func signDebugToken(expires time.Time, routeID int) (string, error) {
+	secret, err := debugSecret()
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(expires.Unix(), 10) + "." + strconv.Itoa(routeID)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// validDebugToken reports whether token is unexpired and covers routeID
+func validDebugToken(token string, routeID int, now time.Time) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expires {
+		return false
+	}
+	scope, err := strconv.Atoi(parts[1])
+	if err != nil || (scope != 0 && scope != routeID) {
+		return false
+	}
+	expected, err := signDebugToken(time.Unix(expires, 0), scope)
+	return err == nil && hmac.Equal([]byte(token), []byte(expected))
+}
+
+// debugWriter adds the debug headers to the response once its status is
+// known, so they describe the whole middleware chain
+type debugWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	wrote bool
+}
+
+// debugResponse returns w wrapped to report debug headers when the route
+// or a debug token asks for them. The token is not forwarded upstream.
+func debugResponse(w http.ResponseWriter, r *http.Request, route Route) http.ResponseWriter {
+	header := config.settings().Debug.header()
+	token := r.Header.Get(header)
+	r.Header.Del(header)
+	if !route.Debug && (token == "" || !validDebugToken(token, route.ID, time.Now())) {
+		return w
+	}
+	return &debugWriter{ResponseWriter: w, r: r}
+}
+
+// WriteHeader adds the debug headers before the status is written
+func (d *debugWriter) WriteHeader(status int) {
+	d.addHeaders()
+	d.ResponseWriter.WriteHeader(status)
+}
+
+// Write adds the debug headers before an implicit 200
+func (d *debugWriter) Write(b []byte) (int, error) {
+	d.addHeaders()
+	return d.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (d *debugWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
+
+// addHeaders reports the request's route, target and decisions
+func (d *debugWriter) addHeaders() {
+	if d.wrote {
+		return
+	}
+	d.wrote = true
+	rc := requestContext(d.r)
+	if rc == nil {
+		return
+	}
+	h := d.ResponseWriter.Header()
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	h.Set(debugRouteHeader, fmt.Sprintf("%d %s", rc.RouteID, rc.RoutePath))
+	if rc.target != "" {
+		h.Set(debugTargetHeader, rc.target)
+	}
+	if decisions := rc.debugDecisions(); len(decisions) > 0 {
+		h.Set(debugDecisionsHeader, strings.Join(decisions, "; "))
+	}
+}
+
+// debugDecisions lists what the middleware resolved, as name=value pairs.
+// The caller holds the context's lock.
+func (rc *RequestContext) debugDecisions() []string {
+	var decisions []string
+	add := func(name, value string) {
+		if value != "" {
+			decisions = append(decisions, name+"="+value)
+		}
+	}
+	add("auth", rc.AuthMethod)
+	add("tenant", rc.Tenant)
+	add("country", rc.Country)
+	add("version", rc.Version)
+	add("variant", rc.Variant)
+	var sampled []string
+	if rc.sampling.accessLog {
+		sampled = append(sampled, "log")
+	}
+	if rc.span.sampled {
+		sampled = append(sampled, "trace")
+	}
+	if rc.sampling.capture != nil && *rc.sampling.capture {
+		sampled = append(sampled, "capture")
+	}
+	add("sampled", strings.Join(sampled, ","))
+	return append(decisions, rc.decisions...)
+}
+
+// note records a middleware decision for the debug headers
+func (rc *RequestContext) note(name, value string) {
+	if rc == nil {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.decisions = append(rc.decisions, name+"="+value)
+}
+
+// setTarget records the upstream a request is sent to
+func (rc *RequestContext) setTarget(target string) {
+	if rc == nil {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.target = target
+}
+
+// DebugToken is a token that turns on debug headers for its bearer
+type DebugToken struct {
+	Token   string    `json:"token"`
+	Header  string    `json:"header"` // request header to send it in
+	RouteID int       `json:"routeId,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleDebugTokens issues debug tokens to admins. The body may set ttl,
+// in seconds, and routeId to limit the token to one route.
+func handleDebugTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Tokens expose routing internals to whoever holds them, so minting
+	// needs admin credentials even where the rest of the API is open
+	if !config.settings().Admin.adminAuthConfigured() {
+		writeError(w, r, http.StatusForbidden, ErrCodeForbidden, "Set admin credentials to issue debug tokens")
+		return
+	}
+	var req struct {
+		TTL     int `json:"ttl"`
+		RouteID int `json:"routeId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	var v ValidationError
+	ttl := time.Duration(req.TTL) * time.Second
+	if req.TTL == 0 {
+		ttl = defaultDebugTokenTTL
+	}
+	if ttl <= 0 || ttl > maxDebugTokenTTL {
+		v.add("ttl", "must be between 1 and %d seconds", int(maxDebugTokenTTL.Seconds()))
+	}
+	if req.RouteID != 0 {
+		if _, found := config.getRoute(req.RouteID); !found {
+			v.add("routeId", "route %d does not exist", req.RouteID)
+		}
+	}
+	if err := v.err(); err != nil {
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Debug token request is invalid", err.(*ValidationError).Violations)
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := signDebugToken(expires, req.RouteID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to sign token: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, DebugToken{Token: token, Header: config.settings().Debug.header(), RouteID: req.RouteID, Expires: expires})
+}
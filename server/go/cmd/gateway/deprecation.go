@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// maxDeprecationConsumers bounds the consumers tracked per deprecated
+// route; further consumers are counted under "other"
+const maxDeprecationConsumers = 100
+
+// DeprecationConfig marks a route deprecated. Responses carry Deprecation,
+// Sunset and Link headers, and its consumers are logged and counted so
+// they can be chased before the sunset.
+type DeprecationConfig struct {
+	Since       string `json:"since,omitempty"`       // when the route was deprecated, YYYY-MM-DD or RFC 3339
+	Sunset      string `json:"sunset,omitempty"`      // when the route will be removed
+	Link        string `json:"link,omitempty"`        // migration guide
+	Successor   string `json:"successor,omitempty"`   // replacement API
+	ConsumerKey string `json:"consumerKey,omitempty"` // ip (default), header:<name> or claim:<name>
+}
+
+// DeprecationStat counts the use of a deprecated route
+type DeprecationStat struct {
+	Requests  int64            `json:"requests"`
+	Sunset    string           `json:"sunset,omitempty"`
+	Consumers map[string]int64 `json:"consumers"`
+}
+
+// parseDeprecationDate accepts a date or an RFC 3339 timestamp
+func parseDeprecationDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q: use YYYY-MM-DD or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// checkDeprecation validates a route's deprecation settings
+func checkDeprecation(d *DeprecationConfig, v *ValidationError) {
+	if d == nil {
+		return
+	}
+	var since, sunset time.Time
+	var err error
+	if d.Since != "" {
+		if since, err = parseDeprecationDate(d.Since); err != nil {
+			v.add("deprecation.since", "%v", err)
+		}
+	}
+	if d.Sunset != "" {
+		if sunset, err = parseDeprecationDate(d.Sunset); err != nil {
+			v.add("deprecation.sunset", "%v", err)
+		}
+	}
+	if !since.IsZero() && !sunset.IsZero() && sunset.Before(since) {
+		v.add("deprecation.sunset", "must not be before since")
+	}
+	checkDeprecationLink("deprecation.link", d.Link, v)
+	checkDeprecationLink("deprecation.successor", d.Successor, v)
+	if d.ConsumerKey == rateLimitKeyRoute || !validRateLimitKey(d.ConsumerKey) {
+		v.add("deprecation.consumerKey", "invalid key %q: use ip, header:<name> or claim:<name>", d.ConsumerKey)
+	}
+}
+
+// checkDeprecationLink reports a link that is not a URL or path
+func checkDeprecationLink(field, link string, v *ValidationError) {
+	if link == "" {
+		return
+	}
+	if u, err := url.Parse(link); err != nil || (u.Scheme == "" && u.Path == "") {
+		v.add(field, "invalid link %q", link)
+	}
+}
+
+// setDeprecationHeaders announces a route's deprecation (RFC 9745) and
+// sunset (RFC 8594) to the client
+func setDeprecationHeaders(w http.ResponseWriter, d *DeprecationConfig) {
+	h := w.Header()
+	if since, err := parseDeprecationDate(d.Since); err == nil {
+		h.Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+	} else {
+		h.Set("Deprecation", "true")
+	}
+	if sunset, err := parseDeprecationDate(d.Sunset); err == nil {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", d.Link))
+	}
+	if d.Successor != "" {
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", d.Successor))
+	}
+}
+
+// markDeprecated stamps the deprecation headers on a deprecated route's
+// response and records which consumer used it
+func markDeprecated(w http.ResponseWriter, r *http.Request, route Route) {
+	d := route.Deprecation
+	if d == nil {
+		return
+	}
+	setDeprecationHeaders(w, d)
+
+	source := d.ConsumerKey
+	if source == "" {
+		source = rateLimitKeyIP
+	}
+	proxy.recordDeprecatedUse(route, clientKey(r, source))
+}
+
+// recordDeprecatedUse counts a request to a deprecated route, logging each
+// consumer the first time it is seen
+func (p *Proxy) recordDeprecatedUse(route Route, consumer string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	stat, ok := p.stats.Deprecations[route.Path]
+	if !ok {
+		stat = DeprecationStat{Consumers: make(map[string]int64)}
+	}
+	stat.Requests++
+	stat.Sunset = route.Deprecation.Sunset
+
+	if _, seen := stat.Consumers[consumer]; !seen {
+		if len(stat.Consumers) >= maxDeprecationConsumers {
+			consumer = "other"
+		} else {
+			log.Printf("Deprecated route %s used by %s", route.Path, consumer)
+		}
+	}
+	stat.Consumers[consumer]++
+	p.stats.Deprecations[route.Path] = stat
+}
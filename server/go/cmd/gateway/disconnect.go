@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// clientGone reports whether the client disconnected. The server cancels
+// the request context when the connection closes or a write to it fails,
+// which also cancels the upstream request derived from it.
+func clientGone(clientCtx context.Context) bool {
+	return clientCtx.Err() != nil
+}
+
+// recoverClientAbort counts a streamed response cut short by the client.
+// ReverseProxy aborts the handler with http.ErrAbortHandler when copying
+// the body fails; the panic is passed on so the server drops the
+// connection.
+func (p *Proxy) recoverClientAbort(clientCtx context.Context, r *http.Request, path string) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler && clientGone(clientCtx) {
+		log.Printf("Client closed request: %s %s", r.Method, r.URL.Path)
+		p.recordClientAbort(path)
+	}
+	panic(v)
+}
+
+// recordClientAbort counts a request abandoned by its client. Aborts are
+// kept apart from errors: neither the upstream nor the gateway failed.
+func (p *Proxy) recordClientAbort(path string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	p.stats.ClientAborts++
+	routeStat := p.stats.RouteStats[path]
+	routeStat.ClientAborts++
+	p.stats.RouteStats[path] = routeStat
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// DrainState reports the progress of draining a service. A draining
+// service gets no new requests, while those in flight run to completion.
+type DrainState struct {
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"` // when the last in-flight request finished
+	Removed   bool       `json:"removed,omitempty"`   // no route uses the service; it is dropped once drained
+}
+
+// startDrain marks a service as draining and reports whether it already
+// has no requests in flight. Callers hold servicesMutex.
+func (svc *Service) startDrain(removed bool, now time.Time) bool {
+	if svc.Drain == nil {
+		svc.Drain = &DrainState{Started: now}
+	}
+	// Replace rather than modify the state, as copies of the service share it
+	drain := *svc.Drain
+	drain.Removed = drain.Removed || removed
+	svc.Drain = &drain
+	return svc.finishDrain(now)
+}
+
+// finishDrain records a drain as complete once nothing is in flight and
+// reports whether it just completed. Callers hold servicesMutex.
+func (svc *Service) finishDrain(now time.Time) bool {
+	if svc.Drain == nil || svc.Drain.Completed != nil || svc.InFlight > 0 {
+		return false
+	}
+	drain := *svc.Drain
+	drain.Completed = &now
+	svc.Drain = &drain
+	return true
+}
+
+// drainService stops new requests to a service. Services no route uses any
+// more are dropped from the registry once drained.
+func (p *Proxy) drainService(name string, removed bool) (Service, bool) {
+	p.servicesMutex.Lock()
+	svc, ok := p.services[name]
+	if !ok {
+		p.servicesMutex.Unlock()
+		return Service{}, false
+	}
+	started := svc.Drain == nil
+	drained := svc.startDrain(removed, time.Now())
+	if drained && svc.Drain.Removed {
+		delete(p.services, name)
+	}
+	current := *svc
+	p.servicesMutex.Unlock()
+
+	if started {
+		log.Printf("Draining service %s: %d requests in flight", name, current.InFlight)
+		events.emit(EventServiceDraining, current)
+	}
+	if drained {
+		log.Printf("Service %s drained", name)
+		events.emit(EventServiceDrained, current)
+	}
+	return current, true
+}
+
+// undrainService sends new requests to a service again
+func (p *Proxy) undrainService(name string) (Service, bool) {
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	svc, ok := p.services[name]
+	if !ok {
+		return Service{}, false
+	}
+	if svc.Drain != nil {
+		log.Printf("Stopped draining service %s", name)
+	}
+	svc.Drain = nil
+	return *svc, true
+}
+
+// targetDraining reports whether a route's target is draining
+func (p *Proxy) targetDraining(route Route) bool {
+	name, err := serviceName(route.Target)
+	if err != nil {
+		return false
+	}
+	svc, ok := p.getService(name)
+	return ok && svc.Drain != nil
+}
+
+// acquireTarget counts a request in flight to a route's target. It returns
+// false if the target is draining; otherwise release must be called once
+// the request is done.
+func (p *Proxy) acquireTarget(route Route) (func(), bool) {
+	name, err := serviceName(route.Target)
+	if err != nil {
+		return func() {}, true
+	}
+
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	svc, ok := p.services[name]
+	if !ok {
+		return func() {}, true
+	}
+	if svc.Drain != nil {
+		return nil, false
+	}
+	svc.InFlight++
+
+	return func() {
+		p.servicesMutex.Lock()
+		svc.InFlight--
+		drained := svc.finishDrain(time.Now())
+		if drained && svc.Drain.Removed && p.services[name] == svc {
+			delete(p.services, name)
+		}
+		current := *svc
+		p.servicesMutex.Unlock()
+
+		if drained {
+			log.Printf("Service %s drained", name)
+			events.emit(EventServiceDrained, current)
+		}
+	}, true
+}
+
+// handleServiceDrain starts (POST), reports (GET) or cancels (DELETE) the
+// draining of a service
+func handleServiceDrain(w http.ResponseWriter, r *http.Request, name string) {
+	var svc Service
+	var found bool
+	switch r.Method {
+	case http.MethodGet:
+		svc, found = proxy.getService(name)
+	case http.MethodPost:
+		svc, found = proxy.drainService(name, false)
+	case http.MethodDelete:
+		svc, found = proxy.undrainService(name)
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if !found {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+		return
+	}
+	writeJSON(w, svc)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routeProxyDirect disables the egress proxy for a route
+const routeProxyDirect = "direct"
+
+// EgressProxyConfig configures the forward proxy used for upstream connections
+type EgressProxyConfig struct {
+	URL     string   `json:"url"`     // http://, https:// or socks5:// proxy URL
+	NoProxy []string `json:"noProxy"` // hosts, .domain suffixes, CIDRs or "*"
+}
+
+// egressProxyFunc returns the proxy selector for a route's upstream
+// requests, or nil when connections should be made directly
+func egressProxyFunc(global EgressProxyConfig, route Route) (func(*http.Request) (*url.URL, error), error) {
+	rawURL := global.URL
+	if route.UpstreamProxy != "" {
+		rawURL = route.UpstreamProxy
+	}
+	if rawURL == "" || rawURL == routeProxyDirect {
+		return nil, nil
+	}
+
+	proxyURL, err := parseEgressProxyURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	noProxy := global.NoProxy
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassEgressProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// parseEgressProxyURL validates a proxy URL
+func parseEgressProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL: %v", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("upstream proxy URL %q has no host", rawURL)
+	}
+
+	return proxyURL, nil
+}
+
+// bypassEgressProxy reports whether host matches an entry in the no-proxy list
+func bypassEgressProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		case strings.HasPrefix(entry, "."):
+			if strings.HasSuffix(host, entry) || host == entry[1:] {
+				return true
+			}
+		default:
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Environment variables that supply the key for encrypting files at rest.
+// The command variant lets a KMS or secret manager CLI print the key.
+const (
+	encryptionKeyEnv        = "GATEWAY_ENCRYPTION_KEY"
+	encryptionKeyFileEnv    = "GATEWAY_ENCRYPTION_KEY_FILE"
+	encryptionKeyCommandEnv = "GATEWAY_ENCRYPTION_KEY_COMMAND"
+)
+
+// encryptedFileHeader marks files written by fileCipher
+var encryptedFileHeader = []byte("GATEWAY-ENCRYPTED-V1\n")
+
+// fileCipher encrypts persisted files with AES-256-GCM. A nil fileCipher
+// reads and writes plaintext.
+type fileCipher struct {
+	aead cipher.AEAD
+}
+
+// loadFileCipher builds a cipher from the configured key source, returning
+// nil if no key is configured
+func loadFileCipher() (*fileCipher, error) {
+	var raw, source string
+	switch {
+	case os.Getenv(encryptionKeyEnv) != "":
+		raw, source = os.Getenv(encryptionKeyEnv), encryptionKeyEnv
+	case os.Getenv(encryptionKeyFileEnv) != "":
+		path := os.Getenv(encryptionKeyFileEnv)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading encryption key: %v", err)
+		}
+		raw, source = string(data), path
+	case os.Getenv(encryptionKeyCommandEnv) != "":
+		command := os.Getenv(encryptionKeyCommandEnv)
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running %s: %v: %s", encryptionKeyCommandEnv, err, strings.TrimSpace(stderr.String()))
+		}
+		raw, source = string(out), encryptionKeyCommandEnv
+	default:
+		return nil, nil
+	}
+
+	key, err := parseEncryptionKey(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("encryption key from %s: %v", source, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{aead: aead}, nil
+}
+
+// parseEncryptionKey decodes a 32-byte key given as base64 or hex
+func parseEncryptionKey(s string) ([]byte, error) {
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("must be 32 bytes encoded as base64 or hex")
+}
+
+// isEncrypted reports whether data was written by a fileCipher
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedFileHeader)
+}
+
+// seal encrypts data, or returns it unchanged if c is nil
+func (c *fileCipher) seal(data []byte) ([]byte, error) {
+	if c == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := c.aead.Seal(nonce, nonce, data, encryptedFileHeader)
+
+	out := make([]byte, 0, len(encryptedFileHeader)+base64.StdEncoding.EncodedLen(len(sealed))+1)
+	out = append(out, encryptedFileHeader...)
+	out = append(out, base64.StdEncoding.EncodeToString(sealed)...)
+	return append(out, '\n'), nil
+}
+
+// open decrypts data written by seal. Plaintext data is returned unchanged
+// so existing files keep loading after a key is configured.
+func (c *fileCipher) open(name string, data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%s is encrypted; set %s, %s or %s", name, encryptionKeyEnv, encryptionKeyFileEnv, encryptionKeyCommandEnv)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data[len(encryptedFileHeader):])))
+	if err != nil {
+		return nil, fmt.Errorf("%s: corrupt encrypted file: %v", name, err)
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("%s: corrupt encrypted file", name)
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plain, err := c.aead.Open(nil, nonce, ciphertext, encryptedFileHeader)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decryption failed; wrong key or corrupt file", name)
+	}
+	return plain, nil
+}
+
+// readFile reads and decrypts a file
+func (c *fileCipher) readFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(path, data)
+}
+
+// writeFile encrypts and writes a file
+func (c *fileCipher) writeFile(path string, data []byte, perm os.FileMode) error {
+	sealed, err := c.seal(data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, sealed, perm)
+}
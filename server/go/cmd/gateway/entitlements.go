@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiKeyHeader carries a credential's API key
+const apiKeyHeader = "X-Api-Key"
+
+// Entitlement scopes
+const (
+	ScopeRead  = "read"  // GET, HEAD and OPTIONS
+	ScopeWrite = "write" // every other method
+)
+
+// apiKeyRefreshInterval bounds how long credentials changed by another
+// gateway sharing the store can go unnoticed
+const apiKeyRefreshInterval = 30 * time.Second
+
+// Entitlement grants a credential access to one route, or to every route
+// carrying a tag, optionally limited to some scopes
+type Entitlement struct {
+	RouteID int      `json:"routeId,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"` // read and/or write; empty grants both
+}
+
+// checkEntitlements validates a credential's entitlements against routes
+func checkEntitlements(cred Credential, routes []Route, v *ValidationError) {
+	exists := func(id int) bool {
+		for _, route := range routes {
+			if route.ID == id {
+				return true
+			}
+		}
+		return false
+	}
+	if cred.RouteID == 0 && len(cred.Entitlements) == 0 {
+		v.add("entitlements", "a routeId or at least one entitlement is required")
+	}
+	if cred.RouteID != 0 {
+		if !exists(cred.RouteID) {
+			v.add("routeId", "route %d does not exist", cred.RouteID)
+		}
+	}
+	for _, e := range cred.Entitlements {
+		switch {
+		case (e.RouteID == 0) == (e.Tag == ""):
+			v.add("entitlements", "each entitlement needs exactly one of routeId or tag")
+		case e.RouteID != 0:
+			if !exists(e.RouteID) {
+				v.add("entitlements", "route %d does not exist", e.RouteID)
+			}
+		}
+		for _, scope := range e.Scopes {
+			if scope != ScopeRead && scope != ScopeWrite {
+				v.add("entitlements", "unknown scope %q: use read or write", scope)
+			}
+		}
+	}
+}
+
+// checkTags rejects blank route tags
+func checkTags(tags []string, v *ValidationError) {
+	for _, tag := range tags {
+		if strings.TrimSpace(tag) == "" {
+			v.add("tags", "must not be blank")
+		}
+	}
+}
+
+// methodScope returns the scope a request method needs
+func methodScope(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// hasTag reports whether a route carries tag
+func (r Route) hasTag(tag string) bool {
+	for _, t := range r.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// entitles reports whether a credential may call a route with a method.
+// A credential's RouteID grants that route in full.
+func (c Credential) entitles(route Route, method string) bool {
+	if c.RouteID != 0 && c.RouteID == route.ID {
+		return true
+	}
+	scope := methodScope(method)
+	for _, e := range c.Entitlements {
+		if e.RouteID != 0 && e.RouteID != route.ID {
+			continue
+		}
+		if e.Tag != "" && !route.hasTag(e.Tag) {
+			continue
+		}
+		if len(e.Scopes) == 0 {
+			return true
+		}
+		for _, s := range e.Scopes {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apiKeyIndex caches credentials by API key so requests do not hit the
+// store. It is invalidated when credentials change and refreshed
+// periodically for changes made elsewhere.
+type apiKeyIndex struct {
+	mutex  sync.Mutex
+	keys   map[string]Credential
+	loaded time.Time
+}
+
+// apiKeys resolves API keys to credentials
+var apiKeys = &apiKeyIndex{}
+
+// invalidate drops the cache after credentials change
+func (i *apiKeyIndex) invalidate() {
+	i.mutex.Lock()
+	i.keys = nil
+	i.mutex.Unlock()
+}
+
+// lookup returns the credential holding key
+func (i *apiKeyIndex) lookup(key string) (Credential, bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.keys == nil || time.Since(i.loaded) > apiKeyRefreshInterval {
+		creds, err := store.ListCredentials()
+		if err != nil {
+			log.Printf("Failed to load credentials: %v", err)
+			if i.keys == nil {
+				return Credential{}, false
+			}
+			// Keep serving the cached keys until the next refresh
+			i.loaded = time.Now()
+		} else {
+			i.keys = make(map[string]Credential, len(creds))
+			for _, c := range creds {
+				i.keys[c.APIKey] = c
+			}
+			i.loaded = time.Now()
+		}
+	}
+	cred, ok := i.keys[key]
+	return cred, ok
+}
+
+// authenticateAPIKey checks a request's API key against the route's
+// entitlements, answering 401 for unknown or disabled keys and 403 for
+// keys not entitled to the route
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, route Route, key string) bool {
+	cred, ok := apiKeys.lookup(key)
+	if !ok || !cred.Enabled {
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid API key")
+		return false
+	}
+	if !cred.entitles(route, r.Method) {
+		writeErrorDetails(w, r, http.StatusForbidden, ErrCodeForbidden, "API key is not entitled to this route",
+			map[string]interface{}{"credentialId": cred.ID, "routeId": route.ID, "scope": methodScope(r.Method)})
+		return false
+	}
+	requestContext(r).setConsumer(AuthMethodAPIKey, cred.Name)
+	return true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Error classes in the error breakdown. Upstream 5xx responses are
+// classed by code, as upstream_502; other gateway failures as gateway_500.
+const (
+	ErrorClassConnectRefused  = "connect_refused"
+	ErrorClassConnectionReset = "connection_reset"
+	ErrorClassDNS             = "dns"
+	ErrorClassTLS             = "tls"
+	ErrorClassTimeout         = "timeout"
+	ErrorClassBadResponse     = "bad_response"
+	ErrorClassProxy           = "proxy_error"
+	ErrorClassDraining        = "draining"
+	ErrorClassRateLimited     = "rate_limited"
+	ErrorClassAuthFailed      = "auth_failed"
+	ErrorClassBlocked         = "blocked"
+	ErrorClassInvalidRequest  = "invalid_request"
+	ErrorClassNoRoute         = "no_route"
+)
+
+// errorCodeClasses classes the gateway's own error responses by code
+var errorCodeClasses = map[string]string{
+	ErrCodeRateLimited:          ErrorClassRateLimited,
+	ErrCodeUnauthorized:         ErrorClassAuthFailed,
+	ErrCodeForbidden:            ErrorClassAuthFailed,
+	ErrCodeLockedOut:            ErrorClassAuthFailed,
+	ErrCodeCSRFFailed:           ErrorClassAuthFailed,
+	ErrCodeWebhookInvalid:       ErrorClassAuthFailed,
+	ErrCodeDuplicateDelivery:    ErrorClassInvalidRequest,
+	ErrCodeGeoBlocked:           ErrorClassBlocked,
+	ErrCodeBotBlocked:           ErrorClassBlocked,
+	ErrCodeBadRequest:           ErrorClassInvalidRequest,
+	ErrCodeInvalidBody:          ErrorClassInvalidRequest,
+	ErrCodeMethodNotAllowed:     ErrorClassInvalidRequest,
+	ErrCodePayloadTooLarge:      ErrorClassInvalidRequest,
+	ErrCodeUnsupportedMediaType: ErrorClassInvalidRequest,
+	ErrCodeUnsupportedVersion:   ErrorClassInvalidRequest,
+	ErrCodeRouteIncluded:        ErrorClassInvalidRequest,
+	ErrCodeRouteNotFound:        ErrorClassNoRoute,
+	ErrCodeGatewayTimeout:       ErrorClassTimeout,
+}
+
+// upstreamErrorClass classes a 5xx response returned by the upstream
+func upstreamErrorClass(status int) string {
+	return fmt.Sprintf("upstream_%d", status)
+}
+
+// classifyProxyError classes a failed upstream call from its error
+func classifyProxyError(err error) string {
+	var statusErr *fallbackStatusError
+	var typeErr *unexpectedContentTypeError
+	var sizeErr *responseTooLargeError
+	var timeoutErr *upstreamTimeoutError
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &statusErr):
+		return upstreamErrorClass(statusErr.status)
+	case errors.As(err, &typeErr), errors.As(err, &sizeErr):
+		return ErrorClassBadResponse
+	case errors.As(err, &timeoutErr), isTimeout(err):
+		return ErrorClassTimeout
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorClassTLS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassConnectRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassConnectionReset
+	}
+	return ErrorClassProxy
+}
+
+// setErrorClass records the cause of the error response r is about to get
+func setErrorClass(r *http.Request, class string) {
+	requestContext(r).update(func(rc *RequestContext) { rc.errorClass = class })
+}
+
+// recordErrorResponse classes an error response the gateway writes for a
+// proxied request. Admin API errors are not counted.
+func recordErrorResponse(r *http.Request, status int, code string) {
+	rc := requestContext(r)
+	if rc == nil {
+		if code == ErrCodeRouteNotFound {
+			proxy.recordError("", ErrorClassNoRoute)
+		}
+		return
+	}
+	rc.mutex.Lock()
+	path, class := rc.RoutePath, rc.errorClass
+	rc.mutex.Unlock()
+	if class == "" {
+		class = errorCodeClasses[code]
+	}
+	if class == "" {
+		class = fmt.Sprintf("gateway_%d", status)
+	}
+	proxy.recordError(path, class)
+}
+
+// errorLogBucket holds the errors of one minute or hour by route and class
+type errorLogBucket map[string]map[string]int64
+
+// entries returns the number of route and class pairs counted
+func (m errorLogBucket) entries() int {
+	n := 0
+	for _, classes := range m {
+		n += len(classes)
+	}
+	return n
+}
+
+// absorb adds another bucket's counts
+func (m errorLogBucket) absorb(other logBucket) {
+	for route, classes := range other.(errorLogBucket) {
+		if m[route] == nil {
+			m[route] = make(map[string]int64, len(classes))
+		}
+		for class, count := range classes {
+			m[route][class] += count
+		}
+	}
+}
+
+// errorClassLog keeps error counts in time buckets within the analytics
+// bounds, so the breakdown can be queried by time range
+type errorClassLog struct {
+	mutex   sync.Mutex
+	buckets bucketLog
+}
+
+// errorLog is the gateway's error breakdown over time
+var errorLog = &errorClassLog{buckets: newBucketLog(func() logBucket { return make(errorLogBucket) })}
+
+// add counts an error at now
+func (l *errorClassLog) add(now time.Time, route, class string, limits analyticsLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	m := l.buckets.bucket(now, limits).(errorLogBucket)
+	if m[route] == nil {
+		m[route] = make(map[string]int64)
+	}
+	m[route][class]++
+}
+
+// ErrorBreakdown counts errors by class over a time range
+type ErrorBreakdown struct {
+	Since   time.Time                   `json:"since"`
+	Until   time.Time                   `json:"until"`
+	Total   int64                       `json:"total"`
+	Classes map[string]int64            `json:"classes"`
+	Routes  map[string]map[string]int64 `json:"routes"` // by route path; "" holds requests no route matched
+}
+
+// breakdown sums the errors between since and until, for one route or,
+// with route empty, for all of them. Ranges reaching into counts merged
+// into hours are to the hour.
+func (l *errorClassLog) breakdown(since, until time.Time, route string) ErrorBreakdown {
+	b := ErrorBreakdown{
+		Since:   since,
+		Until:   until,
+		Classes: make(map[string]int64),
+		Routes:  make(map[string]map[string]int64),
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.buckets.each(since.Unix()/60, until.Unix()/60, func(bucket logBucket) {
+		for path, classes := range bucket.(errorLogBucket) {
+			if route != "" && path != route {
+				continue
+			}
+			if b.Routes[path] == nil {
+				b.Routes[path] = make(map[string]int64)
+			}
+			for class, count := range classes {
+				b.Total += count
+				b.Classes[class] += count
+				b.Routes[path][class] += count
+			}
+		}
+	})
+	return b
+}
+
+// recordError counts an error of the given class for a route
+func (p *Proxy) recordError(path, class string) {
+	p.statsMutex.Lock()
+	p.stats.ErrorTypes[class]++
+	p.statsMutex.Unlock()
+
+	errorLog.add(time.Now(), path, class, p.config.analyticsLimits())
+}
+
+// parseTimeParam reads an RFC 3339 time or a duration before now, such as
+// 6h, from a query parameter, falling back to def when it is not set
+func parseTimeParam(r *http.Request, name string, def time.Time) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or a duration", name)
+}
+
+// handleErrorStats returns the error breakdown by class. The since and
+// until parameters bound the range, by default the last hour; route
+// limits it to one route path.
+func handleErrorStats(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since, err := parseTimeParam(r, "since", now.Add(-time.Hour))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	until, err := parseTimeParam(r, "until", now)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	if until.Before(since) {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "until must not be before since")
+		return
+	}
+	writeJSON(w, errorLog.breakdown(since, until, r.URL.Query().Get("route")))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// requestIDHeader carries the request ID to upstreams and back to clients
+const requestIDHeader = "X-Request-ID"
+
+// Machine-readable error codes returned by the gateway
+const (
+	ErrCodeBadRequest           = "bad_request"
+	ErrCodeInvalidBody          = "invalid_body"
+	ErrCodeValidationFailed     = "validation_failed"
+	ErrCodeUnauthorized         = "unauthorized"
+	ErrCodeForbidden            = "forbidden"
+	ErrCodeGeoBlocked           = "geo_blocked"
+	ErrCodeBotBlocked           = "bot_blocked"
+	ErrCodeCSRFFailed           = "csrf_failed"
+	ErrCodeWebhookInvalid       = "webhook_invalid"
+	ErrCodeDuplicateDelivery    = "duplicate_delivery"
+	ErrCodeNotFound             = "not_found"
+	ErrCodeRouteNotFound        = "route_not_found"
+	ErrCodeMethodNotAllowed     = "method_not_allowed"
+	ErrCodeServiceInUse         = "service_in_use"
+	ErrCodeRouteIncluded        = "route_included"
+	ErrCodePayloadTooLarge      = "payload_too_large"
+	ErrCodeUnsupportedMediaType = "unsupported_media_type"
+	ErrCodeRateLimited          = "rate_limited"
+	ErrCodeLockedOut            = "locked_out"
+	ErrCodeInternal             = "internal_error"
+	ErrCodeUpstreamFailed       = "upstream_failed"
+	ErrCodeServiceUnavailable   = "service_unavailable"
+	ErrCodeGatewayTimeout       = "gateway_timeout"
+	ErrCodeUnsupportedVersion   = "unsupported_api_version"
+)
+
+// ErrorResponse is the envelope for every error the gateway itself returns
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	RequestID string      `json:"requestId,omitempty"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// writeError writes an error envelope in the format the client accepts
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorDetails(w, r, status, code, message, nil)
+}
+
+// writeErrorDetails writes an error envelope with additional details
+func writeErrorDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	recordErrorResponse(r, status, code)
+
+	resp := ErrorResponse{
+		Code:      code,
+		Message:   message,
+		RequestID: ensureRequestID(w, r),
+		Details:   details,
+	}
+
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if negotiate(r.Header.Get("Accept"), "application/json", "text/plain") == "text/plain" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if resp.RequestID != "" {
+			fmt.Fprintf(w, "%s: %s (request %s)\n", code, message, resp.RequestID)
+		} else {
+			fmt.Fprintf(w, "%s: %s\n", code, message)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(resp)
+}
+
+// ensureRequestID returns the request's ID, assigning one if the client
+// did not send it, and echoes it on the response
+func ensureRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// negotiate picks the offered media type the Accept header prefers. The
+// first offer wins ties and is used when nothing matches.
+func negotiate(accept string, offers ...string) string {
+	if accept == "" {
+		return offers[0]
+	}
+
+	best, bestQ := offers[0], -1.0
+	for _, offer := range offers {
+		q := acceptQuality(accept, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if bestQ <= 0 {
+		return offers[0]
+	}
+	return best
+}
+
+// acceptQuality returns the q-value the Accept header gives a media type,
+// using the most specific matching range
+func acceptQuality(accept, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		s := -1
+		switch {
+		case mediaRange == mediaType:
+			s = 2
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		rangeQ := 1.0
+		for _, param := range fields[1:] {
+			if name, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(name, "q") {
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					rangeQ = v
+				}
+			}
+		}
+		q, specificity = rangeQ, s
+	}
+	return q
+}
+
+// errorCodeForStatus maps a status to a generic error code
+func errorCodeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrCodeBadRequest
+	case http.StatusUnauthorized:
+		return ErrCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrCodeForbidden
+	case http.StatusNotFound:
+		return ErrCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return ErrCodeMethodNotAllowed
+	case http.StatusRequestEntityTooLarge:
+		return ErrCodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return ErrCodeUnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return ErrCodeRateLimited
+	case http.StatusBadGateway:
+		return ErrCodeUpstreamFailed
+	case http.StatusServiceUnavailable:
+		return ErrCodeServiceUnavailable
+	case http.StatusGatewayTimeout:
+		return ErrCodeGatewayTimeout
+	}
+	return ErrCodeInternal
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published by the gateway
+const (
+	EventRouteCreated       = "route.created"
+	EventRouteUpdated       = "route.updated"
+	EventRouteDeleted       = "route.deleted"
+	EventServiceUnhealthy   = "service.unhealthy"
+	EventServiceHealthy     = "service.healthy"
+	EventServiceDraining    = "service.draining"
+	EventServiceDrained     = "service.drained"
+	EventServiceFlapping    = "service.flapping"
+	EventCircuitOpened      = "circuit.opened"
+	EventCircuitClosed      = "circuit.closed"
+	EventRateLimitExceeded  = "ratelimit.tripped"
+	EventAuthLockout        = "auth.lockout"
+	EventCredentialStuffing = "auth.credential_stuffing"
+	EventAlertFiring        = "alert.firing"
+	EventAlertResolved      = "alert.resolved"
+	EventLeaderChanged      = "leader.changed"
+)
+
+// EventsConfig configures publishing of gateway events to a message broker
+type EventsConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Backend       string `json:"backend"`       // "nats" or "kafka"
+	URL           string `json:"url"`           // nats://host:4222 or Kafka REST proxy URL
+	SubjectPrefix string `json:"subjectPrefix"` // NATS subject prefix, e.g. "gateway"
+	Topic         string `json:"topic"`         // Kafka topic
+	BufferSize    int    `json:"bufferSize"`
+}
+
+// Event represents a structured gateway state change
+type Event struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// EventPublisher delivers serialized events to a broker
+type EventPublisher interface {
+	Publish(event Event, payload []byte) error
+	Close() error
+}
+
+// Event delivery timeouts
+const (
+	eventDrainTimeout = 5 * time.Second // for queued events to go out on shutdown
+	natsWriteTimeout  = 5 * time.Second
+)
+
+// rateLimitEventInterval is the least time between ratelimit.tripped
+// events for one route or gateway limit scope
+const rateLimitEventInterval = 10 * time.Second
+
+// droppedEvents counts events dropped because the queue was full
+var droppedEvents atomic.Int64
+
+// EventBus queues events and publishes them asynchronously so that
+// request handling never blocks on the broker
+type EventBus struct {
+	publisher EventPublisher
+	queue     chan Event
+	done      chan struct{} // closed once run has drained the queue
+
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// newEventBus creates an event bus for the configured backend, or nil if
+// event publishing is disabled
+func newEventBus(cfg EventsConfig) (*EventBus, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	var publisher EventPublisher
+	switch strings.ToLower(cfg.Backend) {
+	case "nats":
+		prefix := cfg.SubjectPrefix
+		if prefix == "" {
+			prefix = "gateway"
+		}
+		publisher = newNATSPublisher(cfg.URL, prefix)
+	case "kafka":
+		if cfg.Topic == "" {
+			return nil, fmt.Errorf("events: kafka topic is required")
+		}
+		publisher = newKafkaRESTPublisher(cfg.URL, cfg.Topic)
+	default:
+		return nil, fmt.Errorf("events: unsupported backend %q", cfg.Backend)
+	}
+
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1024
+	}
+
+	b := &EventBus{
+		publisher: publisher,
+		queue:     make(chan Event, bufferSize),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+
+	return b, nil
+}
+
+// emit queues an event for publishing, dropping it if the queue is full
+// or the bus is closed. It is safe to call on a nil bus.
+func (b *EventBus) emit(eventType string, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.closed {
+		return
+	}
+
+	event := Event{
+		Type:      eventType,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	select {
+	case b.queue <- event:
+	default:
+		droppedEvents.Add(1)
+	}
+}
+
+// eventSampler lets one event of a key through per interval, counting the
+// events it holds back in between
+type eventSampler struct {
+	interval time.Duration
+
+	mutex sync.Mutex
+	last  map[string]time.Time
+	held  map[string]int
+}
+
+// rateLimitEvents samples ratelimit.tripped events, as a limit under load
+// refuses many requests a second
+var rateLimitEvents = &eventSampler{interval: rateLimitEventInterval, last: make(map[string]time.Time), held: make(map[string]int)}
+
+// allow reports whether an event of key goes out now, and how many were
+// held back since the last one that did
+func (s *eventSampler) allow(key string, now time.Time) (bool, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if last, ok := s.last[key]; ok && now.Sub(last) < s.interval {
+		s.held[key]++
+		return false, 0
+	}
+	held := s.held[key]
+	s.last[key] = now
+	delete(s.held, key)
+	return true, held
+}
+
+// emitRateLimitTripped publishes a ratelimit.tripped event for key, the
+// route or scope refused, unless one went out within the interval. The
+// event's suppressed field counts the refusals not published since.
+func emitRateLimitTripped(key string, data map[string]interface{}) {
+	if events == nil {
+		return
+	}
+	ok, held := rateLimitEvents.allow(key, time.Now())
+	if !ok {
+		return
+	}
+	data["suppressed"] = held
+	events.emit(EventRateLimitExceeded, data)
+}
+
+// run publishes queued events until the queue is closed
+func (b *EventBus) run() {
+	defer close(b.done)
+	for event := range b.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode event %s: %v", event.Type, err)
+			continue
+		}
+		if err := b.publisher.Publish(event, payload); err != nil {
+			log.Printf("Failed to publish event %s: %v", event.Type, err)
+		}
+	}
+}
+
+// close stops the bus, waits for queued events to be published and closes
+// the underlying publisher. Events still queued after eventDrainTimeout
+// are dropped.
+func (b *EventBus) close() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return
+	}
+	b.closed = true
+	close(b.queue)
+	b.mutex.Unlock()
+
+	select {
+	case <-b.done:
+	case <-time.After(eventDrainTimeout):
+		log.Printf("Event queue not drained after %v, dropping %d events", eventDrainTimeout, len(b.queue))
+	}
+	b.publisher.Close()
+}
+
+// natsPublisher publishes events using the NATS text protocol
+type natsPublisher struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+	closed bool
+	mu     sync.Mutex
+}
+
+// newNATSPublisher creates a NATS publisher; the connection is established lazily
+func newNATSPublisher(rawURL, prefix string) *natsPublisher {
+	addr := rawURL
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		addr = u.Host
+	}
+	if addr == "" {
+		addr = "localhost:4222"
+	}
+	return &natsPublisher{addr: addr, prefix: prefix}
+}
+
+// connect dials the server and performs the CONNECT handshake
+func (n *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// The server greets us with an INFO line
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadString('\n'); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats: reading INFO: %v", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"api-gateway\"}\r\n"); err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.conn = conn
+
+	// Answer server keepalives so the connection is not dropped
+	go n.readLoop(conn, reader)
+
+	return nil
+}
+
+// readLoop responds to PING messages until the connection fails
+func (n *natsPublisher) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.HasPrefix(line, "PING") {
+			n.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+			conn.Write([]byte("PONG\r\n"))
+			n.mu.Unlock()
+		} else if strings.HasPrefix(line, "-ERR") {
+			log.Printf("NATS error: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// Publish sends the payload on <prefix>.<event type>
+func (n *natsPublisher) Publish(event Event, payload []byte) error {
+	return n.publishTo(n.prefix+"."+event.Type, payload)
+}
+
+// publishTo sends the payload on a subject, connecting first if needed
+func (n *natsPublisher) publishTo(subject string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return fmt.Errorf("nats: publisher closed")
+	}
+	if n.conn == nil {
+		if err := n.connect(); err != nil {
+			return err
+		}
+	}
+
+	// A stalled server must not hold the lock, and the event queue, forever
+	n.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	if _, err := n.conn.Write([]byte(msg)); err != nil {
+		// Drop the connection so the next publish reconnects
+		n.conn.Close()
+		n.conn = nil
+		return err
+	}
+
+	return nil
+}
+
+// Close closes the NATS connection; later publishes fail
+func (n *natsPublisher) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.closed = true
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn = nil
+	return err
+}
+
+// kafkaRESTPublisher publishes events through a Kafka REST proxy
+type kafkaRESTPublisher struct {
+	endpoint string
+	client   *http.Client
+}
+
+// newKafkaRESTPublisher creates a publisher for the given REST proxy and topic
+func newKafkaRESTPublisher(baseURL, topic string) *kafkaRESTPublisher {
+	return &kafkaRESTPublisher{
+		endpoint: strings.TrimRight(baseURL, "/") + "/topics/" + url.PathEscape(topic),
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Publish produces a single record keyed by event type
+func (k *kafkaRESTPublisher) Publish(event Event, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{
+			{"key": event.Type, "value": json.RawMessage(payload)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("kafka rest proxy returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Close is a no-op for the REST publisher
+func (k *kafkaRESTPublisher) Close() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitEventsSampled(t *testing.T) {
+	s := &eventSampler{interval: 10 * time.Second, last: make(map[string]time.Time), held: make(map[string]int)}
+	now := time.Now()
+	if ok, held := s.allow("route 1", now); !ok || held != 0 {
+		t.Fatalf("first trip: %v, %d held; want it published", ok, held)
+	}
+	for i := 1; i <= 3; i++ {
+		if ok, _ := s.allow("route 1", now.Add(time.Duration(i)*time.Second)); ok {
+			t.Fatalf("trip %d within the interval was published", i)
+		}
+	}
+	if ok, _ := s.allow("route 2", now.Add(time.Second)); !ok {
+		t.Fatal("another route's first trip was held back")
+	}
+	if ok, held := s.allow("route 1", now.Add(11*time.Second)); !ok || held != 3 {
+		t.Fatalf("trip after the interval: %v, %d held; want it published with 3 held", ok, held)
+	}
+}
+
+func TestEventDropsCounted(t *testing.T) {
+	b := &EventBus{queue: make(chan Event, 1)}
+	before := droppedEvents.Load()
+	for i := 0; i < 3; i++ {
+		b.emit(EventRateLimitExceeded, nil)
+	}
+	if dropped := droppedEvents.Load() - before; dropped != 2 {
+		t.Fatalf("%d events counted as dropped, want 2", dropped)
+	}
+}
+
+func TestCircuitOpensAndCloses(t *testing.T) {
+	route := Route{ID: 9, Path: "/flaky", CircuitBreaker: &CircuitBreakerConfig{Failures: 2, OpenFor: 1}}
+	cs := &circuitSet{circuits: make(map[int]*circuitState)}
+	cs.record(route, circuitFailure)
+	if ok, _ := cs.allow(route); !ok {
+		t.Fatal("circuit opened before reaching its failure count")
+	}
+	cs.record(route, circuitFailure)
+	if ok, wait := cs.allow(route); ok || wait <= 0 {
+		t.Fatalf("allow = %v, %v after 2 failures, want the circuit open", ok, wait)
+	}
+
+	cs.circuits[route.ID].openedAt = time.Now().Add(-2 * time.Second)
+	if ok, _ := cs.allow(route); !ok {
+		t.Fatal("no trial request once openFor passed")
+	}
+	if ok, _ := cs.allow(route); ok {
+		t.Fatal("a second request went through during the trial")
+	}
+	cs.record(route, circuitSuccess)
+	if ok, _ := cs.allow(route); !ok {
+		t.Fatal("circuit still open after a successful trial")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"net/http"
+	"time"
+)
+
+// defaultVariantHeader carries the assigned variant upstream and back
+const defaultVariantHeader = "X-Experiment-Variant"
+
+// ExperimentConfig splits a route's clients between variants. Clients are
+// bucketed deterministically by Key, so each keeps its variant for as long
+// as the variants and weights are unchanged.
+type ExperimentConfig struct {
+	Name     string    `json:"name"`
+	Key      string    `json:"key,omitempty"`    // ip (default), header:<name> or claim:<name>
+	Header   string    `json:"header,omitempty"` // defaults to X-Experiment-Variant
+	Variants []Variant `json:"variants"`
+}
+
+// Variant is one arm of an experiment
+type Variant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight,omitempty"` // relative share; variants default to equal shares
+	Target string `json:"target,omitempty"` // overrides the route target
+}
+
+// VariantStat counts the requests served to a variant
+type VariantStat struct {
+	Requests   int64   `json:"requests"`
+	Errors     int64   `json:"errors"` // 5xx responses
+	AvgLatency float64 `json:"avgLatency"`
+}
+
+// checkExperiment validates a route's experiment
+func checkExperiment(e *ExperimentConfig, v *ValidationError) {
+	if e == nil {
+		return
+	}
+	if e.Name == "" {
+		v.add("experiment.name", "is required")
+	}
+	if e.Key == rateLimitKeyRoute || !validRateLimitKey(e.Key) {
+		v.add("experiment.key", "invalid key %q: use ip, header:<name> or claim:<name>", e.Key)
+	}
+	if len(e.Variants) < 2 {
+		v.add("experiment.variants", "needs at least two variants")
+	}
+
+	names := make(map[string]bool, len(e.Variants))
+	for _, variant := range e.Variants {
+		switch {
+		case variant.Name == "":
+			v.add("experiment.variants", "every variant needs a name")
+		case names[variant.Name]:
+			v.add("experiment.variants", "duplicate variant %q", variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			v.add("experiment.variants."+variant.Name+".weight", "must not be negative")
+		}
+		if variant.Target != "" {
+			if err := validateTargetURL(variant.Target); err != nil {
+				v.add("experiment.variants."+variant.Name+".target", "%v", err)
+			}
+		}
+	}
+}
+
+// header returns the header naming the assigned variant
+func (e *ExperimentConfig) header() string {
+	if e.Header == "" {
+		return defaultVariantHeader
+	}
+	return e.Header
+}
+
+// assign picks the variant for a request by hashing its client key into
+// the variants' weighted shares. share scales the weight of variants whose
+// target is warming up.
+func (e *ExperimentConfig) assign(r *http.Request, share func(Variant) float64) Variant {
+	weights := make([]int, len(e.Variants))
+	total := 0
+	for i, variant := range e.Variants {
+		weights[i] = variant.Weight
+		total += variant.Weight
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = len(weights)
+	}
+	if scaled := scaleWeights(weights, e.Variants, share); scaled != nil {
+		weights, total = scaled, 0
+		for _, w := range weights {
+			total += w
+		}
+	}
+
+	source := e.Key
+	if source == "" {
+		source = rateLimitKeyIP
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "|" + clientKey(r, source)))
+	bucket := int(h.Sum32() % uint32(total))
+
+	for i, w := range weights {
+		if bucket < w {
+			return e.Variants[i]
+		}
+		bucket -= w
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+// scaleWeights applies traffic shares to variant weights, or returns nil
+// if every variant takes its full share, so assignments stay unchanged
+func scaleWeights(weights []int, variants []Variant, share func(Variant) float64) []int {
+	shares := make([]float64, len(variants))
+	full := true
+	for i, variant := range variants {
+		shares[i] = share(variant)
+		full = full && shares[i] >= 1
+	}
+	if full {
+		return nil
+	}
+	scaled := make([]int, len(weights))
+	for i, w := range weights {
+		scaled[i] = int(math.Ceil(float64(w*100) * shares[i]))
+	}
+	return scaled
+}
+
+// applyExperiment assigns the request a variant, stamps it on the request
+// and response and points the route at the variant's target. It returns a
+// function recording the outcome once the request has been served.
+func applyExperiment(w http.ResponseWriter, r *http.Request, route *Route) (http.ResponseWriter, func()) {
+	e := route.Experiment
+	if e == nil || len(e.Variants) == 0 {
+		return w, func() {}
+	}
+
+	variant := e.assign(r, func(v Variant) float64 {
+		if v.Target == "" {
+			return proxy.targetShare(route.Target)
+		}
+		return proxy.targetShare(v.Target)
+	})
+	r.Header.Set(e.header(), variant.Name)
+	w.Header().Set(e.header(), variant.Name)
+	requestContext(r).update(func(rc *RequestContext) { rc.Variant = variant.Name })
+	if variant.Target != "" {
+		route.Target = variant.Target
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		proxy.recordVariant(e.Name, variant.Name, time.Since(start), rec.statusCode())
+	}
+}
+
+// recordVariant updates the stats of an experiment variant
+func (p *Proxy) recordVariant(experiment, variant string, latency time.Duration, status int) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	variants, ok := p.stats.Experiments[experiment]
+	if !ok {
+		variants = make(map[string]VariantStat)
+		p.stats.Experiments[experiment] = variants
+	}
+	stat := variants[variant]
+	stat.Requests++
+	stat.AvgLatency = (stat.AvgLatency*float64(stat.Requests-1) + latency.Seconds()) / float64(stat.Requests)
+	if status >= 500 {
+		stat.Errors++
+	}
+	variants[variant] = stat
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fallbackHeader tells clients which fallback answered the request
+const fallbackHeader = "X-Gateway-Fallback"
+
+// Stale response cache limits
+const (
+	maxStaleBody    = 1 << 20
+	maxStaleEntries = 1000
+)
+
+// FallbackConfig defines what a route serves when its primary target is
+// unhealthy, unreachable or returns one of the OnStatus codes. A fallback
+// target is tried first, then the last good response, then the static
+// response.
+type FallbackConfig struct {
+	Target   string `json:"target,omitempty"`   // degraded-mode upstream
+	OnStatus []int  `json:"onStatus,omitempty"` // primary statuses that trigger the fallback
+
+	// ServeStale answers GET requests with the last successful response
+	ServeStale bool `json:"serveStale,omitempty"`
+
+	// Static response; Status defaults to 200 when a body is given
+	Status      int               `json:"status,omitempty"`
+	Body        string            `json:"body,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// triggeredBy reports whether a primary status triggers the fallback
+func (f *FallbackConfig) triggeredBy(status int) bool {
+	for _, s := range f.OnStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// hasStatic reports whether a static response is configured
+func (f *FallbackConfig) hasStatic() bool {
+	return f.Status != 0 || f.Body != ""
+}
+
+// checkFallback validates a route's fallback settings
+func checkFallback(f *FallbackConfig, v *ValidationError) {
+	if f == nil {
+		return
+	}
+	if f.Target == "" && !f.ServeStale && !f.hasStatic() {
+		v.add("fallback", "needs a target, serveStale or a static response")
+	}
+	if f.Target != "" {
+		if err := validateTargetURL(f.Target); err != nil {
+			v.add("fallback.target", "%v", err)
+		}
+	}
+	for _, s := range f.OnStatus {
+		if s < 100 || s > 599 {
+			v.add("fallback.onStatus", "%d is not an HTTP status", s)
+		}
+	}
+	if f.Status != 0 && (f.Status < 100 || f.Status > 599) {
+		v.add("fallback.status", "%d is not an HTTP status", f.Status)
+	}
+}
+
+// fallbackStatusError reports a primary response that triggers the fallback
+type fallbackStatusError struct {
+	status int
+}
+
+// Error describes the primary response
+func (e *fallbackStatusError) Error() string {
+	return fmt.Sprintf("upstream returned %d", e.status)
+}
+
+// primaryUnhealthy reports whether health checks consider the route's
+// target down
+func (p *Proxy) primaryUnhealthy(route Route) bool {
+	name, err := serviceName(route.Target)
+	if err != nil {
+		return false
+	}
+	svc, ok := p.getService(name)
+	return ok && svc.Status == "unhealthy"
+}
+
+// serveFallback answers a request from the route's fallback. It returns
+// the status served, whether it came from an upstream, and false if no
+// fallback could answer.
+func (p *Proxy) serveFallback(w http.ResponseWriter, r *http.Request, route Route, reason string) (int, bool, bool) {
+	f := route.Fallback
+	log.Printf("Using fallback for %s %s: %s", r.Method, r.URL.Path, reason)
+	requestContext(r).note("fallback", reason)
+
+	if f.Target != "" {
+		if status, ok := p.proxyFallback(w, r, route); ok {
+			p.recordFallback(route.Path)
+			return status, true, true
+		}
+	}
+
+	if f.ServeStale && r.Method == http.MethodGet {
+		if entry, ok := staleResponses.get(staleKey(route, r)); ok {
+			copyHeader(w.Header(), entry.header)
+			w.Header().Set(fallbackHeader, "stale")
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+			w.Header().Set("Age", fmt.Sprint(int(time.Since(entry.stored).Seconds())))
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			p.recordFallback(route.Path)
+			return entry.status, false, true
+		}
+	}
+
+	if f.hasStatic() {
+		status := f.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		for name, value := range f.Headers {
+			w.Header().Set(name, value)
+		}
+		if f.ContentType != "" {
+			w.Header().Set("Content-Type", f.ContentType)
+		}
+		w.Header().Set(fallbackHeader, "static")
+		w.WriteHeader(status)
+		io.WriteString(w, f.Body)
+		p.recordFallback(route.Path)
+		return status, false, true
+	}
+
+	return 0, false, false
+}
+
+// proxyFallback forwards a request to the fallback target. Request bodies
+// can only be resent if they were buffered.
+func (p *Proxy) proxyFallback(w http.ResponseWriter, r *http.Request, route Route) (int, bool) {
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if r.GetBody == nil {
+			log.Printf("Fallback target skipped for %s %s: request body was not buffered", r.Method, r.URL.Path)
+			return 0, false
+		}
+		body, err := r.GetBody()
+		if err != nil {
+			return 0, false
+		}
+		r.Body = body
+	}
+
+	target, err := url.Parse(route.Fallback.Target)
+	if err != nil {
+		return 0, false
+	}
+	requestContext(r).setTarget(route.Fallback.Target)
+	transport, err := p.transport(route)
+	if err != nil {
+		return 0, false
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+
+	failed := false
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Fallback error: %v", err)
+		failed = true
+	}
+	status := 0
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		status = resp.StatusCode
+		resp.Header.Set(fallbackHeader, "target")
+		return nil
+	}
+
+	proxy.ServeHTTP(w, r)
+	return status, !failed
+}
+
+// copyHeader adds every value in src to dst
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+}
+
+// recordFallback counts a request answered by a fallback
+func (p *Proxy) recordFallback(path string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	routeStat.Fallbacks++
+	p.stats.RouteStats[path] = routeStat
+}
+
+// staleEntry is a cached successful response
+type staleEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	hits   int // times the response was stored again; saved entries are the hottest
+}
+
+// staleCache keeps the last successful GET response per route and URL
+type staleCache struct {
+	mutex   sync.Mutex
+	entries map[string]*staleEntry
+}
+
+// staleResponses holds responses for routes that serve stale fallbacks
+var staleResponses = &staleCache{entries: make(map[string]*staleEntry)}
+
+// staleKey identifies a cached response
+func staleKey(route Route, r *http.Request) string {
+	return fmt.Sprintf("%d %s", route.ID, r.URL.RequestURI())
+}
+
+// get returns a cached response
+func (c *staleCache) get(key string) (*staleEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+// put stores a response, evicting the oldest entry when full
+func (c *staleCache) put(key string, entry *staleEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if previous, exists := c.entries[key]; exists {
+		entry.hits = previous.hits + 1
+	} else if len(c.entries) >= maxStaleEntries {
+		oldestKey := ""
+		var oldest time.Time
+		for k, e := range c.entries {
+			if oldestKey == "" || e.stored.Before(oldest) {
+				oldestKey, oldest = k, e.stored
+			}
+		}
+		delete(c.entries, oldestKey)
+	}
+	c.entries[key] = entry
+}
+
+// routeChanged drops cached responses for changed and deleted routes
+func (c *staleCache) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	prefix := fmt.Sprintf("%d ", change.Old.ID)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// capture wraps a response body so the response is cached once it has
+// been read completely
+func (c *staleCache) capture(key string, resp *http.Response) {
+	resp.Body = &staleCapture{
+		ReadCloser: resp.Body,
+		cache:      c,
+		key:        key,
+		status:     resp.StatusCode,
+		header:     resp.Header.Clone(),
+	}
+}
+
+// staleCapture copies a response body as it is read
+type staleCapture struct {
+	io.ReadCloser
+	cache    *staleCache
+	key      string
+	status   int
+	header   http.Header
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// Read copies data into the capture buffer, storing it at EOF
+func (s *staleCapture) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if !s.overflow {
+		if s.buf.Len()+n > maxStaleBody {
+			s.overflow = true
+			s.buf.Reset()
+		} else {
+			s.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !s.overflow {
+		s.cache.put(s.key, &staleEntry{status: s.status, header: s.header, body: s.buf.Bytes(), stored: time.Now()})
+		s.overflow = true
+	}
+	return n, err
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feature flag defaults
+const (
+	defaultFlagPollInterval = 10
+	defaultFlagTimeout      = 5
+
+	flagPollJob = "feature-flags"
+)
+
+// FeatureFlagsConfig connects the gateway to a feature flag provider
+// speaking the OpenFeature Remote Evaluation Protocol (OFREP), such as
+// flagd, GO Feature Flag or a vendor's OFREP endpoint. Flags are evaluated
+// in bulk against a static context and polled, so a flag change reaches
+// routes within one poll interval.
+type FeatureFlagsConfig struct {
+	URL          string            `json:"url,omitempty"`          // provider base URL; /ofrep/v1/evaluate/flags is appended
+	Headers      map[string]string `json:"headers,omitempty"`      // sent with each poll, e.g. Authorization; values may be secret references
+	Context      map[string]string `json:"context,omitempty"`      // evaluation context, e.g. targetingKey and environment
+	PollInterval int               `json:"pollInterval,omitempty"` // seconds between polls; defaults to 10
+	Timeout      int               `json:"timeout,omitempty"`      // seconds per poll; defaults to 5
+}
+
+// RouteFlags ties route behavior to feature flags. A flag that is missing
+// or not yet evaluated leaves the route as configured.
+type RouteFlags struct {
+	Enabled  string                    `json:"enabled,omitempty"`  // boolean flag; false hides the route
+	Target   string                    `json:"target,omitempty"`   // string flag choosing one of Targets
+	Targets  map[string]string         `json:"targets,omitempty"`  // target URL by flag value
+	Rewrite  string                    `json:"rewrite,omitempty"`  // string flag choosing one of Rewrites
+	Rewrites map[string]*RewriteConfig `json:"rewrites,omitempty"` // rewrite by flag value
+}
+
+// checkFeatureFlags validates the flag provider settings
+func checkFeatureFlags(c FeatureFlagsConfig, v *ValidationError) {
+	if c.URL != "" {
+		if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("featureFlags.url", "must be an http or https URL")
+		}
+	}
+	for name, ref := range c.Headers {
+		checkSettingsSecretRef("featureFlags.headers."+name, ref, v)
+	}
+	checkNonNegative("featureFlags", []namedInt{
+		{"pollInterval", c.PollInterval},
+		{"timeout", c.Timeout},
+	}, v)
+}
+
+// checkRouteFlags validates a route's flag bindings
+func checkRouteFlags(f *RouteFlags, cfg *Config, v *ValidationError) {
+	if f == nil {
+		return
+	}
+	if cfg != nil && cfg.settings().FeatureFlags.URL == "" {
+		v.add("flags", "needs a provider: set featureFlags.url")
+	}
+	if f.Enabled == "" && f.Target == "" && f.Rewrite == "" {
+		v.add("flags", "needs an enabled, target or rewrite flag")
+	}
+	if f.Target != "" && len(f.Targets) == 0 {
+		v.add("flags.targets", "is required with a target flag")
+	}
+	for value, target := range f.Targets {
+		if u, err := url.Parse(target); err != nil || u.Scheme == "" || u.Host == "" {
+			v.add("flags.targets."+value, "must be an absolute URL")
+		}
+	}
+	if f.Rewrite != "" && len(f.Rewrites) == 0 {
+		v.add("flags.rewrites", "is required with a rewrite flag")
+	}
+	for value, rewrite := range f.Rewrites {
+		var rv ValidationError
+		checkRewrite(rewrite, &rv)
+		for _, violation := range rv.Violations {
+			v.add("flags.rewrites."+value+"."+strings.TrimPrefix(violation.Field, "rewrite."), "%s", violation.Message)
+		}
+	}
+}
+
+// pollInterval returns the time between polls
+func (c FeatureFlagsConfig) pollInterval() time.Duration {
+	if c.PollInterval <= 0 {
+		return defaultFlagPollInterval * time.Second
+	}
+	return time.Duration(c.PollInterval) * time.Second
+}
+
+// timeout returns the time allowed for one poll
+func (c FeatureFlagsConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultFlagTimeout * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// FlagValue is one evaluated flag
+type FlagValue struct {
+	Value   interface{} `json:"value"`
+	Variant string      `json:"variant,omitempty"`
+	Reason  string      `json:"reason,omitempty"`
+}
+
+// FlagsStatus reports the flags last fetched from the provider
+type FlagsStatus struct {
+	Provider  string               `json:"provider,omitempty"`
+	Updated   *time.Time           `json:"updated,omitempty"` // when flag values last changed
+	LastPoll  *time.Time           `json:"lastPoll,omitempty"`
+	LastError string               `json:"lastError,omitempty"`
+	Flags     map[string]FlagValue `json:"flags"`
+}
+
+// flagStore holds the flag values last fetched from the provider. Values
+// are kept when a poll fails, so a provider outage does not flip routes.
+type flagStore struct {
+	mutex  sync.RWMutex
+	cfg    FeatureFlagsConfig
+	flags  map[string]FlagValue
+	etag   string
+	status FlagsStatus
+	client *http.Client
+}
+
+// featureFlags holds the current flag values
+var featureFlags = &flagStore{flags: make(map[string]FlagValue)}
+
+// start schedules polling of the provider, replacing the polling of an
+// earlier config
+func (s *flagStore) start(ctx context.Context, cfg FeatureFlagsConfig) {
+	if cfg.URL == "" {
+		jobs.remove(flagPollJob)
+		return
+	}
+	s.mutex.Lock()
+	s.cfg = cfg
+	s.client = &http.Client{Timeout: cfg.timeout()}
+	s.status.Provider = cfg.URL
+	s.mutex.Unlock()
+
+	jobs.start(ctx, jobSpec{
+		name:      flagPollJob,
+		interval:  every(cfg.pollInterval()),
+		immediate: true,
+		run:       func(context.Context, time.Time) error { return s.poll() },
+	})
+}
+
+// ofrepResponse is an OFREP bulk evaluation response
+type ofrepResponse struct {
+	Flags []struct {
+		Key          string      `json:"key"`
+		Value        interface{} `json:"value"`
+		Variant      string      `json:"variant"`
+		Reason       string      `json:"reason"`
+		ErrorCode    string      `json:"errorCode"`
+		ErrorDetails string      `json:"errorDetails"`
+	} `json:"flags"`
+}
+
+// poll fetches every flag in one bulk evaluation, sending the last ETag so
+// an unchanged flag set costs the provider nothing
+func (s *flagStore) poll() error {
+	s.mutex.RLock()
+	cfg, etag, client := s.cfg, s.etag, s.client
+	s.mutex.RUnlock()
+
+	flags, newETag, err := fetchFlags(client, cfg, etag)
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.LastPoll = &now
+	if err != nil {
+		if s.status.LastError != err.Error() {
+			log.Printf("Feature flag poll failed, keeping the last values: %v", err)
+		}
+		s.status.LastError = err.Error()
+		return err
+	}
+	if s.status.LastError != "" {
+		log.Printf("Feature flag provider recovered")
+	}
+	s.status.LastError = ""
+	if flags == nil {
+		return nil // not modified
+	}
+	s.etag = newETag
+	if changed := diffFlags(s.flags, flags); len(changed) > 0 {
+		log.Printf("Feature flags changed: %s", strings.Join(changed, ", "))
+		s.status.Updated = &now
+	}
+	s.flags = flags
+	return nil
+}
+
+// fetchFlags runs an OFREP bulk evaluation. It returns nil flags when the
+// provider reports them unchanged since etag.
+func fetchFlags(client *http.Client, cfg FeatureFlagsConfig, etag string) (map[string]FlagValue, string, error) {
+	body, err := json.Marshal(map[string]interface{}{"context": cfg.Context})
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.URL, "/")+"/ofrep/v1/evaluate/flags", bytes.NewReader(body))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	for name, ref := range cfg.Headers {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return nil, "", fmt.Errorf("header %s: %v", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusTooManyRequests:
+		return nil, "", fmt.Errorf("provider rate limited the gateway (Retry-After %s)", resp.Header.Get("Retry-After"))
+	default:
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("provider answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var parsed ofrepResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxUpstreamJSONSize)).Decode(&parsed); err != nil {
+		return nil, "", fmt.Errorf("invalid provider response: %v", err)
+	}
+	flags := make(map[string]FlagValue, len(parsed.Flags))
+	for _, f := range parsed.Flags {
+		if f.ErrorCode != "" {
+			continue
+		}
+		flags[f.Key] = FlagValue{Value: f.Value, Variant: f.Variant, Reason: f.Reason}
+	}
+	return flags, resp.Header.Get("ETag"), nil
+}
+
+// diffFlags lists the flags added, removed or changed between two sets
+func diffFlags(before, after map[string]FlagValue) []string {
+	var changed []string
+	for key, value := range after {
+		if old, ok := before[key]; !ok || fmt.Sprint(old.Value) != fmt.Sprint(value.Value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// lookup returns a flag's current value
+func (s *flagStore) lookup(key string) (interface{}, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	f, ok := s.flags[key]
+	return f.Value, ok
+}
+
+// stringFlag returns a flag's value as a string
+func (s *flagStore) stringFlag(key string) (string, bool) {
+	value, ok := s.lookup(key)
+	if !ok {
+		return "", false
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// routeEnabled reports whether a route's enabled flag lets it serve
+func (s *flagStore) routeEnabled(route Route) bool {
+	if route.Flags == nil || route.Flags.Enabled == "" {
+		return true
+	}
+	value, ok := s.lookup(route.Flags.Enabled)
+	enabled, isBool := value.(bool)
+	return !ok || !isBool || enabled
+}
+
+// apply points the route at the target and rewrite its flags select, and
+// records the flag values in the request context
+func (s *flagStore) apply(r *http.Request, route *Route) {
+	f := route.Flags
+	if f == nil {
+		return
+	}
+	rc := requestContext(r)
+	if f.Target != "" {
+		if value, ok := s.stringFlag(f.Target); ok {
+			if target, ok := f.Targets[value]; ok {
+				route.Target = target
+				rc.set("flagTarget", value)
+			}
+		}
+	}
+	if f.Rewrite != "" {
+		if value, ok := s.stringFlag(f.Rewrite); ok {
+			if rewrite, ok := f.Rewrites[value]; ok {
+				route.Rewrite = rewrite
+				rc.set("flagRewrite", value)
+			}
+		}
+	}
+}
+
+// snapshot returns the provider status and current flags
+func (s *flagStore) snapshot() FlagsStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	status := s.status
+	status.Flags = make(map[string]FlagValue, len(s.flags))
+	for key, value := range s.flags {
+		status.Flags[key] = value
+	}
+	return status
+}
+
+// handleFlags reports the feature flags the gateway currently sees. POST
+// polls the provider at once instead of waiting for the next interval.
+func handleFlags(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if config.settings().FeatureFlags.URL == "" {
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "No feature flag provider is configured")
+			return
+		}
+		featureFlags.poll()
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, featureFlags.snapshot())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configPathEnv names the config file when neither --config nor a
+// positional argument is given
+const configPathEnv = "GATEWAY_CONFIG"
+
+// overridableSettings are the config fields that flags and GATEWAY_*
+// environment variables may override. Precedence, highest first: flag,
+// environment variable, config file, built-in default.
+var overridableSettings = []struct {
+	field string // config path
+	env   string
+	flag  string // empty if the setting has no flag
+	ptr   func(c *Config) interface{}
+}{
+	{"port", "GATEWAY_PORT", "port", func(c *Config) interface{} { return &c.Port }},
+	{"admin.port", "GATEWAY_ADMIN_PORT", "admin-port", func(c *Config) interface{} { return &c.Admin.Port }},
+	{"logLevel", "GATEWAY_LOG_LEVEL", "log-level", func(c *Config) interface{} { return &c.LogLevel }},
+	{"logFile", "GATEWAY_LOG_FILE", "", func(c *Config) interface{} { return &c.LogFile }},
+	{"pidFile", "GATEWAY_PID_FILE", "pid-file", func(c *Config) interface{} { return &c.PIDFile }},
+	{"enableRateLimit", "GATEWAY_ENABLE_RATE_LIMIT", "", func(c *Config) interface{} { return &c.EnableRateLimit }},
+	{"admin.username", "GATEWAY_ADMIN_USERNAME", "", func(c *Config) interface{} { return &c.Admin.Username }},
+	{"admin.password", "GATEWAY_ADMIN_PASSWORD", "", func(c *Config) interface{} { return &c.Admin.Password }},
+	{"admin.prefix", "GATEWAY_ADMIN_PREFIX", "", func(c *Config) interface{} { return &c.Admin.Prefix }},
+	{"storage.driver", "GATEWAY_STORAGE_DRIVER", "", func(c *Config) interface{} { return &c.Storage.Driver }},
+	{"storage.dsn", "GATEWAY_STORAGE_DSN", "", func(c *Config) interface{} { return &c.Storage.DSN }},
+	{"reload.watch", "GATEWAY_RELOAD_WATCH", "watch-config", func(c *Config) interface{} { return &c.Reload.Watch }},
+}
+
+// fileEnvSuffix marks a variable naming a file that holds the setting,
+// such as a mounted Secret: GATEWAY_ADMIN_PASSWORD_FILE for
+// GATEWAY_ADMIN_PASSWORD
+const fileEnvSuffix = "_FILE"
+
+// configOverride replaces one config field with a flag or environment value
+type configOverride struct {
+	field  string
+	source string // flag or variable the value came from
+	value  string
+	ptr    func(c *Config) interface{}
+}
+
+// options holds the parsed command line
+type options struct {
+	configPath string
+	validate   bool
+	overrides  []configOverride
+}
+
+// parseOptions parses the command line and GATEWAY_* environment variables
+func parseOptions(args []string) (options, error) {
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: gateway [flags] [config.json]\n       gateway upgrade [--check] [--migrate] [config.json]\n\nFlags:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(out, "\nEnvironment overrides (flags take precedence, then variables, then the config file).\nEach variable may instead be set with %s naming a file to read it from:\n", fileEnvSuffix)
+		fmt.Fprintf(out, "  %-26s %s\n", configPathEnv, "config file path")
+		for _, s := range overridableSettings {
+			fmt.Fprintf(out, "  %-26s %s\n", s.env, s.field)
+		}
+	}
+
+	var opts options
+	fs.StringVar(&opts.configPath, "config", "", "path to the config file (default "+defaultConfigPath+")")
+	fs.BoolVar(&opts.validate, "validate", false, "validate the configuration and exit")
+	flagValues := make(map[string]*string)
+	for _, s := range overridableSettings {
+		if s.flag != "" {
+			flagValues[s.flag] = fs.String(s.flag, "", "override "+s.field)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return options{}, err
+	}
+
+	if fs.NArg() > 1 {
+		return options{}, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args()[1:], " "))
+	}
+	if opts.configPath == "" {
+		opts.configPath = fs.Arg(0)
+	}
+	if opts.configPath == "" {
+		opts.configPath = os.Getenv(configPathEnv)
+	}
+	if opts.configPath == "" {
+		opts.configPath = defaultConfigPath
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, s := range overridableSettings {
+		o := configOverride{field: s.field, ptr: s.ptr}
+		if s.flag != "" && set[s.flag] {
+			o.source, o.value = "--"+s.flag, *flagValues[s.flag]
+		} else if v, ok := os.LookupEnv(s.env); ok {
+			o.source, o.value = s.env, v
+		} else if path, ok := os.LookupEnv(s.env + fileEnvSuffix); ok {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return options{}, fmt.Errorf("%s: %v", s.env+fileEnvSuffix, err)
+			}
+			o.source, o.value = s.env+fileEnvSuffix, strings.TrimRight(string(data), "\r\n")
+		} else {
+			continue
+		}
+		opts.overrides = append(opts.overrides, o)
+	}
+
+	return opts, nil
+}
+
+// applyOverrides sets the overridden fields, remembering their file values
+// so saving the config does not persist them
+func (c *Config) applyOverrides(overrides []configOverride) error {
+	c.overrides = overrides
+	c.fileValues = make(map[string]json.RawMessage)
+
+	for _, o := range overrides {
+		ptr := o.ptr(c)
+		original, err := json.Marshal(ptr)
+		if err != nil {
+			return err
+		}
+		c.fileValues[o.field] = original
+
+		switch p := ptr.(type) {
+		case *int:
+			n, err := strconv.Atoi(o.value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not an integer", o.source, o.value)
+			}
+			*p = n
+		case *bool:
+			b, err := strconv.ParseBool(o.value)
+			if err != nil {
+				return fmt.Errorf("%s: %q is not a boolean", o.source, o.value)
+			}
+			*p = b
+		case *string:
+			*p = o.value
+		}
+	}
+	return nil
+}
+
+// fileJSON marshals the config with overridden fields set back to their
+// config file values
+func (c *Config) fileJSON() ([]byte, error) {
+	settings := c.settings()
+	file := configSnapshot{ConfigSettings: *settings, Routes: c.fileRoutes()}
+	data, err := json.MarshalIndent(&file, "", "  ")
+	if err != nil || len(settings.overrides) == 0 {
+		return data, err
+	}
+
+	var saved Config
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, o := range settings.overrides {
+		if err := json.Unmarshal(settings.fileValues[o.field], o.ptr(&saved)); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(&saved, "", "  ")
+}
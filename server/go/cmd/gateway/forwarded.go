@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding header modes
+const (
+	ForwardPreserve = "preserve" // pass the client's value through
+	ForwardAppend   = "append"   // add this hop to the client's value
+	ForwardReplace  = "replace"  // send only this hop
+	ForwardStrip    = "strip"    // send nothing
+)
+
+// defaultViaName identifies the gateway in Via headers
+const defaultViaName = "gateway"
+
+// ForwardedConfig controls the headers that describe the client and the
+// proxies a request passed through. Unset modes keep the default behavior:
+// X-Forwarded-For is appended to and the others are passed through. Route
+// settings override the global ones field by field.
+type ForwardedConfig struct {
+	XForwardedFor   string `json:"xForwardedFor,omitempty"`   // preserve, append (default), replace or strip
+	XForwardedProto string `json:"xForwardedProto,omitempty"` // preserve (default), append, replace or strip
+	XForwardedHost  string `json:"xForwardedHost,omitempty"`  // preserve (default), append, replace or strip
+	Forwarded       string `json:"forwarded,omitempty"`       // RFC 7239; preserve (default), append, replace or strip
+	Via             string `json:"via,omitempty"`             // requests and responses; preserve (default), append, replace or strip
+	ViaName         string `json:"viaName,omitempty"`         // defaults to gateway
+}
+
+// checkForwarded validates forwarding header modes
+func checkForwarded(field string, f *ForwardedConfig, v *ValidationError) {
+	if f == nil {
+		return
+	}
+	for _, m := range []struct{ name, mode string }{
+		{"xForwardedFor", f.XForwardedFor},
+		{"xForwardedProto", f.XForwardedProto},
+		{"xForwardedHost", f.XForwardedHost},
+		{"forwarded", f.Forwarded},
+		{"via", f.Via},
+	} {
+		switch m.mode {
+		case "", ForwardPreserve, ForwardAppend, ForwardReplace, ForwardStrip:
+		default:
+			v.add(field+"."+m.name, "unknown mode %q: use preserve, append, replace or strip", m.mode)
+		}
+	}
+	if strings.ContainsAny(f.ViaName, " ,;\t") {
+		v.add(field+".viaName", "must be a single token")
+	}
+}
+
+// forwardedFor merges a route's forwarding settings over the global ones
+// and fills in the defaults
+func forwardedFor(route Route) ForwardedConfig {
+	f := config.settings().Forwarded
+	if r := route.Forwarded; r != nil {
+		for _, m := range []struct {
+			dst *string
+			src string
+		}{
+			{&f.XForwardedFor, r.XForwardedFor},
+			{&f.XForwardedProto, r.XForwardedProto},
+			{&f.XForwardedHost, r.XForwardedHost},
+			{&f.Forwarded, r.Forwarded},
+			{&f.Via, r.Via},
+			{&f.ViaName, r.ViaName},
+		} {
+			if m.src != "" {
+				*m.dst = m.src
+			}
+		}
+	}
+	if f.XForwardedFor == "" {
+		f.XForwardedFor = ForwardAppend
+	}
+	for _, mode := range []*string{&f.XForwardedProto, &f.XForwardedHost, &f.Forwarded, &f.Via} {
+		if *mode == "" {
+			*mode = ForwardPreserve
+		}
+	}
+	if f.ViaName == "" {
+		f.ViaName = defaultViaName
+	}
+	return f
+}
+
+// isDefault reports whether the settings match the proxy's own behavior,
+// so requests need no rewriting
+func (f ForwardedConfig) isDefault() bool {
+	return f.XForwardedFor == ForwardAppend && f.XForwardedProto == ForwardPreserve &&
+		f.XForwardedHost == ForwardPreserve && f.Forwarded == ForwardPreserve && f.Via == ForwardPreserve
+}
+
+// forwardedHop applies a mode to a header, returning nil to send nothing
+func forwardedHop(mode string, prior []string, hop string) []string {
+	switch mode {
+	case ForwardPreserve:
+		if len(prior) == 0 {
+			return nil
+		}
+		return []string{strings.Join(prior, ", ")}
+	case ForwardAppend:
+		if len(prior) == 0 {
+			return []string{hop}
+		}
+		return []string{strings.Join(prior, ", ") + ", " + hop}
+	case ForwardReplace:
+		return []string{hop}
+	}
+	return nil
+}
+
+// forwardedParam formats an RFC 7239 parameter value, quoting it unless it
+// is a token
+func forwardedParam(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+	return value
+}
+
+// viaHop returns this gateway's Via entry for a message of the given
+// HTTP version
+func (f ForwardedConfig) viaHop(major, minor int) string {
+	if major >= 2 {
+		return fmt.Sprintf("%d %s", major, f.ViaName)
+	}
+	return fmt.Sprintf("%d.%d %s", major, minor, f.ViaName)
+}
+
+// outbound computes the forwarding headers for a client request. A nil
+// value means the header is not sent.
+func (f ForwardedConfig) outbound(r *http.Request) map[string][]string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	forIP := ip
+	if strings.Contains(ip, ":") {
+		forIP = "[" + ip + "]"
+	}
+	element := "for=" + forwardedParam(forIP) + ";proto=" + proto + ";host=" + forwardedParam(r.Host)
+
+	return map[string][]string{
+		"X-Forwarded-For":   forwardedHop(f.XForwardedFor, r.Header.Values("X-Forwarded-For"), ip),
+		"X-Forwarded-Proto": forwardedHop(f.XForwardedProto, r.Header.Values("X-Forwarded-Proto"), proto),
+		"X-Forwarded-Host":  forwardedHop(f.XForwardedHost, r.Header.Values("X-Forwarded-Host"), r.Host),
+		"Forwarded":         forwardedHop(f.Forwarded, r.Header.Values("Forwarded"), element),
+		"Via":               forwardedHop(f.Via, r.Header.Values("Via"), f.viaHop(r.ProtoMajor, r.ProtoMinor)),
+	}
+}
+
+// forwardedTransport sets the forwarding headers computed for the client
+// request on every attempt, after the reverse proxy has added its own
+type forwardedTransport struct {
+	base    http.RoundTripper
+	headers map[string][]string
+}
+
+// RoundTrip replaces the forwarding headers and sends the request
+func (t *forwardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if values == nil {
+			req.Header.Del(name)
+		} else {
+			req.Header[name] = values
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// responseVia applies the Via mode to an upstream response
+func (f ForwardedConfig) responseVia(resp *http.Response) {
+	if f.Via == ForwardPreserve {
+		return
+	}
+	values := forwardedHop(f.Via, resp.Header.Values("Via"), f.viaHop(resp.ProtoMajor, resp.ProtoMinor))
+	if values == nil {
+		resp.Header.Del("Via")
+	} else {
+		resp.Header["Via"] = values
+	}
+}
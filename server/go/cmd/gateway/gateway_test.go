@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// startTestGateway points the gateway's globals at a config with one route,
+// /svc, to upstream, and puts the previous ones back when the test ends.
+// configure may adjust the route and settings before the proxy is built.
+// It returns the gateway's config.
+func startTestGateway(tb testing.TB, upstream http.Handler, configure func(*Config, *Route)) *Config {
+	tb.Helper()
+
+	prevConfig, prevEvents, prevGeoIP := config, events, geoIP
+	prevBots, prevProxy, prevLimiter := botDetector.Load(), proxy, rateLimiter
+	logOutput := log.Writer()
+	log.SetOutput(ioutil.Discard)
+
+	backend := httptest.NewServer(upstream)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cfg := defaultConfig(filepath.Join(tb.TempDir(), "config.json"))
+	cfg.EnableRateLimit = false
+	route := Route{
+		Path:    "/svc",
+		Target:  backend.URL,
+		Methods: []string{"GET", "POST"},
+		Timeout: 10,
+		Active:  true,
+	}
+	if configure != nil {
+		configure(cfg, &route)
+	}
+	route.ID = 1
+	cfg.install(cfg.ConfigSettings, []Route{route}, 2)
+
+	bus, err := newEventBus(cfg.Events)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	geo, err := newGeoIP(cfg.GeoIP)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Nothing runs yet that reads the globals, so they can be swapped
+	config, events, geoIP = cfg, bus, geo
+	botDetector.Store(newBotDetector(ctx, cfg.settings().BotDetection))
+	proxy = newProxy(cfg)
+	rateLimiter = newRateLimiter(ctx, cfg)
+	routeLookups.purge()
+
+	tb.Cleanup(func() {
+		cancel()
+		bus.close()
+		backend.Close()
+		routeLookups.purge()
+		config, events, geoIP = prevConfig, prevEvents, prevGeoIP
+		botDetector.Store(prevBots)
+		proxy, rateLimiter = prevProxy, prevLimiter
+		log.SetOutput(logOutput)
+	})
+	return cfg
+}
+
+// serveProxy sends r through the proxy path and returns the response
+func serveProxy(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handleProxyRequest(w, r)
+	return w
+}
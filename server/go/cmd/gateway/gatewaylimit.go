@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scopes of the gateway rate limits, as counted in stats
+const (
+	gatewayLimitGlobal   = "global"
+	gatewayLimitListener = "listener:"
+)
+
+// GatewayLimitConfig caps the request rate of the whole gateway and of
+// each listener. The caps apply before routes are matched, whatever the
+// route limits allow, so aggregate load can't overwhelm the process. They
+// are enforced whether or not enableRateLimit is set; unset caps are off.
+type GatewayLimitConfig struct {
+	Global    RateLimit            `json:"global"`              // proxied requests on every listener; admin requests are exempt
+	Listeners map[string]RateLimit `json:"listeners,omitempty"` // by listener: proxy or admin, which also covers admin requests on a shared port
+}
+
+// checkGatewayRateLimit validates the gateway and listener rate limits
+func checkGatewayRateLimit(c GatewayLimitConfig, v *ValidationError) {
+	checkRateLimit("gatewayRateLimit.global", c.Global, v)
+	names := make([]string, 0, len(c.Listeners))
+	for name := range c.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := "gatewayRateLimit.listeners." + name
+		if name != listenerProxy && name != listenerAdmin {
+			v.add(field, "unknown listener %q: use %s or %s", name, listenerProxy, listenerAdmin)
+		}
+		checkRateLimit(field, c.Listeners[name], v)
+	}
+}
+
+// gatewayLimiter holds the buckets of the gateway and listener rate limits
+type gatewayLimiter struct {
+	buckets map[string]*gatewayBucket
+	mutex   sync.Mutex
+}
+
+// gatewayBucket is a scope's bucket and the limit it was built for, so a
+// changed limit replaces it
+type gatewayBucket struct {
+	limit  RateLimit
+	bucket *TokenBucket
+}
+
+var gatewayLimits = &gatewayLimiter{buckets: make(map[string]*gatewayBucket)}
+
+// allow takes a token from the scope's bucket. Unset limits allow all.
+func (g *gatewayLimiter) allow(scope string, limit RateLimit) bool {
+	if !limit.isSet() {
+		return true
+	}
+	g.mutex.Lock()
+	b, ok := g.buckets[scope]
+	if !ok || b.limit != limit {
+		capacity := limit.capacity()
+		b = &gatewayBucket{limit: limit, bucket: &TokenBucket{
+			tokens:         capacity,
+			capacity:       capacity,
+			refillRate:     limit.refillRate(),
+			lastRefillTime: time.Now(),
+		}}
+		g.buckets[scope] = b
+	}
+	g.mutex.Unlock()
+	return b.bucket.takeToken()
+}
+
+// gatewayRateLimitHandler refuses requests on a listener once its limit
+// or the gateway's is reached
+func gatewayRateLimitHandler(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := config.settings().GatewayRateLimit
+		scope := gatewayLimitListener + listener
+		allowed := gatewayLimits.allow(scope, limits.Listeners[listener])
+		if allowed && listener != listenerAdmin {
+			scope = gatewayLimitGlobal
+			allowed = gatewayLimits.allow(scope, limits.Global)
+		}
+		if !allowed {
+			proxy.recordThrottled(scope)
+			emitRateLimitTripped(scope, map[string]interface{}{
+				"scope":  scope,
+				"client": r.RemoteAddr,
+			})
+			writeError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "Gateway rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordThrottled counts a request refused by a gateway rate limit
+func (p *Proxy) recordThrottled(scope string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	p.stats.Throttled[scope]++
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GeoIPConfig configures GeoIP enrichment using MaxMind-format databases
+type GeoIPConfig struct {
+	CountryDatabase string `json:"countryDatabase"` // e.g. GeoLite2-Country.mmdb
+	ASNDatabase     string `json:"asnDatabase"`     // e.g. GeoLite2-ASN.mmdb
+}
+
+// GeoInfo holds the location details resolved for a client IP
+type GeoInfo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"asOrg,omitempty"`
+}
+
+// GeoIP resolves client IPs to country and ASN
+type GeoIP struct {
+	country *mmdbReader
+	asn     *mmdbReader
+}
+
+// newGeoIP opens the configured databases, or returns nil if none are configured
+func newGeoIP(cfg GeoIPConfig) (*GeoIP, error) {
+	if cfg.CountryDatabase == "" && cfg.ASNDatabase == "" {
+		return nil, nil
+	}
+
+	g := &GeoIP{}
+	var err error
+	if cfg.CountryDatabase != "" {
+		if g.country, err = openMMDB(cfg.CountryDatabase); err != nil {
+			return nil, fmt.Errorf("geoip: %s: %v", cfg.CountryDatabase, err)
+		}
+	}
+	if cfg.ASNDatabase != "" {
+		if g.asn, err = openMMDB(cfg.ASNDatabase); err != nil {
+			return nil, fmt.Errorf("geoip: %s: %v", cfg.ASNDatabase, err)
+		}
+	}
+
+	return g, nil
+}
+
+// lookup resolves the given IP. It is safe to call on a nil GeoIP.
+func (g *GeoIP) lookup(ip net.IP) GeoInfo {
+	var info GeoInfo
+	if g == nil || ip == nil {
+		return info
+	}
+
+	if g.country != nil {
+		if record, ok := g.country.lookup(ip).(map[string]interface{}); ok {
+			info.Country = isoCode(record["country"])
+			if info.Country == "" {
+				info.Country = isoCode(record["registered_country"])
+			}
+		}
+	}
+
+	if g.asn != nil {
+		if record, ok := g.asn.lookup(ip).(map[string]interface{}); ok {
+			if n, ok := record["autonomous_system_number"].(uint64); ok {
+				info.ASN = uint(n)
+			}
+			if org, ok := record["autonomous_system_organization"].(string); ok {
+				info.ASOrg = org
+			}
+		}
+	}
+
+	return info
+}
+
+// isoCode extracts iso_code from a country record
+func isoCode(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if code, ok := m["iso_code"].(string); ok {
+			return code
+		}
+	}
+	return ""
+}
+
+// isoCountries lists the assigned ISO 3166-1 alpha-2 codes
+const isoCountries = "AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ " +
+	"CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR " +
+	"GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP " +
+	"KE KG KH KI KM KN KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ " +
+	"NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW " +
+	"SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ " +
+	"UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW"
+
+// checkGeoRules validates a route's country lists. They need a country
+// database: without one every client's country is unknown, and the rules
+// would quietly let everyone through a deny list.
+func checkGeoRules(route *Route, cfg GeoIPConfig, v *ValidationError) {
+	lists := []struct {
+		field     string
+		countries []string
+	}{{"allowCountries", route.AllowCountries}, {"denyCountries", route.DenyCountries}}
+	for _, list := range lists {
+		if len(list.countries) == 0 {
+			continue
+		}
+		if cfg.CountryDatabase == "" {
+			v.add(list.field, "needs geoip.countryDatabase")
+		}
+		for i, c := range list.countries {
+			if !isCountryCode(c) {
+				v.add(fmt.Sprintf("%s[%d]", list.field, i), "%q is not an ISO 3166-1 alpha-2 country code", c)
+			}
+		}
+	}
+}
+
+// isCountryCode reports whether c is an assigned alpha-2 code, in any case
+func isCountryCode(c string) bool {
+	c = strings.ToUpper(c)
+	return len(c) == 2 && c[0] >= 'A' && c[0] <= 'Z' && c[1] >= 'A' && c[1] <= 'Z' && strings.Contains(isoCountries, c)
+}
+
+// geoAllowed checks a country against a route's allow and deny lists.
+// Requests with an unknown country are only rejected by an allow list.
+func geoAllowed(route Route, country string) bool {
+	for _, c := range route.DenyCountries {
+		if strings.EqualFold(c, country) {
+			return false
+		}
+	}
+
+	if len(route.AllowCountries) == 0 {
+		return true
+	}
+	for _, c := range route.AllowCountries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// setGeoHeaders forwards the resolved location to the upstream, replacing
+// any location headers the client sent
+func setGeoHeaders(r *http.Request, info GeoInfo) {
+	r.Header.Del("X-Client-Country")
+	r.Header.Del("X-Client-ASN")
+	if info.Country != "" {
+		r.Header.Set("X-Client-Country", info.Country)
+	}
+	if info.ASN != 0 {
+		r.Header.Set("X-Client-ASN", fmt.Sprintf("%d", info.ASN))
+	}
+}
+
+// metadataMarker precedes the metadata section of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbReader is a minimal reader for the MaxMind DB file format
+type mmdbReader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// openMMDB loads a MaxMind DB file into memory
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB file")
+	}
+	metaStart := idx + len(metadataMarker)
+
+	meta, _, err := decodeMMDB(buf[metaStart:], 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	metadata, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	r := &mmdbReader{buf: buf}
+	r.nodeCount = uint(metaUint(metadata["node_count"]))
+	r.recordSize = uint(metaUint(metadata["record_size"]))
+	r.ipVersion = uint(metaUint(metadata["ip_version"]))
+
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	dataStart := treeSize + 16
+	if dataStart > uint(idx) {
+		return nil, fmt.Errorf("corrupt search tree")
+	}
+	r.data = buf[dataStart:idx]
+
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < r.nodeCount; i++ {
+			node = r.readNode(node, 0)
+		}
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// metaUint converts a decoded unsigned metadata value
+func metaUint(v interface{}) uint64 {
+	if n, ok := v.(uint64); ok {
+		return n
+	}
+	return 0
+}
+
+// readNode returns the left (bit 0) or right (bit 1) record of a node
+func (r *mmdbReader) readNode(node uint, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		off := node * 6
+		b := r.buf[off+bit*3 : off+bit*3+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		off := node * 7
+		b := r.buf[off : off+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(r.buf[off : off+4]))
+	}
+}
+
+// lookup walks the search tree for ip and decodes the matching record
+func (r *mmdbReader) lookup(ip net.IP) interface{} {
+	node := uint(0)
+	bits := 128
+	addr := ip.To16()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = ip4
+		bits = 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+		node = r.readNode(node, bit)
+	}
+
+	if node <= r.nodeCount {
+		return nil
+	}
+
+	offset := node - r.nodeCount - 16
+	if offset >= uint(len(r.data)) {
+		return nil
+	}
+
+	value, _, err := decodeMMDB(r.data, offset)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// decodeMMDB decodes the value at offset in a data section and returns it
+// along with the offset of the next value
+func decodeMMDB(data []byte, offset uint) (interface{}, uint, error) {
+	if offset >= uint(len(data)) {
+		return nil, 0, fmt.Errorf("offset out of range")
+	}
+
+	ctrl := data[offset]
+	offset++
+	typeNum := uint(ctrl >> 5)
+
+	// Pointers carry their size in the control byte
+	if typeNum == 1 {
+		size := uint(ctrl>>3) & 0x3
+		vvv := uint(ctrl & 0x7)
+		if offset+size+1 > uint(len(data)) {
+			return nil, 0, fmt.Errorf("pointer out of range")
+		}
+		b := data[offset : offset+size+1]
+		var ptr uint
+		switch size {
+		case 0:
+			ptr = vvv<<8 | uint(b[0])
+		case 1:
+			ptr = 2048 + (vvv<<16 | uint(b[0])<<8 | uint(b[1]))
+		case 2:
+			ptr = 526336 + (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		default:
+			ptr = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := decodeMMDB(data, ptr)
+		return value, offset + size + 1, err
+	}
+
+	if typeNum == 0 {
+		if offset >= uint(len(data)) {
+			return nil, 0, fmt.Errorf("extended type out of range")
+		}
+		typeNum = 7 + uint(data[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(data)) {
+			return nil, 0, fmt.Errorf("size out of range")
+		}
+		var ext uint
+		for _, c := range data[offset : offset+n] {
+			ext = ext<<8 | uint(c)
+		}
+		switch size {
+		case 29:
+			size = 29 + ext
+		case 30:
+			size = 285 + ext
+		default:
+			size = 65821 + ext
+		}
+		offset += n
+	}
+
+	switch typeNum {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := decodeMMDB(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := decodeMMDB(data, next)
+			if err != nil {
+				return nil, 0, err
+			}
+			if k, ok := key.(string); ok {
+				m[k] = value
+			}
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := decodeMMDB(data, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(data)) {
+		return nil, 0, fmt.Errorf("value out of range")
+	}
+	b := data[offset : offset+size]
+	next := offset + size
+
+	switch typeNum {
+	case 2: // utf8 string
+		return string(b), next, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case 4: // bytes
+		return append([]byte(nil), b...), next, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, next, nil
+	case 8: // int32
+		var n uint32
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n<<(32-8*size)) >> (32 - 8*size)), next, nil
+	case 10: // uint128, kept as raw bytes
+		return append([]byte(nil), b...), next, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	}
+
+	return nil, 0, fmt.Errorf("unsupported data type %d", typeNum)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGeoRulesValidation(t *testing.T) {
+	cfg := defaultConfig(filepath.Join(t.TempDir(), "config.json"))
+	route := func(allow, deny []string) *Route {
+		return &Route{Path: "/geo", Target: "http://127.0.0.1:1", Methods: []string{"GET"}, AllowCountries: allow, DenyCountries: deny}
+	}
+
+	err := validateRoute(route(nil, []string{"RU"}), nil, cfg)
+	if err == nil || !strings.Contains(err.Error(), "geoip.countryDatabase") {
+		t.Fatalf("deny list without a country database: %v, want it rejected", err)
+	}
+
+	settings := *cfg.settings()
+	settings.GeoIP.CountryDatabase = "GeoLite2-Country.mmdb"
+	cfg.setSettings(settings)
+	if err := validateRoute(route([]string{"US", "gb"}, []string{"KP"}), nil, cfg); err != nil {
+		t.Fatalf("valid country lists: %v", err)
+	}
+	for _, code := range []string{"UK", "USA", "Z9", "", "ZZ"} {
+		if err := validateRoute(route(nil, []string{code}), nil, cfg); err == nil {
+			t.Errorf("country %q accepted", code)
+		}
+	}
+}
+
+func TestClientLocationHeadersStripped(t *testing.T) {
+	startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Client-Country") + r.Header.Get("X-Client-ASN")))
+	}), nil)
+
+	r := httptest.NewRequest("GET", "/svc/items", nil)
+	r.Header.Set("X-Client-Country", "US")
+	r.Header.Set("X-Client-ASN", "15169")
+	if w := serveProxy(r); w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Fatalf("status %d, upstream saw %q; want the client's location headers dropped", w.Code, w.Body.String())
+	}
+}
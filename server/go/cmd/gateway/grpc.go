@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The control plane is served over gRPC as the service in
+// controlplane.proto. gRPC is HTTP/2 with length-prefixed protobuf
+// messages and a status in the trailers, which the standard library can
+// serve, so the few messages the service has are encoded by hand rather
+// than with generated code.
+
+// grpcService is the full name of the gRPC control-plane service; its
+// methods are served at /<service>/<method>
+const grpcService = "gateway.admin.v1.ControlPlane"
+
+// grpcPath is the path the gRPC service is mounted at
+const grpcPath = "/" + grpcService
+
+// maxGRPCMessage caps the size of a request message
+const maxGRPCMessage = 4 << 20
+
+// gRPC status codes used by the service
+const (
+	grpcOK               = 0
+	grpcCanceled         = 1
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+)
+
+// grpcError is a failed call's status
+type grpcError struct {
+	code    int
+	message string
+}
+
+func (e *grpcError) Error() string {
+	return e.message
+}
+
+// enableGRPC lets a server accept HTTP/2 without TLS, as gRPC clients
+// connect with prior knowledge, alongside HTTP/1.1
+func enableGRPC(server *http.Server) {
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+}
+
+// handleGRPC serves the control-plane RPCs. Reads return the admin API's
+// JSON document; Watch streams the same events as the SSE watch stream.
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		writeError(w, r, http.StatusHTTPVersionNotSupported, ErrCodeBadRequest, "gRPC requires HTTP/2")
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if r.Method != http.MethodPost || (contentType != "application/grpc" && contentType != "application/grpc+proto") {
+		writeError(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, "Expected a gRPC request with the proto codec")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	err := serveGRPC(w, r)
+	code, message := grpcOK, ""
+	var status *grpcError
+	switch {
+	case err == nil:
+	case errors.As(err, &status):
+		code, message = status.code, status.message
+	case errors.Is(err, context.DeadlineExceeded):
+		code, message = grpcDeadlineExceeded, "deadline exceeded"
+	case errors.Is(err, context.Canceled):
+		code, message = grpcCanceled, "canceled"
+	default:
+		code, message = grpcInternal, err.Error()
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// serveGRPC reads the request message and runs the method
+func serveGRPC(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	if timeout, ok := grpcTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	msg, err := readGRPCMessage(r.Body)
+	if err != nil {
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	reply := func(msg []byte) error {
+		if err := writeGRPCMessage(w, msg); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	document := func(v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return reply(appendBytesField(nil, 1, data))
+	}
+
+	switch method := strings.TrimPrefix(r.URL.Path, grpcPath+"/"); method {
+	case "ListRoutes":
+		return document(config.getRoutes())
+	case "GetConfig":
+		return document(configWithoutRoutes())
+	case "GetStats":
+		return document(watchStats())
+	case "Watch":
+		topics, interval, err := parseWatchRequest(msg)
+		if err != nil {
+			return err
+		}
+		var sendErr error
+		send := func(id uint64, eventType string, data json.RawMessage) error {
+			event := appendVarintField(nil, 1, id)
+			event = appendBytesField(event, 2, []byte(eventType))
+			event = appendBytesField(event, 3, data)
+			sendErr = reply(event)
+			return sendErr
+		}
+		streamWatch(ctx, topics, interval, send, nil)
+		if sendErr != nil {
+			return sendErr
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The gateway is shutting down or the watcher fell behind
+		return &grpcError{grpcUnavailable, "watch stream closed; watch again for a fresh snapshot"}
+	default:
+		return &grpcError{grpcUnimplemented, fmt.Sprintf("unknown method %s", method)}
+	}
+}
+
+// parseWatchRequest decodes a WatchRequest: the topics watched, all by
+// default, and the seconds between stats events
+func parseWatchRequest(msg []byte) (map[string]bool, time.Duration, error) {
+	var names []string
+	seconds := uint64(defaultWatchStatsInterval)
+	err := parseProtoFields(msg, func(field int, varint uint64, data []byte) {
+		switch field {
+		case 1:
+			names = append(names, string(data))
+		case 2:
+			if varint > 0 {
+				seconds = varint
+			}
+		}
+	})
+	if err != nil {
+		return nil, 0, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if seconds > maxWatchStatsInterval {
+		return nil, 0, &grpcError{grpcInvalidArgument, fmt.Sprintf("stats interval must be at most %d seconds", maxWatchStatsInterval)}
+	}
+	topics := make(map[string]bool)
+	if len(names) == 0 {
+		names = []string{WatchRoutes, WatchConfig, WatchStats}
+	}
+	for _, topic := range names {
+		switch topic {
+		case WatchRoutes, WatchConfig, WatchStats:
+			topics[topic] = true
+		default:
+			return nil, 0, &grpcError{grpcInvalidArgument, fmt.Sprintf("unknown topic %q; use routes, config or stats", topic)}
+		}
+	}
+	return topics, time.Duration(seconds) * time.Second, nil
+}
+
+// grpcTimeout parses a grpc-timeout header, such as 30S or 500m
+func grpcTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[value[len(value)-1]]
+	return time.Duration(n) * unit, ok
+}
+
+// readGRPCMessage reads the one message of a unary or server-streaming
+// call. Compressed messages are refused, since the service advertises no
+// compression.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxGRPCMessage {
+		return nil, &grpcError{grpcInvalidArgument, "request message too large"}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, "truncated request message"}
+	}
+	return msg, nil
+}
+
+// writeGRPCMessage writes an uncompressed, length-prefixed message
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// appendVarintField appends a varint field, omitted when zero as proto3 does
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytesField appends a length-delimited field, omitted when empty
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// parseProtoFields walks a message's fields, passing varints and
+// length-delimited values to fn and skipping fixed-width ones
+func parseProtoFields(msg []byte, fn func(field int, varint uint64, data []byte)) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("malformed message")
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			msg = msg[n:]
+			fn(field, v, nil)
+		case 1, 5:
+			width := 8
+			if key&7 == 5 {
+				width = 4
+			}
+			if len(msg) < width {
+				return errors.New("truncated field")
+			}
+			msg = msg[width:]
+		case 2:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errors.New("truncated field")
+			}
+			fn(field, 0, msg[n:n+int(size)])
+			msg = msg[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+	}
+	return nil
+}
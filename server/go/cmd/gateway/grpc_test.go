@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startGRPCServer serves the control plane over h2c as the admin listener
+// does, returning a client that speaks HTTP/2 with prior knowledge
+func startGRPCServer(t *testing.T) (*httptest.Server, *http.Client) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handleGRPC))
+	enableGRPC(srv.Config)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	t.Cleanup(transport.CloseIdleConnections)
+	return srv, &http.Client{Transport: transport}
+}
+
+// callGRPC sends a framed request message to method
+func callGRPC(ctx context.Context, t *testing.T, srv *httptest.Server, client *http.Client, method string, msg []byte) *http.Response {
+	t.Helper()
+	var body bytes.Buffer
+	writeGRPCMessage(&body, msg)
+	r, err := http.NewRequestWithContext(ctx, "POST", srv.URL+grpcPath+"/"+method, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Fatalf("%s: %s %s, want 200 over HTTP/2", method, resp.Proto, resp.Status)
+	}
+	return resp
+}
+
+// protoFields decodes a reply into its varint and length-delimited fields
+func protoFields(t *testing.T, msg []byte) (map[int]uint64, map[int][]byte) {
+	t.Helper()
+	varints, data := make(map[int]uint64), make(map[int][]byte)
+	err := parseProtoFields(msg, func(field int, varint uint64, value []byte) {
+		if value != nil {
+			data[field] = value
+		} else {
+			varints[field] = varint
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return varints, data
+}
+
+func TestGRPCGetConfig(t *testing.T) {
+	cfg := startTestGateway(t, http.NotFoundHandler(), nil)
+	srv, client := startGRPCServer(t)
+
+	resp := callGRPC(context.Background(), t, srv, client, "GetConfig", nil)
+	defer resp.Body.Close()
+	msg, err := readGRPCMessage(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data := protoFields(t, msg)
+	var got configSnapshot
+	if err := json.Unmarshal(data[1], &got); err != nil {
+		t.Fatalf("Document.json %q: %v", data[1], err)
+	}
+	if got.Port != cfg.settings().Port || got.Routes != nil {
+		t.Fatalf("GetConfig = port %d with %d routes, want port %d without routes", got.Port, len(got.Routes), cfg.settings().Port)
+	}
+	if _, err := readGRPCMessage(resp.Body); err == nil {
+		t.Fatal("a unary call sent a second message")
+	}
+	if status := resp.Trailer.Get("Grpc-Status"); status != "0" {
+		t.Fatalf("Grpc-Status %q, want 0", status)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), nil)
+	srv, client := startGRPCServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request := appendBytesField(nil, 1, []byte(WatchRoutes))
+	request = appendBytesField(request, 1, []byte(WatchConfig))
+	resp := callGRPC(ctx, t, srv, client, "Watch", request)
+	defer resp.Body.Close()
+	next := func() (uint64, string, []byte) {
+		t.Helper()
+		msg, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		varints, data := protoFields(t, msg)
+		return varints[1], string(data[2]), data[3]
+	}
+
+	// The stream opens with a snapshot of each topic
+	id, eventType, data := next()
+	var routes []Route
+	if err := json.Unmarshal(data, &routes); err != nil || eventType != WatchEventRoutes || id != 0 {
+		t.Fatalf("first event %d %q %s, want the routes snapshot", id, eventType, data)
+	}
+	if len(routes) != 1 || routes[0].Path != "/svc" {
+		t.Fatalf("routes snapshot %+v, want /svc", routes)
+	}
+	if _, eventType, _ := next(); eventType != WatchEventConfig {
+		t.Fatalf("second event %q, want the config snapshot", eventType)
+	}
+
+	// Then changes as they happen
+	route := routes[0]
+	route.Path = "/moved"
+	watches.routeChanged(RouteChange{Kind: RouteUpdated, New: &route})
+	id, eventType, data = next()
+	var updated Route
+	if err := json.Unmarshal(data, &updated); err != nil || eventType != WatchEventRouteUpdated || id == 0 || updated.Path != "/moved" {
+		t.Fatalf("change event %d %q %s, want route 1 moved", id, eventType, data)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), nil)
+	srv, client := startGRPCServer(t)
+
+	// Trailers arrive once the body is read to the end
+	resp := callGRPC(context.Background(), t, srv, client, "DeleteEverything", nil)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get("Grpc-Status"); status != "12" {
+		t.Fatalf("unknown method: Grpc-Status %q, want 12 (UNIMPLEMENTED)", status)
+	}
+
+	resp = callGRPC(context.Background(), t, srv, client, "Watch", appendBytesField(nil, 1, []byte("everything")))
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get("Grpc-Status"); status != "3" {
+		t.Fatalf("unknown topic: Grpc-Status %q, want 3 (INVALID_ARGUMENT)", status)
+	}
+
+	// An interval past a day would overflow the stats ticker
+	resp = callGRPC(context.Background(), t, srv, client, "Watch", appendVarintField(nil, 2, 1<<40))
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := resp.Trailer.Get("Grpc-Status"); status != "3" {
+		t.Fatalf("huge interval: Grpc-Status %q, want 3 (INVALID_ARGUMENT)", status)
+	}
+
+	// HTTP/1.1 clients are turned away before any gRPC framing
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", grpcPath+"/GetConfig", nil)
+	r.Header.Set("Content-Type", "application/grpc")
+	handleGRPC(w, r)
+	if w.Code != http.StatusHTTPVersionNotSupported {
+		t.Fatalf("HTTP/1.1 call: status %d, want 505", w.Code)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders apply to a single connection and never reach clients
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Upgrade",
+}
+
+// framingHeaders describe the body and survive allow-lists
+var framingHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Range",
+	"Transfer-Encoding",
+	"Trailer",
+	"Date",
+}
+
+// HeaderFilterConfig controls which upstream response headers reach
+// clients. Names are case-insensitive; a trailing * matches a prefix, as in
+// X-Internal-*.
+type HeaderFilterConfig struct {
+	Deny  []string `json:"deny,omitempty"`  // headers stripped from responses
+	Allow []string `json:"allow,omitempty"` // if set, only these and the framing headers are kept
+}
+
+// checkHeaderFilter validates header patterns
+func checkHeaderFilter(field string, f *HeaderFilterConfig, v *ValidationError) {
+	if f == nil {
+		return
+	}
+	check := func(list string, patterns []string) {
+		for _, p := range patterns {
+			name := strings.TrimSuffix(p, "*")
+			if name == "" || strings.ContainsAny(name, "* \t:") {
+				v.add(field+"."+list, "invalid header pattern %q", p)
+			}
+		}
+	}
+	check("deny", f.Deny)
+	check("allow", f.Allow)
+}
+
+// headerMatches reports whether a header name matches any pattern
+func headerMatches(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterHeaders removes hop-by-hop headers, denied headers and, with an
+// allow-list, headers it does not name
+func filterHeaders(h http.Header, deny, allow []string) {
+	for name := range h {
+		switch {
+		case headerMatches(name, hopByHopHeaders):
+			delete(h, name)
+		case headerMatches(name, framingHeaders):
+		case headerMatches(name, deny):
+			delete(h, name)
+		case len(allow) > 0 && !headerMatches(name, allow):
+			delete(h, name)
+		}
+	}
+}
+
+// filterResponseHeaders applies the global and route header filters to an
+// upstream response. Denied headers add up; a route's allow-list replaces
+// the global one.
+func filterResponseHeaders(resp *http.Response, route Route) {
+	global := config.settings().ResponseHeaders
+	deny, allow := global.Deny, global.Allow
+	if f := route.ResponseHeaders; f != nil {
+		deny = append(append([]string(nil), deny...), f.Deny...)
+		if len(f.Allow) > 0 {
+			allow = f.Allow
+		}
+	}
+	filterHeaders(resp.Header, deny, allow)
+	filterHeaders(resp.Trailer, deny, allow)
+}
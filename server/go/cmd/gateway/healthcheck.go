@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Health check defaults
+const (
+	defaultHealthInterval = 60
+	defaultHealthTimeout  = 5
+	defaultHealthPath     = "/health"
+)
+
+// HealthCheckConfig configures backend health checks. Top-level settings
+// apply to every service; Services overrides them per service name.
+type HealthCheckConfig struct {
+	Interval           int    `json:"interval,omitempty"`           // seconds between checks
+	Timeout            int    `json:"timeout,omitempty"`            // probe timeout in seconds
+	Path               string `json:"path,omitempty"`               // health endpoint path
+	HealthyThreshold   int    `json:"healthyThreshold,omitempty"`   // consecutive successes before healthy
+	UnhealthyThreshold int    `json:"unhealthyThreshold,omitempty"` // consecutive failures before unhealthy
+	Jitter             int    `json:"jitter,omitempty"`             // max random delay in seconds before the first check
+	SlowStart          int    `json:"slowStart,omitempty"`          // seconds to ramp up traffic to a service that turned healthy
+	FlapThreshold      int    `json:"flapThreshold,omitempty"`      // transitions within flapWindow that mark a service flapping; 0 disables detection
+	FlapWindow         int    `json:"flapWindow,omitempty"`         // seconds; defaults to 300
+	HoldDown           int    `json:"holdDown,omitempty"`           // seconds a flapping service must pass checks before it is healthy again; defaults to 60
+
+	Services map[string]HealthCheckConfig `json:"services,omitempty"`
+}
+
+// forService returns the effective settings for a service
+func (c HealthCheckConfig) forService(name string) HealthCheckConfig {
+	cfg := c
+	cfg.Services = nil
+	if o, ok := c.Services[name]; ok {
+		if o.Interval > 0 {
+			cfg.Interval = o.Interval
+		}
+		if o.Timeout > 0 {
+			cfg.Timeout = o.Timeout
+		}
+		if o.Path != "" {
+			cfg.Path = o.Path
+		}
+		if o.HealthyThreshold > 0 {
+			cfg.HealthyThreshold = o.HealthyThreshold
+		}
+		if o.UnhealthyThreshold > 0 {
+			cfg.UnhealthyThreshold = o.UnhealthyThreshold
+		}
+		if o.Jitter > 0 {
+			cfg.Jitter = o.Jitter
+		}
+		if o.SlowStart > 0 {
+			cfg.SlowStart = o.SlowStart
+		}
+		if o.FlapThreshold > 0 {
+			cfg.FlapThreshold = o.FlapThreshold
+		}
+		if o.FlapWindow > 0 {
+			cfg.FlapWindow = o.FlapWindow
+		}
+		if o.HoldDown > 0 {
+			cfg.HoldDown = o.HoldDown
+		}
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultHealthInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultHealthTimeout
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultHealthPath
+	}
+	if cfg.HealthyThreshold <= 0 {
+		cfg.HealthyThreshold = 1
+	}
+	if cfg.UnhealthyThreshold <= 0 {
+		cfg.UnhealthyThreshold = 1
+	}
+	if cfg.FlapWindow <= 0 {
+		cfg.FlapWindow = defaultFlapWindow
+	}
+	if cfg.HoldDown <= 0 {
+		cfg.HoldDown = defaultHoldDown
+	}
+	return cfg
+}
+
+// startupDelay returns a random delay up to the configured jitter, so
+// services are not all probed at the same moment
+func (c HealthCheckConfig) startupDelay() time.Duration {
+	if c.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(c.Jitter) * int64(time.Second)))
+}
+
+// applyProbe records a probe result and returns the resulting status.
+// A service only changes between healthy and unhealthy after the configured
+// number of consecutive results; its first result applies immediately.
+func (svc *Service) applyProbe(result string, cfg HealthCheckConfig) string {
+	if result == "healthy" {
+		svc.successes++
+		svc.failures = 0
+		if svc.Status == "unknown" || svc.successes >= cfg.HealthyThreshold {
+			return result
+		}
+		return svc.Status
+	}
+
+	svc.failures++
+	svc.successes = 0
+	if svc.Status != "healthy" || svc.failures >= cfg.UnhealthyThreshold {
+		return result
+	}
+	return svc.Status
+}
+
+// startHealthChecks schedules probes of each service on its own interval.
+// With leader election, only the leader probes.
+func (p *Proxy) startHealthChecks(ctx context.Context) {
+	// Bound the number of probes in flight
+	slots := make(chan struct{}, healthCheckWorkers)
+
+	jobs.start(ctx, jobSpec{
+		name:      "health-checks",
+		interval:  every(time.Second),
+		singleton: true,
+		run: func(ctx context.Context, now time.Time) error {
+			for _, name := range p.dueServices(now) {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					return nil
+				}
+				go func(name string) {
+					defer func() { <-slots }()
+					p.checkServiceHealth(name, 0)
+				}(name)
+			}
+			return nil
+		},
+	})
+}
+
+// dueServices returns the services whose next check is due and schedules
+// their following check
+func (p *Proxy) dueServices(now time.Time) []string {
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	var due []string
+	for name, svc := range p.services {
+		if svc.checking || now.Before(svc.nextCheck) {
+			continue
+		}
+		cfg := p.config.settings().HealthCheck.forService(name)
+		svc.nextCheck = now.Add(time.Duration(cfg.Interval) * time.Second)
+		due = append(due, name)
+	}
+	return due
+}
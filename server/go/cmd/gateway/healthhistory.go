@@ -0,0 +1,149 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Flap detection defaults
+const (
+	defaultFlapWindow = 300
+	defaultHoldDown   = 60
+
+	// healthHistorySize bounds the transitions kept per service
+	healthHistorySize = 100
+)
+
+// HealthTransition is a change of a service's health status
+type HealthTransition struct {
+	At     time.Time `json:"at"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Result string    `json:"result"`         // the probe result that caused it
+	Held   bool      `json:"held,omitempty"` // recovery held down because the service is flapping
+}
+
+// ServiceHealthHistory is a service's recent health transitions, newest
+// first
+type ServiceHealthHistory struct {
+	Name          string             `json:"name"`
+	Status        string             `json:"status"`
+	Flapping      bool               `json:"flapping"`
+	HoldDownUntil *time.Time         `json:"holdDownUntil,omitempty"`
+	Transitions   []HealthTransition `json:"transitions"`
+}
+
+// recordTransition adds a transition to the service's history and marks
+// it flapping once FlapThreshold transitions fall within FlapWindow.
+// It reports whether the service started flapping.
+func (svc *Service) recordTransition(t HealthTransition, cfg HealthCheckConfig) bool {
+	svc.history = append(svc.history, t)
+	if len(svc.history) > healthHistorySize {
+		svc.history = svc.history[len(svc.history)-healthHistorySize:]
+	}
+	if t.Held || cfg.FlapThreshold <= 0 || svc.Flapping {
+		return false
+	}
+
+	since := t.At.Add(-time.Duration(cfg.FlapWindow) * time.Second)
+	count := 0
+	for _, h := range svc.history {
+		if !h.Held && h.At.After(since) {
+			count++
+		}
+	}
+	svc.Flapping = count >= cfg.FlapThreshold
+	return svc.Flapping
+}
+
+// dampen holds a flapping service unhealthy until its checks have passed
+// for the hold-down period. Failures apply at once and restart the
+// period. A service that stops changing for a flap window is no longer
+// considered flapping.
+func (svc *Service) dampen(previous, status, result string, cfg HealthCheckConfig, now time.Time) string {
+	if !svc.Flapping || cfg.FlapThreshold <= 0 {
+		svc.Flapping, svc.HoldDownUntil = false, nil
+		return status
+	}
+	if status == previous && svc.HoldDownUntil == nil && now.Sub(svc.lastTransition()) > time.Duration(cfg.FlapWindow)*time.Second {
+		svc.Flapping = false
+		return status
+	}
+	if result != "healthy" {
+		svc.HoldDownUntil = nil
+		return status
+	}
+	if status != "healthy" || previous == "healthy" {
+		return status
+	}
+
+	if svc.HoldDownUntil == nil {
+		until := now.Add(time.Duration(cfg.HoldDown) * time.Second)
+		svc.HoldDownUntil = &until
+		svc.recordTransition(HealthTransition{At: now, From: previous, To: status, Result: result, Held: true}, cfg)
+	}
+	if now.Before(*svc.HoldDownUntil) {
+		return previous
+	}
+	svc.Flapping, svc.HoldDownUntil = false, nil
+	return status
+}
+
+// lastTransition returns when the service's status last changed
+func (svc *Service) lastTransition() time.Time {
+	for i := len(svc.history) - 1; i >= 0; i-- {
+		if !svc.history[i].Held {
+			return svc.history[i].At
+		}
+	}
+	return time.Time{}
+}
+
+// healthHistory returns a service's transitions, newest first
+func (p *Proxy) healthHistory(name string) (ServiceHealthHistory, bool) {
+	p.servicesMutex.RLock()
+	defer p.servicesMutex.RUnlock()
+
+	svc, ok := p.services[name]
+	if !ok {
+		return ServiceHealthHistory{}, false
+	}
+	h := ServiceHealthHistory{
+		Name:          svc.Name,
+		Status:        svc.Status,
+		Flapping:      svc.Flapping,
+		HoldDownUntil: svc.HoldDownUntil,
+		Transitions:   make([]HealthTransition, 0, len(svc.history)),
+	}
+	for i := len(svc.history) - 1; i >= 0; i-- {
+		h.Transitions = append(h.Transitions, svc.history[i])
+	}
+	return h, true
+}
+
+// logFlapping reports a service that started flapping
+func logFlapping(svc Service, cfg HealthCheckConfig) {
+	log.Printf("Service %s is flapping: %d health transitions within %ds; holding down recovery for %ds",
+		svc.Name, cfg.FlapThreshold, cfg.FlapWindow, cfg.HoldDown)
+	events.emit(EventServiceFlapping, svc)
+}
+
+// handleServiceHistory returns a service's health transitions
+func handleServiceHistory(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+		return
+	}
+	h, found := proxy.healthHistory(name)
+	if !found {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+		return
+	}
+	writeJSON(w, h)
+}
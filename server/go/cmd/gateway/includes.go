@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+)
+
+// RouteFile is a file of routes the config includes, so each team can own
+// its routes and review changes to them on their own
+type RouteFile struct {
+	Routes []Route `json:"routes"`
+}
+
+// loadIncludes appends the routes of the files matched by the include
+// patterns, relative to the config file's directory, marking each with
+// the file it came from. A file matched by several patterns is read once.
+func (c *Config) loadIncludes() error {
+	dir := filepath.Dir(c.configFilePath)
+	read := make(map[string]bool)
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("include %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			log.Printf("Warning: include %q matches no files", pattern)
+		}
+		for _, path := range matches {
+			if read[path] {
+				continue
+			}
+			read[path] = true
+			routes, err := readRouteFile(path)
+			if err != nil {
+				return err
+			}
+			source := path
+			if rel, err := filepath.Rel(dir, path); err == nil {
+				source = rel
+			}
+			for i := range routes {
+				routes[i].source = source
+			}
+			c.Routes = append(c.Routes, routes...)
+		}
+	}
+	return nil
+}
+
+// readRouteFile strictly decodes an included route file, decrypting it
+// if needed
+func readRouteFile(path string) ([]Route, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fileCrypto.open(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var file RouteFile
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return file.Routes, nil
+}
+
+// fileRoutes returns the routes kept in the config file itself
+func (c *Config) fileRoutes() []Route {
+	routes := []Route{}
+	for _, route := range c.getRoutes() {
+		if route.source == "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// routeField names a route in validation errors by its position in the
+// file that defines it: routes[i] in the config file, or the included
+// file and its index there
+func routeField(routes []Route, i int) string {
+	source, n := routes[i].source, 0
+	for _, route := range routes[:i] {
+		if route.source == source {
+			n++
+		}
+	}
+	if source == "" {
+		return fmt.Sprintf("routes[%d]", n)
+	}
+	return fmt.Sprintf("%s:routes[%d]", source, n)
+}
+
+// checkIncludes reports routes of different files that conflict. Conflicts
+// within one file are only warned about, as they always have been.
+func checkIncludes(c *Config, v *ValidationError) {
+	if len(c.Include) > 0 && c.Storage.driver() != StorageFile {
+		v.add("include", "needs the file storage driver; a database keeps its own routes")
+	}
+	for i := range c.Routes {
+		var others []Route
+		for _, other := range c.Routes[:i] {
+			if other.source != c.Routes[i].source {
+				others = append(others, other)
+			}
+		}
+		var conflicts ValidationError
+		checkConflicts(&c.Routes[i], others, &conflicts)
+		for _, violation := range conflicts.Violations {
+			v.add(routeField(c.Routes, i)+"."+violation.Field, "%s", violation.Message)
+		}
+	}
+}
+
+// includedRouteMessage explains that a route can't be changed through the
+// admin API because an included file defines it
+func includedRouteMessage(route Route) string {
+	return fmt.Sprintf("route %d is defined in %s; change it there", route.ID, route.source)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobShutdownTimeout bounds how long shutdown waits for running jobs
+const jobShutdownTimeout = 10 * time.Second
+
+// jobSpec describes a background task the scheduler runs periodically
+type jobSpec struct {
+	name      string
+	interval  func() time.Duration // reread before each wait, so reloads apply
+	run       func(ctx context.Context, now time.Time) error
+	singleton bool // with leader election, only the leader runs it
+	immediate bool // run at start rather than after the first interval
+}
+
+// JobStatus reports a background job's runs
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval"`
+	Singleton    bool       `json:"singleton,omitempty"`
+	Running      bool       `json:"running"`
+	Runs         int64      `json:"runs"`
+	Errors       int64      `json:"errors"`
+	Skipped      int64      `json:"skipped,omitempty"` // runs left to the leader replica
+	LastRun      *time.Time `json:"lastRun,omitempty"`
+	LastDuration string     `json:"lastDuration,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	LastErrorAt  *time.Time `json:"lastErrorAt,omitempty"`
+	NextRun      *time.Time `json:"nextRun,omitempty"`
+}
+
+// scheduledJob is a job, its status and the goroutine running it
+type scheduledJob struct {
+	spec   jobSpec
+	status JobStatus
+	worker worker
+}
+
+// scheduler runs the gateway's periodic background jobs, each on its own
+// goroutine, by name
+type scheduler struct {
+	mutex sync.Mutex
+	jobs  map[string]*scheduledJob
+}
+
+// jobs runs the background jobs
+var jobs = &scheduler{jobs: make(map[string]*scheduledJob)}
+
+// start schedules a job until ctx is done or the job is removed. A job
+// started again under the same name, as after a reload, replaces the old
+// one once its run in progress has finished.
+func (s *scheduler) start(ctx context.Context, spec jobSpec) {
+	s.remove(spec.name)
+	job := &scheduledJob{spec: spec, status: JobStatus{Name: spec.name, Singleton: spec.singleton}}
+	s.mutex.Lock()
+	s.jobs[spec.name] = job
+	s.mutex.Unlock()
+
+	job.worker.start(ctx, func(ctx context.Context) {
+		if spec.immediate {
+			s.runOnce(ctx, job)
+		}
+		for {
+			interval := spec.interval()
+			next := time.Now().Add(interval)
+			s.mutex.Lock()
+			job.status.Interval = interval.String()
+			job.status.NextRun = &next
+			s.mutex.Unlock()
+
+			timer := time.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			s.runOnce(ctx, job)
+		}
+	})
+}
+
+// remove stops a job, waiting for a run in progress to finish
+func (s *scheduler) remove(name string) {
+	s.mutex.Lock()
+	job := s.jobs[name]
+	delete(s.jobs, name)
+	s.mutex.Unlock()
+	if job != nil {
+		job.worker.stop()
+	}
+}
+
+// runOnce runs a job and records the outcome. A panicking job counts as
+// failed rather than taking the gateway down.
+func (s *scheduler) runOnce(ctx context.Context, job *scheduledJob) {
+	if job.spec.singleton && !leadership.Load().isLeader() {
+		s.mutex.Lock()
+		job.status.Skipped++
+		s.mutex.Unlock()
+		return
+	}
+
+	start := time.Now()
+	s.mutex.Lock()
+	job.status.Running = true
+	s.mutex.Unlock()
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				err = fmt.Errorf("panic: %v", v)
+			}
+		}()
+		return job.spec.run(ctx, start)
+	}()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job.status.Running = false
+	job.status.Runs++
+	job.status.LastRun = &start
+	job.status.LastDuration = time.Since(start).String()
+	if err != nil {
+		job.status.Errors++
+		job.status.LastError = err.Error()
+		job.status.LastErrorAt = &start
+		log.Printf("Job %s failed: %v", job.spec.name, err)
+	}
+}
+
+// shutdown stops every job and waits for running ones to finish. Their
+// status stays available.
+func (s *scheduler) shutdown(timeout time.Duration) {
+	s.mutex.Lock()
+	running := make([]*scheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		running = append(running, job)
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, job := range running {
+			job.worker.stop()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		for _, status := range s.statuses() {
+			if status.Running {
+				log.Printf("Job %s still running at shutdown", status.Name)
+			}
+		}
+	}
+}
+
+// statuses returns the jobs' status sorted by name
+func (s *scheduler) statuses() []JobStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		statuses = append(statuses, job.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// every returns a fixed interval
+func every(d time.Duration) func() time.Duration {
+	return func() time.Duration { return d }
+}
+
+// handleJobs reports the background jobs
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, jobs.statuses())
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT verification defaults
+const (
+	defaultJWKSRefresh = 300 * time.Second
+	jwksMinRefetch     = 10 * time.Second // between fetches for an unknown key ID
+	jwksMaxBackoff     = 5 * time.Minute  // between fetches after failures
+	jwksFetchTimeout   = 10 * time.Second
+	maxJWKSSize        = 1 << 20
+)
+
+// JWTConfig configures how bearer tokens are verified before their claims
+// are trusted, for route authorization and tenant claims. Tokens must be
+// signed by a configured key and carry an exp claim.
+type JWTConfig struct {
+	Secret      string   `json:"secret,omitempty"`      // HMAC key for HS256, HS384 and HS512; may be a secret reference
+	JWKSURL     string   `json:"jwksUrl,omitempty"`     // JSON Web Key Set with the RSA and EC keys for RS*, PS* and ES* tokens
+	JWKSRefresh int      `json:"jwksRefresh,omitempty"` // seconds between key set fetches; defaults to 300
+	Issuer      string   `json:"issuer,omitempty"`      // required iss claim, when set
+	Audience    []string `json:"audience,omitempty"`    // the aud claim must name one of these, when set
+	Leeway      int      `json:"leeway,omitempty"`      // seconds of clock skew allowed on exp and nbf
+}
+
+// configured reports whether tokens can be verified
+func (c JWTConfig) configured() bool {
+	return c.Secret != "" || c.JWKSURL != ""
+}
+
+// checkJWT validates the token verification settings
+func checkJWT(c JWTConfig, v *ValidationError) {
+	if c.Secret != "" {
+		checkSettingsSecretRef("jwt.secret", c.Secret, v)
+	}
+	if c.JWKSURL != "" && !strings.HasPrefix(c.JWKSURL, "https://") && !strings.HasPrefix(c.JWKSURL, "http://") {
+		v.add("jwt.jwksUrl", "must be an http or https URL")
+	}
+	checkNonNegative("jwt", []namedInt{
+		{"jwksRefresh", c.JWKSRefresh},
+		{"leeway", c.Leeway},
+	}, v)
+}
+
+// jwtHashes maps signing algorithms to their digests
+var jwtHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verifyJWT checks a token's signature against the configured keys and its
+// exp, nbf, iss and aud claims, and returns the claims of a valid token
+func verifyJWT(token string) (map[string]interface{}, error) {
+	return verifyToken(token, true)
+}
+
+// verifyKnownJWT is verifyJWT for requests not yet authenticated: a token
+// naming a key ID not seen yet is rejected rather than sending for the key
+// set, so clients can't make the gateway refetch it
+func verifyKnownJWT(token string) (map[string]interface{}, error) {
+	return verifyToken(token, false)
+}
+
+// verifyToken verifies a token, fetching the key set for an unknown key ID
+// when refetch is set
+func verifyToken(token string, refetch bool) (map[string]interface{}, error) {
+	cfg := config.settings().JWT
+	if !cfg.configured() {
+		return nil, errors.New("token verification is not configured")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	hash, ok := jwtHashes[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch header.Alg[:2] {
+	case "HS":
+		if cfg.Secret == "" {
+			return nil, errors.New("no HMAC key is configured")
+		}
+		secret, err := resolveSecret(cfg.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("jwt.secret: %v", err)
+		}
+		mac := hmac.New(hash.New, []byte(secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		if cfg.JWKSURL == "" {
+			return nil, errors.New("no key set is configured")
+		}
+		key, err := jwtKeys.key(cfg, header.Kid, refetch)
+		if err != nil {
+			return nil, err
+		}
+		digest := hash.New()
+		digest.Write(signed)
+		if err := verifySignature(header.Alg, key, hash, digest.Sum(nil), signature); err != nil {
+			return nil, err
+		}
+	}
+
+	claims, err := parseJWTClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRegisteredClaims(claims, cfg, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature checks an RSA or ECDSA signature with a key set key
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, sum, signature []byte) error {
+	invalid := errors.New("invalid token signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, sum, signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, sum, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("key does not fit algorithm %s", alg)
+		}
+		if err != nil {
+			return invalid
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, sum, r, s) {
+			return invalid
+		}
+	default:
+		return fmt.Errorf("key does not fit algorithm %s", alg)
+	}
+	return nil
+}
+
+// checkRegisteredClaims enforces exp, nbf, iss and aud
+func checkRegisteredClaims(claims map[string]interface{}, cfg JWTConfig, now time.Time) error {
+	leeway := time.Duration(cfg.Leeway) * time.Second
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	if cfg.Issuer != "" && claimString(claims, "iss") != cfg.Issuer {
+		return errors.New("token has the wrong issuer")
+	}
+	if len(cfg.Audience) > 0 {
+		for _, aud := range claimValues(claims["aud"]) {
+			for _, allowed := range cfg.Audience {
+				if aud == allowed {
+					return nil
+				}
+			}
+		}
+		return errors.New("token is not meant for this audience")
+	}
+	return nil
+}
+
+// jwksCache holds the keys of the configured key set, fetched when stale
+// or when a token names a key ID not seen yet. Fetches run outside the
+// lock, one at a time, so a slow key set endpoint never holds up tokens
+// signed with known keys.
+type jwksCache struct {
+	mutex    sync.Mutex
+	url      string
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time     // last successful fetch
+	failures int           // fetches failed since then
+	retryAt  time.Time     // no fetch before this after a failure
+	fetching chan struct{} // closed when the fetch in flight ends
+}
+
+// jwtKeys caches the configured key set
+var jwtKeys = &jwksCache{}
+
+// key returns the key set key for a key ID. Without a key ID, a key set
+// with a single key is used. A stale key set is refreshed in the
+// background. A key ID not seen yet waits for a fetch, at most one every
+// jwksMinRefetch, if refetch is set, and fails otherwise.
+func (c *jwksCache) key(cfg JWTConfig, kid string, refetch bool) (crypto.PublicKey, error) {
+	refresh := time.Duration(cfg.JWKSRefresh) * time.Second
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+
+	c.mutex.Lock()
+	if c.url != cfg.JWKSURL {
+		c.url, c.keys, c.fetched, c.failures, c.retryAt = cfg.JWKSURL, nil, time.Time{}, 0, time.Time{}
+	}
+	now := time.Now()
+	canFetch := !now.Before(c.retryAt)
+	if key, ok := c.lookup(kid); ok {
+		if canFetch && now.Sub(c.fetched) > refresh {
+			c.startFetch()
+		}
+		c.mutex.Unlock()
+		return key, nil
+	}
+	if !canFetch || (!c.fetched.IsZero() && now.Sub(c.fetched) <= jwksMinRefetch) {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if !refetch {
+		// Load a key set never fetched, without waiting for it
+		if c.fetched.IsZero() {
+			c.startFetch()
+		}
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	done := c.startFetch()
+	c.mutex.Unlock()
+
+	<-done
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup returns a cached key. The caller holds the lock.
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// startFetch fetches the key set unless a fetch is in flight, and returns
+// a channel closed once the fetch ends. Failed fetches keep the previous
+// keys and back off, doubling from jwksMinRefetch up to jwksMaxBackoff.
+// The caller holds the lock.
+func (c *jwksCache) startFetch() <-chan struct{} {
+	if c.fetching != nil {
+		return c.fetching
+	}
+	done := make(chan struct{})
+	c.fetching = done
+	url := c.url
+	go func() {
+		keys, err := fetchJWKS(url)
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		defer close(done)
+		c.fetching = nil
+		if url != c.url {
+			return
+		}
+		if err != nil {
+			log.Printf("JWKS %s: %v", url, err)
+			backoff := jwksMaxBackoff
+			if c.failures < 5 {
+				backoff = min(jwksMinRefetch<<c.failures, jwksMaxBackoff)
+			}
+			c.failures++
+			c.retryAt = time.Now().Add(backoff)
+			return
+		}
+		c.keys, c.fetched, c.failures, c.retryAt = keys, time.Now(), 0, time.Time{}
+	}()
+	return done
+}
+
+// jsonWebKey is a public key of a JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS downloads a key set, keeping the RSA and EC signing keys
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: jwksFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("parse key set: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("JWKS %s: key %q skipped: %v", url, jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA or EC key
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, errors.New("invalid point")
+		}
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
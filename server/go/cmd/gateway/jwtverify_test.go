@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWKS serves a key set with one RSA key, kid k1, counting fetches
+type testJWKS struct {
+	key     *rsa.PrivateKey
+	fetches int64
+	status  int64         // answered instead of the key set when set
+	block   chan struct{} // held open by fetches while set
+	server  *httptest.Server
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &testJWKS{key: key}
+	j.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&j.fetches, 1)
+		if j.block != nil {
+			<-j.block
+		}
+		if status := atomic.LoadInt64(&j.status); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1", "use": "sig",
+			"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	t.Cleanup(j.server.Close)
+	return j
+}
+
+// token signs an RS256 token naming kid
+func (j *testJWKS) token(t *testing.T, kid string, claims map[string]interface{}) string {
+	signed := testJWTPayload(map[string]interface{}{"alg": "RS256", "kid": kid}, claims)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, j.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJWTPayload encodes the signed part of a token
+func testJWTPayload(header, claims map[string]interface{}) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+}
+
+// testHS256Token signs an HS256 token with secret
+func testHS256Token(secret string, claims map[string]interface{}) string {
+	signed := testJWTPayload(map[string]interface{}{"alg": "HS256"}, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// useJWT starts a gateway verifying tokens with cfg and an empty key cache
+func useJWT(t *testing.T, cfg JWTConfig) {
+	startTestGateway(t, http.NotFoundHandler(), func(c *Config, _ *Route) { c.JWT = cfg })
+	prevKeys := jwtKeys
+	jwtKeys = &jwksCache{}
+	t.Cleanup(func() { jwtKeys = prevKeys })
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func TestVerifyJWTClaims(t *testing.T) {
+	useJWT(t, JWTConfig{Secret: "s3cret", Issuer: "https://issuer", Audience: []string{"gateway"}})
+
+	claims := validClaims()
+	claims["iss"], claims["aud"] = "https://issuer", []string{"other", "gateway"}
+	if _, err := verifyJWT(testHS256Token("s3cret", claims)); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"expired":       func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no exp":        func(c map[string]interface{}) { delete(c, "exp") },
+		"not yet valid": func(c map[string]interface{}) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+		"wrong issuer":  func(c map[string]interface{}) { c["iss"] = "https://other" },
+		"wrong aud":     func(c map[string]interface{}) { c["aud"] = "other" },
+	} {
+		bad := validClaims()
+		bad["iss"], bad["aud"] = "https://issuer", "gateway"
+		change(bad)
+		if _, err := verifyJWT(testHS256Token("s3cret", bad)); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	if _, err := verifyJWT(testHS256Token("wrong", claims)); err == nil {
+		t.Error("token signed with another key accepted")
+	}
+}
+
+func TestJWKSUnknownKeyIDOnlyRefetchedAfterAuthentication(t *testing.T) {
+	jwks := newTestJWKS(t)
+	useJWT(t, JWTConfig{JWKSURL: jwks.server.URL})
+
+	if _, err := verifyJWT(jwks.token(t, "k1", validClaims())); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if n := atomic.LoadInt64(&jwks.fetches); n != 1 {
+		t.Fatalf("%d fetches, want 1", n)
+	}
+
+	// Past jwksMinRefetch, unknown key IDs may send for the key set again
+	jwtKeys.mutex.Lock()
+	jwtKeys.fetched = time.Now().Add(-time.Minute)
+	jwtKeys.mutex.Unlock()
+
+	if _, err := verifyKnownJWT(jwks.token(t, "made-up", validClaims())); err == nil {
+		t.Fatal("token with an unknown key ID accepted")
+	}
+	if n := atomic.LoadInt64(&jwks.fetches); n != 1 {
+		t.Fatalf("an unauthenticated unknown key ID caused a fetch: %d fetches", n)
+	}
+
+	verifyJWT(jwks.token(t, "made-up", validClaims()))
+	if n := atomic.LoadInt64(&jwks.fetches); n != 2 {
+		t.Fatalf("%d fetches, want 2", n)
+	}
+}
+
+func TestJWKSSlowFetchDoesNotBlockKnownKeys(t *testing.T) {
+	jwks := newTestJWKS(t)
+	useJWT(t, JWTConfig{JWKSURL: jwks.server.URL})
+	token := jwks.token(t, "k1", validClaims())
+	if _, err := verifyJWT(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the key set stale and its endpoint hang
+	jwks.block = make(chan struct{})
+	defer close(jwks.block)
+	jwtKeys.mutex.Lock()
+	jwtKeys.fetched = time.Now().Add(-time.Hour)
+	jwtKeys.mutex.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := verifyJWT(token)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("verification waited for the key set refresh")
+	}
+}
+
+func TestJWKSBacksOffAfterFailures(t *testing.T) {
+	jwks := newTestJWKS(t)
+	atomic.StoreInt64(&jwks.status, http.StatusInternalServerError)
+	useJWT(t, JWTConfig{JWKSURL: jwks.server.URL})
+
+	for i := 0; i < 3; i++ {
+		if _, err := verifyJWT(jwks.token(t, fmt.Sprintf("k%d", i), validClaims())); err == nil {
+			t.Fatal("token accepted without a key set")
+		}
+	}
+	if n := atomic.LoadInt64(&jwks.fetches); n != 1 {
+		t.Fatalf("%d fetches of a failing key set, want 1 before the backoff ends", n)
+	}
+}
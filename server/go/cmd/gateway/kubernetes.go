@@ -0,0 +1,678 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kubernetes resources the controller turns into routes
+const (
+	KubernetesIngress   = "ingress"
+	KubernetesHTTPRoute = "httproute"
+
+	defaultClusterDomain   = "cluster.local"
+	serviceAccountDir      = "/var/run/secrets/kubernetes.io/serviceaccount"
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+
+	// kubernetesSource prefixes the source of routes the controller keeps
+	kubernetesSource = "kubernetes "
+
+	// Watches are renewed this often, and the controller relists with
+	// backoff up to maxKubernetesBackoff after errors
+	kubernetesWatchTimeout = 5 * time.Minute
+	maxKubernetesBackoff   = 30 * time.Second
+)
+
+// errWatchExpired ends a watch whose resource version the API server no
+// longer has; the controller lists again
+var errWatchExpired = errors.New("kubernetes: watch expired")
+
+// KubernetesConfig runs the gateway as a Kubernetes ingress controller. It
+// watches Ingress or Gateway API HTTPRoute objects and keeps a route for
+// each of their paths, so platform teams manage routing with standard
+// objects instead of the admin API.
+type KubernetesConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Resource      string `json:"resource,omitempty"`      // ingress (default) or httproute
+	Namespace     string `json:"namespace,omitempty"`     // watches every namespace when empty
+	IngressClass  string `json:"ingressClass,omitempty"`  // only Ingresses of this class
+	Gateway       string `json:"gateway,omitempty"`       // only HTTPRoutes attached to this Gateway, as [namespace/]name
+	Template      string `json:"template,omitempty"`      // route template for the routes, for timeouts, auth and so on
+	APIServer     string `json:"apiServer,omitempty"`     // defaults to the in-cluster address
+	ClusterDomain string `json:"clusterDomain,omitempty"` // of service addresses; defaults to cluster.local
+}
+
+// resource returns the kind of object watched
+func (c KubernetesConfig) resource() string {
+	if c.Resource == "" {
+		return KubernetesIngress
+	}
+	return strings.ToLower(c.Resource)
+}
+
+// checkKubernetes validates the controller settings
+func checkKubernetes(c *Config, v *ValidationError) {
+	k := c.Kubernetes
+	if !k.Enabled {
+		return
+	}
+	switch k.resource() {
+	case KubernetesIngress:
+		if k.Gateway != "" {
+			v.add("kubernetes.gateway", "applies only to httproute resources")
+		}
+	case KubernetesHTTPRoute:
+		if k.IngressClass != "" {
+			v.add("kubernetes.ingressClass", "applies only to ingress resources")
+		}
+	default:
+		v.add("kubernetes.resource", "unknown resource %q: use ingress or httproute", k.Resource)
+	}
+	if k.APIServer != "" {
+		if u, err := url.Parse(k.APIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("kubernetes.apiServer", "must be an http or https URL")
+		}
+	}
+	if k.Template != "" {
+		if _, ok := c.RouteTemplates[k.Template]; !ok {
+			v.add("kubernetes.template", "unknown route template %q", k.Template)
+		}
+	}
+	if c.Storage.driver() != StorageFile {
+		v.add("kubernetes", "needs the file storage driver; a database keeps its own routes")
+	}
+}
+
+// KubernetesStatus reports what the controller has translated
+type KubernetesStatus struct {
+	Enabled   bool                  `json:"enabled"`
+	Resource  string                `json:"resource,omitempty"`
+	Connected bool                  `json:"connected"` // whether the watch is running
+	Objects   int                   `json:"objects"`   // objects selected by class or gateway
+	Routes    int                   `json:"routes"`    // routes kept for them
+	Rejected  []KubernetesRejection `json:"rejected,omitempty"`
+	LastSync  *time.Time            `json:"lastSync,omitempty"`
+	LastError string                `json:"lastError,omitempty"`
+}
+
+// KubernetesRejection is a path the controller could not turn into a route
+type KubernetesRejection struct {
+	Object string `json:"object"` // kind namespace/name
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// kubeMeta is the object metadata the controller reads
+type kubeMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// kubeObject is an Ingress or HTTPRoute, its spec decoded on translation
+type kubeObject struct {
+	Kind     string          `json:"kind"`
+	Metadata kubeMeta        `json:"metadata"`
+	Spec     json.RawMessage `json:"spec"`
+}
+
+// name identifies an object in route sources and rejections
+func (o kubeObject) name() string {
+	return o.Kind + " " + o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// kubeList is a list response
+type kubeList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubeObject `json:"items"`
+}
+
+// kubeEvent is one event of a watch stream
+type kubeEvent struct {
+	Type   string          `json:"type"` // ADDED, MODIFIED, DELETED, BOOKMARK or ERROR
+	Object json.RawMessage `json:"object"`
+}
+
+// ingressSpec is the part of an Ingress spec the controller translates
+type ingressSpec struct {
+	IngressClassName string          `json:"ingressClassName"`
+	DefaultBackend   *ingressBackend `json:"defaultBackend"`
+	Rules            []struct {
+		Host string `json:"host"`
+		HTTP *struct {
+			Paths []struct {
+				Path     string         `json:"path"`
+				PathType string         `json:"pathType"`
+				Backend  ingressBackend `json:"backend"`
+			} `json:"paths"`
+		} `json:"http"`
+	} `json:"rules"`
+}
+
+// ingressBackend is the service an Ingress path sends requests to
+type ingressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Number int    `json:"number"`
+			Name   string `json:"name"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+// httpRouteSpec is the part of an HTTPRoute spec the controller translates
+type httpRouteSpec struct {
+	ParentRefs []struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"parentRefs"`
+	Rules []struct {
+		Matches     []httpRouteMatch `json:"matches"`
+		BackendRefs []struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			Port      int    `json:"port"`
+			Weight    *int   `json:"weight"`
+		} `json:"backendRefs"`
+	} `json:"rules"`
+}
+
+// httpRouteMatch selects the requests of an HTTPRoute rule
+type httpRouteMatch struct {
+	Path *struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"path"`
+	Method      string            `json:"method"`
+	Headers     []json.RawMessage `json:"headers"`
+	QueryParams []json.RawMessage `json:"queryParams"`
+}
+
+// kubeController keeps a route for each path of the watched objects
+type kubeController struct {
+	cfg     KubernetesConfig
+	client  *http.Client
+	server  string
+	token   string // token file, reread on each request as tokens rotate
+	objects map[string]kubeObject
+	worker  worker // the list and watch loop
+
+	mutex  sync.Mutex
+	status KubernetesStatus
+}
+
+// kube is the Kubernetes controller; nil when disabled
+var kube atomic.Pointer[kubeController]
+
+// newKubeController starts watching the cluster until ctx is done, or
+// returns nil when the controller is disabled
+func newKubeController(ctx context.Context, cfg KubernetesConfig) (*kubeController, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	k := &kubeController{
+		cfg:    cfg,
+		server: strings.TrimRight(cfg.APIServer, "/"),
+		status: KubernetesStatus{Enabled: true, Resource: cfg.resource()},
+	}
+	if k.server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("kubernetes: not running in a cluster; set kubernetes.apiServer")
+		}
+		if port == "" {
+			port = "443"
+		}
+		k.server = "https://" + net.JoinHostPort(host, port)
+	}
+	if _, err := os.Stat(filepath.Join(serviceAccountDir, "token")); err == nil {
+		k.token = filepath.Join(serviceAccountDir, "token")
+	}
+
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt")); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	k.client = &http.Client{Transport: transport}
+
+	k.worker.start(ctx, k.run)
+	return k, nil
+}
+
+// stop ends the watch and waits for it to exit. The routes stay until a
+// new controller reconciles them, or dropKubernetesRoutes removes them.
+func (k *kubeController) stop() {
+	if k != nil {
+		k.worker.stop()
+	}
+}
+
+// run lists and watches the objects until ctx is done, backing off after
+// errors
+func (k *kubeController) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := k.sync(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		k.setConnected(false, err.Error())
+		log.Printf("Kubernetes watch failed: %v", err)
+
+		if time.Since(started) > maxKubernetesBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxKubernetesBackoff {
+			backoff = maxKubernetesBackoff
+		}
+	}
+}
+
+// sync lists the objects, reconciles the routes with them and keeps them
+// in step with a watch, listing again when the watch expires
+func (k *kubeController) sync(ctx context.Context) error {
+	for {
+		var list kubeList
+		if err := k.get(ctx, k.resourcePath(), &list); err != nil {
+			return err
+		}
+		k.objects = make(map[string]kubeObject)
+		for _, obj := range list.Items {
+			obj.Kind = k.kind()
+			k.objects[obj.Metadata.Namespace+"/"+obj.Metadata.Name] = obj
+		}
+		k.reconcile()
+		k.setConnected(true, "")
+
+		version := list.Metadata.ResourceVersion
+		var err error
+		for err == nil {
+			version, err = k.watch(ctx, version)
+		}
+		if err != errWatchExpired {
+			return err
+		}
+	}
+}
+
+// watch applies the events of one watch request, returning the resource
+// version to resume from
+func (k *kubeController) watch(ctx context.Context, version string) (string, error) {
+	query := url.Values{
+		"watch":               {"1"},
+		"allowWatchBookmarks": {"true"},
+		"resourceVersion":     {version},
+		"timeoutSeconds":      {strconv.Itoa(int(kubernetesWatchTimeout / time.Second))},
+	}
+	resp, err := k.request(ctx, k.resourcePath()+"?"+query.Encode())
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event kubeEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+			return version, err
+		}
+		if event.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errWatchExpired
+			}
+			return version, fmt.Errorf("kubernetes: watch: %s", status.Message)
+		}
+
+		var obj kubeObject
+		if err := json.Unmarshal(event.Object, &obj); err != nil {
+			return version, fmt.Errorf("kubernetes: watch: %v", err)
+		}
+		version = obj.Metadata.ResourceVersion
+		obj.Kind = k.kind()
+		key := obj.Metadata.Namespace + "/" + obj.Metadata.Name
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.objects[key] = obj
+		case "DELETED":
+			delete(k.objects, key)
+		default:
+			continue
+		}
+		k.reconcile()
+	}
+}
+
+// kind returns the kind of the objects watched
+func (k *kubeController) kind() string {
+	if k.cfg.resource() == KubernetesHTTPRoute {
+		return "HTTPRoute"
+	}
+	return "Ingress"
+}
+
+// resourcePath returns the API path of the objects watched
+func (k *kubeController) resourcePath() string {
+	group, resource := "/apis/networking.k8s.io/v1", "ingresses"
+	if k.cfg.resource() == KubernetesHTTPRoute {
+		group, resource = "/apis/gateway.networking.k8s.io/v1", "httproutes"
+	}
+	if k.cfg.Namespace != "" {
+		return group + "/namespaces/" + url.PathEscape(k.cfg.Namespace) + "/" + resource
+	}
+	return group + "/" + resource
+}
+
+// get requests path and decodes the JSON response into out
+func (k *kubeController) get(ctx context.Context, path string, out interface{}) error {
+	resp, err := k.request(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kubernetes: %s: %v", path, err)
+	}
+	return nil
+}
+
+// request sends an authenticated GET to the API server
+func (k *kubeController) request(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if k.token != "" {
+		token, err := ioutil.ReadFile(k.token)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes: %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// setConnected records the state of the watch
+func (k *kubeController) setConnected(connected bool, lastError string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.status.Connected = connected
+	if lastError != "" {
+		k.status.LastError = lastError
+	}
+}
+
+// reconcile creates, updates and deletes the controller's routes to match
+// the objects. A route that fails validation is reported and its previous
+// version, if any, kept.
+func (k *kubeController) reconcile() {
+	var desired []Route
+	var rejected []KubernetesRejection
+	selected := 0
+	keys := make([]string, 0, len(k.objects))
+	for key := range k.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		obj := k.objects[key]
+		routes, problems, ok := k.translate(obj)
+		if ok {
+			selected++
+		}
+		desired = append(desired, routes...)
+		rejected = append(rejected, problems...)
+	}
+	// Longer paths first, so they are matched before the prefixes they extend
+	sort.SliceStable(desired, func(i, j int) bool { return len(desired[i].Path) > len(desired[j].Path) })
+
+	routes := syncControllerRoutes(kubernetesSource, "Kubernetes", desired, func(route Route, err error) {
+		rejected = append(rejected, KubernetesRejection{Object: strings.TrimPrefix(route.source, kubernetesSource), Path: route.Path, Reason: err.Error()})
+	})
+	now := time.Now()
+	k.mutex.Lock()
+	k.status.Objects, k.status.Routes, k.status.Rejected = selected, routes, rejected
+	k.status.LastSync = &now
+	k.mutex.Unlock()
+}
+
+// dropKubernetesRoutes deletes every route the controller kept, once it is
+// disabled
+func dropKubernetesRoutes() {
+	dropControllerRoutes(kubernetesSource, "Kubernetes")
+}
+
+// translate returns the routes for an object and the paths it could not
+// translate, reporting whether the object is selected at all
+func (k *kubeController) translate(obj kubeObject) ([]Route, []KubernetesRejection, bool) {
+	if obj.Kind == "HTTPRoute" {
+		return k.translateHTTPRoute(obj)
+	}
+	return k.translateIngress(obj)
+}
+
+// translateIngress returns a route for each path of an Ingress of the
+// configured class. Hosts are not matched: routes match by path alone.
+func (k *kubeController) translateIngress(obj kubeObject) ([]Route, []KubernetesRejection, bool) {
+	var spec ingressSpec
+	if err := json.Unmarshal(obj.Spec, &spec); err != nil {
+		return nil, []KubernetesRejection{{Object: obj.name(), Reason: err.Error()}}, true
+	}
+	class := spec.IngressClassName
+	if class == "" {
+		class = obj.Metadata.Annotations[ingressClassAnnotation]
+	}
+	if k.cfg.IngressClass != "" && class != k.cfg.IngressClass {
+		return nil, nil, false
+	}
+
+	var routes []Route
+	var rejected []KubernetesRejection
+	if spec.DefaultBackend != nil {
+		rejected = append(rejected, KubernetesRejection{Object: obj.name(), Reason: "default backends are not supported; set catchAll.target instead"})
+	}
+	for _, rule := range spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, p := range rule.HTTP.Paths {
+			path := kubePath(p.Path)
+			service := p.Backend.Service
+			switch {
+			case p.PathType == "Exact":
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "exact paths are not supported; routes match everything under their path"})
+			case service == nil:
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "only service backends are supported"})
+			case service.Port.Number == 0:
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "named service ports are not supported; use the port number"})
+			default:
+				routes = append(routes, k.route(obj, path, nil, []WeightedTarget{{URL: k.serviceURL(service.Name, obj.Metadata.Namespace, service.Port.Number)}}))
+			}
+		}
+	}
+	return routes, rejected, true
+}
+
+// translateHTTPRoute returns a route for each path match of an HTTPRoute
+// attached to the configured Gateway. Backends are pooled by weight.
+func (k *kubeController) translateHTTPRoute(obj kubeObject) ([]Route, []KubernetesRejection, bool) {
+	var spec httpRouteSpec
+	if err := json.Unmarshal(obj.Spec, &spec); err != nil {
+		return nil, []KubernetesRejection{{Object: obj.name(), Reason: err.Error()}}, true
+	}
+	if gateway := k.cfg.Gateway; gateway != "" {
+		attached := false
+		for _, ref := range spec.ParentRefs {
+			namespace := ref.Namespace
+			if namespace == "" {
+				namespace = obj.Metadata.Namespace
+			}
+			if ref.Name == gateway || namespace+"/"+ref.Name == gateway {
+				attached = true
+			}
+		}
+		if !attached {
+			return nil, nil, false
+		}
+	}
+
+	var routes []Route
+	var rejected []KubernetesRejection
+	for _, rule := range spec.Rules {
+		// A backend in another namespace needs a ReferenceGrant there,
+		// which the controller doesn't read, so such rules are rejected
+		var targets []WeightedTarget
+		var foreign string
+		for _, ref := range rule.BackendRefs {
+			if ref.Namespace != "" && ref.Namespace != obj.Metadata.Namespace {
+				foreign = ref.Namespace + "/" + ref.Name
+			}
+			if ref.Weight != nil && *ref.Weight == 0 {
+				continue
+			}
+			target := WeightedTarget{URL: k.serviceURL(ref.Name, obj.Metadata.Namespace, ref.Port)}
+			if ref.Weight != nil {
+				target.Weight = *ref.Weight
+			}
+			targets = append(targets, target)
+		}
+
+		matches := rule.Matches
+		if len(matches) == 0 {
+			matches = []httpRouteMatch{{}}
+		}
+		for _, match := range matches {
+			path := "/"
+			if match.Path != nil {
+				path = kubePath(match.Path.Value)
+			}
+			var methods []string
+			if match.Method != "" {
+				methods = []string{match.Method}
+			}
+			switch {
+			case match.Path != nil && match.Path.Type == "RegularExpression":
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "regular expression paths are not supported"})
+			case match.Path != nil && match.Path.Type == "Exact":
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "exact paths are not supported; routes match everything under their path"})
+			case foreign != "":
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: fmt.Sprintf("backend %s is in another namespace; ReferenceGrants are not supported", foreign)})
+			case len(match.Headers) > 0 || len(match.QueryParams) > 0:
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "header and query parameter matches are not supported"})
+			case len(targets) == 0:
+				rejected = append(rejected, KubernetesRejection{Object: obj.name(), Path: path, Reason: "no backend with a weight"})
+			default:
+				routes = append(routes, k.route(obj, path, methods, targets))
+			}
+		}
+	}
+	return routes, rejected, true
+}
+
+// route builds the route for one path of an object
+func (k *kubeController) route(obj kubeObject, path string, methods []string, targets []WeightedTarget) Route {
+	if len(methods) == 0 {
+		methods = []string{"*"}
+	}
+	route := Route{
+		Path:        path,
+		Target:      targets[0].URL,
+		Methods:     methods,
+		Active:      true,
+		Template:    k.cfg.Template,
+		Description: obj.name(),
+		source:      kubernetesSource + obj.name(),
+	}
+	if len(targets) > 1 {
+		route.Targets = targets
+	}
+	return route
+}
+
+// serviceURL returns the cluster address of a service port
+func (k *kubeController) serviceURL(name, namespace string, port int) string {
+	domain := k.cfg.ClusterDomain
+	if domain == "" {
+		domain = defaultClusterDomain
+	}
+	return fmt.Sprintf("http://%s.%s.svc.%s:%d", name, namespace, domain, port)
+}
+
+// kubePath returns the route path of an Ingress or HTTPRoute prefix path.
+// Routes match their path and everything under it, as prefix paths do.
+func kubePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+		return trimmed
+	}
+	return "/"
+}
+
+// handleKubernetes reports the controller's state
+func handleKubernetes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	kube := kube.Load()
+	if kube == nil {
+		writeJSON(w, KubernetesStatus{})
+		return
+	}
+	kube.mutex.Lock()
+	status := kube.status
+	kube.mutex.Unlock()
+	writeJSON(w, status)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKubernetesRejectsExactPathsAndForeignBackends(t *testing.T) {
+	k := &kubeController{}
+	ingress := kubeObject{Kind: "Ingress", Metadata: kubeMeta{Name: "web", Namespace: "shop"}, Spec: []byte(`{"rules": [{"http": {"paths": [
+		{"path": "/cart", "pathType": "Exact", "backend": {"service": {"name": "cart", "port": {"number": 80}}}},
+		{"path": "/shop", "pathType": "Prefix", "backend": {"service": {"name": "shop", "port": {"number": 80}}}}
+	]}}]}`)}
+	routes, rejected, _ := k.translate(ingress)
+	if len(routes) != 1 || routes[0].Path != "/shop" {
+		t.Fatalf("Ingress routes %+v, want /shop alone", routes)
+	}
+	if len(rejected) != 1 || rejected[0].Path != "/cart" || !strings.Contains(rejected[0].Reason, "exact") {
+		t.Fatalf("Ingress rejections %+v, want the exact path", rejected)
+	}
+
+	route := kubeObject{Kind: "HTTPRoute", Metadata: kubeMeta{Name: "web", Namespace: "shop"}, Spec: []byte(`{"rules": [
+		{"matches": [{"path": {"type": "Exact", "value": "/cart"}}], "backendRefs": [{"name": "cart", "port": 80}]},
+		{"matches": [{"path": {"type": "PathPrefix", "value": "/billing"}}], "backendRefs": [{"name": "billing", "namespace": "finance", "port": 80}]},
+		{"matches": [{"path": {"type": "PathPrefix", "value": "/shop"}}], "backendRefs": [{"name": "shop", "namespace": "shop", "port": 80}]}
+	]}`)}
+	routes, rejected, _ = k.translate(route)
+	if len(routes) != 1 || routes[0].Path != "/shop" || routes[0].Target != "http://shop.shop.svc.cluster.local:80" {
+		t.Fatalf("HTTPRoute routes %+v, want /shop alone", routes)
+	}
+	if len(rejected) != 2 || !strings.Contains(rejected[0].Reason, "exact") || !strings.Contains(rejected[1].Reason, "finance/billing") {
+		t.Fatalf("HTTPRoute rejections %+v, want the exact path and the backend in finance", rejected)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// laneHandler splits a listener shared by the proxy and the admin API into
+// lanes. Requests under a priority path (the admin API, including health
+// and stats, and the dashboard) go to priority, so the gateway-wide rate
+// limit meant for proxied traffic never sheds them; the rest go to data.
+func laneHandler(priorityPaths []string, priority, data http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if priorityRequest(priorityPaths, r.URL.Path) {
+			priority.ServeHTTP(w, r)
+			return
+		}
+		data.ServeHTTP(w, r)
+	})
+}
+
+// priorityRequest reports whether path is at or under a priority path
+func priorityRequest(priorityPaths []string, path string) bool {
+	for _, p := range priorityPaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// warnSharedLane logs that connection limits, which apply before a
+// request's lane is known, also cover the admin API on a shared listener
+func warnSharedLane(cfg ServerConfig) {
+	if cfg.MaxConns > 0 || cfg.MaxConnsPerIP > 0 {
+		log.Printf("Warning: the admin API shares the proxy port, so its connections count toward server.maxConns and server.maxConnsPerIP; set admin.port to keep it reachable when the proxy is saturated")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// maxLatencyBuckets bounds the histogram size, which every route's counts
+// in every analytics bucket carry
+const maxLatencyBuckets = 30
+
+// defaultLatencyBuckets are the histogram upper bounds in milliseconds
+var defaultLatencyBuckets = []float64{50, 100, 200, 500, 1000}
+
+// LatencyConfig sets the bucket boundaries of the latency histograms
+type LatencyConfig struct {
+	Buckets []float64 `json:"buckets,omitempty"` // ascending upper bounds in milliseconds; defaults to 50, 100, 200, 500 and 1000
+}
+
+// checkLatency validates the histogram buckets
+func checkLatency(c LatencyConfig, v *ValidationError) {
+	if len(c.Buckets) > maxLatencyBuckets {
+		v.add("latency.buckets", "must have at most %d boundaries", maxLatencyBuckets)
+	}
+	for i, bound := range c.Buckets {
+		switch {
+		case bound <= 0:
+			v.add("latency.buckets", "boundary %g must be positive", bound)
+		case i > 0 && bound <= c.Buckets[i-1]:
+			v.add("latency.buckets", "boundary %g must be greater than %g", bound, c.Buckets[i-1])
+		}
+	}
+}
+
+// latencyBuckets returns the effective histogram upper bounds
+func (c *Config) latencyBuckets() []float64 {
+	settings := c.settings()
+	if len(settings.Latency.Buckets) > 0 {
+		return settings.Latency.Buckets
+	}
+	return defaultLatencyBuckets
+}
+
+// LatencyHistogram counts requests by latency. Histograms recorded under
+// other bucket boundaries, before a reload changed them, start afresh.
+type LatencyHistogram struct {
+	Bounds []float64 `json:"bounds"` // bucket upper bounds in milliseconds
+	Counts []int64   `json:"counts"` // requests per bucket; the last counts those over the highest bound
+	Count  int64     `json:"count"`
+	Sum    float64   `json:"sum"` // seconds
+}
+
+// newLatencyHistogram returns an empty histogram with the given bounds
+func newLatencyHistogram(bounds []float64) LatencyHistogram {
+	return LatencyHistogram{Bounds: bounds, Counts: make([]int64, len(bounds)+1)}
+}
+
+// observe counts a request, first clearing counts kept under other bounds.
+// The bounds are shared, not copied, so callers must not modify them.
+func (h *LatencyHistogram) observe(bounds []float64, latency time.Duration) {
+	if !sameBounds(h.Bounds, bounds) || len(h.Counts) != len(bounds)+1 {
+		*h = newLatencyHistogram(bounds)
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+	h.Counts[sort.SearchFloat64s(bounds, ms)]++
+	h.Count++
+	h.Sum += latency.Seconds()
+}
+
+// merge adds another histogram's counts. An empty histogram takes the
+// other's bounds; counts under different bounds are skipped.
+func (h *LatencyHistogram) merge(other LatencyHistogram) {
+	if len(other.Counts) == 0 {
+		return
+	}
+	if len(h.Counts) == 0 {
+		*h = newLatencyHistogram(other.Bounds)
+	}
+	if !sameBounds(h.Bounds, other.Bounds) {
+		return
+	}
+	for i, count := range other.Counts {
+		h.Counts[i] += count
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+}
+
+// quantile estimates the q-th quantile latency in milliseconds,
+// interpolating within the bucket it falls in. Latencies over the highest
+// bound report that bound. ok is false for an empty histogram.
+func (h LatencyHistogram) quantile(q float64) (ms float64, ok bool) {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0, false
+	}
+	rank := q * float64(h.Count)
+	var seen int64
+	for i, count := range h.Counts {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+		if i == len(h.Bounds) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-float64(seen))/float64(count), true
+	}
+	return h.Bounds[len(h.Bounds)-1], true
+}
+
+// clone returns a copy that shares no counts
+func (h LatencyHistogram) clone() LatencyHistogram {
+	if h.Counts != nil {
+		h.Counts = append([]int64(nil), h.Counts...)
+	}
+	return h
+}
+
+// sameBounds reports whether two sets of bucket bounds are equal
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
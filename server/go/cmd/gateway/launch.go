@@ -0,0 +1,39 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+)
+
+// checkLaunch validates a route's dark-launch settings
+func checkLaunch(route *Route, v *ValidationError) {
+	if p := route.EnabledPercent; p != nil && (*p < 0 || *p > 100) {
+		v.add("enabledPercent", "must be between 0 and 100")
+	}
+	if route.LaunchKey == rateLimitKeyRoute || !validRateLimitKey(route.LaunchKey) {
+		v.add("launchKey", "invalid launch key %q: use ip, header:<name> or claim:<name>", route.LaunchKey)
+	}
+}
+
+// launchEnabled reports whether a dark-launched route serves a request.
+// Clients are bucketed by a hash of their launch key, so the same client
+// keeps getting the same answer while the percentage is unchanged, and
+// raising it only adds clients.
+func launchEnabled(r *http.Request, route Route) bool {
+	p := route.EnabledPercent
+	if p == nil || *p >= 100 {
+		return true
+	}
+	if *p <= 0 {
+		return false
+	}
+
+	source := route.LaunchKey
+	if source == "" {
+		source = rateLimitKeyIP
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strconv.Itoa(route.ID) + "|" + clientKey(r, source)))
+	return int(h.Sum32()%100) < *p
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultLDAPTimeout bounds a bind, in seconds
+const defaultLDAPTimeout = 5
+
+// LDAP result codes
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// LDAPConfig checks passwords by binding to a directory as the user
+type LDAPConfig struct {
+	URL     string `json:"url"`               // ldap://host:389 or ldaps://host:636
+	BindDN  string `json:"bindDn"`            // e.g. uid={username},ou=people,dc=example,dc=com
+	Timeout int    `json:"timeout,omitempty"` // seconds; defaults to 5
+}
+
+// checkLDAP validates LDAP settings
+func checkLDAP(l *LDAPConfig, v *ValidationError) {
+	if l == nil {
+		return
+	}
+	if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		v.add("basicAuth.ldap.url", "must be an ldap:// or ldaps:// URL")
+	}
+	if !strings.Contains(l.BindDN, "{username}") {
+		v.add("basicAuth.ldap.bindDn", "must contain {username}")
+	}
+	if l.Timeout < 0 {
+		v.add("basicAuth.ldap.timeout", "must not be negative")
+	}
+}
+
+// escapeDN escapes a value for use in a distinguished name (RFC 4514)
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", c),
+			i == 0 && (c == '#' || c == ' '),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c == 0:
+			b.WriteString("\\00")
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// bind performs a simple bind as the user, reporting whether the password
+// was accepted. Errors mean the directory could not give an answer.
+func (l *LDAPConfig) bind(user, password string) (bool, error) {
+	// An empty password is an unauthenticated bind, which succeeds
+	if password == "" {
+		return false, nil
+	}
+
+	u, err := url.Parse(l.URL)
+	if err != nil {
+		return false, err
+	}
+	timeout := time.Duration(l.Timeout) * time.Second
+	if l.Timeout == 0 {
+		timeout = defaultLDAPTimeout * time.Second
+	}
+
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	if u.Scheme == "ldaps" {
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	dn := strings.ReplaceAll(l.BindDN, "{username}", escapeDN(user))
+	if _, err := conn.Write(ldapBindRequest(1, dn, password)); err != nil {
+		return false, err
+	}
+	code, err := readLDAPBindResponse(bufio.NewReader(conn))
+	if err != nil {
+		return false, err
+	}
+	conn.Write(ldapUnbindRequest(2))
+
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("ldap bind returned result code %d", code)
+}
+
+// berElement encodes a BER tag, length and content
+func berElement(tag byte, content []byte) []byte {
+	n := len(content)
+	out := []byte{tag}
+	if n < 0x80 {
+		out = append(out, byte(n))
+		return append(out, content...)
+	}
+
+	// Long form: 0x80 | the number of length octets, then the length
+	var length []byte
+	for ; n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	out = append(out, 0x80|byte(len(length)))
+	out = append(out, length...)
+	return append(out, content...)
+}
+
+// berInt encodes a small non-negative INTEGER
+func berInt(v int) []byte {
+	return berElement(0x02, []byte{byte(v)})
+}
+
+// ldapBindRequest encodes an LDAPv3 simple BindRequest
+func ldapBindRequest(id int, dn, password string) []byte {
+	var bind []byte
+	bind = append(bind, berInt(3)...)
+	bind = append(bind, berElement(0x04, []byte(dn))...)
+	bind = append(bind, berElement(0x80, []byte(password))...)
+
+	msg := append(berInt(id), berElement(0x60, bind)...)
+	return berElement(0x30, msg)
+}
+
+// ldapUnbindRequest encodes an UnbindRequest
+func ldapUnbindRequest(id int) []byte {
+	return berElement(0x30, append(berInt(id), 0x42, 0x00))
+}
+
+// readBERElement reads one BER element, returning its tag and content
+func readBERElement(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return 0, nil, errors.New("ldap: unsupported length encoding")
+		}
+		n = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("ldap: response too large")
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// readLDAPBindResponse reads a BindResponse and returns its result code
+func readLDAPBindResponse(r *bufio.Reader) (int, error) {
+	tag, msg, err := readBERElement(r)
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x30 {
+		return 0, errors.New("ldap: malformed response")
+	}
+
+	body := bufio.NewReader(strings.NewReader(string(msg)))
+	if tag, _, err = readBERElement(body); err != nil || tag != 0x02 {
+		return 0, errors.New("ldap: malformed message ID")
+	}
+	tag, op, err := readBERElement(body)
+	if err != nil || tag != 0x61 {
+		return 0, errors.New("ldap: expected a bind response")
+	}
+	tag, code, err := readBERElement(bufio.NewReader(strings.NewReader(string(op))))
+	if err != nil || tag != 0x0a || len(code) != 1 {
+		return 0, errors.New("ldap: malformed result code")
+	}
+	return int(code[0]), nil
+}
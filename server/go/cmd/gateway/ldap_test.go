@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testDirectory answers simple binds, accepting password for dn
+func testDirectory(t *testing.T, dn, password string) *LDAPConfig {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, msg, err := readBERElement(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				body := bufio.NewReader(bytes.NewReader(msg))
+				_, id, _ := readBERElement(body)
+				_, bind, _ := readBERElement(body)
+				fields := bufio.NewReader(bytes.NewReader(bind))
+				readBERElement(fields) // version
+				_, gotDN, _ := readBERElement(fields)
+				_, gotPassword, _ := readBERElement(fields)
+
+				code := byte(ldapInvalidCredentials)
+				if string(gotDN) == dn && string(gotPassword) == password {
+					code = ldapSuccess
+				}
+				result := append(berElement(0x0a, []byte{code}), berElement(0x04, nil)...)
+				result = append(result, berElement(0x04, nil)...)
+				conn.Write(berElement(0x30, append(berElement(0x02, id), berElement(0x61, result)...)))
+			}()
+		}
+	}()
+	return &LDAPConfig{URL: "ldap://" + ln.Addr().String(), BindDN: "uid={username},dc=example"}
+}
+
+func TestBERLengths(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0xff, 0x100, 0xffff, 0x10000, 0xfffff} {
+		content := bytes.Repeat([]byte{'x'}, n)
+		tag, got, err := readBERElement(bufio.NewReader(bytes.NewReader(berElement(0x04, content))))
+		if err != nil {
+			t.Fatalf("length %d: %v", n, err)
+		}
+		if tag != 0x04 || len(got) != n {
+			t.Fatalf("length %d: read tag %#x with %d bytes", n, tag, len(got))
+		}
+	}
+}
+
+func TestLDAPBind(t *testing.T) {
+	long := strings.Repeat("p", 0x10000+10)
+	l := testDirectory(t, `uid=a\,b,dc=example`, long)
+
+	ok, err := l.bind("a,b", long)
+	if err != nil || !ok {
+		t.Fatalf("bind with a %d byte password = %v, %v; want accepted", len(long), ok, err)
+	}
+	if ok, err := l.bind("a,b", long[1:]); err != nil || ok {
+		t.Fatalf("bind with the wrong password = %v, %v; want refused", ok, err)
+	}
+	if ok, err := l.bind("a,b", ""); err != nil || ok {
+		t.Fatalf("bind with an empty password = %v, %v; want refused", ok, err)
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Leader election backends
+const (
+	LeaderBackendRedis = "redis"
+	LeaderBackendEtcd  = "etcd"
+
+	defaultLeaderKey = "gateway/leader"
+	defaultLeaderTTL = 15
+
+	leaderElectionJob = "leader-election"
+)
+
+// LeaderConfig elects one replica to run the singleton background tasks:
+// active health checks, alert evaluation and, with a shared database,
+// stats history. Followers take service health from the leader.
+type LeaderConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Backend   string `json:"backend"`             // "redis" or "etcd"
+	URL       string `json:"url"`                 // redis://[:password@]host:6379 or http://etcd:2379
+	Key       string `json:"key,omitempty"`       // lock key; defaults to gateway/leader
+	TTL       int    `json:"ttl,omitempty"`       // seconds a leader that stops renewing keeps the lock; defaults to 15
+	ReplicaID string `json:"replicaId,omitempty"` // defaults to sync.replicaId, else host name and process ID
+}
+
+// ttl returns the lock's lifetime
+func (c LeaderConfig) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return defaultLeaderTTL * time.Second
+	}
+	return time.Duration(c.TTL) * time.Second
+}
+
+// checkLeader validates the leader election settings
+func checkLeader(c LeaderConfig, v *ValidationError) {
+	checkNonNegative("leader", []namedInt{{"ttl", c.TTL}}, v)
+	if !c.Enabled {
+		return
+	}
+	switch strings.ToLower(c.Backend) {
+	case LeaderBackendRedis, LeaderBackendEtcd:
+	default:
+		v.add("leader.backend", "must be redis or etcd")
+	}
+	if c.URL == "" {
+		v.add("leader.url", "is required when leader election is enabled")
+	}
+	if c.TTL == 1 {
+		v.add("leader.ttl", "must be at least 2 seconds so the lock is renewed in time")
+	}
+}
+
+// LeaderStatus reports the outcome of leader election
+type LeaderStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Replica   string     `json:"replica,omitempty"`
+	Leader    bool       `json:"leader"`           // whether this replica runs the singleton tasks
+	Holder    string     `json:"holder,omitempty"` // the replica holding the lock
+	Since     *time.Time `json:"since,omitempty"`  // when this replica last became leader or follower
+	Reachable bool       `json:"reachable"`        // whether the lock backend answered the last attempt
+	LastError string     `json:"lastError,omitempty"`
+}
+
+// leaderLock is a lock that expires unless its holder renews it
+type leaderLock interface {
+	// acquire takes or renews the lock and returns the replica holding it
+	acquire() (string, error)
+	release() error
+	// put and get share a value that expires with the leader's term
+	put(name string, value []byte) error
+	get(name string) ([]byte, error)
+}
+
+// leaderElection campaigns for the lock on behalf of this replica
+type leaderElection struct {
+	lock leaderLock
+	ttl  time.Duration
+
+	mutex       sync.Mutex
+	status      LeaderStatus
+	lastContact time.Time // when the backend last answered
+}
+
+// leadership elects the replica that runs singleton tasks; nil when
+// election is disabled, so every replica runs them
+var leadership atomic.Pointer[leaderElection]
+
+// newLeaderElection campaigns for leadership until ctx is done, or returns
+// nil when election is disabled
+func newLeaderElection(ctx context.Context, cfg LeaderConfig, replicaID string, p *Proxy) (*leaderElection, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	key := cfg.Key
+	if key == "" {
+		key = defaultLeaderKey
+	}
+	id := replicaName(cfg.ReplicaID)
+	if cfg.ReplicaID == "" {
+		id = replicaName(replicaID)
+	}
+
+	var lock leaderLock
+	switch strings.ToLower(cfg.Backend) {
+	case LeaderBackendRedis:
+		conn, err := newRedisSync(cfg.URL, "")
+		if err != nil {
+			return nil, err
+		}
+		lock = &redisLock{conn: conn, key: key, id: id, ttl: cfg.ttl()}
+	case LeaderBackendEtcd:
+		lock = &etcdLock{
+			endpoint: strings.TrimSuffix(cfg.URL, "/"),
+			key:      key,
+			id:       id,
+			ttl:      cfg.ttl(),
+			client:   &http.Client{Timeout: 5 * time.Second},
+		}
+	default:
+		return nil, fmt.Errorf("leader: unsupported backend %q", cfg.Backend)
+	}
+
+	e := &leaderElection{
+		lock:   lock,
+		ttl:    cfg.ttl(),
+		status: LeaderStatus{Enabled: true, Replica: id},
+		// Give the backend a term to answer before falling back
+		lastContact: time.Now(),
+	}
+	jobs.start(ctx, jobSpec{
+		name:      leaderElectionJob,
+		interval:  every(e.ttl / 3),
+		immediate: true,
+		run:       func(context.Context, time.Time) error { return e.run(p) },
+	})
+	return e, nil
+}
+
+// isLeader reports whether this replica should run singleton tasks: when
+// election is disabled, when it holds the lock, or when the lock backend
+// has been unreachable for a whole term. Duplicate work beats none.
+func (e *leaderElection) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status.Leader || (!e.status.Reachable && time.Since(e.lastContact) > e.ttl)
+}
+
+// run renews or contends for the lock, then shares service health as
+// leader or adopts it as follower. It runs three times a term.
+func (e *leaderElection) run(p *Proxy) error {
+	if err := e.campaign(); err != nil {
+		return err
+	}
+	if e.holdsLock() {
+		return e.shareHealth(p)
+	}
+	return e.adoptHealth(p)
+}
+
+// stop ends campaigning and gives up the lock, so another replica takes
+// over without waiting for it to expire
+func (e *leaderElection) stop() {
+	if e == nil {
+		return
+	}
+	jobs.remove(leaderElectionJob)
+	if !e.holdsLock() {
+		return
+	}
+	e.mutex.Lock()
+	e.status.Leader = false
+	e.mutex.Unlock()
+	if err := e.lock.release(); err != nil {
+		log.Printf("Failed to release leadership: %v", err)
+	}
+}
+
+// holdsLock reports whether this replica won the last election
+func (e *leaderElection) holdsLock() bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status.Leader
+}
+
+// campaign tries to take or renew the lock once. A leader that can't reach
+// the backend stays leader until its lock would have expired.
+func (e *leaderElection) campaign() error {
+	holder, err := e.lock.acquire()
+	now := time.Now()
+
+	e.mutex.Lock()
+	wasLeader := e.status.Leader
+	e.status.Reachable = err == nil
+	if err != nil {
+		e.status.LastError = err.Error()
+		if wasLeader && now.Sub(e.lastContact) > e.ttl {
+			e.status.Leader = false
+			e.status.Holder = ""
+		}
+	} else {
+		e.status.Holder = holder
+		e.status.Leader = holder == e.status.Replica
+		e.lastContact = now
+	}
+	changed := e.status.Leader != wasLeader
+	if changed {
+		e.status.Since = &now
+	}
+	status := e.status
+	e.mutex.Unlock()
+
+	if !changed {
+		return err
+	}
+	if status.Leader {
+		log.Printf("Replica %s elected leader; running singleton tasks", status.Replica)
+	} else {
+		log.Printf("Replica %s is a follower of %q; singleton tasks stopped", status.Replica, status.Holder)
+		alerts.reset()
+	}
+	events.emit(EventLeaderChanged, status)
+	return err
+}
+
+// SharedHealth is a service's health as the leader shares it
+type SharedHealth struct {
+	Status    string    `json:"status"`
+	LastCheck time.Time `json:"lastCheck"`
+	Flapping  bool      `json:"flapping,omitempty"`
+}
+
+// shareHealth publishes the leader's view of service health
+func (e *leaderElection) shareHealth(p *Proxy) error {
+	health := make(map[string]SharedHealth)
+	for _, svc := range p.getServices() {
+		health[svc.Name] = SharedHealth{Status: svc.Status, LastCheck: svc.LastCheck, Flapping: svc.Flapping}
+	}
+	payload, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	return e.lock.put("health", payload)
+}
+
+// adoptHealth takes the leader's newer results in place of probing
+func (e *leaderElection) adoptHealth(p *Proxy) error {
+	payload, err := e.lock.get("health")
+	if err != nil || payload == nil {
+		return err
+	}
+	var health map[string]SharedHealth
+	if err := json.Unmarshal(payload, &health); err != nil {
+		return fmt.Errorf("malformed shared health: %v", err)
+	}
+
+	now := time.Now()
+	p.servicesMutex.Lock()
+	for name, shared := range health {
+		svc, ok := p.services[name]
+		if !ok || !shared.LastCheck.After(svc.LastCheck) {
+			continue
+		}
+		if shared.Status == "healthy" && svc.Status != "healthy" {
+			svc.startWarmUp(svc.Status, p.config.settings().HealthCheck.forService(name), now)
+		}
+		svc.Status, svc.LastCheck, svc.Flapping = shared.Status, shared.LastCheck, shared.Flapping
+	}
+	p.servicesMutex.Unlock()
+	p.checkReadiness()
+	return nil
+}
+
+// handleLeader reports leader election state
+func handleLeader(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	leadership := leadership.Load()
+	if leadership == nil {
+		writeJSON(w, LeaderStatus{Leader: true})
+		return
+	}
+	leadership.mutex.Lock()
+	status := leadership.status
+	leadership.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+// Scripts that touch the Redis lock only while this replica holds it
+const (
+	redisRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	redisReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+// redisLock is a Redis key holding the leader's replica ID
+type redisLock struct {
+	conn *redisSync // connection settings, shared with replica sync
+	key  string
+	id   string
+	ttl  time.Duration
+
+	client net.Conn
+	reader *bufio.Reader
+}
+
+// do runs a command, connecting if needed. Only the election goroutine
+// uses the lock, so the connection needs no mutex.
+func (l *redisLock) do(args ...string) (interface{}, error) {
+	if l.client == nil {
+		conn, reader, err := l.conn.dial()
+		if err != nil {
+			return nil, err
+		}
+		l.client, l.reader = conn, reader
+	}
+	reply, err := redisCommand(l.client, l.reader, args...)
+	if err != nil && !strings.HasPrefix(err.Error(), "redis: ") {
+		// Drop a broken connection so the next command reconnects
+		l.client.Close()
+		l.client = nil
+	}
+	return reply, err
+}
+
+// acquire sets the key if it is free, else extends it if it is ours
+func (l *redisLock) acquire() (string, error) {
+	ms := strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+	reply, err := l.do("SET", l.key, l.id, "NX", "PX", ms)
+	if err != nil {
+		return "", err
+	}
+	if reply == "OK" {
+		return l.id, nil
+	}
+	reply, err = l.do("EVAL", redisRenewScript, "1", l.key, l.id, ms)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := reply.(int64); n == 1 {
+		return l.id, nil
+	}
+	reply, err = l.do("GET", l.key)
+	if err != nil {
+		return "", err
+	}
+	holder, _ := reply.(string)
+	return holder, nil
+}
+
+// release deletes the key if it is still ours
+func (l *redisLock) release() error {
+	_, err := l.do("EVAL", redisReleaseScript, "1", l.key, l.id)
+	if l.client != nil {
+		l.client.Close()
+		l.client = nil
+	}
+	return err
+}
+
+// put sets a value beside the lock, expiring with it
+func (l *redisLock) put(name string, value []byte) error {
+	ms := strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+	_, err := l.do("SET", l.key+"/"+name, string(value), "PX", ms)
+	return err
+}
+
+// get reads a value beside the lock; nil when unset
+func (l *redisLock) get(name string) ([]byte, error) {
+	reply, err := l.do("GET", l.key+"/"+name)
+	if value, ok := reply.(string); ok && err == nil {
+		return []byte(value), nil
+	}
+	return nil, err
+}
+
+// etcdLock is an etcd key holding the leader's replica ID, attached to a
+// lease the leader keeps alive. It uses etcd's JSON gateway to the v3 API.
+type etcdLock struct {
+	endpoint string
+	key      string
+	id       string
+	ttl      time.Duration
+	client   *http.Client
+
+	lease string // ID of this replica's lease, once granted
+}
+
+// call posts a request to an etcd v3 API endpoint
+func (l *etcdLock) call(path string, request, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := l.client.Post(l.endpoint+"/v3/"+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("etcd: %s returned %d: %s", path, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// etcdKey encodes a key or value as the JSON gateway expects
+func etcdKey(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// etcdKV is a key-value pair in a range response
+type etcdKV struct {
+	Value string `json:"value"`
+}
+
+// etcdRange is the response to a range request
+type etcdRange struct {
+	Kvs []etcdKV `json:"kvs"`
+}
+
+// acquire keeps this replica's lease alive, granting a new one once it has
+// expired, then creates the key on the lease unless it already exists
+func (l *etcdLock) acquire() (string, error) {
+	if l.lease != "" {
+		var keepAlive struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := l.call("lease/keepalive", map[string]string{"ID": l.lease}, &keepAlive); err != nil {
+			return "", err
+		}
+		if ttl, _ := strconv.Atoi(keepAlive.Result.TTL); ttl <= 0 {
+			l.lease = ""
+		}
+	}
+	if l.lease == "" {
+		var grant struct {
+			ID string `json:"ID"`
+		}
+		if err := l.call("lease/grant", map[string]int64{"TTL": int64(l.ttl / time.Second)}, &grant); err != nil {
+			return "", err
+		}
+		l.lease = grant.ID
+	}
+
+	key := etcdKey(l.key)
+	var txn struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			Range etcdRange `json:"response_range"`
+		} `json:"responses"`
+	}
+	err := l.call("kv/txn", map[string]interface{}{
+		"compare": []map[string]string{{"key": key, "target": "CREATE", "create_revision": "0"}},
+		"success": []interface{}{map[string]interface{}{"request_put": map[string]string{"key": key, "value": etcdKey(l.id), "lease": l.lease}}},
+		"failure": []interface{}{map[string]interface{}{"request_range": map[string]string{"key": key}}},
+	}, &txn)
+	if err != nil {
+		return "", err
+	}
+	if txn.Succeeded {
+		return l.id, nil
+	}
+	if len(txn.Responses) == 0 || len(txn.Responses[0].Range.Kvs) == 0 {
+		return "", nil
+	}
+	holder, err := base64.StdEncoding.DecodeString(txn.Responses[0].Range.Kvs[0].Value)
+	return string(holder), err
+}
+
+// release revokes the lease, deleting the key and shared values with it
+func (l *etcdLock) release() error {
+	if l.lease == "" {
+		return nil
+	}
+	err := l.call("lease/revoke", map[string]string{"ID": l.lease}, nil)
+	l.lease = ""
+	return err
+}
+
+// put sets a value beside the lock on the leader's lease
+func (l *etcdLock) put(name string, value []byte) error {
+	return l.call("kv/put", map[string]string{
+		"key":   etcdKey(l.key + "/" + name),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": l.lease,
+	}, nil)
+}
+
+// get reads a value beside the lock; nil when unset
+func (l *etcdLock) get(name string) ([]byte, error) {
+	var resp etcdRange
+	if err := l.call("kv/range", map[string]string{"key": etcdKey(l.key + "/" + name)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(resp.Kvs[0].Value)
+}
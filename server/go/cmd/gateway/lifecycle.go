@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"sync"
+)
+
+// backgroundCtx scopes the gateway's background work. main cancels it at
+// shutdown, once the servers have drained.
+var backgroundCtx = context.Background()
+
+// worker is a background goroutine that can be stopped and started again,
+// so a reload can restart it with new settings without leaking the old one
+type worker struct {
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start stops the running goroutine, waiting for it to exit, then runs f
+// under a context derived from ctx
+func (w *worker) start(ctx context.Context, f func(ctx context.Context)) {
+	w.stop()
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	w.mutex.Lock()
+	w.cancel, w.done = cancel, done
+	w.mutex.Unlock()
+	go func() {
+		defer close(done)
+		f(ctx)
+	}()
+}
+
+// stop cancels the goroutine, if running, and waits for it to exit
+func (w *worker) stop() {
+	w.mutex.Lock()
+	cancel, done := w.cancel, w.done
+	w.cancel, w.done = nil, nil
+	w.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// backgroundSettings are the settings background work is started with
+type backgroundSettings struct {
+	FeatureFlags FeatureFlagsConfig
+	Tracing      TracingConfig
+	Storage      StorageConfig
+	BotDetection BotConfig
+	Sync         SyncConfig
+	Leader       LeaderConfig
+	Kubernetes   KubernetesConfig
+	XDS          XDSConfig
+	Reload       ReloadConfig
+}
+
+// backgroundSettings returns the settings background work depends on
+func (c *Config) backgroundSettings() backgroundSettings {
+	settings := c.settings()
+	return backgroundSettings{
+		FeatureFlags: settings.FeatureFlags,
+		Tracing:      settings.Tracing,
+		Storage:      settings.Storage,
+		BotDetection: settings.BotDetection,
+		Sync:         settings.Sync,
+		Leader:       settings.Leader,
+		Kubernetes:   settings.Kubernetes,
+		XDS:          settings.XDS,
+		Reload:       settings.Reload,
+	}
+}
+
+// restartBackground restarts the background work whose settings a reload
+// changed, stopping the old goroutines before starting new ones. Work
+// that rereads its settings on each run, like alert evaluation, is left
+// running.
+func restartBackground(before backgroundSettings, c *Config) {
+	after := c.backgroundSettings()
+	if !reflect.DeepEqual(before.FeatureFlags, after.FeatureFlags) {
+		featureFlags.start(backgroundCtx, after.FeatureFlags)
+	}
+	if !reflect.DeepEqual(before.Tracing, after.Tracing) {
+		tracer.start(backgroundCtx, after.Tracing)
+	}
+	if before.Storage.HistoryInterval != after.Storage.HistoryInterval || before.Storage.HistoryRetention != after.Storage.HistoryRetention {
+		proxy.recordHistory(backgroundCtx, store, after.Storage)
+	}
+	if !reflect.DeepEqual(before.BotDetection, after.BotDetection) {
+		botDetector.Store(newBotDetector(backgroundCtx, after.BotDetection))
+	}
+	if !reflect.DeepEqual(before.Sync, after.Sync) {
+		replicas.Load().stop()
+		syncer, err := newReplicaSync(backgroundCtx, after.Sync)
+		if err != nil {
+			log.Printf("Replica sync stopped: %v", err)
+		}
+		replicas.Store(syncer)
+	}
+	if !reflect.DeepEqual(before.Leader, after.Leader) || before.Sync.ReplicaID != after.Sync.ReplicaID {
+		leadership.Load().stop()
+		election, err := newLeaderElection(backgroundCtx, after.Leader, after.Sync.ReplicaID, proxy)
+		if err != nil {
+			log.Printf("Leader election stopped: %v", err)
+		}
+		leadership.Store(election)
+	}
+	if !reflect.DeepEqual(before.Kubernetes, after.Kubernetes) {
+		kube.Load().stop()
+		controller, err := newKubeController(backgroundCtx, after.Kubernetes)
+		if err != nil {
+			log.Printf("Kubernetes controller stopped: %v", err)
+		}
+		kube.Store(controller)
+		if controller == nil {
+			dropKubernetesRoutes()
+		}
+	}
+	if !reflect.DeepEqual(before.XDS, after.XDS) {
+		xds.Load().stop()
+		client, err := newXDSClient(backgroundCtx, after.XDS)
+		if err != nil {
+			log.Printf("xDS client stopped: %v", err)
+		}
+		xds.Store(client)
+		if client == nil {
+			dropXDSRoutes()
+		}
+	}
+	if before.Reload.Watch != after.Reload.Watch {
+		startConfigWatch(backgroundCtx, c)
+	}
+}
+
+// stopBackground cancels the background work and waits for it to exit:
+// running jobs finish, queued spans are exported and the leader releases
+// its lock
+func stopBackground(cancel context.CancelFunc) {
+	cancel()
+	jobs.shutdown(jobShutdownTimeout)
+	tracer.worker.stop()
+	replicas.Load().stop()
+	leadership.Load().stop()
+	kube.Load().stop()
+	xds.Load().stop()
+}
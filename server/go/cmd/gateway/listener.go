@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ServerConfig configures the client-facing listener
+type ServerConfig struct {
+	ReadHeaderTimeout int `json:"readHeaderTimeout"` // seconds to receive request headers
+	IdleTimeout       int `json:"idleTimeout"`       // seconds to keep idle keep-alive connections
+	MinBodyRate       int `json:"minBodyRate"`       // minimum request body bytes/sec, 0 disables
+	BodyRateGrace     int `json:"bodyRateGrace"`     // seconds before the body rate is enforced
+	MaxConnsPerIP     int `json:"maxConnsPerIP"`     // concurrent connections per client IP, 0 disables
+	MaxConns          int `json:"maxConns"`          // concurrent connections in total, 0 disables
+}
+
+// newHTTPServer builds the gateway server with slow-client protections applied
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	readHeaderTimeout := time.Duration(cfg.ReadHeaderTimeout) * time.Second
+	if readHeaderTimeout <= 0 {
+		readHeaderTimeout = 10 * time.Second
+	}
+
+	idleTimeout := time.Duration(cfg.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = 120 * time.Second
+	}
+
+	if cfg.MinBodyRate > 0 {
+		handler = minBodyRateHandler(handler, cfg.MinBodyRate, time.Duration(cfg.BodyRateGrace)*time.Second)
+	}
+
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
+
+// minBodyRateHandler aborts requests whose body arrives slower than
+// minRate bytes/sec once the grace period has passed
+func minBodyRateHandler(next http.Handler, minRate int, grace time.Duration) http.Handler {
+	if grace <= 0 {
+		grace = 5 * time.Second
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &rateEnforcedBody{
+				ReadCloser: r.Body,
+				rc:         http.NewResponseController(w),
+				start:      time.Now(),
+				grace:      grace,
+				minRate:    float64(minRate),
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateEnforcedBody moves the connection read deadline forward as bytes
+// arrive, so a body must average at least minRate after the grace period
+type rateEnforcedBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	start   time.Time
+	grace   time.Duration
+	minRate float64
+	read    int64
+}
+
+// Read reads from the body, requiring the next byte before the deadline
+// implied by the minimum rate
+func (b *rateEnforcedBody) Read(p []byte) (int, error) {
+	allowed := b.grace + time.Duration(float64(b.read+1)/b.minRate*float64(time.Second))
+	b.rc.SetReadDeadline(b.start.Add(allowed))
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Printf("Request body too slow: %d bytes in %v", b.read, time.Since(b.start).Round(time.Millisecond))
+	}
+
+	return n, err
+}
+
+// Close clears the read deadline so the connection can be reused
+func (b *rateEnforcedBody) Close() error {
+	b.rc.SetReadDeadline(time.Time{})
+	return b.ReadCloser.Close()
+}
+
+// ConnectionStats reports open client connections
+type ConnectionStats struct {
+	Total         int            `json:"total"`
+	MaxConns      int            `json:"maxConns"`
+	MaxConnsPerIP int            `json:"maxConnsPerIP"`
+	Rejected      int64          `json:"rejected"`
+	PerIP         map[string]int `json:"perIP"`
+}
+
+// connLimitListener tracks open connections and rejects new ones at accept
+// time once the global or per-client limit is reached
+type connLimitListener struct {
+	net.Listener
+	maxTotal int
+	maxPerIP int
+
+	conns    map[string]int
+	total    int
+	rejected int64
+	mu       sync.Mutex
+}
+
+// newConnLimitListener wraps l with global and per-IP connection caps
+func newConnLimitListener(l net.Listener, maxTotal, maxPerIP int) *connLimitListener {
+	return &connLimitListener{
+		Listener: l,
+		maxTotal: maxTotal,
+		maxPerIP: maxPerIP,
+		conns:    make(map[string]int),
+	}
+}
+
+// Accept waits for the next connection that is within the limits
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if !l.acquire(ip) {
+			log.Printf("Connection limit reached, rejecting connection from %s", ip)
+			conn.Close()
+			continue
+		}
+
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire reserves a connection slot for ip
+func (l *connLimitListener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if (l.maxTotal > 0 && l.total >= l.maxTotal) || (l.maxPerIP > 0 && l.conns[ip] >= l.maxPerIP) {
+		l.rejected++
+		return false
+	}
+	l.conns[ip]++
+	l.total++
+	return true
+}
+
+// release frees a connection slot for ip
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total--
+	l.conns[ip]--
+	if l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// stats returns a snapshot of the current connection counts
+func (l *connLimitListener) stats() ConnectionStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	perIP := make(map[string]int, len(l.conns))
+	for ip, count := range l.conns {
+		perIP[ip] = count
+	}
+
+	return ConnectionStats{
+		Total:         l.total,
+		MaxConns:      l.maxTotal,
+		MaxConnsPerIP: l.maxPerIP,
+		Rejected:      l.rejected,
+		PerIP:         perIP,
+	}
+}
+
+// limitedConn releases its slot exactly once when closed
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+// Close closes the connection and releases its slot
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// remoteIP returns the IP portion of a connection's remote address
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
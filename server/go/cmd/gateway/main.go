@@ -1,71 +1,336 @@
 package main
 
 import (
+        "container/list"
+        "context"
         "encoding/json"
+        "errors"
+        "flag"
         "fmt"
         "io/ioutil"
         "log"
+        "net"
         "net/http"
         "net/http/httputil"
         "net/url"
         "os"
+        "os/signal"
+        "runtime"
         "strconv"
         "strings"
         "sync"
+        "sync/atomic"
+        "syscall"
         "time"
 )
 
 // Route represents an API route configuration
 type Route struct {
-        ID           int      `json:"id"`
-        Path         string   `json:"path"`
-        Target       string   `json:"target"`
-        Methods      []string `json:"methods"`
-        RateLimit    int      `json:"rateLimit"`
-        Timeout      int      `json:"timeout"`
-        AuthRequired bool     `json:"authRequired"`
-        Active       bool     `json:"active"`
+        ID           int       `json:"id"`
+        Path         string    `json:"path"`
+        Target       string    `json:"target"`
+        Methods      []string  `json:"methods"`
+        RateLimit    RateLimit `json:"rateLimit"`
+        Timeout      int       `json:"timeout"`
+        AuthRequired bool      `json:"authRequired"`
+        Active       bool      `json:"active"`
+
+        AllowCountries []string `json:"allowCountries,omitempty"`
+        DenyCountries  []string `json:"denyCountries,omitempty"`
+        BotAction      string   `json:"botAction,omitempty"`
+        RateLimitKey   string   `json:"rateLimitKey,omitempty"`
+        UpstreamProxy  string   `json:"upstreamProxy,omitempty"`
+
+        // Static routes serve files from a local directory instead of proxying
+        Type        string `json:"type,omitempty"`
+        StaticDir   string `json:"staticDir,omitempty"`
+        StaticIndex string `json:"staticIndex,omitempty"`
+        SPAFallback bool   `json:"spaFallback,omitempty"`
+        CacheMaxAge int    `json:"cacheMaxAge,omitempty"`
+
+        // Aggregate routes merge responses from several upstreams
+        Aggregate *AggregateConfig `json:"aggregate,omitempty"`
+
+        // Pipeline routes call upstreams in sequence
+        Pipeline *PipelineConfig `json:"pipeline,omitempty"`
+
+        // Request body inspection
+        BodyLogging   *BodyLoggingConfig   `json:"bodyLogging,omitempty"`
+        XMLValidation *XMLValidationConfig `json:"xmlValidation,omitempty"`
+
+        // DisableUpgrades forwards upgrade requests (e.g. WebSocket) as plain HTTP
+        DisableUpgrades bool `json:"disableUpgrades,omitempty"`
+
+        // AllowMethodOverride honors X-HTTP-Method-Override on POST requests
+        AllowMethodOverride bool `json:"allowMethodOverride,omitempty"`
+
+        // Timeouts refines Timeout into header, total and idle-stream limits
+        Timeouts *RouteTimeouts `json:"timeouts,omitempty"`
+
+        // Buffering controls request body buffering, retries and header limits
+        Buffering *BufferingConfig `json:"buffering,omitempty"`
+
+        // Fallback answers requests when the target is down or failing
+        Fallback *FallbackConfig `json:"fallback,omitempty"`
+
+        // CircuitBreaker holds requests back from a failing target
+        CircuitBreaker *CircuitBreakerConfig `json:"circuitBreaker,omitempty"`
+
+        // RequestCompression gzips or decodes request bodies for the upstream
+        RequestCompression *RequestCompressionConfig `json:"requestCompression,omitempty"`
+
+        // Options answers OPTIONS and CORS preflight requests, whether or
+        // not OPTIONS is among Methods
+        Options *OptionsConfig `json:"options,omitempty"`
+
+        // EnabledPercent soft-launches the route to a share of clients,
+        // chosen by LaunchKey (ip, header:<name> or claim:<name>); the rest
+        // get 404. Unset serves everyone.
+        EnabledPercent *int   `json:"enabledPercent,omitempty"`
+        LaunchKey      string `json:"launchKey,omitempty"`
+
+        // Experiment buckets clients into A/B variants, each optionally
+        // served by its own target
+        Experiment *ExperimentConfig `json:"experiment,omitempty"`
+
+        // Smoothing paces requests to the upstream, queueing bursts
+        // instead of rejecting them
+        Smoothing *SmoothingConfig `json:"smoothing,omitempty"`
+
+        // Consumes lists the request body media types accepted (type/*
+        // and */* ranges allowed); others get 415. Upstream responses
+        // outside Produces are logged, or failed with 502 when
+        // EnforceProduces is set.
+        Consumes        []string `json:"consumes,omitempty"`
+        Produces        []string `json:"produces,omitempty"`
+        EnforceProduces bool     `json:"enforceProduces,omitempty"`
+
+        // ResponseLimit caps upstream response bodies
+        ResponseLimit *ResponseLimitConfig `json:"responseLimit,omitempty"`
+
+        // Deprecation marks the route deprecated, announcing its sunset to
+        // clients and tracking who still uses it
+        Deprecation *DeprecationConfig `json:"deprecation,omitempty"`
+
+        // Versioning sends each API version of the route to its own target
+        Versioning *VersioningConfig `json:"versioning,omitempty"`
+
+        // Tags group routes, e.g. into API plans credentials are entitled to
+        Tags []string `json:"tags,omitempty"`
+
+        // Owner, Team and Description say whom to page when the route
+        // misbehaves; owner and team label its stats and alerts
+        Owner       string `json:"owner,omitempty"`
+        Team        string `json:"team,omitempty"`
+        Description string `json:"description,omitempty"`
+
+        // Authorization requires scopes or claims of the bearer token
+        Authorization *AuthorizationConfig `json:"authorization,omitempty"`
+
+        // BasicAuth checks usernames and passwords against htpasswd or LDAP
+        BasicAuth *BasicAuthConfig `json:"basicAuth,omitempty"`
+
+        // Session issues a gateway session cookie after an upstream login
+        Session *SessionConfig `json:"session,omitempty"`
+
+        // CSRF requires a double-submit token on state-changing requests
+        CSRF *CSRFConfig `json:"csrf,omitempty"`
+
+        // BruteForce locks out clients after repeated failed logins
+        BruteForce *BruteForceConfig `json:"bruteForce,omitempty"`
+
+        // Signing signs requests to the target with SigV4 or HMAC
+        Signing *SigningConfig `json:"signing,omitempty"`
+
+        // ResponseHeaders strips upstream headers on top of the global filter
+        ResponseHeaders *HeaderFilterConfig `json:"responseHeaders,omitempty"`
+
+        // Cookies rewrites, hardens or encrypts cookies the upstream sets
+        Cookies *CookiePolicy `json:"cookies,omitempty"`
+
+        // Rewrite changes the forwarded path and query
+        Rewrite *RewriteConfig `json:"rewrite,omitempty"`
+
+        // Forwarded overrides the global X-Forwarded-*, Forwarded and Via handling
+        Forwarded *ForwardedConfig `json:"forwarded,omitempty"`
+
+        // Flags let feature flags enable the route and pick its target or rewrite
+        Flags *RouteFlags `json:"flags,omitempty"`
+
+        // Webhook verifies signed third-party webhooks and drops replays
+        Webhook *WebhookConfig `json:"webhook,omitempty"`
+
+        // Concurrency caps requests in flight upstream, queueing short bursts
+        Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+
+        // Sampling overrides the global access log, trace and capture rates
+        Sampling *SamplingConfig `json:"sampling,omitempty"`
+
+        // Template names an entry of routeTemplates that fills the
+        // settings the route leaves unset
+        Template string `json:"template,omitempty"`
+
+        // Debug reports the route, target and middleware decisions in
+        // response headers to every client
+        Debug bool `json:"debug,omitempty"`
+
+        // Targets balances requests across a pool of upstreams by weight;
+        // Target is then the first of them
+        Targets []WeightedTarget `json:"targets,omitempty"`
+
+        source string // the included file, Kubernetes object or xDS route configuration defining the route; empty for the config file
 }
 
-// Config represents the gateway configuration
+// Config represents the gateway configuration: its settings and the
+// routes, which change under the routes lock. Requests read the settings
+// through settings(), which a swap never writes to.
 type Config struct {
-        Port             int     `json:"port"`
-        LogLevel         string  `json:"logLevel"`
-        LogFile          string  `json:"logFile"`
-        EnableRateLimit  bool    `json:"enableRateLimit"`
-        DefaultRateLimit int     `json:"defaultRateLimit"`
-        DefaultTimeout   int     `json:"defaultTimeout"`
-        Routes           []Route `json:"routes"`
+        ConfigSettings
+        Routes []Route `json:"routes"`
+
+        routesMutex sync.RWMutex
+        nextRouteID int
+        published   atomic.Pointer[ConfigSettings] // the settings as last swapped in
+        syncedAt    atomic.Int64                   // when the file was last loaded or saved, in Unix nanoseconds
+}
+
+// ConfigSettings is every setting of the configuration but the routes.
+// It holds no lock, so it can be copied and swapped whole.
+type ConfigSettings struct {
+        SchemaVersion    int                `json:"schemaVersion"`
+        Port             int                `json:"port"`
+        LogLevel         string             `json:"logLevel"`
+        LogFile          string             `json:"logFile"`
+        TenantKey        string             `json:"tenantKey,omitempty"`
+        PIDFile          string             `json:"pidFile,omitempty"`
+        EnableRateLimit  bool               `json:"enableRateLimit"`
+        DefaultRateLimit RateLimit          `json:"defaultRateLimit"`
+        GatewayRateLimit GatewayLimitConfig `json:"gatewayRateLimit"`
+        DefaultTimeout   int                `json:"defaultTimeout"`
+        Events           EventsConfig       `json:"events"`
+        Sync             SyncConfig         `json:"sync"`
+        Leader           LeaderConfig       `json:"leader"`
+        Kubernetes       KubernetesConfig   `json:"kubernetes"`
+        XDS              XDSConfig          `json:"xds"`
+        Reload           ReloadConfig       `json:"reload"`
+        Scaling          ScalingConfig      `json:"scaling"`
+        WarmCache        WarmCacheConfig    `json:"warmCache"`
+        GeoIP            GeoIPConfig        `json:"geoip"`
+        BotDetection     BotConfig          `json:"botDetection"`
+        Server           ServerConfig       `json:"server"`
+        UpstreamProxy    EgressProxyConfig  `json:"upstreamProxy"`
+        Admin            AdminConfig        `json:"admin"`
+        JWT              JWTConfig          `json:"jwt"`
+        Dashboard        DashboardConfig    `json:"dashboard"`
+        HealthCheck      HealthCheckConfig  `json:"healthCheck"`
+        Storage          StorageConfig      `json:"storage"`
+        Buffering        BufferPoolConfig   `json:"buffering"`
+        Recording        RecordingConfig    `json:"recording"`
+        ResponseHeaders  HeaderFilterConfig `json:"responseHeaders"`
+        Forwarded        ForwardedConfig    `json:"forwarded"`
+        Readiness        ReadinessConfig    `json:"readiness"`
+        FeatureFlags     FeatureFlagsConfig `json:"featureFlags"`
+        Sampling         SamplingConfig     `json:"sampling"`
+        Alerts           AlertsConfig       `json:"alerts"`
+        Analytics        AnalyticsConfig    `json:"analytics"`
+        Latency          LatencyConfig      `json:"latency"`
+        Tracing          TracingConfig      `json:"tracing"`
+        RouteTemplates   map[string]Route   `json:"routeTemplates,omitempty"`
+        CatchAll         CatchAllConfig     `json:"catchAll"`
+        Debug            DebugConfig        `json:"debug"`
+        TargetWeights    map[string]int     `json:"targetWeights,omitempty"` // runtime weights of pooled targets by host:port
+        Include          []string           `json:"include,omitempty"`       // route files, as glob patterns relative to the config file
 
         configFilePath string
-        routesMutex    sync.RWMutex
-        nextRouteID    int
+        overrides      []configOverride
+        fileValues     map[string]json.RawMessage
+}
+
+// configSnapshot is a config's settings with a route list, marshalled as
+// the Config is
+type configSnapshot struct {
+        ConfigSettings
+        Routes []Route `json:"routes"`
 }
 
 // Service represents a backend service
 type Service struct {
-        Name      string    `json:"name"`
-        URL       string    `json:"url"`
-        Status    string    `json:"status"`
-        LastCheck time.Time `json:"lastCheck"`
+        Name      string      `json:"name"`
+        URL       string      `json:"url"`
+        Status    string      `json:"status"`
+        LastCheck time.Time   `json:"lastCheck"`
+        WarmUntil *time.Time  `json:"warmUntil,omitempty"` // traffic ramps up until then after turning healthy
+        InFlight  int64       `json:"inFlight"`            // requests in progress
+        Drain     *DrainState `json:"drain,omitempty"`     // set while no new requests are sent
+
+        // Flapping services are held unhealthy until HoldDownUntil
+        Flapping      bool       `json:"flapping,omitempty"`
+        HoldDownUntil *time.Time `json:"holdDownUntil,omitempty"`
+
+        checking  bool
+        successes int
+        failures  int
+        nextCheck time.Time
+        rampUp    bool
+        warmFrom  time.Time
+        history   []HealthTransition
 }
 
 // Stats represents gateway statistics
 type Stats struct {
-        TotalRequests      int64                `json:"totalRequests"`
-        RequestsPerSecond  float64              `json:"requestsPerSecond"`
-        AvgResponseTime    float64              `json:"avgResponseTime"`
-        ErrorRate          float64              `json:"errorRate"`
-        ActiveConnections  int                  `json:"activeConnections"`
-        Uptime             int64                `json:"uptime"`
-        RouteStats         map[string]RouteStat `json:"routeStats"`
+        TotalRequests      int64                             `json:"totalRequests"`
+        RequestsPerSecond  float64                           `json:"requestsPerSecond"`
+        RPS1s              float64                           `json:"rps1s"`
+        RPS10s             float64                           `json:"rps10s"`
+        RPS1m              float64                           `json:"rps1m"`
+        AvgResponseTime    float64                           `json:"avgResponseTime"`
+        Latency            LatencyHistogram                  `json:"latency"` // request latencies across routes
+        ErrorRate          float64                           `json:"errorRate"`
+        ErrorRate1m        float64                           `json:"errorRate1m"`
+        ErrorRate5m        float64                           `json:"errorRate5m"`
+        TotalErrors        int64                             `json:"totalErrors"`
+        ActiveConnections  int                               `json:"activeConnections"`
+        Uptime             int64                             `json:"uptime"`
+        RouteStats         map[string]RouteStat              `json:"routeStats"`
+        Countries          map[string]int64                  `json:"countries"`
+        BotDetections      map[string]int64                  `json:"botDetections"`
+        Upgrades           UpgradeStats                      `json:"upgrades"`
+        ErrorTypes         map[string]int64                  `json:"errorTypes"`
+        Experiments        map[string]map[string]VariantStat `json:"experiments"`
+        ClientAborts       int64                             `json:"clientAborts"` // requests abandoned by their clients
+        Deprecations       map[string]DeprecationStat        `json:"deprecations"` // use of deprecated routes by path
+        APIVersions        map[string]map[string]VersionStat `json:"apiVersions"`  // requests per API version by route path
+        Webhooks           map[string]WebhookStat            `json:"webhooks"`     // webhook deliveries by route path
+        Traces             TraceStats                        `json:"traces"`       // the gateway's spans by outcome
+        Targets            map[string]TargetStat             `json:"targets"`      // requests per pooled target by host:port
+        Throttled          map[string]int64                  `json:"throttled"`    // requests refused by the gateway and listener rate limits, by scope
+        Since              time.Time                         `json:"since"`        // start of the counters, at startup or the last reset
 }
 
 // RouteStat represents statistics for a specific route
 type RouteStat struct {
-        Requests   int64   `json:"requests"`
-        Errors     int64   `json:"errors"`
-        AvgLatency float64 `json:"avgLatency"`
+        Requests           int64            `json:"requests"`
+        Errors             int64            `json:"errors"`             // 5xx responses from any source
+        ClientErrors       int64            `json:"clientErrors"`       // 4xx responses
+        UpstreamErrors     int64            `json:"upstreamErrors"`     // 5xx returned by the upstream
+        GatewayErrors      int64            `json:"gatewayErrors"`      // 5xx produced by the gateway itself
+        Fallbacks          int64            `json:"fallbacks"`          // requests answered by the route's fallback
+        Preflights         int64            `json:"preflights"`         // CORS preflights on routes with options settings
+        Smoothed           int64            `json:"smoothed"`           // requests delayed by smoothing
+        SmoothingRejected  int64            `json:"smoothingRejected"`  // requests rejected with the smoothing queue full
+        Queued             int64            `json:"queued"`             // requests that waited for a concurrency slot
+        QueueRejected      int64            `json:"queueRejected"`      // requests turned away at the concurrency limit
+        ClientAborts       int64            `json:"clientAborts"`       // requests abandoned by their clients
+        OversizedResponses int64            `json:"oversizedResponses"` // upstream responses over the route's size limit
+        AuthFailures       int64            `json:"authFailures"`       // failed logins on routes with brute-force protection
+        AuthLockouts       int64            `json:"authLockouts"`       // lockouts of an IP or account
+        DialTimeouts       int64            `json:"dialTimeouts"`       // upstream connections not established in time
+        HeaderTimeouts     int64            `json:"headerTimeouts"`     // upstream response headers not received in time
+        BodyTimeouts       int64            `json:"bodyTimeouts"`       // upstream response bodies that stalled or ran past the total timeout
+        AvgLatency         float64          `json:"avgLatency"`
+        Latency            LatencyHistogram `json:"latency"`
+
+        RouteOwner // the route's owner and team, when set
 }
 
 // Proxy handles the proxying of requests to backend services
@@ -74,19 +339,37 @@ type Proxy struct {
         stats          Stats
         services       map[string]*Service
         statsMutex     sync.RWMutex
+        window         rollingWindow
         servicesMutex  sync.RWMutex
         startTime      time.Time
         activeRequests int32
         reqMutex       sync.RWMutex
+
+        transports      map[int]*http.Transport
+        transportsMutex sync.Mutex
 }
 
 // RateLimiter implements a token bucket rate limiter
 type RateLimiter struct {
         config      *Config
-        buckets     map[string]*TokenBucket
-        bucketMutex sync.RWMutex
+        buckets     map[string]*list.Element // of *rateLimitEntry
+        order       *list.List               // front is most recently used
+        bucketMutex sync.Mutex
+}
+
+// rateLimitEntry is a bucket and the key it is kept under
+type rateLimitEntry struct {
+        key    string
+        bucket *TokenBucket
 }
 
+// maxRateLimitBuckets caps the live buckets. Past it, the least recently
+// used bucket is dropped, and its client starts again with a full one.
+const maxRateLimitBuckets = 100000
+
+// rateLimitIdleTTL is how long an unused bucket is kept
+const rateLimitIdleTTL = 10 * time.Minute
+
 // TokenBucket represents a token bucket for rate limiting
 type TokenBucket struct {
         tokens         float64
@@ -99,71 +382,317 @@ type TokenBucket struct {
 const (
         defaultConfigPath = "config.json"
         defaultPort       = 8000
-        apiPrefix         = "/api"
+        apiPrefix         = "/api" // default admin API prefix
+
+        // Health checks run concurrently on at most this many services
+        healthCheckWorkers = 8
+
+        // On-demand health checks reuse results younger than this
+        onDemandCheckInterval = 5 * time.Second
 )
 
 var (
         config      *Config
         proxy       *Proxy
         rateLimiter *RateLimiter
+        events      *EventBus
+        geoIP       *GeoIP
+        botDetector atomic.Pointer[BotDetector] // swapped when a reload changes bot settings
+        connLimiter *connLimitListener
+        store       Store
+        fileCrypto  *fileCipher
+
+        routeChanges = &routeWatchers{}
+        activeConfig = &activeConfigState{}
 )
 
 func main() {
-        // Load configuration
-        var err error
-        configPath := defaultConfigPath
-        if len(os.Args) > 1 {
-                configPath = os.Args[1]
+        // Check or migrate the config for this binary
+        if len(os.Args) > 1 && os.Args[1] == "upgrade" {
+                os.Exit(runUpgrade(os.Args[2:]))
         }
 
-        config, err = loadConfig(configPath)
+        // Parse flags and environment overrides
+        opts, err := parseOptions(os.Args[1:])
+        if err == flag.ErrHelp {
+                os.Exit(0)
+        }
+        if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                os.Exit(2)
+        }
+
+        // Load the key for files encrypted at rest
+        fileCrypto, err = loadFileCipher()
+        if err != nil {
+                log.Fatalf("Failed to load encryption key: %v", err)
+        }
+
+        // Check the config without creating or rewriting it
+        if opts.validate {
+                if _, err := os.Stat(opts.configPath); err != nil {
+                        fmt.Fprintln(os.Stderr, err)
+                        os.Exit(1)
+                }
+                if _, err := loadConfig(opts.configPath, opts.overrides); err != nil {
+                        fmt.Fprintln(os.Stderr, err)
+                        os.Exit(1)
+                }
+                fmt.Printf("%s: configuration is valid\n", opts.configPath)
+                return
+        }
+
+        // Load configuration
+        config, err = loadConfig(opts.configPath, opts.overrides)
         if err != nil {
                 log.Fatalf("Failed to load config: %v", err)
         }
 
+        // Encrypt a plaintext config once a key is configured
+        if raw, err := ioutil.ReadFile(opts.configPath); err == nil && fileCrypto != nil && !isEncrypted(raw) {
+                log.Printf("Encrypting %s", opts.configPath)
+                if err := config.save(); err != nil {
+                        log.Fatalf("Failed to encrypt config: %v", err)
+                }
+        }
+
         // Configure logging
         config.configureLogging()
+        traffic.configure(config.settings().Recording)
+
+        // Open the store and load the persisted routes
+        store, err = newStore(config.settings().Storage, config)
+        if err != nil {
+                log.Fatalf("Failed to open storage: %v", err)
+        }
+        defer store.Close()
+        if err := config.loadRoutesFrom(store); err != nil {
+                log.Fatalf("Failed to load routes from storage: %v", err)
+        }
+
+        // Set up event publishing
+        events, err = newEventBus(config.settings().Events)
+        if err != nil {
+                log.Fatalf("Failed to set up event publishing: %v", err)
+        }
+        defer events.close()
+
+        // Load GeoIP databases
+        geoIP, err = newGeoIP(config.settings().GeoIP)
+        if err != nil {
+                log.Fatalf("Failed to load GeoIP databases: %v", err)
+        }
+
+        // Scope background work to the gateway's lifetime
+        var stopWork context.CancelFunc
+        backgroundCtx, stopWork = context.WithCancel(context.Background())
+
+        // Set up bot detection
+        botDetector.Store(newBotDetector(backgroundCtx, config.settings().BotDetection))
 
         // Set up the proxy
         proxy = newProxy(config)
 
+        // Start background service health checks
+        proxy.startHealthChecks(backgroundCtx)
+
+        // Hold traffic back until critical upstreams are healthy
+        readiness.start(config.settings().Readiness, proxy)
+
+        // Poll the feature flag provider
+        featureFlags.start(backgroundCtx, config.settings().FeatureFlags)
+
+        // Export the gateway's spans to the trace collector
+        tracer.start(backgroundCtx, config.settings().Tracing)
+
+        // Evaluate alert rules over the gateway's own metrics
+        alerts.start(backgroundCtx, proxy)
+
         // Set up rate limiter
-        rateLimiter = newRateLimiter(config)
+        rateLimiter = newRateLimiter(backgroundCtx, config)
+
+        // Keep a history of the headline stats
+        proxy.recordHistory(backgroundCtx, store, config.settings().Storage)
+
+        // Load the responses cached before the last shutdown
+        loadWarmCache(config.settings().WarmCache)
+
+        // Reconcile state derived from routes when they change
+        routeChanges.subscribe(proxy.routeChanged)
+        routeChanges.subscribe(rateLimiter.routeChanged)
+        routeChanges.subscribe(proxy.syncServices)
+        routeChanges.subscribe(activeConfig.routeChanged)
+        routeChanges.subscribe(staleResponses.routeChanged)
+        routeChanges.subscribe(upstreamEncodings.routeChanged)
+        routeChanges.subscribe(routeLookups.routeChanged)
+        routeChanges.subscribe(requestPacers.routeChanged)
+        routeChanges.subscribe(routeLimiters.routeChanged)
+        routeChanges.subscribe(circuits.routeChanged)
+        routeChanges.subscribe(watches.routeChanged)
+
+        // Share route changes with the other replicas
+        syncer, err := newReplicaSync(backgroundCtx, config.settings().Sync)
+        if err != nil {
+                log.Fatalf("Failed to set up replica sync: %v", err)
+        }
+        replicas.Store(syncer)
+        routeChanges.subscribe(func(change RouteChange) { replicas.Load().routeChanged(change) })
 
-        // Register handlers
-        http.HandleFunc(apiPrefix+"/routes", handleRoutes)
-        http.HandleFunc(apiPrefix+"/routes/", handleRoute)
-        http.HandleFunc(apiPrefix+"/stats", handleStats)
-        http.HandleFunc(apiPrefix+"/services", handleServices)
-        http.HandleFunc(apiPrefix+"/health", handleHealth)
-        http.HandleFunc(apiPrefix+"/config", handleConfig)
+        // Elect the replica that runs singleton background tasks
+        election, err := newLeaderElection(backgroundCtx, config.settings().Leader, config.settings().Sync.ReplicaID, proxy)
+        if err != nil {
+                log.Fatalf("Failed to set up leader election: %v", err)
+        }
+        leadership.Store(election)
 
-        // Default handler for proxying requests
-        http.HandleFunc("/", handleProxyRequest)
+        // Keep routes for the cluster's Ingress or HTTPRoute objects
+        controller, err := newKubeController(backgroundCtx, config.settings().Kubernetes)
+        if err != nil {
+                log.Fatalf("Failed to set up the Kubernetes controller: %v", err)
+        }
+        kube.Store(controller)
+
+        // Keep routes for an xDS management server's route configurations
+        client, err := newXDSClient(backgroundCtx, config.settings().XDS)
+        if err != nil {
+                log.Fatalf("Failed to set up the xDS client: %v", err)
+        }
+        xds.Store(client)
 
-        // Start server
-        port := config.Port
+        // Resolve listener ports. The admin API and dashboard get their own
+        // listener when an admin port other than the proxy port is set.
+        port := config.settings().Port
         if port == 0 {
                 port = defaultPort
         }
+        mux := http.NewServeMux()
+        adminMux := mux
+        adminPort := config.settings().Admin.Port
+        if adminPort != 0 && adminPort != port {
+                adminMux = http.NewServeMux()
+        }
+
+        // Register handlers
+        registerAdminAPI(adminMux, config.settings().Admin.prefix())
+        priorityPaths := adminPaths(config.settings().Admin.prefix())
+
+        // Serve the embedded dashboard
+        if config.settings().Dashboard.Enabled {
+                dashboardPath := dashboardMountPath(config.settings().Dashboard)
+                priorityPaths = append(priorityPaths, dashboardPath)
+                if !config.settings().Admin.adminAuthConfigured() {
+                        log.Printf("Warning: dashboard is served at %s without admin credentials", dashboardPath)
+                }
+                adminMux.Handle(dashboardPath+"/", dashboardHandler(dashboardPath))
+                adminMux.Handle(dashboardPath, http.RedirectHandler(dashboardPath+"/", http.StatusMovedPermanently))
+        }
+
+        // Serve the control plane over gRPC beside the admin API
+        if config.settings().Admin.GRPC {
+                priorityPaths = append(priorityPaths, grpcPath)
+                adminMux.Handle(grpcPath+"/", requireAdmin(http.HandlerFunc(handleGRPC)))
+        }
+
+        // Default handler for proxying requests
+        mux.HandleFunc("/", handleProxyRequest)
+
+        // Start server, on the socket passed by systemd or a parent process
+        // if there is one
+        if err := inherited.load(); err != nil {
+                log.Fatalf("Failed to inherit listeners: %v", err)
+        }
+        listener, err := listen(listenerProxy, port)
+        if err != nil {
+                log.Fatalf("Failed to start server: %v", err)
+        }
+        connLimiter = newConnLimitListener(listener, config.settings().Server.MaxConns, config.settings().Server.MaxConnsPerIP)
+
+        // A shared listener serves admin requests in the priority lane
+        handler := gatewayRateLimitHandler(listenerProxy, mux)
+        if adminMux == mux {
+                handler = laneHandler(priorityPaths, gatewayRateLimitHandler(listenerAdmin, mux), handler)
+                warnSharedLane(config.settings().Server)
+        }
+        server := newHTTPServer(config.settings().Server, handler)
+        if config.settings().Admin.GRPC && adminMux == mux {
+                enableGRPC(server)
+        }
+
+        listeners := []string{"proxy=" + listener.Addr().String()}
+
+        // Start the admin server on its own port
+        var adminServer *http.Server
+        if adminMux != mux {
+                adminListener, err := listen(listenerAdmin, adminPort)
+                if err != nil {
+                        log.Fatalf("Failed to start admin server: %v", err)
+                }
+                listeners = append(listeners, "admin="+adminListener.Addr().String())
+                adminServer = newHTTPServer(config.settings().Server, gatewayRateLimitHandler(listenerAdmin, adminMux))
+                if config.settings().Admin.GRPC {
+                        enableGRPC(adminServer)
+                }
+                go func() {
+                        log.Printf("Starting admin API on port %d", adminPort)
+                        if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+                                log.Fatalf("Admin server failed: %v", err)
+                        }
+                }()
+        }
+
+        inherited.close()
+
+        // Record the PID, reopen logs on SIGUSR1 and reload the config
+        // file on SIGHUP or, when watched, as it changes
+        if err := writePIDFile(config.settings().PIDFile); err != nil {
+                log.Fatalf("Failed to write PID file: %v", err)
+        }
+        defer removePIDFile(config.settings().PIDFile)
+        handleReopenSignal()
+        handleReloadSignal()
+        startConfigWatch(backgroundCtx, config)
+
+        // Shut down cleanly on SIGINT/SIGTERM
+        ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+        defer stop()
+        go func() {
+                <-ctx.Done()
+                log.Printf("Shutting down API Gateway")
+                shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+                defer cancel()
+                if adminServer != nil {
+                        adminServer.Shutdown(shutdownCtx)
+                }
+                server.Shutdown(shutdownCtx)
+        }()
 
+        activeConfig.load(config, listeners, "loaded")
         log.Printf("Starting API Gateway on port %d", port)
-        if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+        go warmFromURLs(config.settings().WarmCache, listener.Addr())
+        if err := server.Serve(connLimiter); err != nil && err != http.ErrServerClosed {
                 log.Fatalf("Failed to start server: %v", err)
         }
+
+        stopBackground(stopWork)
+        saveWarmCache(config.settings().WarmCache)
 }
 
-// loadConfig loads configuration from a file
-func loadConfig(configPath string) (*Config, error) {
-        // Default config
-        config := &Config{
+// defaultConfig returns the settings used where the config file is silent
+func defaultConfig(configPath string) *Config {
+        return &Config{ConfigSettings: ConfigSettings{
+                SchemaVersion:    configSchemaVersion,
                 Port:             8000,
                 LogLevel:         "info",
                 EnableRateLimit:  true,
-                DefaultRateLimit: 100,
+                DefaultRateLimit: rateLimitPerMinute(100),
                 DefaultTimeout:   30,
                 configFilePath:   configPath,
-        }
+        }}
+}
+
+// loadConfig loads configuration from a file and applies overrides
+func loadConfig(configPath string, overrides []configOverride) (*Config, error) {
+        config := defaultConfig(configPath)
 
         // Check if config file exists
         if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -174,7 +703,7 @@ func loadConfig(configPath string) (*Config, error) {
                                 Path:         "/api/users",
                                 Target:       "http://user-service:8080",
                                 Methods:      []string{"GET", "POST", "PUT", "DELETE"},
-                                RateLimit:    100,
+                                RateLimit:    rateLimitPerMinute(100),
                                 Timeout:      30,
                                 AuthRequired: true,
                                 Active:       true,
@@ -184,7 +713,7 @@ func loadConfig(configPath string) (*Config, error) {
                                 Path:         "/api/products",
                                 Target:       "http://product-service:8080",
                                 Methods:      []string{"GET", "POST", "PUT", "DELETE"},
-                                RateLimit:    50,
+                                RateLimit:    rateLimitPerMinute(50),
                                 Timeout:      30,
                                 AuthRequired: true,
                                 Active:       true,
@@ -194,7 +723,7 @@ func loadConfig(configPath string) (*Config, error) {
                                 Path:         "/api/auth",
                                 Target:       "http://auth-service:8080",
                                 Methods:      []string{"POST"},
-                                RateLimit:    20,
+                                RateLimit:    rateLimitPerMinute(20),
                                 Timeout:      10,
                                 AuthRequired: false,
                                 Active:       true,
@@ -204,53 +733,79 @@ func loadConfig(configPath string) (*Config, error) {
                                 Path:         "/public",
                                 Target:       "http://static-service:8080",
                                 Methods:      []string{"GET"},
-                                RateLimit:    500,
+                                RateLimit:    rateLimitPerMinute(500),
                                 Timeout:      5,
                                 AuthRequired: false,
                                 Active:       true,
                         },
                 }
                 config.nextRouteID = 5
+                if err := config.applyOverrides(overrides); err != nil {
+                        return nil, err
+                }
 
                 // Save default config
                 if err := config.save(); err != nil {
                         return nil, err
                 }
+                config.publishSettings()
 
                 return config, nil
         }
 
-        // Read config file
-        data, err := ioutil.ReadFile(configPath)
+        // Read config file, decrypting it if needed
+        raw, err := ioutil.ReadFile(configPath)
         if err != nil {
                 return nil, err
         }
-
-        // Parse config
-        if err := json.Unmarshal(data, config); err != nil {
+        data, err := fileCrypto.open(configPath, raw)
+        if err != nil {
                 return nil, err
         }
 
-        // Set next route ID
-        config.nextRouteID = 1
-        for _, route := range config.Routes {
-                if route.ID >= config.nextRouteID {
-                        config.nextRouteID = route.ID + 1
-                }
+        // Bring a config written by an older version up to date
+        data, version, migrations, err := migrateConfig(data)
+        if err != nil {
+                return nil, fmt.Errorf("%s: %v", configPath, err)
+        }
+        if len(migrations) > 0 {
+                log.Printf("%s uses config schema version %d; run \"gateway upgrade --migrate\" to update it to %d", configPath, version, configSchemaVersion)
         }
 
+        // Parse and validate config
+        if err := decodeConfig(configPath, data, config); err != nil {
+                return nil, err
+        }
+        if err := config.loadIncludes(); err != nil {
+                return nil, err
+        }
+        if err := config.applyOverrides(overrides); err != nil {
+                return nil, err
+        }
+        if err := config.validate(); err != nil {
+                return nil, fmt.Errorf("%s: invalid configuration:\n  %s", configPath, strings.Replace(err.Error(), "; ", "\n  ", -1))
+        }
+
+        // The file and environment are the only sources of secret commands
+        trustSecretCommands(config)
+
+        // Set next route ID and normalize method lists
+        config.setRoutes(config.Routes)
+        warnRouteConflicts(config.Routes)
+        config.syncedAt.Store(time.Now().UnixNano())
+        config.publishSettings()
+
         return config, nil
 }
 
 // configureLogging configures logging based on config settings
 func (c *Config) configureLogging() {
-        if c.LogFile != "" {
-                file, err := os.OpenFile(c.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-                if err != nil {
-                        log.Printf("Failed to open log file %s: %v", c.LogFile, err)
+        settings := c.settings()
+        if settings.LogFile != "" {
+                if err := openLogFile(settings.LogFile); err != nil {
+                        log.Printf("Failed to open log file %s: %v", settings.LogFile, err)
                         return
                 }
-                log.SetOutput(file)
         }
 
         // Set log flags
@@ -259,11 +814,21 @@ func (c *Config) configureLogging() {
 
 // save saves the configuration to the config file
 func (c *Config) save() error {
-        data, err := json.MarshalIndent(c, "", "  ")
+        settings := c.settings()
+        data, err := c.fileJSON()
         if err != nil {
                 return err
         }
-        return ioutil.WriteFile(c.configFilePath, data, 0644)
+        // Replace the file in one step so a crash never leaves half a config
+        tmp := settings.configFilePath + ".tmp"
+        if err := fileCrypto.writeFile(tmp, data, 0644); err != nil {
+                return err
+        }
+        if err := os.Rename(tmp, settings.configFilePath); err != nil {
+                return err
+        }
+        c.syncedAt.Store(time.Now().UnixNano())
+        return nil
 }
 
 // getRoutes returns all routes
@@ -290,6 +855,64 @@ func (c *Config) getRoute(id int) (Route, bool) {
         return Route{}, false
 }
 
+// setRoutes replaces all routes, normalizing their methods and advancing
+// the next route ID past them
+func (c *Config) setRoutes(routes []Route) {
+        c.routesMutex.Lock()
+        defer c.routesMutex.Unlock()
+        c.storeRoutes(routes, 1)
+}
+
+// settings returns a snapshot of the settings that stays unchanged when
+// new ones are swapped in. Configs never swapped return their own.
+func (c *Config) settings() *ConfigSettings {
+        if settings := c.published.Load(); settings != nil {
+                return settings
+        }
+        return &c.ConfigSettings
+}
+
+// publishSettings makes a copy of the current settings the snapshot
+// settings() returns. The caller holds the routes lock, or is the only
+// user of c.
+func (c *Config) publishSettings() {
+        settings := c.ConfigSettings
+        c.published.Store(&settings)
+}
+
+// setSettings swaps in new settings, leaving the routes alone
+func (c *Config) setSettings(settings ConfigSettings) {
+        c.routesMutex.Lock()
+        c.ConfigSettings = settings
+        c.publishSettings()
+        c.routesMutex.Unlock()
+}
+
+// install swaps in new settings and routes in one step, so no request
+// sees the routes of one config with the settings of another
+func (c *Config) install(settings ConfigSettings, routes []Route, nextRouteID int) {
+        c.routesMutex.Lock()
+        defer c.routesMutex.Unlock()
+        c.ConfigSettings = settings
+        c.publishSettings()
+        c.storeRoutes(routes, nextRouteID)
+}
+
+// storeRoutes replaces all routes, normalizing their methods, and sets the
+// next route ID to nextRouteID or past the routes, whichever is higher.
+// The caller holds the routes lock.
+func (c *Config) storeRoutes(routes []Route, nextRouteID int) {
+        c.nextRouteID = max(nextRouteID, 1)
+        for i, route := range routes {
+                routes[i].Methods = normalizeMethods(route.Methods)
+                if route.ID >= c.nextRouteID {
+                        c.nextRouteID = route.ID + 1
+                }
+        }
+        c.Routes = routes
+        routeLookups.purge()
+}
+
 // addRoute adds a new route and returns its ID
 func (c *Config) addRoute(route Route) int {
         c.routesMutex.Lock()
@@ -301,22 +924,28 @@ func (c *Config) addRoute(route Route) int {
         return route.ID
 }
 
-// updateRoute updates an existing route
-func (c *Config) updateRoute(route Route) bool {
+// updateRoute updates an existing route and returns its previous definition
+func (c *Config) updateRoute(route Route) (Route, bool) {
         c.routesMutex.Lock()
         defer c.routesMutex.Unlock()
 
         for i, r := range c.Routes {
                 if r.ID == route.ID {
                         c.Routes[i] = route
-                        return true
+                        return r, true
                 }
         }
-        return false
+        return Route{}, false
+}
+
+// deleteRoute removes a route by ID and returns it
+func (c *Config) deleteRoute(id int) (Route, bool) {
+        route, _, found := c.takeRoute(id)
+        return route, found
 }
 
-// deleteRoute removes a route by ID
-func (c *Config) deleteRoute(id int) bool {
+// takeRoute removes a route by ID and returns it with its position
+func (c *Config) takeRoute(id int) (Route, int, bool) {
         c.routesMutex.Lock()
         defer c.routesMutex.Unlock()
 
@@ -324,10 +953,20 @@ func (c *Config) deleteRoute(id int) bool {
                 if route.ID == id {
                         // Remove route from slice
                         c.Routes = append(c.Routes[:i], c.Routes[i+1:]...)
-                        return true
+                        return route, i, true
                 }
         }
-        return false
+        return Route{}, 0, false
+}
+
+// restoreRoute puts a route taken by takeRoute back at its position, so
+// a deletion that could not be persisted is undone
+func (c *Config) restoreRoute(route Route, index int) {
+        c.routesMutex.Lock()
+        defer c.routesMutex.Unlock()
+
+        index = min(index, len(c.Routes))
+        c.Routes = append(c.Routes[:index], append([]Route{route}, c.Routes[index:]...)...)
 }
 
 // findRouteByPath finds a route that matches the given path and method
@@ -340,11 +979,11 @@ func (c *Config) findRouteByPath(path string, method string) (Route, bool) {
                         continue
                 }
 
-                // Check if path matches
-                if pathMatches(path, route.Path) {
+                // Check if path matches, directly or under a version prefix
+                if route.matchesPath(path) {
                         // Check if method is allowed
                         for _, m := range route.Methods {
-                                if m == "*" || m == method {
+                                if m == "*" || strings.EqualFold(m, method) {
                                         return route, true
                                 }
                         }
@@ -373,61 +1012,24 @@ func pathMatches(requestPath, routePath string) bool {
 // newProxy creates a new proxy with the given configuration
 func newProxy(config *Config) *Proxy {
         p := &Proxy{
-                config:    config,
-                services:  make(map[string]*Service),
-                startTime: time.Now(),
-                stats: Stats{
-                        RouteStats: make(map[string]RouteStat),
-                },
+                config:     config,
+                services:   make(map[string]*Service),
+                transports: make(map[int]*http.Transport),
+                startTime:  time.Now(),
+                stats:      newStats(),
         }
 
         // Initialize services from routes
         p.initServices()
 
-        // Start background service health check
-        go p.backgroundHealthCheck()
-
         return p
 }
 
 // initServices initializes the service map from route targets
 func (p *Proxy) initServices() {
-        p.servicesMutex.Lock()
-        defer p.servicesMutex.Unlock()
-
         // Find unique services from routes
         for _, route := range p.config.getRoutes() {
-                if route.Target == "" {
-                        continue
-                }
-
-                targetURL, err := url.Parse(route.Target)
-                if err != nil {
-                        log.Printf("Invalid target URL %s: %v", route.Target, err)
-                        continue
-                }
-
-                serviceName := targetURL.Hostname()
-                if _, exists := p.services[serviceName]; !exists {
-                        p.services[serviceName] = &Service{
-                                Name:   serviceName,
-                                URL:    route.Target,
-                                Status: "unknown",
-                        }
-                }
-        }
-}
-
-// backgroundHealthCheck periodically checks the health of backend services
-func (p *Proxy) backgroundHealthCheck() {
-        ticker := time.NewTicker(60 * time.Second)
-        defer ticker.Stop()
-
-        for {
-                select {
-                case <-ticker.C:
-                        p.checkHealth()
-                }
+                p.registerService(route, false)
         }
 }
 
@@ -447,7 +1049,56 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request, route Route
                 p.reqMutex.Unlock()
         }()
 
+        // Go straight to the fallback while the target is draining or
+        // unhealthy, and for part of the traffic while it warms up
+        if route.Fallback != nil {
+                reason := ""
+                if p.targetDraining(route) {
+                        reason = "target draining"
+                } else if p.primaryUnhealthy(route) {
+                        reason = "target unhealthy"
+                } else if p.divertWhileWarming(route) {
+                        reason = "target warming up"
+                }
+                if reason != "" {
+                        if status, upstream, ok := p.serveFallback(w, r, route, reason); ok {
+                                p.updateStats(route.Path, time.Since(startTime), status, upstream)
+                                return nil
+                        }
+                }
+        }
+
+        // Hold requests back while the route's circuit is open
+        circuitOutcome := circuitUnknown
+        if route.CircuitBreaker != nil {
+                allowed, wait := circuits.allow(route)
+                if !allowed {
+                        if route.Fallback != nil {
+                                if status, upstream, ok := p.serveFallback(w, r, route, "circuit open"); ok {
+                                        p.updateStats(route.Path, time.Since(startTime), status, upstream)
+                                        return nil
+                                }
+                        }
+                        w.Header().Set("Retry-After", retryAfterSeconds(wait))
+                        writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Circuit open for this route")
+                        p.updateStats(route.Path, time.Since(startTime), http.StatusServiceUnavailable, false)
+                        return nil
+                }
+                defer func() { circuits.record(route, circuitOutcome) }()
+        }
+
+        // Count the request against its target; draining targets take no new requests
+        release, ok := p.acquireTarget(route)
+        if !ok {
+                setErrorClass(r, ErrorClassDraining)
+                writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Target is draining")
+                p.updateStats(route.Path, time.Since(startTime), http.StatusServiceUnavailable, false)
+                return nil
+        }
+        defer release()
+
         // Create target URL
+        requestContext(r).setTarget(route.Target)
         target, err := url.Parse(route.Target)
         if err != nil {
                 return fmt.Errorf("invalid target URL: %v", err)
@@ -455,56 +1106,269 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request, route Route
 
         // Create reverse proxy
         proxy := httputil.NewSingleHostReverseProxy(target)
+        if route.Rewrite != nil {
+                director := proxy.Director
+                proxy.Director = func(req *http.Request) {
+                        route.Rewrite.apply(req, route)
+                        director(req)
+                }
+        }
 
-        // Set timeout if configured
-        timeout := route.Timeout
-        if timeout <= 0 {
-                timeout = p.config.DefaultTimeout
+        // Reuse the route's transport (timeout and egress proxy settings)
+        transport, err := p.transport(route)
+        if err != nil {
+                return err
         }
-        if timeout > 0 {
-                proxy.Transport = &http.Transport{
-                        ResponseHeaderTimeout: time.Duration(timeout) * time.Second,
-                }
+        proxy.Transport = transport
+        if route.Signing != nil {
+                proxy.Transport = &signingTransport{base: proxy.Transport, route: route}
+        }
+        forwarded := forwardedFor(route)
+        if !forwarded.isDefault() {
+                proxy.Transport = &forwardedTransport{base: proxy.Transport, headers: forwarded.outbound(r)}
+        }
+        if route.RequestCompression != nil && route.RequestCompression.Compress != "" {
+                proxy.Transport = &compressTransport{base: proxy.Transport, route: route}
+        }
+        if route.Buffering != nil && route.Buffering.Retries > 0 {
+                proxy.Transport = &retryTransport{base: proxy.Transport, retries: route.Buffering.Retries}
         }
 
-        // Handle proxy errors
+        // Count clients that leave while a response is streamed
+        origCtx := r.Context()
+        defer p.recoverClientAbort(origCtx, r, route.Path)
+
+        // Handle proxy errors; stats are recorded once ServeHTTP returns.
+        // Routes with a fallback answer from it after ServeHTTP instead.
+        gatewayStatus := 0
+        aborted := false
+        headersReceived := false
+        var primaryErr error
         proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+                // Nobody is waiting for an error or a fallback
+                if clientGone(origCtx) {
+                        aborted = true
+                        return
+                }
+                if timeoutErr := classifyTimeout(err, r.Context(), route, p.config.settings().DefaultTimeout, headersReceived); timeoutErr != nil {
+                        p.recordTimeout(route.Path, timeoutErr)
+                        err = timeoutErr
+                }
+                setErrorClass(r, classifyProxyError(err))
                 log.Printf("Proxy error: %v", err)
+                if route.Fallback != nil {
+                        primaryErr = err
+                        return
+                }
+                gatewayStatus = writeProxyError(w, r, err)
+        }
 
-                // Update error stats
-                p.updateStats(route.Path, time.Since(startTime), true)
+        // Restore cookie values encrypted at the edge
+        if route.Cookies != nil {
+                if err := decryptRequestCookies(r, route); err != nil {
+                        log.Printf("Cookie decryption for %s failed: %v", route.Path, err)
+                        return fmt.Errorf("cookie decryption unavailable")
+                }
+        }
 
-                if err.Error() == "net/http: timeout awaiting response headers" {
-                        http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+        // Log the request
+        if logSampled(r) {
+                if country := r.Header.Get("X-Client-Country"); country != "" {
+                        log.Printf("Proxying request: %s %s -> %s (country=%s asn=%s)", r.Method, r.URL.Path, route.Target, country, r.Header.Get("X-Client-ASN"))
                 } else {
-                        http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+                        log.Printf("Proxying request: %s %s -> %s", r.Method, r.URL.Path, route.Target)
                 }
         }
 
-        // Log the request
-        log.Printf("Proxying request: %s %s -> %s", r.Method, r.URL.Path, route.Target)
+        // Handle protocol upgrades
+        protocol := upgradeProtocol(r)
+        if protocol != "" && route.DisableUpgrades {
+                log.Printf("Protocol upgrade to %s not allowed on %s, forwarding as plain HTTP", protocol, route.Path)
+                p.recordRejectedUpgrade()
+                stripUpgrade(r)
+                protocol = ""
+        }
 
-        // Serve the request
+        // Bound the whole exchange; stalled response bodies cancel it too.
+        // An upgraded connection lives as long as its peers keep it open,
+        // so upgrade requests get no total timeout.
+        var ctx context.Context
+        var cancel context.CancelFunc
+        if total := route.totalTimeout(); total > 0 && protocol == "" {
+                ctx, cancel = context.WithTimeout(r.Context(), total)
+        } else {
+                ctx, cancel = context.WithCancel(r.Context())
+        }
+        defer cancel()
+        r = r.WithContext(ctx)
+
+        // Capture the upstream status code
+        upstreamStatus := 0
+        upgraded := false
+        var handshakeLatency time.Duration
+        proxy.ModifyResponse = func(resp *http.Response) error {
+                upstreamStatus = resp.StatusCode
+                headersReceived = true
+                if route.RequestCompression != nil && route.RequestCompression.Compress == CompressAuto {
+                        upstreamEncodings.observe(route.ID, resp)
+                }
+                if resp.StatusCode != http.StatusSwitchingProtocols {
+                        filterResponseHeaders(resp, route)
+                }
+                if route.Cookies != nil {
+                        if err := applyCookiePolicy(resp, route); err != nil {
+                                return err
+                        }
+                }
+                forwarded.responseVia(resp)
+                if protocol != "" && resp.StatusCode == http.StatusSwitchingProtocols {
+                        upgraded = true
+                        handshakeLatency = time.Since(startTime)
+                        p.recordUpgrade(protocol)
+                }
+                if route.Options != nil {
+                        route.Options.allowOrigin(r, resp)
+                }
+                if route.Session != nil {
+                        if err := issueSession(r, resp, route); err != nil {
+                                return err
+                        }
+                }
+                if route.Fallback != nil && route.Fallback.triggeredBy(resp.StatusCode) {
+                        return &fallbackStatusError{status: resp.StatusCode}
+                }
+                if err := checkResponseContentType(resp, route); err != nil {
+                        return err
+                }
+                if err := p.limitResponse(resp, route); err != nil {
+                        return err
+                }
+                if idle := route.idleTimeout(); idle > 0 && resp.StatusCode != http.StatusSwitchingProtocols {
+                        resp.Body = newIdleTimeoutBody(resp.Body, idle, cancel)
+                }
+                if route.Timeouts != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+                        resp.Body = &timeoutWatchBody{ReadCloser: resp.Body, report: func(err error) {
+                                timeoutErr := classifyTimeout(err, ctx, route, p.config.settings().DefaultTimeout, true)
+                                log.Printf("Response from %s cut off: %v", route.Target, timeoutErr)
+                                p.recordTimeout(route.Path, timeoutErr)
+                        }}
+                }
+                if route.Fallback != nil && route.Fallback.ServeStale && r.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+                        staleResponses.capture(staleKey(route, r), resp)
+                }
+                return nil
+        }
+
+        // Serve the request; upgraded connections stay in ServeHTTP until closed
         proxy.ServeHTTP(w, r)
 
+        if aborted {
+                log.Printf("Client closed request: %s %s", r.Method, r.URL.Path)
+                p.recordClientAbort(route.Path)
+                return nil
+        }
+
+        if upgraded {
+                circuitOutcome = circuitSuccess
+                p.endUpgrade()
+                p.updateStats(route.Path, handshakeLatency, http.StatusSwitchingProtocols, true)
+                return nil
+        }
+
+        // Answer failed requests from the fallback, outside the primary's deadline
+        if primaryErr != nil {
+                var statusErr *fallbackStatusError
+                circuitOutcome = circuitFailure
+                if errors.As(primaryErr, &statusErr) && statusErr.status < 500 {
+                        circuitOutcome = circuitSuccess
+                }
+                if status, upstream, ok := p.serveFallback(w, r.WithContext(origCtx), route, primaryErr.Error()); ok {
+                        p.updateStats(route.Path, time.Since(startTime), status, upstream)
+                        return nil
+                }
+                gatewayStatus = writeProxyError(w, r, primaryErr)
+                if errors.As(primaryErr, &statusErr) {
+                        p.updateStats(route.Path, time.Since(startTime), gatewayStatus, true)
+                        return nil
+                }
+        }
+
         // Update stats
-        p.updateStats(route.Path, time.Since(startTime), false)
+        if gatewayStatus != 0 {
+                if gatewayStatus >= 500 {
+                        circuitOutcome = circuitFailure
+                }
+                p.updateStats(route.Path, time.Since(startTime), gatewayStatus, false)
+        } else {
+                circuitOutcome = circuitSuccess
+                if upstreamStatus >= 500 {
+                        circuitOutcome = circuitFailure
+                        p.recordError(route.Path, upstreamErrorClass(upstreamStatus))
+                }
+                p.updateStats(route.Path, time.Since(startTime), upstreamStatus, true)
+        }
 
         return nil
 }
 
-// updateStats updates the request statistics
-func (p *Proxy) updateStats(path string, latency time.Duration, isError bool) {
+// writeProxyError answers a request whose upstream call failed and returns
+// the status written
+func writeProxyError(w http.ResponseWriter, r *http.Request, err error) int {
+        var tooLarge *http.MaxBytesError
+        var statusErr *fallbackStatusError
+        var typeErr *unexpectedContentTypeError
+        var sizeErr *responseTooLargeError
+        var timeoutErr *upstreamTimeoutError
+        switch {
+        case errors.As(err, &timeoutErr):
+                writeErrorDetails(w, r, http.StatusGatewayTimeout, ErrCodeGatewayTimeout, timeoutErr.Error(), timeoutErr.details())
+                return http.StatusGatewayTimeout
+        case errors.As(err, &tooLarge):
+                writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large")
+                return http.StatusRequestEntityTooLarge
+        case errors.As(err, &statusErr):
+                writeError(w, r, statusErr.status, ErrCodeUpstreamFailed, err.Error())
+                return statusErr.status
+        case errors.As(err, &typeErr), errors.As(err, &sizeErr):
+                writeError(w, r, http.StatusBadGateway, ErrCodeUpstreamFailed, err.Error())
+                return http.StatusBadGateway
+        case isTimeout(err):
+                writeError(w, r, http.StatusGatewayTimeout, ErrCodeGatewayTimeout, "gateway timeout")
+                return http.StatusGatewayTimeout
+        }
+        writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "service unavailable")
+        return http.StatusServiceUnavailable
+}
+
+// newStats returns zeroed stats counting from now
+func newStats() Stats {
+        return Stats{
+                RouteStats:    make(map[string]RouteStat),
+                Countries:     make(map[string]int64),
+                BotDetections: make(map[string]int64),
+                ErrorTypes:    make(map[string]int64),
+                Experiments:   make(map[string]map[string]VariantStat),
+                Deprecations:  make(map[string]DeprecationStat),
+                APIVersions:   make(map[string]map[string]VersionStat),
+                Webhooks:      make(map[string]WebhookStat),
+                Targets:       make(map[string]TargetStat),
+                Throttled:     make(map[string]int64),
+                Upgrades: UpgradeStats{
+                        ByProtocol: make(map[string]int64),
+                },
+                Since: time.Now(),
+        }
+}
+
+// updateStats updates the request statistics. upstream reports whether the
+// status was returned by the upstream rather than produced by the gateway.
+func (p *Proxy) updateStats(path string, latency time.Duration, status int, upstream bool) {
         p.statsMutex.Lock()
         defer p.statsMutex.Unlock()
 
         // Update total stats
         p.stats.TotalRequests++
 
-        // Calculate requests per second
-        elapsed := time.Since(p.startTime).Seconds()
-        p.stats.RequestsPerSecond = float64(p.stats.TotalRequests) / elapsed
-
         // Update route stats
         routeStat, exists := p.stats.RouteStats[path]
         if !exists {
@@ -513,13 +1377,27 @@ func (p *Proxy) updateStats(path string, latency time.Duration, isError bool) {
 
         routeStat.Requests++
         routeStat.AvgLatency = (routeStat.AvgLatency*float64(routeStat.Requests-1) + latency.Seconds()) / float64(routeStat.Requests)
+        buckets := p.config.latencyBuckets()
+        routeStat.Latency.observe(buckets, latency)
+        p.stats.Latency.observe(buckets, latency)
 
-        if isError {
+        switch {
+        case status >= 500:
                 routeStat.Errors++
-                p.stats.ErrorRate = float64(routeStat.Errors) / float64(routeStat.Requests)
+                if upstream {
+                        routeStat.UpstreamErrors++
+                } else {
+                        routeStat.GatewayErrors++
+                }
+                p.stats.TotalErrors++
+        case status >= 400:
+                routeStat.ClientErrors++
         }
 
         p.stats.RouteStats[path] = routeStat
+        p.stats.ErrorRate = float64(p.stats.TotalErrors) / float64(p.stats.TotalRequests)
+        p.window.add(time.Now(), status >= 500)
+        statsLog.add(time.Now(), path, latency, status, upstream, buckets, p.config.analyticsLimits())
 
         // Update average response time
         p.stats.AvgResponseTime = 0
@@ -533,6 +1411,24 @@ func (p *Proxy) updateStats(path string, latency time.Duration, isError bool) {
         }
 }
 
+// recordCountry counts a request from the given country
+func (p *Proxy) recordCountry(country string) {
+        if country == "" {
+                country = "unknown"
+        }
+
+        p.statsMutex.Lock()
+        p.stats.Countries[country]++
+        p.statsMutex.Unlock()
+}
+
+// recordBotDetection counts a bot detection by reason
+func (p *Proxy) recordBotDetection(reason string) {
+        p.statsMutex.Lock()
+        p.stats.BotDetections[reason]++
+        p.statsMutex.Unlock()
+}
+
 // getStats returns the current gateway statistics
 func (p *Proxy) getStats() Stats {
         p.statsMutex.RLock()
@@ -540,6 +1436,63 @@ func (p *Proxy) getStats() Stats {
 
         // Make a copy of the stats to avoid race conditions
         stats := p.stats
+        stats.Latency = p.stats.Latency.clone()
+        stats.RouteStats = make(map[string]RouteStat, len(p.stats.RouteStats))
+        for path, stat := range p.stats.RouteStats {
+                stat.Latency = stat.Latency.clone()
+                stats.RouteStats[path] = stat
+        }
+        stats.Countries = make(map[string]int64, len(p.stats.Countries))
+        for country, count := range p.stats.Countries {
+                stats.Countries[country] = count
+        }
+        stats.BotDetections = make(map[string]int64, len(p.stats.BotDetections))
+        for reason, count := range p.stats.BotDetections {
+                stats.BotDetections[reason] = count
+        }
+        stats.ErrorTypes = make(map[string]int64, len(p.stats.ErrorTypes))
+        for errType, count := range p.stats.ErrorTypes {
+                stats.ErrorTypes[errType] = count
+        }
+        stats.Experiments = make(map[string]map[string]VariantStat, len(p.stats.Experiments))
+        for name, variants := range p.stats.Experiments {
+                stats.Experiments[name] = make(map[string]VariantStat, len(variants))
+                for variant, stat := range variants {
+                        stats.Experiments[name][variant] = stat
+                }
+        }
+        stats.APIVersions = make(map[string]map[string]VersionStat, len(p.stats.APIVersions))
+        for path, versions := range p.stats.APIVersions {
+                stats.APIVersions[path] = make(map[string]VersionStat, len(versions))
+                for version, stat := range versions {
+                        stats.APIVersions[path][version] = stat
+                }
+        }
+        stats.Deprecations = make(map[string]DeprecationStat, len(p.stats.Deprecations))
+        for path, stat := range p.stats.Deprecations {
+                consumers := make(map[string]int64, len(stat.Consumers))
+                for consumer, count := range stat.Consumers {
+                        consumers[consumer] = count
+                }
+                stat.Consumers = consumers
+                stats.Deprecations[path] = stat
+        }
+        stats.Webhooks = make(map[string]WebhookStat, len(p.stats.Webhooks))
+        for path, stat := range p.stats.Webhooks {
+                stats.Webhooks[path] = stat
+        }
+        stats.Targets = make(map[string]TargetStat, len(p.stats.Targets))
+        for target, stat := range p.stats.Targets {
+                stats.Targets[target] = stat
+        }
+        stats.Throttled = make(map[string]int64, len(p.stats.Throttled))
+        for scope, count := range p.stats.Throttled {
+                stats.Throttled[scope] = count
+        }
+        stats.Upgrades.ByProtocol = make(map[string]int64, len(p.stats.Upgrades.ByProtocol))
+        for protocol, count := range p.stats.Upgrades.ByProtocol {
+                stats.Upgrades.ByProtocol[protocol] = count
+        }
 
         // Update dynamic fields
         p.reqMutex.RLock()
@@ -548,6 +1501,15 @@ func (p *Proxy) getStats() Stats {
 
         stats.Uptime = int64(time.Since(p.startTime).Seconds())
 
+        // Rolling rates surface changes lifetime averages hide
+        now := time.Now()
+        stats.RPS1s = p.window.requestRate(now, time.Second)
+        stats.RPS10s = p.window.requestRate(now, 10*time.Second)
+        stats.RPS1m = p.window.requestRate(now, time.Minute)
+        stats.RequestsPerSecond = stats.RPS10s
+        stats.ErrorRate1m = p.window.errorRate(now, time.Minute)
+        stats.ErrorRate5m = p.window.errorRate(now, 5*time.Minute)
+
         return stats
 }
 
@@ -564,134 +1526,231 @@ func (p *Proxy) getServices() []Service {
         return services
 }
 
-// checkHealth performs health checks on all backend services
-func (p *Proxy) checkHealth() []Service {
+// checkHealth performs health checks on all backend services concurrently.
+// Services checked within maxAge keep their current status.
+func (p *Proxy) checkHealth(maxAge time.Duration) []Service {
+        p.servicesMutex.RLock()
+        names := make([]string, 0, len(p.services))
+        for name := range p.services {
+                names = append(names, name)
+        }
+        p.servicesMutex.RUnlock()
+
+        // Probe with a bounded number of workers
+        queue := make(chan string)
+        var wg sync.WaitGroup
+        for i := 0; i < healthCheckWorkers && i < len(names); i++ {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        for name := range queue {
+                                p.checkServiceHealth(name, maxAge)
+                        }
+                }()
+        }
+        for _, name := range names {
+                queue <- name
+        }
+        close(queue)
+        wg.Wait()
+
+        return p.getServices()
+}
+
+// checkServiceHealth checks the health of a single service unless it was
+// checked within maxAge or a check is already running. It reports whether
+// a probe was made.
+func (p *Proxy) checkServiceHealth(name string, maxAge time.Duration) (Service, bool) {
         p.servicesMutex.Lock()
-        defer p.servicesMutex.Unlock()
+        svc, ok := p.services[name]
+        if !ok {
+                p.servicesMutex.Unlock()
+                return Service{}, false
+        }
+        if svc.checking || (maxAge > 0 && time.Since(svc.LastCheck) < maxAge) {
+                current := *svc
+                p.servicesMutex.Unlock()
+                return current, false
+        }
+        svc.checking = true
+        serviceURL := svc.URL
+        p.servicesMutex.Unlock()
+
+        // Probe without holding the lock
+        cfg := p.config.settings().HealthCheck.forService(name)
+        result := p.probeService(serviceURL, cfg)
 
-        // Perform health check on each service
-        for name, svc := range p.services {
-                p.checkServiceHealth(svc)
-                log.Printf("Service %s health check: %s", name, svc.Status)
+        p.servicesMutex.Lock()
+        now := time.Now()
+        previous := svc.Status
+        status := svc.dampen(previous, svc.applyProbe(result, cfg), result, cfg, now)
+        if status == "healthy" && previous != "healthy" {
+                svc.startWarmUp(previous, cfg, now)
+        }
+        flapping := false
+        if status != previous {
+                flapping = svc.recordTransition(HealthTransition{At: now, From: previous, To: status, Result: result}, cfg)
+        }
+        svc.Status = status
+        svc.LastCheck = now
+        svc.checking = false
+        current := *svc
+        p.servicesMutex.Unlock()
+        p.checkReadiness()
+
+        log.Printf("Service %s health check: %s (status %s)", name, result, status)
+        if flapping {
+                logFlapping(current, cfg)
         }
 
-        // Return services
-        services := make([]Service, 0, len(p.services))
-        for _, svc := range p.services {
-                services = append(services, *svc)
+        // Publish health transitions
+        if status != previous {
+                if status == "healthy" {
+                        events.emit(EventServiceHealthy, current)
+                } else if previous == "healthy" || previous == "unknown" {
+                        events.emit(EventServiceUnhealthy, current)
+                }
         }
 
-        return services
+        return current, true
 }
 
-// checkServiceHealth checks the health of a single service
-func (p *Proxy) checkServiceHealth(svc *Service) {
-        svc.LastCheck = time.Now()
-
+// probeService requests a service's health endpoint and returns its status
+func (p *Proxy) probeService(serviceURL string, cfg HealthCheckConfig) string {
         // Parse URL
-        targetURL, err := url.Parse(svc.URL)
+        targetURL, err := url.Parse(serviceURL)
         if err != nil {
-                svc.Status = "error"
-                return
+                return "error"
         }
 
-        // Create health check URL (could be customized in a real system)
-        healthURL := fmt.Sprintf("%s://%s/health", targetURL.Scheme, targetURL.Host)
+        // Create health check URL
+        healthURL := fmt.Sprintf("%s://%s%s", targetURL.Scheme, targetURL.Host, cfg.Path)
 
-        // Send request with timeout
+        // Send request with timeout, through the global egress proxy if
+        // configured. Probes share a transport of their own, so their
+        // connections are reused.
+        transport, err := p.transport(Route{ID: probeTransportID})
+        if err != nil {
+                return "error"
+        }
         client := &http.Client{
-                Timeout: 5 * time.Second,
+                Timeout:   time.Duration(cfg.Timeout) * time.Second,
+                Transport: transport,
         }
 
         req, err := http.NewRequest("GET", healthURL, nil)
         if err != nil {
-                svc.Status = "error"
-                return
+                return "error"
         }
 
         resp, err := client.Do(req)
         if err != nil {
-                svc.Status = "error"
-                return
+                return "error"
         }
         defer resp.Body.Close()
 
         // Read response
         body, err := ioutil.ReadAll(resp.Body)
         if err != nil {
-                svc.Status = "warning"
-                return
+                return "warning"
         }
 
         // Check status code
         if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-                svc.Status = "warning"
-                return
+                return "warning"
         }
 
         // For simplicity, any successful response indicates health
-        svc.Status = "healthy"
-
         // In a real system, we would parse the response and look for specific health indicators
         _ = body // Use body in real implementation
+        return "healthy"
 }
 
 // newRateLimiter creates a new rate limiter
-func newRateLimiter(config *Config) *RateLimiter {
-        return &RateLimiter{
+func newRateLimiter(ctx context.Context, config *Config) *RateLimiter {
+        rl := &RateLimiter{
                 config:  config,
-                buckets: make(map[string]*TokenBucket),
+                buckets: make(map[string]*list.Element),
+                order:   list.New(),
         }
+
+        // Per-client keys create many buckets, so drop idle ones
+        jobs.start(ctx, jobSpec{
+                name:     "rate-limit-pruning",
+                interval: every(5 * time.Minute),
+                run: func(_ context.Context, now time.Time) error {
+                        rl.pruneBuckets(now)
+                        return nil
+                },
+        })
+
+        return rl
 }
 
-// Allow checks if a request for the given path is allowed by the rate limiter
-func (rl *RateLimiter) allow(path string, rateLimit int) bool {
+// pruneBuckets removes buckets unused for rateLimitIdleTTL
+func (rl *RateLimiter) pruneBuckets(now time.Time) {
+        rl.bucketMutex.Lock()
+        defer rl.bucketMutex.Unlock()
+
+        // Buckets are ordered by use, so the idle ones are at the back
+        cutoff := now.Add(-rateLimitIdleTTL)
+        for el := rl.order.Back(); el != nil; el = rl.order.Back() {
+                entry := el.Value.(*rateLimitEntry)
+                entry.bucket.mutex.Lock()
+                idle := entry.bucket.lastRefillTime.Before(cutoff)
+                entry.bucket.mutex.Unlock()
+                if !idle {
+                        return
+                }
+                rl.order.Remove(el)
+                delete(rl.buckets, entry.key)
+        }
+}
+
+// Allow checks if a request for the given bucket key is allowed by the rate limiter
+func (rl *RateLimiter) allow(key string, rateLimit RateLimit) bool {
         // Skip rate limiting if disabled
-        if !rl.config.EnableRateLimit {
+        if !rl.config.settings().EnableRateLimit {
                 return true
         }
 
         // If no specific rate limit is provided, use the default
-        if rateLimit <= 0 {
-                rateLimit = rl.config.DefaultRateLimit
+        if !rateLimit.isSet() {
+                rateLimit = rl.config.settings().DefaultRateLimit
         }
 
-        // Get or create the bucket for this path
-        bucket := rl.getBucket(path, rateLimit)
+        // Get or create the bucket for this key
+        bucket := rl.getBucket(key, rateLimit)
 
         // Try to take a token
         return bucket.takeToken()
 }
 
-// getBucket gets or creates a token bucket for the given path
-func (rl *RateLimiter) getBucket(path string, rateLimit int) *TokenBucket {
-        rl.bucketMutex.RLock()
-        bucket, exists := rl.buckets[path]
-        rl.bucketMutex.RUnlock()
-
-        if exists {
-                return bucket
-        }
-
-        // Create a new bucket
+// getBucket gets or creates the token bucket for a key
+func (rl *RateLimiter) getBucket(key string, rateLimit RateLimit) *TokenBucket {
         rl.bucketMutex.Lock()
         defer rl.bucketMutex.Unlock()
 
-        // Check again in case another goroutine created it
-        bucket, exists = rl.buckets[path]
-        if exists {
-                return bucket
+        if el, exists := rl.buckets[key]; exists {
+                rl.order.MoveToFront(el)
+                return el.Value.(*rateLimitEntry).bucket
+        }
+
+        // Keep the map bounded; clients never share a bucket
+        if rl.order.Len() >= maxRateLimitBuckets {
+                oldest := rl.order.Back()
+                rl.order.Remove(oldest)
+                delete(rl.buckets, oldest.Value.(*rateLimitEntry).key)
         }
 
-        capacity := float64(rateLimit)
-        bucket = &TokenBucket{
+        capacity := rateLimit.capacity()
+        bucket := &TokenBucket{
                 tokens:         capacity,
                 capacity:       capacity,
-                refillRate:     capacity / 60.0, // Refill the bucket over 1 minute
+                refillRate:     rateLimit.refillRate(),
                 lastRefillTime: time.Now(),
         }
-
-        rl.buckets[path] = bucket
+        rl.buckets[key] = rl.order.PushFront(&rateLimitEntry{key: key, bucket: bucket})
         return bucket
 }
 
@@ -727,56 +1786,64 @@ func (tb *TokenBucket) takeToken() bool {
 func handleRoutes(w http.ResponseWriter, r *http.Request) {
         switch r.Method {
         case http.MethodGet:
-                // Return all routes
-                routes := config.getRoutes()
+                // Return all routes, or those of an owner or team
+                routes := filterRoutesByOwner(config.getRoutes(), r.URL.Query())
                 writeJSON(w, routes)
 
         case http.MethodPost:
                 // Create a new route
                 var route Route
                 if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
-                        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+                        writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
                         return
                 }
 
+                routeWrites.Lock()
+                defer routeWrites.Unlock()
+
                 // Validate route
-                if err := validateRoute(route); err != nil {
-                        http.Error(w, err.Error(), http.StatusBadRequest)
+                if err := validateRoute(&route, config.getRoutes(), config); err != nil {
+                        writeValidationError(w, r, err)
                         return
                 }
 
-                // Add route to config
-                id := config.addRoute(route)
+                // Add route to config. The file store saves the config as
+                // it is in memory, so the route is added first and taken out
+                // again if it can't be persisted.
+                route.ID = config.addRoute(route)
 
-                // Save config
-                if err := config.save(); err != nil {
-                        http.Error(w, fmt.Sprintf("Failed to save config: %v", err), http.StatusInternalServerError)
+                // Persist route
+                if err := store.SaveRoute(route); err != nil {
+                        config.deleteRoute(route.ID)
+                        routeLookups.purge()
+                        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save route: %v", err))
                         return
                 }
 
                 // Return the new route with ID
-                route.ID = id
+                routeChanges.notify(RouteChange{Kind: RouteCreated, New: &route})
+                events.emit(EventRouteCreated, route)
                 w.WriteHeader(http.StatusCreated)
                 writeJSON(w, route)
 
         default:
-                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
         }
 }
 
 // handleRoute handles GET, PUT, and DELETE requests for a specific route
 func handleRoute(w http.ResponseWriter, r *http.Request) {
         // Extract route ID from URL
-        parts := strings.Split(r.URL.Path, "/")
-        if len(parts) < 4 {
-                http.Error(w, "Invalid route ID", http.StatusBadRequest)
-                return
-        }
-
-        idStr := parts[3]
+        idStr := strings.TrimPrefix(r.URL.Path, "/routes/")
+        clone := strings.HasSuffix(idStr, "/clone")
+        idStr = strings.TrimSuffix(idStr, "/clone")
         id, err := strconv.Atoi(idStr)
         if err != nil {
-                http.Error(w, "Invalid route ID", http.StatusBadRequest)
+                writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "Invalid route ID")
+                return
+        }
+        if clone {
+                handleRouteClone(w, r, id)
                 return
         }
 
@@ -785,7 +1852,7 @@ func handleRoute(w http.ResponseWriter, r *http.Request) {
                 // Get route by ID
                 route, found := config.getRoute(id)
                 if !found {
-                        http.Error(w, "Route not found", http.StatusNotFound)
+                        writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Route not found")
                         return
                 }
                 writeJSON(w, route)
@@ -794,59 +1861,116 @@ func handleRoute(w http.ResponseWriter, r *http.Request) {
                 // Update route
                 var route Route
                 if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
-                        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+                        writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
                         return
                 }
 
                 // Ensure ID matches
                 route.ID = id
+                routeWrites.Lock()
+                defer routeWrites.Unlock()
+                if old, found := config.getRoute(id); found && old.source != "" {
+                        writeError(w, r, http.StatusConflict, ErrCodeRouteIncluded, includedRouteMessage(old))
+                        return
+                }
 
                 // Validate route
-                if err := validateRoute(route); err != nil {
-                        http.Error(w, err.Error(), http.StatusBadRequest)
+                if err := validateRoute(&route, config.getRoutes(), config); err != nil {
+                        writeValidationError(w, r, err)
                         return
                 }
 
-                // Update route in config
-                if !config.updateRoute(route) {
-                        http.Error(w, "Route not found", http.StatusNotFound)
+                // Update route in config, restoring the old one if the
+                // change can't be persisted
+                old, found := config.updateRoute(route)
+                if !found {
+                        writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Route not found")
                         return
                 }
 
-                // Save config
-                if err := config.save(); err != nil {
-                        http.Error(w, fmt.Sprintf("Failed to save config: %v", err), http.StatusInternalServerError)
+                // Persist route
+                if err := store.SaveRoute(route); err != nil {
+                        config.updateRoute(old)
+                        routeLookups.purge()
+                        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save route: %v", err))
                         return
                 }
 
+                routeChanges.notify(RouteChange{Kind: RouteUpdated, Old: &old, New: &route})
+                events.emit(EventRouteUpdated, route)
                 writeJSON(w, route)
 
         case http.MethodDelete:
-                // Delete route
-                if !config.deleteRoute(id) {
-                        http.Error(w, "Route not found", http.StatusNotFound)
+                routeWrites.Lock()
+                defer routeWrites.Unlock()
+                if old, found := config.getRoute(id); found && old.source != "" {
+                        writeError(w, r, http.StatusConflict, ErrCodeRouteIncluded, includedRouteMessage(old))
                         return
                 }
 
-                // Save config
-                if err := config.save(); err != nil {
-                        http.Error(w, fmt.Sprintf("Failed to save config: %v", err), http.StatusInternalServerError)
+                // Delete route, putting it back if the deletion can't be persisted
+                old, index, found := config.takeRoute(id)
+                if !found {
+                        writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Route not found")
                         return
                 }
 
+                // Persist deletion
+                if err := store.DeleteRoute(id); err != nil {
+                        config.restoreRoute(old, index)
+                        routeLookups.purge()
+                        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to delete route: %v", err))
+                        return
+                }
+
+                routeChanges.notify(RouteChange{Kind: RouteDeleted, Old: &old})
+                events.emit(EventRouteDeleted, map[string]int{"id": id})
                 w.WriteHeader(http.StatusNoContent)
 
         default:
-                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
         }
 }
 
-// handleStats returns current gateway statistics
+// handleStats returns current gateway statistics, or with a window or
+// since parameter the stats of that range
 func handleStats(w http.ResponseWriter, r *http.Request) {
+        since, scoped, err := statsWindow(r)
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+                return
+        }
+        if scoped {
+                window := statsLog.window(since, time.Now())
+                window.RouteStats = withWindowOwners(window.RouteStats)
+                writeJSON(w, window)
+                return
+        }
         stats := proxy.getStats()
+        stats.RouteStats = withOwners(stats.RouteStats)
         writeJSON(w, stats)
 }
 
+// handleStatsHistory returns stats snapshots. The since parameter takes an
+// RFC 3339 time or a duration such as 6h; the default is the last hour.
+func handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+        since, err := parseTimeParam(r, "since", time.Now().Add(-time.Hour))
+        if err != nil {
+                writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+                return
+        }
+
+        history, err := store.StatsHistory(since)
+        if err != nil {
+                writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to read stats history: %v", err))
+                return
+        }
+        if history == nil {
+                history = []StatsSnapshot{}
+        }
+        writeJSON(w, history)
+}
+
 // handleServices returns information about backend services
 func handleServices(w http.ResponseWriter, r *http.Request) {
         services := proxy.getServices()
@@ -855,77 +1979,336 @@ func handleServices(w http.ResponseWriter, r *http.Request) {
 
 // handleHealth performs health checks on backend services
 func handleHealth(w http.ResponseWriter, r *http.Request) {
-        health := proxy.checkHealth()
+        health := proxy.checkHealth(onDemandCheckInterval)
         writeJSON(w, health)
 }
 
+// handleConnections returns open client connection counts
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, connLimiter.stats())
+}
+
+// handleRuntime returns memory and goroutine counters, so load tests can
+// measure allocations per request, and the size of the analytics logs
+func handleRuntime(w http.ResponseWriter, r *http.Request) {
+        var m runtime.MemStats
+        runtime.ReadMemStats(&m)
+        writeJSON(w, map[string]interface{}{
+                "goroutines":   runtime.NumGoroutine(),
+                "mallocs":      m.Mallocs,
+                "totalAlloc":   m.TotalAlloc,
+                "heapAlloc":    m.HeapAlloc,
+                "heapObjects":  m.HeapObjects,
+                "numGC":        m.NumGC,
+                "pauseTotalNs": m.PauseTotalNs,
+                "analytics":    analyticsUsage(),
+        })
+}
+
 // handleConfig handles configuration settings
 func handleConfig(w http.ResponseWriter, r *http.Request) {
         switch r.Method {
         case http.MethodGet:
                 // Return current config (excluding routes for brevity)
-                configCopy := *config
-                configCopy.Routes = nil
-                writeJSON(w, configCopy)
+                writeJSON(w, configWithoutRoutes())
 
         case http.MethodPut:
                 // Update config
                 var newConfig Config
-                if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
-                        http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+                data, err := ioutil.ReadAll(r.Body)
+                if err == nil {
+                        err = decodeConfig("request body", data, &newConfig)
+                }
+                if err != nil {
+                        writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
                         return
                 }
 
                 // Preserve routes and other non-serialized fields
                 newConfig.Routes = config.getRoutes() // Use getter to get a copy
+                newConfig.configFilePath = config.settings().configFilePath
+                config.routesMutex.RLock()
+                newConfig.nextRouteID = config.nextRouteID
+                config.routesMutex.RUnlock()
+
+                // Flags and environment variables still take precedence
+                if err := newConfig.applyOverrides(config.settings().overrides); err != nil {
+                        writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, err.Error())
+                        return
+                }
+
+                err = newConfig.validate()
+                if err == nil {
+                        err = checkSecretCommands(&newConfig)
+                }
+                if err != nil {
+                        writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Configuration is invalid", err.(*ValidationError).Violations)
+                        return
+                }
 
                 // Update config
-                *config = newConfig
+                before := config.backgroundSettings()
+                config.setSettings(newConfig.ConfigSettings)
+                routeLookups.purge()
 
                 // Apply new configuration
                 config.configureLogging()
+                traffic.configure(config.settings().Recording)
+                proxy.resetTransports()
 
                 // Save config
                 if err := config.save(); err != nil {
-                        http.Error(w, fmt.Sprintf("Failed to save config: %v", err), http.StatusInternalServerError)
+                        writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save config: %v", err))
                         return
                 }
+                activeConfig.load(config, nil, "reloaded")
+                restartBackground(before, config)
 
-                writeJSON(w, newConfig)
+                writeJSON(w, &newConfig)
 
         default:
-                http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+                writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
         }
 }
 
 // handleProxyRequest proxies all other requests to the appropriate backend
 func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
+        // Tag the request so errors and upstream logs can be correlated
+        ensureRequestID(w, r)
+
+        // Serve the whole request with the settings it started under
+        settings := config.settings()
+
+        // Queue or refuse requests until the gateway is ready, if configured
+        if !readiness.admit(w, r, settings.Readiness) {
+                return
+        }
+
+        // Normalize the method before matching
+        applyMethodOverride(r)
+
         // Look up route
-        route, found := config.findRouteByPath(r.URL.Path, r.Method)
+        route, found := routeLookups.find(r)
+        if found && (!launchEnabled(r, route) || !featureFlags.routeEnabled(route)) {
+                found = false
+        }
+        catchAll := false
+        if !found {
+                route, found = config.catchAllRoute()
+                catchAll = found
+        }
         if !found {
-                http.Error(w, "Not found", http.StatusNotFound)
+                serveNoRoute(w, r)
+                return
+        }
+
+        // Track what is learnt about the request, and class its errors
+        // under its route
+        r = withRequestContext(r, route)
+        if catchAll {
+                requestContext(r).note("route", "catchAll")
+        }
+
+        // Balance pooled routes across their targets by weight
+        if !balanceTargets(w, r, &route) {
+                return
+        }
+
+        // Report how the request was handled to support engineers
+        w = debugResponse(w, r, route)
+
+        // Let feature flags choose the target and rewrite
+        target := route.Target
+        featureFlags.apply(r, &route)
+        if route.Target != target {
+                requestContext(r).note("flags", "target")
+        }
+
+        // Decide what the request logs, traces and captures
+        decideSampling(r, route)
+        w, finishSpan := startSpan(w, r, route)
+        defer finishSpan()
+
+        // Resolve client location and enforce geo restrictions. Without a
+        // database the country is unknown, which an allow list rejects.
+        var geo GeoInfo
+        if geoIP != nil {
+                geo = geoIP.lookup(clientIP(r))
+                proxy.recordCountry(geo.Country)
+                rc := requestContext(r)
+                rc.update(func(rc *RequestContext) { rc.Country = geo.Country })
+                if geo.ASN != 0 {
+                        rc.set("asn", geo.ASN)
+                        rc.set("asOrg", geo.ASOrg)
+                }
+        }
+        if !geoAllowed(route, geo.Country) {
+                log.Printf("Blocked request from country %q to %s", geo.Country, route.Path)
+                writeErrorDetails(w, r, http.StatusForbidden, ErrCodeGeoBlocked, "Access denied from your region", map[string]string{"country": geo.Country})
+                return
+        }
+        setGeoHeaders(r, geo)
+
+        // Apply bot mitigation
+        if !botDetector.Load().check(w, r, route) {
+                return
+        }
+
+        // Answer OPTIONS requests locally unless the route proxies them
+        if r.Method == http.MethodOptions && route.Options != nil {
+                if route.Options.Mode != OptionsProxy {
+                        proxy.serveOptions(w, r, route)
+                        return
+                }
+                if isPreflight(r) {
+                        proxy.recordPreflight(route.Path)
+                }
+        }
+
+        // Reject request bodies of types the route does not accept
+        if !checkRequestContentType(w, r, route) {
+                return
+        }
+
+        // Decode compressed bodies for upstreams that cannot, before
+        // anything reads them
+        if !decompressRequestBody(w, r, route) {
+                return
+        }
+
+        // Validate and log the request body if configured
+        if !inspectRequestBody(w, r, route) {
                 return
         }
 
+        // Accept only authentic, fresh webhooks, each delivery once
+        w, recordDelivery, ok := verifyWebhook(w, r, route)
+        if !ok {
+                return
+        }
+        defer recordDelivery()
+
         // Check rate limit
-        if config.EnableRateLimit {
-                if !rateLimiter.allow(route.Path, route.RateLimit) {
-                        http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+        if settings.EnableRateLimit {
+                if !rateLimiter.allow(rateLimitBucketKey(r, route), route.RateLimit) {
+                        emitRateLimitTripped("route "+strconv.Itoa(route.ID), map[string]interface{}{
+                                "routeId": route.ID,
+                                "path":    route.Path,
+                                "client":  r.RemoteAddr,
+                        })
+                        writeError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "Rate limit exceeded")
                         return
                 }
+                requestContext(r).note("rateLimit", "allowed")
+        }
+
+        // Refuse clients locked out after failed logins and count this attempt
+        w, recordAuthAttempt, ok := guardAuth(w, r, route)
+        if !ok {
+                return
+        }
+        defer recordAuthAttempt()
+
+        // Reject cross-site requests riding on cookies, before auth strips them
+        if route.CSRF != nil && !checkCSRFRequest(w, r, route) {
+                return
         }
 
-        // Check authentication if required
-        if route.AuthRequired {
-                // Authentication logic would go here
-                authHeader := r.Header.Get("Authorization")
-                if authHeader == "" {
-                        http.Error(w, "Authentication required", http.StatusUnauthorized)
+        // Check authentication if required; preflights never carry credentials
+        if route.BasicAuth != nil && !(route.Options != nil && isPreflight(r)) {
+                if !basicAuthenticate(w, r, route) {
+                        return
+                }
+        } else if route.Session != nil && !(route.Options != nil && isPreflight(r)) {
+                if !checkSessionRequest(w, r, route) {
+                        return
+                }
+        } else if route.AuthRequired && !(route.Options != nil && isPreflight(r)) {
+                // API keys are checked against the credential's entitlements
+                if key := r.Header.Get(apiKeyHeader); key != "" {
+                        if !authenticateAPIKey(w, r, route, key) {
+                                return
+                        }
+                } else if r.Header.Get("Authorization") == "" {
+                        writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Authentication required")
                         return
                 }
                 // In a real implementation, we would validate the authentication token
         }
 
+        // Enforce the route's scope and claim requirements
+        if !(route.Options != nil && isPreflight(r)) && !authorizeRequest(w, r, route) {
+                return
+        }
+        resolveTenant(r, settings.TenantKey)
+
+        // Sample the request for replay
+        traffic.record(r, route)
+
+        // Announce deprecation and note who still uses the route
+        markDeprecated(w, r, route)
+
+        // Route to the requested API version
+        w, recordVersion, ok := applyVersion(w, r, &route)
+        if !ok {
+                return
+        }
+        defer recordVersion()
+
+        // Assign the experiment variant
+        w, recordVariant := applyExperiment(w, r, &route)
+        defer recordVariant()
+
+        // Serve static routes locally
+        if route.Type == RouteTypeStatic {
+                startTime := time.Now()
+                rec := &statusRecorder{ResponseWriter: w}
+                serveStatic(rec, r, route)
+                proxy.updateStats(route.Path, time.Since(startTime), rec.statusCode(), false)
+                return
+        }
+
+        // Fan out aggregate routes and run pipelines
+        if route.Type == RouteTypeAggregate || route.Type == RouteTypePipeline {
+                startTime := time.Now()
+                timeout := route.Timeout
+                if timeout <= 0 {
+                        timeout = settings.DefaultTimeout
+                }
+                if route.Timeouts != nil && route.Timeouts.Total > 0 {
+                        timeout = route.Timeouts.Total
+                }
+
+                rec := &statusRecorder{ResponseWriter: w}
+                relayed := false
+                if route.Type == RouteTypeAggregate {
+                        serveAggregate(rec, r, route, time.Duration(timeout)*time.Second)
+                } else {
+                        relayed = servePipeline(rec, r, route, time.Duration(timeout)*time.Second)
+                }
+                proxy.updateStats(route.Path, time.Since(startTime), rec.statusCode(), relayed)
+                return
+        }
+
+        // Pace requests to upstreams with a strict ingest rate
+        if !smoothRequest(w, r, route) {
+                return
+        }
+
+        // Wait for a free in-flight slot on capped routes
+        releaseSlot, ok := limitConcurrency(w, r, route)
+        if !ok {
+                return
+        }
+        defer releaseSlot()
+
+        // Buffer small bodies so they can be replayed
+        release, ok := bufferRequestBody(w, r, route)
+        if !ok {
+                return
+        }
+        defer release()
+
         // Proxy the request
         if err := proxy.proxyRequest(w, r, route); err != nil {
                 status := http.StatusInternalServerError
@@ -934,25 +2317,113 @@ func handleProxyRequest(w http.ResponseWriter, r *http.Request) {
                 } else if err.Error() == "service unavailable" {
                         status = http.StatusServiceUnavailable
                 }
-                http.Error(w, err.Error(), status)
+                writeError(w, r, status, errorCodeForStatus(status), err.Error())
         }
 }
 
-// validateRoute validates a route configuration
-func validateRoute(route Route) error {
+// validateRoute validates a route configuration against the existing
+// routes and the paths cfg reserves, reporting every violation found
+func validateRoute(route *Route, existing []Route, cfg *Config) error {
+        var v ValidationError
+        cfg.applyTemplate(route, &v)
+        checkTargets(route, &v)
+        route.Methods = normalizeMethods(route.Methods)
+
         if route.Path == "" {
-                return fmt.Errorf("path is required")
-        }
-        if !strings.HasPrefix(route.Path, "/") {
-                return fmt.Errorf("path must start with /")
+                v.add("path", "is required")
+        } else if !strings.HasPrefix(route.Path, "/") {
+                v.add("path", "must start with /")
+        } else {
+                cfg.checkReservedPaths(route, &v)
         }
-        if route.Target == "" {
-                return fmt.Errorf("target is required")
+        switch route.Type {
+        case "", RouteTypeProxy:
+                if route.Target == "" {
+                        v.add("target", "is required")
+                } else if err := validateTargetURL(route.Target); err != nil {
+                        v.add("target", "%v", err)
+                }
+        case RouteTypeStatic:
+                if route.StaticDir == "" {
+                        v.add("staticDir", "is required for static routes")
+                } else if info, err := os.Stat(route.StaticDir); err != nil || !info.IsDir() {
+                        v.add("staticDir", "%q is not a directory", route.StaticDir)
+                }
+        case RouteTypeAggregate:
+                if err := validateAggregate(route.Aggregate); err != nil {
+                        v.add("aggregate", "%v", err)
+                }
+        case RouteTypePipeline:
+                if err := validatePipeline(route.Pipeline); err != nil {
+                        v.add("pipeline", "%v", err)
+                }
+        default:
+                v.add("type", "unknown route type %q", route.Type)
         }
         if len(route.Methods) == 0 {
-                return fmt.Errorf("at least one HTTP method must be specified")
+                v.add("methods", "at least one HTTP method must be specified")
         }
-        return nil
+        checkMethods(route.Methods, &v)
+        if route.BotAction != "" && !validBotAction(route.BotAction) {
+                v.add("botAction", "must be off, log, challenge or block")
+        }
+        checkRateLimit("rateLimit", route.RateLimit, &v)
+        if !validRateLimitKey(route.RateLimitKey) {
+                v.add("rateLimitKey", "invalid rate limit key %q: use route, ip, header:<name> or claim:<name>", route.RateLimitKey)
+        }
+        if err := validateBodyRules(*route); err != nil {
+                v.add("bodyLogging", "%v", err)
+        }
+        if route.Timeout < 0 {
+                v.add("timeout", "must not be negative")
+        }
+        checkTimeouts(route.Timeouts, &v)
+        checkBuffering(route.Buffering, &v)
+        checkFallback(route.Fallback, &v)
+        checkCircuitBreaker(route.CircuitBreaker, &v)
+        checkRequestCompression(route.RequestCompression, &v)
+        checkOptions(route.Options, &v)
+        checkLaunch(route, &v)
+        checkExperiment(route.Experiment, &v)
+        checkSmoothing(route.Smoothing, &v)
+        checkMediaTypes(route, &v)
+        checkResponseLimit(route.ResponseLimit, &v)
+        checkDeprecation(route.Deprecation, &v)
+        checkVersioning(route.Versioning, &v)
+        checkTags(route.Tags, &v)
+        checkGeoRules(route, cfg.settings().GeoIP, &v)
+        checkAuthorization(route.Authorization, cfg.settings().JWT, &v)
+        checkBasicAuth(route.BasicAuth, &v)
+        checkSession(route.Session, route.Path, &v)
+        checkCSRF(route.CSRF, &v)
+        checkBruteForce(route.BruteForce, &v)
+        checkSigning(route.Signing, &v)
+        checkHeaderFilter("responseHeaders", route.ResponseHeaders, &v)
+        checkCookiePolicy(route.Cookies, &v)
+        checkRewrite(route.Rewrite, &v)
+        checkForwarded("forwarded", route.Forwarded, &v)
+        checkRouteFlags(route.Flags, cfg, &v)
+        checkWebhook(route.Webhook, &v)
+        checkConcurrency(route.Concurrency, &v)
+        checkSampling("sampling", route.Sampling, &v)
+        if route.UpstreamProxy != "" && route.UpstreamProxy != routeProxyDirect {
+                if _, err := parseEgressProxyURL(route.UpstreamProxy); err != nil {
+                        v.add("upstreamProxy", "%v", err)
+                }
+        }
+        if route.Path != "" {
+                checkConflicts(route, existing, &v)
+        }
+        return v.err()
+}
+
+// clientIP returns the IP address of the connecting client
+func clientIP(r *http.Request) net.IP {
+        host, _, err := net.SplitHostPort(r.RemoteAddr)
+        if err != nil {
+                host = r.RemoteAddr
+        }
+        return net.ParseIP(host)
 }
 
 // writeJSON writes JSON response with proper headers
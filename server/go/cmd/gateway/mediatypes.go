@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// unexpectedContentTypeError rejects an upstream response whose type is
+// not among the route's Produces
+type unexpectedContentTypeError struct {
+	contentType string
+}
+
+// Error describes the upstream response
+func (e *unexpectedContentTypeError) Error() string {
+	return fmt.Sprintf("upstream returned unexpected content type %q", e.contentType)
+}
+
+// checkMediaTypes validates a route's consumes and produces lists
+func checkMediaTypes(route *Route, v *ValidationError) {
+	for _, t := range route.Consumes {
+		if !validMediaRange(t) {
+			v.add("consumes", "invalid media type %q: use type/subtype, type/* or */*", t)
+		}
+	}
+	for _, t := range route.Produces {
+		if !validMediaRange(t) {
+			v.add("produces", "invalid media type %q: use type/subtype, type/* or */*", t)
+		}
+	}
+	if route.EnforceProduces && len(route.Produces) == 0 {
+		v.add("enforceProduces", "requires produces")
+	}
+}
+
+// validMediaRange reports whether t is a media type or a wildcard range
+func validMediaRange(t string) bool {
+	mediaType, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return false
+	}
+	typ, subtype, ok := strings.Cut(mediaType, "/")
+	if !ok || typ == "" || subtype == "" {
+		return false
+	}
+	return typ != "*" || subtype == "*"
+}
+
+// matchesMediaType reports whether a Content-Type header falls within one
+// of the allowed ranges. Parameters such as charset are ignored.
+func matchesMediaType(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	for _, a := range allowed {
+		allowedType, _, _ := mime.ParseMediaType(a)
+		switch {
+		case allowedType == "*/*", allowedType == mediaType, allowedType == typ+"/*":
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequestContentType answers 415 when a request body's Content-Type
+// is not among the route's Consumes. Requests without a body pass.
+func checkRequestContentType(w http.ResponseWriter, r *http.Request, route Route) bool {
+	if len(route.Consumes) == 0 || r.ContentLength == 0 {
+		return true
+	}
+	contentType := r.Header.Get("Content-Type")
+	if matchesMediaType(contentType, route.Consumes) {
+		return true
+	}
+
+	log.Printf("Rejected %s %s: unexpected content type %q", r.Method, r.URL.Path, contentType)
+	w.Header().Set("Accept", strings.Join(route.Consumes, ", "))
+	writeErrorDetails(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType,
+		"Unsupported Content-Type", map[string]interface{}{"accepted": route.Consumes})
+	return false
+}
+
+// checkResponseContentType logs upstream responses whose Content-Type is
+// not among the route's Produces, failing them if EnforceProduces is set
+func checkResponseContentType(resp *http.Response, route Route) error {
+	if len(route.Produces) == 0 || !responseHasBody(resp) {
+		return nil
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if matchesMediaType(contentType, route.Produces) {
+		return nil
+	}
+
+	log.Printf("Upstream %s returned unexpected content type %q for %s %s",
+		route.Target, contentType, resp.Request.Method, resp.Request.URL.Path)
+	if route.EnforceProduces {
+		return &unexpectedContentTypeError{contentType: contentType}
+	}
+	return nil
+}
+
+// responseHasBody reports whether a response status allows a body
+func responseHasBody(resp *http.Response) bool {
+	status := resp.StatusCode
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
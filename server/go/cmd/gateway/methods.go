@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// methodOverrideHeader carries the intended method for clients that can only send POST
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+// overridableMethods are the methods a POST may be overridden to
+var overridableMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// methodOverride returns the overriding method requested by a POST, or ""
+func methodOverride(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+
+	method := strings.ToUpper(strings.TrimSpace(r.Header.Get(methodOverrideHeader)))
+	if !overridableMethods[method] {
+		return ""
+	}
+	return method
+}
+
+// applyMethodOverride rewrites the request method when the route it would
+// match with the overriding method opts in to overrides
+func applyMethodOverride(r *http.Request) {
+	method := methodOverride(r)
+	if method == "" {
+		return
+	}
+
+	route, found := config.findRouteByPath(r.URL.Path, method)
+	if !found || !route.AllowMethodOverride {
+		return
+	}
+
+	// Forward the real intent; upstreams see the overriding method
+	r.Method = method
+	r.Header.Del(methodOverrideHeader)
+}
+
+// normalizeMethods upper-cases and de-duplicates a route's method list
+func normalizeMethods(methods []string) []string {
+	seen := make(map[string]bool, len(methods))
+	normalized := make([]string, 0, len(methods))
+
+	for _, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m == "" || seen[m] {
+			continue
+		}
+		seen[m] = true
+		normalized = append(normalized, m)
+	}
+
+	return normalized
+}
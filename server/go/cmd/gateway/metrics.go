@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelEscaper escapes label values in the Prometheus text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	buf bytes.Buffer
+}
+
+// family writes a metric family's help and type lines
+func (m *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels alternate names and values
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteByte(',')
+			}
+			fmt.Fprintf(&m.buf, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.buf.WriteByte('}')
+	}
+	m.buf.WriteByte(' ')
+	m.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.buf.WriteByte('\n')
+}
+
+// histogram writes a latency histogram's cumulative buckets, sum and count,
+// with the bounds converted to seconds
+func (m *metricsWriter) histogram(name string, h LatencyHistogram, labels ...string) {
+	var cumulative int64
+	for i, count := range h.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.Bounds) {
+			le = strconv.FormatFloat(h.Bounds[i]/1000, 'g', -1, 64)
+		}
+		m.sample(name+"_bucket", float64(cumulative), append(labels, "le", le)...)
+	}
+	m.sample(name+"_sum", h.Sum, labels...)
+	m.sample(name+"_count", float64(h.Count), labels...)
+}
+
+// handleMetrics exposes the lifetime stats to Prometheus. Latencies come
+// from the same histograms as /stats, with the buckets in seconds.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	stats := proxy.getStats()
+	paths := make([]string, 0, len(stats.RouteStats))
+	for path := range stats.RouteStats {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var m metricsWriter
+	m.family("gateway_requests_total", "counter", "Requests completed, by route.")
+	for _, path := range paths {
+		m.sample("gateway_requests_total", float64(stats.RouteStats[path].Requests), "route", path)
+	}
+	m.family("gateway_request_errors_total", "counter", "Error responses, by route and source: client (4xx), upstream or gateway (5xx).")
+	for _, path := range paths {
+		rs := stats.RouteStats[path]
+		m.sample("gateway_request_errors_total", float64(rs.ClientErrors), "route", path, "source", "client")
+		m.sample("gateway_request_errors_total", float64(rs.UpstreamErrors), "route", path, "source", "upstream")
+		m.sample("gateway_request_errors_total", float64(rs.GatewayErrors), "route", path, "source", "gateway")
+	}
+	m.family("gateway_request_duration_seconds", "histogram", "Request latency, by route.")
+	for _, path := range paths {
+		if h := stats.RouteStats[path].Latency; len(h.Counts) > 0 {
+			m.histogram("gateway_request_duration_seconds", h, "route", path)
+		}
+	}
+	m.family("gateway_active_connections", "gauge", "Requests in flight.")
+	m.sample("gateway_active_connections", float64(stats.ActiveConnections))
+	m.family("gateway_uptime_seconds", "gauge", "Seconds since the gateway started.")
+	m.sample("gateway_uptime_seconds", float64(stats.Uptime))
+	m.family("gateway_events_dropped_total", "counter", "Events dropped because the publishing queue was full.")
+	m.sample("gateway_events_dropped_total", float64(droppedEvents.Load()))
+
+	// Gauges for autoscalers, as GET /scaling reports them
+	scaling := scalingMetrics()
+	m.family("gateway_requests_per_second", "gauge", "Requests per second over the last 10 seconds.")
+	m.sample("gateway_requests_per_second", scaling.RequestsPerSecond)
+	m.family("gateway_open_connections", "gauge", "Open client connections.")
+	m.sample("gateway_open_connections", float64(scaling.ActiveConnections))
+	m.family("gateway_saturation_ratio", "gauge", "Load over the replica's capacity; 1 is fully loaded.")
+	m.sample("gateway_saturation_ratio", scaling.Saturation)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.buf.Bytes())
+}
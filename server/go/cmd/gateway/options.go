@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OPTIONS handling modes
+const (
+	OptionsAllow = "allow" // answer locally, allowing any origin the route's methods
+	OptionsLocal = "local" // answer locally from the configured CORS policy
+	OptionsProxy = "proxy" // forward to the upstream
+)
+
+// OptionsConfig defines how a route answers OPTIONS requests, including
+// CORS preflights, whether or not OPTIONS is in its methods
+type OptionsConfig struct {
+	Mode string `json:"mode"`
+
+	// CORS policy for the local mode. AllowOrigins may contain "*";
+	// AllowHeaders defaults to echoing the requested headers.
+	AllowOrigins     []string `json:"allowOrigins,omitempty"`
+	AllowHeaders     []string `json:"allowHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAge           int      `json:"maxAge,omitempty"` // seconds browsers may cache a preflight
+}
+
+// checkOptions validates a route's OPTIONS settings
+func checkOptions(o *OptionsConfig, v *ValidationError) {
+	if o == nil {
+		return
+	}
+	switch o.Mode {
+	case OptionsAllow, OptionsProxy:
+	case OptionsLocal:
+		if len(o.AllowOrigins) == 0 {
+			v.add("options.allowOrigins", "is required for local mode")
+		}
+	default:
+		v.add("options.mode", "must be allow, local or proxy")
+	}
+	if o.MaxAge < 0 {
+		v.add("options.maxAge", "must not be negative")
+	}
+	if o.AllowCredentials {
+		for _, origin := range o.AllowOrigins {
+			if origin == "*" {
+				v.add("options.allowOrigins", "cannot be * when allowCredentials is set")
+			}
+		}
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// findOptionsRoute finds the route answering an OPTIONS request for a path
+// when no route lists OPTIONS among its methods
+func (c *Config) findOptionsRoute(path string) (Route, bool) {
+	c.routesMutex.RLock()
+	defer c.routesMutex.RUnlock()
+
+	for _, route := range c.Routes {
+		if route.Active && route.Options != nil && route.matchesPath(path) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
+
+// allowsMethod reports whether a route accepts method
+func (r Route) allowsMethod(method string) bool {
+	for _, m := range r.Methods {
+		if m == "*" || strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrigin reports whether the local policy accepts origin
+func (o *OptionsConfig) allowsOrigin(origin string) bool {
+	if o.Mode == OptionsAllow {
+		return true
+	}
+	for _, allowed := range o.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveOptions answers an OPTIONS request locally. Preflights from origins
+// or for methods the route does not allow get no CORS headers, which
+// browsers treat as a refusal.
+func (p *Proxy) serveOptions(w http.ResponseWriter, r *http.Request, route Route) {
+	startTime := time.Now()
+	o := route.Options
+
+	methods := append([]string{}, route.Methods...)
+	if !route.allowsMethod(http.MethodOptions) {
+		methods = append(methods, http.MethodOptions)
+	}
+	allow := strings.Join(methods, ", ")
+	w.Header().Set("Allow", allow)
+
+	if isPreflight(r) {
+		p.recordPreflight(route.Path)
+		origin := r.Header.Get("Origin")
+		requested := r.Header.Get("Access-Control-Request-Method")
+		if o.allowsOrigin(origin) && route.allowsMethod(requested) {
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Allow-Methods", allow)
+			if len(o.AllowHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(o.AllowHeaders, ", "))
+			} else if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if o.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if o.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(o.MaxAge))
+			}
+		}
+		w.Header().Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	p.updateStats(route.Path, time.Since(startTime), http.StatusNoContent, false)
+}
+
+// allowOrigin adds Access-Control-Allow-Origin to a proxied response on a
+// route answering preflights locally, unless the upstream set it
+func (o *OptionsConfig) allowOrigin(r *http.Request, resp *http.Response) {
+	origin := r.Header.Get("Origin")
+	if o.Mode == OptionsProxy || origin == "" || !o.allowsOrigin(origin) ||
+		resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		return
+	}
+	resp.Header.Set("Access-Control-Allow-Origin", origin)
+	resp.Header.Add("Vary", "Origin")
+	if o.AllowCredentials {
+		resp.Header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// recordPreflight counts a CORS preflight; compared with the route's
+// requests it shows how well browsers cache preflights
+func (p *Proxy) recordPreflight(path string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	routeStat.Preflights++
+	p.stats.RouteStats[path] = routeStat
+}
@@ -0,0 +1,65 @@
+package main
+
+import "net/url"
+
+// RouteOwner says whom to contact about a route
+type RouteOwner struct {
+	Owner string `json:"owner,omitempty"`
+	Team  string `json:"team,omitempty"`
+}
+
+// owner returns the route's owner and team
+func (r Route) owner() RouteOwner {
+	return RouteOwner{Owner: r.Owner, Team: r.Team}
+}
+
+// routeOwners returns the owners of routes by path. Where routes share a
+// path, the first with an owner or team set wins.
+func routeOwners() map[string]RouteOwner {
+	owners := make(map[string]RouteOwner)
+	for _, route := range config.getRoutes() {
+		owner := route.owner()
+		if _, seen := owners[route.Path]; !seen && owner != (RouteOwner{}) {
+			owners[route.Path] = owner
+		}
+	}
+	return owners
+}
+
+// withOwners returns route stats labelled with their routes' owners
+func withOwners(stats map[string]RouteStat) map[string]RouteStat {
+	owners := routeOwners()
+	labelled := make(map[string]RouteStat, len(stats))
+	for path, rs := range stats {
+		rs.RouteOwner = owners[path]
+		labelled[path] = rs
+	}
+	return labelled
+}
+
+// withWindowOwners returns windowed route stats labelled with their
+// routes' owners
+func withWindowOwners(stats map[string]WindowRouteStat) map[string]WindowRouteStat {
+	owners := routeOwners()
+	for path, rs := range stats {
+		rs.RouteOwner = owners[path]
+		stats[path] = rs
+	}
+	return stats
+}
+
+// filterRoutesByOwner keeps the routes matching the owner and team query
+// parameters, when given
+func filterRoutesByOwner(routes []Route, query url.Values) []Route {
+	owner, team := query.Get("owner"), query.Get("team")
+	if owner == "" && team == "" {
+		return routes
+	}
+	filtered := []Route{}
+	for _, route := range routes {
+		if (owner == "" || route.Owner == owner) && (team == "" || route.Team == team) {
+			filtered = append(filtered, route)
+		}
+	}
+	return filtered
+}
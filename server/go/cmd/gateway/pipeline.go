@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RouteTypePipeline calls upstreams in sequence, feeding each step's
+// response into the next, and returns the last step's response
+const RouteTypePipeline = "pipeline"
+
+// PipelineConfig configures a pipeline route
+type PipelineConfig struct {
+	Steps []PipelineStep `json:"steps"`
+}
+
+// PipelineStep is one upstream call in a pipeline. URL, Body and Headers
+// may reference earlier results with {{<step>.<path>}} placeholders, or the
+// incoming request with {{request.query.<name>}}, {{request.header.<name>}}
+// and {{request.body.<path>}}, or the request context with
+// {{context.<path>}}, such as {{context.consumer}} or {{context.values.<key>}}.
+type PipelineStep struct {
+	Name           string            `json:"name"`
+	URL            string            `json:"url"`
+	Method         string            `json:"method,omitempty"`
+	Body           string            `json:"body,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	ForwardHeaders []string          `json:"forwardHeaders,omitempty"`
+}
+
+// pipelinePlaceholder matches {{reference}} placeholders
+var pipelinePlaceholder = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_.\-]+)\s*\}\}`)
+
+// pipelineScope holds the values placeholders resolve against
+type pipelineScope struct {
+	request *http.Request
+	body    interface{}
+	steps   map[string]interface{}
+}
+
+// resolve looks up a placeholder reference
+func (s *pipelineScope) resolve(ref string) (interface{}, bool) {
+	parts := strings.SplitN(ref, ".", 3)
+	if parts[0] == "request" && len(parts) >= 2 {
+		switch {
+		case parts[1] == "query" && len(parts) == 3:
+			if v := s.request.URL.Query().Get(parts[2]); v != "" {
+				return v, true
+			}
+			return nil, false
+		case parts[1] == "header" && len(parts) == 3:
+			if v := s.request.Header.Get(parts[2]); v != "" {
+				return v, true
+			}
+			return nil, false
+		case parts[1] == "body":
+			return lookupJSONPath(s.body, strings.TrimPrefix(strings.TrimPrefix(ref, "request.body"), "."))
+		}
+		return nil, false
+	}
+
+	if parts[0] == "context" {
+		rc := requestContext(s.request)
+		if rc == nil {
+			return nil, false
+		}
+		return lookupJSONPath(rc.document(), strings.TrimPrefix(strings.TrimPrefix(ref, "context"), "."))
+	}
+
+	name := parts[0]
+	value, ok := s.steps[name]
+	if !ok {
+		return nil, false
+	}
+	return lookupJSONPath(value, strings.TrimPrefix(strings.TrimPrefix(ref, name), "."))
+}
+
+// expand substitutes placeholders in template, formatting each value with format
+func (s *pipelineScope) expand(template string, format func(interface{}) string) (string, error) {
+	var missing []string
+	result := pipelinePlaceholder.ReplaceAllStringFunc(template, func(match string) string {
+		ref := pipelinePlaceholder.FindStringSubmatch(match)[1]
+		value, ok := s.resolve(ref)
+		if !ok {
+			missing = append(missing, ref)
+			return ""
+		}
+		return format(value)
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unresolved placeholders: %s", strings.Join(missing, ", "))
+	}
+	return result, nil
+}
+
+// plainValue formats a value for use in headers
+func plainValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// pathValue formats a value for use in a URL path segment
+func pathValue(v interface{}) string {
+	return url.PathEscape(plainValue(v))
+}
+
+// queryValue formats a value for use in a URL query, so it cannot add or
+// end parameters
+func queryValue(v interface{}) string {
+	return url.QueryEscape(plainValue(v))
+}
+
+// expandURL substitutes placeholders in a step URL, escaping each value
+// for the part of the URL it lands in
+func (s *pipelineScope) expandURL(template string) (string, error) {
+	path, query, hasQuery := strings.Cut(template, "?")
+	expanded, err := s.expand(path, pathValue)
+	if err != nil || !hasQuery {
+		return expanded, err
+	}
+	expandedQuery, err := s.expand(query, queryValue)
+	if err != nil {
+		return "", err
+	}
+	return expanded + "?" + expandedQuery, nil
+}
+
+// jsonValue formats a value for use in a JSON body
+func jsonValue(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// servePipeline runs the pipeline steps and relays the final response. It
+// reports whether the response written came from the final upstream.
+func servePipeline(w http.ResponseWriter, r *http.Request, route Route, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	// Share the route's transport, with its egress proxy and timeouts
+	transport, err := proxy.transport(route)
+	if err != nil {
+		log.Printf("Pipeline %s: %v", route.Path, err)
+		writeError(w, r, http.StatusBadGateway, ErrCodeUpstreamFailed, "Upstream proxy is misconfigured")
+		return false
+	}
+	client := &http.Client{Transport: transport}
+
+	scope := &pipelineScope{request: r, steps: make(map[string]interface{})}
+	if r.Body != nil {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxUpstreamJSONSize))
+		if err == nil && len(data) > 0 {
+			if isXMLContentType(r.Header.Get("Content-Type")) {
+				scope.body, _ = decodeXMLValue(bytes.NewReader(data))
+			} else {
+				json.Unmarshal(data, &scope.body)
+			}
+		}
+	}
+
+	steps := route.Pipeline.Steps
+	for i, step := range steps {
+		resp, err := doPipelineStep(ctx, client, scope, step)
+		if err != nil {
+			log.Printf("Pipeline step %s for %s failed: %v", step.Name, route.Path, err)
+			status := http.StatusBadGateway
+			if ctx.Err() == context.DeadlineExceeded {
+				status = http.StatusGatewayTimeout
+			}
+			writeErrorDetails(w, r, status, errorCodeForStatus(status), fmt.Sprintf("pipeline step %s failed", step.Name), map[string]string{"step": step.Name})
+			return false
+		}
+
+		// The final step's response goes back to the client with the
+		// headers a proxied response keeps
+		if i == len(steps)-1 {
+			defer resp.Body.Close()
+			for _, field := range resp.Header["Connection"] {
+				for _, name := range strings.Split(field, ",") {
+					resp.Header.Del(strings.TrimSpace(name))
+				}
+			}
+			filterResponseHeaders(resp, route)
+			for name, values := range resp.Header {
+				for _, v := range values {
+					w.Header().Add(name, v)
+				}
+			}
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return true
+		}
+
+		value, err := decodeUpstreamBody(resp)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 || err != nil {
+			log.Printf("Pipeline step %s for %s returned %s", step.Name, route.Path, resp.Status)
+			writeErrorDetails(w, r, http.StatusBadGateway, ErrCodeUpstreamFailed, fmt.Sprintf("pipeline step %s failed", step.Name), map[string]interface{}{"step": step.Name, "status": resp.StatusCode})
+			return false
+		}
+		scope.steps[step.Name] = value
+	}
+
+	return false
+}
+
+// doPipelineStep builds and sends the request for one step
+func doPipelineStep(ctx context.Context, client *http.Client, scope *pipelineScope, step PipelineStep) (*http.Response, error) {
+	target, err := scope.expandURL(step.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if step.Body != "" {
+		expanded, err := scope.expand(step.Body, jsonValue)
+		if err != nil {
+			return nil, err
+		}
+		body = strings.NewReader(expanded)
+	}
+
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json, application/xml;q=0.9, text/xml;q=0.9")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, name := range step.ForwardHeaders {
+		if v := scope.request.Header.Get(name); v != "" {
+			req.Header.Set(name, v)
+		}
+	}
+	for name, template := range step.Headers {
+		value, err := scope.expand(template, plainValue)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set(name, value)
+	}
+
+	return client.Do(req)
+}
+
+// checkPipelineURL requires a step URL to be absolute http or https with a
+// literal host, so placeholders can only fill in the path and query and
+// never redirect a step to another server
+func checkPipelineURL(template string) error {
+	scheme, rest, ok := strings.Cut(template, "://")
+	if !ok || (!strings.EqualFold(scheme, "http") && !strings.EqualFold(scheme, "https")) {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	host := rest
+	if i := strings.IndexAny(rest, "/?#"); i >= 0 {
+		host = rest[:i]
+	}
+	if strings.Contains(host, "{{") {
+		return fmt.Errorf("url host must not contain placeholders")
+	}
+	u, err := url.Parse(scheme + "://" + host)
+	if err != nil || u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("url must name a host")
+	}
+	return nil
+}
+
+// validatePipeline checks that a pipeline's steps are well formed and only
+// reference earlier steps
+func validatePipeline(cfg *PipelineConfig) error {
+	if cfg == nil || len(cfg.Steps) == 0 {
+		return fmt.Errorf("pipeline routes require at least one step")
+	}
+
+	seen := map[string]bool{"request": true, "context": true}
+	for _, step := range cfg.Steps {
+		if step.Name == "" || step.Name == "request" || step.Name == "context" {
+			return fmt.Errorf("pipeline steps require a name other than \"request\" or \"context\"")
+		}
+		if seen[step.Name] {
+			return fmt.Errorf("duplicate pipeline step name %q", step.Name)
+		}
+		if step.URL == "" {
+			return fmt.Errorf("pipeline step %q requires a url", step.Name)
+		}
+		if err := checkPipelineURL(step.URL); err != nil {
+			return fmt.Errorf("pipeline step %q: %v", step.Name, err)
+		}
+
+		templates := []string{step.URL, step.Body}
+		for _, v := range step.Headers {
+			templates = append(templates, v)
+		}
+		for _, template := range templates {
+			for _, match := range pipelinePlaceholder.FindAllStringSubmatch(template, -1) {
+				ref := strings.SplitN(match[1], ".", 2)[0]
+				if !seen[ref] {
+					return fmt.Errorf("pipeline step %q references %q before it runs", step.Name, ref)
+				}
+			}
+		}
+
+		seen[step.Name] = true
+	}
+
+	return nil
+}
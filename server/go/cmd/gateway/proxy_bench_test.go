@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/adevstack/ApiGateway/server/go/pkg/mockbackend"
+)
+
+// Benchmarks for the proxy path: each request goes through
+// handleProxyRequest to a mock backend on a loopback address. Run them with
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// The numbers cover route lookup, middleware, the reverse proxy and the
+// loopback round trip; compare runs on the same machine only.
+
+// benchmarkGateway starts a gateway whose one route, /svc, proxies to a
+// mock backend echoing each request. configure may adjust the route and
+// settings before the proxy is built.
+func benchmarkGateway(b *testing.B, configure func(*Config, *Route)) {
+	startTestGateway(b, mockbackend.New(mockbackend.Options{}), configure)
+}
+
+// runProxyBenchmark sends requests built by newRequest through the proxy
+// path, failing on any response other than 200
+func runProxyBenchmark(b *testing.B, newRequest func() *http.Request) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		handleProxyRequest(w, newRequest())
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+	}
+}
+
+func BenchmarkProxyGet(b *testing.B) {
+	benchmarkGateway(b, nil)
+	runProxyBenchmark(b, func() *http.Request {
+		return httptest.NewRequest("GET", "/svc/items?page=1", nil)
+	})
+}
+
+func BenchmarkProxyPost(b *testing.B) {
+	benchmarkGateway(b, nil)
+	payload := strings.Repeat(`{"field":"value"},`, 512)
+	b.SetBytes(int64(len(payload)))
+	runProxyBenchmark(b, func() *http.Request {
+		r := httptest.NewRequest("POST", "/svc/items", strings.NewReader(payload))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	})
+}
+
+func BenchmarkProxyRateLimited(b *testing.B) {
+	benchmarkGateway(b, func(cfg *Config, route *Route) {
+		cfg.EnableRateLimit = true
+		route.RateLimit = rateLimitPerMinute(1 << 30)
+	})
+	runProxyBenchmark(b, func() *http.Request {
+		return httptest.NewRequest("GET", "/svc/items", nil)
+	})
+}
+
+func BenchmarkProxyParallel(b *testing.B) {
+	benchmarkGateway(b, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			handleProxyRequest(w, httptest.NewRequest("GET", "/svc/items", nil))
+			if w.Code != http.StatusOK {
+				b.Errorf("status %d: %s", w.Code, w.Body.String())
+				return
+			}
+		}
+	})
+}
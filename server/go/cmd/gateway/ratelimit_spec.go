@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitUnits maps the period names a rate limit string may use
+var rateLimitUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour,
+}
+
+// RateLimit is a token bucket limit: Requests per Per, with bursts of up
+// to Burst requests (Requests when unset). In JSON it is either a number
+// of requests per minute, as limits have always been, or a string such as
+// "10/s", "1000/h", "500/10m" or "100/min burst 50".
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+
+	invalid string // a string that didn't parse, reported when validated
+}
+
+// rateLimitPerMinute returns a limit of n requests per minute
+func rateLimitPerMinute(n int) RateLimit {
+	return RateLimit{Requests: n, Per: time.Minute}
+}
+
+// parseRateLimit parses a rate limit string like "100/min burst 50". A
+// bare number is requests per minute.
+func parseRateLimit(s string) (RateLimit, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) != 1 && !(len(fields) == 3 && fields[1] == "burst") {
+		return RateLimit{}, fmt.Errorf("%q is not a rate limit: use <requests>/<period>, optionally followed by burst <n>", s)
+	}
+
+	requests, period, found := strings.Cut(fields[0], "/")
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return RateLimit{}, fmt.Errorf("%q is not a rate limit: %q is not a number of requests", s, requests)
+	}
+	limit := rateLimitPerMinute(n)
+	if found {
+		count, unit := 1, strings.TrimLeft(period, "0123456789")
+		if digits := strings.TrimSuffix(period, unit); digits != "" {
+			count, _ = strconv.Atoi(digits)
+		}
+		per, ok := rateLimitUnits[unit]
+		if !ok || count <= 0 {
+			return RateLimit{}, fmt.Errorf("%q is not a rate limit: unknown period %q; use s, min, h or d", s, period)
+		}
+		limit.Per = time.Duration(count) * per
+	}
+
+	if len(fields) == 3 {
+		burst, err := strconv.Atoi(fields[2])
+		if err != nil || burst < 1 {
+			return RateLimit{}, fmt.Errorf("%q is not a rate limit: burst must be a positive number", s)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// UnmarshalJSON accepts a number of requests per minute or a rate limit
+// string. Strings that don't parse are kept and reported by check, so
+// the error names the field.
+func (l *RateLimit) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*l = rateLimitPerMinute(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rate limit must be a number of requests per minute or a string like \"10/s\"")
+	}
+	limit, err := parseRateLimit(s)
+	if err != nil {
+		limit = RateLimit{invalid: s}
+	}
+	*l = limit
+	return nil
+}
+
+// MarshalJSON writes plain per-minute limits as numbers, so configs that
+// never used strings read back unchanged, and others as strings
+func (l RateLimit) MarshalJSON() ([]byte, error) {
+	if l.invalid != "" {
+		return json.Marshal(l.invalid)
+	}
+	if l.Burst == 0 && (l.Per == time.Minute || l.Requests == 0) {
+		return json.Marshal(l.Requests)
+	}
+	return json.Marshal(l.String())
+}
+
+// String formats the limit as it would be written in a config
+func (l RateLimit) String() string {
+	if l.invalid != "" {
+		return l.invalid
+	}
+	s := strconv.Itoa(l.Requests) + "/" + formatRatePeriod(l.Per)
+	if l.Burst > 0 {
+		s += " burst " + strconv.Itoa(l.Burst)
+	}
+	return s
+}
+
+// formatRatePeriod names a period in the largest unit that divides it
+func formatRatePeriod(per time.Duration) string {
+	for _, u := range []struct {
+		name string
+		d    time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"min", time.Minute}, {"s", time.Second}} {
+		if per%u.d == 0 {
+			if per == u.d {
+				return u.name
+			}
+			return strconv.Itoa(int(per/u.d)) + u.name
+		}
+	}
+	return strconv.Itoa(int(per/time.Second)) + "s"
+}
+
+// isSet reports whether a limit was configured; unset limits fall back
+// to the default
+func (l RateLimit) isSet() bool {
+	return l.Requests > 0
+}
+
+// capacity returns the most requests the bucket admits at once
+func (l RateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// refillRate returns the tokens the bucket regains per second
+func (l RateLimit) refillRate() float64 {
+	if l.Per <= 0 {
+		return 0
+	}
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// checkRateLimit reports a rate limit string that didn't parse or a
+// negative limit
+func checkRateLimit(field string, l RateLimit, v *ValidationError) {
+	if l.invalid != "" {
+		_, err := parseRateLimit(l.invalid)
+		v.add(field, "%v", err)
+		return
+	}
+	if l.Requests < 0 {
+		v.add(field, "must not be negative")
+	}
+}
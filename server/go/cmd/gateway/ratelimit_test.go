@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitKeyFromHeader(t *testing.T) {
+	route := Route{Path: "/svc", RateLimitKey: "header:X-User"}
+	if !validRateLimitKey(route.RateLimitKey) {
+		t.Fatalf("%s rejected", route.RateLimitKey)
+	}
+
+	r := httptest.NewRequest("GET", "/svc", nil)
+	r.Header.Set("X-User", "alice")
+	if got := rateLimitBucketKey(r, route); got != "/svc|header=alice" {
+		t.Fatalf("key = %q, want /svc|header=alice", got)
+	}
+
+	r.Header.Del("X-User")
+	if got := rateLimitBucketKey(r, route); got != "/svc|ip="+clientIP(r).String() {
+		t.Fatalf("key without the header = %q, want the client IP", got)
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rl := newRateLimiter(ctx, defaultConfig(""))
+	limit := rateLimitPerMinute(1)
+
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		rl.getBucket("/svc|ip="+strconv.Itoa(i), limit)
+	}
+	// Using the first bucket again keeps it; the second is now the oldest
+	rl.getBucket("/svc|ip=0", limit)
+	if !rl.allow("/svc|ip=new", limit) {
+		t.Fatal("a new client past the cap was limited by another's bucket")
+	}
+	if rl.allow("/svc|ip=new", limit) {
+		t.Fatal("the new client's bucket was not kept")
+	}
+	if _, ok := rl.buckets["/svc|ip=1"]; ok {
+		t.Fatal("the least recently used bucket was kept")
+	}
+	if _, ok := rl.buckets["/svc|ip=0"]; !ok {
+		t.Fatal("a recently used bucket was dropped")
+	}
+	if len(rl.buckets) != maxRateLimitBuckets || rl.order.Len() != maxRateLimitBuckets {
+		t.Fatalf("%d buckets, want %d", len(rl.buckets), maxRateLimitBuckets)
+	}
+
+	rl.pruneBuckets(time.Now().Add(rateLimitIdleTTL + time.Minute))
+	if len(rl.buckets) != 0 || rl.order.Len() != 0 {
+		t.Fatalf("%d buckets left after all went idle", len(rl.buckets))
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Readiness actions for proxied requests that arrive before the gateway is
+// ready
+const (
+	ReadinessPass   = "pass"
+	ReadinessQueue  = "queue"
+	ReadinessReject = "reject"
+)
+
+// Readiness defaults
+const (
+	defaultReadinessMaxWait = 30
+	readinessRetryAfter     = 5
+)
+
+// ReadinessConfig holds the gateway back after startup until critical
+// upstreams pass their first health check, so a deploy does not answer its
+// first requests with a burst of errors
+type ReadinessConfig struct {
+	Services []string `json:"services,omitempty"` // service names (target hosts) that must be healthy
+	Timeout  int      `json:"timeout,omitempty"`  // seconds after which the gateway is ready regardless; 0 waits
+	Action   string   `json:"action,omitempty"`   // for requests before ready: pass (default), queue or reject
+	MaxWait  int      `json:"maxWait,omitempty"`  // seconds a queued request waits before a 503; defaults to 30
+}
+
+// checkReadiness validates readiness settings
+func checkReadiness(c ReadinessConfig, v *ValidationError) {
+	checkNonNegative("readiness", []namedInt{
+		{"timeout", c.Timeout},
+		{"maxWait", c.MaxWait},
+	}, v)
+	switch c.Action {
+	case "", ReadinessPass, ReadinessQueue, ReadinessReject:
+	default:
+		v.add("readiness.action", "unknown action %q: use pass, queue or reject", c.Action)
+	}
+	for _, name := range c.Services {
+		if name == "" || strings.ContainsAny(name, "/: ") {
+			v.add("readiness.services", "invalid service name %q: use the target host", name)
+		}
+	}
+}
+
+// maxWait returns how long a queued request waits for readiness
+func (c ReadinessConfig) maxWait() time.Duration {
+	if c.MaxWait <= 0 {
+		return defaultReadinessMaxWait * time.Second
+	}
+	return time.Duration(c.MaxWait) * time.Second
+}
+
+// readinessGate opens once the gateway is ready for traffic. It never
+// closes again: later health changes are handled per route.
+type readinessGate struct {
+	ready chan struct{}
+	once  sync.Once
+
+	mutex   sync.Mutex
+	readyAt time.Time
+	reason  string
+	holds   int // reloads in progress; probes fail while any is
+}
+
+// readiness tracks whether the gateway is ready for traffic
+var readiness = &readinessGate{ready: make(chan struct{})}
+
+// open marks the gateway ready
+func (g *readinessGate) open(reason string) {
+	g.once.Do(func() {
+		g.mutex.Lock()
+		g.readyAt, g.reason = time.Now(), reason
+		g.mutex.Unlock()
+		close(g.ready)
+		log.Printf("Gateway ready: %s", reason)
+	})
+}
+
+// hold fails readiness probes until release, as while a reload settles.
+// Requests are still served: the probe only takes the replica out of
+// rotation.
+func (g *readinessGate) hold() {
+	g.mutex.Lock()
+	g.holds++
+	g.mutex.Unlock()
+}
+
+// release ends a hold
+func (g *readinessGate) release() {
+	g.mutex.Lock()
+	g.holds--
+	g.mutex.Unlock()
+}
+
+// isReady reports whether the gate is open
+func (g *readinessGate) isReady() bool {
+	select {
+	case <-g.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// start opens the gate at once if no critical services are configured, and
+// otherwise arms the timeout
+func (g *readinessGate) start(c ReadinessConfig, p *Proxy) {
+	if len(c.Services) == 0 {
+		g.open("no critical services configured")
+		return
+	}
+	for _, name := range c.Services {
+		if _, ok := p.getService(name); !ok {
+			log.Printf("Warning: readiness waits for %s, which no route targets", name)
+		}
+	}
+	log.Printf("Waiting for %s to pass health checks before accepting traffic", strings.Join(c.Services, ", "))
+	if c.Timeout > 0 {
+		time.AfterFunc(time.Duration(c.Timeout)*time.Second, func() {
+			g.open(fmt.Sprintf("timed out after %ds waiting for %s", c.Timeout, strings.Join(p.pendingServices(), ", ")))
+		})
+	}
+	p.checkReadiness()
+}
+
+// pendingServices returns the critical services not yet healthy
+func (p *Proxy) pendingServices() []string {
+	var pending []string
+	for _, name := range p.config.settings().Readiness.Services {
+		if svc, ok := p.getService(name); !ok || svc.Status != "healthy" {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
+
+// checkReadiness opens the readiness gate once every critical service is
+// healthy
+func (p *Proxy) checkReadiness() {
+	if readiness.isReady() {
+		return
+	}
+	if len(p.pendingServices()) == 0 {
+		readiness.open("critical services healthy")
+	}
+}
+
+// admit applies the readiness action to a proxied request. It reports
+// whether the request may proceed; otherwise it has been answered.
+func (g *readinessGate) admit(w http.ResponseWriter, r *http.Request, c ReadinessConfig) bool {
+	if g.isReady() {
+		return true
+	}
+	switch c.Action {
+	case ReadinessQueue:
+		timer := time.NewTimer(c.maxWait())
+		defer timer.Stop()
+		select {
+		case <-g.ready:
+			return true
+		case <-r.Context().Done():
+			return false
+		case <-timer.C:
+		}
+	case ReadinessReject:
+	default:
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(readinessRetryAfter))
+	writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Gateway is not ready")
+	return false
+}
+
+// ReadinessStatus reports whether the gateway is ready for traffic
+type ReadinessStatus struct {
+	Ready     bool       `json:"ready"`
+	ReadyAt   *time.Time `json:"readyAt,omitempty"`
+	Reason    string     `json:"reason,omitempty"`    // why the gateway became ready
+	Waiting   []string   `json:"waiting,omitempty"`   // critical services not yet healthy
+	Reloading bool       `json:"reloading,omitempty"` // a config reload is settling
+}
+
+// handleReady answers readiness probes: 200 once the gateway is ready,
+// 503 until then and while a config reload settles
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	var status ReadinessStatus
+	if readiness.isReady() {
+		readiness.mutex.Lock()
+		readyAt := readiness.readyAt
+		status = ReadinessStatus{Ready: true, ReadyAt: &readyAt, Reason: readiness.reason}
+		if readiness.holds > 0 {
+			status = ReadinessStatus{Reloading: true, Waiting: proxy.pendingServices()}
+		}
+		readiness.mutex.Unlock()
+	} else {
+		status.Waiting = proxy.pendingServices()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
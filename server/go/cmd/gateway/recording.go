@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Recording defaults
+const (
+	defaultRecordMaxBody     = 64 << 10
+	defaultRecordMaxFileSize = 100 << 20
+)
+
+// replayedHeader marks requests sent by the replay tool, which are not
+// recorded again
+const replayedHeader = "X-Replayed"
+
+// sensitiveHeaders are never recorded
+var sensitiveHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+	"X-Api-Secret",
+}
+
+// RecordingConfig samples proxied requests to a file for replay against
+// another gateway. Credentials are always stripped; other sensitive
+// values are redacted as configured.
+type RecordingConfig struct {
+	Enabled       bool     `json:"enabled"`
+	File          string   `json:"file,omitempty"`          // JSON lines, appended
+	SampleRate    float64  `json:"sampleRate,omitempty"`    // fraction of requests recorded, 0 to 1
+	Routes        []int    `json:"routes,omitempty"`        // route IDs to record; empty records all
+	MaxBody       int64    `json:"maxBody,omitempty"`       // skip requests with larger bodies; defaults to 64 KiB
+	MaxFileSize   int64    `json:"maxFileSize,omitempty"`   // stop recording at this size; defaults to 100 MiB
+	RedactHeaders []string `json:"redactHeaders,omitempty"` // headers replaced with ***
+	RedactQuery   []string `json:"redactQuery,omitempty"`   // query parameters replaced with ***
+	RedactBody    []string `json:"redactBody,omitempty"`    // dotted JSON paths or XPath expressions
+}
+
+// checkRecording validates the recording settings
+func checkRecording(c RecordingConfig, v *ValidationError) {
+	if c.Enabled && c.File == "" {
+		v.add("recording.file", "is required when recording is enabled")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		v.add("recording.sampleRate", "must be between 0 and 1")
+	}
+	if c.MaxBody < 0 {
+		v.add("recording.maxBody", "must not be negative")
+	}
+	if c.MaxFileSize < 0 {
+		v.add("recording.maxFileSize", "must not be negative")
+	}
+	for _, p := range c.RedactBody {
+		if isXPath(p) {
+			if _, err := parseXPath(p); err != nil {
+				v.add("recording.redactBody", "%v", err)
+			}
+		}
+	}
+}
+
+// RecordedRequest is one line of a recording
+type RecordedRequest struct {
+	Time         time.Time   `json:"time"`
+	RouteID      int         `json:"routeId"`
+	Method       string      `json:"method"`
+	Host         string      `json:"host"`
+	URI          string      `json:"uri"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"` // "base64" for binary bodies
+}
+
+// trafficRecorder appends sampled requests to the recording file
+type trafficRecorder struct {
+	mutex   sync.Mutex
+	cfg     RecordingConfig
+	file    *os.File
+	size    int64
+	full    bool
+	enabled bool
+}
+
+// traffic records sampled requests when recording is enabled
+var traffic = &trafficRecorder{}
+
+// configure applies recording settings, reopening the file if it changed
+func (t *trafficRecorder) configure(cfg RecordingConfig) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file != nil && (!cfg.Enabled || cfg.File != t.cfg.File) {
+		t.file.Close()
+		t.file = nil
+	}
+	t.cfg = cfg
+	t.enabled = false
+	if !cfg.Enabled {
+		return
+	}
+
+	if t.file == nil {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Printf("Failed to open recording file %s: %v", cfg.File, err)
+			return
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			log.Printf("Failed to open recording file %s: %v", cfg.File, err)
+			return
+		}
+		t.file = f
+		t.size = info.Size()
+		t.full = false
+	}
+	t.enabled = true
+	log.Printf("Recording %.1f%% of requests to %s", cfg.SampleRate*100, cfg.File)
+}
+
+// reopen closes and reopens the recording file, picking up a new file
+// after the old one was moved aside
+func (t *trafficRecorder) reopen() {
+	t.mutex.Lock()
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	cfg := t.cfg
+	t.mutex.Unlock()
+	t.configure(cfg)
+}
+
+// sample decides whether to record a request on a route. A route's
+// capture sampling rate replaces the recording sample rate and route list.
+func (t *trafficRecorder) sample(r *http.Request, route Route) (RecordingConfig, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if !t.enabled || t.full {
+		return t.cfg, false
+	}
+	if capture, set := captureSampled(r); set {
+		return t.cfg, capture
+	}
+	if rand.Float64() >= t.cfg.SampleRate {
+		return t.cfg, false
+	}
+	if len(t.cfg.Routes) == 0 {
+		return t.cfg, true
+	}
+	for _, id := range t.cfg.Routes {
+		if id == route.ID {
+			return t.cfg, true
+		}
+	}
+	return t.cfg, false
+}
+
+// record captures a sanitized copy of a request if it is sampled. The
+// body is read and replaced so the request can still be proxied.
+func (t *trafficRecorder) record(r *http.Request, route Route) {
+	if r.Header.Get(replayedHeader) != "" {
+		return
+	}
+	cfg, ok := t.sample(r, route)
+	if !ok {
+		return
+	}
+
+	entry := RecordedRequest{
+		Time:    time.Now().UTC(),
+		RouteID: route.ID,
+		Method:  r.Method,
+		Host:    r.Host,
+		URI:     redactQuery(r.URL, cfg.RedactQuery),
+		Header:  redactHeaders(r.Header, cfg.RedactHeaders),
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		maxBody := cfg.MaxBody
+		if maxBody <= 0 {
+			maxBody = defaultRecordMaxBody
+		}
+		if r.ContentLength > maxBody {
+			return
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBody+1))
+		if int64(len(data)) > maxBody || err != nil {
+			// Too large to record; put back what was read
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+			return
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if r.GetBody == nil {
+			r.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(data)), nil
+			}
+		}
+
+		redacted, err := redactBody(data, cfg.RedactBody, isXMLContentType(r.Header.Get("Content-Type")))
+		if err != nil {
+			// Never record a body we could not redact
+			return
+		}
+		if utf8.Valid(redacted) {
+			entry.Body = string(redacted)
+		} else {
+			entry.Body = base64.StdEncoding.EncodeToString(redacted)
+			entry.BodyEncoding = "base64"
+		}
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	t.write(append(line, '\n'))
+}
+
+// write appends a line, stopping once the file reaches its maximum size
+func (t *trafficRecorder) write(line []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil || t.full {
+		return
+	}
+	limit := t.cfg.MaxFileSize
+	if limit <= 0 {
+		limit = defaultRecordMaxFileSize
+	}
+	if t.size+int64(len(line)) > limit {
+		t.full = true
+		log.Printf("Recording file %s reached %d bytes, recording stopped", t.cfg.File, limit)
+		return
+	}
+
+	n, err := t.file.Write(line)
+	t.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write recording: %v", err)
+	}
+}
+
+// redactHeaders copies headers without credentials, replacing the values
+// of the configured headers
+func redactHeaders(h http.Header, redact []string) http.Header {
+	out := h.Clone()
+	for _, name := range sensitiveHeaders {
+		out.Del(name)
+	}
+	for _, name := range redact {
+		if out.Get(name) != "" {
+			out.Set(name, redactedValue)
+		}
+	}
+	return out
+}
+
+// redactQuery returns the request URI with the configured query
+// parameters replaced
+func redactQuery(u *url.URL, redact []string) string {
+	if len(redact) == 0 || u.RawQuery == "" {
+		return u.RequestURI()
+	}
+
+	q := u.Query()
+	for _, name := range redact {
+		for key := range q {
+			if strings.EqualFold(key, name) {
+				q[key] = []string{redactedValue}
+			}
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.RequestURI()
+}
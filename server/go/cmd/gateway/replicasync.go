@@ -0,0 +1,639 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Replica sync backends
+const (
+	SyncBackendNATS  = "nats"
+	SyncBackendRedis = "redis"
+
+	defaultSyncChannel = "gateway.config"
+
+	// Replicas reconnect to the broker with backoff up to this long
+	maxSyncBackoff = 30 * time.Second
+)
+
+// errSyncClosed ends a subscription begun after its transport was closed
+var errSyncClosed = errors.New("sync: transport closed")
+
+// errRouteConflict rejects a remote change whose route ID belongs to
+// another route here, as when two replicas create a route at once
+var errRouteConflict = errors.New("route ID conflict")
+
+// SyncConfig shares route changes made through one replica's admin API
+// with the other replicas over NATS or Redis pub/sub, so each applies them
+// within seconds instead of being reconfigured individually
+type SyncConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Backend   string `json:"backend"`             // "nats" or "redis"
+	URL       string `json:"url"`                 // nats://host:4222 or redis://[:password@]host:6379
+	Channel   string `json:"channel,omitempty"`   // subject or channel; defaults to gateway.config
+	ReplicaID string `json:"replicaId,omitempty"` // names this replica in messages; defaults to host name and process ID
+}
+
+// checkSync validates the replica sync settings
+func checkSync(c SyncConfig, v *ValidationError) {
+	if !c.Enabled {
+		return
+	}
+	switch strings.ToLower(c.Backend) {
+	case SyncBackendNATS, SyncBackendRedis:
+	default:
+		v.add("sync.backend", "must be nats or redis")
+	}
+	if c.URL == "" {
+		v.add("sync.url", "is required when sync is enabled")
+	}
+}
+
+// SyncMessage is a route change as replicas exchange it
+type SyncMessage struct {
+	Replica  string    `json:"replica"`
+	Kind     string    `json:"kind"`               // created, updated or deleted
+	Route    *Route    `json:"route"`              // the route as changed; for deletions, as it was
+	Previous *Route    `json:"previous,omitempty"` // for updates, the route as it was
+	Time     time.Time `json:"time"`
+}
+
+// SyncStatus reports what replica sync has exchanged
+type SyncStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Replica     string     `json:"replica,omitempty"`
+	Backend     string     `json:"backend,omitempty"`
+	Connected   bool       `json:"connected"`
+	Published   int64      `json:"published"`
+	Applied     int64      `json:"applied"`
+	Rejected    int64      `json:"rejected"`  // remote changes that failed validation here
+	Conflicts   int64      `json:"conflicts"` // rejected changes whose route ID is another route here
+	LastApplied *time.Time `json:"lastApplied,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+// syncTransport carries sync messages over a broker
+type syncTransport interface {
+	publish(payload []byte) error
+	// subscribe calls ready once subscribed, then handle for each message
+	// until the connection fails or the transport is closed
+	subscribe(ready func(), handle func(payload []byte)) error
+	close()
+}
+
+// replicaSync publishes local route changes and applies remote ones
+type replicaSync struct {
+	transport syncTransport
+	queue     chan []byte
+	worker    worker // the publish and receive loops
+
+	mutex  sync.Mutex
+	status SyncStatus
+}
+
+// replicas syncs route changes with other replicas; nil when disabled
+var replicas atomic.Pointer[replicaSync]
+
+// newReplicaSync starts syncing with the other replicas until ctx is done,
+// or returns nil when sync is disabled
+func newReplicaSync(ctx context.Context, cfg SyncConfig) (*replicaSync, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	channel := cfg.Channel
+	if channel == "" {
+		channel = defaultSyncChannel
+	}
+
+	var transport syncTransport
+	backend := strings.ToLower(cfg.Backend)
+	switch backend {
+	case SyncBackendNATS:
+		transport = newNATSSync(cfg.URL, channel)
+	case SyncBackendRedis:
+		t, err := newRedisSync(cfg.URL, channel)
+		if err != nil {
+			return nil, err
+		}
+		transport = t
+	default:
+		return nil, fmt.Errorf("sync: unsupported backend %q", cfg.Backend)
+	}
+
+	id := replicaName(cfg.ReplicaID)
+	s := &replicaSync{
+		transport: transport,
+		queue:     make(chan []byte, 256),
+		status:    SyncStatus{Enabled: true, Replica: id, Backend: backend},
+	}
+	s.worker.start(ctx, func(ctx context.Context) {
+		var receiving sync.WaitGroup
+		receiving.Add(1)
+		go func() {
+			defer receiving.Done()
+			s.receiveLoop(ctx)
+		}()
+		s.publishLoop(ctx)
+		receiving.Wait()
+	})
+	return s, nil
+}
+
+// stop ends syncing and waits for the loops to exit
+func (s *replicaSync) stop() {
+	if s != nil {
+		s.worker.stop()
+	}
+}
+
+// replicaName returns the configured replica ID, or one made of the host
+// name and process ID
+func replicaName(id string) string {
+	if id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// routeChanged queues a local route change for the other replicas
+func (s *replicaSync) routeChanged(change RouteChange) {
+	if s == nil || change.Remote {
+		return
+	}
+	route := change.New
+	if route == nil {
+		route = change.Old
+	}
+	msg := SyncMessage{Replica: s.status.Replica, Kind: change.Kind, Route: route, Time: time.Now().UTC()}
+	if change.New != nil {
+		msg.Previous = change.Old
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode route change for sync: %v", err)
+		return
+	}
+	select {
+	case s.queue <- payload:
+	default:
+		log.Printf("Sync queue full, dropping change of route %d", route.ID)
+	}
+}
+
+// publishLoop sends queued changes until ctx is done, then closes the
+// transport, which ends the subscription
+func (s *replicaSync) publishLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			s.transport.close()
+			return
+		case payload := <-s.queue:
+			err := s.transport.publish(payload)
+			s.mutex.Lock()
+			if err != nil {
+				s.status.LastError = err.Error()
+			} else {
+				s.status.Published++
+			}
+			s.mutex.Unlock()
+			if err != nil {
+				log.Printf("Failed to publish route change: %v", err)
+			}
+		}
+	}
+}
+
+// receiveLoop applies remote changes, resubscribing with backoff when the
+// connection fails. Changes published while disconnected are not replayed.
+func (s *replicaSync) receiveLoop(ctx context.Context) {
+	backoff := time.Second
+	for {
+		err := s.transport.subscribe(func() {
+			backoff = time.Second
+			s.setConnected(true, "")
+			log.Printf("Syncing route changes as replica %s", s.status.Replica)
+		}, s.apply)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		s.setConnected(false, fmt.Sprint(err))
+		log.Printf("Replica sync disconnected: %v; retrying in %v", err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxSyncBackoff {
+			backoff = maxSyncBackoff
+		}
+	}
+}
+
+// setConnected records the subscription state
+func (s *replicaSync) setConnected(connected bool, lastError string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Connected = connected
+	if lastError != "" {
+		s.status.LastError = lastError
+	}
+}
+
+// apply makes a change published by another replica here, validating it
+// against the local routes. Changes are matched to routes by ID; the last
+// one received wins. A change to an ID that is a different route here is
+// rejected as a conflict.
+func (s *replicaSync) apply(payload []byte) {
+	var msg SyncMessage
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Route == nil {
+		log.Printf("Ignoring malformed sync message: %s", payload)
+		return
+	}
+	if msg.Replica == s.status.Replica {
+		return
+	}
+
+	route := *msg.Route
+	if err := applyRemoteChange(msg.Kind, route, msg.Previous); err != nil {
+		log.Printf("Rejected %s of route %d from replica %s: %v", msg.Kind, route.ID, msg.Replica, err)
+		s.mutex.Lock()
+		s.status.Rejected++
+		if errors.Is(err, errRouteConflict) {
+			s.status.Conflicts++
+			s.status.LastError = err.Error()
+		}
+		s.mutex.Unlock()
+		return
+	}
+	log.Printf("Applied %s of route %d from replica %s", msg.Kind, route.ID, msg.Replica)
+	now := time.Now()
+	s.mutex.Lock()
+	s.status.Applied++
+	s.status.LastApplied = &now
+	s.mutex.Unlock()
+}
+
+// applyRemoteChange creates, updates or deletes a route as another replica
+// did, persisting it and reconciling state derived from routes. previous is
+// an updated route as the other replica had it.
+func applyRemoteChange(kind string, route Route, previous *Route) error {
+	routeWrites.Lock()
+	defer routeWrites.Unlock()
+	current, found := config.getRoute(route.ID)
+	if found && current.source != "" {
+		return fmt.Errorf("%s", includedRouteMessage(current))
+	}
+	if found && routeKey(current) != routeKey(route) && (previous == nil || routeKey(current) != routeKey(*previous)) {
+		return fmt.Errorf("%w: route %d is %s here, not %s", errRouteConflict, route.ID, routeKey(current), routeKey(route))
+	}
+
+	if kind == RouteDeleted {
+		old, found := config.deleteRoute(route.ID)
+		if !found {
+			return nil
+		}
+		routeChanges.notify(RouteChange{Kind: RouteDeleted, Old: &old, Remote: true})
+		return store.DeleteRoute(route.ID)
+	}
+	if kind != RouteCreated && kind != RouteUpdated {
+		return fmt.Errorf("unknown change %q", kind)
+	}
+
+	if err := validateRoute(&route, config.getRoutes(), config); err != nil {
+		return err
+	}
+	change := RouteChange{Kind: RouteUpdated, New: &route, Remote: true}
+	if old, found := config.upsertRoute(route); found {
+		change.Old = &old
+	} else {
+		change.Kind = RouteCreated
+	}
+	routeChanges.notify(change)
+	return store.SaveRoute(route)
+}
+
+// upsertRoute replaces the route with the same ID, or adds the route
+// keeping its ID, and returns the replaced route
+func (c *Config) upsertRoute(route Route) (Route, bool) {
+	c.routesMutex.Lock()
+	defer c.routesMutex.Unlock()
+
+	if route.ID >= c.nextRouteID {
+		c.nextRouteID = route.ID + 1
+	}
+	for i, r := range c.Routes {
+		if r.ID == route.ID {
+			c.Routes[i] = route
+			return r, true
+		}
+	}
+	c.Routes = append(c.Routes, route)
+	return Route{}, false
+}
+
+// handleSync reports replica sync activity
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	replicas := replicas.Load()
+	if replicas == nil {
+		writeJSON(w, SyncStatus{})
+		return
+	}
+	replicas.mutex.Lock()
+	status := replicas.status
+	replicas.mutex.Unlock()
+	writeJSON(w, status)
+}
+
+// natsSync exchanges sync messages on a NATS subject
+type natsSync struct {
+	publisher *natsPublisher
+	subject   string
+
+	mutex  sync.Mutex
+	sub    net.Conn
+	closed bool
+}
+
+// newNATSSync creates a NATS transport; connections are made lazily
+func newNATSSync(rawURL, subject string) *natsSync {
+	return &natsSync{publisher: newNATSPublisher(rawURL, ""), subject: subject}
+}
+
+// publish sends a message on the subject
+func (n *natsSync) publish(payload []byte) error {
+	return n.publisher.publishTo(n.subject, payload)
+}
+
+// subscribe reads messages on the subject from a connection of its own
+func (n *natsSync) subscribe(ready func(), handle func([]byte)) error {
+	conn, err := net.DialTimeout("tcp", n.publisher.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if !n.setSub(conn) {
+		conn.Close()
+		return errSyncClosed
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		return fmt.Errorf("nats: reading INFO: %v", err)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"api-gateway-sync\"}\r\nSUB %s 1\r\n", n.subject); err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			if _, err := conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		case strings.HasPrefix(line, "MSG "):
+			// MSG <subject> <sid> [reply-to] <size>
+			fields := strings.Fields(line)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("nats: malformed %q", line)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return err
+			}
+			handle(payload[:size])
+		}
+	}
+}
+
+// setSub remembers the subscription connection so close can end it. It
+// reports false once the transport is closed.
+func (n *natsSync) setSub(conn net.Conn) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.sub = conn
+	return !n.closed
+}
+
+// close closes both connections
+func (n *natsSync) close() {
+	n.publisher.Close()
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.closed = true
+	if n.sub != nil {
+		n.sub.Close()
+	}
+}
+
+// redisSync exchanges sync messages on a Redis pub/sub channel
+type redisSync struct {
+	addr     string
+	username string
+	password string
+	channel  string
+
+	mutex     sync.Mutex
+	pub       net.Conn
+	pubReader *bufio.Reader
+	sub       net.Conn
+	closed    bool
+}
+
+// newRedisSync creates a Redis transport from a redis:// URL
+func newRedisSync(rawURL, channel string) (*redisSync, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("sync: invalid redis URL %q", rawURL)
+	}
+	r := &redisSync{addr: u.Host, channel: channel}
+	if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.username = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	return r, nil
+}
+
+// dial connects and authenticates
+func (r *redisSync) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, 5*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	if r.password != "" {
+		args := []string{"AUTH", r.password}
+		if r.username != "" {
+			args = []string{"AUTH", r.username, r.password}
+		}
+		if _, err := redisCommand(conn, reader, args...); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, reader, nil
+}
+
+// publish sends a message on the channel, reconnecting if needed
+func (r *redisSync) publish(payload []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.pub == nil {
+		conn, reader, err := r.dial()
+		if err != nil {
+			return err
+		}
+		r.pub, r.pubReader = conn, reader
+	}
+	if _, err := redisCommand(r.pub, r.pubReader, "PUBLISH", r.channel, string(payload)); err != nil {
+		// Drop the connection so the next publish reconnects
+		r.pub.Close()
+		r.pub = nil
+		return err
+	}
+	return nil
+}
+
+// subscribe reads messages on the channel from a connection of its own;
+// a subscribed Redis connection can't publish
+func (r *redisSync) subscribe(ready func(), handle func([]byte)) error {
+	conn, reader, err := r.dial()
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	r.sub = conn
+	closed := r.closed
+	r.mutex.Unlock()
+	defer conn.Close()
+	if closed {
+		return errSyncClosed
+	}
+
+	if _, err := redisCommand(conn, reader, "SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+	ready()
+
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return err
+		}
+		// ["message", channel, payload]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		if payload, ok := parts[2].(string); ok {
+			handle([]byte(payload))
+		}
+	}
+}
+
+// close closes both connections
+func (r *redisSync) close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	if r.pub != nil {
+		r.pub.Close()
+		r.pub = nil
+	}
+	if r.sub != nil {
+		r.sub.Close()
+	}
+}
+
+// redisCommand sends a command and reads its reply
+func redisCommand(conn net.Conn, reader *bufio.Reader, args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(reader)
+}
+
+// readRESP reads one reply of the Redis protocol: simple strings, errors,
+// integers, bulk strings and arrays of them
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = readRESP(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
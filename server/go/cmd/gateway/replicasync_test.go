@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedis is a Redis server that only does SUBSCRIBE and PUBLISH
+type testRedis struct {
+	ln          net.Listener
+	mutex       sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newTestRedis(t *testing.T) *testRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testRedis{ln: ln, subscribers: make(map[string][]net.Conn)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// url returns the server's redis:// URL
+func (s *testRedis) url() string {
+	return "redis://" + s.ln.Addr().String()
+}
+
+// serve answers one connection's commands
+func (s *testRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, _ := reply.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		switch command, _ := args[0].(string); strings.ToUpper(command) {
+		case "SUBSCRIBE":
+			channel := args[1].(string)
+			s.mutex.Lock()
+			s.subscribers[channel] = append(s.subscribers[channel], conn)
+			fmt.Fprintf(conn, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(channel), channel)
+			s.mutex.Unlock()
+		case "PUBLISH":
+			channel, payload := args[1].(string), args[2].(string)
+			s.mutex.Lock()
+			subscribers := s.subscribers[channel]
+			for _, sub := range subscribers {
+				fmt.Fprintf(sub, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(channel), channel, len(payload), payload)
+			}
+			s.mutex.Unlock()
+			fmt.Fprintf(conn, ":%d\r\n", len(subscribers))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command\r\n")
+		}
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds pass
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// syncStatus returns a copy of a replica's status
+func (s *replicaSync) syncStatus() SyncStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+func TestReplicaSyncOverRedis(t *testing.T) {
+	cfg := startTestGateway(t, http.NotFoundHandler(), nil)
+	prevStore := store
+	fileStore, err := newFileStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = fileStore
+	t.Cleanup(func() { store = prevStore })
+
+	broker := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	local, err := newReplicaSync(ctx, SyncConfig{Enabled: true, Backend: SyncBackendRedis, URL: broker.url(), ReplicaID: "local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.stop()
+	defer cancel()
+
+	// The test plays the other replica with a transport of its own
+	remote, err := newRedisSync(broker.url(), defaultSyncChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.close()
+	received := make(chan SyncMessage, 8)
+	go remote.subscribe(func() {}, func(payload []byte) {
+		var msg SyncMessage
+		json.Unmarshal(payload, &msg)
+		received <- msg
+	})
+	waitFor(t, "both replicas to subscribe", func() bool {
+		broker.mutex.Lock()
+		defer broker.mutex.Unlock()
+		return len(broker.subscribers[defaultSyncChannel]) == 2
+	})
+	publish := func(msg SyncMessage) {
+		payload, _ := json.Marshal(msg)
+		if err := remote.publish(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	route := Route{ID: 5, Path: "/other", Target: "http://127.0.0.1:1", Methods: []string{"GET"}, Timeout: 10, Active: true}
+	publish(SyncMessage{Replica: "remote", Kind: RouteCreated, Route: &route})
+	waitFor(t, "the remote route", func() bool { return local.syncStatus().Applied == 1 })
+	if got, ok := cfg.getRoute(5); !ok || got.Path != "/other" {
+		t.Fatalf("route 5 = %+v, %v after the remote change", got, ok)
+	}
+
+	invalid := route
+	invalid.ID, invalid.Path, invalid.Methods = 6, "/invalid", nil
+	publish(SyncMessage{Replica: "remote", Kind: RouteCreated, Route: &invalid})
+	waitFor(t, "the invalid route to be rejected", func() bool { return local.syncStatus().Rejected == 1 })
+	if _, ok := cfg.getRoute(6); ok {
+		t.Fatal("an invalid remote route was added")
+	}
+
+	// Route 1 is /svc here, so a remote route created as 1 conflicts
+	clash := route
+	clash.ID, clash.Path = 1, "/clash"
+	publish(SyncMessage{Replica: "remote", Kind: RouteCreated, Route: &clash})
+	waitFor(t, "the clashing route to be rejected", func() bool { return local.syncStatus().Conflicts == 1 })
+	if got, _ := cfg.getRoute(1); got.Path != "/svc" {
+		t.Fatalf("route 1 = %+v after a conflicting create, want /svc", got)
+	}
+
+	// An update may move a route, as long as it was the same route before
+	moved := route
+	moved.Path = "/moved"
+	publish(SyncMessage{Replica: "remote", Kind: RouteUpdated, Route: &moved, Previous: &route})
+	waitFor(t, "the remote update", func() bool { return local.syncStatus().Applied == 2 })
+	publish(SyncMessage{Replica: "remote", Kind: RouteUpdated, Route: &route, Previous: &moved})
+	waitFor(t, "the update back", func() bool { return local.syncStatus().Applied == 3 })
+
+	// The remote replica also receives its own messages, which it skips
+	local.routeChanged(RouteChange{Kind: RouteUpdated, Old: &moved, New: &route})
+	for msg := range received {
+		if msg.Replica == "remote" {
+			continue
+		}
+		if msg.Replica != "local" || msg.Kind != RouteUpdated || msg.Route == nil || msg.Route.ID != 5 || msg.Previous == nil {
+			t.Fatalf("published %+v, want the local update of route 5", msg)
+		}
+		break
+	}
+
+	// Changes applied from other replicas are not sent on again
+	local.routeChanged(RouteChange{Kind: RouteUpdated, New: &route, Remote: true})
+	publish(SyncMessage{Replica: "remote", Kind: RouteDeleted, Route: &route})
+	waitFor(t, "the remote deletion", func() bool { return local.syncStatus().Applied == 4 })
+	if _, ok := cfg.getRoute(5); ok {
+		t.Fatal("route 5 is still there after the remote deletion")
+	}
+	if n := local.syncStatus().Published; n != 1 {
+		t.Fatalf("%d changes published, want 1", n)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication methods recorded in the request context
+const (
+	AuthMethodAPIKey  = "apiKey"
+	AuthMethodBasic   = "basic"
+	AuthMethodSession = "session"
+	AuthMethodJWT     = "jwt"
+)
+
+// RequestContext is what the gateway learns about a request on its way
+// through the middleware chain. Each stage records what it resolves, so
+// later stages and pipeline templates reuse it instead of parsing the
+// request again, and values set by one stage are visible to the next.
+type RequestContext struct {
+	RequestID  string                 `json:"requestId"`
+	RouteID    int                    `json:"routeId"`
+	RoutePath  string                 `json:"routePath"`
+	Tags       []string               `json:"tags,omitempty"`
+	Params     map[string]string      `json:"params,omitempty"`     // "path" holds the path below the route prefix
+	Consumer   string                 `json:"consumer,omitempty"`   // authenticated user, credential or token subject
+	AuthMethod string                 `json:"authMethod,omitempty"` // apiKey, basic, session or jwt
+	Claims     map[string]interface{} `json:"claims,omitempty"`     // verified bearer token claims
+	Tenant     string                 `json:"tenant,omitempty"`     // from tenantKey
+	Country    string                 `json:"country,omitempty"`
+	Version    string                 `json:"version,omitempty"` // API version served
+	Variant    string                 `json:"variant,omitempty"` // experiment variant assigned
+	TraceID    string                 `json:"traceId,omitempty"` // W3C trace ID sent upstream
+
+	mutex      sync.Mutex
+	values     map[string]interface{}
+	errorClass string         // cause of the error response about to be written
+	sampling   sampleDecision // observability data the request produces
+	span       traceSpan      // the gateway's span, when the request is traced
+	target     string         // upstream the request was sent to
+	decisions  []string       // middleware decisions reported by debug headers
+}
+
+// requestContextKey finds a request's RequestContext
+type requestContextKey struct{}
+
+// withRequestContext attaches a context for the matched route to r
+func withRequestContext(r *http.Request, route Route) *http.Request {
+	rc := &RequestContext{
+		RequestID: r.Header.Get(requestIDHeader),
+		RouteID:   route.ID,
+		RoutePath: route.Path,
+		Tags:      route.Tags,
+		Params:    map[string]string{"path": strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, route.Path), "/")},
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey{}, rc))
+}
+
+// requestContext returns the context of r, or nil before a route matched
+func requestContext(r *http.Request) *RequestContext {
+	rc, _ := r.Context().Value(requestContextKey{}).(*RequestContext)
+	return rc
+}
+
+// set stores a value for later stages
+func (rc *RequestContext) set(key string, value interface{}) {
+	if rc == nil {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.values == nil {
+		rc.values = make(map[string]interface{})
+	}
+	rc.values[key] = value
+}
+
+// setConsumer records who the request was authenticated as
+func (rc *RequestContext) setConsumer(method, consumer string) {
+	if rc == nil {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.AuthMethod, rc.Consumer = method, consumer
+}
+
+// update changes fields under the context's lock
+func (rc *RequestContext) update(f func(rc *RequestContext)) {
+	if rc == nil {
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	f(rc)
+}
+
+// document returns the context as a JSON-like tree for template lookups,
+// with stored values under "values"
+func (rc *RequestContext) document() map[string]interface{} {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	tags := make([]interface{}, len(rc.Tags))
+	for i, tag := range rc.Tags {
+		tags[i] = tag
+	}
+	params := make(map[string]interface{}, len(rc.Params))
+	for name, value := range rc.Params {
+		params[name] = value
+	}
+	values := make(map[string]interface{}, len(rc.values))
+	for key, value := range rc.values {
+		values[key] = value
+	}
+	doc := map[string]interface{}{
+		"requestId": rc.RequestID,
+		"route":     map[string]interface{}{"id": float64(rc.RouteID), "path": rc.RoutePath},
+		"tags":      tags,
+		"params":    params,
+		"claims":    rc.Claims,
+		"values":    values,
+	}
+	for name, value := range map[string]string{
+		"consumer":   rc.Consumer,
+		"authMethod": rc.AuthMethod,
+		"tenant":     rc.Tenant,
+		"country":    rc.Country,
+		"version":    rc.Version,
+		"variant":    rc.Variant,
+		"traceId":    rc.TraceID,
+	} {
+		if value != "" {
+			doc[name] = value
+		}
+	}
+	return doc
+}
+
+// Tenant key sources. The global tenantKey is "header:<name>" or
+// "claim:<name>".
+const (
+	tenantKeyHeader = "header:"
+	tenantKeyClaim  = "claim:"
+)
+
+// validTenantKey reports whether a tenant key source is supported
+func validTenantKey(source string) bool {
+	name := strings.TrimPrefix(strings.TrimPrefix(source, tenantKeyHeader), tenantKeyClaim)
+	return source == "" || (name != source && name != "")
+}
+
+// resolveTenant records the request's tenant once it is authenticated,
+// reading claims from the context when a token was verified
+func resolveTenant(r *http.Request, source string) {
+	rc := requestContext(r)
+	if rc == nil || source == "" {
+		return
+	}
+	var tenant string
+	switch {
+	case strings.HasPrefix(source, tenantKeyHeader):
+		tenant = r.Header.Get(strings.TrimPrefix(source, tenantKeyHeader))
+	case strings.HasPrefix(source, tenantKeyClaim):
+		claims := rc.Claims
+		if claims == nil {
+			claims, _ = verifyJWT(bearerToken(r))
+		}
+		tenant = claimString(claims, strings.TrimPrefix(source, tenantKeyClaim))
+	}
+	rc.update(func(rc *RequestContext) { rc.Tenant = tenant })
+}
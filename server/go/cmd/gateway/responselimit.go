@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Response limit actions
+const (
+	ResponseLimitAbort    = "abort"
+	ResponseLimitTruncate = "truncate"
+)
+
+// truncatedHeader flags a response cut at the route's limit. It is sent as
+// a trailer when the body is streamed without a known length.
+const truncatedHeader = "X-Response-Truncated"
+
+// errResponseTooLarge ends a streamed response that passed its limit
+var errResponseTooLarge = errors.New("upstream response exceeded the route limit")
+
+// ResponseLimitConfig caps the size of upstream response bodies
+type ResponseLimitConfig struct {
+	MaxBytes int64  `json:"maxBytes"`
+	Action   string `json:"action,omitempty"` // abort (default) or truncate
+}
+
+// responseTooLargeError rejects a response whose declared length is over
+// the limit, before anything is sent to the client
+type responseTooLargeError struct {
+	length, limit int64
+}
+
+// Error describes the oversized response
+func (e *responseTooLargeError) Error() string {
+	return fmt.Sprintf("upstream response of %d bytes exceeds the %d byte limit", e.length, e.limit)
+}
+
+// checkResponseLimit validates a route's response limit
+func checkResponseLimit(l *ResponseLimitConfig, v *ValidationError) {
+	if l == nil {
+		return
+	}
+	if l.MaxBytes <= 0 {
+		v.add("responseLimit.maxBytes", "must be positive")
+	}
+	switch l.Action {
+	case "", ResponseLimitAbort, ResponseLimitTruncate:
+	default:
+		v.add("responseLimit.action", "must be abort or truncate")
+	}
+}
+
+// limitResponse applies a route's response limit. Responses declaring a
+// larger length fail with 502 when aborting, or are cut to the limit and
+// flagged when truncating. Bodies of unknown length are counted as they
+// stream: aborting drops the connection at the limit, truncating ends the
+// body there and flags it in a trailer.
+func (p *Proxy) limitResponse(resp *http.Response, route Route) error {
+	l := route.ResponseLimit
+	if l == nil || l.MaxBytes <= 0 {
+		return nil
+	}
+	truncate := l.Action == ResponseLimitTruncate
+
+	if resp.ContentLength > l.MaxBytes {
+		p.recordOversizedResponse(route, resp.ContentLength)
+		if !truncate {
+			return &responseTooLargeError{length: resp.ContentLength, limit: l.MaxBytes}
+		}
+		resp.Body = readCloser{io.LimitReader(resp.Body, l.MaxBytes), resp.Body}
+		resp.ContentLength = l.MaxBytes
+		resp.Header.Set("Content-Length", strconv.FormatInt(l.MaxBytes, 10))
+		resp.Header.Set(truncatedHeader, "true")
+		return nil
+	}
+	if resp.ContentLength >= 0 {
+		return nil
+	}
+
+	if truncate {
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+		resp.Trailer[truncatedHeader] = nil
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, resp: resp, route: route, remaining: l.MaxBytes, truncate: truncate}
+	return nil
+}
+
+// limitedBody counts a streamed response body against the route limit
+type limitedBody struct {
+	io.ReadCloser
+	resp      *http.Response
+	route     Route
+	remaining int64
+	truncate  bool
+	exceeded  bool
+}
+
+// Read passes data through until the limit, then ends or fails the body
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, b.endErr()
+	}
+	// Read one byte past the limit to tell an exact fit from an overrun
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+
+	b.exceeded = true
+	n = int(b.remaining)
+	b.remaining = 0
+	proxy.recordOversizedResponse(b.route, -1)
+	if b.truncate {
+		b.resp.Trailer.Set(truncatedHeader, "true")
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, b.endErr()
+}
+
+// endErr ends a truncated body cleanly and fails an aborted one
+func (b *limitedBody) endErr() error {
+	if b.truncate {
+		return io.EOF
+	}
+	return errResponseTooLarge
+}
+
+// recordOversizedResponse logs and counts a response over its route limit;
+// length is -1 for streamed bodies
+func (p *Proxy) recordOversizedResponse(route Route, length int64) {
+	action := route.ResponseLimit.Action
+	if action == "" {
+		action = ResponseLimitAbort
+	}
+	if length >= 0 {
+		log.Printf("Response of %d bytes from %s exceeds the %d byte limit of %s (%s)", length, route.Target, route.ResponseLimit.MaxBytes, route.Path, action)
+	} else {
+		log.Printf("Streamed response from %s exceeded the %d byte limit of %s (%s)", route.Target, route.ResponseLimit.MaxBytes, route.Path, action)
+	}
+
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[route.Path]
+	routeStat.OversizedResponses++
+	p.stats.RouteStats[route.Path] = routeStat
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RewriteConfig changes the path and query of requests forwarded to the
+// upstream, e.g. to always add ?source=gateway or drop debug parameters.
+// Query changes apply in order: remove, rename, then add.
+type RewriteConfig struct {
+	StripPrefix bool              `json:"stripPrefix,omitempty"` // drop the route path (and any version prefix)
+	BasePath    string            `json:"basePath,omitempty"`    // prepended to the forwarded path
+	RemoveQuery []string          `json:"removeQuery,omitempty"` // parameters dropped; a trailing * matches a prefix
+	RenameQuery map[string]string `json:"renameQuery,omitempty"` // client name to upstream name
+	AddQuery    map[string]string `json:"addQuery,omitempty"`    // set on every request, replacing client values
+}
+
+// checkRewrite validates a route's rewrite settings
+func checkRewrite(c *RewriteConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	if c.BasePath != "" && (!strings.HasPrefix(c.BasePath, "/") || strings.ContainsAny(c.BasePath, "?#")) {
+		v.add("rewrite.basePath", "must start with / and contain no query")
+	}
+	for _, name := range c.RemoveQuery {
+		if strings.TrimSuffix(name, "*") == "" {
+			v.add("rewrite.removeQuery", "invalid parameter %q", name)
+		}
+	}
+	for _, from := range sortedKeys(c.RenameQuery) {
+		if from == "" || c.RenameQuery[from] == "" {
+			v.add("rewrite.renameQuery", "names must not be empty")
+		}
+	}
+	for _, name := range sortedKeys(c.AddQuery) {
+		if name == "" {
+			v.add("rewrite.addQuery", "names must not be empty")
+		}
+	}
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// queryRemoved reports whether a parameter matches a remove pattern
+func (c *RewriteConfig) queryRemoved(name string) bool {
+	for _, p := range c.RemoveQuery {
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+// apply rewrites an outgoing request's path and query. It runs before the
+// target's path is joined on.
+func (c *RewriteConfig) apply(req *http.Request, route Route) {
+	path := req.URL.Path
+	if c.StripPrefix {
+		prefix := route.Path
+		if version, ok := route.Versioning.pathVersion(path, route.Path); ok {
+			prefix = "/" + version.Name + route.Path
+		}
+		path = strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/"))
+	}
+	if c.BasePath != "" {
+		path = strings.TrimSuffix(c.BasePath, "/") + path
+	}
+	if path == "" {
+		path = "/"
+	}
+	if path != req.URL.Path {
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+
+	if len(c.RemoveQuery) == 0 && len(c.RenameQuery) == 0 && len(c.AddQuery) == 0 {
+		return
+	}
+	query := req.URL.Query()
+	for name := range query {
+		if c.queryRemoved(name) {
+			query.Del(name)
+		}
+	}
+	for _, from := range sortedKeys(c.RenameQuery) {
+		if values, ok := query[from]; ok {
+			query.Del(from)
+			query[c.RenameQuery[from]] = append(query[c.RenameQuery[from]], values...)
+		}
+	}
+	for _, name := range sortedKeys(c.AddQuery) {
+		query.Set(name, c.AddQuery[name])
+	}
+	req.URL.RawQuery = query.Encode()
+}
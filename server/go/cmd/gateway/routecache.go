@@ -0,0 +1,107 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// routeCacheSize is the number of route lookups kept
+const routeCacheSize = 4096
+
+// routeLookup is a cached route resolution
+type routeLookup struct {
+	key   string
+	route Route
+}
+
+// routeCache is an LRU of recent route matches keyed on method, host and
+// cleaned path. Misses are not cached, so requests for made-up paths can't
+// push out the routes in use. It is purged whenever routes or the config
+// change.
+type routeCache struct {
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+	generation uint64
+}
+
+// routeLookups caches route resolution for handleProxyRequest
+var routeLookups = &routeCache{entries: make(map[string]*list.Element), order: list.New()}
+
+// cleanRoutePath removes . and .. segments and repeated slashes from a
+// request path, keeping a trailing slash, as http.ServeMux does before
+// serving the proxy
+func cleanRoutePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// find resolves the route for a request by its cleaned path, consulting
+// the cache first
+func (c *routeCache) find(r *http.Request) (Route, bool) {
+	cleaned := cleanRoutePath(r.URL.Path)
+	key := r.Method + " " + strings.ToLower(r.Host) + " " + cleaned
+
+	c.mutex.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		entry := el.Value.(*routeLookup)
+		c.mutex.Unlock()
+		return entry.route, true
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	route, found := config.findRouteByPath(cleaned, r.Method)
+	if !found && r.Method == http.MethodOptions {
+		route, found = config.findOptionsRoute(cleaned)
+	}
+	if !found {
+		return route, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Routes changed during the lookup; the result may be stale
+	if generation != c.generation {
+		return route, found
+	}
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		return route, found
+	}
+	c.entries[key] = c.order.PushFront(&routeLookup{key: key, route: route})
+	if c.order.Len() > routeCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*routeLookup).key)
+	}
+	return route, found
+}
+
+// purge drops every cached lookup
+func (c *routeCache) purge() {
+	c.mutex.Lock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.generation++
+	c.mutex.Unlock()
+}
+
+// routeChanged purges the cache; any change can alter which route matches
+func (c *routeCache) routeChanged(RouteChange) {
+	c.purge()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCleanRoutePath(t *testing.T) {
+	for raw, want := range map[string]string{
+		"":               "/",
+		"/":              "/",
+		"/svc//items":    "/svc/items",
+		"/svc/./items/":  "/svc/items/",
+		"/svc/../other":  "/other",
+		"svc/items":      "/svc/items",
+		"/svc/items/../": "/svc/",
+	} {
+		if got := cleanRoutePath(raw); got != want {
+			t.Errorf("cleanRoutePath(%q) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestRouteCacheKeysOnCleanedPathAndSkipsMisses(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), nil)
+	lookup := func(path string) (Route, bool) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = path
+		return routeLookups.find(r)
+	}
+	for _, path := range []string{"/svc/items", "/svc//items", "/svc/./items"} {
+		if route, found := lookup(path); !found || route.Path != "/svc" {
+			t.Fatalf("%s: found %v, route %q; want /svc", path, found, route.Path)
+		}
+	}
+	if _, found := lookup("/svc/../other"); found {
+		t.Fatal("/svc/../other matched /svc")
+	}
+	for i := 0; i < 100; i++ {
+		lookup("/missing/" + strconv.Itoa(i))
+	}
+
+	routeLookups.mutex.Lock()
+	defer routeLookups.mutex.Unlock()
+	if n := routeLookups.order.Len(); n != 1 || len(routeLookups.entries) != 1 {
+		t.Fatalf("%d cached lookups, want the one for /svc/items", n)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route change kinds
+const (
+	RouteCreated = "created"
+	RouteUpdated = "updated"
+	RouteDeleted = "deleted"
+)
+
+// RouteChange describes a route created, updated or deleted at runtime
+type RouteChange struct {
+	Kind   string
+	Old    *Route // nil for created routes
+	New    *Route // nil for deleted routes
+	Remote bool   // made outside this replica's admin API, as by another replica, the Kubernetes controller, the xDS client or a reload; not published
+}
+
+// routeWatchers fans route changes out to components that hold state
+// derived from routes
+type routeWatchers struct {
+	mutex    sync.RWMutex
+	handlers []func(RouteChange)
+}
+
+// subscribe registers fn to be called on every route change
+func (rw *routeWatchers) subscribe(fn func(RouteChange)) {
+	rw.mutex.Lock()
+	rw.handlers = append(rw.handlers, fn)
+	rw.mutex.Unlock()
+}
+
+// notify delivers a change synchronously, so dependent state is reconciled
+// before the admin API responds
+func (rw *routeWatchers) notify(change RouteChange) {
+	rw.mutex.RLock()
+	handlers := rw.handlers
+	rw.mutex.RUnlock()
+
+	for _, fn := range handlers {
+		fn(change)
+	}
+}
+
+// routeChanged drops the cached transport of an updated or deleted route
+func (p *Proxy) routeChanged(change RouteChange) {
+	if change.Old != nil {
+		p.dropTransport(change.Old.ID)
+	}
+}
+
+// probeTransportID keys the transport health probes share in the cache.
+// No route has a negative ID; 0 is the catch-all route's.
+const probeTransportID = -1
+
+// transport returns the cached upstream transport for a route, creating it
+// on first use
+func (p *Proxy) transport(route Route) (*http.Transport, error) {
+	p.transportsMutex.Lock()
+	defer p.transportsMutex.Unlock()
+
+	if t, ok := p.transports[route.ID]; ok {
+		return t, nil
+	}
+
+	proxyFunc, err := egressProxyFunc(p.config.settings().UpstreamProxy, route)
+	if err != nil {
+		return nil, err
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyFunc != nil || route.UpstreamProxy == routeProxyDirect {
+		t.Proxy = proxyFunc
+	}
+	t.DialContext = (&net.Dialer{Timeout: route.connectTimeout(), KeepAlive: 30 * time.Second}).DialContext
+	if timeout := route.responseHeaderTimeout(p.config.settings().DefaultTimeout); timeout > 0 {
+		t.ResponseHeaderTimeout = timeout
+	}
+	if route.Buffering != nil && route.Buffering.MaxResponseHeaderBytes > 0 {
+		t.MaxResponseHeaderBytes = route.Buffering.MaxResponseHeaderBytes
+	}
+
+	p.transports[route.ID] = t
+	return t, nil
+}
+
+// dropTransport discards a route's cached transport
+func (p *Proxy) dropTransport(id int) {
+	p.transportsMutex.Lock()
+	t, ok := p.transports[id]
+	delete(p.transports, id)
+	p.transportsMutex.Unlock()
+
+	if ok {
+		t.CloseIdleConnections()
+	}
+}
+
+// resetTransports discards every cached transport, e.g. after global
+// timeout or egress proxy settings change
+func (p *Proxy) resetTransports() {
+	p.transportsMutex.Lock()
+	transports := p.transports
+	p.transports = make(map[int]*http.Transport)
+	p.transportsMutex.Unlock()
+
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+// routeChanged resets the buckets of a route whose path or limits changed,
+// since bucket capacity is fixed when a bucket is created
+func (rl *RateLimiter) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	if change.New != nil &&
+		change.New.Path == change.Old.Path &&
+		change.New.RateLimit == change.Old.RateLimit &&
+		change.New.RateLimitKey == change.Old.RateLimitKey {
+		return
+	}
+
+	rl.resetRoute(change.Old.Path)
+}
+
+// resetRoute removes all buckets belonging to a route path
+func (rl *RateLimiter) resetRoute(path string) {
+	rl.bucketMutex.Lock()
+	defer rl.bucketMutex.Unlock()
+
+	for key, el := range rl.buckets {
+		if key == path || strings.HasPrefix(key, path+"|") {
+			rl.order.Remove(el)
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestProbeTransportIsNotTheCatchAll(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), nil)
+	backend := config.getRoutes()[0].Target
+	if status := proxy.probeService(backend, HealthCheckConfig{Path: "/health", Timeout: 1}); status == "" {
+		t.Fatal("probe reported no status")
+	}
+
+	// The catch-all route has ID 0; a probe made first must not have
+	// cached a transport without its timeouts
+	catchAll, err := proxy.transport(Route{Timeout: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if catchAll.ResponseHeaderTimeout != 7*time.Second {
+		t.Fatalf("catch-all transport has a %v response header timeout, want 7s", catchAll.ResponseHeaderTimeout)
+	}
+	probe, _ := proxy.transport(Route{ID: probeTransportID})
+	if probe == catchAll {
+		t.Fatal("probes share the catch-all route's transport")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// checkRouteTemplates validates the route templates. Their settings are
+// checked as part of each route that uses them.
+func checkRouteTemplates(templates map[string]Route, v *ValidationError) {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tmpl := templates[name]
+		prefix := "routeTemplates." + name
+		if name == "" {
+			v.add("routeTemplates", "template names must not be empty")
+		}
+		if tmpl.ID != 0 {
+			v.add(prefix+".id", "is set per route")
+		}
+		if tmpl.Path != "" {
+			v.add(prefix+".path", "is set per route")
+		}
+		if tmpl.Template != "" {
+			v.add(prefix+".template", "templates cannot use other templates")
+		}
+	}
+}
+
+// applyTemplate fills the settings a route leaves unset from its template.
+// An unset field can't be told from false or 0, so a route keeps a
+// template's enabled flags and non-zero limits.
+func (c *Config) applyTemplate(route *Route, v *ValidationError) {
+	settings := c.settings()
+	if route.Template == "" {
+		return
+	}
+	tmpl, ok := settings.RouteTemplates[route.Template]
+	if !ok {
+		v.add("template", "unknown route template %q", route.Template)
+		return
+	}
+	tmpl, err := copyRoute(tmpl)
+	if err != nil {
+		v.add("template", "%v", err)
+		return
+	}
+	dst := reflect.ValueOf(route).Elem()
+	src := reflect.ValueOf(tmpl)
+	for i := 0; i < dst.NumField(); i++ {
+		if field := dst.Field(i); field.CanSet() && field.IsZero() {
+			field.Set(src.Field(i))
+		}
+	}
+}
+
+// copyRoute returns a deep copy of a route, sharing none of its settings
+func copyRoute(route Route) (Route, error) {
+	var clone Route
+	data, err := json.Marshal(route)
+	if err != nil {
+		return clone, err
+	}
+	err = json.Unmarshal(data, &clone)
+	return clone, err
+}
+
+// handleRouteClone creates a copy of a route. Fields in the request body
+// replace the copied ones; the clone starts inactive unless the body sets
+// active, so it doesn't conflict with its source.
+func handleRouteClone(w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	source, found := config.getRoute(id)
+	if !found {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Route not found")
+		return
+	}
+	route, err := copyRoute(source)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to copy route: %v", err))
+		return
+	}
+	route.Active = false
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil && err != io.EOF {
+		writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+	route.ID = 0
+
+	routeWrites.Lock()
+	defer routeWrites.Unlock()
+	if err := validateRoute(&route, config.getRoutes(), config); err != nil {
+		writeValidationError(w, r, err)
+		return
+	}
+	route.ID = config.addRoute(route)
+	if err := store.SaveRoute(route); err != nil {
+		config.deleteRoute(route.ID)
+		routeLookups.purge()
+		writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save route: %v", err))
+		return
+	}
+
+	routeChanges.notify(RouteChange{Kind: RouteCreated, New: &route})
+	events.emit(EventRouteCreated, route)
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, route)
+}
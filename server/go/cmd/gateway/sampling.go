@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// traceparentHeader carries W3C trace context
+const traceparentHeader = "traceparent"
+
+// SamplingConfig sets the share of requests, from 0 to 1, that produce
+// each kind of observability data, so high-volume routes can be sampled
+// lightly and critical ones in full. A route's rates override the global
+// ones; unset rates inherit.
+type SamplingConfig struct {
+	AccessLog *float64 `json:"accessLog,omitempty"` // request log lines; defaults to 1
+	Traces    *float64 `json:"traces,omitempty"`    // new traces marked sampled in traceparent; unset leaves trace context alone unless tracing is on
+	Captures  *float64 `json:"captures,omitempty"`  // body logs and traffic recordings; unset keeps their own settings
+}
+
+// checkSampling validates sampling rates
+func checkSampling(prefix string, c *SamplingConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	for name, rate := range map[string]*float64{
+		"accessLog": c.AccessLog,
+		"traces":    c.Traces,
+		"captures":  c.Captures,
+	} {
+		if rate != nil && (*rate < 0 || *rate > 1) {
+			v.add(prefix+"."+name, "must be between 0 and 1")
+		}
+	}
+}
+
+// samplingFor merges a route's sampling rates over the global ones
+func samplingFor(route Route) SamplingConfig {
+	s := config.settings().Sampling
+	if o := route.Sampling; o != nil {
+		if o.AccessLog != nil {
+			s.AccessLog = o.AccessLog
+		}
+		if o.Traces != nil {
+			s.Traces = o.Traces
+		}
+		if o.Captures != nil {
+			s.Captures = o.Captures
+		}
+	}
+	return s
+}
+
+// sampleDecision records which observability data a request produces. It
+// is made once per request, so a request is either logged or not
+// throughout.
+type sampleDecision struct {
+	accessLog bool
+	capture   *bool // nil leaves the decision to body logging and recording
+}
+
+// sampled draws against a rate
+func sampled(rate float64) bool {
+	return rate >= 1 || (rate > 0 && mathrand.Float64() < rate)
+}
+
+// decideSampling makes the request's sampling decisions and, when trace
+// sampling is configured, propagates W3C trace context upstream
+func decideSampling(r *http.Request, route Route) {
+	rc := requestContext(r)
+	if rc == nil {
+		return
+	}
+	s := samplingFor(route)
+	d := sampleDecision{accessLog: true}
+	if s.AccessLog != nil {
+		d.accessLog = sampled(*s.AccessLog)
+	}
+	if s.Captures != nil {
+		capture := sampled(*s.Captures)
+		d.capture = &capture
+	}
+
+	rate := s.Traces
+	if rate == nil && tracer.enabled() {
+		defaultRate := defaultTraceSampleRate
+		rate = &defaultRate
+	}
+	var span traceSpan
+	if rate != nil {
+		span = propagateTrace(r, *rate)
+	}
+	rc.update(func(rc *RequestContext) {
+		rc.sampling, rc.TraceID, rc.span = d, span.traceID, span
+	})
+}
+
+// traceSpan is the gateway's span of a request's trace
+type traceSpan struct {
+	traceID string
+	id      string
+	parent  string // the caller's span, if it sent trace context
+	sampled bool   // the head sampling decision sent upstream
+}
+
+// propagateTrace continues the caller's trace or starts a new one sampled
+// at rate, and sends the gateway's span as the upstream's parent. A
+// caller's sampling decision is kept, so traces are not broken mid-way.
+func propagateTrace(r *http.Request, rate float64) traceSpan {
+	var span traceSpan
+	flags := ""
+	if parts := strings.Split(r.Header.Get(traceparentHeader), "-"); len(parts) == 4 && parts[0] == "00" && len(parts[1]) == 32 && len(parts[2]) == 16 && len(parts[3]) == 2 {
+		span.traceID, span.parent, flags = parts[1], parts[2], parts[3]
+	}
+	if span.traceID == "" {
+		span.traceID = randomHex(16)
+		flags = "00"
+		if sampled(rate) {
+			flags = "01"
+		}
+	}
+	span.id = randomHex(8)
+	bits, _ := strconv.ParseUint(flags, 16, 8)
+	span.sampled = bits&1 == 1
+	r.Header.Set(traceparentHeader, "00-"+span.traceID+"-"+span.id+"-"+flags)
+	return span
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logSampled reports whether a request's access log line is written
+func logSampled(r *http.Request) bool {
+	rc := requestContext(r)
+	if rc == nil {
+		return true
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return rc.sampling.accessLog
+}
+
+// captureSampled reports whether a request is captured by body logging or
+// recording, deferring to their own settings when the sampling config
+// leaves captures unset
+func captureSampled(r *http.Request) (bool, bool) {
+	rc := requestContext(r)
+	if rc == nil {
+		return false, false
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.sampling.capture == nil {
+		return false, false
+	}
+	return *rc.sampling.capture, true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Saturation sources: the capacity a replica is closest to
+const (
+	SaturationRPS         = "rps"
+	SaturationInFlight    = "inFlight"
+	SaturationConnections = "connections"
+	SaturationRateLimit   = "rateLimit"
+)
+
+// ScalingConfig sizes one replica for autoscaling. The saturation ratio
+// autoscalers track is the load measured against these targets and the
+// gateway's own limits.
+type ScalingConfig struct {
+	TargetRPS      float64 `json:"targetRps,omitempty"`      // requests per second one replica should serve
+	TargetInFlight int     `json:"targetInFlight,omitempty"` // concurrent requests one replica should serve
+}
+
+// checkScaling validates the scaling targets
+func checkScaling(c ScalingConfig, v *ValidationError) {
+	if c.TargetRPS < 0 {
+		v.add("scaling.targetRps", "must not be negative")
+	}
+	checkNonNegative("scaling", []namedInt{{"targetInFlight", c.TargetInFlight}}, v)
+}
+
+// ScalingMetrics are this replica's load, for KEDA and HPA external
+// metrics
+type ScalingMetrics struct {
+	RequestsPerSecond   float64 `json:"requestsPerSecond"`   // over the last 10 seconds
+	RequestsPerSecond1m float64 `json:"requestsPerSecond1m"` // over the last minute
+	InFlight            int     `json:"inFlight"`            // requests in progress
+	ActiveConnections   int     `json:"activeConnections"`   // open client connections
+	Saturation          float64 `json:"saturation"`          // load over capacity; 1 is fully loaded, 0 when no capacity is known
+	SaturatedBy         string  `json:"saturatedBy,omitempty"`
+}
+
+// scalingMetrics measures the load against each known capacity, reporting
+// the highest ratio as the saturation
+func scalingMetrics() ScalingMetrics {
+	now := time.Now()
+	m := ScalingMetrics{
+		RequestsPerSecond:   proxy.window.requestRate(now, 10*time.Second),
+		RequestsPerSecond1m: proxy.window.requestRate(now, time.Minute),
+	}
+	proxy.reqMutex.RLock()
+	m.InFlight = int(proxy.activeRequests)
+	proxy.reqMutex.RUnlock()
+	maxConns := 0
+	if connLimiter != nil {
+		conns := connLimiter.stats()
+		m.ActiveConnections, maxConns = conns.Total, conns.MaxConns
+	}
+
+	ratio := func(source string, load, capacity float64) {
+		if capacity > 0 && load/capacity > m.Saturation {
+			m.Saturation, m.SaturatedBy = load/capacity, source
+		}
+	}
+	ratio(SaturationRPS, m.RequestsPerSecond, config.settings().Scaling.TargetRPS)
+	ratio(SaturationInFlight, float64(m.InFlight), float64(config.settings().Scaling.TargetInFlight))
+	ratio(SaturationConnections, float64(m.ActiveConnections), float64(maxConns))
+	ratio(SaturationRateLimit, m.RequestsPerSecond, config.settings().GatewayRateLimit.Global.refillRate())
+	return m
+}
+
+// handleScaling reports the load autoscalers scale on. KEDA's metrics-api
+// scaler reads a field such as saturation from the JSON.
+func handleScaling(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, scalingMetrics())
+}
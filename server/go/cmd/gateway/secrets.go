@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret reference prefixes. Like the encryption key sources, they keep
+// credentials out of the config file.
+const (
+	secretFromEnv     = "env:"
+	secretFromFile    = "file:"
+	secretFromCommand = "command:"
+)
+
+// secretCacheTTL bounds how long a resolved secret is reused, so rotated
+// files and secret manager values are picked up
+const secretCacheTTL = 5 * time.Minute
+
+// cachedSecret is a resolved secret and when it was read
+type cachedSecret struct {
+	value string
+	read  time.Time
+}
+
+// secrets caches resolved secret references
+var secrets = struct {
+	sync.Mutex
+	values map[string]cachedSecret
+}{values: make(map[string]cachedSecret)}
+
+// trustedSecretCommands holds the command: references of the settings read
+// from the config file and environment. Only these are ever run: routes,
+// and settings sent through the admin API, can be written by clients.
+var trustedSecretCommands = struct {
+	sync.RWMutex
+	refs map[string]bool
+}{refs: make(map[string]bool)}
+
+// checkSecretRef validates a route's secret reference. Routes arrive
+// through the admin API and replica sync, so they can't run commands.
+func checkSecretRef(field, ref string, v *ValidationError) {
+	if strings.HasPrefix(ref, secretFromCommand) {
+		v.add(field, "%s references are only allowed in the settings of the config file", secretFromCommand)
+		return
+	}
+	checkSettingsSecretRef(field, ref, v)
+}
+
+// checkSettingsSecretRef validates a secret reference without resolving
+// it, since the environment it reads may not exist where configs are
+// validated
+func checkSettingsSecretRef(field, ref string, v *ValidationError) {
+	for _, prefix := range []string{secretFromEnv, secretFromFile, secretFromCommand} {
+		if strings.HasPrefix(ref, prefix) && strings.TrimSpace(strings.TrimPrefix(ref, prefix)) == "" {
+			v.add(field, "%s needs a value", prefix)
+			return
+		}
+	}
+	if ref == "" {
+		v.add(field, "is required")
+	}
+}
+
+// isSecretRef reports whether a value refers to a secret rather than
+// being one
+func isSecretRef(ref string) bool {
+	return strings.HasPrefix(ref, secretFromEnv) || strings.HasPrefix(ref, secretFromFile) || strings.HasPrefix(ref, secretFromCommand)
+}
+
+// resolveSecret returns the value of a secret reference: an environment
+// variable (env:NAME), a file (file:/path) or the output of a command
+// (command:vault kv get ...) the config file trusts. Other values are used
+// as they are.
+func resolveSecret(ref string) (string, error) {
+	if !isSecretRef(ref) {
+		return ref, nil
+	}
+	if strings.HasPrefix(ref, secretFromCommand) {
+		trustedSecretCommands.RLock()
+		trusted := trustedSecretCommands.refs[ref]
+		trustedSecretCommands.RUnlock()
+		if !trusted {
+			return "", fmt.Errorf("%s references are only allowed in the settings of the config file", secretFromCommand)
+		}
+	}
+
+	secrets.Lock()
+	cached, ok := secrets.values[ref]
+	secrets.Unlock()
+	if ok && time.Since(cached.read) < secretCacheTTL {
+		return cached.value, nil
+	}
+
+	var value string
+	switch {
+	case strings.HasPrefix(ref, secretFromEnv):
+		name := strings.TrimPrefix(ref, secretFromEnv)
+		value = os.Getenv(name)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(ref, secretFromFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, secretFromFile))
+		if err != nil {
+			return "", err
+		}
+		value = strings.TrimSpace(string(data))
+	case strings.HasPrefix(ref, secretFromCommand):
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", strings.TrimPrefix(ref, secretFromCommand))
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			// Keep the command out of the error; it may embed credentials
+			return "", fmt.Errorf("secret command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		value = strings.TrimSpace(string(out))
+	}
+
+	secrets.Lock()
+	secrets.values[ref] = cachedSecret{value: value, read: time.Now()}
+	secrets.Unlock()
+	return value, nil
+}
+
+// trustSecretCommands makes the command: references of settings read from
+// the config file and environment the only ones resolveSecret runs
+func trustSecretCommands(c *Config) {
+	refs := make(map[string]bool)
+	for _, ref := range settingsSecretCommands(c) {
+		refs[ref] = true
+	}
+	trustedSecretCommands.Lock()
+	trustedSecretCommands.refs = refs
+	trustedSecretCommands.Unlock()
+}
+
+// checkSecretCommands rejects command: references in settings sent through
+// the admin API unless the config file already has them
+func checkSecretCommands(c *Config) error {
+	var v ValidationError
+	trustedSecretCommands.RLock()
+	defer trustedSecretCommands.RUnlock()
+	for field, ref := range settingsSecretCommands(c) {
+		if !trustedSecretCommands.refs[ref] {
+			v.add(field, "%s references are only allowed in the config file", secretFromCommand)
+		}
+	}
+	return v.err()
+}
+
+// settingsSecretCommands returns the command: references among a config's
+// settings, keyed by field path
+func settingsSecretCommands(c *Config) map[string]string {
+	refs := make(map[string]string)
+	collectSecretCommands(reflect.ValueOf(*c.settings()), "", refs)
+	return refs
+}
+
+// collectSecretCommands adds the command: references among the JSON
+// fields of v to refs
+func collectSecretCommands(v reflect.Value, path string, refs map[string]string) {
+	switch v.Kind() {
+	case reflect.String:
+		if strings.HasPrefix(v.String(), secretFromCommand) {
+			refs[path] = v.String()
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			collectSecretCommands(v.Elem(), path, refs)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			name := strings.Split(tag, ",")[0]
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			field := path
+			if !f.Anonymous || tag != "" {
+				if name == "" {
+					name = f.Name
+				}
+				field = joinFieldPath(path, name)
+			}
+			collectSecretCommands(v.Field(i), field, refs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			collectSecretCommands(v.Index(i), fmt.Sprintf("%s[%d]", path, i), refs)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			collectSecretCommands(iter.Value(), joinFieldPath(path, fmt.Sprint(iter.Key().Interface())), refs)
+		}
+	}
+}
+
+// joinFieldPath appends a field name to a field path
+func joinFieldPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteSecretRefsRejectCommands(t *testing.T) {
+	var v ValidationError
+	checkSecretRef("webhook.secret", "command:echo secret", &v)
+	if len(v.Violations) != 1 || v.Violations[0].Field != "webhook.secret" {
+		t.Fatalf("violations = %+v, want one for webhook.secret", v.Violations)
+	}
+
+	v = ValidationError{}
+	checkSettingsSecretRef("admin.password", "command:echo secret", &v)
+	if len(v.Violations) != 0 {
+		t.Fatalf("settings violations = %+v, want none", v.Violations)
+	}
+}
+
+func TestResolveSecretRunsTrustedCommandsOnly(t *testing.T) {
+	t.Cleanup(func() { trustSecretCommands(defaultConfig("")) })
+
+	const ref = "command:echo trusted"
+	if _, err := resolveSecret(ref); err == nil {
+		t.Fatal("an untrusted command was run")
+	}
+
+	cfg := defaultConfig(filepath.Join(t.TempDir(), "config.json"))
+	cfg.Admin.Password = ref
+	trustSecretCommands(cfg)
+	value, err := resolveSecret(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "trusted" {
+		t.Fatalf("value = %q, want trusted", value)
+	}
+}
+
+func TestCheckSecretCommandsNamesUntrustedFields(t *testing.T) {
+	trusted := defaultConfig("")
+	trusted.Admin.Password = "command:echo admin"
+	trustSecretCommands(trusted)
+	t.Cleanup(func() { trustSecretCommands(defaultConfig("")) })
+
+	submitted := defaultConfig("")
+	submitted.Admin.Password = "command:echo admin"
+	if err := checkSecretCommands(submitted); err != nil {
+		t.Fatalf("a command the file has was rejected: %v", err)
+	}
+
+	submitted.Tracing.Headers = map[string]string{"Authorization": "command:id"}
+	err := checkSecretCommands(submitted)
+	if err == nil {
+		t.Fatal("a new command was accepted")
+	}
+	violations := err.(*ValidationError).Violations
+	if len(violations) != 1 || violations[0].Field != "tracing.headers.Authorization" {
+		t.Fatalf("violations = %+v, want one for tracing.headers.Authorization", violations)
+	}
+}
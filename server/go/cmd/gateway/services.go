@@ -0,0 +1,221 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceName returns the registry name of a route target (its hostname)
+func serviceName(target string) (string, error) {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	return targetURL.Hostname(), nil
+}
+
+// registerService adds the services behind a route's targets if they are
+// not already known. rampUp marks services added while the gateway runs,
+// which warm up once healthy.
+func (p *Proxy) registerService(route Route, rampUp bool) {
+	for _, target := range route.targetURLs() {
+		p.registerTarget(target, rampUp)
+	}
+}
+
+// targetURLs returns the route's target and the rest of its pool
+func (r Route) targetURLs() []string {
+	var targets []string
+	if r.Target != "" {
+		targets = append(targets, r.Target)
+	}
+	for _, t := range r.Targets {
+		if t.URL != r.Target {
+			targets = append(targets, t.URL)
+		}
+	}
+	return targets
+}
+
+// registerTarget adds the service behind a target if it is not already known
+func (p *Proxy) registerTarget(target string, rampUp bool) {
+	name, err := serviceName(target)
+	if err != nil {
+		log.Printf("Invalid target URL %s: %v", target, err)
+		return
+	}
+
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	if svc, exists := p.services[name]; exists {
+		// A route uses the service again before it finished draining
+		if svc.Drain != nil && svc.Drain.Removed {
+			svc.Drain = nil
+		}
+	} else {
+		p.services[name] = &Service{
+			Name:   name,
+			URL:    target,
+			Status: "unknown",
+			rampUp: rampUp,
+		}
+	}
+}
+
+// syncServices keeps the service registry in step with route changes:
+// new targets are registered and services no route uses are dropped
+func (p *Proxy) syncServices(change RouteChange) {
+	if change.New != nil {
+		p.registerService(*change.New, true)
+	}
+
+	if change.Old == nil {
+		return
+	}
+	for _, target := range change.Old.targetURLs() {
+		p.dropUnusedService(target)
+	}
+}
+
+// dropUnusedService removes the service behind a target once no route
+// uses it, draining it first if requests are in flight
+func (p *Proxy) dropUnusedService(target string) {
+	name, err := serviceName(target)
+	if err != nil {
+		return
+	}
+	if len(p.routesUsingService(name)) == 0 {
+		// Let requests in flight finish before the service goes
+		if svc, ok := p.getService(name); ok && svc.InFlight > 0 {
+			p.drainService(name, true)
+			return
+		}
+		p.servicesMutex.Lock()
+		delete(p.services, name)
+		p.servicesMutex.Unlock()
+		log.Printf("Removed service %s: no routes reference it", name)
+	}
+}
+
+// routesUsingService returns the IDs of routes whose target is the named service
+func (p *Proxy) routesUsingService(name string) []int {
+	var ids []int
+	for _, route := range p.config.getRoutes() {
+		for _, target := range route.targetURLs() {
+			if n, err := serviceName(target); err == nil && n == name {
+				ids = append(ids, route.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// getService returns a service by name
+func (p *Proxy) getService(name string) (Service, bool) {
+	p.servicesMutex.RLock()
+	defer p.servicesMutex.RUnlock()
+
+	svc, ok := p.services[name]
+	if !ok {
+		return Service{}, false
+	}
+	return *svc, true
+}
+
+// deleteService removes a service from the registry
+func (p *Proxy) deleteService(name string) bool {
+	p.servicesMutex.Lock()
+	defer p.servicesMutex.Unlock()
+
+	if _, ok := p.services[name]; !ok {
+		return false
+	}
+	delete(p.services, name)
+	return true
+}
+
+// handleService handles GET and DELETE requests for a single service, POST
+// requests to /api/services/{name}/check and /api/services/{name}/drain,
+// GET requests to /api/services/{name}/history and the weights of pooled
+// targets at /api/services/{name}/targets/{target}/weight
+func handleService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/services/")
+	if strings.HasSuffix(name, "/check") {
+		handleServiceCheck(w, r, strings.TrimSuffix(name, "/check"))
+		return
+	}
+	if strings.HasSuffix(name, "/drain") {
+		handleServiceDrain(w, r, strings.TrimSuffix(name, "/drain"))
+		return
+	}
+	if i := strings.Index(name, "/targets/"); i >= 0 && strings.HasSuffix(name, "/weight") {
+		handleTargetWeight(w, r, name[:i], strings.TrimSuffix(name[i+len("/targets/"):], "/weight"))
+		return
+	}
+	if strings.HasSuffix(name, "/history") {
+		handleServiceHistory(w, r, strings.TrimSuffix(name, "/history"))
+		return
+	}
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		svc, found := proxy.getService(name)
+		if !found {
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+			return
+		}
+		writeJSON(w, svc)
+
+	case http.MethodDelete:
+		// Services still referenced by routes would be orphaned from health checks
+		if ids := proxy.routesUsingService(name); len(ids) > 0 {
+			writeErrorDetails(w, r, http.StatusConflict, ErrCodeServiceInUse, "Service is still referenced by routes", map[string][]int{"routes": ids})
+			return
+		}
+		if !proxy.deleteService(name) {
+			writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// handleServiceCheck probes a single service on demand. Probes are limited
+// to one per service per onDemandCheckInterval.
+func handleServiceCheck(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if _, found := proxy.getService(name); !found {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Service not found")
+		return
+	}
+
+	svc, probed := proxy.checkServiceHealth(name, onDemandCheckInterval)
+	if !probed {
+		retryAfter := onDemandCheckInterval - time.Since(svc.LastCheck)
+		if retryAfter < time.Second {
+			retryAfter = time.Second
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second)/time.Second)))
+		writeErrorDetails(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "Service was checked recently", svc)
+		return
+	}
+
+	writeJSON(w, svc)
+}
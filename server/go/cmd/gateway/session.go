@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session defaults
+const (
+	defaultSessionCookie  = "gw_session"
+	defaultSessionSubject = "X-Session-Subject"
+	defaultSessionTTL     = 3600
+	minSessionSecret      = 16
+)
+
+// SessionConfig puts the gateway in front of a legacy login. A successful
+// response to the login path names the user in a header; the gateway
+// replaces the upstream's cookies with its own signed session cookie and
+// checks that cookie on every other request to the route.
+type SessionConfig struct {
+	LoginPath     string   `json:"loginPath"`               // e.g. /app/login; proxied without a session
+	LogoutPath    string   `json:"logoutPath,omitempty"`    // clears the session, then proxies
+	LoginURL      string   `json:"loginUrl,omitempty"`      // browsers without a session are redirected here
+	Public        []string `json:"public,omitempty"`        // path prefixes served without a session
+	SubjectHeader string   `json:"subjectHeader,omitempty"` // login response header naming the user; defaults to X-Session-Subject
+	UserHeader    string   `json:"userHeader,omitempty"`    // carries the user upstream; defaults to X-Authenticated-User
+	CookieName    string   `json:"cookieName,omitempty"`    // defaults to gw_session
+	Secret        string   `json:"secret,omitempty"`        // signing key; defaults to a per-process key
+	TTL           int      `json:"ttl,omitempty"`           // seconds; defaults to 3600
+}
+
+// checkSession validates a route's session settings
+func checkSession(s *SessionConfig, routePath string, v *ValidationError) {
+	if s == nil {
+		return
+	}
+	if s.LoginPath == "" {
+		v.add("session.loginPath", "is required")
+	} else if !pathMatches(s.LoginPath, routePath) {
+		v.add("session.loginPath", "must be under the route path %s", routePath)
+	}
+	if s.LogoutPath != "" && !pathMatches(s.LogoutPath, routePath) {
+		v.add("session.logoutPath", "must be under the route path %s", routePath)
+	}
+	if s.Secret != "" {
+		checkSecretRef("session.secret", s.Secret, v)
+		if !isSecretRef(s.Secret) && len(s.Secret) < minSessionSecret {
+			v.add("session.secret", "must be at least %d characters", minSessionSecret)
+		}
+	}
+	if s.TTL < 0 {
+		v.add("session.ttl", "must not be negative")
+	}
+	if s.CookieName != "" && strings.ContainsAny(s.CookieName, " \t;,=\"") {
+		v.add("session.cookieName", "invalid cookie name %q", s.CookieName)
+	}
+}
+
+// sessionKeys holds the generated signing keys of routes without a secret.
+// Such sessions end when the gateway restarts.
+var sessionKeys = struct {
+	sync.Mutex
+	keys map[int][]byte
+}{keys: make(map[int][]byte)}
+
+// key returns the signing key for a route's sessions
+func (s *SessionConfig) key(routeID int) ([]byte, error) {
+	if s.Secret != "" {
+		secret, err := resolveSecret(s.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) < minSessionSecret {
+			return nil, fmt.Errorf("session secret is shorter than %d characters", minSessionSecret)
+		}
+		return []byte(secret), nil
+	}
+	sessionKeys.Lock()
+	defer sessionKeys.Unlock()
+	key, ok := sessionKeys.keys[routeID]
+	if !ok {
+		key = make([]byte, 32)
+		rand.Read(key)
+		sessionKeys.keys[routeID] = key
+	}
+	return key, nil
+}
+
+// cookieName returns the name of the session cookie
+func (s *SessionConfig) cookieName() string {
+	if s.CookieName == "" {
+		return defaultSessionCookie
+	}
+	return s.CookieName
+}
+
+// ttl returns how long a session lasts
+func (s *SessionConfig) ttl() time.Duration {
+	if s.TTL == 0 {
+		return defaultSessionTTL * time.Second
+	}
+	return time.Duration(s.TTL) * time.Second
+}
+
+// isPublic reports whether a path is served without a session
+func (s *SessionConfig) isPublic(path string) bool {
+	if path == s.LoginPath {
+		return true
+	}
+	for _, prefix := range s.Public {
+		if pathMatches(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// signSession computes the signature of a session for a route
+func signSession(key []byte, routeID int, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d\x00%s", routeID, payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encode builds a cookie value: subject, expiry and signature
+func (s *SessionConfig) encode(key []byte, routeID int, subject string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signSession(key, routeID, payload)
+}
+
+// decode verifies a cookie value, returning its subject and expiry
+func (s *SessionConfig) decode(key []byte, routeID int, value string) (string, time.Time, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload, signature := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signSession(key, routeID, payload))) {
+		return "", time.Time{}, false
+	}
+	encoded, unix, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", time.Time{}, false
+	}
+	subject, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	expires := time.Unix(seconds, 0)
+	if time.Now().After(expires) {
+		return "", time.Time{}, false
+	}
+	return string(subject), expires, true
+}
+
+// cookie builds the session cookie for a route
+func (s *SessionConfig) cookie(r *http.Request, route Route, value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    value,
+		Path:     route.Path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stripSessionCookie keeps the gateway's cookie from reaching the upstream
+func (s *SessionConfig) stripSessionCookie(r *http.Request) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != s.cookieName() {
+			r.AddCookie(c)
+		}
+	}
+}
+
+// checkSessionRequest requires a valid session cookie on the route's
+// protected paths, redirecting browsers to the login page or answering 401.
+// Sessions past half their lifetime are renewed.
+func checkSessionRequest(w http.ResponseWriter, r *http.Request, route Route) bool {
+	s := route.Session
+	cookie, _ := r.Cookie(s.cookieName())
+	s.stripSessionCookie(r)
+
+	// Only the gateway names the user, even on public paths
+	header := s.UserHeader
+	if header == "" {
+		header = defaultAuthUserHeader
+	}
+	r.Header.Del(header)
+
+	if r.URL.Path == s.LogoutPath {
+		http.SetCookie(w, s.cookie(r, route, "", -1))
+		return true
+	}
+	if s.isPublic(r.URL.Path) {
+		return true
+	}
+
+	key, err := s.key(route.ID)
+	if err != nil {
+		log.Printf("Session secret for %s unavailable: %v", route.Path, err)
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Session verification unavailable")
+		return false
+	}
+	var subject string
+	var expires time.Time
+	ok := false
+	if cookie != nil {
+		subject, expires, ok = s.decode(key, route.ID, cookie.Value)
+	}
+	if !ok {
+		if s.LoginURL != "" && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, s.LoginURL, http.StatusFound)
+			return false
+		}
+		writeError(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, "Session required")
+		return false
+	}
+
+	if time.Until(expires) < s.ttl()/2 {
+		renewed := time.Now().Add(s.ttl())
+		http.SetCookie(w, s.cookie(r, route, s.encode(key, route.ID, subject, renewed), int(s.ttl().Seconds())))
+	}
+
+	r.Header.Set(header, subject)
+	requestContext(r).setConsumer(AuthMethodSession, subject)
+	return true
+}
+
+// issueSession exchanges a successful login response for a session cookie.
+// The upstream's own cookies are dropped so the gateway's is the only one.
+// It fails the response when the session secret can't be resolved.
+func issueSession(r *http.Request, resp *http.Response, route Route) error {
+	s := route.Session
+	if r.URL.Path != s.LoginPath {
+		return nil
+	}
+	header := s.SubjectHeader
+	if header == "" {
+		header = defaultSessionSubject
+	}
+	subject := resp.Header.Get(header)
+	resp.Header.Del(header)
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return nil
+	}
+	if subject == "" {
+		log.Printf("Login response on %s did not name the user in %s; no session issued", route.Path, header)
+		return nil
+	}
+
+	key, err := s.key(route.ID)
+	if err != nil {
+		return fmt.Errorf("session secret unavailable: %w", err)
+	}
+	resp.Header.Del("Set-Cookie")
+	value := s.encode(key, route.ID, subject, time.Now().Add(s.ttl()))
+	resp.Header.Add("Set-Cookie", s.cookie(r, route, value, int(s.ttl().Seconds())).String())
+	return nil
+}
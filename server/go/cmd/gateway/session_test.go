@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// useSession starts a gateway whose route logs users in at /svc/login
+func useSession(t *testing.T, secret string) {
+	startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/svc/login" {
+			w.Header().Set(defaultSessionSubject, "alice")
+			http.SetCookie(w, &http.Cookie{Name: "upstream", Value: "1"})
+			return
+		}
+		w.Write([]byte(r.Header.Get(defaultAuthUserHeader)))
+	}), func(_ *Config, route *Route) {
+		route.Session = &SessionConfig{LoginPath: "/svc/login", Secret: secret}
+	})
+}
+
+// login returns the session cookie issued by the login path
+func login(t *testing.T) *http.Cookie {
+	w := serveProxy(httptest.NewRequest("POST", "/svc/login", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body.String())
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != defaultSessionCookie {
+		t.Fatalf("login set cookies %v, want only the session cookie", cookies)
+	}
+	return cookies[0]
+}
+
+func TestSessionCookie(t *testing.T) {
+	t.Setenv("TEST_SESSION_SECRET", "0123456789abcdef0123")
+	useSession(t, "env:TEST_SESSION_SECRET")
+	cookie := login(t)
+
+	r := httptest.NewRequest("GET", "/svc/profile", nil)
+	r.AddCookie(cookie)
+	r.Header.Set(defaultAuthUserHeader, "mallory")
+	if w := serveProxy(r); w.Code != http.StatusOK || w.Body.String() != "alice" {
+		t.Fatalf("with a session: status %d, user %q; want 200 and alice", w.Code, w.Body.String())
+	}
+
+	if w := serveProxy(httptest.NewRequest("GET", "/svc/profile", nil)); w.Code != http.StatusUnauthorized {
+		t.Fatalf("without a session: status %d, want 401", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/svc/profile", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value + "0"})
+	if w := serveProxy(r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("with a tampered cookie: status %d, want 401", w.Code)
+	}
+
+	// A cookie signed with another key is not accepted
+	other := &SessionConfig{}
+	key, _ := other.key(99)
+	r = httptest.NewRequest("GET", "/svc/profile", nil)
+	r.AddCookie(&http.Cookie{Name: cookie.Name, Value: other.encode(key, 1, "alice", time.Now().Add(time.Hour))})
+	if w := serveProxy(r); w.Code != http.StatusUnauthorized {
+		t.Fatalf("with a cookie signed by another key: status %d, want 401", w.Code)
+	}
+}
+
+func TestSessionSecretUnavailable(t *testing.T) {
+	useSession(t, "env:TEST_SESSION_SECRET_UNSET")
+
+	if w := serveProxy(httptest.NewRequest("POST", "/svc/login", nil)); w.Code < 500 || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("login: status %d with cookies %v, want an error and no cookies", w.Code, w.Result().Cookies())
+	}
+	if w := serveProxy(httptest.NewRequest("GET", "/svc/profile", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("protected path: status %d, want 503", w.Code)
+	}
+}
+
+func TestCheckSessionSecret(t *testing.T) {
+	for secret, valid := range map[string]bool{
+		"0123456789abcdef":   true,
+		"short":              false,
+		"env:SESSION_SECRET": true,
+		"command:echo x":     false,
+	} {
+		var v ValidationError
+		checkSession(&SessionConfig{LoginPath: "/svc/login", Secret: secret}, "/svc", &v)
+		if got := len(v.Violations) == 0; got != valid {
+			t.Errorf("secret %q: violations %+v", secret, v.Violations)
+		}
+	}
+}
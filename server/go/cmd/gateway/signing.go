@@ -0,0 +1,291 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request signing schemes
+const (
+	SigningSigV4 = "sigv4"
+	SigningHMAC  = "hmac"
+)
+
+// HMAC signing defaults
+const (
+	defaultSignatureHeader = "X-Signature"
+	signatureTimeHeader    = "X-Signature-Timestamp"
+	signatureKeyIDHeader   = "X-Signature-Key-Id"
+)
+
+// unsignedPayload is signed in place of the hash of bodies too large to
+// buffer
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// SigningConfig signs requests to upstreams that require it, so clients do
+// not need the upstream's credentials. Credentials are secret references
+// such as env:AWS_SECRET_ACCESS_KEY.
+type SigningConfig struct {
+	Type string `json:"type"` // sigv4 or hmac
+
+	// AWS Signature Version 4, for API Gateway, S3 and other AWS targets
+	Region          string `json:"region,omitempty"`
+	Service         string `json:"service,omitempty"` // e.g. execute-api or s3
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+
+	// Generic HMAC over method, path, timestamp and body hash
+	Key       string `json:"key,omitempty"`
+	KeyID     string `json:"keyId,omitempty"`     // sent in X-Signature-Key-Id
+	Header    string `json:"header,omitempty"`    // defaults to X-Signature
+	Algorithm string `json:"algorithm,omitempty"` // sha256 (default) or sha512
+}
+
+// checkSigning validates a route's request signing settings
+func checkSigning(s *SigningConfig, v *ValidationError) {
+	if s == nil {
+		return
+	}
+	switch s.Type {
+	case SigningSigV4:
+		if s.Region == "" {
+			v.add("signing.region", "is required for sigv4")
+		}
+		if s.Service == "" {
+			v.add("signing.service", "is required for sigv4")
+		}
+		checkSecretRef("signing.accessKeyId", s.AccessKeyID, v)
+		checkSecretRef("signing.secretAccessKey", s.SecretAccessKey, v)
+		if s.SessionToken != "" {
+			checkSecretRef("signing.sessionToken", s.SessionToken, v)
+		}
+	case SigningHMAC:
+		checkSecretRef("signing.key", s.Key, v)
+		switch s.Algorithm {
+		case "", "sha256", "sha512":
+		default:
+			v.add("signing.algorithm", "unknown algorithm %q: use sha256 or sha512", s.Algorithm)
+		}
+	default:
+		v.add("signing.type", "unknown type %q: use sigv4 or hmac", s.Type)
+	}
+}
+
+// signingTransport signs each request just before it is sent, after the
+// body has been compressed and again on every retry
+type signingTransport struct {
+	base  http.RoundTripper
+	route Route
+}
+
+// RoundTrip signs the request and sends it
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	payloadHash := unsignedPayload
+	if data, ok := peekRequestBody(req); ok {
+		sum := sha256.Sum256(data)
+		payloadHash = hex.EncodeToString(sum[:])
+		if req.Body != nil && req.Body != http.NoBody {
+			req.ContentLength = int64(len(data))
+		}
+	}
+
+	var err error
+	switch s := t.route.Signing; s.Type {
+	case SigningSigV4:
+		err = s.signV4(req, payloadHash, time.Now().UTC())
+	case SigningHMAC:
+		err = s.signHMAC(req, payloadHash, time.Now().UTC())
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("signing request: %v", err)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// hmacSHA256 computes HMAC-SHA256 of data
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signV4 adds AWS Signature Version 4 headers to req
+func (s *SigningConfig) signV4(req *http.Request, payloadHash string, now time.Time) error {
+	accessKey, err := resolveSecret(s.AccessKeyID)
+	if err != nil {
+		return err
+	}
+	secretKey, err := resolveSecret(s.SecretAccessKey)
+	if err != nil {
+		return err
+	}
+	sessionToken := ""
+	if s.SessionToken != "" {
+		if sessionToken, err = resolveSecret(s.SessionToken); err != nil {
+			return err
+		}
+	}
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	// AWS checks the signature against the target host, not the client's
+	req.Host = req.URL.Host
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// Sign the host, content type and every x-amz-* header
+	headers := map[string]string{"host": req.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			trimmed := make([]string, len(values))
+			for i, value := range values {
+				trimmed[i] = strings.Join(strings.Fields(value), " ")
+			}
+			headers[lower] = strings.Join(trimmed, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// S3 paths are encoded once, other services encode the encoded path
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonicalURI := awsURIEncode(path, false)
+	if s.Service != "s3" {
+		canonicalURI = awsURIEncode(canonicalURI, false)
+	}
+
+	canonicalQuery, err := awsCanonicalQuery(req.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, as
+// SigV4 requires; slashes are kept unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsCanonicalQuery encodes query parameters for SigV4, sorted by name and
+// then value. A query that doesn't parse can't be signed as the upstream
+// will read it, so it is an error.
+func awsCanonicalQuery(rawQuery string) (string, error) {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("query: %v", err)
+	}
+	var pairs [][2]string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, [2]string{awsURIEncode(name, true), awsURIEncode(value, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	encoded := make([]string, len(pairs))
+	for i, pair := range pairs {
+		encoded[i] = pair[0] + "=" + pair[1]
+	}
+	return strings.Join(encoded, "&"), nil
+}
+
+// signHMAC signs method, path and query, timestamp and body hash, each on
+// its own line, and sends the signature hex-encoded
+func (s *SigningConfig) signHMAC(req *http.Request, payloadHash string, now time.Time) error {
+	key, err := resolveSecret(s.Key)
+	if err != nil {
+		return err
+	}
+	newHash := sha256.New
+	if s.Algorithm == "sha512" {
+		newHash = sha512.New
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	stringToSign := strings.Join([]string{req.Method, req.URL.RequestURI(), timestamp, payloadHash}, "\n")
+	mac := hmac.New(newHash, []byte(key))
+	mac.Write([]byte(stringToSign))
+
+	header := s.Header
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	req.Header.Set(signatureTimeHeader, timestamp)
+	if s.KeyID != "" {
+		req.Header.Set(signatureKeyIDHeader, s.KeyID)
+	}
+	req.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
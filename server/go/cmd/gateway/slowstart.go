@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// minWarmUpShare is the traffic share a warming service starts at
+const minWarmUpShare = 0.1
+
+// startWarmUp begins ramping up traffic to a service that just turned
+// healthy. Services known at startup take full traffic at once; services
+// added later or recovering from failed checks warm up over the slow-start
+// window, so a cold cache is not hit by the full load.
+func (svc *Service) startWarmUp(previous string, cfg HealthCheckConfig, now time.Time) {
+	svc.WarmUntil = nil
+	if cfg.SlowStart <= 0 || (previous == "unknown" && !svc.rampUp) {
+		return
+	}
+	until := now.Add(time.Duration(cfg.SlowStart) * time.Second)
+	svc.warmFrom, svc.WarmUntil = now, &until
+}
+
+// trafficShare returns the share of its traffic a service takes: all of
+// it, unless it is warming up, when the share rises linearly over the
+// slow-start window
+func (svc Service) trafficShare(now time.Time) float64 {
+	if svc.WarmUntil == nil || !now.Before(*svc.WarmUntil) {
+		return 1
+	}
+	share := float64(now.Sub(svc.warmFrom)) / float64(svc.WarmUntil.Sub(svc.warmFrom))
+	return math.Max(share, minWarmUpShare)
+}
+
+// targetShare returns the traffic share of the service behind a target
+func (p *Proxy) targetShare(target string) float64 {
+	name, err := serviceName(target)
+	if err != nil {
+		return 1
+	}
+	svc, ok := p.getService(name)
+	if !ok {
+		return 1
+	}
+	return svc.trafficShare(time.Now())
+}
+
+// divertWhileWarming reports whether a request should go to the route's
+// fallback instead of its warming target
+func (p *Proxy) divertWhileWarming(route Route) bool {
+	share := p.targetShare(route.Target)
+	return share < 1 && rand.Float64() >= share
+}
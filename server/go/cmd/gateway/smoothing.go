@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SmoothingConfig paces a route's requests to its upstream. Requests
+// arriving faster than Rate wait their turn instead of being rejected, so
+// short client bursts reach a backend with a strict ingest rate evenly.
+type SmoothingConfig struct {
+	Rate     int `json:"rate"`               // requests per second sent upstream
+	MaxQueue int `json:"maxQueue,omitempty"` // requests allowed to wait; defaults to one second's worth
+}
+
+// checkSmoothing validates a route's smoothing settings
+func checkSmoothing(s *SmoothingConfig, v *ValidationError) {
+	if s == nil {
+		return
+	}
+	if s.Rate <= 0 {
+		v.add("smoothing.rate", "must be positive")
+	}
+	if s.MaxQueue < 0 {
+		v.add("smoothing.maxQueue", "must not be negative")
+	}
+}
+
+// maxQueue returns how many requests may wait for a slot
+func (s *SmoothingConfig) maxQueue() int {
+	if s.MaxQueue > 0 {
+		return s.MaxQueue
+	}
+	return s.Rate
+}
+
+// pacer hands out evenly spaced send slots: a leaky bucket on egress
+type pacer struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	next     time.Time // earliest slot not yet handed out
+	waiting  int
+}
+
+// reserve claims the next slot, returning how long to wait for it. It
+// reports false without claiming a slot when the queue is full.
+func (p *pacer) reserve(maxQueue int) (time.Duration, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	slot := p.next
+	if slot.Before(now) {
+		slot = now
+	}
+	wait := slot.Sub(now)
+	if wait > 0 && p.waiting >= maxQueue {
+		return wait, false
+	}
+	p.next = slot.Add(p.interval)
+	if wait > 0 {
+		p.waiting++
+	}
+	return wait, true
+}
+
+// done releases a waiting request's place in the queue
+func (p *pacer) done() {
+	p.mutex.Lock()
+	p.waiting--
+	p.mutex.Unlock()
+}
+
+// pacerSet holds the pacer of each smoothed route
+type pacerSet struct {
+	mutex  sync.Mutex
+	pacers map[int]*pacer
+}
+
+// requestPacers paces routes with smoothing settings
+var requestPacers = &pacerSet{pacers: make(map[int]*pacer)}
+
+// get returns a route's pacer, replacing it if the rate changed
+func (ps *pacerSet) get(route Route) *pacer {
+	interval := time.Second / time.Duration(route.Smoothing.Rate)
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	p, ok := ps.pacers[route.ID]
+	if !ok || p.interval != interval {
+		p = &pacer{interval: interval}
+		ps.pacers[route.ID] = p
+	}
+	return p
+}
+
+// routeChanged drops the pacer of an updated or deleted route
+func (ps *pacerSet) routeChanged(change RouteChange) {
+	if change.Old == nil {
+		return
+	}
+	ps.mutex.Lock()
+	delete(ps.pacers, change.Old.ID)
+	ps.mutex.Unlock()
+}
+
+// smoothRequest holds a request until the route's pacer admits it. It
+// answers 429 when the queue is full and reports false if the request
+// should not be proxied.
+func smoothRequest(w http.ResponseWriter, r *http.Request, route Route) bool {
+	if route.Smoothing == nil || route.Smoothing.Rate <= 0 {
+		return true
+	}
+
+	p := requestPacers.get(route)
+	wait, ok := p.reserve(route.Smoothing.maxQueue())
+	if !ok {
+		proxy.recordSmoothing(route.Path, false)
+		retryAfter := int(wait.Round(time.Second) / time.Second)
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, http.StatusTooManyRequests, ErrCodeRateLimited, "Smoothing queue is full")
+		return false
+	}
+	if wait == 0 {
+		return true
+	}
+	defer p.done()
+	proxy.recordSmoothing(route.Path, true)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		// The client left; its slot stays spent so the pace is kept
+		return false
+	}
+}
+
+// recordSmoothing counts requests delayed or rejected by smoothing
+func (p *Proxy) recordSmoothing(path string, delayed bool) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	if delayed {
+		routeStat.Smoothed++
+	} else {
+		routeStat.SmoothingRejected++
+	}
+	p.stats.RouteStats[path] = routeStat
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// Route types
+const (
+	RouteTypeProxy  = "proxy"
+	RouteTypeStatic = "static"
+)
+
+// defaultStaticIndex is served for directory requests and SPA fallbacks
+const defaultStaticIndex = "index.html"
+
+// serveStatic serves a file from the route's static directory
+func serveStatic(w http.ResponseWriter, r *http.Request, route Route) {
+	index := route.StaticIndex
+	if index == "" {
+		index = defaultStaticIndex
+	}
+
+	// http.Dir rejects attempts to escape the directory
+	serveFiles(w, r, http.Dir(route.StaticDir), route.Path, index, route.SPAFallback, route.CacheMaxAge)
+}
+
+// serveFiles serves a file from root for a request under prefix, falling
+// back to the index file for client-side routes when spa is set
+func serveFiles(w http.ResponseWriter, r *http.Request, root http.FileSystem, prefix, index string, spa bool, maxAge int) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Resolve the file relative to the prefix
+	rel := strings.TrimPrefix(r.URL.Path, prefix)
+	if !strings.HasPrefix(rel, "/") {
+		rel = "/" + rel
+	}
+
+	file, info, err := openStaticFile(root, rel, index)
+	if err != nil && spa && path.Ext(rel) == "" {
+		// Client-side routes have no extension; hand them the app shell
+		file, info, err = openStaticFile(root, "/"+index, index)
+	}
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Not found")
+		return
+	}
+	defer file.Close()
+
+	// The app shell must be revalidated so new deployments are picked up
+	if info.Name() == index {
+		w.Header().Set("Cache-Control", "no-cache")
+	} else if maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	}
+
+	if compressible(info.Name()) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodGet && r.Header.Get("Range") == "" && acceptsGzip(r) {
+			gw := &gzipResponseWriter{ResponseWriter: w}
+			defer gw.Close()
+			w = gw
+		}
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// openStaticFile opens name from root, resolving directories to their index file
+func openStaticFile(root http.FileSystem, name, index string) (http.File, os.FileInfo, error) {
+	file, err := root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if info.IsDir() {
+		file.Close()
+		return openStaticIndex(root, path.Join(name, index))
+	}
+
+	return file, info, nil
+}
+
+// openStaticIndex opens an index file, refusing directories
+func openStaticIndex(root http.FileSystem, name string) (http.File, os.FileInfo, error) {
+	file, err := root.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, nil, os.ErrNotExist
+	}
+
+	return file, info, nil
+}
+
+// compressible reports whether a file's content type benefits from gzip
+func compressible(name string) bool {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "text/"):
+		return true
+	case contentType == "application/javascript", contentType == "application/json",
+		contentType == "application/xml", contentType == "image/svg+xml",
+		contentType == "application/wasm":
+		return true
+	}
+	return false
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		part = strings.TrimSpace(part)
+		if part == "gzip" || (strings.HasPrefix(part, "gzip;") && !strings.HasSuffix(part, "q=0")) {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses successful responses on the fly
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader switches to gzip encoding for 200 responses
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+
+	if status == http.StatusOK {
+		g.Header().Del("Content-Length")
+		g.Header().Set("Content-Encoding", "gzip")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the (possibly compressed) body
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// Close flushes any buffered compressed output
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
+}
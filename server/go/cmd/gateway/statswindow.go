@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// windowCounts counts one route's requests completed within a minute
+type windowCounts struct {
+	requests       int64
+	errors         int64
+	clientErrors   int64
+	upstreamErrors int64
+	gatewayErrors  int64
+	latency        float64 // seconds, summed
+	histogram      LatencyHistogram
+}
+
+// statsLogBucket holds the counts of one minute or hour by route path
+type statsLogBucket map[string]*windowCounts
+
+// entries returns the number of routes counted
+func (m statsLogBucket) entries() int {
+	return len(m)
+}
+
+// absorb adds another bucket's counts
+func (m statsLogBucket) absorb(other logBucket) {
+	for path, c := range other.(statsLogBucket) {
+		sum := m[path]
+		if sum == nil {
+			sum = &windowCounts{}
+			m[path] = sum
+		}
+		sum.requests += c.requests
+		sum.errors += c.errors
+		sum.clientErrors += c.clientErrors
+		sum.upstreamErrors += c.upstreamErrors
+		sum.gatewayErrors += c.gatewayErrors
+		sum.latency += c.latency
+		sum.histogram.merge(c.histogram)
+	}
+}
+
+// routeStatsLog keeps request counts in time buckets within the analytics
+// bounds, so stats can be scoped to a recent window
+type routeStatsLog struct {
+	mutex   sync.Mutex
+	buckets bucketLog
+}
+
+// statsLog is the gateway's request counts over time
+var statsLog = &routeStatsLog{buckets: newBucketLog(func() logBucket { return make(statsLogBucket) })}
+
+// add counts a completed request at now
+func (l *routeStatsLog) add(now time.Time, path string, latency time.Duration, status int, upstream bool, buckets []float64, limits analyticsLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	m := l.buckets.bucket(now, limits).(statsLogBucket)
+	c := m[path]
+	if c == nil {
+		c = &windowCounts{}
+		m[path] = c
+	}
+	c.requests++
+	c.latency += latency.Seconds()
+	c.histogram.observe(buckets, latency)
+	switch {
+	case status >= 500:
+		c.errors++
+		if upstream {
+			c.upstreamErrors++
+		} else {
+			c.gatewayErrors++
+		}
+	case status >= 400:
+		c.clientErrors++
+	}
+}
+
+// WindowStats are the headline stats over a time range
+type WindowStats struct {
+	Since             time.Time                  `json:"since"`
+	Until             time.Time                  `json:"until"`
+	TotalRequests     int64                      `json:"totalRequests"`
+	TotalErrors       int64                      `json:"totalErrors"`
+	RequestsPerSecond float64                    `json:"requestsPerSecond"`
+	AvgResponseTime   float64                    `json:"avgResponseTime"`
+	Latency           LatencyHistogram           `json:"latency"`
+	ErrorRate         float64                    `json:"errorRate"`
+	RouteStats        map[string]WindowRouteStat `json:"routeStats"`
+	ErrorTypes        map[string]int64           `json:"errorTypes"`
+}
+
+// WindowRouteStat are a route's stats over a time range
+type WindowRouteStat struct {
+	Requests       int64            `json:"requests"`
+	Errors         int64            `json:"errors"`         // 5xx responses from any source
+	ClientErrors   int64            `json:"clientErrors"`   // 4xx responses
+	UpstreamErrors int64            `json:"upstreamErrors"` // 5xx returned by the upstream
+	GatewayErrors  int64            `json:"gatewayErrors"`  // 5xx produced by the gateway itself
+	AvgLatency     float64          `json:"avgLatency"`
+	Latency        LatencyHistogram `json:"latency"`
+
+	RouteOwner // the route's owner and team, when set
+}
+
+// window sums the requests completed between since and until, to the
+// minute, or to the hour where counts have been merged into hours.
+// Latencies recorded under other histogram buckets are left out of the
+// histograms.
+func (l *routeStatsLog) window(since, until time.Time) WindowStats {
+	buckets := config.latencyBuckets()
+	s := WindowStats{
+		Since:      since,
+		Until:      until,
+		Latency:    newLatencyHistogram(buckets),
+		RouteStats: make(map[string]WindowRouteStat),
+		ErrorTypes: errorLog.breakdown(since, until, "").Classes,
+	}
+
+	l.mutex.Lock()
+	latency := make(map[string]float64)
+	l.buckets.each(since.Unix()/60, until.Unix()/60, func(bucket logBucket) {
+		for path, c := range bucket.(statsLogBucket) {
+			rs, ok := s.RouteStats[path]
+			if !ok {
+				rs.Latency = newLatencyHistogram(buckets)
+			}
+			rs.Requests += c.requests
+			rs.Errors += c.errors
+			rs.ClientErrors += c.clientErrors
+			rs.UpstreamErrors += c.upstreamErrors
+			rs.GatewayErrors += c.gatewayErrors
+			rs.Latency.merge(c.histogram)
+			s.RouteStats[path] = rs
+			latency[path] += c.latency
+		}
+	})
+	l.mutex.Unlock()
+
+	var totalLatency float64
+	for path, rs := range s.RouteStats {
+		rs.AvgLatency = latency[path] / float64(rs.Requests)
+		s.RouteStats[path] = rs
+		s.TotalRequests += rs.Requests
+		s.TotalErrors += rs.Errors
+		totalLatency += latency[path]
+		s.Latency.merge(rs.Latency)
+	}
+	if s.TotalRequests > 0 {
+		s.AvgResponseTime = totalLatency / float64(s.TotalRequests)
+		s.ErrorRate = float64(s.TotalErrors) / float64(s.TotalRequests)
+	}
+	if seconds := until.Sub(since).Seconds(); seconds > 0 {
+		s.RequestsPerSecond = float64(s.TotalRequests) / seconds
+	}
+	return s
+}
+
+// statsWindow reads the window stats are scoped to: window takes a
+// duration such as 5m, since an RFC 3339 time or a duration. It returns
+// false when neither is given.
+func statsWindow(r *http.Request) (time.Time, bool, error) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("window") != "" && query.Get("since") != "":
+		return time.Time{}, false, fmt.Errorf("use either window or since")
+	case query.Get("window") != "":
+		d, err := time.ParseDuration(query.Get("window"))
+		if err != nil || d <= 0 {
+			return time.Time{}, false, fmt.Errorf("window must be a duration such as 5m or 1h")
+		}
+		return time.Now().Add(-d), true, nil
+	case query.Get("since") != "":
+		since, err := parseTimeParam(r, "since", time.Time{})
+		return since, err == nil, err
+	}
+	return time.Time{}, false, nil
+}
+
+// resetStats zeroes the lifetime counters. Rolling rates, the stats
+// history and windowed stats are scoped by time and are kept.
+func (p *Proxy) resetStats() {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	p.stats = newStats()
+}
+
+// handleStatsReset zeroes the lifetime stats
+func handleStatsReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	proxy.resetStats()
+	log.Printf("Stats reset")
+	writeJSON(w, proxy.getStats())
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Storage drivers
+const (
+	StorageFile     = "file"
+	StorageSQLite   = "sqlite"
+	StoragePostgres = "postgres"
+)
+
+// Storage defaults
+const (
+	defaultHistoryInterval  = 60
+	defaultHistoryRetention = 168
+	defaultSQLiteDSN        = "gateway.db"
+)
+
+// StorageConfig selects where routes, credentials and stats history are kept.
+// With a database driver, routes in the config file only seed an empty database.
+type StorageConfig struct {
+	Driver           string `json:"driver"`           // "sqlite" (default), "postgres" or "file"
+	DSN              string `json:"dsn"`              // database file or connection string; may be a secret reference
+	HistoryInterval  int    `json:"historyInterval"`  // seconds between stats snapshots
+	HistoryRetention int    `json:"historyRetention"` // hours of stats history kept
+}
+
+// driver returns the configured driver, SQLite when none is set
+func (cfg StorageConfig) driver() string {
+	if cfg.Driver == "" {
+		return StorageSQLite
+	}
+	return cfg.Driver
+}
+
+// Credential represents an API key credential
+type Credential struct {
+	ID        int        `json:"id"`
+	RouteID   int        `json:"routeId,omitempty"` // grants this route in full
+	Name      string     `json:"name"`
+	APIKey    string     `json:"apiKey"`
+	APISecret string     `json:"apiSecret,omitempty"` // Not returned in listings
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Enabled   bool       `json:"enabled"`
+
+	// Entitlements grant further routes, by ID or tag, with scopes
+	Entitlements []Entitlement `json:"entitlements,omitempty"`
+}
+
+// StatsSnapshot is a point-in-time copy of the headline gateway stats
+type StatsSnapshot struct {
+	Time              time.Time `json:"time"`
+	TotalRequests     int64     `json:"totalRequests"`
+	TotalErrors       int64     `json:"totalErrors"`
+	RequestsPerSecond float64   `json:"requestsPerSecond"`
+	AvgResponseTime   float64   `json:"avgResponseTime"`
+	ErrorRate         float64   `json:"errorRate"`
+	ActiveConnections int       `json:"activeConnections"`
+}
+
+// Store persists routes, credentials and stats history
+type Store interface {
+	// LoadRoutes returns the persisted routes
+	LoadRoutes() ([]Route, error)
+	// SaveRoute creates or replaces a route
+	SaveRoute(route Route) error
+	// DeleteRoute removes a route
+	DeleteRoute(id int) error
+	// ReplaceRoutes atomically replaces every route
+	ReplaceRoutes(routes []Route) error
+
+	ListCredentials() ([]Credential, error)
+	CreateCredential(cred Credential) (Credential, error)
+	// UpdateCredential replaces the credential with cred's ID
+	UpdateCredential(cred Credential) (bool, error)
+	DeleteCredential(id int) (bool, error)
+
+	// RecordStats stores a snapshot and drops snapshots older than retention
+	RecordStats(snapshot StatsSnapshot, retention time.Duration) error
+	// StatsHistory returns snapshots taken since the given time, oldest first
+	StatsHistory(since time.Time) ([]StatsSnapshot, error)
+
+	Close() error
+}
+
+// newStore opens the configured store. SQLite is the default; its
+// database sits beside the config file unless a dsn names another.
+func newStore(cfg StorageConfig, config *Config) (Store, error) {
+	dsn, err := resolveSecret(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("storage: dsn: %v", err)
+	}
+	switch cfg.driver() {
+	case StorageFile:
+		return newFileStore(config)
+	case StorageSQLite:
+		if dsn == "" {
+			dsn = filepath.Join(filepath.Dir(config.settings().configFilePath), defaultSQLiteDSN)
+		}
+		return openSQLStore(sqliteDialect, dsn)
+	case StoragePostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("storage: postgres requires a dsn")
+		}
+		return openSQLStore(postgresDialect, dsn)
+	}
+	return nil, fmt.Errorf("storage: unsupported driver %q", cfg.Driver)
+}
+
+// historySettings returns the snapshot interval and retention
+func (cfg StorageConfig) historySettings() (time.Duration, time.Duration) {
+	interval, retention := cfg.HistoryInterval, cfg.HistoryRetention
+	if interval <= 0 {
+		interval = defaultHistoryInterval
+	}
+	if retention <= 0 {
+		retention = defaultHistoryRetention
+	}
+	return time.Duration(interval) * time.Second, time.Duration(retention) * time.Hour
+}
+
+// loadRoutesFrom replaces the config's routes with the stored ones. An
+// empty store is seeded from the routes in the config file instead.
+func (c *Config) loadRoutesFrom(s Store) error {
+	routes, err := s.LoadRoutes()
+	if err != nil {
+		return err
+	}
+	if len(routes) == 0 && len(c.Routes) > 0 {
+		return s.ReplaceRoutes(c.getRoutes())
+	}
+	c.setRoutes(routes)
+	return nil
+}
+
+// recordHistory schedules snapshots of the stats into the store. Only the
+// leader records into a Postgres database the replicas share.
+func (p *Proxy) recordHistory(ctx context.Context, s Store, cfg StorageConfig) {
+	interval, retention := cfg.historySettings()
+	jobs.start(ctx, jobSpec{
+		name:      "stats-history",
+		interval:  every(interval),
+		singleton: cfg.driver() == StoragePostgres,
+		run: func(_ context.Context, now time.Time) error {
+			stats := p.getStats()
+			snapshot := StatsSnapshot{
+				Time:              now,
+				TotalRequests:     stats.TotalRequests,
+				TotalErrors:       stats.TotalErrors,
+				RequestsPerSecond: stats.RPS1m,
+				AvgResponseTime:   stats.AvgResponseTime,
+				ErrorRate:         stats.ErrorRate1m,
+				ActiveConnections: stats.ActiveConnections,
+			}
+			return s.RecordStats(snapshot, retention)
+		},
+	})
+}
+
+// fileStore keeps routes in the config file, credentials in a JSON file
+// beside it and stats history in memory
+type fileStore struct {
+	config          *Config
+	credentialsPath string
+
+	mutex       sync.Mutex
+	credentials []Credential
+	nextCredID  int
+	history     []StatsSnapshot
+}
+
+// newFileStore creates a file store, loading any saved credentials
+func newFileStore(config *Config) (*fileStore, error) {
+	s := &fileStore{
+		config:          config,
+		credentialsPath: filepath.Join(filepath.Dir(config.settings().configFilePath), "credentials.json"),
+		nextCredID:      1,
+	}
+
+	raw, err := ioutil.ReadFile(s.credentialsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	data, err := fileCrypto.open(s.credentialsPath, raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.credentials); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.credentialsPath, err)
+		}
+	}
+	for _, cred := range s.credentials {
+		if cred.ID >= s.nextCredID {
+			s.nextCredID = cred.ID + 1
+		}
+	}
+
+	// Encrypt plaintext credentials once a key is configured
+	if fileCrypto != nil && len(raw) > 0 && !isEncrypted(raw) {
+		log.Printf("Encrypting %s", s.credentialsPath)
+		if err := s.writeCredentials(s.credentials); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// LoadRoutes returns the routes read from the config file
+func (s *fileStore) LoadRoutes() ([]Route, error) {
+	return s.config.getRoutes(), nil
+}
+
+// SaveRoute writes the config file, which already holds the route
+func (s *fileStore) SaveRoute(route Route) error {
+	return s.config.save()
+}
+
+// DeleteRoute writes the config file, from which the route was removed
+func (s *fileStore) DeleteRoute(id int) error {
+	return s.config.save()
+}
+
+// ReplaceRoutes writes the config file
+func (s *fileStore) ReplaceRoutes(routes []Route) error {
+	return s.config.save()
+}
+
+// ListCredentials returns all credentials
+func (s *fileStore) ListCredentials() ([]Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	creds := make([]Credential, len(s.credentials))
+	copy(creds, s.credentials)
+	return creds, nil
+}
+
+// CreateCredential stores a credential and assigns its ID
+func (s *fileStore) CreateCredential(cred Credential) (Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, c := range s.credentials {
+		if c.APIKey == cred.APIKey {
+			return Credential{}, fmt.Errorf("credential with API key already exists")
+		}
+	}
+
+	cred.ID = s.nextCredID
+	creds := append(append([]Credential(nil), s.credentials...), cred)
+	if err := s.writeCredentials(creds); err != nil {
+		return Credential{}, err
+	}
+
+	s.credentials = creds
+	s.nextCredID++
+	return cred, nil
+}
+
+// UpdateCredential replaces a credential by ID
+func (s *fileStore) UpdateCredential(cred Credential) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, c := range s.credentials {
+		if c.ID != cred.ID {
+			continue
+		}
+		creds := append([]Credential(nil), s.credentials...)
+		creds[i] = cred
+		if err := s.writeCredentials(creds); err != nil {
+			return false, err
+		}
+		s.credentials = creds
+		return true, nil
+	}
+	return false, nil
+}
+
+// DeleteCredential removes a credential by ID
+func (s *fileStore) DeleteCredential(id int) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, c := range s.credentials {
+		if c.ID != id {
+			continue
+		}
+		creds := append(append([]Credential(nil), s.credentials[:i]...), s.credentials[i+1:]...)
+		if err := s.writeCredentials(creds); err != nil {
+			return false, err
+		}
+		s.credentials = creds
+		return true, nil
+	}
+	return false, nil
+}
+
+// writeCredentials replaces the credentials file atomically
+func (s *fileStore) writeCredentials(creds []Credential) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.credentialsPath + ".tmp"
+	if err := fileCrypto.writeFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.credentialsPath)
+}
+
+// RecordStats keeps a snapshot in memory
+func (s *fileStore) RecordStats(snapshot StatsSnapshot, retention time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := snapshot.Time.Add(-retention)
+	kept := s.history[:0]
+	for _, h := range s.history {
+		if h.Time.After(cutoff) {
+			kept = append(kept, h)
+		}
+	}
+	s.history = append(kept, snapshot)
+	return nil
+}
+
+// StatsHistory returns snapshots taken since the given time
+func (s *fileStore) StatsHistory(since time.Time) ([]StatsSnapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var history []StatsSnapshot
+	for _, h := range s.history {
+		if !h.Time.Before(since) {
+			history = append(history, h)
+		}
+	}
+	return history, nil
+}
+
+// Close releases nothing; files are written as changes are made
+func (s *fileStore) Close() error {
+	return nil
+}
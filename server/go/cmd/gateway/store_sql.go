@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// sqlDialect describes the differences between the supported databases
+type sqlDialect struct {
+	name       string // storage driver name
+	driver     string // database/sql driver name
+	autoID     string // auto-incrementing primary key column type
+	dollarArgs bool   // placeholders are $1, $2... rather than ?
+}
+
+var (
+	sqliteDialect   = sqlDialect{name: StorageSQLite, driver: "sqlite", autoID: "INTEGER PRIMARY KEY AUTOINCREMENT"}
+	postgresDialect = sqlDialect{name: StoragePostgres, driver: "postgres", autoID: "SERIAL PRIMARY KEY", dollarArgs: true}
+)
+
+// rebind rewrites ? placeholders for the dialect
+func (d sqlDialect) rebind(query string) string {
+	if !d.dollarArgs {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// schema returns the statements that create the store's tables
+func (d sqlDialect) schema() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS routes (
+			id INTEGER PRIMARY KEY,
+			path TEXT NOT NULL,
+			data TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS credentials (
+			id ` + d.autoID + `,
+			route_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			api_key TEXT NOT NULL UNIQUE,
+			api_secret TEXT NOT NULL,
+			created BIGINT NOT NULL,
+			last_used BIGINT NOT NULL DEFAULT 0,
+			enabled BOOLEAN NOT NULL,
+			entitlements TEXT NOT NULL DEFAULT '[]'
+		)`,
+		`CREATE TABLE IF NOT EXISTS stats_history (
+			recorded_at BIGINT NOT NULL,
+			data TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS stats_history_recorded_at ON stats_history (recorded_at)`,
+	}
+}
+
+// sqlStore keeps routes, credentials and stats history in a database.
+// Routes are stored as JSON so new route fields need no migration.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// openSQLStore connects to the database and creates missing tables
+func openSQLStore(dialect sqlDialect, dsn string) (*sqlStore, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("storage: %v", err)
+	}
+	if dialect.name == StorageSQLite {
+		// SQLite allows a single writer; serialise access instead of
+		// failing with "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: connecting to %s: %v", dialect.name, err)
+	}
+	for _, stmt := range dialect.schema() {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("storage: creating schema: %v", err)
+		}
+	}
+	if err := migrateSchema(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("storage: migrating schema: %v", err)
+	}
+
+	return &sqlStore{db: db, dialect: dialect}, nil
+}
+
+// migrateSchema adds columns missing from tables created by older versions
+func migrateSchema(db *sql.DB) error {
+	if _, err := db.Exec(`SELECT entitlements FROM credentials LIMIT 0`); err != nil {
+		if _, err := db.Exec(`ALTER TABLE credentials ADD COLUMN entitlements TEXT NOT NULL DEFAULT '[]'`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exec runs a statement with dialect placeholders
+func (s *sqlStore) exec(q execer, query string, args ...interface{}) (sql.Result, error) {
+	return q.Exec(s.dialect.rebind(query), args...)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// LoadRoutes returns the persisted routes ordered by ID
+func (s *sqlStore) LoadRoutes() ([]Route, error) {
+	rows, err := s.db.Query(`SELECT id, data FROM routes ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes []Route
+	for rows.Next() {
+		var id int
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var route Route
+		if err := json.Unmarshal([]byte(data), &route); err != nil {
+			return nil, fmt.Errorf("route %d: %v", id, err)
+		}
+		route.ID = id
+		routes = append(routes, route)
+	}
+	return routes, rows.Err()
+}
+
+// SaveRoute creates or replaces a route
+func (s *sqlStore) SaveRoute(route Route) error {
+	return s.saveRoute(s.db, route)
+}
+
+// saveRoute upserts a route
+func (s *sqlStore) saveRoute(q execer, route Route) error {
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+	_, err = s.exec(q, `INSERT INTO routes (id, path, data) VALUES (?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET path = excluded.path, data = excluded.data`,
+		route.ID, route.Path, string(data))
+	return err
+}
+
+// DeleteRoute removes a route
+func (s *sqlStore) DeleteRoute(id int) error {
+	_, err := s.exec(s.db, `DELETE FROM routes WHERE id = ?`, id)
+	return err
+}
+
+// ReplaceRoutes replaces every route in one transaction
+func (s *sqlStore) ReplaceRoutes(routes []Route) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM routes`); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := s.saveRoute(tx, route); err != nil {
+			return fmt.Errorf("route %d: %v", route.ID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ListCredentials returns all credentials ordered by ID
+func (s *sqlStore) ListCredentials() ([]Credential, error) {
+	rows, err := s.db.Query(`SELECT id, route_id, name, api_key, api_secret, created, last_used, enabled, entitlements FROM credentials ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []Credential
+	for rows.Next() {
+		var c Credential
+		var created, lastUsed int64
+		var entitlements string
+		if err := rows.Scan(&c.ID, &c.RouteID, &c.Name, &c.APIKey, &c.APISecret, &created, &lastUsed, &c.Enabled, &entitlements); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(entitlements), &c.Entitlements); err != nil {
+			return nil, fmt.Errorf("credential %d: %v", c.ID, err)
+		}
+		c.Created = time.UnixMilli(created)
+		if lastUsed > 0 {
+			t := time.UnixMilli(lastUsed)
+			c.LastUsed = &t
+		}
+		creds = append(creds, c)
+	}
+	return creds, rows.Err()
+}
+
+// CreateCredential stores a credential and assigns its ID
+func (s *sqlStore) CreateCredential(cred Credential) (Credential, error) {
+	var lastUsed int64
+	if cred.LastUsed != nil {
+		lastUsed = cred.LastUsed.UnixMilli()
+	}
+
+	entitlements, err := json.Marshal(cred.Entitlements)
+	if err != nil {
+		return Credential{}, err
+	}
+	if cred.Entitlements == nil {
+		entitlements = []byte("[]")
+	}
+
+	query := s.dialect.rebind(`INSERT INTO credentials (route_id, name, api_key, api_secret, created, last_used, enabled, entitlements)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`)
+	err = s.db.QueryRow(query, cred.RouteID, cred.Name, cred.APIKey, cred.APISecret,
+		cred.Created.UnixMilli(), lastUsed, cred.Enabled, string(entitlements)).Scan(&cred.ID)
+	if err != nil {
+		return Credential{}, err
+	}
+	return cred, nil
+}
+
+// UpdateCredential replaces a credential by ID
+func (s *sqlStore) UpdateCredential(cred Credential) (bool, error) {
+	var lastUsed int64
+	if cred.LastUsed != nil {
+		lastUsed = cred.LastUsed.UnixMilli()
+	}
+
+	entitlements, err := json.Marshal(cred.Entitlements)
+	if err != nil {
+		return false, err
+	}
+	if cred.Entitlements == nil {
+		entitlements = []byte("[]")
+	}
+
+	res, err := s.exec(s.db, `UPDATE credentials SET route_id = ?, name = ?, api_key = ?, api_secret = ?, created = ?, last_used = ?, enabled = ?, entitlements = ?
+		WHERE id = ?`, cred.RouteID, cred.Name, cred.APIKey, cred.APISecret,
+		cred.Created.UnixMilli(), lastUsed, cred.Enabled, string(entitlements), cred.ID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// DeleteCredential removes a credential by ID
+func (s *sqlStore) DeleteCredential(id int) (bool, error) {
+	res, err := s.exec(s.db, `DELETE FROM credentials WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RecordStats stores a snapshot and prunes expired history
+func (s *sqlStore) RecordStats(snapshot StatsSnapshot, retention time.Duration) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := s.exec(tx, `INSERT INTO stats_history (recorded_at, data) VALUES (?, ?)`, snapshot.Time.UnixMilli(), string(data)); err != nil {
+		return err
+	}
+	if _, err := s.exec(tx, `DELETE FROM stats_history WHERE recorded_at < ?`, snapshot.Time.Add(-retention).UnixMilli()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// StatsHistory returns snapshots taken since the given time, oldest first
+func (s *sqlStore) StatsHistory(since time.Time) ([]StatsSnapshot, error) {
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT data FROM stats_history WHERE recorded_at >= ? ORDER BY recorded_at`), since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StatsSnapshot
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var snapshot StatsSnapshot
+		if err := json.Unmarshal([]byte(data), &snapshot); err != nil {
+			return nil, err
+		}
+		history = append(history, snapshot)
+	}
+	return history, rows.Err()
+}
+
+// Close closes the database
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	cfg := defaultConfig(filepath.Join(t.TempDir(), "config.json"))
+	s, err := newStore(cfg.Storage, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.(*sqlStore); !ok {
+		t.Fatalf("default store is %T, want SQLite", s)
+	}
+
+	routes := []Route{{ID: 1, Path: "/a", Target: "http://a"}, {ID: 2, Path: "/b", Target: "http://b"}}
+	if err := s.ReplaceRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	routes[1].Path = "/b2"
+	if err := s.SaveRoute(routes[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteRoute(1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.LoadRoutes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].ID != 2 || got[0].Path != "/b2" {
+		t.Fatalf("routes %+v, want only route 2 at /b2", got)
+	}
+
+	cred, err := s.CreateCredential(Credential{Name: "ci", APIKey: "key-1", Created: time.Now(), Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateCredential(Credential{Name: "dup", APIKey: "key-1", Created: time.Now()}); err == nil {
+		t.Fatal("a duplicate API key was stored")
+	}
+	cred.Enabled = false
+	if ok, err := s.UpdateCredential(cred); !ok || err != nil {
+		t.Fatalf("UpdateCredential = %v, %v", ok, err)
+	}
+	creds, err := s.ListCredentials()
+	if err != nil || len(creds) != 1 || creds[0].Enabled {
+		t.Fatalf("credentials %+v, %v; want one disabled credential", creds, err)
+	}
+
+	now := time.Now()
+	for _, age := range []time.Duration{3 * time.Hour, time.Hour, 0} {
+		if err := s.RecordStats(StatsSnapshot{Time: now.Add(-age), TotalRequests: int64(age / time.Hour)}, 2*time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := s.StatsHistory(now.Add(-90 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].TotalRequests != 1 || history[1].TotalRequests != 0 {
+		t.Fatalf("history %+v, want the last two snapshots oldest first", history)
+	}
+}
+
+func TestStoreSeedsFromConfig(t *testing.T) {
+	cfg := defaultConfig(filepath.Join(t.TempDir(), "config.json"))
+	cfg.setRoutes([]Route{{ID: 4, Path: "/seed", Target: "http://seed"}})
+	s, err := newStore(cfg.Storage, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := cfg.loadRoutesFrom(s); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.LoadRoutes()
+	if err != nil || len(stored) != 1 || stored[0].Path != "/seed" {
+		t.Fatalf("stored routes %+v, %v; want the config's route", stored, err)
+	}
+
+	// Once seeded, the database's routes win over the file's
+	cfg.setRoutes([]Route{{ID: 5, Path: "/file", Target: "http://file"}})
+	if err := cfg.loadRoutesFrom(s); err != nil {
+		t.Fatal(err)
+	}
+	if routes := cfg.getRoutes(); len(routes) != 1 || routes[0].Path != "/seed" {
+		t.Fatalf("routes %+v after loading, want the stored route", routes)
+	}
+}
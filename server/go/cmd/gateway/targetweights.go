@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// WeightedTarget is one upstream of a route's target pool
+type WeightedTarget struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"` // relative share of requests; defaults to 1
+}
+
+// TargetStat counts the requests sent to a pooled target
+type TargetStat struct {
+	Requests int64 `json:"requests"`
+	Weight   int   `json:"weight"` // current weight
+}
+
+// TargetWeight is a pooled target's weight as the admin API reports it
+type TargetWeight struct {
+	Service    string `json:"service"`
+	Target     string `json:"target"` // host:port
+	Weight     int    `json:"weight"`
+	Configured int    `json:"configured"`         // weight set on the routes
+	Override   bool   `json:"override,omitempty"` // weight set at runtime
+	Routes     []int  `json:"routes"`
+	Requests   int64  `json:"requests"`
+}
+
+// targetWeightsMutex serializes changes to the weight overrides. The map is
+// copied on write, so readers use the one in their settings snapshot.
+var targetWeightsMutex sync.Mutex
+
+// checkTargets validates a route's target pool and makes its first
+// target the route's target, which health checks and fallbacks watch
+func checkTargets(route *Route, v *ValidationError) {
+	if len(route.Targets) == 0 {
+		return
+	}
+	inPool := false
+	for i, t := range route.Targets {
+		prefix := fmt.Sprintf("targets[%d]", i)
+		if err := validateTargetURL(t.URL); err != nil {
+			v.add(prefix+".url", "%v", err)
+		}
+		if t.Weight < 0 {
+			v.add(prefix+".weight", "must not be negative")
+		}
+		inPool = inPool || t.URL == route.Target
+	}
+	if route.Target == "" {
+		route.Target = route.Targets[0].URL
+	} else if !inPool {
+		v.add("target", "must be one of targets when a pool is set")
+	}
+}
+
+// checkTargetWeights validates the runtime weight overrides
+func checkTargetWeights(weights map[string]int, v *ValidationError) {
+	for target, weight := range weights {
+		if weight < 0 {
+			v.add("targetWeights."+target, "must not be negative")
+		}
+	}
+}
+
+// targetHost returns the host:port a target URL is addressed by
+func targetHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+	return u.Host
+}
+
+// targetWeight returns a pooled target's effective weight
+func targetWeight(t WeightedTarget) int {
+	weights := config.settings().TargetWeights
+	if weight, ok := weights[targetHost(t.URL)]; ok {
+		return weight
+	}
+	if t.Weight == 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// balanceTargets sends a pooled route's request to one of its targets,
+// chosen by weight. Targets of unhealthy or draining services are skipped
+// while others can take the request. It answers 503 and returns false
+// when every target has weight 0.
+func balanceTargets(w http.ResponseWriter, r *http.Request, route *Route) bool {
+	if len(route.Targets) == 0 {
+		return true
+	}
+	weights := make([]int, len(route.Targets))
+	total, healthyTotal := 0, 0
+	healthy := make([]bool, len(route.Targets))
+	for i, t := range route.Targets {
+		weights[i] = targetWeight(t)
+		total += weights[i]
+		probe := Route{Target: t.URL}
+		healthy[i] = !proxy.primaryUnhealthy(probe) && !proxy.targetDraining(probe)
+		if healthy[i] {
+			healthyTotal += weights[i]
+		}
+	}
+	if total == 0 {
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "No target of the route has weight")
+		return false
+	}
+
+	pick := rand.Intn(total)
+	if healthyTotal > 0 {
+		pick = rand.Intn(healthyTotal)
+	}
+	for i, t := range route.Targets {
+		if healthyTotal > 0 && !healthy[i] {
+			continue
+		}
+		if pick < weights[i] {
+			route.Target = t.URL
+			proxy.recordTargetPick(targetHost(t.URL), weights[i])
+			return true
+		}
+		pick -= weights[i]
+	}
+	return true
+}
+
+// recordTargetPick counts a request sent to a pooled target
+func (p *Proxy) recordTargetPick(target string, weight int) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	stat := p.stats.Targets[target]
+	stat.Requests++
+	stat.Weight = weight
+	p.stats.Targets[target] = stat
+}
+
+// recordTargetWeight shows a changed weight in the target's stats
+func (p *Proxy) recordTargetWeight(target string, weight int) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	stat := p.stats.Targets[target]
+	stat.Weight = weight
+	p.stats.Targets[target] = stat
+}
+
+// pooledTarget finds a service's target in the route pools
+func pooledTarget(service, target string) (TargetWeight, bool) {
+	tw := TargetWeight{Service: service, Target: target, Routes: []int{}}
+	found := false
+	for _, route := range config.getRoutes() {
+		for _, t := range route.Targets {
+			if name, err := serviceName(t.URL); err != nil || name != service || targetHost(t.URL) != target {
+				continue
+			}
+			if !found {
+				tw.Configured = t.Weight
+				if tw.Configured == 0 {
+					tw.Configured = 1
+				}
+				tw.Weight = targetWeight(t)
+			}
+			found = true
+			tw.Routes = append(tw.Routes, route.ID)
+		}
+	}
+	if !found {
+		return tw, false
+	}
+	sort.Ints(tw.Routes)
+	_, tw.Override = config.settings().TargetWeights[target]
+	tw.Requests = proxy.getStats().Targets[target].Requests
+	return tw, true
+}
+
+// setTargetWeight overrides a target's weight, or with weight nil restores
+// its configured one, and saves the config
+func setTargetWeight(target string, weight *int) error {
+	targetWeightsMutex.Lock()
+	defer targetWeightsMutex.Unlock()
+
+	settings := *config.settings()
+	weights := make(map[string]int, len(settings.TargetWeights)+1)
+	for t, w := range settings.TargetWeights {
+		weights[t] = w
+	}
+	if weight != nil {
+		weights[target] = *weight
+	} else {
+		delete(weights, target)
+	}
+	if len(weights) == 0 {
+		weights = nil
+	}
+	settings.TargetWeights = weights
+	config.setSettings(settings)
+	return config.save()
+}
+
+// handleTargetWeight reads, sets and resets the weight of a pooled target
+// at /api/services/{name}/targets/{target}/weight
+func handleTargetWeight(w http.ResponseWriter, r *http.Request, service, target string) {
+	if target == "" || strings.Contains(target, "/") {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Target not found")
+		return
+	}
+	tw, found := pooledTarget(service, target)
+	if !found {
+		writeError(w, r, http.StatusNotFound, ErrCodeNotFound, "Target not found in any route's target pool")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, tw)
+		return
+
+	case http.MethodPut:
+		var req struct {
+			Weight *int `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+		if req.Weight == nil || *req.Weight < 0 {
+			writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Weight is invalid", []Violation{{Field: "weight", Message: "must be a non-negative integer"}})
+			return
+		}
+		if err := setTargetWeight(target, req.Weight); err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save weight: %v", err))
+			return
+		}
+		log.Printf("Weight of target %s of service %s set to %d", target, service, *req.Weight)
+
+	case http.MethodDelete:
+		if err := setTargetWeight(target, nil); err != nil {
+			writeError(w, r, http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Failed to save weight: %v", err))
+			return
+		}
+		log.Printf("Weight of target %s of service %s reset to %d", target, service, tw.Configured)
+
+	default:
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	tw, _ = pooledTarget(service, target)
+	proxy.recordTargetWeight(target, tw.Weight)
+	writeJSON(w, tw)
+}
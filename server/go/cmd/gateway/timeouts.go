@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errIdleTimeout is reported when a streamed upstream response stalls
+var errIdleTimeout = errors.New("upstream idle timeout")
+
+// defaultConnectTimeout bounds dialing upstreams, as http.DefaultTransport does
+const defaultConnectTimeout = 30
+
+// Stages of an upstream exchange that can time out
+const (
+	TimeoutStageDial    = "dial"
+	TimeoutStageHeaders = "headers"
+	TimeoutStageBody    = "body"
+)
+
+// RouteTimeouts separates the timeouts applied to proxied requests, so a
+// long-lived stream and a short CRUD call can each be bounded sensibly
+type RouteTimeouts struct {
+	Connect        int `json:"connect,omitempty"`        // seconds to establish the upstream connection; defaults to 30
+	ResponseHeader int `json:"responseHeader,omitempty"` // seconds to wait for response headers; defaults to the route timeout
+	Total          int `json:"total,omitempty"`          // seconds for the whole exchange, including streaming the body
+	Idle           int `json:"idle,omitempty"`           // seconds a response body may go without data
+}
+
+// checkTimeouts reports negative timeouts
+func checkTimeouts(t *RouteTimeouts, v *ValidationError) {
+	if t == nil {
+		return
+	}
+	checkNonNegative("timeouts", []namedInt{
+		{"connect", t.Connect},
+		{"responseHeader", t.ResponseHeader},
+		{"total", t.Total},
+		{"idle", t.Idle},
+	}, v)
+	if t.Total > 0 && t.ResponseHeader > t.Total {
+		v.add("timeouts.responseHeader", "must not exceed timeouts.total")
+	}
+}
+
+// connectTimeout returns how long to wait for an upstream connection
+func (r Route) connectTimeout() time.Duration {
+	if r.Timeouts != nil && r.Timeouts.Connect > 0 {
+		return time.Duration(r.Timeouts.Connect) * time.Second
+	}
+	return defaultConnectTimeout * time.Second
+}
+
+// responseHeaderTimeout returns how long to wait for upstream headers
+func (r Route) responseHeaderTimeout(defaultTimeout int) time.Duration {
+	timeout := r.Timeout
+	if r.Timeouts != nil && r.Timeouts.ResponseHeader > 0 {
+		timeout = r.Timeouts.ResponseHeader
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// totalTimeout returns the deadline for the whole exchange, or 0 for none
+func (r Route) totalTimeout() time.Duration {
+	if r.Timeouts == nil {
+		return 0
+	}
+	return time.Duration(r.Timeouts.Total) * time.Second
+}
+
+// idleTimeout returns the allowed gap between body reads, or 0 for none
+func (r Route) idleTimeout() time.Duration {
+	if r.Timeouts == nil {
+		return 0
+	}
+	return time.Duration(r.Timeouts.Idle) * time.Second
+}
+
+// idleTimeoutBody cancels the upstream request when its body produces no
+// data for the idle timeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut int32
+}
+
+// newIdleTimeoutBody wraps body, calling cancel if it stalls
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutBody {
+	b := &idleTimeoutBody{ReadCloser: body, timeout: timeout}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.timedOut, 1)
+		cancel()
+	})
+	return b
+}
+
+// Read resets the idle timer whenever data arrives
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && atomic.LoadInt32(&b.timedOut) == 1 {
+		err = errIdleTimeout
+	}
+	return n, err
+}
+
+// Close stops the idle timer
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.ReadCloser.Close()
+}
+
+// upstreamTimeoutError reports which stage of an upstream exchange timed
+// out and the limit that expired
+type upstreamTimeoutError struct {
+	stage   string
+	limit   string // the setting that expired, e.g. timeouts.total
+	timeout time.Duration
+}
+
+func (e *upstreamTimeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %s (%s)", e.stage, e.timeout, e.limit)
+}
+
+// TimeoutDetails describes a timeout in gateway_timeout error responses
+type TimeoutDetails struct {
+	Stage   string  `json:"stage"`   // dial, headers or body
+	Limit   string  `json:"limit"`   // the setting that expired
+	Seconds float64 `json:"seconds"` // its value
+}
+
+// details returns the error response details for the timeout
+func (e *upstreamTimeoutError) details() TimeoutDetails {
+	return TimeoutDetails{Stage: e.stage, Limit: e.limit, Seconds: e.timeout.Seconds()}
+}
+
+// isTimeout reports whether err is a deadline or network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errIdleTimeout) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// classifyTimeout turns a timeout of an upstream exchange into an
+// upstreamTimeoutError, or returns nil for other errors. ctx is the
+// exchange's context, which carries the total deadline; headersReceived
+// tells header timeouts from body timeouts.
+func classifyTimeout(err error, ctx context.Context, route Route, defaultTimeout int, headersReceived bool) *upstreamTimeoutError {
+	var timeoutErr *upstreamTimeoutError
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr
+	}
+	if !isTimeout(err) {
+		return nil
+	}
+
+	e := &upstreamTimeoutError{stage: TimeoutStageHeaders}
+	var opErr *net.OpError
+	switch {
+	case headersReceived || errors.Is(err, errIdleTimeout):
+		e.stage = TimeoutStageBody
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		e.stage = TimeoutStageDial
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		e.limit, e.timeout = "timeouts.total", route.totalTimeout()
+	case e.stage == TimeoutStageDial:
+		e.limit, e.timeout = "timeouts.connect", route.connectTimeout()
+	case e.stage == TimeoutStageBody:
+		e.limit, e.timeout = "timeouts.idle", route.idleTimeout()
+	case route.Timeouts != nil && route.Timeouts.ResponseHeader > 0:
+		e.limit, e.timeout = "timeouts.responseHeader", route.responseHeaderTimeout(defaultTimeout)
+	case route.Timeout > 0:
+		e.limit, e.timeout = "timeout", route.responseHeaderTimeout(defaultTimeout)
+	default:
+		e.limit, e.timeout = "defaultTimeout", route.responseHeaderTimeout(defaultTimeout)
+	}
+	return e
+}
+
+// timeoutWatchBody reports the first read of a streamed upstream response
+// that fails with a timeout, which can no longer become an error response
+type timeoutWatchBody struct {
+	io.ReadCloser
+	report func(error)
+	once   sync.Once
+}
+
+// Read passes reads through, reporting timeouts
+func (b *timeoutWatchBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && isTimeout(err) {
+		b.once.Do(func() { b.report(err) })
+	}
+	return n, err
+}
+
+// recordTimeout counts an upstream timeout by stage
+func (p *Proxy) recordTimeout(path string, e *upstreamTimeoutError) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	routeStat := p.stats.RouteStats[path]
+	switch e.stage {
+	case TimeoutStageDial:
+		routeStat.DialTimeouts++
+	case TimeoutStageHeaders:
+		routeStat.HeaderTimeouts++
+	case TimeoutStageBody:
+		routeStat.BodyTimeouts++
+	}
+	p.stats.RouteStats[path] = routeStat
+}
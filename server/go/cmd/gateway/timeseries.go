@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxTimeseriesPoints bounds the points one timeseries request returns
+const maxTimeseriesPoints = 10000
+
+// timeseriesMetrics are the metrics a timeseries can chart
+var timeseriesMetrics = map[string]bool{"rps": true, "errors": true, "p95": true}
+
+// TimeseriesPoint is a metric's value over one step
+type TimeseriesPoint struct {
+	Time  time.Time `json:"time"`  // start of the step
+	Value *float64  `json:"value"` // null for p95 in steps without requests
+}
+
+// Timeseries is a metric over steps aligned to multiples of the step since
+// the Unix epoch, one point per step whether or not it saw requests
+type Timeseries struct {
+	Metric string            `json:"metric"`
+	Route  string            `json:"route,omitempty"` // empty for all routes
+	Step   int64             `json:"step"`            // seconds
+	Since  time.Time         `json:"since"`
+	Until  time.Time         `json:"until"`
+	Points []TimeseriesPoint `json:"points"`
+}
+
+// stepCounts are the requests counted in one step
+type stepCounts struct {
+	requests float64
+	errors   float64
+	latency  LatencyHistogram
+}
+
+// steps sums the requests of one route, or all routes with route empty,
+// into steps from the step holding since to the one holding until. Counts
+// merged into hours are spread evenly over the steps the hour covers, and
+// their latencies count in each.
+func (l *routeStatsLog) steps(route string, since, until time.Time, step int64, buckets []float64) (int64, []stepCounts) {
+	first := since.Unix() / step * step
+	counts := make([]stepCounts, (until.Unix()-first)/step+1)
+	for i := range counts {
+		counts[i].latency = newLatencyHistogram(buckets)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.buckets.spans(first/60, until.Unix()/60, func(start, minutes int64, bucket logBucket) {
+		from, to := start*60, (start+minutes)*60
+		for path, c := range bucket.(statsLogBucket) {
+			if route != "" && path != route {
+				continue
+			}
+			for t := from - (from-first)%step; t < to; t += step {
+				i := (t - first) / step
+				if i < 0 || i >= int64(len(counts)) {
+					continue
+				}
+				overlap := min64(t+step, to) - max64(t, from)
+				share := float64(overlap) / float64(to-from)
+				counts[i].requests += float64(c.requests) * share
+				counts[i].errors += float64(c.errors) * share
+				counts[i].latency.merge(c.histogram)
+			}
+		}
+	})
+	return first, counts
+}
+
+// timeseries returns a metric over aligned, gap-filled steps
+func (l *routeStatsLog) timeseries(metric, route string, since, until time.Time, step int64) Timeseries {
+	first, counts := l.steps(route, since, until, step, config.latencyBuckets())
+	ts := Timeseries{
+		Metric: metric,
+		Route:  route,
+		Step:   step,
+		Since:  since,
+		Until:  until,
+		Points: make([]TimeseriesPoint, len(counts)),
+	}
+	for i, c := range counts {
+		point := TimeseriesPoint{Time: time.Unix(first+int64(i)*step, 0).UTC()}
+		var value float64
+		switch metric {
+		case "rps":
+			value = c.requests / float64(step)
+		case "errors":
+			value = c.errors
+		case "p95":
+			ms, ok := c.latency.quantile(0.95)
+			if !ok {
+				ts.Points[i] = point
+				continue
+			}
+			value = ms
+		}
+		point.Value = &value
+		ts.Points[i] = point
+	}
+	return ts
+}
+
+// min64 returns the smaller of a and b
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// max64 returns the larger of a and b
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// handleTimeseries returns a metric per step for charting. metric is rps,
+// errors (5xx responses per step) or p95 (latency in milliseconds); step
+// is a whole number of minutes, by default one; since and until bound the
+// range, by default the last hour; route limits it to one route path.
+func handleTimeseries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		metric = "rps"
+	}
+	if !timeseriesMetrics[metric] {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("unknown metric %q: use rps, errors or p95", metric))
+		return
+	}
+	step := time.Minute
+	if v := query.Get("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute || d%time.Minute != 0 {
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "step must be a whole number of minutes, such as 60s or 5m")
+			return
+		}
+		step = d
+	}
+
+	now := time.Now()
+	since, err := parseTimeParam(r, "since", now.Add(-time.Hour))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	until, err := parseTimeParam(r, "until", now)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	if !until.After(since) {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, "until must be after since")
+		return
+	}
+	if points := until.Sub(since) / step; points >= maxTimeseriesPoints {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("the range holds %d steps; at most %d are allowed", points+1, maxTimeseriesPoints))
+		return
+	}
+
+	writeJSON(w, statsLog.timeseries(metric, query.Get("route"), since, until, int64(step/time.Second)))
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing defaults
+const (
+	defaultTraceSampleRate    = 0.01
+	defaultTraceServiceName   = "api-gateway"
+	defaultTraceErrorStatus   = 500
+	defaultTraceBatchSize     = 100
+	defaultTraceFlushInterval = 5
+
+	// traceQueueSize bounds the spans waiting for export
+	traceQueueSize = 4096
+
+	// traceExportTimeout bounds one export to the collector
+	traceExportTimeout = 10 * time.Second
+)
+
+// Reasons a trace is kept
+const (
+	traceKeptError   = "error"
+	traceKeptSlow    = "latency"
+	traceKeptSampled = "sampled"
+)
+
+// TracingConfig exports the gateway's spans to an OpenTelemetry collector
+// over OTLP/HTTP. Sampling happens when a request completes: traces of
+// errors and slow requests are always kept, the rest at the sampling.traces
+// rate.
+type TracingConfig struct {
+	Endpoint           string            `json:"endpoint,omitempty"`           // OTLP/HTTP traces URL, e.g. http://collector:4318/v1/traces
+	Headers            map[string]string `json:"headers,omitempty"`            // sent with each export; values may be secret references
+	ServiceName        string            `json:"serviceName,omitempty"`        // defaults to api-gateway
+	ErrorStatus        int               `json:"errorStatus,omitempty"`        // responses at or above this status are always kept; defaults to 500
+	LatencyThresholdMs int               `json:"latencyThresholdMs,omitempty"` // slower requests are always kept; 0 keeps none for latency
+	BatchSize          int               `json:"batchSize,omitempty"`          // spans per export; defaults to 100
+	FlushInterval      int               `json:"flushInterval,omitempty"`      // seconds between exports; defaults to 5
+}
+
+// TraceStats count the gateway's spans by outcome
+type TraceStats struct {
+	KeptErrors  int64 `json:"keptErrors"`  // kept because the request failed
+	KeptSlow    int64 `json:"keptSlow"`    // kept because the request was slow
+	KeptSampled int64 `json:"keptSampled"` // kept by the sampling rate
+	Discarded   int64 `json:"discarded"`   // not kept
+	Exported    int64 `json:"exported"`    // accepted by the collector
+	Dropped     int64 `json:"dropped"`     // lost to a full queue or a failed export
+}
+
+// checkTracing validates the trace export settings
+func checkTracing(c TracingConfig, v *ValidationError) {
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.add("tracing.endpoint", "must be an http or https URL")
+		}
+	}
+	for name, ref := range c.Headers {
+		checkSettingsSecretRef("tracing.headers."+name, ref, v)
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 100 || c.ErrorStatus > 599) {
+		v.add("tracing.errorStatus", "must be an HTTP status")
+	}
+	checkNonNegative("tracing", []namedInt{
+		{"latencyThresholdMs", c.LatencyThresholdMs},
+		{"batchSize", c.BatchSize},
+		{"flushInterval", c.FlushInterval},
+	}, v)
+}
+
+// spanRecord is a completed span waiting for export
+type spanRecord struct {
+	span      traceSpan
+	method    string
+	path      string
+	route     Route
+	requestID string
+	consumer  string
+	status    int
+	reason    string
+	start     time.Time
+	end       time.Time
+}
+
+// traceExporter batches kept spans and sends them to the collector
+type traceExporter struct {
+	mutex  sync.RWMutex
+	cfg    TracingConfig
+	client *http.Client
+	queue  chan spanRecord
+	worker worker // the export loop
+}
+
+// tracer exports the gateway's spans when tracing is configured
+var tracer = &traceExporter{}
+
+// start exports spans until ctx is done, replacing the export loop of an
+// earlier config. Spans still queued when a loop stops are flushed.
+func (t *traceExporter) start(ctx context.Context, cfg TracingConfig) {
+	if cfg.Endpoint == "" {
+		t.mutex.Lock()
+		t.queue = nil
+		t.mutex.Unlock()
+		t.worker.stop()
+		return
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultTraceServiceName
+	}
+	if cfg.ErrorStatus == 0 {
+		cfg.ErrorStatus = defaultTraceErrorStatus
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultTraceBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = defaultTraceFlushInterval
+	}
+	queue := make(chan spanRecord, traceQueueSize)
+	t.mutex.Lock()
+	t.cfg = cfg
+	t.client = &http.Client{Timeout: traceExportTimeout}
+	t.queue = queue
+	t.mutex.Unlock()
+	log.Printf("Exporting traces to %s", cfg.Endpoint)
+
+	t.worker.start(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(time.Duration(cfg.FlushInterval) * time.Second)
+		defer ticker.Stop()
+		var batch []spanRecord
+		for {
+			select {
+			case <-ctx.Done():
+				for len(queue) > 0 {
+					batch = append(batch, <-queue)
+				}
+				t.export(batch)
+				return
+			case rec := <-queue:
+				batch = append(batch, rec)
+				if len(batch) < cfg.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+			}
+			t.export(batch)
+			batch = nil
+		}
+	})
+}
+
+// enabled reports whether spans are exported
+func (t *traceExporter) enabled() bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.queue != nil
+}
+
+// keep decides, once the request is answered, whether its span is
+// exported, returning the reason it is kept
+func (t *traceExporter) keep(rec spanRecord) (string, bool) {
+	t.mutex.RLock()
+	cfg := t.cfg
+	t.mutex.RUnlock()
+
+	switch {
+	case rec.status >= cfg.ErrorStatus:
+		return traceKeptError, true
+	case cfg.LatencyThresholdMs > 0 && rec.end.Sub(rec.start) >= time.Duration(cfg.LatencyThresholdMs)*time.Millisecond:
+		return traceKeptSlow, true
+	case rec.span.sampled:
+		return traceKeptSampled, true
+	}
+	return "", false
+}
+
+// finish queues a completed span for export if it is kept. Spans are
+// dropped rather than delaying requests when the queue is full.
+func (t *traceExporter) finish(rec spanRecord) {
+	reason, ok := t.keep(rec)
+	proxy.recordTrace(reason)
+	if !ok {
+		return
+	}
+	rec.reason = reason
+
+	t.mutex.RLock()
+	queue := t.queue
+	t.mutex.RUnlock()
+	select {
+	case queue <- rec:
+	default:
+		proxy.recordTraceExport(0, 1)
+	}
+}
+
+// export sends a batch of spans to the collector
+func (t *traceExporter) export(batch []spanRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	t.mutex.RLock()
+	cfg, client := t.cfg, t.client
+	t.mutex.RUnlock()
+
+	if err := sendSpans(client, cfg, batch); err != nil {
+		log.Printf("Failed to export %d spans: %v", len(batch), err)
+		proxy.recordTraceExport(0, len(batch))
+		return
+	}
+	proxy.recordTraceExport(len(batch), 0)
+}
+
+// sendSpans posts spans to the collector as an OTLP/HTTP JSON request
+func sendSpans(client *http.Client, cfg TracingConfig, batch []spanRecord) error {
+	spans := make([]interface{}, len(batch))
+	for i, rec := range batch {
+		spans[i] = otlpSpan(rec)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpString("service.name", cfg.ServiceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": defaultTraceServiceName},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, ref := range cfg.Headers {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			return fmt.Errorf("header %s: %v", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("collector answered %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// OTLP span kind and status codes
+const (
+	otlpSpanKindServer = 2
+	otlpStatusError    = 2
+)
+
+// otlpSpan encodes a span in OTLP JSON, named and attributed after the
+// OpenTelemetry HTTP server conventions
+func otlpSpan(rec spanRecord) map[string]interface{} {
+	attributes := []interface{}{
+		otlpString("http.request.method", rec.method),
+		otlpString("url.path", rec.path),
+		otlpString("http.route", rec.route.Path),
+		otlpInt("http.response.status_code", int64(rec.status)),
+		otlpInt("gateway.route.id", int64(rec.route.ID)),
+		otlpString("gateway.trace.kept", rec.reason),
+	}
+	if rec.requestID != "" {
+		attributes = append(attributes, otlpString("gateway.request.id", rec.requestID))
+	}
+	if rec.consumer != "" {
+		attributes = append(attributes, otlpString("enduser.id", rec.consumer))
+	}
+	span := map[string]interface{}{
+		"traceId":           rec.span.traceID,
+		"spanId":            rec.span.id,
+		"name":              rec.method + " " + rec.route.Path,
+		"kind":              otlpSpanKindServer,
+		"startTimeUnixNano": strconv.FormatInt(rec.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(rec.end.UnixNano(), 10),
+		"attributes":        attributes,
+	}
+	if rec.span.parent != "" {
+		span["parentSpanId"] = rec.span.parent
+	}
+	if rec.status >= 500 {
+		span["status"] = map[string]interface{}{"code": otlpStatusError}
+	}
+	return span
+}
+
+// otlpString encodes a string attribute
+func otlpString(key, value string) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]interface{}{"stringValue": value}}
+}
+
+// otlpInt encodes an integer attribute, which OTLP JSON carries as a
+// string
+func otlpInt(key string, value int64) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+// startSpan times a traced request. It returns the writer to use and the
+// function that hands the span to the exporter once the request is done.
+func startSpan(w http.ResponseWriter, r *http.Request, route Route) (http.ResponseWriter, func()) {
+	rc := requestContext(r)
+	if rc == nil || !tracer.enabled() {
+		return w, func() {}
+	}
+	rc.mutex.Lock()
+	span := rc.span
+	rc.mutex.Unlock()
+	if span.id == "" {
+		return w, func() {}
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		rc.mutex.Lock()
+		consumer := rc.Consumer
+		rc.mutex.Unlock()
+		tracer.finish(spanRecord{
+			span:      span,
+			method:    r.Method,
+			path:      r.URL.Path,
+			route:     route,
+			requestID: rc.RequestID,
+			consumer:  consumer,
+			status:    rec.statusCode(),
+			start:     start,
+			end:       time.Now(),
+		})
+	}
+}
+
+// recordTrace counts a completed span by why it was kept, or as discarded
+func (p *Proxy) recordTrace(reason string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	switch reason {
+	case traceKeptError:
+		p.stats.Traces.KeptErrors++
+	case traceKeptSlow:
+		p.stats.Traces.KeptSlow++
+	case traceKeptSampled:
+		p.stats.Traces.KeptSampled++
+	default:
+		p.stats.Traces.Discarded++
+	}
+}
+
+// recordTraceExport counts spans accepted by the collector or lost
+func (p *Proxy) recordTraceExport(exported, dropped int) {
+	p.statsMutex.Lock()
+	p.stats.Traces.Exported += int64(exported)
+	p.stats.Traces.Dropped += int64(dropped)
+	p.statsMutex.Unlock()
+}
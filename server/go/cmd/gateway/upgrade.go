@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// UpgradeStats tracks protocol upgrades (101 Switching Protocols)
+type UpgradeStats struct {
+	Total      int64            `json:"total"`
+	Active     int              `json:"active"`
+	Rejected   int64            `json:"rejected"`
+	ByProtocol map[string]int64 `json:"byProtocol"`
+}
+
+// upgradeProtocol returns the requested upgrade protocol (e.g. "websocket"),
+// or "" if the request does not ask for an upgrade
+func upgradeProtocol(r *http.Request) string {
+	if !headerHasToken(r.Header, "Connection", "upgrade") {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(r.Header.Get("Upgrade")))
+}
+
+// headerHasToken reports whether a comma-separated header contains token
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripUpgrade removes upgrade negotiation so the request is forwarded as
+// plain HTTP
+func stripUpgrade(r *http.Request) {
+	r.Header.Del("Upgrade")
+
+	var kept []string
+	for _, value := range r.Header["Connection"] {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part != "" && !strings.EqualFold(part, "upgrade") {
+				kept = append(kept, part)
+			}
+		}
+	}
+	if len(kept) > 0 {
+		r.Header.Set("Connection", strings.Join(kept, ", "))
+	} else {
+		r.Header.Del("Connection")
+	}
+}
+
+// recordUpgrade counts a completed upgrade and marks it active
+func (p *Proxy) recordUpgrade(protocol string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	p.stats.Upgrades.Total++
+	p.stats.Upgrades.Active++
+	p.stats.Upgrades.ByProtocol[protocol]++
+}
+
+// endUpgrade marks an upgraded connection as closed
+func (p *Proxy) endUpgrade() {
+	p.statsMutex.Lock()
+	p.stats.Upgrades.Active--
+	p.statsMutex.Unlock()
+}
+
+// recordRejectedUpgrade counts an upgrade refused by route policy
+func (p *Proxy) recordRejectedUpgrade() {
+	p.statsMutex.Lock()
+	p.stats.Upgrades.Rejected++
+	p.statsMutex.Unlock()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validMethods are the HTTP methods a route may list, besides "*"
+var validMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodConnect: true,
+}
+
+// Violation is a single problem found while validating a route
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every violation found in a route
+type ValidationError struct {
+	Violations []Violation
+}
+
+// Error joins the violations into one message
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		messages[i] = v.Field + ": " + v.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records a violation
+func (e *ValidationError) add(field, format string, args ...interface{}) {
+	e.Violations = append(e.Violations, Violation{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns e if it holds any violations, nil otherwise
+func (e *ValidationError) err() error {
+	if len(e.Violations) == 0 {
+		return nil
+	}
+	return e
+}
+
+// validateTargetURL checks that a target is an absolute http(s) URL
+func validateTargetURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("must be an absolute http or https URL")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("has no host")
+	}
+	return nil
+}
+
+// checkMethods reports unknown methods
+func checkMethods(methods []string, v *ValidationError) {
+	for _, m := range methods {
+		if m != "*" && !validMethods[m] {
+			v.add("methods", "%q is not a valid HTTP method", m)
+		}
+	}
+}
+
+// checkConflicts reports active routes that serve the same path with an
+// overlapping method
+func checkConflicts(route *Route, existing []Route, v *ValidationError) {
+	if !route.Active {
+		return
+	}
+
+	for _, other := range existing {
+		if other.ID == route.ID || !other.Active || other.Path != route.Path {
+			continue
+		}
+		if shared := overlappingMethods(route.Methods, other.Methods); len(shared) > 0 {
+			v.add("path", "conflicts with route %d on %s for %s", other.ID, other.Path, strings.Join(shared, ", "))
+		}
+	}
+}
+
+// overlappingMethods returns the methods both lists accept
+func overlappingMethods(a, b []string) []string {
+	has := func(methods []string, m string) bool {
+		for _, x := range methods {
+			if x == "*" || x == m {
+				return true
+			}
+		}
+		return false
+	}
+
+	var shared []string
+	for _, m := range a {
+		if m == "*" {
+			if has(b, "*") {
+				return []string{"*"}
+			}
+			return b
+		}
+		if has(b, m) {
+			shared = append(shared, m)
+		}
+	}
+	return shared
+}
+
+// warnRouteConflicts logs conflicting routes found in a loaded config;
+// the first matching route wins at request time
+func warnRouteConflicts(routes []Route) {
+	for i := range routes {
+		var v ValidationError
+		checkConflicts(&routes[i], routes[:i], &v)
+		for _, violation := range v.Violations {
+			log.Printf("Warning: route %d (%s) %s", routes[i].ID, routes[i].Path, violation.Message)
+		}
+	}
+}
+
+// writeValidationError writes a validation failure, listing every violation
+func writeValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	if ve, ok := err.(*ValidationError); ok {
+		writeErrorDetails(w, r, http.StatusBadRequest, ErrCodeValidationFailed, "Route is invalid", ve.Violations)
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, ErrCodeValidationFailed, err.Error())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Admin API versions
+const (
+	adminAPIVersion = "1"
+
+	// adminVersionHeader negotiates the admin API version. Clients may send
+	// it to require a version; every admin response carries it.
+	adminVersionHeader = "X-Gateway-API-Version"
+)
+
+// supportedAdminVersions lists the admin API versions this build serves
+var supportedAdminVersions = []string{adminAPIVersion}
+
+// adminEndpoint is a management endpoint, relative to the version prefix.
+// Handlers see the path with the prefix stripped.
+type adminEndpoint struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// adminEndpoints lists the management API
+func adminEndpoints() []adminEndpoint {
+	return []adminEndpoint{
+		{"/routes", handleRoutes},
+		{"/routes/", handleRoute},
+		{"/stats", handleStats},
+		{"/stats/history", handleStatsHistory},
+		{"/stats/errors", handleErrorStats},
+		{"/stats/reset", handleStatsReset},
+		{"/metrics", handleMetrics},
+		{"/scaling", handleScaling},
+		{"/analytics/timeseries", handleTimeseries},
+		{"/credentials", handleCredentials},
+		{"/credentials/", handleCredential},
+		{"/services", handleServices},
+		{"/services/", handleService},
+		{"/health", handleHealth},
+		{"/ready", handleReady},
+		{"/flags", handleFlags},
+		{"/alerts", handleAlerts},
+		{"/config", handleConfig},
+		{"/config/active", handleActiveConfig},
+		{"/config/drift", handleConfigDrift},
+		{"/config/reload", handleConfigReload},
+		{"/batch", handleBatch},
+		{"/apply", handleApply},
+		{"/sync", handleSync},
+		{"/leader", handleLeader},
+		{"/kubernetes", handleKubernetes},
+		{"/xds", handleXDS},
+		{"/watch", handleWatch},
+		{"/jobs", handleJobs},
+		{"/debug/connections", handleConnections},
+		{"/debug/tokens", handleDebugTokens},
+		{"/debug/runtime", handleRuntime},
+	}
+}
+
+// versionPrefix returns the mount point of an admin API version
+func versionPrefix(prefix, version string) string {
+	return prefix + "/v" + version
+}
+
+// legacyAliases reports whether unversioned aliases are served. They exist
+// for clients of the original /api paths, so a relocated prefix has none.
+func legacyAliases(prefix string) bool {
+	return prefix == apiPrefix
+}
+
+// adminPaths lists the paths the admin API is mounted at under prefix
+func adminPaths(prefix string) []string {
+	paths := []string{versionPrefix(prefix, adminAPIVersion), prefix + "/versions"}
+	if legacyAliases(prefix) {
+		for _, e := range adminEndpoints() {
+			paths = append(paths, prefix+strings.TrimSuffix(e.pattern, "/"))
+		}
+	}
+	return paths
+}
+
+// probeEndpoints answer orchestrator probes, which carry no credentials,
+// so they stay open when admin credentials are set
+var probeEndpoints = map[string]bool{"/health": true, "/ready": true}
+
+// registerAdminAPI mounts the management endpoints under the versioned
+// prefix, with unversioned aliases kept for existing clients. Every
+// endpoint but the probes requires the admin credentials when they are set.
+func registerAdminAPI(mux *http.ServeMux, prefix string) {
+	versioned := versionPrefix(prefix, adminAPIVersion)
+	for _, e := range adminEndpoints() {
+		var handler http.Handler = e.handler
+		if !probeEndpoints[e.pattern] {
+			handler = requireAdmin(handler)
+		}
+		mux.Handle(versioned+e.pattern, versionedAdmin(http.StripPrefix(versioned, handler)))
+		if legacyAliases(prefix) {
+			mux.Handle(prefix+e.pattern, legacyAdmin(prefix, e.pattern, versioned, http.StripPrefix(prefix, handler)))
+		}
+	}
+	mux.HandleFunc(prefix+"/versions", adminVersionsHandler(prefix))
+}
+
+// versionedAdmin checks the requested admin API version and labels the
+// response with the version served
+func versionedAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(adminVersionHeader, adminAPIVersion)
+		if requested := r.Header.Get(adminVersionHeader); requested != "" && requested != adminAPIVersion {
+			writeErrorDetails(w, r, http.StatusNotAcceptable, ErrCodeUnsupportedVersion,
+				"Admin API version "+requested+" is not served at "+r.URL.Path,
+				map[string]interface{}{"supported": supportedAdminVersions})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// legacyWarned records the unversioned endpoints already logged
+var legacyWarned sync.Map
+
+// legacyAdmin serves an unversioned path as the current version, marking
+// the response deprecated and pointing at its successor
+func legacyAdmin(prefix, pattern, versioned string, next http.Handler) http.Handler {
+	next = versionedAdmin(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := versioned + strings.TrimPrefix(r.URL.Path, prefix)
+		if _, seen := legacyWarned.LoadOrStore(pattern, true); !seen {
+			log.Printf("Deprecated admin path %s used; clients should move to %s", r.URL.Path, successor)
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminVersionsHandler lists the admin API versions and their prefixes
+func adminVersionsHandler(prefix string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		versions := make([]map[string]string, 0, len(supportedAdminVersions))
+		for _, v := range supportedAdminVersions {
+			versions = append(versions, map[string]string{"version": v, "prefix": versionPrefix(prefix, v)})
+		}
+
+		w.Header().Set(adminVersionHeader, adminAPIVersion)
+		writeJSON(w, map[string]interface{}{
+			"current":  adminAPIVersion,
+			"versions": versions,
+		})
+	}
+}
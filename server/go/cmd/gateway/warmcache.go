@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache warming defaults
+const (
+	defaultWarmConcurrency = 4
+	warmRequestTimeout     = 30 * time.Second
+)
+
+// warmHeader marks the gateway's own requests that warm the cache
+const warmHeader = "X-Gateway-Warmup"
+
+// WarmCacheConfig keeps the stale response cache across restarts, so a
+// restart during peak traffic does not leave routes with serveStale
+// fallbacks without a response to fall back on
+type WarmCacheConfig struct {
+	Path        string   `json:"path,omitempty"`        // file the hottest responses are saved to on shutdown and loaded from on startup
+	MaxEntries  int      `json:"maxEntries,omitempty"`  // responses saved, hottest first; defaults to all
+	MaxAge      int      `json:"maxAge,omitempty"`      // seconds a saved response may be old to be loaded; 0 loads any
+	URLs        []string `json:"urls,omitempty"`        // request URIs fetched through the gateway on startup
+	Concurrency int      `json:"concurrency,omitempty"` // URLs fetched at once; defaults to 4
+}
+
+// checkWarmCache validates the cache warming settings
+func checkWarmCache(c WarmCacheConfig, v *ValidationError) {
+	checkNonNegative("warmCache", []namedInt{
+		{"maxEntries", c.MaxEntries},
+		{"maxAge", c.MaxAge},
+		{"concurrency", c.Concurrency},
+	}, v)
+	for i, uri := range c.URLs {
+		if !strings.HasPrefix(uri, "/") {
+			v.add(fmt.Sprintf("warmCache.urls[%d]", i), "must be a path starting with /")
+		}
+	}
+}
+
+// savedResponse is a cached response as it is kept on disk. The route
+// path is saved with the ID so a response is only loaded for the route it
+// came from.
+type savedResponse struct {
+	RouteID   int         `json:"routeId"`
+	RoutePath string      `json:"routePath"`
+	URI       string      `json:"uri"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header,omitempty"`
+	Body      []byte      `json:"body"`
+	Stored    time.Time   `json:"stored"`
+	Hits      int         `json:"hits,omitempty"`
+}
+
+// save writes the hottest cached responses to path, replacing the file
+// atomically. Responses are kept in the clear unless storage encryption
+// is configured.
+func (c *staleCache) save(path string, maxEntries int) (int, error) {
+	var saved []savedResponse
+	c.mutex.Lock()
+	for key, entry := range c.entries {
+		id, uri, _ := strings.Cut(key, " ")
+		routeID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
+		route, ok := config.getRoute(routeID)
+		if !ok {
+			continue
+		}
+		saved = append(saved, savedResponse{
+			RouteID:   routeID,
+			RoutePath: route.Path,
+			URI:       uri,
+			Status:    entry.status,
+			Header:    entry.header,
+			Body:      entry.body,
+			Stored:    entry.stored,
+			Hits:      entry.hits,
+		})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(saved, func(i, j int) bool {
+		if saved[i].Hits != saved[j].Hits {
+			return saved[i].Hits > saved[j].Hits
+		}
+		return saved[i].Stored.After(saved[j].Stored)
+	})
+	if maxEntries > 0 && len(saved) > maxEntries {
+		saved = saved[:maxEntries]
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	if err := fileCrypto.writeFile(tmp, data, 0600); err != nil {
+		return 0, err
+	}
+	return len(saved), os.Rename(tmp, path)
+}
+
+// load fills the cache from a saved file. Responses are skipped when
+// their route is gone, changed path or no longer serves stale responses,
+// or when they are older than maxAge.
+func (c *staleCache) load(path string, maxAge time.Duration) (int, error) {
+	data, err := fileCrypto.readFile(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var saved []savedResponse
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	loaded := 0
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, s := range saved {
+		if len(c.entries) >= maxStaleEntries {
+			break
+		}
+		if maxAge > 0 && time.Since(s.Stored) > maxAge {
+			continue
+		}
+		route, ok := config.getRoute(s.RouteID)
+		if !ok || route.Path != s.RoutePath || route.Fallback == nil || !route.Fallback.ServeStale {
+			continue
+		}
+		key := fmt.Sprintf("%d %s", s.RouteID, s.URI)
+		if _, exists := c.entries[key]; exists {
+			continue
+		}
+		c.entries[key] = &staleEntry{status: s.Status, header: s.Header, body: s.Body, stored: s.Stored, hits: s.Hits}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// loadWarmCache loads the responses saved by the last shutdown
+func loadWarmCache(c WarmCacheConfig) {
+	if c.Path == "" {
+		return
+	}
+	n, err := staleResponses.load(c.Path, time.Duration(c.MaxAge)*time.Second)
+	if err != nil {
+		log.Printf("Warm cache not loaded: %v", err)
+		return
+	}
+	log.Printf("Loaded %d cached responses from %s", n, c.Path)
+}
+
+// saveWarmCache saves the hottest responses for the next startup
+func saveWarmCache(c WarmCacheConfig) {
+	if c.Path == "" {
+		return
+	}
+	n, err := staleResponses.save(c.Path, c.MaxEntries)
+	if err != nil {
+		log.Printf("Warm cache not saved: %v", err)
+		return
+	}
+	log.Printf("Saved %d cached responses to %s", n, c.Path)
+}
+
+// warmFromURLs requests each configured URL through the gateway's own
+// listener, so the responses of routes with serveStale fallbacks are
+// cached as they would be for a client. Requests pass the gateway's
+// middleware, so routes that require credentials are not warmed.
+func warmFromURLs(c WarmCacheConfig, addr net.Addr) {
+	if len(c.URLs) == 0 {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		log.Printf("Cache warming skipped: %v", err)
+		return
+	}
+	base := "http://" + net.JoinHostPort("127.0.0.1", port)
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultWarmConcurrency
+	}
+
+	client := &http.Client{Timeout: warmRequestTimeout}
+	uris := make(chan string)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	warmed := 0
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uri := range uris {
+				req, err := http.NewRequest(http.MethodGet, base+uri, nil)
+				if err != nil {
+					log.Printf("Cache warming %s: %v", uri, err)
+					continue
+				}
+				req.Header.Set(warmHeader, "1")
+				resp, err := client.Do(req)
+				if err != nil {
+					log.Printf("Cache warming %s: %v", uri, err)
+					continue
+				}
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					log.Printf("Cache warming %s: status %d", uri, resp.StatusCode)
+					continue
+				}
+				mutex.Lock()
+				warmed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, uri := range c.URLs {
+		uris <- uri
+	}
+	close(uris)
+	wg.Wait()
+	log.Printf("Warmed the cache from %d of %d URLs", warmed, len(c.URLs))
+}
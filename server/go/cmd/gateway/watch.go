@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watch topics
+const (
+	WatchRoutes = "routes"
+	WatchConfig = "config"
+	WatchStats  = "stats"
+)
+
+// Watch event types. A stream opens with a snapshot of each topic watched,
+// then sends changes as they happen.
+const (
+	WatchEventRoutes       = "routes" // every route, on connect
+	WatchEventRouteCreated = EventRouteCreated
+	WatchEventRouteUpdated = EventRouteUpdated
+	WatchEventRouteDeleted = EventRouteDeleted
+	WatchEventConfig       = "config" // the config without routes, on connect and on each change
+	WatchEventStats        = "stats"  // the stats, on connect and every interval
+	WatchEventResync       = "resync" // the watcher fell behind; reconnect for a fresh snapshot
+)
+
+// Watch stream limits
+const (
+	watchBuffer               = 256
+	watchHeartbeat            = 15 * time.Second
+	defaultWatchStatsInterval = 5
+	maxWatchStatsInterval     = 86400 // a day, well within a time.Duration
+)
+
+// watchEvent is one event of a watch stream
+type watchEvent struct {
+	ID   uint64
+	Type string
+	Data json.RawMessage
+}
+
+// watcher is one open watch stream
+type watcher struct {
+	topics map[string]bool
+	events chan watchEvent // closed when the watcher falls behind
+}
+
+// watchHub fans route and config changes out to open watch streams. A
+// watcher that falls behind is dropped rather than slowing the change.
+type watchHub struct {
+	mutex    sync.Mutex
+	watchers map[*watcher]bool
+	sequence uint64
+}
+
+// watches holds the open watch streams
+var watches = &watchHub{watchers: make(map[*watcher]bool)}
+
+// add opens a watcher for topics
+func (h *watchHub) add(topics map[string]bool) *watcher {
+	w := &watcher{topics: topics, events: make(chan watchEvent, watchBuffer)}
+	h.mutex.Lock()
+	h.watchers[w] = true
+	h.mutex.Unlock()
+	return w
+}
+
+// remove closes a watcher that is still open
+func (h *watchHub) remove(w *watcher) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.watchers[w] {
+		delete(h.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish sends an event to the watchers of topic
+func (h *watchHub) publish(topic, eventType string, data interface{}) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.watchers) == 0 {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	h.sequence++
+	event := watchEvent{ID: h.sequence, Type: eventType, Data: payload}
+	for w := range h.watchers {
+		if !w.topics[topic] {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			delete(h.watchers, w)
+			close(w.events)
+		}
+	}
+}
+
+// routeChanged publishes a route change as the event bus does
+func (h *watchHub) routeChanged(change RouteChange) {
+	switch change.Kind {
+	case RouteCreated:
+		h.publish(WatchRoutes, WatchEventRouteCreated, change.New)
+	case RouteUpdated:
+		h.publish(WatchRoutes, WatchEventRouteUpdated, change.New)
+	case RouteDeleted:
+		h.publish(WatchRoutes, WatchEventRouteDeleted, map[string]int{"id": change.Old.ID})
+	}
+}
+
+// configChanged publishes the config after a PUT, batch, apply or reload
+func (h *watchHub) configChanged() {
+	h.publish(WatchConfig, WatchEventConfig, configWithoutRoutes())
+}
+
+// configWithoutRoutes returns the config as GET /config does
+func configWithoutRoutes() configSnapshot {
+	return configSnapshot{ConfigSettings: *config.settings()}
+}
+
+// watchTopics parses the topics query parameter; all topics by default
+func watchTopics(r *http.Request) (map[string]bool, error) {
+	topics := make(map[string]bool)
+	param := r.URL.Query().Get("topics")
+	if param == "" {
+		param = strings.Join([]string{WatchRoutes, WatchConfig, WatchStats}, ",")
+	}
+	for _, topic := range strings.Split(param, ",") {
+		switch topic = strings.TrimSpace(topic); topic {
+		case WatchRoutes, WatchConfig, WatchStats:
+			topics[topic] = true
+		default:
+			return nil, fmt.Errorf("unknown topic %q; use routes, config or stats", topic)
+		}
+	}
+	return topics, nil
+}
+
+// handleWatch streams route, config and stats changes as server-sent
+// events, so dashboards and controllers are pushed updates instead of
+// polling. Each stream starts with a snapshot of the topics watched.
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	topics, err := watchTopics(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+	interval := defaultWatchStatsInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		if interval, err = strconv.Atoi(s); err != nil || interval < 1 || interval > maxWatchStatsInterval {
+			writeError(w, r, http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("interval must be a whole number of seconds from 1 to %d", maxWatchStatsInterval))
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(id uint64, eventType string, data json.RawMessage) error {
+		if id > 0 {
+			fmt.Fprintf(w, "id: %d\n", id)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	heartbeat := func() error {
+		// A comment line keeps idle proxies from closing the stream
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	streamWatch(r.Context(), topics, time.Duration(interval)*time.Second, send, heartbeat)
+}
+
+// streamWatch sends a snapshot of each topic watched, then changes as they
+// happen and stats every interval, until ctx is done, the gateway shuts
+// down, the watcher falls behind or send fails. heartbeat, if set, runs
+// every watchHeartbeat. The SSE and gRPC watch streams share it.
+func streamWatch(ctx context.Context, topics map[string]bool, interval time.Duration, send func(id uint64, eventType string, data json.RawMessage) error, heartbeat func() error) {
+	// Subscribe before the snapshot so no change between them is missed
+	sub := watches.add(topics)
+	defer watches.remove(sub)
+
+	sendValue := func(eventType string, data interface{}) error {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return send(0, eventType, payload)
+	}
+
+	if topics[WatchRoutes] {
+		if sendValue(WatchEventRoutes, config.getRoutes()) != nil {
+			return
+		}
+	}
+	if topics[WatchConfig] {
+		if sendValue(WatchEventConfig, configWithoutRoutes()) != nil {
+			return
+		}
+	}
+	var statsTick <-chan time.Time
+	if topics[WatchStats] {
+		if sendValue(WatchEventStats, watchStats()) != nil {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
+	var heartbeatTick <-chan time.Time
+	if heartbeat != nil {
+		ticker := time.NewTicker(watchHeartbeat)
+		defer ticker.Stop()
+		heartbeatTick = ticker.C
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(backgroundCtx, cancel)
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-sub.events:
+			if !ok {
+				sendValue(WatchEventResync, map[string]string{"reason": "watcher fell behind"})
+				return
+			}
+			if send(event.ID, event.Type, event.Data) != nil {
+				return
+			}
+		case <-statsTick:
+			if sendValue(WatchEventStats, watchStats()) != nil {
+				return
+			}
+		case <-heartbeatTick:
+			if heartbeat() != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchStats returns the stats as a watch stream sends them
+func watchStats() Stats {
+	stats := proxy.getStats()
+	stats.RouteStats = withOwners(stats.RouteStats)
+	return stats
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWatchIntervalBounds(t *testing.T) {
+	startTestGateway(t, http.NotFoundHandler(), nil)
+	for _, interval := range []string{"0", "86401", "9223372036854775807"} {
+		w := httptest.NewRecorder()
+		handleWatch(w, httptest.NewRequest("GET", "/api/v1/watch?topics=stats&interval="+interval, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("interval %s: status %d, want 400", interval, w.Code)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhook signature schemes
+const (
+	WebhookStripe = "stripe"
+	WebhookGitHub = "github"
+	WebhookSlack  = "slack"
+	WebhookHMAC   = "hmac" // hex HMAC-SHA256 of the body in a configured header
+)
+
+// Webhook defaults
+const (
+	defaultWebhookTolerance   = 300
+	defaultWebhookDedupWindow = 24 * 60 * 60
+)
+
+// WebhookConfig verifies third-party webhooks before they reach the
+// upstream: the signature must match, a signed timestamp must be recent,
+// and a delivery already accepted is not forwarded again
+type WebhookConfig struct {
+	Provider    string `json:"provider"`              // stripe, github, slack or hmac
+	Secret      string `json:"secret"`                // signing secret; may be a secret reference
+	Tolerance   int    `json:"tolerance,omitempty"`   // seconds a signed timestamp may be off; defaults to 300
+	DedupWindow int    `json:"dedupWindow,omitempty"` // seconds accepted delivery IDs are remembered; defaults to a day, -1 disables
+
+	// For the hmac provider
+	SignatureHeader string `json:"signatureHeader,omitempty"`
+	SignaturePrefix string `json:"signaturePrefix,omitempty"` // stripped from the header value, e.g. sha256=
+	DeliveryHeader  string `json:"deliveryHeader,omitempty"`  // carries the delivery ID, if the sender sets one
+}
+
+// WebhookStat counts webhook deliveries on a route
+type WebhookStat struct {
+	Verified         int64 `json:"verified"`
+	InvalidSignature int64 `json:"invalidSignature"`
+	Stale            int64 `json:"stale"`      // timestamp outside the tolerance
+	Duplicates       int64 `json:"duplicates"` // delivery already accepted
+}
+
+// checkWebhook validates a route's webhook settings
+func checkWebhook(c *WebhookConfig, v *ValidationError) {
+	if c == nil {
+		return
+	}
+	switch c.Provider {
+	case WebhookStripe, WebhookGitHub, WebhookSlack:
+	case WebhookHMAC:
+		if c.SignatureHeader == "" {
+			v.add("webhook.signatureHeader", "is required for the hmac provider")
+		}
+	default:
+		v.add("webhook.provider", "unknown provider %q: use stripe, github, slack or hmac", c.Provider)
+	}
+	checkSecretRef("webhook.secret", c.Secret, v)
+	checkNonNegative("webhook", []namedInt{{"tolerance", c.Tolerance}}, v)
+	if c.DedupWindow < -1 {
+		v.add("webhook.dedupWindow", "must be -1, 0 or positive")
+	}
+}
+
+// tolerance returns how far a signed timestamp may be from now
+func (c *WebhookConfig) tolerance() time.Duration {
+	if c.Tolerance <= 0 {
+		return defaultWebhookTolerance * time.Second
+	}
+	return time.Duration(c.Tolerance) * time.Second
+}
+
+// dedupWindow returns how long accepted delivery IDs are remembered
+func (c *WebhookConfig) dedupWindow() time.Duration {
+	if c.DedupWindow == 0 {
+		return defaultWebhookDedupWindow * time.Second
+	}
+	return time.Duration(c.DedupWindow) * time.Second
+}
+
+// webhookDelivery is what a signature scheme extracts from a request
+type webhookDelivery struct {
+	signatures [][]byte  // candidate signatures; any may match
+	payload    []byte    // the signed bytes
+	timestamp  time.Time // zero if the scheme signs none
+	id         string    // delivery ID, if the scheme has one
+}
+
+// parse extracts the signatures, signed payload, timestamp and delivery ID
+// of a webhook
+func (c *WebhookConfig) parse(r *http.Request, body []byte) (webhookDelivery, error) {
+	d := webhookDelivery{payload: body}
+	switch c.Provider {
+	case WebhookStripe:
+		// Stripe-Signature: t=<unix>,v1=<hex>[,v1=<hex>] over "<t>.<body>"
+		var ts string
+		for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				ts = kv[1]
+			case "v1":
+				if sig, err := hex.DecodeString(kv[1]); err == nil {
+					d.signatures = append(d.signatures, sig)
+				}
+			}
+		}
+		if ts == "" {
+			return d, fmt.Errorf("missing Stripe-Signature timestamp")
+		}
+		if err := d.setTimestamp(ts); err != nil {
+			return d, err
+		}
+		d.payload = append([]byte(ts+"."), body...)
+		d.id = jsonStringField(body, "id")
+	case WebhookGitHub:
+		// X-Hub-Signature-256: sha256=<hex> over the body
+		if sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")); err == nil {
+			d.signatures = append(d.signatures, sig)
+		}
+		d.id = r.Header.Get("X-GitHub-Delivery")
+	case WebhookSlack:
+		// X-Slack-Signature: v0=<hex> over "v0:<timestamp>:<body>"
+		ts := r.Header.Get("X-Slack-Request-Timestamp")
+		if err := d.setTimestamp(ts); err != nil {
+			return d, err
+		}
+		if sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Slack-Signature"), "v0=")); err == nil {
+			d.signatures = append(d.signatures, sig)
+		}
+		d.payload = append([]byte("v0:"+ts+":"), body...)
+		d.id = jsonStringField(body, "event_id")
+	case WebhookHMAC:
+		if sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get(c.SignatureHeader), c.SignaturePrefix)); err == nil {
+			d.signatures = append(d.signatures, sig)
+		}
+		if c.DeliveryHeader != "" {
+			d.id = r.Header.Get(c.DeliveryHeader)
+		}
+	}
+	if len(d.signatures) == 0 {
+		return d, fmt.Errorf("missing or malformed signature")
+	}
+	return d, nil
+}
+
+// setTimestamp parses a signed Unix timestamp
+func (d *webhookDelivery) setTimestamp(ts string) error {
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or malformed timestamp")
+	}
+	d.timestamp = time.Unix(sec, 0)
+	return nil
+}
+
+// jsonStringField returns a top-level string field of a JSON body
+func jsonStringField(body []byte, name string) string {
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	s, _ := fields[name].(string)
+	return s
+}
+
+// verify checks a delivery's signature against the secret
+func (d webhookDelivery) verify(secret string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(d.payload)
+	expected := mac.Sum(nil)
+	for _, sig := range d.signatures {
+		if hmac.Equal(sig, expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryState is a delivery being forwarded or already accepted
+type deliveryState struct {
+	accepted bool
+	expires  time.Time
+}
+
+// deliveryLog remembers webhook delivery IDs by route
+type deliveryLog struct {
+	mutex      sync.Mutex
+	deliveries map[string]deliveryState
+	swept      time.Time
+}
+
+// webhookDeliveries remembers accepted webhook deliveries
+var webhookDeliveries = &deliveryLog{deliveries: make(map[string]deliveryState)}
+
+// reserve claims a delivery ID while it is forwarded. It reports whether
+// the delivery was already accepted, and whether it is in flight.
+func (l *deliveryLog) reserve(key string, now time.Time) (accepted, inFlight bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if now.Sub(l.swept) > time.Minute {
+		for k, state := range l.deliveries {
+			if state.accepted && now.After(state.expires) {
+				delete(l.deliveries, k)
+			}
+		}
+		l.swept = now
+	}
+	if state, ok := l.deliveries[key]; ok && !(state.accepted && now.After(state.expires)) {
+		return state.accepted, !state.accepted
+	}
+	l.deliveries[key] = deliveryState{}
+	return false, false
+}
+
+// finish records an accepted delivery for window, or forgets a failed one
+// so the sender's retry goes through
+func (l *deliveryLog) finish(key string, accepted bool, window time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if accepted {
+		l.deliveries[key] = deliveryState{accepted: true, expires: time.Now().Add(window)}
+	} else {
+		delete(l.deliveries, key)
+	}
+}
+
+// verifyWebhook checks a webhook's signature, timestamp and delivery ID,
+// answering 401 for forged or stale deliveries and 200 for ones already
+// accepted, so the sender stops retrying. It returns a function recording
+// the delivery once the upstream has answered.
+func verifyWebhook(w http.ResponseWriter, r *http.Request, route Route) (http.ResponseWriter, func(), bool) {
+	c := route.Webhook
+	if c == nil {
+		return w, func() {}, true
+	}
+	reject := func(stat func(*WebhookStat), status int, code, message string) (http.ResponseWriter, func(), bool) {
+		proxy.recordWebhook(route.Path, stat)
+		writeError(w, r, status, code, message)
+		return w, nil, false
+	}
+
+	body := []byte{}
+	if r.Body != nil && r.Body != http.NoBody {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInspectedBodySize+1))
+		r.Body.Close()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, "Failed to read request body")
+			return w, nil, false
+		}
+		if len(data) > maxInspectedBodySize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, "Request body too large")
+			return w, nil, false
+		}
+		body = data
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+
+	secret, err := resolveSecret(c.Secret)
+	if err != nil {
+		log.Printf("Webhook secret for %s unavailable: %v", route.Path, err)
+		writeError(w, r, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "Webhook verification unavailable")
+		return w, nil, false
+	}
+	d, err := c.parse(r, body)
+	if err == nil && !d.verify(secret) {
+		err = fmt.Errorf("signature mismatch")
+	}
+	if err != nil {
+		log.Printf("Rejected %s webhook on %s: %v", c.Provider, route.Path, err)
+		return reject(func(s *WebhookStat) { s.InvalidSignature++ }, http.StatusUnauthorized, ErrCodeWebhookInvalid, "Invalid webhook signature")
+	}
+	if !d.timestamp.IsZero() {
+		if skew := time.Since(d.timestamp); skew > c.tolerance() || skew < -c.tolerance() {
+			log.Printf("Rejected %s webhook on %s: timestamp %s is outside the tolerance", c.Provider, route.Path, d.timestamp.Format(time.RFC3339))
+			return reject(func(s *WebhookStat) { s.Stale++ }, http.StatusUnauthorized, ErrCodeWebhookInvalid, "Webhook timestamp outside the tolerance")
+		}
+	}
+
+	if d.id == "" || c.DedupWindow < 0 {
+		proxy.recordWebhook(route.Path, func(s *WebhookStat) { s.Verified++ })
+		return w, func() {}, true
+	}
+	key := strconv.Itoa(route.ID) + "|" + d.id
+	accepted, inFlight := webhookDeliveries.reserve(key, time.Now())
+	switch {
+	case accepted:
+		proxy.recordWebhook(route.Path, func(s *WebhookStat) { s.Duplicates++ })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"duplicate": true, "deliveryId": d.id})
+		return w, nil, false
+	case inFlight:
+		w.Header().Set("Retry-After", "1")
+		return reject(func(s *WebhookStat) { s.Duplicates++ }, http.StatusConflict, ErrCodeDuplicateDelivery, "Delivery is already being processed")
+	}
+
+	proxy.recordWebhook(route.Path, func(s *WebhookStat) { s.Verified++ })
+	requestContext(r).set("webhookDelivery", d.id)
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() {
+		status := rec.statusCode()
+		webhookDeliveries.finish(key, status >= 200 && status < 300, c.dedupWindow())
+	}, true
+}
+
+// recordWebhook updates the webhook stats of a route
+func (p *Proxy) recordWebhook(path string, update func(*WebhookStat)) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	stat := p.stats.Webhooks[path]
+	update(&stat)
+	p.stats.Webhooks[path] = stat
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hmacHex returns the hex HMAC-SHA256 of payload
+func hmacHex(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// useWebhook starts a gateway verifying webhooks with c, returning the
+// number of deliveries the upstream received
+func useWebhook(t *testing.T, c WebhookConfig) *int64 {
+	var delivered int64
+	startTestGateway(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&delivered, 1)
+	}), func(_ *Config, route *Route) {
+		route.Webhook = &c
+	})
+	return &delivered
+}
+
+// deliver posts body to the route with the given headers
+func deliver(body string, headers map[string]string) int {
+	r := httptest.NewRequest("POST", "/svc/hooks", strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return serveProxy(r).Code
+}
+
+func TestGitHubWebhook(t *testing.T) {
+	delivered := useWebhook(t, WebhookConfig{Provider: WebhookGitHub, Secret: "gh-secret"})
+	const body = `{"action":"opened"}`
+	headers := map[string]string{
+		"X-Hub-Signature-256": "sha256=" + hmacHex("gh-secret", body),
+		"X-GitHub-Delivery":   "delivery-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+
+	if code := deliver(body, headers); code != http.StatusOK {
+		t.Fatalf("signed delivery: status %d, want 200", code)
+	}
+	if code := deliver(body, headers); code != http.StatusOK {
+		t.Fatalf("repeated delivery: status %d, want 200", code)
+	}
+	if n := atomic.LoadInt64(delivered); n != 1 {
+		t.Fatalf("upstream received %d deliveries, want the repeat dropped", n)
+	}
+
+	headers["X-Hub-Signature-256"] = "sha256=" + hmacHex("other", body)
+	headers["X-GitHub-Delivery"] = "forged"
+	if code := deliver(body, headers); code != http.StatusUnauthorized {
+		t.Fatalf("forged delivery: status %d, want 401", code)
+	}
+	if code := deliver(body+" ", map[string]string{"X-Hub-Signature-256": "sha256=" + hmacHex("gh-secret", body)}); code != http.StatusUnauthorized {
+		t.Fatalf("altered body: status %d, want 401", code)
+	}
+	if n := atomic.LoadInt64(delivered); n != 1 {
+		t.Fatalf("upstream received %d deliveries, want only the signed one", n)
+	}
+}
+
+func TestStripeWebhookTimestamp(t *testing.T) {
+	delivered := useWebhook(t, WebhookConfig{Provider: WebhookStripe, Secret: "whsec", DedupWindow: -1})
+	const body = `{"id":"evt_1"}`
+	signed := func(at time.Time) map[string]string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		return map[string]string{"Stripe-Signature": "t=" + ts + ",v1=" + hmacHex("whsec", ts+"."+body)}
+	}
+
+	if code := deliver(body, signed(time.Now())); code != http.StatusOK {
+		t.Fatalf("fresh delivery: status %d, want 200", code)
+	}
+	if code := deliver(body, signed(time.Now().Add(-time.Hour))); code != http.StatusUnauthorized {
+		t.Fatalf("stale delivery: status %d, want 401", code)
+	}
+	if n := atomic.LoadInt64(delivered); n != 1 {
+		t.Fatalf("upstream received %d deliveries, want 1", n)
+	}
+}
+
+func TestHMACWebhook(t *testing.T) {
+	useWebhook(t, WebhookConfig{
+		Provider:        WebhookHMAC,
+		Secret:          "shared",
+		SignatureHeader: "X-Signature",
+		SignaturePrefix: "sha256=",
+	})
+	const body = "payload"
+	if code := deliver(body, map[string]string{"X-Signature": "sha256=" + hmacHex("shared", body)}); code != http.StatusOK {
+		t.Fatalf("signed delivery: status %d, want 200", code)
+	}
+	if code := deliver(body, map[string]string{"X-Signature": hmacHex("shared", body)[2:]}); code != http.StatusUnauthorized {
+		t.Fatalf("malformed signature: status %d, want 401", code)
+	}
+	if code := deliver(body, nil); code != http.StatusUnauthorized {
+		t.Fatalf("unsigned delivery: status %d, want 401", code)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "time"
+
+// windowSeconds is the longest rolling window tracked
+const windowSeconds = 300
+
+// windowSlot counts requests completed within one second
+type windowSlot struct {
+	second   int64
+	requests int64
+	errors   int64
+}
+
+// rollingWindow is a ring buffer of per-second request counts
+type rollingWindow struct {
+	slots [windowSeconds]windowSlot
+}
+
+// add records a completed request at now
+func (w *rollingWindow) add(now time.Time, isError bool) {
+	sec := now.Unix()
+	slot := &w.slots[sec%windowSeconds]
+	if slot.second != sec {
+		*slot = windowSlot{second: sec}
+	}
+
+	slot.requests++
+	if isError {
+		slot.errors++
+	}
+}
+
+// sum totals the requests and errors in the last d before now
+func (w *rollingWindow) sum(now time.Time, d time.Duration) (requests, errors int64) {
+	sec := now.Unix()
+	span := int64(d / time.Second)
+	if span > windowSeconds {
+		span = windowSeconds
+	}
+
+	for i := range w.slots {
+		slot := &w.slots[i]
+		if slot.second > sec-span && slot.second <= sec {
+			requests += slot.requests
+			errors += slot.errors
+		}
+	}
+	return requests, errors
+}
+
+// requestRate returns requests per second over the last d, counting only
+// completed seconds so a partially elapsed second does not drag it down
+func (w *rollingWindow) requestRate(now time.Time, d time.Duration) float64 {
+	seconds := int64(d / time.Second)
+	if seconds <= 0 {
+		return 0
+	}
+	requests, _ := w.sum(now.Add(-time.Second), d)
+	return float64(requests) / float64(seconds)
+}
+
+// errorRate returns the error rate over the last d
+func (w *rollingWindow) errorRate(now time.Time, d time.Duration) float64 {
+	requests, errors := w.sum(now, d)
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// xDS resource types the client requests, by REST endpoint
+const (
+	xdsClusterType    = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+	xdsEndpointType   = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+	xdsRouteType      = "type.googleapis.com/envoy.config.route.v3.RouteConfiguration"
+	xdsClusterPath    = "/v3/discovery:clusters"
+	xdsEndpointPath   = "/v3/discovery:endpoints"
+	xdsRoutePath      = "/v3/discovery:routes"
+	defaultXDSRefresh = 5
+
+	// xdsSource prefixes the source of routes the xDS client keeps
+	xdsSource = "xds "
+
+	// The client polls again with backoff up to maxXDSBackoff after errors
+	maxXDSBackoff = 30 * time.Second
+)
+
+// XDSConfig makes the gateway an xDS client. It polls a management server
+// with Envoy's REST-JSON discovery API for route configurations, clusters
+// and endpoints, and keeps a route for each route entry, so the gateway
+// takes its routing from an existing service-mesh control plane.
+// Experimental: the gRPC transport and ADS are not supported.
+type XDSConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Server       string   `json:"server,omitempty"`       // the management server's REST endpoint, such as http://control-plane:18000
+	Node         string   `json:"node,omitempty"`         // node.id sent with requests; defaults to the host name
+	Cluster      string   `json:"cluster,omitempty"`      // node.cluster sent with requests
+	RouteConfigs []string `json:"routeConfigs,omitempty"` // RouteConfiguration names to request; every one the server has for the node when empty
+	Refresh      int      `json:"refresh,omitempty"`      // seconds between polls; defaults to 5
+	Token        string   `json:"token,omitempty"`        // bearer token or a secret reference
+	Template     string   `json:"template,omitempty"`     // route template for the routes, for auth, limits and so on
+}
+
+// refresh returns how often the server is polled
+func (c XDSConfig) refresh() time.Duration {
+	if c.Refresh <= 0 {
+		return defaultXDSRefresh * time.Second
+	}
+	return time.Duration(c.Refresh) * time.Second
+}
+
+// checkXDS validates the xDS client settings
+func checkXDS(c *Config, v *ValidationError) {
+	x := c.XDS
+	if !x.Enabled {
+		return
+	}
+	if u, err := url.Parse(x.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add("xds.server", "must be an http or https URL")
+	}
+	checkNonNegative("xds", []namedInt{{"refresh", x.Refresh}}, v)
+	if x.Token != "" {
+		checkSettingsSecretRef("xds.token", x.Token, v)
+	}
+	if x.Template != "" {
+		if _, ok := c.RouteTemplates[x.Template]; !ok {
+			v.add("xds.template", "unknown route template %q", x.Template)
+		}
+	}
+	if c.Storage.driver() != StorageFile {
+		v.add("xds", "needs the file storage driver; a database keeps its own routes")
+	}
+}
+
+// XDSStatus reports what the xDS client has received and translated
+type XDSStatus struct {
+	Enabled      bool              `json:"enabled"`
+	Server       string            `json:"server,omitempty"`
+	Node         string            `json:"node,omitempty"`
+	Connected    bool              `json:"connected"`          // whether the last poll succeeded
+	Versions     map[string]string `json:"versions,omitempty"` // version accepted, by resource type
+	RouteConfigs int               `json:"routeConfigs"`
+	Clusters     int               `json:"clusters"`
+	Routes       int               `json:"routes"` // routes kept for the route entries
+	Rejected     []XDSRejection    `json:"rejected,omitempty"`
+	LastSync     *time.Time        `json:"lastSync,omitempty"`
+	LastError    string            `json:"lastError,omitempty"`
+}
+
+// XDSRejection is a route entry or resource the client could not use
+type XDSRejection struct {
+	Resource string `json:"resource"` // routeConfig/virtualHost
+	Path     string `json:"path,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// xdsRequest is a DiscoveryRequest
+type xdsRequest struct {
+	VersionInfo   string   `json:"versionInfo,omitempty"`
+	Node          xdsNode  `json:"node"`
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	TypeURL       string   `json:"typeUrl"`
+	ResponseNonce string   `json:"responseNonce,omitempty"`
+	ErrorDetail   *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail,omitempty"`
+}
+
+// xdsNode identifies the gateway to the management server
+type xdsNode struct {
+	ID      string `json:"id"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// xdsResponse is a DiscoveryResponse
+type xdsResponse struct {
+	VersionInfo string            `json:"versionInfo"`
+	Resources   []json.RawMessage `json:"resources"`
+	TypeURL     string            `json:"typeUrl"`
+	Nonce       string            `json:"nonce"`
+}
+
+// xdsCluster is the part of a Cluster the client translates
+type xdsCluster struct {
+	Name             string `json:"name"`
+	Type             string `json:"type"` // STATIC, STRICT_DNS, LOGICAL_DNS or EDS
+	EDSClusterConfig *struct {
+		ServiceName string `json:"serviceName"`
+	} `json:"edsClusterConfig"`
+	LoadAssignment  *xdsLoadAssignment `json:"loadAssignment"`
+	TransportSocket *struct {
+		Name string `json:"name"`
+	} `json:"transportSocket"`
+}
+
+// edsName returns the name the cluster's endpoints are requested by
+func (c xdsCluster) edsName() string {
+	if c.EDSClusterConfig != nil && c.EDSClusterConfig.ServiceName != "" {
+		return c.EDSClusterConfig.ServiceName
+	}
+	return c.Name
+}
+
+// xdsLoadAssignment is a ClusterLoadAssignment
+type xdsLoadAssignment struct {
+	ClusterName string `json:"clusterName"`
+	Endpoints   []struct {
+		LBEndpoints []struct {
+			Endpoint struct {
+				Address struct {
+					SocketAddress struct {
+						Address   string `json:"address"`
+						PortValue int    `json:"portValue"`
+					} `json:"socketAddress"`
+				} `json:"address"`
+			} `json:"endpoint"`
+			HealthStatus        string `json:"healthStatus"`
+			LoadBalancingWeight *int   `json:"loadBalancingWeight"`
+		} `json:"lbEndpoints"`
+	} `json:"endpoints"`
+}
+
+// xdsRouteConfig is the part of a RouteConfiguration the client translates
+type xdsRouteConfig struct {
+	Name         string `json:"name"`
+	VirtualHosts []struct {
+		Name   string          `json:"name"`
+		Routes []xdsRouteEntry `json:"routes"`
+	} `json:"virtualHosts"`
+}
+
+// xdsRouteEntry is one route of a virtual host
+type xdsRouteEntry struct {
+	Match struct {
+		Prefix              *string           `json:"prefix"`
+		Path                *string           `json:"path"`
+		PathSeparatedPrefix *string           `json:"pathSeparatedPrefix"`
+		SafeRegex           json.RawMessage   `json:"safeRegex"`
+		Headers             []xdsHeaderMatch  `json:"headers"`
+		QueryParameters     []json.RawMessage `json:"queryParameters"`
+	} `json:"match"`
+	Route *struct {
+		Cluster          string `json:"cluster"`
+		WeightedClusters *struct {
+			Clusters []struct {
+				Name   string `json:"name"`
+				Weight *int   `json:"weight"`
+			} `json:"clusters"`
+		} `json:"weightedClusters"`
+		PrefixRewrite *string `json:"prefixRewrite"`
+		Timeout       string  `json:"timeout"`
+	} `json:"route"`
+}
+
+// xdsHeaderMatch matches a request header; only :method is translated
+type xdsHeaderMatch struct {
+	Name        string `json:"name"`
+	ExactMatch  string `json:"exactMatch"`
+	StringMatch *struct {
+		Exact string `json:"exact"`
+	} `json:"stringMatch"`
+}
+
+// method returns the method an exact :method match selects
+func (h xdsHeaderMatch) method() (string, bool) {
+	if h.Name != ":method" {
+		return "", false
+	}
+	if h.StringMatch != nil && h.StringMatch.Exact != "" {
+		return h.StringMatch.Exact, true
+	}
+	return h.ExactMatch, h.ExactMatch != ""
+}
+
+// xdsResources holds the accepted resources of one type and the state of
+// polling for them
+type xdsResources struct {
+	typeURL   string
+	path      string
+	version   string
+	nonce     string
+	lastError string                     // sent as error_detail, rejecting the last response
+	resources map[string]json.RawMessage // by name
+}
+
+// xdsClient keeps a route for each route entry the management server
+// sends
+type xdsClient struct {
+	cfg       XDSConfig
+	node      xdsNode
+	server    string
+	client    *http.Client
+	clusters  xdsResources
+	endpoints xdsResources
+	routes    xdsResources
+	worker    worker // the poll loop
+
+	mutex  sync.Mutex
+	status XDSStatus
+}
+
+// xds is the xDS client; nil when disabled
+var xds atomic.Pointer[xdsClient]
+
+// newXDSClient starts polling the management server until ctx is done, or
+// returns nil when the client is disabled
+func newXDSClient(ctx context.Context, cfg XDSConfig) (*xdsClient, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	node := xdsNode{ID: cfg.Node, Cluster: cfg.Cluster}
+	if node.ID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("xds: node id: %v", err)
+		}
+		node.ID = host
+	}
+	x := &xdsClient{
+		cfg:       cfg,
+		node:      node,
+		server:    strings.TrimRight(cfg.Server, "/"),
+		client:    &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{DialContext: (&net.Dialer{Timeout: 10 * time.Second}).DialContext, TLSHandshakeTimeout: 10 * time.Second}},
+		clusters:  xdsResources{typeURL: xdsClusterType, path: xdsClusterPath},
+		endpoints: xdsResources{typeURL: xdsEndpointType, path: xdsEndpointPath},
+		routes:    xdsResources{typeURL: xdsRouteType, path: xdsRoutePath},
+		status:    XDSStatus{Enabled: true, Server: cfg.Server, Node: node.ID},
+	}
+	x.worker.start(ctx, x.run)
+	return x, nil
+}
+
+// stop ends polling and waits for it to exit. The routes stay until a new
+// client reconciles them, or dropXDSRoutes removes them.
+func (x *xdsClient) stop() {
+	if x != nil {
+		x.worker.stop()
+	}
+}
+
+// run polls the management server until ctx is done, backing off after
+// errors
+func (x *xdsClient) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		wait := x.cfg.refresh()
+		if err := x.poll(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			x.setConnected(false, err.Error())
+			log.Printf("xDS poll failed: %v", err)
+			wait = backoff
+			if backoff *= 2; backoff > maxXDSBackoff {
+				backoff = maxXDSBackoff
+			}
+		} else {
+			x.setConnected(true, "")
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// poll fetches clusters, the endpoints of EDS clusters and route
+// configurations, and reconciles the routes when any of them changed
+func (x *xdsClient) poll(ctx context.Context) error {
+	changed, err := x.fetch(ctx, &x.clusters, nil, x.decodeCluster)
+	if err != nil {
+		return err
+	}
+
+	var edsNames []string
+	for _, raw := range x.clusters.resources {
+		var cluster xdsCluster
+		json.Unmarshal(raw, &cluster)
+		if strings.EqualFold(cluster.Type, "EDS") {
+			edsNames = append(edsNames, cluster.edsName())
+		}
+	}
+	sort.Strings(edsNames)
+	if len(edsNames) > 0 {
+		updated, err := x.fetch(ctx, &x.endpoints, edsNames, x.decodeEndpoints)
+		if err != nil {
+			return err
+		}
+		changed = changed || updated
+	}
+
+	updated, err := x.fetch(ctx, &x.routes, x.cfg.RouteConfigs, x.decodeRouteConfig)
+	if err != nil {
+		return err
+	}
+	if changed || updated {
+		x.reconcile()
+	}
+	return nil
+}
+
+// fetch requests one resource type, returning whether a new version was
+// accepted. A response that does not decode is rejected: the next request
+// carries the previous version and the error, as Envoy NACKs an update.
+func (x *xdsClient) fetch(ctx context.Context, res *xdsResources, names []string, decode func(json.RawMessage) (string, error)) (bool, error) {
+	req := xdsRequest{
+		VersionInfo:   res.version,
+		Node:          x.node,
+		ResourceNames: names,
+		TypeURL:       res.typeURL,
+		ResponseNonce: res.nonce,
+	}
+	if res.lastError != "" {
+		req.ErrorDetail = &struct {
+			Message string `json:"message"`
+		}{res.lastError}
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, x.server+res.path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if x.cfg.Token != "" {
+		token, err := resolveSecret(x.cfg.Token)
+		if err != nil {
+			return false, fmt.Errorf("xds: token: %v", err)
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := x.client.Do(httpReq)
+	if err != nil {
+		return false, fmt.Errorf("xds: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("xds: %s: %s: %s", res.path, resp.Status, strings.TrimSpace(string(text)))
+	}
+
+	var response xdsResponse
+	if err := decodeProtoJSON(resp.Body, &response); err != nil {
+		return false, fmt.Errorf("xds: %s: %v", res.path, err)
+	}
+	if response.VersionInfo != "" && response.VersionInfo == res.version {
+		res.nonce = response.Nonce
+		return false, nil
+	}
+	resources := make(map[string]json.RawMessage)
+	for _, raw := range response.Resources {
+		name, err := decode(raw)
+		if err != nil {
+			res.nonce, res.lastError = response.Nonce, err.Error()
+			return false, fmt.Errorf("xds: rejected %s version %s: %v", res.typeURL, response.VersionInfo, err)
+		}
+		resources[name] = raw
+	}
+	res.version, res.nonce, res.lastError, res.resources = response.VersionInfo, response.Nonce, "", resources
+	log.Printf("xDS: accepted %s version %s with %d resources", res.typeURL, response.VersionInfo, len(resources))
+	return true, nil
+}
+
+// decodeCluster checks a Cluster resource and returns its name
+func (x *xdsClient) decodeCluster(raw json.RawMessage) (string, error) {
+	var cluster xdsCluster
+	if err := json.Unmarshal(raw, &cluster); err != nil || cluster.Name == "" {
+		return "", fmt.Errorf("cluster without a name")
+	}
+	return cluster.Name, nil
+}
+
+// decodeEndpoints checks a ClusterLoadAssignment and returns its name
+func (x *xdsClient) decodeEndpoints(raw json.RawMessage) (string, error) {
+	var assignment xdsLoadAssignment
+	if err := json.Unmarshal(raw, &assignment); err != nil || assignment.ClusterName == "" {
+		return "", fmt.Errorf("load assignment without a cluster name")
+	}
+	return assignment.ClusterName, nil
+}
+
+// decodeRouteConfig checks a RouteConfiguration and returns its name
+func (x *xdsClient) decodeRouteConfig(raw json.RawMessage) (string, error) {
+	var rc xdsRouteConfig
+	if err := json.Unmarshal(raw, &rc); err != nil || rc.Name == "" {
+		return "", fmt.Errorf("route configuration without a name")
+	}
+	return rc.Name, nil
+}
+
+// setConnected records the outcome of a poll
+func (x *xdsClient) setConnected(connected bool, lastError string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.status.Connected = connected
+	if lastError != "" {
+		x.status.LastError = lastError
+	}
+}
+
+// reconcile creates, updates and deletes the client's routes to match the
+// route configurations. A route that fails validation is reported and its
+// previous version, if any, kept.
+func (x *xdsClient) reconcile() {
+	var desired []Route
+	var rejected []XDSRejection
+	names := make([]string, 0, len(x.routes.resources))
+	for name := range x.routes.resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var rc xdsRouteConfig
+		json.Unmarshal(x.routes.resources[name], &rc)
+		for _, vh := range rc.VirtualHosts {
+			resource := rc.Name + "/" + vh.Name
+			for _, entry := range vh.Routes {
+				route, err := x.translate(resource, entry)
+				if err != nil {
+					rejected = append(rejected, XDSRejection{Resource: resource, Path: route.Path, Reason: err.Error()})
+					continue
+				}
+				desired = append(desired, route)
+			}
+		}
+	}
+	// Longer paths first, so they are matched before the prefixes they extend
+	sort.SliceStable(desired, func(i, j int) bool { return len(desired[i].Path) > len(desired[j].Path) })
+
+	routes := syncControllerRoutes(xdsSource, "xDS", desired, func(route Route, err error) {
+		rejected = append(rejected, XDSRejection{Resource: strings.TrimPrefix(route.source, xdsSource), Path: route.Path, Reason: err.Error()})
+	})
+
+	now := time.Now()
+	x.mutex.Lock()
+	x.status.Versions = map[string]string{"clusters": x.clusters.version, "endpoints": x.endpoints.version, "routes": x.routes.version}
+	x.status.RouteConfigs, x.status.Clusters = len(x.routes.resources), len(x.clusters.resources)
+	x.status.Routes, x.status.Rejected = routes, rejected
+	x.status.LastSync = &now
+	x.mutex.Unlock()
+}
+
+// translate returns the route for a route entry of a virtual host. Domains
+// are not matched: routes match by path alone.
+func (x *xdsClient) translate(resource string, entry xdsRouteEntry) (Route, error) {
+	match := entry.Match
+	route := Route{
+		Methods:     []string{"*"},
+		Active:      true,
+		Template:    x.cfg.Template,
+		Description: "xds " + resource,
+		source:      xdsSource + resource,
+	}
+	switch {
+	case match.Prefix != nil:
+		route.Path = kubePath(*match.Prefix)
+	case match.Path != nil:
+		route.Path = kubePath(*match.Path)
+		return route, fmt.Errorf("exact paths are not supported; routes match everything under their path")
+	case match.PathSeparatedPrefix != nil:
+		route.Path = kubePath(*match.PathSeparatedPrefix)
+	case match.SafeRegex != nil:
+		return route, fmt.Errorf("regular expression paths are not supported")
+	default:
+		return route, fmt.Errorf("the route has no path match")
+	}
+	for _, header := range match.Headers {
+		method, ok := header.method()
+		if !ok {
+			return route, fmt.Errorf("header matches other than an exact :method are not supported")
+		}
+		route.Methods = []string{strings.ToUpper(method)}
+	}
+	if len(match.QueryParameters) > 0 {
+		return route, fmt.Errorf("query parameter matches are not supported")
+	}
+
+	action := entry.Route
+	if action == nil {
+		return route, fmt.Errorf("only route actions are supported, not redirects or direct responses")
+	}
+	type weighted struct {
+		name   string
+		weight int
+	}
+	var clusters []weighted
+	switch {
+	case action.Cluster != "":
+		clusters = append(clusters, weighted{action.Cluster, 1})
+	case action.WeightedClusters != nil:
+		for _, c := range action.WeightedClusters.Clusters {
+			weight := 1
+			if c.Weight != nil {
+				weight = *c.Weight
+			}
+			if weight > 0 {
+				clusters = append(clusters, weighted{c.Name, weight})
+			}
+		}
+	default:
+		return route, fmt.Errorf("only cluster and weighted cluster actions are supported")
+	}
+
+	// Weights multiply across clusters and endpoints; an endpoint shared
+	// by clusters gets their sum
+	var targets []WeightedTarget
+	index := make(map[string]int)
+	for _, c := range clusters {
+		endpoints, err := x.clusterTargets(c.name)
+		if err != nil {
+			return route, err
+		}
+		for _, target := range endpoints {
+			target.Weight *= c.weight
+			if i, ok := index[target.URL]; ok {
+				targets[i].Weight += target.Weight
+				continue
+			}
+			index[target.URL] = len(targets)
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return route, fmt.Errorf("no healthy endpoint with a weight")
+	}
+	route.Target = targets[0].URL
+	if len(targets) > 1 {
+		route.Targets = targets
+	}
+
+	if action.Timeout != "" {
+		timeout, err := time.ParseDuration(action.Timeout)
+		if err != nil {
+			return route, fmt.Errorf("timeout %q: %v", action.Timeout, err)
+		}
+		route.Timeout = int(math.Ceil(timeout.Seconds()))
+	}
+	if action.PrefixRewrite != nil {
+		rewrite := &RewriteConfig{StripPrefix: true}
+		if base := strings.TrimRight(*action.PrefixRewrite, "/"); base != "" {
+			rewrite.BasePath = base
+		}
+		route.Rewrite = rewrite
+	}
+	return route, nil
+}
+
+// clusterTargets returns a target for each healthy endpoint of a cluster,
+// weighted by its load balancing weight
+func (x *xdsClient) clusterTargets(name string) ([]WeightedTarget, error) {
+	raw, ok := x.clusters.resources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", name)
+	}
+	var cluster xdsCluster
+	json.Unmarshal(raw, &cluster)
+	assignment := cluster.LoadAssignment
+	if strings.EqualFold(cluster.Type, "EDS") {
+		raw, ok := x.endpoints.resources[cluster.edsName()]
+		if !ok {
+			return nil, fmt.Errorf("no endpoints for cluster %q", name)
+		}
+		assignment = &xdsLoadAssignment{}
+		json.Unmarshal(raw, assignment)
+	}
+	if assignment == nil {
+		return nil, fmt.Errorf("cluster %q has no endpoints", name)
+	}
+
+	scheme := "http"
+	if cluster.TransportSocket != nil && strings.Contains(cluster.TransportSocket.Name, "tls") {
+		scheme = "https"
+	}
+	var targets []WeightedTarget
+	for _, locality := range assignment.Endpoints {
+		for _, lb := range locality.LBEndpoints {
+			switch strings.ToUpper(lb.HealthStatus) {
+			case "UNHEALTHY", "DRAINING", "TIMEOUT":
+				continue
+			}
+			weight := 1
+			if lb.LoadBalancingWeight != nil {
+				weight = *lb.LoadBalancingWeight
+			}
+			address := lb.Endpoint.Address.SocketAddress
+			if weight <= 0 || address.Address == "" || address.PortValue == 0 {
+				continue
+			}
+			targets = append(targets, WeightedTarget{
+				URL:    scheme + "://" + net.JoinHostPort(address.Address, strconv.Itoa(address.PortValue)),
+				Weight: weight,
+			})
+		}
+	}
+	return targets, nil
+}
+
+// dropXDSRoutes deletes every route the client kept, once it is disabled
+func dropXDSRoutes() {
+	dropControllerRoutes(xdsSource, "xDS")
+}
+
+// decodeProtoJSON decodes the proto3 JSON of a discovery response into
+// out. Management servers may send field names in snake_case or
+// lowerCamelCase; both are decoded.
+func decodeProtoJSON(r io.Reader, out interface{}) error {
+	var value interface{}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(camelKeys(value))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// camelKeys renames snake_case object keys to lowerCamelCase throughout a
+// decoded JSON value
+func camelKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			renamed[camelCase(key)] = camelKeys(item)
+		}
+		return renamed
+	case []interface{}:
+		for i, item := range v {
+			v[i] = camelKeys(item)
+		}
+		return v
+	}
+	return value
+}
+
+// camelCase returns the lowerCamelCase form of a snake_case name
+func camelCase(name string) string {
+	if !strings.Contains(name, "_") {
+		return name
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// handleXDS reports the xDS client's state
+func handleXDS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
+		return
+	}
+	xds := xds.Load()
+	if xds == nil {
+		writeJSON(w, XDSStatus{})
+		return
+	}
+	xds.mutex.Lock()
+	status := xds.status
+	xds.mutex.Unlock()
+	writeJSON(w, status)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestXDSRejectsExactPaths(t *testing.T) {
+	x := &xdsClient{}
+	var entry xdsRouteEntry
+	if err := json.Unmarshal([]byte(`{"match": {"path": "/cart"}, "route": {"cluster": "cart"}}`), &entry); err != nil {
+		t.Fatal(err)
+	}
+	route, err := x.translate("main/web", entry)
+	if err == nil || !strings.Contains(err.Error(), "exact") {
+		t.Fatalf("exact path match: %v, want it rejected", err)
+	}
+	if route.Path != "/cart" {
+		t.Fatalf("rejection names %q, want /cart", route.Path)
+	}
+}
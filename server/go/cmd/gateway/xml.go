@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// SOAP envelope namespaces
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// isXMLContentType reports whether a Content-Type header denotes XML
+func isXMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "text/xml" || mediaType == "application/xml" ||
+		mediaType == "application/soap+xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// decodeXMLValue converts an XML document into the same generic shape as
+// decoded JSON so templates and path lookups work on both. Namespace
+// prefixes are dropped, attributes are stored as "@name", repeated
+// elements become arrays and mixed text is stored as "#text".
+func decodeXMLValue(r io.Reader) (interface{}, error) {
+	dec := xml.NewDecoder(r)
+
+	type frame struct {
+		name     string
+		children map[string]interface{}
+		text     strings.Builder
+	}
+
+	var stack []*frame
+	var root map[string]interface{}
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			f := &frame{name: t.Name.Local, children: make(map[string]interface{})}
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				f.children["@"+attr.Name.Local] = attr.Value
+			}
+			stack = append(stack, f)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			// Leaf elements collapse to their text
+			var value interface{}
+			text := strings.TrimSpace(f.text.String())
+			if len(f.children) == 0 {
+				value = text
+			} else {
+				if text != "" {
+					f.children["#text"] = text
+				}
+				value = f.children
+			}
+
+			if len(stack) == 0 {
+				root = map[string]interface{}{f.name: value}
+				continue
+			}
+
+			parent := stack[len(stack)-1].children
+			switch existing := parent[f.name].(type) {
+			case nil:
+				parent[f.name] = value
+			case []interface{}:
+				parent[f.name] = append(existing, value)
+			default:
+				parent[f.name] = []interface{}{existing, value}
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("empty XML document")
+	}
+	return root, nil
+}
+
+// xpathExpr is a small XPath subset: absolute (/a/b) or descendant (//a/b)
+// location paths over local element names, with * as a wildcard
+type xpathExpr struct {
+	descendant bool
+	steps      []string
+}
+
+// parseXPath parses a supported XPath expression
+func parseXPath(expr string) (xpathExpr, error) {
+	var x xpathExpr
+	switch {
+	case strings.HasPrefix(expr, "//"):
+		x.descendant = true
+		expr = expr[2:]
+	case strings.HasPrefix(expr, "/"):
+		expr = expr[1:]
+	default:
+		return x, fmt.Errorf("xpath %q must start with / or //", expr)
+	}
+
+	for _, step := range strings.Split(expr, "/") {
+		if step == "" || strings.ContainsAny(step, "[]()@=") {
+			return x, fmt.Errorf("unsupported xpath %q", expr)
+		}
+		// Namespace prefixes are ignored when matching
+		if i := strings.Index(step, ":"); i >= 0 {
+			step = step[i+1:]
+		}
+		x.steps = append(x.steps, step)
+	}
+
+	return x, nil
+}
+
+// matches reports whether the element stack (root first) is selected
+func (x xpathExpr) matches(stack []string) bool {
+	if len(stack) < len(x.steps) || (!x.descendant && len(stack) != len(x.steps)) {
+		return false
+	}
+
+	offset := len(stack) - len(x.steps)
+	for i, step := range x.steps {
+		if step != "*" && step != stack[offset+i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isXPath reports whether a redaction path is written as XPath rather than
+// a dotted JSON path
+func isXPath(path string) bool {
+	return strings.HasPrefix(path, "/")
+}
+
+// redactXML replaces the text content of selected elements with "***",
+// leaving the rest of the document byte-for-byte intact
+func redactXML(body []byte, paths []xpathExpr) ([]byte, error) {
+	if len(paths) == 0 {
+		return body, nil
+	}
+
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var out bytes.Buffer
+	var stack []string
+	var last int64
+	redactDepth := 0
+
+	for {
+		start := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		end := dec.InputOffset()
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if redactDepth > 0 {
+				redactDepth++
+				continue
+			}
+			for _, path := range paths {
+				if path.matches(stack) {
+					redactDepth = 1
+					break
+				}
+			}
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+			if redactDepth > 0 {
+				redactDepth--
+			}
+		case xml.CharData:
+			if redactDepth > 0 && len(bytes.TrimSpace(t)) > 0 {
+				out.Write(body[last:start])
+				out.WriteString("***")
+				last = end
+			}
+		}
+	}
+
+	out.Write(body[last:])
+	return out.Bytes(), nil
+}
+
+// XMLValidationConfig configures validation of XML request bodies. The
+// document must be well formed, have the expected root element and contain
+// required paths, and conform to the XSD schema when one is set.
+type XMLValidationConfig struct {
+	SOAPEnvelope  bool     `json:"soapEnvelope,omitempty"`  // require a SOAP 1.1/1.2 envelope with a Body
+	RootElement   string   `json:"rootElement,omitempty"`   // expected local name of the root (or SOAP body payload)
+	Namespace     string   `json:"namespace,omitempty"`     // expected namespace of RootElement
+	RequiredPaths []string `json:"requiredPaths,omitempty"` // XPath expressions that must match an element
+	Schema        string   `json:"schema,omitempty"`        // XSD file the root (or SOAP body payload) must conform to
+}
+
+// validateXMLBody checks a document against the validation config and
+// returns the SOAP namespace when the document is a SOAP envelope
+func validateXMLBody(body []byte, cfg *XMLValidationConfig) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+
+	required := make([]xpathExpr, 0, len(cfg.RequiredPaths))
+	for _, p := range cfg.RequiredPaths {
+		x, err := parseXPath(p)
+		if err != nil {
+			return "", err
+		}
+		required = append(required, x)
+	}
+	found := make([]bool, len(required))
+
+	var stack []string
+	var soapNS string
+	var payload *xml.Name
+	sawBody := false
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return soapNS, fmt.Errorf("malformed XML: %v", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			if _, ok := tok.(xml.EndElement); ok {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		stack = append(stack, start.Name.Local)
+		depth := len(stack)
+
+		switch {
+		case depth == 1:
+			if start.Name.Local == "Envelope" && (start.Name.Space == soap11Namespace || start.Name.Space == soap12Namespace) {
+				soapNS = start.Name.Space
+			} else if cfg.SOAPEnvelope {
+				return "", fmt.Errorf("root element must be a SOAP Envelope")
+			} else {
+				name := start.Name
+				payload = &name
+			}
+		case depth == 2 && soapNS != "" && start.Name.Local == "Body":
+			sawBody = true
+		case depth == 3 && soapNS != "" && sawBody && payload == nil:
+			name := start.Name
+			payload = &name
+		}
+
+		for i, x := range required {
+			if !found[i] && x.matches(stack) {
+				found[i] = true
+			}
+		}
+	}
+
+	if soapNS != "" && !sawBody {
+		return soapNS, fmt.Errorf("SOAP envelope has no Body")
+	}
+	if cfg.RootElement != "" {
+		if payload == nil || payload.Local != cfg.RootElement {
+			return soapNS, fmt.Errorf("expected root element %s", cfg.RootElement)
+		}
+		if cfg.Namespace != "" && payload.Space != cfg.Namespace {
+			return soapNS, fmt.Errorf("element %s must be in namespace %s", cfg.RootElement, cfg.Namespace)
+		}
+	}
+	for i, x := range found {
+		if !x {
+			return soapNS, fmt.Errorf("required element %s is missing", cfg.RequiredPaths[i])
+		}
+	}
+
+	if cfg.Schema != "" {
+		if err := validateXMLSchema(body, cfg.Schema, soapNS); err != nil {
+			return soapNS, err
+		}
+	}
+	return soapNS, nil
+}
+
+// validateXMLSchema checks the root element, or the payload of a SOAP
+// Body, against an XSD schema file
+func validateXMLSchema(body []byte, path, soapNS string) error {
+	schema, err := loadXSD(path)
+	if err != nil {
+		return fmt.Errorf("XML schema unavailable: %v", err)
+	}
+	root, err := parseXMLTree(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if soapNS != "" {
+		payload := soapPayload(root, soapNS)
+		if payload == nil {
+			return fmt.Errorf("SOAP Body has no payload")
+		}
+		root = payload
+	}
+	return schema.validate(root)
+}
+
+// soapPayload returns the first element in a SOAP envelope's Body
+func soapPayload(envelope *xmlNode, soapNS string) *xmlNode {
+	for _, c := range envelope.children {
+		if c.name.Space == soapNS && c.name.Local == "Body" && len(c.children) > 0 {
+			return c.children[0]
+		}
+	}
+	return nil
+}
+
+// writeSOAPFault answers a SOAP request with a client fault
+func writeSOAPFault(w http.ResponseWriter, soapNS string, message string) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+
+	if soapNS == soap12Namespace {
+		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+		buf.WriteString(`<soap:Envelope xmlns:soap="` + soap12Namespace + `"><soap:Body><soap:Fault>`)
+		buf.WriteString(`<soap:Code><soap:Value>soap:Sender</soap:Value></soap:Code><soap:Reason><soap:Text xml:lang="en">`)
+		xml.EscapeText(&buf, []byte(message))
+		buf.WriteString(`</soap:Text></soap:Reason></soap:Fault></soap:Body></soap:Envelope>`)
+		w.WriteHeader(http.StatusBadRequest)
+	} else {
+		// SOAP 1.1 requires faults to be returned with a 500 status
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		buf.WriteString(`<soap:Envelope xmlns:soap="` + soap11Namespace + `"><soap:Body><soap:Fault>`)
+		buf.WriteString(`<faultcode>soap:Client</faultcode><faultstring>`)
+		xml.EscapeText(&buf, []byte(message))
+		buf.WriteString(`</faultstring></soap:Fault></soap:Body></soap:Envelope>`)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	w.Write(buf.Bytes())
+}
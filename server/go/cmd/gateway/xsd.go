@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// XML Schema namespaces
+const (
+	xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+	xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// xsdRecheckInterval is how often a schema file is checked for changes
+const xsdRecheckInterval = 10 * time.Second
+
+// xmlNode is an element of a parsed XML document
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     string
+	prefixes map[string]string // namespace prefixes in scope, for QName values
+}
+
+// parseXMLTree parses a document into its element tree
+func parseXMLTree(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	var stack []*xmlNode
+	var texts []*strings.Builder
+	var root *xmlNode
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed XML: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name}
+			prefixes := map[string]string{}
+			if len(stack) > 0 {
+				prefixes = stack[len(stack)-1].prefixes
+			}
+			declared := false
+			for _, attr := range t.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					prefixes, declared = declarePrefix(prefixes, declared, attr.Name.Local, attr.Value)
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					prefixes, declared = declarePrefix(prefixes, declared, "", attr.Value)
+				default:
+					n.attrs = append(n.attrs, attr)
+				}
+			}
+			n.prefixes = prefixes
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else {
+				root = n
+			}
+			stack = append(stack, n)
+			texts = append(texts, &strings.Builder{})
+		case xml.CharData:
+			if len(texts) > 0 {
+				texts[len(texts)-1].Write(t)
+			}
+		case xml.EndElement:
+			stack[len(stack)-1].text = texts[len(texts)-1].String()
+			stack, texts = stack[:len(stack)-1], texts[:len(texts)-1]
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("empty XML document")
+	}
+	return root, nil
+}
+
+// declarePrefix adds a namespace declaration, copying the inherited
+// prefixes the first time an element declares one
+func declarePrefix(prefixes map[string]string, copied bool, prefix, space string) (map[string]string, bool) {
+	if !copied {
+		inherited := prefixes
+		prefixes = make(map[string]string, len(inherited)+1)
+		for k, v := range inherited {
+			prefixes[k] = v
+		}
+	}
+	prefixes[prefix] = space
+	return prefixes, true
+}
+
+// attr returns the value of an unqualified attribute
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// qname resolves a prefixed name written in an attribute value
+func (n *xmlNode) qname(value string) (xml.Name, error) {
+	prefix, local, ok := strings.Cut(strings.TrimSpace(value), ":")
+	if !ok {
+		prefix, local = "", prefix
+	}
+	space, declared := n.prefixes[prefix]
+	if !declared && prefix != "" {
+		return xml.Name{}, fmt.Errorf("undeclared namespace prefix %q in %q", prefix, value)
+	}
+	return xml.Name{Space: space, Local: local}, nil
+}
+
+// schemaChildren returns the child elements of a schema node, without
+// annotations
+func (n *xmlNode) schemaChildren() []*xmlNode {
+	children := make([]*xmlNode, 0, len(n.children))
+	for _, c := range n.children {
+		if c.name.Space == xsdNamespace && c.name.Local != "annotation" {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// xsdSchema is a loaded XML Schema. It covers the common subset used to
+// describe SOAP and XML payloads: global and local elements, named and
+// anonymous complex and simple types, sequence, choice and all groups with
+// occurrence bounds, xs:any, attributes, simple content, complex content
+// extension, and restrictions of the built-in types with facets.
+type xsdSchema struct {
+	elements map[xml.Name]*xsdElement
+}
+
+// xsdElement is an element declaration
+type xsdElement struct {
+	name     xml.Name
+	typ      *xsdType
+	nillable bool
+}
+
+// xsdType is a complex type, or a simple type used as an element's type
+type xsdType struct {
+	any     bool         // xs:anyType: any attributes and content
+	simple  *xsdSimple   // text-only content, for simple types and simple content
+	content *xsdParticle // nil for empty content
+	mixed   bool
+	attrs   []xsdAttribute
+	anyAttr bool
+	ready   bool // set once the type is fully built
+}
+
+// xsdParticle is an element, wildcard or group in a content model
+type xsdParticle struct {
+	kind     string // element, any, sequence, choice or all
+	element  *xsdElement
+	items    []*xsdParticle
+	min, max int // max is -1 when unbounded
+
+	// Wildcards match elements in these namespaces, or outside them
+	namespaces []string
+	other      bool
+}
+
+// xsdAttribute is an attribute declaration
+type xsdAttribute struct {
+	name     string
+	typ      *xsdSimple
+	required bool
+	fixed    *string
+}
+
+// xsdSimple is a built-in type with the facets of its restrictions
+type xsdSimple struct {
+	base        string // the built-in type it derives from
+	enum        []string
+	patterns    []*regexp.Regexp
+	length      int // -1 when unset
+	minLength   int
+	maxLength   int
+	lower       *big.Rat
+	lowerIncl   bool
+	upper       *big.Rat
+	upperIncl   bool
+	totalDigits int // 0 when unset
+	fracDigits  int // -1 when unset
+}
+
+// xsdBuiltins lists the supported built-in simple types by local name
+var xsdBuiltins = map[string]bool{
+	"anySimpleType": true, "string": true, "normalizedString": true, "token": true,
+	"language": true, "Name": true, "NCName": true, "NMTOKEN": true, "ID": true,
+	"IDREF": true, "ENTITY": true, "QName": true, "anyURI": true,
+	"boolean": true, "decimal": true, "float": true, "double": true,
+	"integer": true, "long": true, "int": true, "short": true, "byte": true,
+	"nonNegativeInteger": true, "positiveInteger": true, "nonPositiveInteger": true,
+	"negativeInteger": true, "unsignedLong": true, "unsignedInt": true,
+	"unsignedShort": true, "unsignedByte": true,
+	"date": true, "dateTime": true, "time": true, "duration": true,
+	"gYear": true, "gYearMonth": true, "base64Binary": true, "hexBinary": true,
+}
+
+// xsdIntegerRanges bounds the sized integer types
+var xsdIntegerRanges = map[string][2]string{
+	"long":               {"-9223372036854775808", "9223372036854775807"},
+	"int":                {"-2147483648", "2147483647"},
+	"short":              {"-32768", "32767"},
+	"byte":               {"-128", "127"},
+	"nonNegativeInteger": {"0", ""},
+	"positiveInteger":    {"1", ""},
+	"nonPositiveInteger": {"", "0"},
+	"negativeInteger":    {"", "-1"},
+	"unsignedLong":       {"0", "18446744073709551615"},
+	"unsignedInt":        {"0", "4294967295"},
+	"unsignedShort":      {"0", "65535"},
+	"unsignedByte":       {"0", "255"},
+}
+
+// xsdLexical holds the lexical forms of the types checked by pattern
+var xsdLexical = map[string]*regexp.Regexp{
+	"decimal":    regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`),
+	"integer":    regexp.MustCompile(`^[+-]?\d+$`),
+	"dateTime":   regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+	"date":       regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}(Z|[+-]\d{2}:\d{2})?$`),
+	"time":       regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+	"duration":   regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`),
+	"gYear":      regexp.MustCompile(`^-?\d{4,}(Z|[+-]\d{2}:\d{2})?$`),
+	"gYearMonth": regexp.MustCompile(`^-?\d{4,}-\d{2}(Z|[+-]\d{2}:\d{2})?$`),
+}
+
+// xsdLoader builds a schema, resolving named types and global elements on
+// first use so declarations may refer to each other in any order
+type xsdLoader struct {
+	target    string
+	qualified bool // elementFormDefault="qualified"
+	typeNodes map[xml.Name]*xmlNode
+	elemNodes map[xml.Name]*xmlNode
+	types     map[xml.Name]*xsdType
+	simples   map[xml.Name]*xsdSimple
+	elements  map[xml.Name]*xsdElement
+	building  map[xml.Name]bool // simple types being built, to catch cycles
+}
+
+// parseXSD loads a schema document
+func parseXSD(data []byte) (*xsdSchema, error) {
+	root, err := parseXMLTree(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if root.name.Space != xsdNamespace || root.name.Local != "schema" {
+		return nil, errors.New("root element must be xs:schema")
+	}
+
+	l := &xsdLoader{
+		typeNodes: make(map[xml.Name]*xmlNode),
+		elemNodes: make(map[xml.Name]*xmlNode),
+		types:     make(map[xml.Name]*xsdType),
+		simples:   make(map[xml.Name]*xsdSimple),
+		elements:  make(map[xml.Name]*xsdElement),
+		building:  make(map[xml.Name]bool),
+	}
+	l.target, _ = root.attr("targetNamespace")
+	form, _ := root.attr("elementFormDefault")
+	l.qualified = form == "qualified"
+
+	for _, c := range root.schemaChildren() {
+		name, _ := c.attr("name")
+		key := xml.Name{Space: l.target, Local: name}
+		switch c.name.Local {
+		case "element":
+			l.elemNodes[key] = c
+		case "complexType", "simpleType":
+			l.typeNodes[key] = c
+		default:
+			return nil, fmt.Errorf("xs:%s is not supported", c.name.Local)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("global xs:%s needs a name", c.name.Local)
+		}
+	}
+
+	schema := &xsdSchema{elements: make(map[xml.Name]*xsdElement)}
+	for key := range l.elemNodes {
+		e, err := l.globalElement(key)
+		if err != nil {
+			return nil, err
+		}
+		schema.elements[key] = e
+	}
+	// Build unused types too, so errors in them are reported
+	for key, n := range l.typeNodes {
+		if n.name.Local == "complexType" {
+			_, err = l.complexType(key)
+		} else {
+			_, err = l.simpleType(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(schema.elements) == 0 {
+		return nil, errors.New("schema declares no global elements")
+	}
+	return schema, nil
+}
+
+// globalElement builds a global element declaration
+func (l *xsdLoader) globalElement(key xml.Name) (*xsdElement, error) {
+	if e, ok := l.elements[key]; ok {
+		return e, nil
+	}
+	n, ok := l.elemNodes[key]
+	if !ok {
+		return nil, fmt.Errorf("element %s is not declared", key.Local)
+	}
+	e := &xsdElement{name: key}
+	l.elements[key] = e
+	if err := l.fillElement(e, n); err != nil {
+		return nil, fmt.Errorf("element %s: %v", key.Local, err)
+	}
+	return e, nil
+}
+
+// fillElement sets an element's type from its type attribute or inline
+// type definition
+func (l *xsdLoader) fillElement(e *xsdElement, n *xmlNode) error {
+	nillable, _ := n.attr("nillable")
+	e.nillable = nillable == "true"
+
+	if typeName, ok := n.attr("type"); ok {
+		name, err := n.qname(typeName)
+		if err != nil {
+			return err
+		}
+		e.typ, err = l.typeByName(name)
+		return err
+	}
+	for _, c := range n.schemaChildren() {
+		switch c.name.Local {
+		case "complexType":
+			t := &xsdType{}
+			if err := l.fillComplexType(t, c); err != nil {
+				return err
+			}
+			e.typ = t
+			return nil
+		case "simpleType":
+			s, err := l.restriction(c)
+			if err != nil {
+				return err
+			}
+			e.typ = &xsdType{simple: s, ready: true}
+			return nil
+		case "unique", "key", "keyref":
+			continue
+		default:
+			return fmt.Errorf("xs:%s is not supported", c.name.Local)
+		}
+	}
+	e.typ = &xsdType{any: true, ready: true}
+	return nil
+}
+
+// typeByName resolves an element type, built-in or declared
+func (l *xsdLoader) typeByName(name xml.Name) (*xsdType, error) {
+	if name.Space == xsdNamespace {
+		if name.Local == "anyType" {
+			return &xsdType{any: true, ready: true}, nil
+		}
+		s, err := l.builtin(name.Local)
+		if err != nil {
+			return nil, err
+		}
+		return &xsdType{simple: s, ready: true}, nil
+	}
+	n, ok := l.typeNodes[name]
+	if !ok {
+		return nil, fmt.Errorf("type %s is not declared", name.Local)
+	}
+	if n.name.Local == "simpleType" {
+		s, err := l.simpleType(name)
+		if err != nil {
+			return nil, err
+		}
+		return &xsdType{simple: s, ready: true}, nil
+	}
+	return l.complexType(name)
+}
+
+// complexType builds a named complex type. The type is registered before
+// its content, so recursive content models refer to the same value.
+func (l *xsdLoader) complexType(name xml.Name) (*xsdType, error) {
+	if t, ok := l.types[name]; ok {
+		return t, nil
+	}
+	t := &xsdType{}
+	l.types[name] = t
+	if err := l.fillComplexType(t, l.typeNodes[name]); err != nil {
+		return nil, fmt.Errorf("type %s: %v", name.Local, err)
+	}
+	return t, nil
+}
+
+// fillComplexType builds a complex type's content model and attributes
+func (l *xsdLoader) fillComplexType(t *xsdType, n *xmlNode) error {
+	mixed, _ := n.attr("mixed")
+	t.mixed = mixed == "true"
+	for _, c := range n.schemaChildren() {
+		switch c.name.Local {
+		case "sequence", "choice", "all":
+			p, err := l.particle(c)
+			if err != nil {
+				return err
+			}
+			t.content = p
+		case "attribute", "anyAttribute":
+			if err := l.addAttribute(t, c); err != nil {
+				return err
+			}
+		case "simpleContent":
+			if err := l.simpleContent(t, c); err != nil {
+				return err
+			}
+		case "complexContent":
+			if err := l.complexContent(t, c); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("xs:%s is not supported", c.name.Local)
+		}
+	}
+	t.ready = true
+	return nil
+}
+
+// simpleContent builds a type with text content and attributes
+func (l *xsdLoader) simpleContent(t *xsdType, n *xmlNode) error {
+	for _, c := range n.schemaChildren() {
+		if c.name.Local != "extension" {
+			return fmt.Errorf("xs:simpleContent/xs:%s is not supported", c.name.Local)
+		}
+		baseName, _ := c.attr("base")
+		name, err := c.qname(baseName)
+		if err != nil {
+			return err
+		}
+		base, err := l.typeByName(name)
+		if err != nil {
+			return err
+		}
+		if base.simple == nil {
+			return fmt.Errorf("simple content base %s has no text content", name.Local)
+		}
+		t.simple = base.simple
+		t.attrs = append(t.attrs, base.attrs...)
+		t.anyAttr = base.anyAttr
+		for _, a := range c.schemaChildren() {
+			if err := l.addAttribute(t, a); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// complexContent builds a type that extends another complex type, whose
+// content comes first
+func (l *xsdLoader) complexContent(t *xsdType, n *xmlNode) error {
+	for _, c := range n.schemaChildren() {
+		if c.name.Local != "extension" {
+			return fmt.Errorf("xs:complexContent/xs:%s is not supported", c.name.Local)
+		}
+		baseName, _ := c.attr("base")
+		name, err := c.qname(baseName)
+		if err != nil {
+			return err
+		}
+		base, err := l.typeByName(name)
+		if err != nil {
+			return err
+		}
+		if !base.ready {
+			return fmt.Errorf("type %s extends itself", name.Local)
+		}
+		if base.any || base.simple != nil {
+			return fmt.Errorf("complex content base %s must be a complex type", name.Local)
+		}
+		t.attrs = append(t.attrs, base.attrs...)
+		t.anyAttr = base.anyAttr
+		t.mixed = t.mixed || base.mixed
+		var own *xsdParticle
+		for _, e := range c.schemaChildren() {
+			switch e.name.Local {
+			case "sequence", "choice", "all":
+				if own, err = l.particle(e); err != nil {
+					return err
+				}
+			case "attribute", "anyAttribute":
+				if err := l.addAttribute(t, e); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("xs:%s is not supported", e.name.Local)
+			}
+		}
+		switch {
+		case base.content == nil:
+			t.content = own
+		case own == nil:
+			t.content = base.content
+		default:
+			t.content = &xsdParticle{kind: "sequence", items: []*xsdParticle{base.content, own}, min: 1, max: 1}
+		}
+	}
+	return nil
+}
+
+// addAttribute adds an attribute declaration or wildcard to a type
+func (l *xsdLoader) addAttribute(t *xsdType, n *xmlNode) error {
+	if n.name.Local == "anyAttribute" {
+		t.anyAttr = true
+		return nil
+	}
+	if n.name.Local != "attribute" {
+		return fmt.Errorf("xs:%s is not supported", n.name.Local)
+	}
+	if _, ok := n.attr("ref"); ok {
+		return errors.New("attribute references are not supported")
+	}
+	name, _ := n.attr("name")
+	if name == "" {
+		return errors.New("xs:attribute needs a name")
+	}
+	use, _ := n.attr("use")
+	if use == "prohibited" {
+		return nil
+	}
+	a := xsdAttribute{name: name, required: use == "required"}
+	if fixed, ok := n.attr("fixed"); ok {
+		a.fixed = &fixed
+	}
+
+	if typeName, ok := n.attr("type"); ok {
+		qn, err := n.qname(typeName)
+		if err != nil {
+			return err
+		}
+		typ, err := l.typeByName(qn)
+		if err != nil {
+			return err
+		}
+		if typ.simple == nil {
+			return fmt.Errorf("attribute %s must have a simple type", name)
+		}
+		a.typ = typ.simple
+	} else {
+		for _, c := range n.schemaChildren() {
+			if c.name.Local != "simpleType" {
+				return fmt.Errorf("xs:%s is not supported", c.name.Local)
+			}
+			s, err := l.restriction(c)
+			if err != nil {
+				return err
+			}
+			a.typ = s
+		}
+	}
+	if a.typ == nil {
+		a.typ, _ = l.builtin("anySimpleType")
+	}
+	t.attrs = append(t.attrs, a)
+	return nil
+}
+
+// particle builds an element, wildcard or group with its occurrence bounds
+func (l *xsdLoader) particle(n *xmlNode) (*xsdParticle, error) {
+	p := &xsdParticle{kind: n.name.Local, min: 1, max: 1}
+	if v, ok := n.attr("minOccurs"); ok {
+		min, err := strconv.Atoi(v)
+		if err != nil || min < 0 {
+			return nil, fmt.Errorf("invalid minOccurs %q", v)
+		}
+		p.min = min
+	}
+	if v, ok := n.attr("maxOccurs"); ok {
+		if v == "unbounded" {
+			p.max = -1
+		} else {
+			max, err := strconv.Atoi(v)
+			if err != nil || max < p.min {
+				return nil, fmt.Errorf("invalid maxOccurs %q", v)
+			}
+			p.max = max
+		}
+	}
+
+	switch p.kind {
+	case "element":
+		if ref, ok := n.attr("ref"); ok {
+			name, err := n.qname(ref)
+			if err != nil {
+				return nil, err
+			}
+			if p.element, err = l.globalElement(name); err != nil {
+				return nil, err
+			}
+			return p, nil
+		}
+		name, _ := n.attr("name")
+		if name == "" {
+			return nil, errors.New("xs:element needs a name or ref")
+		}
+		space := ""
+		form, _ := n.attr("form")
+		if form == "qualified" || (form == "" && l.qualified) {
+			space = l.target
+		}
+		p.element = &xsdElement{name: xml.Name{Space: space, Local: name}}
+		if err := l.fillElement(p.element, n); err != nil {
+			return nil, fmt.Errorf("element %s: %v", name, err)
+		}
+	case "any":
+		// Wildcard content is accepted without validation
+		namespace, _ := n.attr("namespace")
+		switch namespace {
+		case "", "##any":
+		case "##other":
+			p.namespaces, p.other = []string{l.target, ""}, true
+		default:
+			for _, ns := range strings.Fields(namespace) {
+				switch ns {
+				case "##targetNamespace":
+					ns = l.target
+				case "##local":
+					ns = ""
+				}
+				p.namespaces = append(p.namespaces, ns)
+			}
+		}
+	case "sequence", "choice", "all":
+		for _, c := range n.schemaChildren() {
+			item, err := l.particle(c)
+			if err != nil {
+				return nil, err
+			}
+			if p.kind == "all" && (item.kind != "element" || item.max != 1) {
+				return nil, errors.New("xs:all may only hold elements that occur at most once")
+			}
+			p.items = append(p.items, item)
+		}
+	default:
+		return nil, fmt.Errorf("xs:%s is not supported", p.kind)
+	}
+	return p, nil
+}
+
+// simpleType builds a named simple type
+func (l *xsdLoader) simpleType(name xml.Name) (*xsdSimple, error) {
+	if s, ok := l.simples[name]; ok {
+		return s, nil
+	}
+	if l.building[name] {
+		return nil, fmt.Errorf("type %s derives from itself", name.Local)
+	}
+	l.building[name] = true
+	s, err := l.restriction(l.typeNodes[name])
+	if err != nil {
+		return nil, fmt.Errorf("type %s: %v", name.Local, err)
+	}
+	l.simples[name] = s
+	return s, nil
+}
+
+// builtin returns an unrestricted built-in type
+func (l *xsdLoader) builtin(name string) (*xsdSimple, error) {
+	if !xsdBuiltins[name] {
+		return nil, fmt.Errorf("built-in type xs:%s is not supported", name)
+	}
+	return &xsdSimple{base: name, length: -1, minLength: -1, maxLength: -1, fracDigits: -1}, nil
+}
+
+// restriction builds a simple type from its xs:restriction
+func (l *xsdLoader) restriction(n *xmlNode) (*xsdSimple, error) {
+	var r *xmlNode
+	for _, c := range n.schemaChildren() {
+		if c.name.Local != "restriction" {
+			return nil, fmt.Errorf("xs:%s is not supported", c.name.Local)
+		}
+		r = c
+	}
+	if r == nil {
+		return nil, errors.New("xs:simpleType needs a restriction")
+	}
+
+	var base *xsdSimple
+	if baseName, ok := r.attr("base"); ok {
+		name, err := r.qname(baseName)
+		if err != nil {
+			return nil, err
+		}
+		if name.Space == xsdNamespace {
+			base, err = l.builtin(name.Local)
+		} else if _, declared := l.typeNodes[name]; declared && l.typeNodes[name].name.Local == "simpleType" {
+			base, err = l.simpleType(name)
+		} else {
+			err = fmt.Errorf("simple type %s is not declared", name.Local)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("xs:restriction needs a base")
+	}
+
+	// Facets narrow the base type's facets
+	s := *base
+	s.enum = nil
+	s.patterns = append([]*regexp.Regexp(nil), base.patterns...)
+	numeric := s.isNumeric()
+	for _, f := range r.schemaChildren() {
+		value, _ := f.attr("value")
+		var err error
+		switch f.name.Local {
+		case "enumeration":
+			s.enum = append(s.enum, value)
+		case "pattern":
+			var re *regexp.Regexp
+			// XSD patterns match the whole value
+			if re, err = regexp.Compile(`^(?:` + value + `)$`); err == nil {
+				s.patterns = append(s.patterns, re)
+			}
+		case "length":
+			s.length, err = strconv.Atoi(value)
+		case "minLength":
+			s.minLength, err = strconv.Atoi(value)
+		case "maxLength":
+			s.maxLength, err = strconv.Atoi(value)
+		case "totalDigits":
+			s.totalDigits, err = strconv.Atoi(value)
+		case "fractionDigits":
+			s.fracDigits, err = strconv.Atoi(value)
+		case "minInclusive", "minExclusive", "maxInclusive", "maxExclusive":
+			if !numeric {
+				return nil, fmt.Errorf("xs:%s is only supported on numeric types", f.name.Local)
+			}
+			bound, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+			if !ok {
+				return nil, fmt.Errorf("invalid xs:%s %q", f.name.Local, value)
+			}
+			if strings.HasPrefix(f.name.Local, "min") {
+				s.lower, s.lowerIncl = bound, f.name.Local == "minInclusive"
+			} else {
+				s.upper, s.upperIncl = bound, f.name.Local == "maxInclusive"
+			}
+		case "whiteSpace":
+			// Values are compared with whitespace collapsed except for strings
+		default:
+			return nil, fmt.Errorf("xs:%s is not supported", f.name.Local)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid xs:%s %q: %v", f.name.Local, value, err)
+		}
+	}
+	if s.enum == nil {
+		s.enum = base.enum
+	}
+	return &s, nil
+}
+
+// isNumeric reports whether values compare as numbers
+func (s *xsdSimple) isNumeric() bool {
+	_, sized := xsdIntegerRanges[s.base]
+	return sized || s.base == "decimal" || s.base == "integer" || s.base == "float" || s.base == "double"
+}
+
+// check validates a text value against the type and its facets
+func (s *xsdSimple) check(value string) error {
+	if s.base != "string" && s.base != "anySimpleType" {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	if err := s.checkLexical(value); err != nil {
+		return err
+	}
+
+	length := utf8.RuneCountInString(value)
+	switch {
+	case s.length >= 0 && length != s.length:
+		return fmt.Errorf("value %q must be %d characters long", value, s.length)
+	case s.minLength >= 0 && length < s.minLength:
+		return fmt.Errorf("value %q is shorter than %d characters", value, s.minLength)
+	case s.maxLength >= 0 && length > s.maxLength:
+		return fmt.Errorf("value %q is longer than %d characters", value, s.maxLength)
+	}
+	for _, re := range s.patterns {
+		if !re.MatchString(value) {
+			return fmt.Errorf("value %q does not match pattern %s", value, strings.TrimSuffix(strings.TrimPrefix(re.String(), "^(?:"), ")$"))
+		}
+	}
+	if len(s.enum) > 0 {
+		found := false
+		for _, e := range s.enum {
+			if e == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("value %q is not one of %s", value, strings.Join(s.enum, ", "))
+		}
+	}
+
+	if s.lower != nil || s.upper != nil || s.totalDigits > 0 || s.fracDigits >= 0 {
+		n, ok := new(big.Rat).SetString(value)
+		if !ok {
+			return fmt.Errorf("value %q is not a number", value)
+		}
+		if s.lower != nil && (n.Cmp(s.lower) < 0 || (!s.lowerIncl && n.Cmp(s.lower) == 0)) {
+			return fmt.Errorf("value %q is below the minimum %s", value, s.lower.RatString())
+		}
+		if s.upper != nil && (n.Cmp(s.upper) > 0 || (!s.upperIncl && n.Cmp(s.upper) == 0)) {
+			return fmt.Errorf("value %q is above the maximum %s", value, s.upper.RatString())
+		}
+		whole, frac, _ := strings.Cut(strings.TrimLeft(value, "+-"), ".")
+		whole, frac = strings.TrimLeft(whole, "0"), strings.TrimRight(frac, "0")
+		if s.fracDigits >= 0 && len(frac) > s.fracDigits {
+			return fmt.Errorf("value %q has more than %d fraction digits", value, s.fracDigits)
+		}
+		if s.totalDigits > 0 && len(whole)+len(frac) > s.totalDigits {
+			return fmt.Errorf("value %q has more than %d digits", value, s.totalDigits)
+		}
+	}
+	return nil
+}
+
+// checkLexical checks a value's form against its built-in type
+func (s *xsdSimple) checkLexical(value string) error {
+	invalid := fmt.Errorf("value %q is not a valid %s", value, s.base)
+	if r, sized := xsdIntegerRanges[s.base]; sized || s.base == "integer" {
+		n, ok := new(big.Int).SetString(strings.TrimPrefix(value, "+"), 10)
+		if !ok || !xsdLexical["integer"].MatchString(value) {
+			return invalid
+		}
+		if lo, ok := new(big.Int).SetString(r[0], 10); ok && n.Cmp(lo) < 0 {
+			return invalid
+		}
+		if hi, ok := new(big.Int).SetString(r[1], 10); ok && n.Cmp(hi) > 0 {
+			return invalid
+		}
+		return nil
+	}
+	switch s.base {
+	case "boolean":
+		if value != "true" && value != "false" && value != "1" && value != "0" {
+			return invalid
+		}
+	case "float", "double":
+		if value == "INF" || value == "-INF" || value == "NaN" {
+			return nil
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil || strings.ContainsAny(value, "xXpP_") {
+			return invalid
+		}
+	case "date", "dateTime":
+		if !xsdLexical[s.base].MatchString(value) {
+			return invalid
+		}
+		// Check the calendar date; years beyond four digits are rare enough
+		// to take on their pattern alone
+		if len(value) >= 10 && value[4] == '-' {
+			if _, err := time.Parse("2006-01-02", value[:10]); err != nil {
+				return invalid
+			}
+		}
+	case "base64Binary":
+		if _, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), "")); err != nil {
+			return invalid
+		}
+	case "hexBinary":
+		if _, err := hex.DecodeString(value); err != nil {
+			return invalid
+		}
+	default:
+		if re, ok := xsdLexical[s.base]; ok && !re.MatchString(value) {
+			return invalid
+		}
+	}
+	return nil
+}
+
+// validate checks a document element against its global declaration
+func (s *xsdSchema) validate(root *xmlNode) error {
+	decl, ok := s.elements[root.name]
+	if !ok {
+		return fmt.Errorf("element %s is not declared in the schema", xmlNameString(root.name))
+	}
+	return validateXSDElement(root, decl, "/"+root.name.Local)
+}
+
+// validateXSDElement checks an element's attributes and content, and its
+// child elements recursively
+func validateXSDElement(n *xmlNode, decl *xsdElement, path string) error {
+	t := decl.typ
+	if t.any {
+		return nil
+	}
+	if nilled, _ := xsiAttr(n, "nil"); nilled == "true" || nilled == "1" {
+		if !decl.nillable {
+			return fmt.Errorf("%s: element is not nillable", path)
+		}
+		if len(n.children) > 0 || strings.TrimSpace(n.text) != "" {
+			return fmt.Errorf("%s: nil element must be empty", path)
+		}
+		return nil
+	}
+
+	seen := make(map[string]bool, len(n.attrs))
+	for _, a := range n.attrs {
+		if a.Name.Space == xsiNamespace || a.Name.Space == "xml" || a.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+			continue
+		}
+		declared := false
+		for _, d := range t.attrs {
+			if a.Name.Space == "" && a.Name.Local == d.name {
+				declared, seen[d.name] = true, true
+				if err := d.typ.check(a.Value); err != nil {
+					return fmt.Errorf("%s/@%s: %v", path, d.name, err)
+				}
+				if d.fixed != nil && a.Value != *d.fixed {
+					return fmt.Errorf("%s/@%s: must be %q", path, d.name, *d.fixed)
+				}
+			}
+		}
+		if !declared && !t.anyAttr {
+			return fmt.Errorf("%s: attribute %s is not allowed", path, a.Name.Local)
+		}
+	}
+	for _, d := range t.attrs {
+		if d.required && !seen[d.name] {
+			return fmt.Errorf("%s: attribute %s is required", path, d.name)
+		}
+	}
+
+	if t.simple != nil {
+		if len(n.children) > 0 {
+			return fmt.Errorf("%s: element %s is not allowed in text content", path, n.children[0].name.Local)
+		}
+		if err := t.simple.check(n.text); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return nil
+	}
+	if !t.mixed && strings.TrimSpace(n.text) != "" {
+		return fmt.Errorf("%s: text is not allowed here", path)
+	}
+
+	m := &xsdMatcher{children: n.children, decls: make([]*xsdElement, len(n.children))}
+	pos := 0
+	if t.content != nil {
+		var err error
+		if pos, err = m.match(t.content, 0); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if pos < len(n.children) {
+		return fmt.Errorf("%s: unexpected element %s", path, xmlNameString(n.children[pos].name))
+	}
+	for i, child := range n.children {
+		if m.decls[i] == nil {
+			continue // matched by xs:any
+		}
+		if err := validateXSDElement(child, m.decls[i], path+"/"+child.name.Local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// xsiAttr returns a schema instance attribute such as xsi:nil
+func xsiAttr(n *xmlNode, name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Space == xsiNamespace && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// xmlNameString formats a name with its namespace for error messages
+func xmlNameString(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return "{" + name.Space + "}" + name.Local
+}
+
+// xsdMatcher matches child elements against a content model. Schemas must
+// keep particles unambiguous, so matching greedily without backtracking
+// finds the match when there is one.
+type xsdMatcher struct {
+	children []*xmlNode
+	decls    []*xsdElement // the declaration each child matched
+}
+
+// match consumes the children a particle matches from pos, honoring its
+// occurrence bounds, and returns the position after them
+func (m *xsdMatcher) match(p *xsdParticle, pos int) (int, error) {
+	count := 0
+	for p.max < 0 || count < p.max {
+		next, err := m.matchOnce(p, pos)
+		if err != nil {
+			if count >= p.min {
+				break
+			}
+			return pos, err
+		}
+		if next == pos {
+			// An emptiable group matched nothing; more rounds would too
+			return pos, nil
+		}
+		pos = next
+		count++
+	}
+	return pos, nil
+}
+
+// matchOnce matches a single occurrence of a particle
+func (m *xsdMatcher) matchOnce(p *xsdParticle, pos int) (int, error) {
+	switch p.kind {
+	case "element":
+		if pos < len(m.children) && m.children[pos].name == p.element.name {
+			m.decls[pos] = p.element
+			return pos + 1, nil
+		}
+		return pos, m.expected(xmlNameString(p.element.name), pos)
+	case "any":
+		if pos < len(m.children) && p.allows(m.children[pos].name.Space) {
+			m.decls[pos] = nil
+			return pos + 1, nil
+		}
+		return pos, m.expected("an element", pos)
+	case "sequence":
+		for _, item := range p.items {
+			var err error
+			if pos, err = m.match(item, pos); err != nil {
+				return pos, err
+			}
+		}
+		return pos, nil
+	case "choice":
+		empty := false
+		var names []string
+		for _, item := range p.items {
+			next, err := m.match(item, pos)
+			if err == nil && next > pos {
+				return next, nil
+			}
+			empty = empty || err == nil
+			names = append(names, particleName(item))
+		}
+		if empty {
+			return pos, nil
+		}
+		return pos, m.expected("one of "+strings.Join(names, ", "), pos)
+	case "all":
+		used := make([]bool, len(p.items))
+	children:
+		for pos < len(m.children) {
+			for i, item := range p.items {
+				if !used[i] && m.children[pos].name == item.element.name {
+					used[i] = true
+					m.decls[pos] = item.element
+					pos++
+					continue children
+				}
+			}
+			break
+		}
+		for i, item := range p.items {
+			if !used[i] && item.min > 0 {
+				return pos, fmt.Errorf("element %s is missing", xmlNameString(item.element.name))
+			}
+		}
+		return pos, nil
+	}
+	return pos, fmt.Errorf("unsupported particle %s", p.kind)
+}
+
+// allows reports whether a wildcard matches an element namespace
+func (p *xsdParticle) allows(space string) bool {
+	if p.namespaces == nil {
+		return true
+	}
+	for _, ns := range p.namespaces {
+		if ns == space {
+			return !p.other
+		}
+	}
+	return p.other
+}
+
+// expected describes a content model mismatch at a position
+func (m *xsdMatcher) expected(what string, pos int) error {
+	if pos < len(m.children) {
+		return fmt.Errorf("expected %s, found %s", what, xmlNameString(m.children[pos].name))
+	}
+	return fmt.Errorf("expected %s", what)
+}
+
+// particleName names a particle for error messages
+func particleName(p *xsdParticle) string {
+	switch {
+	case p.kind == "element":
+		return xmlNameString(p.element.name)
+	case len(p.items) > 0:
+		return particleName(p.items[0])
+	}
+	return p.kind
+}
+
+// xsdFile holds a parsed schema file, reloaded when the file changes
+type xsdFile struct {
+	mutex   sync.Mutex
+	schema  *xsdSchema
+	modTime time.Time
+	checked time.Time
+}
+
+// xsdFiles caches parsed schema files by path
+var xsdFiles = struct {
+	sync.Mutex
+	files map[string]*xsdFile
+}{files: make(map[string]*xsdFile)}
+
+// loadXSD returns the schema in a file. A file that fails to load keeps
+// the schema last loaded from it, if any.
+func loadXSD(path string) (*xsdSchema, error) {
+	xsdFiles.Lock()
+	f, ok := xsdFiles.files[path]
+	if !ok {
+		f = &xsdFile{}
+		xsdFiles.files[path] = f
+	}
+	xsdFiles.Unlock()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.schema != nil && time.Since(f.checked) < xsdRecheckInterval {
+		return f.schema, nil
+	}
+	f.checked = time.Now()
+
+	info, err := os.Stat(path)
+	if err == nil && f.schema != nil && info.ModTime().Equal(f.modTime) {
+		return f.schema, nil
+	}
+	var schema *xsdSchema
+	if err == nil {
+		var data []byte
+		if data, err = ioutil.ReadFile(path); err == nil {
+			schema, err = parseXSD(data)
+		}
+	}
+	if err != nil {
+		if f.schema != nil {
+			log.Printf("Failed to reload XML schema %s, keeping the previous one: %v", path, err)
+			return f.schema, nil
+		}
+		return nil, err
+	}
+	f.schema = schema
+	f.modTime = info.ModTime()
+	return schema, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOrderSchema declares an order with a typed ID, a customer, one or
+// more lines and an optional note, in the urn:orders namespace
+const testOrderSchema = `<?xml version="1.0"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:o="urn:orders"
+    targetNamespace="urn:orders" elementFormDefault="qualified">
+  <xs:element name="order" type="o:Order"/>
+  <xs:complexType name="Order">
+    <xs:sequence>
+      <xs:element name="customer" type="o:Customer"/>
+      <xs:element name="line" type="o:Line" maxOccurs="unbounded"/>
+      <xs:element name="note" type="xs:string" minOccurs="0"/>
+    </xs:sequence>
+    <xs:attribute name="id" type="xs:positiveInteger" use="required"/>
+  </xs:complexType>
+  <xs:complexType name="Customer">
+    <xs:choice>
+      <xs:element name="email" type="o:Email"/>
+      <xs:element name="account" type="xs:int"/>
+    </xs:choice>
+  </xs:complexType>
+  <xs:complexType name="Line">
+    <xs:simpleContent>
+      <xs:extension base="o:Quantity">
+        <xs:attribute name="sku" type="xs:string" use="required"/>
+      </xs:extension>
+    </xs:simpleContent>
+  </xs:complexType>
+  <xs:simpleType name="Quantity">
+    <xs:restriction base="xs:int">
+      <xs:minInclusive value="1"/>
+      <xs:maxInclusive value="99"/>
+    </xs:restriction>
+  </xs:simpleType>
+  <xs:simpleType name="Email">
+    <xs:restriction base="xs:string">
+      <xs:pattern value="[^@]+@[^@]+"/>
+    </xs:restriction>
+  </xs:simpleType>
+</xs:schema>`
+
+// testOrder builds an order document with the given content
+func testOrder(attrs, content string) string {
+	return `<order xmlns="urn:orders"` + attrs + `>` + content + `</order>`
+}
+
+func TestXSDValidation(t *testing.T) {
+	schema, err := parseXSD([]byte(testOrderSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const customer = `<customer><email>a@example.com</email></customer>`
+
+	for name, tc := range map[string]struct {
+		doc   string
+		valid bool
+	}{
+		"valid":             {testOrder(` id="7"`, customer+`<line sku="A">2</line><line sku="B">1</line><note>gift</note>`), true},
+		"account customer":  {testOrder(` id="7"`, `<customer><account>12</account></customer><line sku="A">2</line>`), true},
+		"missing id":        {testOrder(``, customer+`<line sku="A">2</line>`), false},
+		"id not positive":   {testOrder(` id="0"`, customer+`<line sku="A">2</line>`), false},
+		"unknown attribute": {testOrder(` id="7" rush="yes"`, customer+`<line sku="A">2</line>`), false},
+		"no lines":          {testOrder(` id="7"`, customer), false},
+		"out of order":      {testOrder(` id="7"`, `<line sku="A">2</line>`+customer), false},
+		"quantity too high": {testOrder(` id="7"`, customer+`<line sku="A">100</line>`), false},
+		"line without sku":  {testOrder(` id="7"`, customer+`<line>2</line>`), false},
+		"bad email":         {testOrder(` id="7"`, `<customer><email>nobody</email></customer><line sku="A">2</line>`), false},
+		"both choices":      {testOrder(` id="7"`, `<customer><email>a@b</email><account>1</account></customer><line sku="A">2</line>`), false},
+		"wrong namespace":   {`<order xmlns="urn:other" id="7">` + customer + `</order>`, false},
+		"unexpected text":   {testOrder(` id="7"`, customer+`stray<line sku="A">2</line>`), false},
+	} {
+		root, err := parseXMLTree(strings.NewReader(tc.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := schema.validate(root); (err == nil) != tc.valid {
+			t.Errorf("%s: validate = %v, want valid %v", name, err, tc.valid)
+		}
+	}
+}
+
+func TestXSDValidationOfSOAPPayload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.xsd")
+	if err := ioutil.WriteFile(path, []byte(testOrderSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	startTestGateway(t, http.NotFoundHandler(), func(_ *Config, route *Route) {
+		route.XMLValidation = &XMLValidationConfig{SOAPEnvelope: true, Schema: path}
+	})
+
+	send := func(order string) *httptest.ResponseRecorder {
+		envelope := `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+			order + `</soap:Body></soap:Envelope>`
+		r := httptest.NewRequest("POST", "/svc/orders", bytes.NewReader([]byte(envelope)))
+		r.Header.Set("Content-Type", "text/xml")
+		return serveProxy(r)
+	}
+
+	// The upstream answers 404, so valid requests are those that reach it
+	valid := testOrder(` id="7"`, `<customer><account>1</account></customer><line sku="A">2</line>`)
+	if w := send(valid); w.Code != http.StatusNotFound {
+		t.Fatalf("valid payload: status %d, want it proxied: %s", w.Code, w.Body.String())
+	}
+
+	// SOAP 1.1 faults are sent with a 500 status
+	w := send(testOrder(` id="7"`, `<customer><account>1</account></customer>`))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "<faultcode>soap:Client</faultcode>") {
+		t.Fatalf("invalid payload: status %d, want a client fault: %s", w.Code, w.Body.String())
+	}
+}
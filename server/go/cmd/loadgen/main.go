@@ -0,0 +1,275 @@
+// Command loadgen drives load through a running gateway and reports
+// throughput, latency and gateway allocations. It starts a mock upstream,
+// registers a route to it through the admin API, sends requests at a fixed
+// rate and removes the route when done.
+//
+//	loadgen --gateway http://localhost:8000 --rps 500 --duration 1m
+//
+// Long soak runs print interim reports with --report-every.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// options are the command line settings
+type options struct {
+	gateway     string
+	admin       string
+	path        string
+	method      string
+	rps         int
+	duration    time.Duration
+	concurrency int
+	bodySize    int
+	reportEvery time.Duration
+	timeout     time.Duration
+
+	upstreamAddr    string
+	upstreamLatency time.Duration
+	upstreamSize    int
+	setupRoute      bool
+	rateLimit       int
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var opts options
+	flag.StringVar(&opts.gateway, "gateway", "http://localhost:8000", "gateway base URL")
+	flag.StringVar(&opts.admin, "admin", "", "admin API base URL (default <gateway>/api/v1)")
+	flag.StringVar(&opts.path, "path", "/loadgen", "route path to load")
+	flag.StringVar(&opts.method, "method", http.MethodGet, "request method")
+	flag.IntVar(&opts.rps, "rps", 200, "requests per second")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long to run")
+	flag.IntVar(&opts.concurrency, "concurrency", 64, "maximum requests in flight")
+	flag.IntVar(&opts.bodySize, "body-size", 0, "request body bytes")
+	flag.DurationVar(&opts.reportEvery, "report-every", 0, "print interim reports at this interval, for soak runs")
+	flag.DurationVar(&opts.timeout, "timeout", 30*time.Second, "per-request timeout")
+	flag.StringVar(&opts.upstreamAddr, "upstream", "127.0.0.1:18090", "mock upstream listen address")
+	flag.DurationVar(&opts.upstreamLatency, "upstream-latency", 0, "mock upstream response delay")
+	flag.IntVar(&opts.upstreamSize, "upstream-size", 1024, "mock upstream response bytes")
+	flag.BoolVar(&opts.setupRoute, "setup-route", true, "create the route through the admin API and delete it afterwards")
+	flag.IntVar(&opts.rateLimit, "rate-limit", 0, "requests per minute allowed on the created route (default twice the load)")
+	flag.Parse()
+
+	opts.gateway = strings.TrimRight(opts.gateway, "/")
+	if opts.admin == "" {
+		opts.admin = opts.gateway + "/api/v1"
+	}
+	if opts.rps <= 0 || opts.concurrency <= 0 || opts.duration <= 0 {
+		log.Fatal("rps, concurrency and duration must be positive")
+	}
+	if opts.rateLimit <= 0 {
+		opts.rateLimit = opts.rps * 120
+	}
+
+	if err := run(opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run starts the upstream, drives the load and prints the report
+func run(opts options) error {
+	listener, err := net.Listen("tcp", opts.upstreamAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start mock upstream: %v", err)
+	}
+	upstream := &http.Server{Handler: mockUpstream(opts.upstreamLatency, opts.upstreamSize)}
+	go upstream.Serve(listener)
+	defer upstream.Close()
+
+	if opts.setupRoute {
+		id, err := createRoute(opts, "http://"+listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer deleteRoute(opts, id)
+	}
+
+	before, err := fetchRuntime(opts.admin)
+	if err != nil {
+		log.Printf("Gateway runtime counters unavailable, allocations are not reported: %v", err)
+	}
+
+	stats := newRecorder()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drive(opts, stats, stop)
+
+	report := stats.report()
+	if before != nil {
+		if after, err := fetchRuntime(opts.admin); err == nil {
+			report.addRuntime(before, after)
+		}
+	}
+	report.print(os.Stdout, "Total")
+	return nil
+}
+
+// drive sends requests at the configured rate until the duration passes or
+// the run is interrupted. Requests that would exceed the concurrency limit
+// are counted as dropped rather than queued, so the rate stays open-loop.
+func drive(opts options, stats *recorder, stop <-chan os.Signal) {
+	client := &http.Client{
+		Timeout: opts.timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        opts.concurrency,
+			MaxIdleConnsPerHost: opts.concurrency,
+		},
+	}
+	body := bytes.Repeat([]byte("x"), opts.bodySize)
+	url := opts.gateway + opts.path
+
+	slots := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+
+	interval := time.Second / time.Duration(opts.rps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.After(opts.duration)
+
+	var interim <-chan time.Time
+	if opts.reportEvery > 0 {
+		t := time.NewTicker(opts.reportEvery)
+		defer t.Stop()
+		interim = t.C
+	}
+
+	log.Printf("Sending %d req/s to %s %s for %s", opts.rps, opts.method, url, opts.duration)
+	for {
+		select {
+		case <-deadline:
+			wg.Wait()
+			return
+		case <-stop:
+			log.Printf("Interrupted, waiting for requests in flight")
+			wg.Wait()
+			return
+		case <-interim:
+			stats.report().print(os.Stdout, "Interim")
+		case <-ticker.C:
+			select {
+			case slots <- struct{}{}:
+			default:
+				stats.drop()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { <-slots; wg.Done() }()
+				send(client, opts.method, url, body, stats)
+			}()
+		}
+	}
+}
+
+// send issues one request and records its outcome
+func send(client *http.Client, method, url string, body []byte, stats *recorder) {
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		stats.fail()
+		return
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		stats.fail()
+		return
+	}
+	n, _ := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	stats.record(resp.StatusCode, time.Since(start), n)
+}
+
+// createRoute registers a route to the mock upstream and returns its ID
+func createRoute(opts options, target string) (int, error) {
+	route := map[string]interface{}{
+		"path":      opts.path,
+		"target":    target,
+		"methods":   []string{opts.method},
+		"rateLimit": opts.rateLimit,
+		"active":    true,
+	}
+	data, _ := json.Marshal(route)
+
+	resp, err := http.Post(opts.admin+"/routes", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create route: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return 0, fmt.Errorf("failed to create route: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var created struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return 0, fmt.Errorf("failed to read created route: %v", err)
+	}
+	log.Printf("Created route %d: %s -> %s", created.ID, opts.path, target)
+	return created.ID, nil
+}
+
+// deleteRoute removes the route created for the run
+func deleteRoute(opts options, id int) {
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/routes/%d", opts.admin, id), nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Failed to delete route %d: %v", id, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// fetchRuntime reads the gateway's memory counters
+func fetchRuntime(admin string) (*runtimeCounters, error) {
+	resp, err := http.Get(admin + "/debug/runtime")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	var c runtimeCounters
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// mockUpstream answers every request with size bytes after latency
+func mockUpstream(latency time.Duration, size int) http.Handler {
+	payload := bytes.Repeat([]byte("x"), size)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(payload)
+	})
+}
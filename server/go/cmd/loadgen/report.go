@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recorder collects request outcomes from concurrent senders
+type recorder struct {
+	mutex     sync.Mutex
+	start     time.Time
+	latencies []time.Duration
+	statuses  map[int]int
+	failures  int
+	dropped   int
+	bytes     int64
+}
+
+// newRecorder starts a recording
+func newRecorder() *recorder {
+	return &recorder{start: time.Now(), statuses: make(map[int]int)}
+}
+
+// record adds a completed request
+func (r *recorder) record(status int, latency time.Duration, n int64) {
+	r.mutex.Lock()
+	r.latencies = append(r.latencies, latency)
+	r.statuses[status]++
+	r.bytes += n
+	r.mutex.Unlock()
+}
+
+// fail counts a request that got no response
+func (r *recorder) fail() {
+	r.mutex.Lock()
+	r.failures++
+	r.mutex.Unlock()
+}
+
+// drop counts a request skipped because the concurrency limit was reached
+func (r *recorder) drop() {
+	r.mutex.Lock()
+	r.dropped++
+	r.mutex.Unlock()
+}
+
+// runtimeCounters are the gateway's /debug/runtime counters
+type runtimeCounters struct {
+	Goroutines int    `json:"goroutines"`
+	Mallocs    uint64 `json:"mallocs"`
+	TotalAlloc uint64 `json:"totalAlloc"`
+	HeapAlloc  uint64 `json:"heapAlloc"`
+	NumGC      uint32 `json:"numGC"`
+}
+
+// report summarizes a recording
+type report struct {
+	elapsed   time.Duration
+	completed int
+	statuses  map[int]int
+	failures  int
+	dropped   int
+	bytes     int64
+	p50, p90  time.Duration
+	p99, max  time.Duration
+	mean      time.Duration
+
+	// Gateway counters; hasRuntime is false when they were unavailable
+	hasRuntime     bool
+	allocsPerReq   float64
+	bytesPerReq    float64
+	gcRuns         uint32
+	heapAlloc      uint64
+	goroutines     int
+	goroutineDelta int
+}
+
+// report summarizes what has been recorded so far
+func (r *recorder) report() *report {
+	r.mutex.Lock()
+	latencies := append([]time.Duration(nil), r.latencies...)
+	statuses := make(map[int]int, len(r.statuses))
+	for status, n := range r.statuses {
+		statuses[status] = n
+	}
+	rep := &report{
+		elapsed:   time.Since(r.start),
+		completed: len(latencies),
+		statuses:  statuses,
+		failures:  r.failures,
+		dropped:   r.dropped,
+		bytes:     r.bytes,
+	}
+	r.mutex.Unlock()
+
+	if len(latencies) == 0 {
+		return rep
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	rep.mean = total / time.Duration(len(latencies))
+	rep.p50 = percentile(latencies, 50)
+	rep.p90 = percentile(latencies, 90)
+	rep.p99 = percentile(latencies, 99)
+	rep.max = latencies[len(latencies)-1]
+	return rep
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return sorted[i]
+}
+
+// addRuntime adds the gateway's allocation figures for the run
+func (rep *report) addRuntime(before, after *runtimeCounters) {
+	if rep.completed == 0 {
+		return
+	}
+	n := float64(rep.completed)
+	rep.hasRuntime = true
+	rep.allocsPerReq = float64(after.Mallocs-before.Mallocs) / n
+	rep.bytesPerReq = float64(after.TotalAlloc-before.TotalAlloc) / n
+	rep.gcRuns = after.NumGC - before.NumGC
+	rep.heapAlloc = after.HeapAlloc
+	rep.goroutines = after.Goroutines
+	rep.goroutineDelta = after.Goroutines - before.Goroutines
+}
+
+// print writes the report
+func (rep *report) print(w io.Writer, title string) {
+	seconds := rep.elapsed.Seconds()
+	fmt.Fprintf(w, "%s after %s\n", title, rep.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "  requests:   %d completed, %d failed, %d dropped\n", rep.completed, rep.failures, rep.dropped)
+	fmt.Fprintf(w, "  throughput: %.1f req/s, %.1f KiB/s\n", float64(rep.completed)/seconds, float64(rep.bytes)/1024/seconds)
+	if rep.completed > 0 {
+		fmt.Fprintf(w, "  latency:    mean %s  p50 %s  p90 %s  p99 %s  max %s\n",
+			rep.mean.Round(time.Microsecond), rep.p50.Round(time.Microsecond), rep.p90.Round(time.Microsecond),
+			rep.p99.Round(time.Microsecond), rep.max.Round(time.Microsecond))
+	}
+
+	codes := make([]int, 0, len(rep.statuses))
+	for status := range rep.statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	for _, status := range codes {
+		fmt.Fprintf(w, "  status %d:  %d\n", status, rep.statuses[status])
+	}
+
+	if rep.hasRuntime {
+		fmt.Fprintf(w, "  gateway:    %.1f allocs/req, %.0f B/req, %d GC runs, heap %.1f MiB, %d goroutines (%+d)\n",
+			rep.allocsPerReq, rep.bytesPerReq, rep.gcRuns, float64(rep.heapAlloc)/(1<<20), rep.goroutines, rep.goroutineDelta)
+	}
+}
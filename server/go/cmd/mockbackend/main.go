@@ -0,0 +1,38 @@
+// Command mockbackend is an upstream for exercising the gateway end to end.
+// It serves the mock endpoints of package mockbackend on a fixed address.
+//
+//	mockbackend --addr :9000 --latency 50ms --jitter 20ms --error-rate 0.1
+//
+// Query parameters override the flags per request, for example
+// /anything?latency=2s, /anything?status=503 or /stream?events=10&interval=500ms.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/adevstack/ApiGateway/server/go/pkg/mockbackend"
+)
+
+func main() {
+	var (
+		addr string
+		opts mockbackend.Options
+	)
+	flag.StringVar(&addr, "addr", ":9000", "listen address")
+	flag.DurationVar(&opts.Latency, "latency", 0, "delay before responding")
+	flag.DurationVar(&opts.Jitter, "jitter", 0, "random extra delay, up to this much")
+	flag.Float64Var(&opts.ErrorRate, "error-rate", 0, "fraction of requests answered with --error-status")
+	flag.IntVar(&opts.ErrorStatus, "error-status", http.StatusInternalServerError, "status of failed requests")
+	flag.Float64Var(&opts.DropRate, "drop-rate", 0, "fraction of connections closed without a response")
+	flag.IntVar(&opts.Size, "size", 0, "pad response bodies to at least this many bytes")
+	flag.Parse()
+
+	if err := opts.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock backend listening on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mockbackend.New(opts)))
+}
@@ -0,0 +1,272 @@
+// Command replay re-sends requests recorded by the gateway against another
+// gateway, typically staging, at their original pacing or faster.
+//
+//	replay --file recording.jsonl --target http://staging:8000 --speed 2
+//
+// A speed of 0 sends requests as fast as --concurrency allows.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recordedRequest mirrors a line of a gateway recording
+type recordedRequest struct {
+	Time         time.Time   `json:"time"`
+	RouteID      int         `json:"routeId"`
+	Method       string      `json:"method"`
+	Host         string      `json:"host"`
+	URI          string      `json:"uri"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"bodyEncoding"`
+}
+
+// headerFlags collects repeated --header name:value flags
+type headerFlags http.Header
+
+// String lists the headers
+func (h headerFlags) String() string {
+	return fmt.Sprint(http.Header(h))
+}
+
+// Set adds a name:value header
+func (h headerFlags) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be name:value")
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+func main() {
+	log.SetFlags(0)
+
+	var (
+		file        string
+		target      string
+		speed       float64
+		concurrency int
+		keepHost    bool
+		timeout     time.Duration
+	)
+	headers := headerFlags{}
+	flag.StringVar(&file, "file", "", "recording to replay")
+	flag.StringVar(&target, "target", "http://localhost:8000", "gateway to send requests to")
+	flag.Float64Var(&speed, "speed", 1, "pacing relative to the recording; 0 sends as fast as possible")
+	flag.IntVar(&concurrency, "concurrency", 32, "maximum requests in flight")
+	flag.BoolVar(&keepHost, "keep-host", false, "send the recorded Host header")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "per-request timeout")
+	flag.Var(headers, "header", "extra name:value header for every request (repeatable)")
+	flag.Parse()
+
+	if file == "" {
+		log.Fatal("--file is required")
+	}
+	if speed < 0 || concurrency <= 0 {
+		log.Fatal("speed must not be negative and concurrency must be positive")
+	}
+	// The target gateway does not record replayed requests
+	headers.Set("X-Replayed:true")
+
+	requests, err := readRecording(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(requests) == 0 {
+		log.Fatalf("%s holds no requests", file)
+	}
+
+	log.Printf("Replaying %d requests from %s against %s", len(requests), file, target)
+	res := replay(requests, replayOptions{
+		target:      strings.TrimRight(target, "/"),
+		speed:       speed,
+		concurrency: concurrency,
+		keepHost:    keepHost,
+		headers:     http.Header(headers),
+		client:      &http.Client{Timeout: timeout},
+	})
+	res.print(os.Stdout)
+}
+
+// readRecording loads a recording, skipping lines it cannot parse
+func readRecording(path string) ([]recordedRequest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []recordedRequest
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var req recordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			log.Printf("Skipping line %d: %v", line, err)
+			continue
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Time.Before(requests[j].Time) })
+	return requests, nil
+}
+
+// replayOptions control how requests are re-sent
+type replayOptions struct {
+	target      string
+	speed       float64
+	concurrency int
+	keepHost    bool
+	headers     http.Header
+	client      *http.Client
+}
+
+// results summarize a replay
+type results struct {
+	mutex     sync.Mutex
+	elapsed   time.Duration
+	statuses  map[int]int
+	failures  map[string]int
+	latencies []time.Duration
+}
+
+// replay sends every request, waiting to match the recorded pacing
+func replay(requests []recordedRequest, opts replayOptions) *results {
+	res := &results{statuses: make(map[int]int), failures: make(map[string]int)}
+	slots := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	first := requests[0].Time
+	for _, rec := range requests {
+		if opts.speed > 0 {
+			due := time.Duration(float64(rec.Time.Sub(first)) / opts.speed)
+			if wait := due - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(rec recordedRequest) {
+			defer func() { <-slots; wg.Done() }()
+			res.add(send(rec, opts))
+		}(rec)
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res
+}
+
+// outcome is the result of one replayed request
+type outcome struct {
+	status  int
+	latency time.Duration
+	err     error
+}
+
+// send re-sends one recorded request
+func send(rec recordedRequest, opts replayOptions) outcome {
+	body := []byte(rec.Body)
+	if rec.BodyEncoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(rec.Body)
+		if err != nil {
+			return outcome{err: fmt.Errorf("invalid body: %v", err)}
+		}
+		body = decoded
+	}
+
+	var reader io.Reader
+	if len(body) > 0 {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(rec.Method, opts.target+rec.URI, reader)
+	if err != nil {
+		return outcome{err: err}
+	}
+	for name, values := range rec.Header {
+		// The client sets these for the body actually sent, and the
+		// target gateway assigns its own request IDs
+		if name == "Content-Length" || name == "Transfer-Encoding" || name == "X-Request-Id" {
+			continue
+		}
+		req.Header[name] = values
+	}
+	for name, values := range opts.headers {
+		req.Header[name] = values
+	}
+	if opts.keepHost && rec.Host != "" {
+		req.Host = rec.Host
+	}
+
+	start := time.Now()
+	resp, err := opts.client.Do(req)
+	if err != nil {
+		return outcome{err: err}
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return outcome{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// add records an outcome
+func (r *results) add(o outcome) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if o.err != nil {
+		msg := o.err.Error()
+		if i := strings.LastIndex(msg, ": "); i >= 0 {
+			msg = msg[i+2:]
+		}
+		r.failures[msg]++
+		return
+	}
+	r.statuses[o.status]++
+	r.latencies = append(r.latencies, o.latency)
+}
+
+// print writes the summary
+func (r *results) print(w io.Writer) {
+	fmt.Fprintf(w, "Replayed in %s\n", r.elapsed.Round(time.Millisecond))
+
+	codes := make([]int, 0, len(r.statuses))
+	for status := range r.statuses {
+		codes = append(codes, status)
+	}
+	sort.Ints(codes)
+	for _, status := range codes {
+		fmt.Fprintf(w, "  status %d: %d\n", status, r.statuses[status])
+	}
+	for msg, n := range r.failures {
+		fmt.Fprintf(w, "  failed (%s): %d\n", msg, n)
+	}
+
+	if n := len(r.latencies); n > 0 {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		fmt.Fprintf(w, "  latency: p50 %s  p99 %s  max %s\n",
+			r.latencies[n/2].Round(time.Microsecond),
+			r.latencies[(n*99)/100].Round(time.Microsecond),
+			r.latencies[n-1].Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// Declaration is the state the gateway should be in. Sections left nil
+// are not managed: their routes, credentials or config stay as they are.
+// An empty, non-nil section with Prune deletes all of its kind.
+type Declaration struct {
+	Config      Config               `json:"config,omitempty"` // the settings as for UpdateConfig
+	Routes      []Route              `json:"routes"`           // matched to running routes by path and methods
+	Credentials []DeclaredCredential `json:"credentials"`      // matched to stored credentials by name
+	Prune       bool                 `json:"prune,omitempty"`  // delete undeclared routes and credentials of managed sections
+}
+
+// DeclaredCredential declares a credential, granting routes by path
+type DeclaredCredential struct {
+	Name         string                `json:"name"`
+	Route        string                `json:"route,omitempty"` // path of a route granted in full
+	Entitlements []DeclaredEntitlement `json:"entitlements,omitempty"`
+	Enabled      *bool                 `json:"enabled,omitempty"` // defaults to true
+}
+
+// DeclaredEntitlement grants a route, by path or tag, with scopes
+type DeclaredEntitlement struct {
+	Route  string   `json:"route,omitempty"`
+	Tag    string   `json:"tag,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Change is one change of a plan
+type Change struct {
+	Action      string       `json:"action"`   // create, update or delete
+	Resource    string       `json:"resource"` // route, credential or config
+	Key         string       `json:"key,omitempty"`
+	ID          int          `json:"id,omitempty"`
+	Differences []Difference `json:"differences,omitempty"`
+	Credential  *Credential  `json:"credential,omitempty"` // a created credential, with its secret, once applied
+	Route       *Route       `json:"route,omitempty"`      // a created route, once applied
+}
+
+// Difference is a setting a change makes; nil means absent on that side
+type Difference struct {
+	Path    string      `json:"path"`
+	Current interface{} `json:"current"`
+	Desired interface{} `json:"desired"`
+}
+
+// Plan is the changes that bring the gateway to a declared state
+type Plan struct {
+	Applied bool     `json:"applied"`
+	Changes []Change `json:"changes"` // empty when the gateway already matches
+}
+
+// Plan returns the changes Apply would make, without making them
+func (c *Client) Plan(ctx context.Context, decl Declaration) (Plan, error) {
+	return c.apply(ctx, decl, true)
+}
+
+// Apply brings the gateway to the declared state, all or nothing, and
+// returns the changes made. Applying the same declaration again changes
+// nothing.
+func (c *Client) Apply(ctx context.Context, decl Declaration) (Plan, error) {
+	return c.apply(ctx, decl, false)
+}
+
+func (c *Client) apply(ctx context.Context, decl Declaration, dryRun bool) (Plan, error) {
+	body := struct {
+		Declaration
+		DryRun bool `json:"dryRun,omitempty"`
+	}{decl, dryRun}
+	var plan Plan
+	err := c.do(ctx, http.MethodPost, "/apply", body, &plan)
+	return plan, err
+}
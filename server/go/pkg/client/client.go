@@ -0,0 +1,267 @@
+// Package client is a Go client for the gateway's admin API. It covers
+// routes, credentials, configuration and stats with typed methods, and
+// handles admin authentication, error envelopes and retries, so tooling
+// and automation need not hand-roll HTTP calls.
+//
+//	c := client.New("http://localhost:8080", client.WithBasicAuth("admin", "secret"))
+//	routes, err := c.ListRoutes(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client defaults
+const (
+	defaultPrefix     = "/api"
+	defaultAPIVersion = "v1"
+	defaultRetries    = 3
+	defaultBackoff    = 200 * time.Millisecond
+	maxBackoff        = 5 * time.Second
+)
+
+// Client calls a gateway's admin API. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	prefix     string
+	httpClient *http.Client
+	username   string
+	password   string
+	retries    int
+	backoff    time.Duration
+	userAgent  string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBasicAuth sends the admin credentials, admin.username and
+// admin.password in the gateway config, with every request
+func WithBasicAuth(username, password string) Option {
+	return func(c *Client) { c.username, c.password = username, password }
+}
+
+// WithPrefix sets the path the admin API is mounted at, admin.prefix in
+// the gateway config. The default is /api.
+func WithPrefix(prefix string) Option {
+	return func(c *Client) { c.prefix = "/" + strings.Trim(prefix, "/") }
+}
+
+// WithHTTPClient sets the HTTP client requests are sent with, for custom
+// timeouts or TLS settings
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a failed request is retried and the
+// delay before the first retry, which doubles on each further retry. Only
+// requests that are safe to repeat are retried: reads, updates and
+// deletes, not creates.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// WithUserAgent sets the User-Agent header, so the gateway's logs show
+// which tool made a change
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.userAgent = userAgent }
+}
+
+// New returns a client for the gateway at baseURL, such as
+// http://localhost:8080 or the admin port when admin.port is set
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		prefix:     defaultPrefix,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+		userAgent:  "gateway-client",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Violation is one problem found validating a route, credential or config
+type Violation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an error response from the gateway
+type Error struct {
+	StatusCode int         `json:"-"`
+	Code       string      `json:"code"` // machine-readable, such as not_found or validation_failed
+	Message    string      `json:"message"`
+	RequestID  string      `json:"requestId,omitempty"`
+	Violations []Violation `json:"-"` // set for validation_failed
+}
+
+// Error describes the failure and its violations
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("gateway: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	for _, v := range e.Violations {
+		msg += fmt.Sprintf("; %s: %s", v.Field, v.Message)
+	}
+	return msg
+}
+
+// IsNotFound reports whether err is a 404 from the gateway
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// IsValidation reports whether err is a validation failure, with the
+// violations in its Violations
+func IsValidation(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == "validation_failed"
+}
+
+// do sends a request to the versioned admin API and decodes the JSON
+// response into out, when not nil. Retryable failures are retried with
+// exponential backoff, honouring Retry-After.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("gateway: encoding request: %w", err)
+		}
+	}
+	url := c.baseURL + c.prefix + "/" + defaultAPIVersion + path
+
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, url, body)
+		retry := err != nil
+		if err == nil {
+			if err = c.decode(resp, out); err == nil {
+				return nil
+			}
+			retry = retryableStatus(resp.StatusCode)
+			if wait := retryAfter(resp); wait > backoff {
+				backoff = wait
+			}
+		}
+		if !retry || method == http.MethodPost || attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// newRequest builds an admin API request with the client's headers and
+// credentials
+func (c *Client) newRequest(ctx context.Context, method, url string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("gateway: %w", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return req, nil
+}
+
+// send makes one attempt at a request
+func (c *Client) send(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gateway: %w", err)
+	}
+	return resp, nil
+}
+
+// decode reads a response, returning an *Error for error statuses
+func (c *Client) decode(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("gateway: reading response: %w", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		e := &Error{StatusCode: resp.StatusCode}
+		var envelope struct {
+			Error
+			Details json.RawMessage `json:"details"`
+		}
+		if json.Unmarshal(data, &envelope) == nil && envelope.Code != "" {
+			e.Code, e.Message, e.RequestID = envelope.Code, envelope.Message, envelope.RequestID
+			json.Unmarshal(envelope.Details, &e.Violations)
+		} else {
+			e.Code = strings.ToLower(strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "_"))
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return e
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("gateway: decoding response: %w", err)
+	}
+	return nil
+}
+
+// retryableStatus reports whether a status is worth retrying: rate
+// limiting and an unavailable or overloaded gateway
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter returns the delay a Retry-After header asks for, in seconds
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	if d := time.Duration(seconds) * time.Second; d < maxBackoff {
+		return d
+	}
+	return maxBackoff
+}
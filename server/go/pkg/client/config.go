@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Config is the gateway configuration without its routes, by top-level
+// JSON name, such as "defaultTimeout" or "alerts". Sections can be edited
+// in place and written back with UpdateConfig.
+type Config map[string]json.RawMessage
+
+// Get decodes a top-level setting into v, reporting whether it was set
+func (c Config) Get(name string, v interface{}) (bool, error) {
+	data, ok := c[name]
+	if !ok {
+		return false, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return true, decoder.Decode(v)
+}
+
+// Set encodes v as a top-level setting
+func (c Config) Set(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c[name] = data
+	return nil
+}
+
+// GetConfig returns the running configuration
+func (c *Client) GetConfig(ctx context.Context) (Config, error) {
+	var cfg Config
+	err := c.do(ctx, http.MethodGet, "/config", nil, &cfg)
+	return cfg, err
+}
+
+// UpdateConfig replaces the configuration and returns the one applied.
+// Routes are kept, and flags and environment overrides still take
+// precedence. Settings left out return to their defaults, so start from
+// GetConfig.
+func (c *Client) UpdateConfig(ctx context.Context, cfg Config) (Config, error) {
+	var applied Config
+	err := c.do(ctx, http.MethodPut, "/config", cfg, &applied)
+	return applied, err
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Credential is an API key and secret for routes that require
+// authentication
+type Credential struct {
+	ID           int           `json:"id"`
+	RouteID      int           `json:"routeId,omitempty"` // grants this route in full
+	Name         string        `json:"name"`
+	APIKey       string        `json:"apiKey"`
+	APISecret    string        `json:"apiSecret,omitempty"` // only returned by CreateCredential
+	Created      time.Time     `json:"created"`
+	LastUsed     *time.Time    `json:"lastUsed,omitempty"`
+	Enabled      bool          `json:"enabled"`
+	Entitlements []Entitlement `json:"entitlements,omitempty"`
+}
+
+// Entitlement grants a credential a route, by ID or tag, with scopes
+type Entitlement struct {
+	RouteID int      `json:"routeId,omitempty"`
+	Tag     string   `json:"tag,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"` // read and/or write; empty grants both
+}
+
+// ListCredentials returns the credentials, without their secrets
+func (c *Client) ListCredentials(ctx context.Context) ([]Credential, error) {
+	var creds []Credential
+	err := c.do(ctx, http.MethodGet, "/credentials", nil, &creds)
+	return creds, err
+}
+
+// ListRouteCredentials returns the credentials entitled to a route
+func (c *Client) ListRouteCredentials(ctx context.Context, routeID int) ([]Credential, error) {
+	var creds []Credential
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/credentials?routeId=%d", routeID), nil, &creds)
+	return creds, err
+}
+
+// CreateCredential creates a credential from its name and grants. The
+// gateway generates the key and secret; the returned credential is the
+// only time the secret is available.
+func (c *Client) CreateCredential(ctx context.Context, cred Credential) (Credential, error) {
+	var created Credential
+	err := c.do(ctx, http.MethodPost, "/credentials", cred, &created)
+	return created, err
+}
+
+// DeleteCredential revokes a credential
+func (c *Client) DeleteCredential(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/credentials/%d", id), nil, nil)
+}
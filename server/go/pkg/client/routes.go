@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Route is a gateway route. The common settings are typed; the rest, such
+// as timeouts, fallbacks or CORS options, are kept in Extra by their JSON
+// name, so reading a route and writing it back never drops settings this
+// package doesn't model.
+type Route struct {
+	ID           int       `json:"id"`
+	Path         string    `json:"path"`
+	Target       string    `json:"target"`
+	Methods      []string  `json:"methods"`
+	RateLimit    RateLimit `json:"rateLimit,omitempty"`
+	Timeout      int       `json:"timeout"` // seconds
+	AuthRequired bool      `json:"authRequired"`
+	Active       bool      `json:"active"`
+	Owner        string    `json:"owner,omitempty"`
+	Team         string    `json:"team,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// RateLimit is a route's rate limit: a number of requests per minute or a
+// string such as "10/s" or "100/min burst 50", as in the gateway config
+type RateLimit = json.RawMessage
+
+// PerMinute returns a limit of n requests per minute
+func PerMinute(n int) RateLimit {
+	return RateLimit(fmt.Sprint(n))
+}
+
+// Limit returns a limit written as a string, such as "10/s"
+func Limit(spec string) RateLimit {
+	data, _ := json.Marshal(spec)
+	return data
+}
+
+// routeFields are the JSON names of the typed Route fields
+var routeFields = []string{"id", "path", "target", "methods", "rateLimit", "timeout", "authRequired", "active", "owner", "team", "tags"}
+
+// routeJSON has Route's typed fields without its methods
+type routeJSON Route
+
+// UnmarshalJSON decodes the typed fields and keeps the others in Extra
+func (r *Route) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*routeJSON)(r)); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, name := range routeFields {
+		delete(all, name)
+	}
+	r.Extra = nil
+	if len(all) > 0 {
+		r.Extra = all
+	}
+	return nil
+}
+
+// MarshalJSON encodes the typed fields over the Extra ones
+func (r Route) MarshalJSON() ([]byte, error) {
+	typed, err := json.Marshal(routeJSON(r))
+	if err != nil || len(r.Extra) == 0 {
+		return typed, err
+	}
+	all := make(map[string]json.RawMessage, len(r.Extra)+len(routeFields))
+	for name, value := range r.Extra {
+		all[name] = value
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(typed, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		all[name] = value
+	}
+	return json.Marshal(all)
+}
+
+// RouteFilter narrows ListRoutes to the routes of an owner or team
+type RouteFilter struct {
+	Owner string
+	Team  string
+}
+
+// ListRoutes returns the gateway's routes, filtered when filter is set
+func (c *Client) ListRoutes(ctx context.Context, filter ...RouteFilter) ([]Route, error) {
+	path := "/routes"
+	if len(filter) > 0 {
+		query := url.Values{}
+		if filter[0].Owner != "" {
+			query.Set("owner", filter[0].Owner)
+		}
+		if filter[0].Team != "" {
+			query.Set("team", filter[0].Team)
+		}
+		if len(query) > 0 {
+			path += "?" + query.Encode()
+		}
+	}
+	var routes []Route
+	err := c.do(ctx, http.MethodGet, path, nil, &routes)
+	return routes, err
+}
+
+// GetRoute returns a route by ID. A missing route is an error for which
+// IsNotFound reports true.
+func (c *Client) GetRoute(ctx context.Context, id int) (Route, error) {
+	var route Route
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/routes/%d", id), nil, &route)
+	return route, err
+}
+
+// CreateRoute adds a route and returns it with the ID the gateway gave it.
+// Creates are not retried, so a failure never leaves duplicates behind.
+func (c *Client) CreateRoute(ctx context.Context, route Route) (Route, error) {
+	var created Route
+	err := c.do(ctx, http.MethodPost, "/routes", route, &created)
+	return created, err
+}
+
+// UpdateRoute replaces the route with route.ID
+func (c *Client) UpdateRoute(ctx context.Context, route Route) (Route, error) {
+	var updated Route
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/routes/%d", route.ID), route, &updated)
+	return updated, err
+}
+
+// DeleteRoute removes a route
+func (c *Client) DeleteRoute(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/routes/%d", id), nil, nil)
+}
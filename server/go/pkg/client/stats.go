@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// LatencyHistogram counts requests by latency
+type LatencyHistogram struct {
+	Bounds []float64 `json:"bounds"` // bucket upper bounds in milliseconds
+	Counts []int64   `json:"counts"` // requests per bucket; the last counts those over the highest bound
+	Count  int64     `json:"count"`
+	Sum    float64   `json:"sum"` // seconds
+}
+
+// RouteStat are one route's request counts
+type RouteStat struct {
+	Requests       int64            `json:"requests"`
+	Errors         int64            `json:"errors"`         // 5xx responses from any source
+	ClientErrors   int64            `json:"clientErrors"`   // 4xx responses
+	UpstreamErrors int64            `json:"upstreamErrors"` // 5xx returned by the upstream
+	GatewayErrors  int64            `json:"gatewayErrors"`  // 5xx produced by the gateway itself
+	AvgLatency     float64          `json:"avgLatency"`     // seconds
+	Latency        LatencyHistogram `json:"latency"`
+	Owner          string           `json:"owner,omitempty"`
+	Team           string           `json:"team,omitempty"`
+}
+
+// Stats are the gateway's headline stats since startup or the last reset
+type Stats struct {
+	TotalRequests     int64                `json:"totalRequests"`
+	TotalErrors       int64                `json:"totalErrors"`
+	RequestsPerSecond float64              `json:"requestsPerSecond"`
+	AvgResponseTime   float64              `json:"avgResponseTime"` // seconds
+	ErrorRate         float64              `json:"errorRate"`
+	ActiveConnections int                  `json:"activeConnections"`
+	Uptime            int64                `json:"uptime"` // seconds
+	Latency           LatencyHistogram     `json:"latency"`
+	RouteStats        map[string]RouteStat `json:"routeStats"` // by route path
+	ErrorTypes        map[string]int64     `json:"errorTypes"`
+	Since             time.Time            `json:"since"`
+}
+
+// WindowStats are the headline stats over a time range
+type WindowStats struct {
+	Since             time.Time            `json:"since"`
+	Until             time.Time            `json:"until"`
+	TotalRequests     int64                `json:"totalRequests"`
+	TotalErrors       int64                `json:"totalErrors"`
+	RequestsPerSecond float64              `json:"requestsPerSecond"`
+	AvgResponseTime   float64              `json:"avgResponseTime"` // seconds
+	ErrorRate         float64              `json:"errorRate"`
+	Latency           LatencyHistogram     `json:"latency"`
+	RouteStats        map[string]RouteStat `json:"routeStats"` // by route path
+	ErrorTypes        map[string]int64     `json:"errorTypes"`
+}
+
+// Stats returns the lifetime stats
+func (c *Client) Stats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.do(ctx, http.MethodGet, "/stats", nil, &stats)
+	return stats, err
+}
+
+// WindowStats returns the stats of the last window, such as 5m, to the
+// minute
+func (c *Client) WindowStats(ctx context.Context, window time.Duration) (WindowStats, error) {
+	var stats WindowStats
+	err := c.do(ctx, http.MethodGet, "/stats?window="+url.QueryEscape(window.String()), nil, &stats)
+	return stats, err
+}
+
+// ResetStats zeroes the lifetime stats and returns them. Windowed stats and
+// the stats history are kept.
+func (c *Client) ResetStats(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.do(ctx, http.MethodPost, "/stats/reset", nil, &stats)
+	return stats, err
+}
+
+// ScalingMetrics are a replica's load, as autoscalers see it
+type ScalingMetrics struct {
+	RequestsPerSecond   float64 `json:"requestsPerSecond"`   // over the last 10 seconds
+	RequestsPerSecond1m float64 `json:"requestsPerSecond1m"` // over the last minute
+	InFlight            int     `json:"inFlight"`
+	ActiveConnections   int     `json:"activeConnections"`
+	Saturation          float64 `json:"saturation"` // load over capacity; 1 is fully loaded
+	SaturatedBy         string  `json:"saturatedBy,omitempty"`
+}
+
+// Scaling returns the load of the replica that answers
+func (c *Client) Scaling(ctx context.Context) (ScalingMetrics, error) {
+	var metrics ScalingMetrics
+	err := c.do(ctx, http.MethodGet, "/scaling", nil, &metrics)
+	return metrics, err
+}
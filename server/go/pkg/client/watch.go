@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Watch topics
+const (
+	WatchRoutes = "routes"
+	WatchConfig = "config"
+	WatchStats  = "stats"
+)
+
+// Watch event types
+const (
+	EventRoutes       = "routes"        // every route, as []Route, when the stream opens
+	EventRouteCreated = "route.created" // a Route
+	EventRouteUpdated = "route.updated" // a Route
+	EventRouteDeleted = "route.deleted" // {"id": n}
+	EventConfig       = "config"        // the Config without routes, when the stream opens and on each change
+	EventStats        = "stats"         // the Stats, when the stream opens and every interval
+	EventResync       = "resync"        // the watcher fell behind and the stream ends
+)
+
+// ErrWatchClosed is returned by Watch when the gateway ends the stream, as
+// on shutdown or after a resync event. Watch again for a fresh snapshot.
+var ErrWatchClosed = errors.New("gateway: watch stream closed")
+
+// WatchEvent is one event of a watch stream
+type WatchEvent struct {
+	ID   uint64 // orders route and config changes; 0 for snapshots and stats
+	Type string
+	Data json.RawMessage
+}
+
+// Decode unmarshals the event's data, such as a Route for route.created
+func (e WatchEvent) Decode(v interface{}) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// WatchOptions selects what a watch stream carries
+type WatchOptions struct {
+	Topics        []string      // routes, config and stats by default
+	StatsInterval time.Duration // between stats events, to the second; 5s by default
+}
+
+// Watch streams route, config and stats changes to fn until ctx is done,
+// the gateway ends the stream, or fn returns an error, which Watch
+// returns. The stream opens with a snapshot of each topic watched.
+// Streams are not retried; watch again after ErrWatchClosed.
+func (c *Client) Watch(ctx context.Context, opts WatchOptions, fn func(WatchEvent) error) error {
+	query := url.Values{}
+	if len(opts.Topics) > 0 {
+		query.Set("topics", strings.Join(opts.Topics, ","))
+	}
+	if seconds := int(opts.StatsInterval / time.Second); seconds > 0 {
+		query.Set("interval", strconv.Itoa(seconds))
+	}
+	watchURL := c.baseURL + c.prefix + "/" + defaultAPIVersion + "/watch"
+	if len(query) > 0 {
+		watchURL += "?" + query.Encode()
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, watchURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// The stream outlives the client's request timeout
+	hc := *c.httpClient
+	hc.Timeout = 0
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("gateway: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return c.decode(resp, nil)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	var event WatchEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event.Type != "" {
+				if err := fn(event); err != nil {
+					return err
+				}
+			}
+			event = WatchEvent{}
+		case strings.HasPrefix(line, ":"):
+			// heartbeat
+		case strings.HasPrefix(line, "id: "):
+			event.ID, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "event: "):
+			event.Type = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.Data = json.RawMessage(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("gateway: reading watch stream: %w", err)
+	}
+	return ErrWatchClosed
+}
@@ -0,0 +1,373 @@
+// Package mockbackend is an upstream for exercising the gateway end to
+// end. It answers with configurable latency, error rates, dropped
+// connections and streamed responses, so retries, fallbacks, health checks
+// and timeouts can be tested against real network behaviour.
+//
+// Query parameters override the options per request, for example
+// /anything?latency=2s, /anything?status=503 or /stream?events=10&interval=500ms.
+// Tests start one like an httptest server:
+//
+//	backend := mockbackend.NewServer(mockbackend.Options{ErrorRate: 0.5})
+//	defer backend.Close()
+//	// send requests through a route to backend.URL
+package mockbackend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options shape every response unless a request overrides them
+type Options struct {
+	Latency     time.Duration // delay before responding
+	Jitter      time.Duration // random extra delay, up to this much
+	ErrorRate   float64       // fraction of requests answered with ErrorStatus
+	ErrorStatus int           // status of failed requests; defaults to 500
+	DropRate    float64       // fraction of connections closed without a response
+	Size        int           // pad response bodies to at least this many bytes
+}
+
+// Validate reports options New would reject
+func (o Options) Validate() error {
+	if o.Latency < 0 || o.Jitter < 0 || o.Size < 0 {
+		return errors.New("latency, jitter and size must not be negative")
+	}
+	if o.ErrorRate < 0 || o.ErrorRate > 1 || o.DropRate < 0 || o.DropRate > 1 {
+		return errors.New("error rate and drop rate must be between 0 and 1")
+	}
+	if o.ErrorStatus != 0 && (o.ErrorStatus < 100 || o.ErrorStatus > 599) {
+		return errors.New("error status must be an HTTP status")
+	}
+	return nil
+}
+
+// Stats counts the requests a backend was sent
+type Stats struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`  // answered with an injected failure
+	Dropped  int64 `json:"dropped"` // connection closed without a response
+}
+
+// Backend serves mock responses and counts what it was sent
+type Backend struct {
+	defaults Options
+	handler  http.Handler
+
+	requests int64
+	errors   int64
+	dropped  int64
+
+	mutex   sync.RWMutex
+	healthy bool
+}
+
+// New creates a healthy backend. It panics if opts are invalid; check
+// options from user input with Validate first.
+func New(opts Options) *Backend {
+	if err := opts.Validate(); err != nil {
+		panic("mockbackend: " + err.Error())
+	}
+	if opts.ErrorStatus == 0 {
+		opts.ErrorStatus = http.StatusInternalServerError
+	}
+	b := &Backend{defaults: opts, healthy: true}
+	b.handler = b.routes()
+	return b
+}
+
+// ServeHTTP answers a request with the mock endpoints
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.handler.ServeHTTP(w, r)
+}
+
+// SetHealthy sets what the health endpoint reports
+func (b *Backend) SetHealthy(healthy bool) {
+	b.mutex.Lock()
+	b.healthy = healthy
+	b.mutex.Unlock()
+}
+
+// Stats returns the request counters
+func (b *Backend) Stats() Stats {
+	return Stats{
+		Requests: atomic.LoadInt64(&b.requests),
+		Errors:   atomic.LoadInt64(&b.errors),
+		Dropped:  atomic.LoadInt64(&b.dropped),
+	}
+}
+
+// ResetStats zeroes the request counters
+func (b *Backend) ResetStats() {
+	atomic.StoreInt64(&b.requests, 0)
+	atomic.StoreInt64(&b.errors, 0)
+	atomic.StoreInt64(&b.dropped, 0)
+}
+
+// Server is a Backend listening on a local loopback address
+type Server struct {
+	*httptest.Server
+	Backend *Backend
+}
+
+// NewServer starts a backend on a loopback address, like
+// httptest.NewServer. The caller should call Close when finished.
+func NewServer(opts Options) *Server {
+	b := New(opts)
+	return &Server{Server: httptest.NewServer(b), Backend: b}
+}
+
+// routes registers the mock endpoints
+func (b *Backend) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", b.handleHealth)
+	mux.HandleFunc("/stream", b.counted(b.handleStream))
+	mux.HandleFunc("/_mock/health", b.handleSetHealth)
+	mux.HandleFunc("/_mock/stats", b.handleStats)
+	mux.HandleFunc("/", b.counted(b.handleRequest))
+	return mux
+}
+
+// counted applies latency, dropped connections and injected errors before
+// calling next
+func (b *Backend) counted(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&b.requests, 1)
+		s, err := b.settingsFor(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		delay := s.Latency
+		if s.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(s.Jitter)))
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if s.DropRate > 0 && rand.Float64() < s.DropRate {
+			atomic.AddInt64(&b.dropped, 1)
+			dropConnection(w)
+			return
+		}
+		if s.ErrorRate > 0 && rand.Float64() < s.ErrorRate {
+			atomic.AddInt64(&b.errors, 1)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(s.ErrorStatus)
+			fmt.Fprintf(w, "{\"error\":\"injected failure\",\"status\":%d}\n", s.ErrorStatus)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// settingsFor applies a request's query overrides to the defaults:
+// latency, jitter, fail (error rate), status, drop and size
+func (b *Backend) settingsFor(r *http.Request) (Options, error) {
+	s := b.defaults
+	q := r.URL.Query()
+
+	durations := map[string]*time.Duration{"latency": &s.Latency, "jitter": &s.Jitter}
+	for name, dst := range durations {
+		if v := q.Get(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return s, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = d
+		}
+	}
+
+	rates := map[string]*float64{"fail": &s.ErrorRate, "drop": &s.DropRate}
+	for name, dst := range rates {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				return s, fmt.Errorf("invalid %s %q: must be between 0 and 1", name, v)
+			}
+			*dst = f
+		}
+	}
+
+	// An explicit status fails every request with it
+	if v := q.Get("status"); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 100 || status > 599 {
+			return s, fmt.Errorf("invalid status %q", v)
+		}
+		s.ErrorStatus = status
+		if q.Get("fail") == "" {
+			s.ErrorRate = 1
+		}
+	}
+
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("invalid size %q", v)
+		}
+		s.Size = n
+	}
+	return s, nil
+}
+
+// handleRequest echoes the request as JSON
+func (b *Backend) handleRequest(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	resp := map[string]interface{}{
+		"method":  r.Method,
+		"path":    r.URL.Path,
+		"query":   r.URL.RawQuery,
+		"headers": r.Header,
+		"body":    string(body),
+	}
+	data, _ := json.Marshal(resp)
+	if s, _ := b.settingsFor(r); len(data) < s.Size {
+		resp["padding"] = strings.Repeat("x", s.Size-len(data))
+		data, _ = json.Marshal(resp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	w.Write([]byte("\n"))
+}
+
+// handleStream sends server-sent events: events (default 5) spaced by
+// interval (default 1s), optionally stalling for stall after the first
+// half to trigger idle timeouts
+func (b *Backend) handleStream(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	events := 5
+	if v := q.Get("events"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid events %q", v), http.StatusBadRequest)
+			return
+		}
+		events = n
+	}
+	interval, err := queryDuration(q.Get("interval"), time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stall, err := queryDuration(q.Get("stall"), 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	for i := 0; i < events; i++ {
+		if i > 0 {
+			pause := interval
+			if i == events/2 {
+				pause += stall
+			}
+			select {
+			case <-time.After(pause):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(w, "id: %d\ndata: {\"event\":%d,\"time\":%q}\n\n", i, i, time.Now().Format(time.RFC3339Nano))
+		rc.Flush()
+	}
+}
+
+// queryDuration parses an optional duration parameter
+func queryDuration(v string, def time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", v)
+	}
+	return d, nil
+}
+
+// handleHealth answers health checks according to the health toggle
+func (b *Backend) handleHealth(w http.ResponseWriter, r *http.Request) {
+	b.mutex.RLock()
+	healthy := b.healthy
+	b.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "{\"status\":\"unhealthy\"}\n")
+		return
+	}
+	io.WriteString(w, "{\"status\":\"healthy\"}\n")
+}
+
+// handleSetHealth flips the health endpoint: POST /_mock/health?status=down
+func (b *Backend) handleSetHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var healthy bool
+	switch r.URL.Query().Get("status") {
+	case "up", "":
+		healthy = true
+	case "down":
+	default:
+		http.Error(w, "status must be up or down", http.StatusBadRequest)
+		return
+	}
+
+	b.SetHealthy(healthy)
+	log.Printf("Health set to %v", healthy)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStats reports request counters; DELETE resets them
+func (b *Backend) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		b.ResetStats()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.Stats())
+}
+
+// dropConnection closes the client connection without a response
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	conn.Close()
+}
@@ -0,0 +1,160 @@
+package mockbackend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve sends a request straight to b
+func serve(b *Backend, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader("hello")))
+	return w
+}
+
+func TestEcho(t *testing.T) {
+	b := New(Options{})
+	w := serve(b, "POST", "/orders/7?x=1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	var echo struct {
+		Method, Path, Query, Body string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Method != "POST" || echo.Path != "/orders/7" || echo.Query != "x=1" || echo.Body != "hello" {
+		t.Fatalf("echo = %+v", echo)
+	}
+
+	if w := serve(b, "GET", "/?size=4096"); w.Body.Len() < 4096 {
+		t.Fatalf("padded body is %d bytes, want at least 4096", w.Body.Len())
+	}
+}
+
+func TestInjectedFailures(t *testing.T) {
+	b := New(Options{})
+	if w := serve(b, "GET", "/?status=503"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status override: %d, want 503", w.Code)
+	}
+	if w := serve(b, "GET", "/?status=503&fail=0"); w.Code != http.StatusOK {
+		t.Fatalf("status with fail=0: %d, want 200", w.Code)
+	}
+	if w := serve(New(Options{ErrorRate: 1, ErrorStatus: 502}), "GET", "/"); w.Code != http.StatusBadGateway {
+		t.Fatalf("error rate 1: %d, want 502", w.Code)
+	}
+	for _, query := range []string{"latency=soon", "fail=2", "status=42", "size=-1"} {
+		if w := serve(b, "GET", "/?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+
+	if got := b.Stats(); got.Requests != 6 || got.Errors != 1 {
+		t.Fatalf("stats = %+v, want 6 requests and 1 error", got)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	b := New(Options{})
+	start := time.Now()
+	serve(b, "GET", "/?latency=50ms")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("answered after %v, want at least 50ms", elapsed)
+	}
+}
+
+func TestDroppedConnection(t *testing.T) {
+	s := NewServer(Options{DropRate: 1})
+	defer s.Close()
+
+	// The server logs the hijacked connection's failure to the client
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	if resp, err := http.Get(s.URL + "/"); err == nil {
+		resp.Body.Close()
+		t.Fatalf("got status %d from a dropped connection", resp.StatusCode)
+	}
+	if got := s.Backend.Stats().Dropped; got != 1 {
+		t.Fatalf("%d dropped, want 1", got)
+	}
+}
+
+func TestStream(t *testing.T) {
+	w := serve(New(Options{}), "GET", "/stream?events=3&interval=1ms")
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	if n := strings.Count(w.Body.String(), "data: "); n != 3 {
+		t.Fatalf("%d events, want 3:\n%s", n, w.Body.String())
+	}
+	if w := serve(New(Options{}), "GET", "/stream?events=x"); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid events: status %d, want 400", w.Code)
+	}
+}
+
+func TestHealthToggle(t *testing.T) {
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	b := New(Options{})
+	if w := serve(b, "GET", "/health"); w.Code != http.StatusOK {
+		t.Fatalf("health: %d, want 200", w.Code)
+	}
+	if w := serve(b, "POST", "/_mock/health?status=down"); w.Code != http.StatusNoContent {
+		t.Fatalf("set health: %d, want 204", w.Code)
+	}
+	if w := serve(b, "GET", "/health"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("health when down: %d, want 503", w.Code)
+	}
+	if w := serve(b, "GET", "/_mock/health?status=down"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET to set health: %d, want 405", w.Code)
+	}
+	if w := serve(b, "POST", "/_mock/health?status=sideways"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown health: %d, want 400", w.Code)
+	}
+	if got := b.Stats().Requests; got != 0 {
+		t.Fatalf("health and control requests counted: %d", got)
+	}
+}
+
+func TestStatsEndpoint(t *testing.T) {
+	b := New(Options{})
+	serve(b, "GET", "/")
+	serve(b, "GET", "/")
+
+	var stats Stats
+	json.Unmarshal(serve(b, "GET", "/_mock/stats").Body.Bytes(), &stats)
+	if stats.Requests != 2 {
+		t.Fatalf("stats = %+v, want 2 requests", stats)
+	}
+	if w := serve(b, "DELETE", "/_mock/stats"); w.Code != http.StatusNoContent {
+		t.Fatalf("reset: %d, want 204", w.Code)
+	}
+	if got := b.Stats(); got != (Stats{}) {
+		t.Fatalf("stats after reset = %+v", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, opts := range []Options{
+		{Latency: -time.Second},
+		{ErrorRate: 1.5},
+		{DropRate: -0.1},
+		{ErrorStatus: 42},
+	} {
+		if opts.Validate() == nil {
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+	if err := (Options{ErrorRate: 0.5, ErrorStatus: 503}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
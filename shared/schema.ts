@@ -121,12 +121,33 @@ export type TrafficData = {
   latency: number;
 };
 
+// Latency histogram as reported by the gateway: counts per bucket, the
+// last counting requests over the highest bound (in milliseconds)
+export type LatencyHistogram = {
+  bounds: number[];
+  counts: number[];
+  count: number;
+  sum: number;
+};
+
+// Gap-filled metric series from the gateway's timeseries endpoint; value
+// is null for p95 in steps without requests
+export type Timeseries = {
+  metric: "rps" | "errors" | "p95";
+  route?: string;
+  step: number;
+  since: string;
+  until: string;
+  points: { time: string; value: number | null }[];
+};
+
 export type DashboardStats = {
   totalRequests: number;
   requestsPerSecond: number;
   avgResponseTime: number;
   errorRate: string;
   activeConnections: number;
+  latency?: LatencyHistogram;
   change?: {
     totalRequests: string;
     requestsPerSecond: string;